@@ -0,0 +1,75 @@
+// Package android attaches the virtual key to an Android emulator, so passkey flows can be
+// tested in an AVD against the vault. The emulator runs on QEMU, so it's given a USB
+// controller and a usb-redir device connected to the usbredir server through its -qemu
+// arguments, which needs no root or USB/IP on the host. On Linux, a key attached with
+// USB/IP can be passed through with usb-host instead.
+package android
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/bulwarkid/virtual-fido/qemu"
+)
+
+// The emulator's machine has no USB controller of its own
+const controllerOptions = "qemu-xhci,id=virtual-fido-xhci"
+
+// USBRedirArgs are emulator arguments connecting the guest to the usbredir server at
+// address, retrying until it's listening. They must come last, as everything after -qemu is
+// passed to QEMU.
+func USBRedirArgs(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid usbredir address %q: %w", address, err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return []string{
+		"-qemu",
+		"-device", controllerOptions,
+		"-chardev", fmt.Sprintf("socket,id=virtual-fido,host=%s,port=%s,reconnect=1", host, port),
+		"-device", "usb-redir,chardev=virtual-fido,bus=virtual-fido-xhci.0",
+	}, nil
+}
+
+// HostDeviceArgs are emulator arguments passing the key attached to this machine through
+// to the guest. They must come last, like USBRedirArgs.
+func HostDeviceArgs(device *qemu.HostDevice) []string {
+	return append([]string{"-qemu", "-device", controllerOptions}, device.Args(qemu.DefaultDeviceID)...)
+}
+
+// FindEmulator looks for the emulator binary of the Android SDK, in $ANDROID_HOME or
+// $ANDROID_SDK_ROOT, then on the PATH
+func FindEmulator() (string, error) {
+	name := "emulator"
+	if runtime.GOOS == "windows" {
+		name = "emulator.exe"
+	}
+	for _, variable := range []string{"ANDROID_HOME", "ANDROID_SDK_ROOT"} {
+		root := os.Getenv(variable)
+		if root == "" {
+			continue
+		}
+		path := filepath.Join(root, "emulator", name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("Could not find the Android emulator, set ANDROID_HOME to the SDK: %w", err)
+	}
+	return path, nil
+}
+
+// Command starts the emulator at path with the AVD named avd, followed by attachArgs from
+// USBRedirArgs or HostDeviceArgs
+func Command(path string, avd string, attachArgs []string) *exec.Cmd {
+	return exec.Command(path, append([]string{"-avd", avd}, attachArgs...)...)
+}
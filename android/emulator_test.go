@@ -0,0 +1,52 @@
+package android
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/qemu"
+)
+
+func TestUSBRedirArgs(t *testing.T) {
+	args, err := USBRedirArgs(":4000")
+	test.Assert(t, err == nil, "Address should be valid")
+	test.AssertArrEqual(t, args, []string{
+		"-qemu",
+		"-device", "qemu-xhci,id=virtual-fido-xhci",
+		"-chardev", "socket,id=virtual-fido,host=localhost,port=4000,reconnect=1",
+		"-device", "usb-redir,chardev=virtual-fido,bus=virtual-fido-xhci.0",
+	}, "Guest should connect to the usbredir server")
+	_, err = USBRedirArgs("localhost")
+	test.Assert(t, err != nil, "Address needs a port")
+}
+
+func TestHostDeviceArgs(t *testing.T) {
+	args := HostDeviceArgs(&qemu.HostDevice{Bus: 3, Address: 4})
+	test.AssertArrEqual(t, args, []string{
+		"-qemu",
+		"-device", "qemu-xhci,id=virtual-fido-xhci",
+		"-device", "usb-host,hostbus=3,hostaddr=4,id=virtual-fido",
+	}, "Guest should get the host device")
+
+	cmd := Command("/sdk/emulator/emulator", "Pixel_7", args[:1])
+	test.AssertArrEqual(t, cmd.Args, []string{"/sdk/emulator/emulator", "-avd", "Pixel_7", "-qemu"}, "AVD should come before the QEMU arguments")
+}
+
+func TestFindEmulator(t *testing.T) {
+	name := "emulator"
+	if runtime.GOOS == "windows" {
+		name = "emulator.exe"
+	}
+	root := t.TempDir()
+	path := filepath.Join(root, "emulator", name)
+	test.Assert(t, os.MkdirAll(filepath.Dir(path), 0755) == nil, "Could not create SDK")
+	test.Assert(t, os.WriteFile(path, nil, 0755) == nil, "Could not create emulator")
+	t.Setenv("ANDROID_HOME", "")
+	t.Setenv("ANDROID_SDK_ROOT", root)
+	found, err := FindEmulator()
+	test.Assert(t, err == nil, "Emulator should be found in the SDK")
+	test.AssertEqual(t, found, path, "Wrong emulator")
+}
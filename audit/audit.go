@@ -0,0 +1,90 @@
+// Package audit records every assertion attempt, for deployments like honeypots where who
+// tried to use which credential matters as much as whether it worked
+package audit
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess       Outcome = "success"
+	OutcomeNoCredentials Outcome = "no_credentials"
+	// The user or a policy refused, or the PIN was wrong
+	OutcomeDenied Outcome = "denied"
+	OutcomeError  Outcome = "error"
+)
+
+// Attempt is one CTAP2 GetAssertion or U2F authenticate request and how it ended
+type Attempt struct {
+	Time time.Time `json:"time"`
+	// events.ProtocolCTAP2 or events.ProtocolU2F
+	Protocol       string `json:"protocol"`
+	RelyingPartyID string `json:"relying_party_id,omitempty"`
+	// U2F only has the hash of the application ID
+	Application    []byte `json:"application,omitempty"`
+	ClientDataHash []byte `json:"client_data_hash,omitempty"`
+	// Transport the request arrived on. Authenticators never see the web origin, which is
+	// only in the hashed client data.
+	Origin string `json:"origin"`
+	// Credentials the RP asked for, empty for discoverable credentials
+	AllowList [][]byte `json:"allow_list,omitempty"`
+	// Credential that signed the assertion, if any
+	CredentialID []byte  `json:"credential_id,omitempty"`
+	Outcome      Outcome `json:"outcome"`
+	// CTAP2 status code or U2F status word
+	Status uint16 `json:"status"`
+	// Whether the attempt named or used a canary credential
+	Canary bool `json:"canary,omitempty"`
+}
+
+// Auditor is called by the CTAP2 and U2F servers after each assertion attempt. It's called
+// before the response is sent, so it should not block for long.
+type Auditor interface {
+	Audit(attempt Attempt)
+}
+
+// CanaryAuditor flags attempts on canary credentials, which exist only to be found by
+// someone who shouldn't have them, and calls alert for them before passing every attempt on
+type CanaryAuditor struct {
+	next  Auditor
+	alert func(Attempt)
+
+	lock     sync.Mutex
+	canaries map[string]bool
+}
+
+// NewCanaryAuditor passes attempts on to next, which may be nil. alert runs in its own
+// goroutine, so a slow callback doesn't hold up the request.
+func NewCanaryAuditor(next Auditor, alert func(Attempt)) *CanaryAuditor {
+	return &CanaryAuditor{next: next, alert: alert, canaries: make(map[string]bool)}
+}
+
+func (auditor *CanaryAuditor) AddCanary(credentialID []byte) {
+	auditor.lock.Lock()
+	defer auditor.lock.Unlock()
+	auditor.canaries[hex.EncodeToString(credentialID)] = true
+}
+
+func (auditor *CanaryAuditor) isCanary(credentialID []byte) bool {
+	auditor.lock.Lock()
+	defer auditor.lock.Unlock()
+	return auditor.canaries[hex.EncodeToString(credentialID)]
+}
+
+func (auditor *CanaryAuditor) Audit(attempt Attempt) {
+	// Asking for a canary is as suspicious as using it
+	attempt.Canary = attempt.CredentialID != nil && auditor.isCanary(attempt.CredentialID)
+	for _, id := range attempt.AllowList {
+		attempt.Canary = attempt.Canary || auditor.isCanary(id)
+	}
+	if attempt.Canary && auditor.alert != nil {
+		go auditor.alert(attempt)
+	}
+	if auditor.next != nil {
+		auditor.next.Audit(attempt)
+	}
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+type recordingAuditor struct {
+	attempts []Attempt
+}
+
+func (auditor *recordingAuditor) Audit(attempt Attempt) {
+	auditor.attempts = append(auditor.attempts, attempt)
+}
+
+func TestLog(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	test.Assert(t, err == nil, "Could not create key")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := OpenLog(path, key)
+	test.Assert(t, err == nil, "Could not open log")
+	log.Audit(Attempt{RelyingPartyID: "first.example", Outcome: OutcomeSuccess})
+	log.Close()
+	// Reopening continues the chain
+	log, err = OpenLog(path, key)
+	test.Assert(t, err == nil, "Could not reopen log")
+	log.Audit(Attempt{RelyingPartyID: "second.example", Outcome: OutcomeDenied})
+	log.Close()
+
+	data, err := os.ReadFile(path)
+	test.Assert(t, err == nil, "Could not read log")
+	attempts, err := VerifyLog(bytes.NewReader(data), publicKey)
+	test.Assert(t, err == nil, "Log should verify")
+	test.AssertEqual(t, len(attempts), 2, "Log should have both attempts")
+	test.AssertEqual(t, attempts[1].RelyingPartyID, "second.example", "Attempts should be in order")
+
+	tampered := bytes.Replace(data, []byte("denied"), []byte("success"), 1)
+	_, err = VerifyLog(bytes.NewReader(tampered), publicKey)
+	test.Assert(t, err != nil, "Changed entry should not verify")
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	_, err = VerifyLog(bytes.NewReader(lines[1]), publicKey)
+	test.Assert(t, err != nil, "Log with a removed entry should not verify")
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = VerifyLog(bytes.NewReader(data), otherKey)
+	test.Assert(t, err != nil, "Log should not verify with another key")
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit-key.pem")
+	key, err := LoadOrCreateKey(path)
+	test.Assert(t, err == nil, "Could not create key")
+	loaded, err := LoadOrCreateKey(path)
+	test.Assert(t, err == nil, "Could not load key")
+	test.Assert(t, key.Equal(loaded), "Saved key should be loaded")
+}
+
+func TestCanaryAuditor(t *testing.T) {
+	next := &recordingAuditor{}
+	alerts := make(chan Attempt, 2)
+	auditor := NewCanaryAuditor(next, func(attempt Attempt) { alerts <- attempt })
+	auditor.AddCanary([]byte("canary"))
+
+	auditor.Audit(Attempt{AllowList: [][]byte{[]byte("real")}, CredentialID: []byte("real")})
+	auditor.Audit(Attempt{AllowList: [][]byte{[]byte("real"), []byte("canary")}, Outcome: OutcomeNoCredentials})
+	test.AssertEqual(t, len(next.attempts), 2, "Every attempt should be passed on")
+	test.Assert(t, !next.attempts[0].Canary, "Normal attempt should not be flagged")
+	test.Assert(t, next.attempts[1].Canary, "Asking for a canary should be flagged")
+	select {
+	case alert := <-alerts:
+		test.AssertEqual(t, alert.Outcome, OutcomeNoCredentials, "Alert should be for the canary attempt")
+	case <-time.After(time.Second):
+		t.Fatal("Canary should alert")
+	}
+	select {
+	case <-alerts:
+		t.Fatal("Only canary attempts should alert")
+	default:
+	}
+}
+
+func TestExport(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	test.Assert(t, err == nil, "Could not create key")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := OpenLog(path, key)
+	test.Assert(t, err == nil, "Could not open log")
+	log.Audit(Attempt{RelyingPartyID: "first.example", Outcome: OutcomeSuccess})
+	log.Audit(Attempt{RelyingPartyID: "second.example", Outcome: OutcomeDenied})
+	log.Audit(Attempt{RelyingPartyID: "third.example", Outcome: OutcomeSuccess})
+	readExport := func() *Export {
+		file, err := os.Open(path)
+		test.Assert(t, err == nil, "Could not open log")
+		defer file.Close()
+		export, err := ExportLog(file, key)
+		test.Assert(t, err == nil, "Could not export log")
+		return export
+	}
+	first := readExport()
+	attempts, err := VerifyExport(first, publicKey, nil)
+	test.Assert(t, err == nil, "Export should verify")
+	test.AssertEqual(t, len(attempts), 3, "Export should have every attempt")
+
+	log.Audit(Attempt{RelyingPartyID: "fourth.example", Outcome: OutcomeSuccess})
+	log.Close()
+	second := readExport()
+	_, err = VerifyExport(second, publicKey, &first.Checkpoint)
+	test.Assert(t, err == nil, "Later export should extend the earlier checkpoint")
+	_, err = VerifyExport(first, publicKey, &second.Checkpoint)
+	test.Assert(t, err != nil, "Shorter export should not extend a later checkpoint")
+
+	rewritten := *second
+	rewritten.Entries = rewritten.Entries[1:]
+	_, err = VerifyExport(&rewritten, publicKey, nil)
+	test.Assert(t, err != nil, "Export with a removed entry should not verify")
+	rewritten = *second
+	rewritten.Checkpoint.Size = 3
+	_, err = VerifyExport(&rewritten, publicKey, nil)
+	test.Assert(t, err != nil, "Changed checkpoint should not verify")
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = VerifyExport(second, otherKey, nil)
+	test.Assert(t, err != nil, "Export should not verify with another key")
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	leaf := func(data []byte) []byte {
+		hash := sha256.Sum256(append([]byte{0}, data...))
+		return hash[:]
+	}
+	node := func(left, right []byte) []byte {
+		hash := sha256.Sum256(append(append([]byte{1}, left...), right...))
+		return hash[:]
+	}
+	expected := node(node(leaf(leaves[0]), leaf(leaves[1])), leaf(leaves[2]))
+	test.AssertArrEqual(t, merkleRoot(leaves), expected, "Root should match RFC 6962")
+}
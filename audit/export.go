@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Checkpoint commits to the first Size entries of a log with the root of a Merkle tree over
+// them, hashed as in RFC 6962. A later export can be checked against a saved checkpoint to
+// show it only added entries, so a log can't be rewritten or cut short after an export.
+type Checkpoint struct {
+	Size uint64 `json:"size"`
+	Root []byte `json:"root"`
+	// Hash of the last entry, which the next entry in the log points to
+	Head      []byte    `json:"head,omitempty"`
+	Time      time.Time `json:"time"`
+	Signature []byte    `json:"sig,omitempty"`
+}
+
+func (checkpoint Checkpoint) signedData() ([]byte, error) {
+	checkpoint.Signature = nil
+	return json.Marshal(checkpoint)
+}
+
+// Export is a copy of a log that can be kept and verified away from the authenticator
+type Export struct {
+	PublicKey  ed25519.PublicKey `json:"public_key"`
+	Entries    []json.RawMessage `json:"entries"`
+	Checkpoint Checkpoint        `json:"checkpoint"`
+}
+
+// ExportLog verifies the log read from reader and signs a checkpoint over all its entries
+func ExportLog(reader io.Reader, key ed25519.PrivateKey) (*Export, error) {
+	var lines [][]byte
+	err := readEntries(reader, func(line []byte, entry logEntry) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	publicKey := key.Public().(ed25519.PublicKey)
+	if _, err := VerifyLog(bytes.NewReader(joinLines(lines)), publicKey); err != nil {
+		return nil, err
+	}
+	export := &Export{PublicKey: publicKey, Entries: make([]json.RawMessage, len(lines))}
+	for i, line := range lines {
+		export.Entries[i] = line
+	}
+	export.Checkpoint = Checkpoint{Size: uint64(len(lines)), Root: merkleRoot(lines), Time: time.Now()}
+	if len(lines) > 0 {
+		export.Checkpoint.Head = hashLine(lines[len(lines)-1])
+	}
+	data, err := export.Checkpoint.signedData()
+	if err != nil {
+		return nil, err
+	}
+	export.Checkpoint.Signature = ed25519.Sign(key, data)
+	return export, nil
+}
+
+// VerifyExport checks the entries and checkpoint of export against publicKey, returning the
+// attempts in it. If previous is not nil, export must also contain every entry previous
+// committed to.
+func VerifyExport(export *Export, publicKey ed25519.PublicKey, previous *Checkpoint) ([]Attempt, error) {
+	lines := make([][]byte, len(export.Entries))
+	for i, entry := range export.Entries {
+		lines[i] = entry
+	}
+	attempts, err := VerifyLog(bytes.NewReader(joinLines(lines)), publicKey)
+	if err != nil {
+		return attempts, err
+	}
+	if err := verifyCheckpoint(export.Checkpoint, lines, publicKey); err != nil {
+		return attempts, err
+	}
+	if previous != nil {
+		if previous.Size > uint64(len(lines)) {
+			return attempts, fmt.Errorf("Export has %d entries, fewer than the %d in the previous checkpoint", len(lines), previous.Size)
+		}
+		if err := verifyCheckpoint(*previous, lines[:previous.Size], publicKey); err != nil {
+			return attempts, fmt.Errorf("Export does not extend the previous checkpoint: %w", err)
+		}
+	}
+	return attempts, nil
+}
+
+func verifyCheckpoint(checkpoint Checkpoint, lines [][]byte, publicKey ed25519.PublicKey) error {
+	data, err := checkpoint.signedData()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, data, checkpoint.Signature) {
+		return fmt.Errorf("Invalid signature on checkpoint")
+	}
+	if checkpoint.Size != uint64(len(lines)) {
+		return fmt.Errorf("Checkpoint is for %d entries, not %d", checkpoint.Size, len(lines))
+	}
+	if !bytes.Equal(checkpoint.Root, merkleRoot(lines)) {
+		return fmt.Errorf("Checkpoint root does not match the entries")
+	}
+	return nil
+}
+
+func joinLines(lines [][]byte) []byte {
+	var data []byte
+	for _, line := range lines {
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	return data
+}
+
+// merkleRoot hashes lines as the leaves of an RFC 6962 Merkle tree
+func merkleRoot(lines [][]byte) []byte {
+	switch len(lines) {
+	case 0:
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	case 1:
+		hash := sha256.Sum256(append([]byte{0}, lines[0]...))
+		return hash[:]
+	}
+	split := 1
+	for split*2 < len(lines) {
+		split *= 2
+	}
+	node := append([]byte{1}, merkleRoot(lines[:split])...)
+	node = append(node, merkleRoot(lines[split:])...)
+	hash := sha256.Sum256(node)
+	return hash[:]
+}
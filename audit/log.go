@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var auditLogger = util.NewLogger("[AUDIT] ", util.LogSubsystemAudit, util.LogLevelEnabled)
+
+// logEntry is one line of the log. Each entry includes the hash of the line before it and is
+// signed, so entries can't be changed, removed or reordered without breaking the chain.
+type logEntry struct {
+	Sequence  uint64  `json:"seq"`
+	Previous  []byte  `json:"prev"`
+	Attempt   Attempt `json:"attempt"`
+	Signature []byte  `json:"sig,omitempty"`
+}
+
+func (entry logEntry) signedData() ([]byte, error) {
+	entry.Signature = nil
+	return json.Marshal(entry)
+}
+
+// Log is an Auditor that appends attempts to a file as signed JSON lines
+type Log struct {
+	lock     sync.Mutex
+	file     *os.File
+	key      ed25519.PrivateKey
+	sequence uint64
+	previous []byte
+}
+
+// OpenLog appends to the log at path, creating it if it doesn't exist
+func OpenLog(path string, key ed25519.PrivateKey) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open audit log: %w", err)
+	}
+	log := &Log{file: file, key: key}
+	err = readEntries(file, func(line []byte, entry logEntry) error {
+		log.sequence = entry.Sequence + 1
+		log.previous = hashLine(line)
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+func (log *Log) Close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return log.file.Close()
+}
+
+func (log *Log) Audit(attempt Attempt) {
+	if err := log.Append(attempt); err != nil {
+		auditLogger.Printf("ERROR: Could not write audit log: %s\n\n", err)
+	}
+}
+
+// Append writes attempt to the log and syncs it to disk
+func (log *Log) Append(attempt Attempt) error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	entry := logEntry{Sequence: log.sequence, Previous: log.previous, Attempt: attempt}
+	data, err := entry.signedData()
+	if err != nil {
+		return err
+	}
+	entry.Signature = ed25519.Sign(log.key, data)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := log.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := log.file.Sync(); err != nil {
+		return err
+	}
+	log.sequence++
+	log.previous = hashLine(line)
+	return nil
+}
+
+func hashLine(line []byte) []byte {
+	hash := sha256.Sum256(line)
+	return hash[:]
+}
+
+func readEntries(reader io.Reader, handle func(line []byte, entry logEntry) error) error {
+	buffered := bufio.NewReader(reader)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return fmt.Errorf("Could not read audit log: %w", err)
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("Invalid audit log entry on line %d: %w", lineNumber, err)
+		}
+		if err := handle(line, entry); err != nil {
+			return fmt.Errorf("Audit log line %d: %w", lineNumber, err)
+		}
+	}
+}
+
+// VerifyLog checks that every entry was signed by publicKey and that none are missing or out
+// of order, returning the attempts in the log
+func VerifyLog(reader io.Reader, publicKey ed25519.PublicKey) ([]Attempt, error) {
+	var attempts []Attempt
+	var previous []byte
+	err := readEntries(reader, func(line []byte, entry logEntry) error {
+		if entry.Sequence != uint64(len(attempts)) {
+			return fmt.Errorf("Expected entry %d, got %d", len(attempts), entry.Sequence)
+		}
+		if !bytes.Equal(entry.Previous, previous) {
+			return fmt.Errorf("Entry %d does not follow the entry before it", entry.Sequence)
+		}
+		data, err := entry.signedData()
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(publicKey, data, entry.Signature) {
+			return fmt.Errorf("Invalid signature on entry %d", entry.Sequence)
+		}
+		attempts = append(attempts, entry.Attempt)
+		previous = hashLine(line)
+		return nil
+	})
+	return attempts, err
+}
+
+// LoadOrCreateKey reads an Ed25519 signing key saved as PEM at path, creating and saving a
+// new one if the file doesn't exist so the log stays verifiable with the same public key
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	key, err := LoadKey(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600)
+}
+
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read audit key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("Audit key file must contain a PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode audit key: %w", err)
+	}
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Audit key must be an Ed25519 key")
+	}
+	return ed25519Key, nil
+}
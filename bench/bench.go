@@ -0,0 +1,224 @@
+// Package bench load-tests the authenticator in process. Requests go through the same
+// CTAPHID, CTAP2 and client layers as requests from USB/IP, without a USB connection.
+package bench
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	benchRelyingPartyID       = "bench.example"
+	ctapCommandMakeCredential = byte(0x01)
+	ctapCommandGetAssertion   = byte(0x02)
+)
+
+// Config is the workload of a load test
+type Config struct {
+	Registrations int
+	// Assertions are spread over the registered credentials
+	Assertions   int
+	ResidentKeys bool
+	// How long the simulated user takes to touch the authenticator
+	TouchLatency time.Duration
+	TouchJitter  time.Duration
+}
+
+// Stats summarizes the latency of one kind of operation
+type Stats struct {
+	Operations   int
+	Total        time.Duration
+	OpsPerSecond float64
+	P50          time.Duration
+	P99          time.Duration
+}
+
+func (stats Stats) String() string {
+	return fmt.Sprintf("%d ops in %s (%.1f ops/sec, p50 %s, p99 %s)",
+		stats.Operations, stats.Total.Round(time.Millisecond), stats.OpsPerSecond, stats.P50, stats.P99)
+}
+
+type Result struct {
+	Registrations Stats
+	Assertions    Stats
+}
+
+func newStats(latencies []time.Duration, total time.Duration) Stats {
+	stats := Stats{Operations: len(latencies), Total: total}
+	if len(latencies) == 0 {
+		return stats
+	}
+	if total > 0 {
+		stats.OpsPerSecond = float64(len(latencies)) / total.Seconds()
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.P50 = percentile(sorted, 50)
+	stats.P99 = percentile(sorted, 99)
+	return stats
+}
+
+// percentile uses the nearest-rank method on sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+type memoryDataSaver struct {
+	data []byte
+}
+
+func (saver *memoryDataSaver) SaveData(data []byte) {
+	saver.data = data
+}
+
+func (saver *memoryDataSaver) RetrieveData() []byte {
+	return saver.data
+}
+
+func (saver *memoryDataSaver) Passphrase() string {
+	return "bench"
+}
+
+// Stack is an authenticator with a host connected over in-process CTAPHID
+type Stack struct {
+	host *hidHost
+}
+
+func NewStack(config Config) (*Stack, error) {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey := sha256.Sum256(crypto.RandomBytes(32))
+	presence := fido_client.NewSimulatedPresence(config.TouchLatency, config.TouchJitter)
+	client := fido_client.NewDefaultClient(certificateAuthority, caPrivateKey, encryptionKey, false, presence, &memoryDataSaver{})
+	// The vault is saved after every registration, and the default KDF cost would be
+	// all that gets measured
+	if err := client.SetKDFParameters(identities.Argon2idParameters{Time: 1, Memory: 64, Threads: 1}); err != nil {
+		return nil, err
+	}
+	server := ctap_hid.NewCTAPHIDServer(ctap.NewCTAPServer(client), u2f.NewU2FServer(client))
+	host, err := newHIDHost(server)
+	if err != nil {
+		return nil, err
+	}
+	return &Stack{host: host}, nil
+}
+
+// Register creates a credential for userID and returns its ID
+func (stack *Stack) Register(userID []byte, residentKey bool) ([]byte, error) {
+	args := map[int]interface{}{
+		1: crypto.HashSHA256(userID),
+		2: map[string]string{"id": benchRelyingPartyID, "name": "Bench"},
+		3: map[string]interface{}{"id": userID, "name": "user", "displayName": "User"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+	}
+	if residentKey {
+		args[7] = map[string]bool{"rk": true}
+	}
+	response, err := stack.request(ctapCommandMakeCredential, args)
+	if err != nil {
+		return nil, err
+	}
+	var attestation struct {
+		AuthData []byte `cbor:"2,keyasint"`
+	}
+	if err := cbor.Unmarshal(response, &attestation); err != nil {
+		return nil, err
+	}
+	// RP ID hash, flags, counter and AAGUID come before the credential ID
+	authData := attestation.AuthData
+	if len(authData) < 55 {
+		return nil, fmt.Errorf("Authenticator data is too short: %d bytes", len(authData))
+	}
+	length := int(binary.BigEndian.Uint16(authData[53:55]))
+	if len(authData) < 55+length {
+		return nil, fmt.Errorf("Credential ID of %d bytes does not fit in authenticator data", length)
+	}
+	return authData[55 : 55+length], nil
+}
+
+// Authenticate gets an assertion for the credential credentialID
+func (stack *Stack) Authenticate(credentialID []byte) error {
+	args := map[int]interface{}{
+		1: benchRelyingPartyID,
+		2: crypto.HashSHA256(credentialID),
+		3: []map[string]interface{}{{"type": "public-key", "id": credentialID}},
+	}
+	_, err := stack.request(ctapCommandGetAssertion, args)
+	return err
+}
+
+func (stack *Stack) request(command byte, args interface{}) ([]byte, error) {
+	response, err := stack.host.transact(hidCommandCBOR, util.Concat([]byte{command}, util.MarshalCBOR(args)))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 0 {
+		return nil, fmt.Errorf("Empty CTAP response")
+	}
+	if response[0] != 0 {
+		return nil, fmt.Errorf("CTAP error 0x%x", response[0])
+	}
+	return response[1:], nil
+}
+
+// Run registers config.Registrations credentials, then gets config.Assertions assertions.
+// Operations run one at a time, like a platform talking to a single authenticator.
+func Run(config Config) (Result, error) {
+	result := Result{}
+	if config.Registrations < 1 {
+		return result, fmt.Errorf("At least one registration is needed")
+	}
+	stack, err := NewStack(config)
+	if err != nil {
+		return result, err
+	}
+
+	credentialIDs := make([][]byte, 0, config.Registrations)
+	latencies := make([]time.Duration, 0, config.Registrations)
+	start := time.Now()
+	for i := 0; i < config.Registrations; i++ {
+		operationStart := time.Now()
+		id, err := stack.Register(util.ToBE(uint32(i)), config.ResidentKeys)
+		if err != nil {
+			return result, fmt.Errorf("Registration %d failed: %w", i, err)
+		}
+		latencies = append(latencies, time.Since(operationStart))
+		credentialIDs = append(credentialIDs, id)
+	}
+	result.Registrations = newStats(latencies, time.Since(start))
+
+	latencies = make([]time.Duration, 0, config.Assertions)
+	start = time.Now()
+	for i := 0; i < config.Assertions; i++ {
+		operationStart := time.Now()
+		if err := stack.Authenticate(credentialIDs[i%len(credentialIDs)]); err != nil {
+			return result, fmt.Errorf("Assertion %d failed: %w", i, err)
+		}
+		latencies = append(latencies, time.Since(operationStart))
+	}
+	result.Assertions = newStats(latencies, time.Since(start))
+	return result, nil
+}
@@ -0,0 +1,76 @@
+package bench
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+func TestRun(t *testing.T) {
+	for _, residentKeys := range []bool{false, true} {
+		result, err := Run(Config{Registrations: 3, Assertions: 5, ResidentKeys: residentKeys})
+		test.Assert(t, err == nil, "Load test failed")
+		test.AssertEqual(t, result.Registrations.Operations, 3, "Wrong number of registrations")
+		test.AssertEqual(t, result.Assertions.Operations, 5, "Wrong number of assertions")
+		test.Assert(t, result.Assertions.OpsPerSecond > 0, "Assertion rate should be measured")
+		test.Assert(t, result.Assertions.P50 <= result.Assertions.P99, "p50 should not exceed p99")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(100-i) * time.Millisecond
+	}
+	stats := newStats(latencies, time.Second)
+	test.AssertEqual(t, stats.P50, 50*time.Millisecond, "Wrong p50")
+	test.AssertEqual(t, stats.P99, 99*time.Millisecond, "Wrong p99")
+	test.AssertEqual(t, stats.OpsPerSecond, 100.0, "Wrong rate")
+}
+
+func TestReassembleSkipsKeepalives(t *testing.T) {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	packets := util.Concat(
+		framePackets(1, hidCommandKeepalive, []byte{2}),
+		framePackets(2, hidCommandCBOR, []byte{1}),
+		framePackets(1, hidCommandCBOR, payload),
+	)
+	response, err := reassemble(packets, 1, hidCommandCBOR)
+	test.Assert(t, err == nil, "Could not reassemble response")
+	test.AssertArrEqual(t, response, payload, "Reassembled response is incorrect")
+}
+
+func BenchmarkRegistration(b *testing.B) {
+	stack, err := NewStack(Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stack.Register(util.ToBE(uint32(i)), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAssertion(b *testing.B) {
+	stack, err := NewStack(Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	id, err := stack.Register([]byte{1}, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := stack.Authenticate(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
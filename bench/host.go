@@ -0,0 +1,112 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+)
+
+const (
+	hidPacketSize             = 64
+	hidInitHeaderSize         = 7
+	hidContinuationHeaderSize = 5
+	hidBroadcastChannel       = uint32(0xFFFFFFFF)
+	hidCommandInit            = byte(0x86)
+	hidCommandCBOR            = byte(0x90)
+	hidCommandKeepalive       = byte(0xBB)
+	hidCommandError           = byte(0xBF)
+)
+
+// hidHost plays the part of the platform, framing messages into HID reports for the
+// CTAPHID server and reassembling its responses
+type hidHost struct {
+	server    *ctap_hid.CTAPHIDServer
+	channelID uint32
+
+	lock    sync.Mutex
+	packets [][]byte
+}
+
+func newHIDHost(server *ctap_hid.CTAPHIDServer) (*hidHost, error) {
+	host := &hidHost{server: server, channelID: hidBroadcastChannel}
+	server.SetResponseHandler(host.receivePacket)
+	nonce := crypto.RandomBytes(8)
+	response, err := host.transact(hidCommandInit, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 || !bytes.Equal(response[:8], nonce) {
+		return nil, fmt.Errorf("Invalid CTAPHID init response: %#v", response)
+	}
+	host.channelID = binary.LittleEndian.Uint32(response[8:12])
+	return host, nil
+}
+
+func (host *hidHost) receivePacket(packet []byte) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	host.packets = append(host.packets, packet)
+}
+
+// transact sends a message and waits for the response. Without a worker pool the server
+// answers before HandleMessage returns, so the response has already arrived.
+func (host *hidHost) transact(command byte, payload []byte) ([]byte, error) {
+	for _, packet := range framePackets(host.channelID, command, payload) {
+		host.server.HandleMessage(packet)
+	}
+	host.lock.Lock()
+	packets := host.packets
+	host.packets = nil
+	host.lock.Unlock()
+	return reassemble(packets, host.channelID, command)
+}
+
+func framePackets(channelID uint32, command byte, payload []byte) [][]byte {
+	packet := make([]byte, hidPacketSize)
+	binary.LittleEndian.PutUint32(packet, channelID)
+	packet[4] = command
+	binary.BigEndian.PutUint16(packet[5:7], uint16(len(payload)))
+	sent := copy(packet[hidInitHeaderSize:], payload)
+	packets := [][]byte{packet}
+	for sequence := byte(0); sent < len(payload); sequence++ {
+		packet := make([]byte, hidPacketSize)
+		binary.LittleEndian.PutUint32(packet, channelID)
+		packet[4] = sequence
+		sent += copy(packet[hidContinuationHeaderSize:], payload[sent:])
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// reassemble finds the response to command among packets, skipping keepalives
+func reassemble(packets [][]byte, channelID uint32, command byte) ([]byte, error) {
+	var payload []byte
+	length := -1
+	for _, packet := range packets {
+		if len(packet) < hidContinuationHeaderSize || binary.LittleEndian.Uint32(packet) != channelID {
+			continue
+		}
+		packetCommand := packet[4]
+		if length < 0 {
+			switch packetCommand {
+			case hidCommandKeepalive:
+				continue
+			case hidCommandError:
+				return nil, fmt.Errorf("CTAPHID error 0x%x", packet[hidInitHeaderSize])
+			case command:
+				length = int(binary.BigEndian.Uint16(packet[5:7]))
+				payload = append(payload, packet[hidInitHeaderSize:]...)
+			}
+		} else if packetCommand&0x80 == 0 {
+			payload = append(payload, packet[hidContinuationHeaderSize:]...)
+		}
+		if length >= 0 && len(payload) >= length {
+			return payload[:length], nil
+		}
+	}
+	return nil, fmt.Errorf("No complete response to CTAPHID command 0x%x", command)
+}
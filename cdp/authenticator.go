@@ -0,0 +1,188 @@
+package cdp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/fido_client"
+)
+
+// credential is a credential of the WebAuthn domain, whose binary fields are base64 encoded
+// by encoding/json
+type credential struct {
+	CredentialID         []byte `json:"credentialId"`
+	IsResidentCredential bool   `json:"isResidentCredential"`
+	RPID                 string `json:"rpId,omitempty"`
+	PrivateKey           []byte `json:"privateKey"`
+	UserHandle           []byte `json:"userHandle,omitempty"`
+	SignCount            int32  `json:"signCount"`
+	BackupEligibility    bool   `json:"backupEligibility,omitempty"`
+	BackupState          bool   `json:"backupState,omitempty"`
+}
+
+func newCredential(virtual fido_client.VirtualCredential) credential {
+	return credential{
+		CredentialID:         virtual.CredentialID,
+		IsResidentCredential: virtual.IsResidentCredential,
+		RPID:                 virtual.RPID,
+		PrivateKey:           virtual.PrivateKey,
+		UserHandle:           virtual.UserHandle,
+		SignCount:            virtual.SignCount,
+		BackupEligibility:    virtual.BackupEligibility,
+		BackupState:          virtual.BackupState,
+	}
+}
+
+func (c credential) virtualCredential() fido_client.VirtualCredential {
+	return fido_client.VirtualCredential{
+		CredentialID:         c.CredentialID,
+		IsResidentCredential: c.IsResidentCredential,
+		RPID:                 c.RPID,
+		PrivateKey:           c.PrivateKey,
+		UserHandle:           c.UserHandle,
+		SignCount:            c.SignCount,
+		BackupEligibility:    c.BackupEligibility,
+		BackupState:          c.BackupState,
+	}
+}
+
+type authenticatorOptions struct {
+	Protocol                    string `json:"protocol"`
+	Transport                   string `json:"transport"`
+	HasResidentKey              bool   `json:"hasResidentKey"`
+	HasUserVerification         bool   `json:"hasUserVerification"`
+	IsUserVerified              bool   `json:"isUserVerified"`
+	AutomaticPresenceSimulation bool   `json:"automaticPresenceSimulation"`
+	DefaultBackupEligibility    bool   `json:"defaultBackupEligibility"`
+	DefaultBackupState          bool   `json:"defaultBackupState"`
+}
+
+// Events Chrome sends when one of the authenticator's credentials is created or used
+var credentialEvents = []string{
+	"WebAuthn.credentialAdded",
+	"WebAuthn.credentialAsserted",
+	"WebAuthn.credentialUpdated",
+}
+
+// Authenticator is a virtual authenticator of a page holding the vault's credentials
+type Authenticator struct {
+	conn   *Conn
+	client *fido_client.DefaultFIDOClient
+	// Set once Chrome has added the authenticator, which events may race
+	lock sync.Mutex
+	id   string
+}
+
+// AddAuthenticator adds a virtual authenticator with options to the page of conn and loads
+// it with client's credentials. Only ECDSA credentials can be loaded. Credentials the page
+// creates or uses are stored back in the vault as Chrome reports them, so the vault and the
+// authenticator stay in step while conn is open.
+func AddAuthenticator(conn *Conn, client *fido_client.DefaultFIDOClient, options fido_client.VirtualAuthenticatorOptions) (*Authenticator, error) {
+	authenticator := &Authenticator{conn: conn, client: client}
+	for _, event := range credentialEvents {
+		conn.On(event, authenticator.handleCredentialEvent)
+	}
+	if err := conn.Call("WebAuthn.enable", map[string]bool{"enableUI": false}, nil); err != nil {
+		return nil, err
+	}
+	protocol := options.Protocol
+	if protocol == "" {
+		protocol = "ctap2"
+	}
+	transport := options.Transport
+	if transport == "" {
+		transport = "usb"
+	}
+	var added struct {
+		AuthenticatorID string `json:"authenticatorId"`
+	}
+	err := conn.Call("WebAuthn.addVirtualAuthenticator", map[string]interface{}{
+		"options": authenticatorOptions{
+			Protocol:                    protocol,
+			Transport:                   transport,
+			HasResidentKey:              options.HasResidentKey,
+			HasUserVerification:         options.HasUserVerification,
+			IsUserVerified:              options.IsUserVerified,
+			AutomaticPresenceSimulation: options.IsUserConsenting,
+			DefaultBackupEligibility:    options.DefaultBackupEligibility,
+			DefaultBackupState:          options.DefaultBackupState,
+		},
+	}, &added)
+	if err != nil {
+		return nil, err
+	}
+	authenticator.lock.Lock()
+	authenticator.id = added.AuthenticatorID
+	authenticator.lock.Unlock()
+	credentials, err := client.VirtualCredentials()
+	if err != nil {
+		return nil, err
+	}
+	for _, virtual := range credentials {
+		// Authenticators without resident keys only take server-side credentials
+		virtual.IsResidentCredential = virtual.IsResidentCredential && options.HasResidentKey
+		err := conn.Call("WebAuthn.addCredential", map[string]interface{}{
+			"authenticatorId": added.AuthenticatorID,
+			"credential":      newCredential(virtual),
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Could not add credential for %s: %w", virtual.RPID, err)
+		}
+	}
+	cdpLogger.Printf("Added virtual authenticator %s with %d credentials\n\n", added.AuthenticatorID, len(credentials))
+	return authenticator, nil
+}
+
+// ID is the authenticatorId Chrome gave the authenticator
+func (authenticator *Authenticator) ID() string {
+	authenticator.lock.Lock()
+	defer authenticator.lock.Unlock()
+	return authenticator.id
+}
+
+// Sync stores the authenticator's credentials in the vault, for Chrome versions that don't
+// report credentials as they're created or used
+func (authenticator *Authenticator) Sync() error {
+	var result struct {
+		Credentials []credential `json:"credentials"`
+	}
+	err := authenticator.conn.Call("WebAuthn.getCredentials", map[string]string{"authenticatorId": authenticator.ID()}, &result)
+	if err != nil {
+		return err
+	}
+	for _, c := range result.Credentials {
+		if err := authenticator.update(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove takes the authenticator off the page
+func (authenticator *Authenticator) Remove() error {
+	return authenticator.conn.Call("WebAuthn.removeVirtualAuthenticator", map[string]string{"authenticatorId": authenticator.ID()}, nil)
+}
+
+func (authenticator *Authenticator) handleCredentialEvent(params json.RawMessage) {
+	var event struct {
+		AuthenticatorID string     `json:"authenticatorId"`
+		Credential      credential `json:"credential"`
+	}
+	if err := json.Unmarshal(params, &event); err != nil {
+		cdpLogger.Printf("ERROR: Invalid credential event: %s\n\n", err)
+		return
+	}
+	if event.AuthenticatorID != authenticator.ID() {
+		return
+	}
+	if err := authenticator.update(event.Credential); err != nil {
+		cdpLogger.Printf("ERROR: Could not store credential: %s\n\n", err)
+	}
+}
+
+func (authenticator *Authenticator) update(c credential) error {
+	authenticator.client.BeginTransaction()
+	defer authenticator.client.EndTransaction()
+	return authenticator.client.UpdateVirtualCredential(c.virtualCredential())
+}
@@ -0,0 +1,170 @@
+// Package cdp registers the vault as a virtual authenticator in Chrome through the WebAuthn
+// domain of the DevTools protocol (https://chromedevtools.github.io/devtools-protocol/tot/WebAuthn/),
+// bypassing USB entirely. Chrome signs with the vault's credentials itself, which makes
+// browser test loops much faster, and credentials it creates are stored in the vault.
+// Chrome must be started with --remote-debugging-port.
+package cdp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var cdpLogger = util.NewLogger("[CDP] ", util.LogSubsystemCDP, util.LogLevelDebug)
+
+// DefaultDebuggerAddress is where Chrome serves DevTools with --remote-debugging-port=9222
+const DefaultDebuggerAddress = "localhost:9222"
+
+type cdpMessage struct {
+	ID     int             `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type cdpRequest struct {
+	ID     int         `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+// Conn is a DevTools connection to a target, usually a page
+type Conn struct {
+	ws       *websocketConn
+	lock     sync.Mutex
+	nextID   int
+	calls    map[int]chan cdpMessage
+	handlers map[string]func(params json.RawMessage)
+	// Closed once the connection is gone, after which err says why
+	done chan struct{}
+	err  error
+}
+
+// Dial connects to a target's webSocketDebuggerUrl
+func Dial(url string) (*Conn, error) {
+	ws, err := dialWebsocket(url)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{
+		ws:       ws,
+		nextID:   1,
+		calls:    make(map[int]chan cdpMessage),
+		handlers: make(map[string]func(params json.RawMessage)),
+		done:     make(chan struct{}),
+	}
+	go conn.read()
+	return conn, nil
+}
+
+// PageURL returns the webSocketDebuggerUrl of the first page open in the Chrome whose
+// DevTools listen on debuggerAddress
+func PageURL(debuggerAddress string) (string, error) {
+	response, err := http.Get("http://" + debuggerAddress + "/json/list")
+	if err != nil {
+		return "", fmt.Errorf("Could not list DevTools targets: %w", err)
+	}
+	defer response.Body.Close()
+	var targets []struct {
+		Type                 string `json:"type"`
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&targets); err != nil {
+		return "", fmt.Errorf("Could not read DevTools targets: %w", err)
+	}
+	for _, target := range targets {
+		if target.Type == "page" && target.WebSocketDebuggerURL != "" {
+			return target.WebSocketDebuggerURL, nil
+		}
+	}
+	return "", fmt.Errorf("Chrome has no page open to debug")
+}
+
+// Call sends a command and decodes its result into result, unless it's nil
+func (conn *Conn) Call(method string, params interface{}, result interface{}) error {
+	replies := make(chan cdpMessage, 1)
+	conn.lock.Lock()
+	id := conn.nextID
+	conn.nextID++
+	conn.calls[id] = replies
+	conn.lock.Unlock()
+	data, err := json.Marshal(cdpRequest{ID: id, Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("Could not encode %s: %w", method, err)
+	}
+	if err := conn.ws.writeFrame(opcodeText, data); err != nil {
+		return fmt.Errorf("Could not send %s: %w", method, err)
+	}
+	var reply cdpMessage
+	select {
+	case reply = <-replies:
+	case <-conn.done:
+		return fmt.Errorf("Could not call %s: %w", method, conn.err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("%s failed: %s", method, reply.Error.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(reply.Result, result); err != nil {
+		return fmt.Errorf("Could not decode %s result: %w", method, err)
+	}
+	return nil
+}
+
+// On calls handler with the parameters of every method event. Handlers run on the goroutine
+// reading the connection, so they mustn't Call.
+func (conn *Conn) On(method string, handler func(params json.RawMessage)) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.handlers[method] = handler
+}
+
+// Done is closed once the connection is gone, e.g. when the page is closed
+func (conn *Conn) Done() <-chan struct{} {
+	return conn.done
+}
+
+func (conn *Conn) Close() error {
+	return conn.ws.close()
+}
+
+func (conn *Conn) read() {
+	for {
+		data, err := conn.ws.readMessage()
+		if err != nil {
+			conn.err = err
+			close(conn.done)
+			return
+		}
+		var message cdpMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			cdpLogger.Printf("ERROR: Invalid DevTools message: %s\n\n", err)
+			continue
+		}
+		conn.lock.Lock()
+		if message.ID != 0 {
+			replies := conn.calls[message.ID]
+			delete(conn.calls, message.ID)
+			conn.lock.Unlock()
+			if replies != nil {
+				replies <- message
+			}
+			continue
+		}
+		handler := conn.handlers[message.Method]
+		conn.lock.Unlock()
+		if handler != nil {
+			handler(message.Params)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package cdp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+type approveAll struct{}
+
+func (approver *approveAll) ApproveClientAction(action fido_client.ClientAction, params fido_client.ClientActionRequestParams) bool {
+	return true
+}
+
+type memoryDataSaver struct {
+	data []byte
+}
+
+func (saver *memoryDataSaver) SaveData(data []byte) {
+	saver.data = data
+}
+
+func (saver *memoryDataSaver) RetrieveData() []byte {
+	return saver.data
+}
+
+func (saver *memoryDataSaver) Passphrase() string {
+	return "passphrase"
+}
+
+func newTestClient(t *testing.T) *fido_client.DefaultFIDOClient {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA private key")
+	ca, err := identities.CreateSelfSignedCA(caPrivateKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	encryptionKey := [32]byte{}
+	copy(encryptionKey[:], crypto.RandomBytes(32))
+	return fido_client.NewDefaultClient(ca, caPrivateKey, encryptionKey, false, &approveAll{}, &memoryDataSaver{})
+}
+
+func newTestCredential(t *testing.T, id string, rpID string) fido_client.VirtualCredential {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), crypto.Random())
+	test.Assert(t, err == nil, "Could not generate key")
+	key, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	test.Assert(t, err == nil, "Could not encode key")
+	return fido_client.VirtualCredential{CredentialID: []byte(id), IsResidentCredential: true, RPID: rpID, PrivateKey: key, UserHandle: []byte("user")}
+}
+
+// fakePage answers the WebAuthn domain like a Chrome page
+type fakePage struct {
+	t           *testing.T
+	lock        sync.Mutex
+	conn        net.Conn
+	reader      *bufio.Reader
+	credentials []credential
+	options     authenticatorOptions
+}
+
+func (page *fakePage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, buffered, err := w.(http.Hijacker).Hijack()
+	test.Assert(page.t, err == nil, "Could not take over connection")
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	buffered.Flush()
+	page.lock.Lock()
+	page.conn = conn
+	page.reader = buffered.Reader
+	page.lock.Unlock()
+	go page.serve()
+}
+
+func (page *fakePage) send(message interface{}) {
+	data, _ := json.Marshal(message)
+	frame := []byte{0x80 | opcodeText}
+	if len(data) < 126 {
+		frame = append(frame, byte(len(data)))
+	} else {
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	}
+	page.conn.Write(append(frame, data...))
+}
+
+func (page *fakePage) serve() {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(page.reader, header); err != nil {
+			return
+		}
+		length := int(header[1] & 0x7F)
+		if length == 126 {
+			extended := make([]byte, 2)
+			io.ReadFull(page.reader, extended)
+			length = int(binary.BigEndian.Uint16(extended))
+		}
+		mask := make([]byte, 4)
+		io.ReadFull(page.reader, mask)
+		payload := make([]byte, length)
+		io.ReadFull(page.reader, payload)
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		if header[0]&0x0F == opcodeClose {
+			return
+		}
+		var request struct {
+			ID     int             `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(payload, &request)
+		result := map[string]interface{}{}
+		page.lock.Lock()
+		switch request.Method {
+		case "WebAuthn.addVirtualAuthenticator":
+			var params struct {
+				Options authenticatorOptions `json:"options"`
+			}
+			json.Unmarshal(request.Params, &params)
+			page.options = params.Options
+			result["authenticatorId"] = "authenticator-1"
+		case "WebAuthn.addCredential":
+			var params struct {
+				Credential credential `json:"credential"`
+			}
+			json.Unmarshal(request.Params, &params)
+			page.credentials = append(page.credentials, params.Credential)
+		case "WebAuthn.getCredentials":
+			result["credentials"] = page.credentials
+		}
+		page.send(map[string]interface{}{"id": request.ID, "result": result})
+		page.lock.Unlock()
+	}
+}
+
+func startFakePage(t *testing.T) (*fakePage, *Conn) {
+	page := &fakePage{t: t}
+	server := httptest.NewServer(page)
+	t.Cleanup(server.Close)
+	conn, err := Dial("ws" + strings.TrimPrefix(server.URL, "http") + "/devtools/page/1")
+	test.Assert(t, err == nil, "Could not connect to page")
+	t.Cleanup(func() { conn.Close() })
+	return page, conn
+}
+
+func TestAddAuthenticator(t *testing.T) {
+	client := newTestClient(t)
+	existing := newTestCredential(t, "existing", "example.com")
+	test.Assert(t, client.AddVirtualCredential(existing) == nil, "Could not add credential")
+	page, conn := startFakePage(t)
+
+	authenticator, err := AddAuthenticator(conn, client, fido_client.DefaultVirtualAuthenticatorOptions())
+	test.Assert(t, err == nil, "Could not add authenticator")
+	test.AssertEqual(t, authenticator.ID(), "authenticator-1", "Wrong authenticator ID")
+	page.lock.Lock()
+	test.AssertEqual(t, page.options.Protocol, "ctap2", "Authenticator should speak CTAP2")
+	test.Assert(t, page.options.HasResidentKey && page.options.AutomaticPresenceSimulation, "Options should be passed on")
+	test.AssertEqual(t, len(page.credentials), 1, "Vault's credential should be loaded")
+	test.AssertArrEqual(t, page.credentials[0].PrivateKey, existing.PrivateKey, "Private key should be loaded")
+	test.AssertEqual(t, page.credentials[0].RPID, "example.com", "RP should be loaded")
+	page.lock.Unlock()
+
+	// A credential the page created
+	created := newTestCredential(t, "created", "example.org")
+	page.lock.Lock()
+	page.send(map[string]interface{}{
+		"method": "WebAuthn.credentialAdded",
+		"params": map[string]interface{}{"authenticatorId": "authenticator-1", "credential": newCredential(created)},
+	})
+	page.credentials[0].SignCount = 5
+	page.lock.Unlock()
+	// The event is handled before the reply to a later call is read
+	test.Assert(t, authenticator.Sync() == nil, "Could not sync")
+	credentials, err := client.VirtualCredentials()
+	test.Assert(t, err == nil, "Could not list credentials")
+	test.AssertEqual(t, len(credentials), 2, "Created credential should be stored in the vault")
+	for _, credential := range credentials {
+		if string(credential.CredentialID) == "existing" {
+			test.AssertEqual(t, credential.SignCount, int32(5), "Signature counter should follow the page")
+		} else {
+			test.AssertEqual(t, credential.RPID, "example.org", "Created credential should keep its RP")
+		}
+	}
+}
+
+func TestPageURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.AssertEqual(t, r.URL.Path, "/json/list", "Wrong path")
+		w.Write([]byte(`[{"type":"service_worker","webSocketDebuggerUrl":"ws://worker"},{"type":"page","webSocketDebuggerUrl":"ws://page"}]`))
+	}))
+	defer server.Close()
+	url, err := PageURL(strings.TrimPrefix(server.URL, "http://"))
+	test.Assert(t, err == nil, "Could not find page")
+	test.AssertEqual(t, url, "ws://page", "Should pick the page")
+}
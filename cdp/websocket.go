@@ -0,0 +1,196 @@
+package cdp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+// Appended to our key to prove the server speaks WebSocket (RFC 6455 section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opcodeContinuation byte = 0x0
+	opcodeText         byte = 0x1
+	opcodeClose        byte = 0x8
+	opcodePing         byte = 0x9
+	opcodePong         byte = 0xA
+)
+
+// DevTools messages can hold whole responses, but none we ask for come close
+const maxMessageLength = 16 << 20
+
+// websocketConn is the client side of RFC 6455, enough to exchange text messages with
+// Chrome's DevTools endpoint
+type websocketConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// dialWebsocket connects to a ws:// URL like the webSocketDebuggerUrl of a DevTools target
+func dialWebsocket(rawURL string) (*websocketConn, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WebSocket URL: %w", err)
+	}
+	if target.Scheme != "ws" {
+		return nil, fmt.Errorf("Unsupported WebSocket scheme: %s", target.Scheme)
+	}
+	host := target.Host
+	if target.Port() == "" {
+		host = net.JoinHostPort(target.Hostname(), "80")
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s: %w", host, err)
+	}
+	ws, err := newWebsocketConn(conn, target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// newWebsocketConn makes the opening handshake for target over conn
+func newWebsocketConn(conn net.Conn, target *url.URL) (*websocketConn, error) {
+	nonce := crypto.RandomBytes(16)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+		Host: target.Host,
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, fmt.Errorf("Could not write handshake: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read handshake: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket handshake failed: %s", response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, fmt.Errorf("WebSocket handshake has the wrong accept key")
+	}
+	return &websocketConn{conn: conn, reader: reader}, nil
+}
+
+// writeFrame sends payload as a single frame, masked as clients must
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := crypto.RandomBytes(4)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// readFrame returns whether the next frame from the server is final, its opcode and payload
+func (ws *websocketConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	final := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 != 0 {
+		return false, 0, nil, fmt.Errorf("Server frames must not be masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > maxMessageLength {
+		return false, 0, nil, fmt.Errorf("Server frame too long: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	return final, opcode, payload, nil
+}
+
+// readMessage returns the next text message, reassembling fragments and answering pings
+func (ws *websocketConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		final, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case opcodeText, opcodeContinuation:
+			message = append(message, payload...)
+			if len(message) > maxMessageLength {
+				return nil, fmt.Errorf("Message too long: %d bytes", len(message))
+			}
+			if final {
+				return message, nil
+			}
+		case opcodePing:
+			if err := ws.writeFrame(opcodePong, payload); err != nil {
+				return nil, err
+			}
+		case opcodeClose:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (ws *websocketConn) close() error {
+	ws.writeFrame(opcodeClose, nil)
+	return ws.conn.Close()
+}
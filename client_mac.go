@@ -3,18 +3,50 @@
 package virtual_fido
 
 import (
-	"github.com/bulwarkid/virtual-fido/ctap"
-	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/hidproxy"
 	"github.com/bulwarkid/virtual-fido/mac"
-	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/privsep"
 )
 
 /*
  * Mac client requires installation of Mac USBDriver, which implements a virtual USB device.
  */
-func startClient(client FIDOClient) {
-	ctapServer := ctap.NewCTAPServer(client)
-	u2fServer := u2f.NewU2FServer(client)
-	ctapHIDServer := ctap_hid.NewCTAPHIDServer(ctapServer, u2fServer)
+func (device *Device) startClient(client Client) {
+	ctapServer, u2fServer := device.newClientServers(client)
+	ctapHIDServer := device.newCTAPHIDServer(ctapServer, u2fServer)
+	// The driver's reports are always 64 bytes, whatever the USB options
+	ctapHIDServer.SetPacketSize(64)
+	ctapServer.SetTransport(ctapHIDServer.MaxMessageSize(), "usb")
+	// The driver reports its own serial number, but the AAGUID and attestation CA still
+	// need to stay the same
+	if identity, ok := client.(DeviceIdentity); ok {
+		identity.PersistDeviceIdentity()
+	}
 	mac.Start(ctapHIDServer)
 }
+
+func (device *Device) startClients(clients []Client) error {
+	if len(clients) != 1 {
+		return fmt.Errorf("The Mac driver only supports a single device")
+	}
+	device.startClient(clients[0])
+	return nil
+}
+
+func (device *Device) startTransport(transport *privsep.Transport) error {
+	return fmt.Errorf("Privilege separation is only supported over USB/IP")
+}
+
+func (device *Device) startProxy(proxy *hidproxy.HIDProxy) error {
+	return fmt.Errorf("Proxying to a key is only supported over USB/IP")
+}
+
+func (device *Device) startRoutedProxy(key *hidproxy.Key, client Client, routes *hidproxy.Routes) error {
+	return fmt.Errorf("Proxying to a key is only supported over USB/IP")
+}
+
+func (device *Device) stopClient() error {
+	return fmt.Errorf("The Mac driver can't be stopped")
+}
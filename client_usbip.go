@@ -3,18 +3,156 @@
 package virtual_fido
 
 import (
-	"github.com/bulwarkid/virtual-fido/ctap"
-	"github.com/bulwarkid/virtual-fido/ctap_hid"
-	"github.com/bulwarkid/virtual-fido/u2f"
+	"fmt"
+	"net"
+
+	"github.com/bulwarkid/virtual-fido/hidproxy"
+	"github.com/bulwarkid/virtual-fido/otp"
+	"github.com/bulwarkid/virtual-fido/piv"
+	"github.com/bulwarkid/virtual-fido/privsep"
 	"github.com/bulwarkid/virtual-fido/usb"
 	"github.com/bulwarkid/virtual-fido/usbip"
+	"github.com/bulwarkid/virtual-fido/usbredir"
+	"github.com/bulwarkid/virtual-fido/util"
 )
 
-func startClient(client FIDOClient) {
-	ctapServer := ctap.NewCTAPServer(client)
-	u2fServer := u2f.NewU2FServer(client)
-	ctapHIDServer := ctap_hid.NewCTAPHIDServer(ctapServer, u2fServer)
-	usbDevice := usb.NewUSBDevice(ctapHIDServer)
-	server := usbip.NewUSBIPServer([]usbip.USBIPDevice{usbDevice})
+func (device *Device) startClient(client Client) {
+	device.startUSBIPServer(device.newClientDevice(client))
+}
+
+func (device *Device) startClients(clients []Client) error {
+	if device.options.OTP && len(clients) > 1 {
+		return fmt.Errorf("OTP is only supported with a single device")
+	}
+	usbDevices := make([]*usb.USBDevice, len(clients))
+	for i, client := range clients {
+		usbDevices[i] = device.newClientDevice(client)
+		usbDevices[i].SetDeviceNumber(uint32(i + 2))
+	}
+	device.startUSBIPServer(usbDevices...)
+	return nil
+}
+
+func (device *Device) newClientDevice(client Client) *usb.USBDevice {
+	ctapServer, u2fServer := device.newClientServers(client)
+	ctapHIDServer := device.newCTAPHIDServer(ctapServer, u2fServer)
+	ctapServer.SetTransport(ctapHIDServer.MaxMessageSize(), "usb")
+	usbDevice := device.newUSBDevice(ctapHIDServer)
+	if identity, ok := client.(DeviceIdentity); ok {
+		identity.PersistDeviceIdentity()
+		usbDevice.SetSerialNumber(identity.SerialNumber())
+	}
+	if device.options.PIV {
+		pivClient, ok := client.(piv.PIVClient)
+		if !ok {
+			util.Panic("ERROR: Could not enable PIV - Client doesn't implement piv.PIVClient")
+		}
+		usbDevice.AddCCIDInterface(piv.NewPIVServer(pivClient))
+	}
+	if device.options.OTP {
+		otpClient, ok := client.(otp.OTPClient)
+		if !ok {
+			util.Panic("ERROR: Could not enable OTP - Client doesn't implement otp.OTPClient")
+		}
+		device.lock.Lock()
+		device.otpServer = otp.NewOTPServer(otpClient, usbDevice.AddKeyboardInterface())
+		device.lock.Unlock()
+	}
+	return usbDevice
+}
+
+func (device *Device) startTransport(transport *privsep.Transport) error {
+	if device.options.PIV || device.options.OTP {
+		return fmt.Errorf("PIV and OTP aren't supported with a key daemon")
+	}
+	device.startUSBIPServer(device.newUSBDevice(device.newCTAPHIDServer(transport.CTAPServer(), transport.U2FServer())))
+	return nil
+}
+
+func (device *Device) startProxy(proxy *hidproxy.HIDProxy) error {
+	if device.options.PIV || device.options.OTP {
+		return fmt.Errorf("PIV and OTP aren't supported when proxying to a key")
+	}
+	if device.options.USBSpeed != usb.USBSpeedFull {
+		return fmt.Errorf("Keys use %d byte reports, so the proxy only supports full speed", hidproxy.ReportSize)
+	}
+	device.startUSBIPServer(device.newUSBDevice(proxy))
+	return nil
+}
+
+func (device *Device) startRoutedProxy(key *hidproxy.Key, client Client, routes *hidproxy.Routes) error {
+	if device.options.PIV || device.options.OTP {
+		return fmt.Errorf("PIV and OTP aren't supported when proxying to a key")
+	}
+	ctapServer, u2fServer := device.newClientServers(client)
+	ctapRouter := hidproxy.NewCTAPRouter(routes, ctapServer, key.CTAPClient())
+	u2fRouter := hidproxy.NewU2FRouter(routes, u2fServer, key.U2FClient())
+	ctapHIDServer := device.newCTAPHIDServer(ctapRouter, u2fRouter)
+	ctapServer.SetTransport(ctapHIDServer.MaxMessageSize(), "usb")
+	device.startUSBIPServer(device.newUSBDevice(ctapHIDServer))
+	return nil
+}
+
+func (device *Device) newUSBDevice(delegate usb.USBDeviceDelegate) *usb.USBDevice {
+	options := device.options
+	usbDevice := usb.NewUSBDevice(delegate)
+	err := usbDevice.SetSpeed(options.USBSpeed, options.USBPacketSize, options.USBInterval)
+	util.CheckErr(err, "Invalid USB speed")
+	usbDevice.SetReportID(options.USBReportID)
+	err = usbDevice.SetInterruptPolling(options.InterruptPolling)
+	util.CheckErr(err, "Invalid interrupt polling")
+	return usbDevice
+}
+
+func (device *Device) startUSBIPServer(usbDevices ...*usb.USBDevice) {
+	device.lock.Lock()
+	listener := device.usbredirListener
+	device.usbredirListener = nil
+	device.lock.Unlock()
+	if listener != nil {
+		device.startUSBRedirServer(listener, usbDevices)
+		return
+	}
+	devices := make([]usbip.USBIPDevice, len(usbDevices))
+	for i, usbDevice := range usbDevices {
+		devices[i] = usbDevice
+	}
+	server := usbip.NewUSBIPServer(devices)
+	server.SetWatchdog(device.watchdog)
+	if device.options.USBCapturePath != "" {
+		err := server.EnableCapture(device.options.USBCapturePath)
+		util.CheckErr(err, "Could not start USB capture")
+	}
+	device.lock.Lock()
+	if device.usbipListener != nil {
+		server.SetListener(device.usbipListener)
+		device.usbipListener = nil
+	}
+	device.server = server
+	device.lock.Unlock()
 	server.Start()
 }
+
+func (device *Device) startUSBRedirServer(listener net.Listener, usbDevices []*usb.USBDevice) {
+	if len(usbDevices) != 1 {
+		listener.Close()
+		util.Panic("ERROR: usbredir only supports a single device")
+	}
+	server := usbredir.NewUSBRedirServer(usbDevices[0])
+	server.SetListener(listener)
+	device.lock.Lock()
+	device.server = server
+	device.lock.Unlock()
+	server.Start()
+}
+
+func (device *Device) stopClient() error {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if device.server == nil {
+		return fmt.Errorf("Device is not started")
+	}
+	device.server.Stop()
+	device.server = nil
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bulwarkid/virtual-fido/android"
+)
+
+var androidAVD string
+
+// runAndroidEmulator boots the AVD with the device attached over usbredir, which the guest
+// keeps retrying until the device server is listening
+func runAndroidEmulator() {
+	path, err := android.FindEmulator()
+	if err != nil {
+		fmt.Printf("Could not start the Android emulator: %s\n", err)
+		return
+	}
+	args, err := android.USBRedirArgs(usbredirAddress)
+	checkErr(err, "Could not attach the Android emulator")
+	emulator := android.Command(path, androidAVD, args)
+	emulator.Stdout = os.Stdout
+	emulator.Stderr = os.Stderr
+	fmt.Printf("Starting Android emulator %s\n", androidAVD)
+	if err := emulator.Run(); err != nil {
+		fmt.Printf("Android emulator stopped: %s\n", err)
+	}
+}
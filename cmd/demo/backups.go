@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/spf13/cobra"
+)
+
+var vaultBackups int
+
+// exitIfDamaged explains how to restore a backup if err says the vault is damaged
+func exitIfDamaged(err error, what string) {
+	if !errors.Is(err, identities.ErrVaultDamaged) {
+		return
+	}
+	fmt.Printf("%s is damaged: %s\n", what, err)
+	fmt.Printf("Run `backups` to check the backups of %s and `restore-backup <n>` to restore one.\n", vaultFilename)
+	os.Exit(1)
+}
+
+// checkVaultFile decrypts every profile of a vault file, and returns the PIN state version of
+// each profile
+func checkVaultFile(filename string) (map[string]uint64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := identities.ParseProfiles(data)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]uint64)
+	for _, name := range profiles.Names() {
+		state, err := identities.DecryptFIDOState(profiles.Profiles[name], vaultPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Profile %s: %w", name, err)
+		}
+		versions[name] = 0
+		if state.PINState != nil {
+			versions[name] = state.PINState.Version
+		}
+	}
+	return versions, nil
+}
+
+func listBackups(cmd *cobra.Command, args []string) {
+	support := &ClientSupport{vaultFilename: vaultFilename}
+	filenames := []string{vaultFilename}
+	for n := 1; ; n++ {
+		if _, err := os.Stat(support.backupFilename(n)); err != nil {
+			break
+		}
+		filenames = append(filenames, support.backupFilename(n))
+	}
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			fmt.Printf("%s: %s\n", filename, err)
+			continue
+		}
+		status := ""
+		versions, err := checkVaultFile(filename)
+		if err != nil {
+			status = err.Error()
+		} else {
+			status = fmt.Sprintf("ok, %d profiles", len(versions))
+		}
+		fmt.Printf("%s (saved %s): %s\n", filename, info.ModTime().Format("2006-01-02 15:04:05"), status)
+	}
+}
+
+func restoreBackup(cmd *cobra.Command, args []string) {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		checkErr(fmt.Errorf("Expected a backup number, got %q", args[0]), "Invalid backup")
+	}
+	support := &ClientSupport{vaultFilename: vaultFilename, backups: vaultBackups}
+	filename := support.backupFilename(n)
+	versions, err := checkVaultFile(filename)
+	checkErr(err, "Could not read backup "+filename)
+	if !prompt(fmt.Sprintf("Replace %s with %s (y/N)?", vaultFilename, filename)) {
+		return
+	}
+	data, err := os.ReadFile(filename)
+	checkErr(err, "Could not read backup")
+	unlock, err := support.LockVault(true)
+	checkErr(err, "Could not lock vault")
+	defer unlock()
+	// The vault being replaced becomes the newest backup
+	support.SaveData(data)
+	// Restoring a backup is a deliberate rollback
+	for profile, version := range versions {
+		support.SetProfileRollbackCounter(profile, version)
+	}
+	fmt.Printf("Restored %s from %s\n", vaultFilename, filename)
+}
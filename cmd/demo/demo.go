@@ -1,17 +1,39 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base32"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	virtual_fido "github.com/bulwarkid/virtual-fido"
+	"github.com/bulwarkid/virtual-fido/audit"
+	"github.com/bulwarkid/virtual-fido/cdp"
+	"github.com/bulwarkid/virtual-fido/credential_db"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/delegate"
 	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/hidproxy"
+	"github.com/bulwarkid/virtual-fido/hotkey"
 	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/mds"
+	"github.com/bulwarkid/virtual-fido/metrics"
+	"github.com/bulwarkid/virtual-fido/usbredir"
 	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/vault_sync"
+	"github.com/bulwarkid/virtual-fido/vpcd"
 	"github.com/spf13/cobra"
 )
 
@@ -19,6 +41,46 @@ var vaultFilename string
 var vaultPassphrase string
 var identityID string
 var verbose bool
+var jsonLogs bool
+var sealKeyFilename string
+var deterministicSignatures bool
+var randomSeed string
+var autoApproveTimeout time.Duration
+var simulatedPresence string
+var touchLatency time.Duration
+var touchJitter time.Duration
+var touchAddress string
+var touchHotkey string
+var desktopNotifications bool
+var approvalWebhook string
+var approvalAddress string
+var approvalSecret string
+var remoteApprovals *fido_client.RemoteApprovalUI
+var policyFilename string
+var automationAddress string
+var metricsAddress string
+var recordFilename string
+var watchdogDeadline time.Duration
+var captureFilename string
+var usbSpeed string
+var usbPacketSize uint16
+var usbInterval uint8
+var usbReportID uint8
+var interruptPolling = virtual_fido.DefaultInterruptPolling()
+var maxMessageSize uint32
+var ctapTimeouts = virtual_fido.DefaultCTAPTimeouts()
+var readOnly bool
+var conformanceMode bool
+var makeCredUVNotRequired bool
+var deviceAssertionLimit string
+var relyingPartyAssertionLimit string
+var enablePIV bool
+var otpAddress string
+var metadataFilename string
+var metadataDescription string
+var metadataStatus string
+var metadataBlobFilename string
+var metadataRootFilename string
 
 func checkErr(err error, message string) {
 	if err != nil {
@@ -29,36 +91,286 @@ func checkErr(err error, message string) {
 func listIdentities(cmd *cobra.Command, args []string) {
 	client := createClient()
 	fmt.Printf("------- Identities in file '%s' -------\n", vaultFilename)
-	sources := client.Identities()
-	for _, source := range sources {
-		fmt.Printf("(%s): '%s' for website '%s'\n", hex.EncodeToString(source.ID[:4]), source.User.Name, source.RelyingParty.Name)
+	for _, credential := range client.ListCredentials() {
+		lastUsed := "never"
+		if !credential.LastUsedAt.IsZero() {
+			lastUsed = credential.LastUsedAt.Local().Format(time.RFC822)
+		}
+		fmt.Printf("(%s): '%s' for website '%s'", hex.EncodeToString(credential.ID[:4]), credential.UserName, credential.RelyingPartyName)
+		if credential.Nickname != "" {
+			fmt.Printf(" [%s]", credential.Nickname)
+		}
+		if credential.Policy != identities.CredentialPolicyApprove {
+			fmt.Printf(" {%s}", credential.Policy)
+		}
+		if credential.BackedUp {
+			fmt.Printf(" (passkey, backed up)")
+		} else if credential.BackupEligible {
+			fmt.Printf(" (passkey)")
+		}
+		fmt.Printf(" - used %d times, last used %s\n", credential.UsageCount, lastUsed)
 	}
 }
 
-func deleteIdentity(cmd *cobra.Command, args []string) {
-	client := createClient()
-	ids := client.Identities()
-	targetIDs := make([]*identities.CredentialSource, 0)
-	for _, id := range ids {
-		hexString := hex.EncodeToString(id.ID)
-		if strings.HasPrefix(hexString, identityID) {
-			targetIDs = append(targetIDs, &id)
+func findIdentity(client *fido_client.DefaultFIDOClient, prefix string) *identities.CredentialMetadata {
+	targetIDs := make([]identities.CredentialMetadata, 0)
+	for _, credential := range client.ListCredentials() {
+		hexString := hex.EncodeToString(credential.ID)
+		if strings.HasPrefix(hexString, prefix) {
+			targetIDs = append(targetIDs, credential)
 		}
 	}
 	if len(targetIDs) > 1 {
-		fmt.Printf("Multiple identities with prefix (%s):\n", identityID)
+		fmt.Printf("Multiple identities with prefix (%s):\n", prefix)
 		for _, id := range targetIDs {
 			fmt.Printf("- (%s)\n", hex.EncodeToString(id.ID))
 		}
-	} else if len(targetIDs) == 1 {
-		fmt.Printf("Deleting identity (%s)\n...", hex.EncodeToString(targetIDs[0].ID))
-		if client.DeleteIdentity(targetIDs[0].ID) {
-			fmt.Printf("Done.\n")
-		} else {
-			fmt.Printf("Could not find (%s).\n", hex.EncodeToString(targetIDs[0].ID))
+		return nil
+	} else if len(targetIDs) == 0 {
+		fmt.Printf("No identity found with prefix (%s)\n", prefix)
+		return nil
+	}
+	return &targetIDs[0]
+}
+
+func identityArgument(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return identityID
+}
+
+func deleteIdentity(cmd *cobra.Command, args []string) {
+	client := createClient()
+	target := findIdentity(client, identityArgument(args))
+	if target == nil {
+		return
+	}
+	fmt.Printf("Deleting identity (%s)\n...", hex.EncodeToString(target.ID))
+	if client.DeleteIdentity(target.ID) {
+		fmt.Printf("Done.\n")
+	} else {
+		fmt.Printf("Could not find (%s).\n", hex.EncodeToString(target.ID))
+	}
+}
+
+func renameIdentity(cmd *cobra.Command, args []string) {
+	client := createClient()
+	target := findIdentity(client, args[0])
+	if target == nil {
+		return
+	}
+	client.SetCredentialNickname(target.ID, args[1])
+	fmt.Printf("Renamed (%s) to '%s'\n", hex.EncodeToString(target.ID), args[1])
+}
+
+func setIdentityPolicy(cmd *cobra.Command, args []string) {
+	policy, err := identities.ParseCredentialPolicy(args[1])
+	checkErr(err, "Invalid policy")
+	client := createClient()
+	target := findIdentity(client, args[0])
+	if target == nil {
+		return
+	}
+	client.SetCredentialPolicy(target.ID, policy)
+	fmt.Printf("Set the policy of (%s) to %s\n", hex.EncodeToString(target.ID), policy)
+}
+
+var transferFilename string
+var transferPassphrase string
+var importFormat string
+
+func exportPassphrase() string {
+	if transferPassphrase != "" {
+		return transferPassphrase
+	}
+	return vaultPassphrase
+}
+
+func exportVault(cmd *cobra.Command, args []string) {
+	client := createClient()
+	data, err := client.ExportVault(exportPassphrase())
+	checkErr(err, "Could not export vault")
+	err = os.WriteFile(transferFilename, data, 0600)
+	checkErr(err, "Could not write export file")
+	fmt.Printf("Exported vault to '%s'\n", transferFilename)
+}
+
+func importVault(cmd *cobra.Command, args []string) {
+	data, err := os.ReadFile(transferFilename)
+	checkErr(err, "Could not read import file")
+	client := createClient()
+	if importFormat == "virtual-fido" {
+		err = client.ImportVault(data, exportPassphrase())
+		checkErr(err, "Could not import vault")
+		fmt.Printf("Imported vault from '%s'\n", transferFilename)
+		return
+	}
+	count, err := client.ImportU2FCredentials(identities.U2FImportFormat(importFormat), data)
+	checkErr(err, "Could not import U2F credentials")
+	fmt.Printf("Imported %d U2F credentials from '%s'\n", count, transferFilename)
+}
+
+func resetVault(cmd *cobra.Command, args []string) {
+	if !prompt(fmt.Sprintf("Delete all credentials and the PIN in '%s' (y/N)?", vaultFilename)) {
+		return
+	}
+	client := createClient()
+	client.ResetVault()
+	fmt.Printf("Vault reset\n")
+}
+
+var newVaultPassphrase string
+
+func changePassphrase(cmd *cobra.Command, args []string) {
+	vault := profileVault()
+	profiles, err := vault.Profiles()
+	checkErr(err, "Could not read vault profiles")
+	if len(profiles) == 0 {
+		fmt.Printf("No vault found at '%s'\n", vaultFilename)
+		return
+	}
+	// Every profile is decrypted before any is saved, so a wrong passphrase changes nothing
+	savers := make([]fido_client.ClientDataSaver, len(profiles))
+	newData := make([][]byte, len(profiles))
+	for i, profile := range profiles {
+		savers[i], err = vault.Profile(profile)
+		checkErr(err, "Could not open profile")
+		data := savers[i].RetrieveData()
+		params, err := identities.PassphraseParameters(data)
+		checkErr(err, "Could not read KDF parameters")
+		newData[i], err = identities.ChangeVaultPassphrase(data, vaultPassphrase, newVaultPassphrase, kdfParameters(params))
+		checkErr(err, "Could not change vault passphrase")
+	}
+	// Opening the database checks the old passphrase too
+	db := credentialDB()
+	for i, saver := range savers {
+		saver.SaveData(newData[i])
+	}
+	if db != nil {
+		err = db.ChangePassphrase(newVaultPassphrase, kdfParameters(identities.DefaultArgon2idParameters()))
+		checkErr(err, "Could not change credential database passphrase")
+	}
+	fmt.Printf("Vault passphrase changed\n")
+}
+
+func listProfiles(cmd *cobra.Command, args []string) {
+	vault := profileVault()
+	profiles, err := vault.Profiles()
+	checkErr(err, "Could not read vault profiles")
+	active, err := vault.ActiveProfile()
+	checkErr(err, "Could not read vault profiles")
+	for _, profile := range profiles {
+		marker := " "
+		if profile == active {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\n", marker, profile)
+	}
+}
+
+func createProfile(cmd *cobra.Command, args []string) {
+	profiles, err := profileVault().Profiles()
+	checkErr(err, "Could not read vault profiles")
+	for _, profile := range profiles {
+		if profile == args[0] {
+			fmt.Printf("Profile %s already exists\n", args[0])
+			return
+		}
+	}
+	setupLogging()
+	createProfileClient(args[0], createApprover()).PersistDeviceIdentity()
+	fmt.Printf("Profile %s created\n", args[0])
+}
+
+func useProfile(cmd *cobra.Command, args []string) {
+	err := profileVault().SetActiveProfile(args[0])
+	checkErr(err, "Could not switch profile")
+	fmt.Printf("Using profile %s\n", args[0])
+}
+
+func deleteProfile(cmd *cobra.Command, args []string) {
+	if !prompt(fmt.Sprintf("Delete profile %s and all its credentials (y/N)?", args[0])) {
+		return
+	}
+	err := profileVault().DeleteProfile(args[0])
+	checkErr(err, "Could not delete profile")
+	if db := credentialDB(); db != nil {
+		err = db.DeleteProfile(args[0])
+		checkErr(err, "Could not delete profile credentials")
+	}
+	support := ClientSupport{vaultFilename: vaultFilename}
+	os.Remove(support.counterFilename(args[0]))
+	fmt.Printf("Profile %s deleted\n", args[0])
+}
+
+func setAAGUID(cmd *cobra.Command, args []string) {
+	client := createClient()
+	if len(args) > 0 {
+		aaguid, err := identities.ParseAAGUID(args[0])
+		checkErr(err, "Could not set AAGUID")
+		client.SetAAGUID(aaguid)
+	}
+	fmt.Println(identities.FormatAAGUID(client.AAGUID()))
+}
+
+func setAttestationFormat(cmd *cobra.Command, args []string) {
+	client := createClient()
+	if len(args) > 0 {
+		format, err := fido_client.ParseAttestationFormat(args[0])
+		checkErr(err, "Could not set attestation format")
+		client.SetAttestationFormat(format)
+	}
+	if keyDescriptionFilename != "" {
+		data, err := os.ReadFile(keyDescriptionFilename)
+		checkErr(err, "Could not read KeyDescription file")
+		// Fields left out of the file keep their current values
+		description := client.AndroidKeyDescription()
+		checkErr(json.Unmarshal(data, &description), "Could not parse KeyDescription file")
+		client.SetAndroidKeyDescription(description)
+	}
+	fmt.Println(client.AttestationFormat())
+}
+
+var keyDescriptionFilename string
+
+func setAlwaysUV(cmd *cobra.Command, args []string) {
+	client := createClient()
+	if len(args) > 0 {
+		if args[0] != "on" && args[0] != "off" {
+			checkErr(fmt.Errorf("Expected on or off, got %q", args[0]), "Could not set alwaysUv")
 		}
+		client.SetAlwaysUV(args[0] == "on")
+	}
+	if client.AlwaysUV() {
+		fmt.Println("on")
 	} else {
-		fmt.Printf("No identity found with prefix (%s)\n", identityID)
+		fmt.Println("off")
+	}
+}
+
+func registerMetadata(cmd *cobra.Command, args []string) {
+	client := createClient()
+	// A newly generated attestation CA has to stay the registered one
+	client.PersistDeviceIdentity()
+	payload, err := mds.ReadLocalMetadata(metadataFilename)
+	checkErr(err, "Could not load metadata")
+	payload.RegisterAuthenticator(client.AAGUID(), client.AttestationCA(), metadataDescription)
+	if metadataStatus != "" {
+		err = payload.AddStatusReport(client.AAGUID(), metadataStatus)
+		checkErr(err, "Could not add status report")
+	}
+	err = mds.WriteLocalMetadata(metadataFilename, payload)
+	checkErr(err, "Could not save metadata")
+	fmt.Printf("Registered %s in %s\n", identities.FormatAAGUID(client.AAGUID()), metadataFilename)
+	if metadataBlobFilename != "" {
+		root, err := mds.LoadOrCreateSigningRoot(metadataRootFilename)
+		checkErr(err, "Could not load MDS signing root")
+		blob, err := root.SignBLOB(payload)
+		checkErr(err, "Could not sign metadata blob")
+		err = os.WriteFile(metadataBlobFilename, blob, 0644)
+		checkErr(err, "Could not save metadata blob")
+		fmt.Printf("Signed metadata blob written to %s, trust the root certificate in %s\n", metadataBlobFilename, metadataRootFilename)
 	}
 }
 
@@ -91,38 +403,790 @@ func setPIN(cmd *cobra.Command, args []string) {
 	cmd.Println("PIN set")
 }
 
-func start(cmd *cobra.Command, args []string) {
+var otpSlot int
+var otpType string
+var otpPassword string
+var otpSecret string
+var otpDigits int
+var otpPeriod int
+var otpAppendEnter bool
+
+func setOTPSlot(cmd *cobra.Command, args []string) {
+	slot := identities.OTPSlot{
+		Slot:        otpSlot,
+		Type:        identities.OTPSlotType(otpType),
+		Password:    otpPassword,
+		Digits:      otpDigits,
+		Period:      otpPeriod,
+		AppendEnter: otpAppendEnter,
+	}
+	if otpSecret != "" {
+		// Authenticator apps show secrets as unpadded base32
+		secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(otpSecret, "=")))
+		if err != nil {
+			cmd.PrintErrf("Invalid secret: %s\n", err)
+			return
+		}
+		slot.Secret = secret
+	}
+	client := createClient()
+	if err := client.SetOTPSlot(slot); err != nil {
+		cmd.PrintErrf("Could not set OTP slot: %s\n", err)
+		return
+	}
+	cmd.Printf("OTP slot %d set\n", otpSlot)
+}
+
+func deleteOTPSlot(cmd *cobra.Command, args []string) {
+	client := createClient()
+	client.DeleteOTPSlot(otpSlot)
+	cmd.Printf("OTP slot %d deleted\n", otpSlot)
+}
+
+// serveOTPTrigger types a slot on POST /otp/<slot>
+func serveOTPTrigger(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/otp/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		slot, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/otp/"))
+		if err != nil {
+			http.Error(w, "Invalid slot", http.StatusBadRequest)
+			return
+		}
+		if err := virtualDevice.TriggerOTP(slot); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	fmt.Printf("OTP trigger listening on http://%s/otp/<slot>\n", address)
+	err := http.ListenAndServe(address, mux)
+	checkErr(err, "Could not serve OTP trigger")
+}
+
+var delegateSocket string
+
+// Where delegate listens. Registering a flag sets its default, so delegate's can't share start's --delegate.
+var delegateListenSocket string
+
+// File holding the secret shared by the delegate and its front-end, next to the socket by default
+var delegateSecretFilename string
+
+func delegateSecretPath(socket string) string {
+	if delegateSecretFilename != "" {
+		return delegateSecretFilename
+	}
+	return socket + ".secret"
+}
+
+// readDelegateSecret reads the secret shared with the delegate, which creates it at first start
+func readDelegateSecret(socket string, create bool) []byte {
+	path := delegateSecretPath(socket)
+	secret, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && create {
+		secret = []byte(hex.EncodeToString(crypto.RandomBytes(32)))
+		err = os.WriteFile(path, secret, 0600)
+	}
+	checkErr(err, "Could not read delegate secret")
+	return bytes.TrimSpace(secret)
+}
+
+// serveDelegate keeps the vault and approvals in this process, for a front-end started with
+// start --delegate
+func serveDelegate(cmd *cobra.Command, args []string) {
+	client := createClient()
+	secret := readDelegateSecret(delegateListenSocket, true)
+	listener, err := delegate.Listen(delegateListenSocket)
+	checkErr(err, "Could not listen on delegate socket")
+	defer listener.Close()
+	fmt.Printf("Delegate listening on %s\n", delegateListenSocket)
+	err = delegate.Serve(listener, client, secret)
+	checkErr(err, "Could not serve delegate")
+}
+
+var keyDaemonSocket string
+
+// Where keyd listens. Registering a flag sets its default, so keyd's can't share start's --keyd.
+var keyDaemonListenSocket string
+var keyDaemonSecretFilename string
+
+func readKeyDaemonSecret() []byte {
+	if keyDaemonSecretFilename == "" {
+		return nil
+	}
+	secret, err := os.ReadFile(keyDaemonSecretFilename)
+	checkErr(err, "Could not read key daemon secret")
+	return bytes.TrimSpace(secret)
+}
+
+// serveKeyDaemon answers the CTAP2 and U2F messages of a device started with start --keyd,
+// so the process handling USB traffic never holds a key
+func serveKeyDaemon(cmd *cobra.Command, args []string) {
 	client := createClient()
-	runServer(client)
+	os.Remove(keyDaemonListenSocket)
+	listener, err := net.Listen("unix", keyDaemonListenSocket)
+	checkErr(err, "Could not listen on key daemon socket")
+	defer listener.Close()
+	setCTAPOptions()
+	setAssertionRateLimits()
+	setupAudit(client)
+	fmt.Printf("Key daemon listening on %s\n", keyDaemonListenSocket)
+	err = virtual_fido.NewDevice(deviceOptions).ServeKeyDaemon(listener, client, readKeyDaemonSecret())
+	checkErr(err, "Could not serve key daemon")
+}
+
+var syncAddress string
+
+// Where sync serve listens, apart from start's --sync-listen like keyDaemonListenSocket
+var syncServeAddress string
+var syncName string
+var syncPair bool
+
+func listenForSync(client *fido_client.DefaultFIDOClient, address string) (*vault_sync.Syncer, net.Listener) {
+	syncer := vault_sync.NewSyncer(client, syncName)
+	listener, err := net.Listen("tcp", address)
+	checkErr(err, "Could not listen for sync")
+	fmt.Printf("Sync listening on %s\n", address)
+	if syncPair {
+		fmt.Printf("Pairing code: %s (valid for %s)\n", syncer.StartPairing(), vault_sync.PairingCodeLifetime)
+	}
+	return syncer, listener
+}
+
+// serveSync mirrors credentials with paired instances that connect, e.g. from a home server
+func serveSync(cmd *cobra.Command, args []string) {
+	syncer, listener := listenForSync(createClient(), syncServeAddress)
+	defer listener.Close()
+	err := syncer.Serve(listener)
+	checkErr(err, "Could not serve sync")
+}
+
+func pairSync(cmd *cobra.Command, args []string) {
+	syncer := vault_sync.NewSyncer(createClient(), syncName)
+	err := syncer.Pair("tcp", args[0], args[1])
+	checkErr(err, "Could not pair")
+	fmt.Printf("Paired and synced with %s\n", args[0])
+}
+
+func syncNow(cmd *cobra.Command, args []string) {
+	syncer := vault_sync.NewSyncer(createClient(), syncName)
+	err := syncer.Sync("tcp", args[0])
+	checkErr(err, "Could not sync")
+	fmt.Printf("Synced with %s\n", args[0])
+}
+
+func listSyncPeers(cmd *cobra.Command, args []string) {
+	client := createClient()
+	for _, peer := range client.SyncPeers() {
+		lastSynced := "never"
+		if !peer.LastSyncedAt.IsZero() {
+			lastSynced = peer.LastSyncedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%s: %s (last synced %s)\n", peer.Name, hex.EncodeToString(peer.PublicKey), lastSynced)
+	}
+}
+
+func unpairSync(cmd *cobra.Command, args []string) {
+	client := createClient()
+	for _, peer := range client.SyncPeers() {
+		if peer.Name == args[0] || hex.EncodeToString(peer.PublicKey) == args[0] {
+			client.RemoveSyncPeer(peer.PublicKey)
+			fmt.Printf("Unpaired %s\n", peer.Name)
+			return
+		}
+	}
+	fmt.Printf("No paired instance called %s\n", args[0])
+}
+
+func defaultSyncName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "virtual-fido"
+	}
+	return hostname
+}
+
+// startLocalClient opens the vault in this process, with the APIs that need direct access to it
+func startLocalClient() virtual_fido.Client {
+	client := createClient()
+	setupAudit(client)
+	if automationAddress != "" {
+		controller, err := client.EnableAutomation(fido_client.DefaultVirtualAuthenticatorOptions())
+		checkErr(err, "Could not enable automation mode")
+		go func() {
+			fmt.Printf("Automation API listening on http://%s/webauthn/\n", automationAddress)
+			err := http.ListenAndServe(automationAddress, http.StripPrefix("/webauthn", controller.Handler()))
+			checkErr(err, "Could not serve automation API")
+		}()
+	}
+	if approvalAddress != "" {
+		go func() {
+			fmt.Printf("Approval API listening on http://%s/approvals\n", approvalAddress)
+			err := http.ListenAndServe(approvalAddress, remoteApprovals.Handler())
+			checkErr(err, "Could not serve approval API")
+		}()
+	}
+	if syncAddress != "" {
+		syncer, listener := listenForSync(client, syncAddress)
+		go func() {
+			err := syncer.Serve(listener)
+			checkErr(err, "Could not serve sync")
+		}()
+	}
+	return client
+}
+
+// startProfileClients opens several profiles of the vault, each attached as its own device
+func startProfileClients() []virtual_fido.Client {
+	if delegateSocket != "" || automationAddress != "" || syncAddress != "" {
+		checkErr(fmt.Errorf("--delegate, --automation-address and --sync-listen need a single profile"), "Could not start profiles")
+	}
+	setupLogging()
+	approver := createApprover()
+	clients := make([]virtual_fido.Client, len(startProfiles))
+	for i, profile := range startProfiles {
+		clients[i] = createProfileClient(profile, approver)
+		fmt.Printf("Profile %s is device 2-%d\n", profile, i+2)
+	}
+	if approvalAddress != "" {
+		go func() {
+			fmt.Printf("Approval API listening on http://%s/approvals\n", approvalAddress)
+			err := http.ListenAndServe(approvalAddress, remoteApprovals.Handler())
+			checkErr(err, "Could not serve approval API")
+		}()
+	}
+	return clients
+}
+
+// Set from start's flags, with the device created from them once they all are
+var deviceOptions = virtual_fido.DefaultOptions()
+var virtualDevice *virtual_fido.Device
+
+func start(cmd *cobra.Command, args []string) {
+	var startDevice func()
+	var managedClient virtual_fido.Client
+	if proxyDevice != "" {
+		setupLogging()
+		path, err := proxyDevicePath()
+		checkErr(err, "Could not find key")
+		if len(proxySoftwareRPs) > 0 {
+			routes, err := hidproxy.SoftwareRoutes(proxySoftwareRPs)
+			checkErr(err, "Invalid --proxy-software-rp")
+			client := startLocalClient()
+			managedClient = client
+			fmt.Printf("Answering %s from the vault and forwarding other RPs to the key at %s\n", strings.Join(proxySoftwareRPs, ", "), path)
+			startDevice = func() {
+				err := virtualDevice.StartRoutedProxy(path, client, routes)
+				checkErr(err, "Could not start device")
+			}
+		} else {
+			fmt.Printf("Forwarding to the key at %s\n", path)
+			startDevice = func() {
+				err := virtualDevice.StartProxy(path)
+				checkErr(err, "Could not start device")
+			}
+		}
+	} else if keyDaemonSocket != "" {
+		setupLogging()
+		secret := readKeyDaemonSecret()
+		startDevice = func() {
+			err := virtualDevice.StartTransport("unix", keyDaemonSocket, secret)
+			checkErr(err, "Could not start device")
+		}
+	} else if len(startProfiles) > 0 {
+		clients := startProfileClients()
+		setupAudit(nil)
+		startDevice = func() {
+			err := virtualDevice.StartMultiple(clients)
+			checkErr(err, "Could not start devices")
+		}
+	} else {
+		var client virtual_fido.Client
+		if delegateSocket != "" {
+			remote, err := delegate.Dial("unix", delegateSocket, readDelegateSecret(delegateSocket, false))
+			checkErr(err, "Could not connect to delegate")
+			setupAudit(nil)
+			defer remote.Close()
+			client = remote
+		} else {
+			client = startLocalClient()
+		}
+		managedClient = client
+		startDevice = func() {
+			virtualDevice.Start(client)
+		}
+	}
+	if androidAVD != "" && usbredirAddress == "" {
+		usbredirAddress = usbredir.DefaultAddress
+	}
+	if usbredirAddress != "" {
+		startDevice = serveUSBRedir(startDevice)
+	}
+	if recordFilename != "" || inspectorAddress != "" {
+		// Without --record, the traffic is only streamed
+		var output io.Writer
+		if recordFilename != "" {
+			recordFile, err := os.Create(recordFilename)
+			checkErr(err, "Could not create session recording")
+			defer recordFile.Close()
+			output = recordFile
+		}
+		recorder := ctap_hid.NewSessionRecorder(output)
+		if inspectorAddress != "" {
+			serveInspector(recorder)
+		}
+		deviceOptions.SessionRecorder = recorder
+	}
+	if captureFilename != "" {
+		deviceOptions.USBCapturePath = captureFilename
+	}
+	switch usbSpeed {
+	case "full":
+		deviceOptions.USBSpeed = virtual_fido.USBSpeedFull
+	case "high":
+		if !cmd.Flags().Changed("usb-interval") {
+			// Every 8 microframes, i.e. once per millisecond
+			usbInterval = 4
+		}
+		deviceOptions.USBSpeed = virtual_fido.USBSpeedHigh
+	default:
+		cmd.PrintErrf("Invalid USB speed: %s\n", usbSpeed)
+		return
+	}
+	deviceOptions.USBPacketSize = usbPacketSize
+	deviceOptions.USBInterval = usbInterval
+	deviceOptions.USBReportID = usbReportID
+	deviceOptions.InterruptPolling = interruptPolling
+	setCTAPOptions()
+	setAssertionRateLimits()
+	deviceOptions.Watchdog = watchdogDeadline
+	deviceOptions.PIV = enablePIV
+	deviceOptions.OTP = otpAddress != ""
+	virtualDevice = virtual_fido.NewDevice(deviceOptions)
+	if otpAddress != "" {
+		go serveOTPTrigger(otpAddress)
+	}
+	if metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			mux.Handle("/debug/vars", expvar.Handler())
+			fmt.Printf("Metrics listening on http://%s/metrics\n", metricsAddress)
+			err := http.ListenAndServe(metricsAddress, mux)
+			checkErr(err, "Could not serve metrics")
+		}()
+	}
+	if qemuMonitorPath != "" {
+		go attachQEMU(managedClient)
+	}
+	if androidAVD != "" {
+		go runAndroidEmulator()
+	}
+	setupSystemd()
+	if managementAddress != "" {
+		device := serveManagement(startDevice, managedClient)
+		runServer(device.run)
+		// Keep serving the management API, which can attach the device again
+		select {}
+	}
+	runServer(startDevice)
+}
+
+func setupLogging() {
+	virtual_fido.SetLogOutput(os.Stdout)
+	if verbose {
+		virtual_fido.SetLogLevel(virtual_fido.LogLevelTrace)
+	} else {
+		virtual_fido.SetLogLevel(virtual_fido.LogLevelDebug)
+	}
+	if jsonLogs {
+		virtual_fido.SetLogFormat(virtual_fido.LogFormatJSON)
+	}
+}
+
+// newSimulatedPresence touches the authenticator by itself, on SIGUSR1, on POST /touch, or
+// on the touch hotkey
+func newSimulatedPresence() *fido_client.SimulatedPresence {
+	var presence *fido_client.SimulatedPresence
+	switch simulatedPresence {
+	case "auto":
+		presence = fido_client.NewSimulatedPresence(touchLatency, touchJitter)
+	case "manual", "":
+		presence = fido_client.NewManualPresence()
+	default:
+		checkErr(fmt.Errorf("%s is not auto or manual", simulatedPresence), "Invalid simulated presence")
+	}
+	signals := make(chan os.Signal, 1)
+	if notifyTouchSignal(signals) {
+		fmt.Printf("Touch the authenticator with: kill -USR1 %d\n", os.Getpid())
+		go func() {
+			for range signals {
+				if !presence.Touch() {
+					fmt.Println("Touched, but no request was waiting")
+				}
+			}
+		}()
+	}
+	if touchAddress != "" {
+		go func() {
+			fmt.Printf("Touch API listening on http://%s/touch\n", touchAddress)
+			err := http.ListenAndServe(touchAddress, presence.Handler())
+			checkErr(err, "Could not serve touch API")
+		}()
+	}
+	if touchHotkey != "" {
+		key, err := hotkey.Parse(touchHotkey)
+		checkErr(err, "Invalid touch hotkey")
+		_, err = hotkey.Listen(key, func() {
+			if !presence.Touch() {
+				fmt.Println("Touched, but no request was waiting")
+			}
+		})
+		checkErr(err, "Could not listen for the touch hotkey")
+		fmt.Printf("Touch the authenticator with %s\n", key)
+	}
+	return presence
+}
+
+func setAssertionRateLimits() {
+	var perDevice, perRelyingParty util.RateLimit
+	var err error
+	if deviceAssertionLimit != "" {
+		perDevice, err = util.ParseRateLimit(deviceAssertionLimit)
+		checkErr(err, "Invalid --device-assertion-rate-limit")
+	}
+	if relyingPartyAssertionLimit != "" {
+		perRelyingParty, err = util.ParseRateLimit(relyingPartyAssertionLimit)
+		checkErr(err, "Invalid --assertion-rate-limit")
+	}
+	deviceOptions.DeviceAssertionLimit = perDevice
+	deviceOptions.RelyingPartyAssertionLimit = perRelyingParty
+}
+
+func setCTAPOptions() {
+	deviceOptions.MaxMessageSize = maxMessageSize
+	deviceOptions.CTAPTimeouts = ctapTimeouts
+	deviceOptions.ReadOnly = readOnly
+	deviceOptions.ConformanceMode = conformanceMode
+	deviceOptions.MakeCredUVNotRequired = makeCredUVNotRequired
 }
 
 func createClient() *fido_client.DefaultFIDOClient {
+	setupLogging()
+	return createProfileClient(currentProfile(), createApprover())
+}
+
+func createApprover() fido_client.ClientRequestApprover {
+	var approver fido_client.ClientRequestApprover = fido_client.NewTerminalApprover(os.Stdin, os.Stdout, autoApproveTimeout)
+	if desktopNotifications {
+		ui, err := fido_client.NewDesktopApprovalUI()
+		checkErr(err, "Could not use desktop notifications")
+		if ui == nil {
+			fmt.Println("Desktop notifications are not supported on this platform, using the terminal")
+		} else {
+			approver = fido_client.NewApprovalUIApprover(ui, 2*time.Minute)
+		}
+	}
+	if approvalWebhook != "" || approvalAddress != "" || managementAddress != "" {
+		remoteApprovals = fido_client.NewRemoteApprovalUI(approvalWebhook, approvalSecret, 2*time.Minute)
+		approver = fido_client.NewApprovalUIApprover(remoteApprovals, 2*time.Minute)
+	}
+	if simulatedPresence != "" || touchHotkey != "" {
+		approver = newSimulatedPresence()
+	}
+	if policyFilename != "" {
+		policyData, err := os.ReadFile(policyFilename)
+		checkErr(err, "Could not read policy file")
+		policy, err := fido_client.ParsePolicy(policyData)
+		checkErr(err, "Could not parse policy file")
+		approver = fido_client.NewPolicyApprover(policy, approver)
+	}
+	return approver
+}
+
+func createProfileClient(profile string, approver fido_client.ClientRequestApprover) *fido_client.DefaultFIDOClient {
 	// ALL OF THIS IS INSECURE, FOR TESTING PURPOSES ONLY
 	caPrivateKey, err := identities.CreateCAPrivateKey()
 	checkErr(err, "Could not generate attestation CA private key")
 	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
-	encryptionKey := sha256.Sum256([]byte("test"))
+	// Seals U2F key handles. A new vault gets a random one, and afterwards it's read from the
+	// vault, which is protected by the passphrase.
+	var encryptionKey [32]byte
+	copy(encryptionKey[:], crypto.GenerateSymmetricKey())
 
-	virtual_fido.SetLogOutput(os.Stdout)
-	if verbose {
-		virtual_fido.SetLogLevel(util.LogLevelTrace)
-	} else {
-		virtual_fido.SetLogLevel(util.LogLevelDebug)
+	saver, err := profileVault().Profile(profile)
+	checkErr(err, "Could not open profile")
+	if db := credentialDB(); db != nil {
+		saver = fido_client.WithCredentialStore(saver, db.Profile(profile))
+	}
+	var client *fido_client.DefaultFIDOClient
+	util.Try(func() {
+		client = fido_client.NewDefaultClient(certificateAuthority, caPrivateKey, encryptionKey, false, approver, saver)
+	}, func(val interface{}) {
+		// Only worth decrypting again once loading failed
+		_, err := identities.DecryptFIDOState(saver.RetrieveData(), vaultPassphrase)
+		exitIfDamaged(err, fmt.Sprintf("Profile %s of %s", profile, vaultFilename))
+		panic(val)
+	})
+	if params := kdfParameters(client.KDFParameters()); params != client.KDFParameters() {
+		err := client.SetKDFParameters(params)
+		checkErr(err, "Invalid KDF parameters")
+	}
+	client.SetDerivedCredentials(derivedCredentials)
+	switch credentialIDFormat {
+	case "", "random16":
+		client.SetCredentialIDFormat(fido_client.CredentialIDFormatRandom16)
+	case "random32":
+		client.SetCredentialIDFormat(fido_client.CredentialIDFormatRandom32)
+	case "wrapped":
+		client.SetCredentialIDFormat(fido_client.CredentialIDFormatWrapped)
+	default:
+		checkErr(fmt.Errorf("Expected random16, random32 or wrapped, got %q", credentialIDFormat), "Invalid credential ID format")
+	}
+	switch backupEligibility {
+	case "", "sync":
+		client.SetBackupEligibility(fido_client.BackupEligibilitySync)
+	case "never":
+		client.SetBackupEligibility(fido_client.BackupEligibilityNever)
+	case "always":
+		client.SetBackupEligibility(fido_client.BackupEligibilityAlways)
+	default:
+		checkErr(fmt.Errorf("Expected sync, never or always, got %q", backupEligibility), "Invalid backup eligibility")
 	}
-	support := ClientSupport{vaultFilename: vaultFilename, vaultPassphrase: vaultPassphrase}
-	return fido_client.NewDefaultClient(certificateAuthority, caPrivateKey, encryptionKey, false, &support, &support)
+	client.SetMaxCredentials(maxCredentials)
+	client.SetAttestationIntermediates(attestationIntermediates)
+	if vaultWatchInterval > 0 {
+		// Picks up changes made by other commands while the device is running
+		client.WatchVault(vaultWatchInterval)
+	}
+	return client
+}
+
+var derivedCredentials bool
+var credentialIDFormat string
+var backupEligibility string
+var maxCredentials int
+var attestationIntermediates int
+var vaultWatchInterval time.Duration
+
+var profileName string
+var startProfiles []string
+var openedProfiles *fido_client.ProfileVault
+
+var credentialDBFilename string
+var openedCredentialDB *credential_db.DB
+
+// credentialDB opens --credential-db, or returns nil if credentials are kept in the vault
+func credentialDB() *credential_db.DB {
+	if credentialDBFilename != "" && openedCredentialDB == nil {
+		var err error
+		openedCredentialDB, err = credential_db.Open(credentialDBFilename, vaultPassphrase, kdfParameters(identities.DefaultArgon2idParameters()))
+		checkErr(err, "Could not open credential database")
+	}
+	return openedCredentialDB
+}
+
+// profileVault opens the profiles in the vault file. Clients of several profiles share it,
+// so their saves don't overwrite each other.
+func profileVault() *fido_client.ProfileVault {
+	if openedProfiles == nil {
+		openedProfiles = fido_client.NewProfileVault(&ClientSupport{vaultFilename: vaultFilename, vaultPassphrase: vaultPassphrase, backups: vaultBackups})
+	}
+	return openedProfiles
+}
+
+var auditLogFilename string
+var auditKeyFilename string
+var canaryIDs []string
+var canaryWebhook string
+
+// setupAudit records assertion attempts in --audit-log and alerts when the --canary
+// credentials of client are asked for. Canaries can't be found without a local vault.
+func setupAudit(client *fido_client.DefaultFIDOClient) {
+	if auditLogFilename == "" && len(canaryIDs) == 0 {
+		return
+	}
+	var next audit.Auditor
+	if auditLogFilename != "" {
+		key, err := audit.LoadOrCreateKey(auditKeyFilename)
+		checkErr(err, "Could not load audit key")
+		log, err := audit.OpenLog(auditLogFilename, key)
+		checkErr(err, "Could not open audit log")
+		next = log
+	}
+	canaries := audit.NewCanaryAuditor(next, alertCanary)
+	for _, prefix := range canaryIDs {
+		if client == nil {
+			checkErr(fmt.Errorf("--canary needs the vault in this process"), "Could not set up canaries")
+		}
+		credential := findIdentity(client, prefix)
+		if credential == nil {
+			checkErr(fmt.Errorf("No single credential with prefix %s", prefix), "Could not set up canaries")
+		}
+		canaries.AddCanary(credential.ID)
+	}
+	deviceOptions.Auditor = canaries
+}
+
+func alertCanary(attempt audit.Attempt) {
+	fmt.Printf("CANARY: Credential asked for by %s (%s)\n", attempt.RelyingPartyID, attempt.Outcome)
+	if canaryWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(attempt)
+	checkErr(err, "Could not encode canary alert")
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(canaryWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Could not send canary alert: %s\n", err)
+		return
+	}
+	response.Body.Close()
+}
+
+func verifyAuditLog(cmd *cobra.Command, args []string) {
+	key, err := audit.LoadKey(auditKeyFilename)
+	checkErr(err, "Could not load audit key")
+	file, err := os.Open(args[0])
+	checkErr(err, "Could not open audit log")
+	defer file.Close()
+	attempts, err := audit.VerifyLog(file, key.Public().(ed25519.PublicKey))
+	for _, attempt := range attempts {
+		canary := ""
+		if attempt.Canary {
+			canary = " CANARY"
+		}
+		fmt.Printf("%s %s %s: %s%s\n", attempt.Time.Local().Format(time.RFC3339), attempt.Protocol, attempt.RelyingPartyID, attempt.Outcome, canary)
+	}
+	checkErr(err, "Audit log does not verify")
+	fmt.Printf("%d entries verified\n", len(attempts))
+}
+
+var auditExportFilename string
+var previousAuditExportFilename string
+
+func exportAuditLog(cmd *cobra.Command, args []string) {
+	key, err := audit.LoadKey(auditKeyFilename)
+	checkErr(err, "Could not load audit key")
+	file, err := os.Open(args[0])
+	checkErr(err, "Could not open audit log")
+	defer file.Close()
+	export, err := audit.ExportLog(file, key)
+	checkErr(err, "Could not export audit log")
+	data, err := json.MarshalIndent(export, "", "  ")
+	checkErr(err, "Could not encode audit log export")
+	err = os.WriteFile(auditExportFilename, data, 0600)
+	checkErr(err, "Could not write audit log export")
+	fmt.Printf("Exported %d entries with root %x\n", export.Checkpoint.Size, export.Checkpoint.Root)
+}
+
+func readAuditExport(filename string) *audit.Export {
+	data, err := os.ReadFile(filename)
+	checkErr(err, "Could not read audit log export")
+	export := &audit.Export{}
+	err = json.Unmarshal(data, export)
+	checkErr(err, "Could not decode audit log export")
+	return export
+}
+
+// verifyAuditExport checks an export with the audit key, or the key in the export if there
+// isn't one, since exports are usually verified away from the authenticator
+func verifyAuditExport(cmd *cobra.Command, args []string) {
+	export := readAuditExport(args[0])
+	publicKey := export.PublicKey
+	if cmd.Flags().Changed("audit-key") {
+		key, err := audit.LoadKey(auditKeyFilename)
+		checkErr(err, "Could not load audit key")
+		publicKey = key.Public().(ed25519.PublicKey)
+	}
+	var previous *audit.Checkpoint
+	if previousAuditExportFilename != "" {
+		previous = &readAuditExport(previousAuditExportFilename).Checkpoint
+	}
+	attempts, err := audit.VerifyExport(export, publicKey, previous)
+	checkErr(err, "Audit log export does not verify")
+	fmt.Printf("%d entries verified with key %x and root %x\n", len(attempts), publicKey, export.Checkpoint.Root)
+}
+
+// currentProfile is the profile chosen with --profile, or else the active one
+func currentProfile() string {
+	if profileName != "" {
+		return profileName
+	}
+	active, err := profileVault().ActiveProfile()
+	checkErr(err, "Could not read vault profiles")
+	return active
+}
+
+var argon2Time uint32
+var argon2Memory uint32
+var argon2Threads uint8
+
+// kdfParameters overrides params with the KDF flags that were given
+func kdfParameters(params identities.Argon2idParameters) identities.Argon2idParameters {
+	if argon2Time != 0 {
+		params.Time = argon2Time
+	}
+	if argon2Memory != 0 {
+		params.Memory = argon2Memory
+	}
+	if argon2Threads != 0 {
+		params.Threads = argon2Threads
+	}
+	return params
+}
+
+// addCTAPTimeoutFlags adds the CTAP2 timers, which default to the spec's limits
+func addCTAPTimeoutFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&ctapTimeouts.UserPresence, "user-presence-timeout", ctapTimeouts.UserPresence, "How long user presence collected with a PIN token is reused for the next request to the same RP")
+	cmd.Flags().DurationVar(&ctapTimeouts.PINTokenInitialUse, "pin-token-unused-timeout", ctapTimeouts.PINTokenInitialUse, "How long a new PIN token can go unused before it expires")
+	cmd.Flags().DurationVar(&ctapTimeouts.PINTokenLifetime, "pin-token-lifetime", ctapTimeouts.PINTokenLifetime, "How long a PIN token can be used after it's issued")
+	cmd.Flags().DurationVar(&ctapTimeouts.UserAction, "user-action-timeout", ctapTimeouts.UserAction, "How long requests wait for approval before timing out (0 waits forever)")
 }
 
 var rootCmd = &cobra.Command{
-	Use:   "demo",
-	Short: "Run Virtual FIDO demo",
-	Long:  `demo attaches a virtual FIDO2 device for logging in with WebAuthN`,
+	Use:              "demo",
+	Short:            "Run Virtual FIDO demo",
+	Long:             `demo attaches a virtual FIDO2 device for logging in with WebAuthN`,
+	PersistentPreRun: setupCryptoProvider,
+}
+
+// setupCryptoProvider seals the vault and key handles to the --seal-key file as well as the
+// passphrase, so both are needed to read them, and signs with RFC 6979 nonces if asked
+func setupCryptoProvider(cmd *cobra.Command, args []string) {
+	if randomSeed != "" {
+		fmt.Printf("WARNING: Generating keys from --insecure-random-seed, anyone with the seed can recreate them\n")
+		crypto.SetRandom(crypto.NewSeededRandom([]byte(randomSeed)))
+	}
+	var provider crypto.Provider = crypto.StdlibProvider{}
+	if sealKeyFilename != "" {
+		fileKey, err := crypto.LoadOrCreateFileKey(sealKeyFilename)
+		checkErr(err, "Could not load seal key")
+		provider = fileKey
+	}
+	if deterministicSignatures {
+		provider = crypto.DeterministicProvider{Provider: provider}
+	}
+	crypto.SetProvider(provider)
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&vaultFilename, "vault", "", "vault.json", "Identity vault filename")
 	rootCmd.PersistentFlags().StringVarP(&vaultPassphrase, "passphrase", "", "passphrase", "Identity vault passphrase")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	rootCmd.PersistentFlags().Uint32Var(&argon2Time, "argon2-time", 0, "Re-encrypt the vault with this many Argon2id passes (default 3)")
+	rootCmd.PersistentFlags().Uint32Var(&argon2Memory, "argon2-memory", 0, "Re-encrypt the vault with this much Argon2id memory in KiB (default 65536)")
+	rootCmd.PersistentFlags().Uint8Var(&argon2Threads, "argon2-threads", 0, "Re-encrypt the vault with this Argon2id parallelism (default 4)")
+	rootCmd.PersistentFlags().BoolVarP(&jsonLogs, "json-logs", "", false, "Output logs as JSON lines")
+	rootCmd.PersistentFlags().StringVar(&sealKeyFilename, "seal-key", "", "Also seal the vault and key handles to an X25519 key in this file, created if it doesn't exist")
+	rootCmd.PersistentFlags().BoolVar(&deterministicSignatures, "deterministic-signatures", false, "Sign with RFC 6979 nonces instead of random ones, with arithmetic that isn't constant-time")
+	rootCmd.PersistentFlags().StringVar(&randomSeed, "insecure-random-seed", "", "Generate credential and attestation keys and credential IDs from this seed, so runs are reproducible. Nonces and tokens stay random. Only for tests.")
+	rootCmd.PersistentFlags().IntVar(&vaultBackups, "vault-backups", 3, "Copies of the vault to keep as it's replaced, <vault>.1 being the newest")
+	rootCmd.PersistentFlags().StringVar(&credentialDBFilename, "credential-db", "", "Keep credentials in this database, indexed by RP and credential ID, instead of the vault file")
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "Vault profile to use, created when first saved (default the active profile)")
 	rootCmd.MarkFlagRequired("vault")
 	rootCmd.MarkFlagRequired("passphrase")
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
@@ -132,6 +1196,63 @@ func init() {
 		Short: "Attach virtual FIDO device",
 		Run:   start,
 	}
+	start.Flags().DurationVar(&autoApproveTimeout, "auto-approve-after", 0, "Approve requests automatically if not answered within this time (e.g. 5s)")
+	start.Flags().StringVar(&simulatedPresence, "simulated-presence", "", "Approve requests without asking: auto (after --touch-latency) or manual (on SIGUSR1 or --touch-address)")
+	start.Flags().DurationVar(&touchLatency, "touch-latency", 200*time.Millisecond, "How long simulated touches take in auto mode")
+	start.Flags().DurationVar(&touchJitter, "touch-jitter", 0, "Random extra delay of up to this long for each simulated touch")
+	start.Flags().StringVar(&touchHotkey, "touch-hotkey", "", "Touch the authenticator when this global hotkey is pressed (e.g. ctrl+alt+t), approving requests without asking")
+	start.Flags().StringVar(&touchAddress, "touch-address", "", "Serve POST /touch on this address to touch the simulated authenticator (e.g. localhost:8093)")
+	start.Flags().BoolVar(&desktopNotifications, "desktop-notifications", false, "Ask for approval with desktop notifications instead of the terminal")
+	start.Flags().StringVar(&approvalWebhook, "approval-webhook", "", "Post approval requests to this URL and wait for them to be answered through the approval API")
+	start.Flags().StringVar(&managementAddress, "management-address", "", "Serve the management API for credentials, attaching, log levels and approvals on this address (e.g. localhost:8093). Approvals are then answered through it")
+	start.Flags().StringVar(&managementToken, "management-token", "", "Bearer token for the management API (default a random token, printed at startup)")
+	start.Flags().StringVar(&approvalAddress, "approval-address", "", "Serve the API that lists and answers approval requests on this address (e.g. localhost:8092)")
+	start.Flags().StringVar(&approvalSecret, "approval-secret", "", "Secret that signs approval webhooks and must be sent as a bearer token to the approval API")
+	start.Flags().StringVar(&delegateSocket, "delegate", "", "Use the vault and approvals of a delegate process listening on this Unix socket instead of opening the vault")
+	start.Flags().StringVar(&delegateSecretFilename, "delegate-secret-file", "", "File holding the secret shared with the delegate (default the socket path with .secret appended)")
+	start.Flags().BoolVar(&derivedCredentials, "derived-credentials", false, "Derive non-resident credentials from the device key instead of storing them in the vault")
+	start.Flags().StringVar(&credentialIDFormat, "credential-id-format", "random16", "IDs of new credentials: random16 or random32 (stored in the vault), or wrapped (non-resident keys sealed into the ID)")
+	start.Flags().StringVar(&backupEligibility, "backup-eligibility", "sync", "Which new credentials are passkeys that may be synced (BE flag): sync (if paired with another instance), never or always")
+	start.Flags().IntVar(&maxCredentials, "max-credentials", 0, "Refuse new credentials with CTAP2_ERR_KEY_STORE_FULL once the vault holds this many (default no limit)")
+	start.Flags().IntVar(&attestationIntermediates, "attestation-intermediates", 0, "Issue attestation certificates through this many intermediate CAs, sent in x5c, so RPs have to build the chain")
+	start.Flags().StringVar(&auditLogFilename, "audit-log", "", "Append every assertion attempt to this signed log")
+	start.Flags().StringVar(&auditKeyFilename, "audit-key", "audit-key.pem", "PEM file with the Ed25519 key signing the audit log, created if missing")
+	start.Flags().StringSliceVar(&canaryIDs, "canary", nil, "ID prefix of a canary credential, whose use is flagged in the audit log and alerted")
+	start.Flags().StringVar(&canaryWebhook, "canary-webhook", "", "POST canary alerts as JSON to this URL")
+	start.Flags().DurationVar(&watchdogDeadline, "watchdog", 0, "Fail URBs and requests still being handled after this long (e.g. 2m), logging what was running. 0 lets them run forever")
+	start.Flags().BoolVar(&readOnly, "read-only", false, "Refuse new credentials and PIN changes, so only existing credentials can be used")
+	start.Flags().BoolVar(&conformanceMode, "conformance", false, "Answer as the FIDO Alliance conformance tools expect of a CTAP 2.0 authenticator, and allow authenticatorReset")
+	start.Flags().BoolVar(&makeCredUVNotRequired, "make-cred-uv-not-required", false, "Create non-resident credentials without the PIN unless alwaysUv is on (makeCredUvNotRqd)")
+	start.Flags().StringVar(&relyingPartyAssertionLimit, "assertion-rate-limit", "", "Limit assertions for each RP, e.g. 10/1m, failing the rest before asking for approval")
+	start.Flags().StringVar(&deviceAssertionLimit, "device-assertion-rate-limit", "", "Limit assertions on all CTAPHID channels together, e.g. 5/10s, answering the rest with ERR_CHANNEL_BUSY")
+	start.Flags().DurationVar(&vaultWatchInterval, "watch-vault", 0, "Check the vault file this often and reload it if another command changed it (e.g. 1s; default never)")
+	start.Flags().StringVar(&keyDaemonSocket, "keyd", "", "Forward CTAP2 and U2F messages to a key daemon listening on this Unix socket instead of opening the vault")
+	start.Flags().StringVar(&keyDaemonSecretFilename, "keyd-secret-file", "", "File holding the secret shared with the key daemon")
+	start.Flags().StringVar(&proxyDevice, "proxy", "", "Forward all traffic to a real FIDO key at this hidraw device (e.g. /dev/hidraw3), or auto for the only key attached, instead of opening the vault (Linux)")
+	start.Flags().StringSliceVar(&proxySoftwareRPs, "proxy-software-rp", nil, "With --proxy, answer these RP IDs (globs, e.g. *.example.com) from the vault and forward only the other RPs to the key")
+	start.Flags().StringVar(&usbredirAddress, "usbredir", "", "Serve the device over usbredir on this address (e.g. localhost:4000) for QEMU's usb-redir device and SPICE, instead of over USB/IP")
+	start.Flags().StringVar(&androidAVD, "android-avd", "", "Boot the Android emulator with this AVD and attach the device to it over usbredir (at --usbredir, or "+usbredir.DefaultAddress+")")
+	start.Flags().StringVar(&qemuMonitorPath, "qemu-qmp", "", "Once attached, pass the device through to the QEMU guest whose QMP monitor listens on this Unix socket (Linux)")
+	start.Flags().StringVar(&policyFilename, "policy", "", "JSON file of per-RP allow/deny/ask rules applied before asking for approval")
+	start.Flags().StringVar(&automationAddress, "automation", "", "Enable test automation mode and serve the WebDriver-style API on this address (e.g. localhost:8090)")
+	start.Flags().StringVar(&metricsAddress, "metrics", "", "Serve Prometheus metrics and expvars on this address (e.g. localhost:9090)")
+	start.Flags().StringVar(&inspectorAddress, "inspector-address", "", "Stream decoded CTAPHID traffic and device events over a WebSocket on this address (e.g. localhost:8094), with a page to watch them. The URL with its token is printed at startup")
+	start.Flags().StringVar(&recordFilename, "record", "", "Record all CTAPHID traffic to this file for replay")
+	start.Flags().StringVar(&captureFilename, "pcap", "", "Capture USB/IP traffic to this pcapng file for Wireshark (Linux and Windows)")
+	start.Flags().StringVar(&usbSpeed, "usb-speed", "full", "USB speed reported over USB/IP: full or high")
+	start.Flags().Uint16Var(&usbPacketSize, "usb-packet-size", 64, "HID report size in bytes; up to 1024 at high speed")
+	start.Flags().Uint8Var(&usbInterval, "usb-interval", 255, "Endpoint polling interval: milliseconds at full speed, an exponent from 1 to 16 at high speed")
+	start.Flags().Uint8Var(&usbReportID, "usb-report-id", 0, "Prefix HID reports with this report ID, for hosts that expect one (default no report ID)")
+	start.Flags().DurationVar(&interruptPolling.EmptyPollTimeout, "empty-poll-timeout", interruptPolling.EmptyPollTimeout, "How long an interrupt IN poll waits for data before completing empty; 0 waits until there is data")
+	start.Flags().Float64Var(&interruptPolling.NAKRate, "nak-rate", 0, "Chance of NAKing an interrupt IN poll while data is ready, holding it for another polling interval")
+	addCTAPTimeoutFlags(start)
+	start.Flags().Uint32Var(&maxMessageSize, "max-msg-size", 0, "Largest CTAP request in bytes, advertised in GetInfo (default as large as the packet size allows)")
+	start.Flags().StringSliceVar(&startProfiles, "profiles", nil, "Attach a separate device for each of these profiles (e.g. work,personal) instead of one for --profile")
+	start.Flags().StringVar(&syncAddress, "sync-listen", "", "Mirror credentials with paired instances that connect to this address (e.g. :8765)")
+	start.Flags().StringVar(&syncName, "sync-name", defaultSyncName(), "Name shown to instances this one pairs with")
+	start.Flags().BoolVar(&syncPair, "sync-pair", false, "Print a code to pair a new instance with sync pair")
+	start.Flags().BoolVar(&enablePIV, "piv", false, "Also expose a PIV smartcard over CCID, backed by the vault (Linux and Windows)")
+	start.Flags().StringVar(&otpAddress, "otp", "", "Also expose a keyboard that types OTP slots, triggered with POST /otp/<slot> on this address (Linux and Windows)")
 	rootCmd.AddCommand(start)
 
 	list := &cobra.Command{
@@ -142,14 +1263,181 @@ func init() {
 	rootCmd.AddCommand(list)
 
 	delete := &cobra.Command{
-		Use:   "delete",
+		Use:   "delete [id]",
 		Short: "Delete identity in vault",
+		Args:  cobra.MaximumNArgs(1),
 		Run:   deleteIdentity,
 	}
 	delete.Flags().StringVar(&identityID, "identity", "", "Identity hash to delete")
-	delete.MarkFlagRequired("identity")
 	rootCmd.AddCommand(delete)
 
+	rename := &cobra.Command{
+		Use:   "rename <id> <nickname>",
+		Short: "Set the nickname of an identity in vault",
+		Args:  cobra.ExactArgs(2),
+		Run:   renameIdentity,
+	}
+	rootCmd.AddCommand(rename)
+
+	policyCommand := &cobra.Command{
+		Use:   "login-policy <id> <approve|pin|silent>",
+		Short: "Set whether logins with an identity ask for approval, also require the PIN, or are silent",
+		Args:  cobra.ExactArgs(2),
+		Run:   setIdentityPolicy,
+	}
+	rootCmd.AddCommand(policyCommand)
+
+	export := &cobra.Command{
+		Use:   "export",
+		Short: "Export vault to an encrypted backup file",
+		Run:   exportVault,
+	}
+	export.Flags().StringVar(&transferFilename, "file", "", "Backup filename")
+	export.Flags().StringVar(&transferPassphrase, "export-passphrase", "", "Backup passphrase (defaults to the vault passphrase)")
+	export.MarkFlagRequired("file")
+	rootCmd.AddCommand(export)
+
+	importCommand := &cobra.Command{
+		Use:   "import",
+		Short: "Import a vault backup or credentials from another soft token",
+		Run:   importVault,
+	}
+	importCommand.Flags().StringVar(&transferFilename, "file", "", "Backup filename")
+	importCommand.Flags().StringVar(&transferPassphrase, "export-passphrase", "", "Backup passphrase (defaults to the vault passphrase)")
+	importCommand.Flags().StringVar(&importFormat, "format", "virtual-fido", "Backup format: virtual-fido, softu2f or rust-u2f")
+	importCommand.MarkFlagRequired("file")
+	rootCmd.AddCommand(importCommand)
+
+	reset := &cobra.Command{
+		Use:   "reset",
+		Short: "Delete all identities and the PIN in vault",
+		Run:   resetVault,
+	}
+	rootCmd.AddCommand(reset)
+
+	passwd := &cobra.Command{
+		Use:   "passwd",
+		Short: "Change the vault passphrase",
+		Run:   changePassphrase,
+	}
+	passwd.Flags().StringVar(&newVaultPassphrase, "new-passphrase", "", "New vault passphrase")
+	passwd.MarkFlagRequired("new-passphrase")
+	rootCmd.AddCommand(passwd)
+
+	backups := &cobra.Command{
+		Use:   "backups",
+		Short: "List the backups of the vault and check that they can be decrypted",
+		Run:   listBackups,
+	}
+	rootCmd.AddCommand(backups)
+
+	restore := &cobra.Command{
+		Use:   "restore-backup <n>",
+		Short: "Replace the vault with backup n, e.g. after a power loss damaged it",
+		Args:  cobra.ExactArgs(1),
+		Run:   restoreBackup,
+	}
+	rootCmd.AddCommand(restore)
+
+	auditCommand := &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log of assertion attempts",
+	}
+	verifyAuditCommand := &cobra.Command{
+		Use:   "verify <log>",
+		Short: "Check the signatures of an audit log and print its attempts",
+		Args:  cobra.ExactArgs(1),
+		Run:   verifyAuditLog,
+	}
+	verifyAuditCommand.Flags().StringVar(&auditKeyFilename, "audit-key", "audit-key.pem", "PEM file with the Ed25519 key that signed the log")
+	auditCommand.AddCommand(verifyAuditCommand)
+	exportAuditCommand := &cobra.Command{
+		Use:   "export <log>",
+		Short: "Write a signed checkpoint and copy of an audit log for safekeeping",
+		Args:  cobra.ExactArgs(1),
+		Run:   exportAuditLog,
+	}
+	exportAuditCommand.Flags().StringVar(&auditKeyFilename, "audit-key", "audit-key.pem", "PEM file with the Ed25519 key that signed the log")
+	exportAuditCommand.Flags().StringVarP(&auditExportFilename, "output", "o", "audit-export.json", "File to write the export to")
+	auditCommand.AddCommand(exportAuditCommand)
+	verifyExportCommand := &cobra.Command{
+		Use:   "verify-export <export>",
+		Short: "Check an audit log export, and that it contains every entry of an earlier one",
+		Args:  cobra.ExactArgs(1),
+		Run:   verifyAuditExport,
+	}
+	verifyExportCommand.Flags().StringVar(&auditKeyFilename, "audit-key", "audit-key.pem", "PEM file with the Ed25519 key that signed the log, instead of the key in the export")
+	verifyExportCommand.Flags().StringVar(&previousAuditExportFilename, "after", "", "Earlier export whose entries must all be in this one")
+	auditCommand.AddCommand(verifyExportCommand)
+	rootCmd.AddCommand(auditCommand)
+
+	profileCommand := &cobra.Command{
+		Use:   "profile",
+		Short: "Manage the profiles in the vault, each with its own credentials, PIN and AAGUID",
+	}
+	profileCommand.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List profiles, marking the active one",
+		Run:   listProfiles,
+	})
+	profileCommand.AddCommand(&cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an empty profile",
+		Args:  cobra.ExactArgs(1),
+		Run:   createProfile,
+	})
+	profileCommand.AddCommand(&cobra.Command{
+		Use:   "use <name>",
+		Short: "Use a profile when --profile isn't given",
+		Args:  cobra.ExactArgs(1),
+		Run:   useProfile,
+	})
+	profileCommand.AddCommand(&cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete a profile and its credentials",
+		Args:  cobra.ExactArgs(1),
+		Run:   deleteProfile,
+	})
+	rootCmd.AddCommand(profileCommand)
+
+	aaguidCommand := &cobra.Command{
+		Use:   "aaguid [aaguid]",
+		Short: "Show or change the AAGUID of the device",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   setAAGUID,
+	}
+	rootCmd.AddCommand(aaguidCommand)
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:       "always-uv [on|off]",
+		Short:     "Show or change whether every request needs user verification (CTAP 2.1 alwaysUv)",
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{"on", "off"},
+		Run:       setAlwaysUV,
+	})
+
+	attestationFormatCommand := &cobra.Command{
+		Use:       "attestation-format [packed|apple|android-key|android-safetynet]",
+		Short:     "Show or change the attestation format of new credentials, e.g. apple to emulate Apple's anonymous attestation",
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{"packed", "apple", "android-key", "android-safetynet"},
+		Run:       setAttestationFormat,
+	}
+	attestationFormatCommand.Flags().StringVar(&keyDescriptionFilename, "key-description", "", "JSON file with the fields of the KeyDescription in android-key certificates, e.g. {\"attestation_security_level\": 0, \"software_enforced\": true}")
+	rootCmd.AddCommand(attestationFormatCommand)
+
+	metadataCommand := &cobra.Command{
+		Use:   "metadata",
+		Short: "Register the device's AAGUID and attestation root in a local FIDO metadata file",
+		Run:   registerMetadata,
+	}
+	metadataCommand.Flags().StringVar(&metadataFilename, "file", "metadata.json", "Local metadata file to create or update")
+	metadataCommand.Flags().StringVar(&metadataDescription, "description", "Virtual FIDO", "Authenticator description")
+	metadataCommand.Flags().StringVar(&metadataStatus, "status", "", "Add a status report, e.g. REVOKED or FIDO_CERTIFIED")
+	metadataCommand.Flags().StringVar(&metadataBlobFilename, "blob", "", "Also write a signed MDS3 blob (JWT) to this file")
+	metadataCommand.Flags().StringVar(&metadataRootFilename, "signing-root", "mds-root.pem", "PEM file with the MDS signing root, created if missing")
+	rootCmd.AddCommand(metadataCommand)
+
 	pinCommand := &cobra.Command{
 		Use:   "pin",
 		Short: "Modify PIN Behavior",
@@ -175,6 +1463,142 @@ func init() {
 	setPINCommand.MarkFlagRequired("pin")
 	pinCommand.AddCommand(setPINCommand)
 	rootCmd.AddCommand(pinCommand)
+
+	delegateCommand := &cobra.Command{
+		Use:   "delegate",
+		Short: "Serve the vault and approvals to a front-end started with start --delegate",
+		Run:   serveDelegate,
+	}
+	delegateCommand.Flags().StringVar(&delegateListenSocket, "socket", "virtual-fido.sock", "Unix socket to listen on, only by this user")
+	delegateCommand.Flags().StringVar(&delegateSecretFilename, "secret-file", "", "File holding the secret shared with the front-end, created if missing (default the socket path with .secret appended)")
+	delegateCommand.Flags().StringVar(&policyFilename, "policy", "", "JSON file of per-RP allow/deny/ask rules applied before asking for approval")
+	delegateCommand.Flags().BoolVar(&derivedCredentials, "derived-credentials", false, "Derive non-resident credentials from the device key instead of storing them in the vault")
+	delegateCommand.Flags().StringVar(&credentialIDFormat, "credential-id-format", "random16", "IDs of new credentials: random16 or random32 (stored in the vault), or wrapped (non-resident keys sealed into the ID)")
+	delegateCommand.Flags().StringVar(&backupEligibility, "backup-eligibility", "sync", "Which new credentials are passkeys that may be synced (BE flag): sync (if paired with another instance), never or always")
+	delegateCommand.Flags().IntVar(&attestationIntermediates, "attestation-intermediates", 0, "Issue attestation certificates through this many intermediate CAs, sent in x5c, so RPs have to build the chain")
+	delegateCommand.Flags().DurationVar(&vaultWatchInterval, "watch-vault", 0, "Check the vault file this often and reload it if another command changed it (e.g. 1s; default never)")
+	rootCmd.AddCommand(delegateCommand)
+
+	keyDaemonCommand := &cobra.Command{
+		Use:   "keyd",
+		Short: "Hold the vault and answer CTAP2 and U2F messages for a device started with start --keyd",
+		Run:   serveKeyDaemon,
+	}
+	keyDaemonCommand.Flags().StringVar(&keyDaemonListenSocket, "socket", "virtual-fido-keys.sock", "Unix socket to listen on")
+	keyDaemonCommand.Flags().StringVar(&keyDaemonSecretFilename, "secret-file", "", "File holding the secret shared with the transport")
+	keyDaemonCommand.Flags().StringVar(&policyFilename, "policy", "", "JSON file of per-RP allow/deny/ask rules applied before asking for approval")
+	keyDaemonCommand.Flags().BoolVar(&derivedCredentials, "derived-credentials", false, "Derive non-resident credentials from the device key instead of storing them in the vault")
+	keyDaemonCommand.Flags().StringVar(&credentialIDFormat, "credential-id-format", "random16", "IDs of new credentials: random16 or random32 (stored in the vault), or wrapped (non-resident keys sealed into the ID)")
+	addCTAPTimeoutFlags(keyDaemonCommand)
+	keyDaemonCommand.Flags().Uint32Var(&maxMessageSize, "max-msg-size", 0, "Largest CTAP request in bytes, advertised in GetInfo; should match the transport")
+	keyDaemonCommand.Flags().StringVar(&backupEligibility, "backup-eligibility", "sync", "Which new credentials are passkeys that may be synced (BE flag): sync (if paired with another instance), never or always")
+	keyDaemonCommand.Flags().IntVar(&attestationIntermediates, "attestation-intermediates", 0, "Issue attestation certificates through this many intermediate CAs, sent in x5c, so RPs have to build the chain")
+	keyDaemonCommand.Flags().StringVar(&auditLogFilename, "audit-log", "", "Append every assertion attempt to this signed log")
+	keyDaemonCommand.Flags().StringVar(&auditKeyFilename, "audit-key", "audit-key.pem", "PEM file with the Ed25519 key signing the audit log, created if missing")
+	keyDaemonCommand.Flags().StringSliceVar(&canaryIDs, "canary", nil, "ID prefix of a canary credential, whose use is flagged in the audit log and alerted")
+	keyDaemonCommand.Flags().StringVar(&canaryWebhook, "canary-webhook", "", "POST canary alerts as JSON to this URL")
+	keyDaemonCommand.Flags().BoolVar(&readOnly, "read-only", false, "Refuse new credentials and PIN changes, so only existing credentials can be used")
+	keyDaemonCommand.Flags().BoolVar(&conformanceMode, "conformance", false, "Answer as the FIDO Alliance conformance tools expect of a CTAP 2.0 authenticator, and allow authenticatorReset")
+	keyDaemonCommand.Flags().BoolVar(&makeCredUVNotRequired, "make-cred-uv-not-required", false, "Create non-resident credentials without the PIN unless alwaysUv is on (makeCredUvNotRqd)")
+	keyDaemonCommand.Flags().StringVar(&relyingPartyAssertionLimit, "assertion-rate-limit", "", "Limit assertions for each RP, e.g. 10/1m, failing the rest before asking for approval")
+	keyDaemonCommand.Flags().DurationVar(&vaultWatchInterval, "watch-vault", 0, "Check the vault file this often and reload it if another command changed it (e.g. 1s; default never)")
+	rootCmd.AddCommand(keyDaemonCommand)
+
+	syncCommand := &cobra.Command{
+		Use:   "sync",
+		Short: "Mirror credentials between paired virtual-fido instances",
+	}
+	syncCommand.PersistentFlags().StringVar(&syncName, "name", defaultSyncName(), "Name shown to instances this one pairs with")
+	serveSyncCommand := &cobra.Command{
+		Use:   "serve",
+		Short: "Sync with paired instances that connect",
+		Run:   serveSync,
+	}
+	serveSyncCommand.Flags().StringVar(&syncServeAddress, "listen", ":8765", "Address to listen on")
+	serveSyncCommand.Flags().BoolVar(&syncPair, "pair", false, "Print a code to pair a new instance with sync pair")
+	syncCommand.AddCommand(serveSyncCommand)
+	syncCommand.AddCommand(&cobra.Command{
+		Use:   "pair <address> <code>",
+		Short: "Pair with an instance showing a pairing code, then sync with it",
+		Args:  cobra.ExactArgs(2),
+		Run:   pairSync,
+	})
+	syncCommand.AddCommand(&cobra.Command{
+		Use:   "now <address>",
+		Short: "Sync with a paired instance",
+		Args:  cobra.ExactArgs(1),
+		Run:   syncNow,
+	})
+	syncCommand.AddCommand(&cobra.Command{
+		Use:   "peers",
+		Short: "List paired instances",
+		Run:   listSyncPeers,
+	})
+	syncCommand.AddCommand(&cobra.Command{
+		Use:   "unpair <name>",
+		Short: "Stop syncing with a paired instance",
+		Args:  cobra.ExactArgs(1),
+		Run:   unpairSync,
+	})
+	rootCmd.AddCommand(syncCommand)
+
+	otpCommand := &cobra.Command{
+		Use:   "otp",
+		Short: "Configure the OTP slots typed by the keyboard",
+	}
+	setOTPCommand := &cobra.Command{
+		Use:   "set",
+		Short: "Sets an OTP slot",
+		Run:   setOTPSlot,
+	}
+	setOTPCommand.Flags().IntVar(&otpSlot, "slot", 1, "Slot number, 1 or 2")
+	setOTPCommand.Flags().StringVar(&otpType, "type", "totp", "Slot type: static, hotp or totp")
+	setOTPCommand.Flags().StringVar(&otpPassword, "password", "", "Password typed by a static slot")
+	setOTPCommand.Flags().StringVar(&otpSecret, "secret", "", "Base32 secret of an HOTP or TOTP slot")
+	setOTPCommand.Flags().IntVar(&otpDigits, "digits", 6, "Digits in HOTP and TOTP codes")
+	setOTPCommand.Flags().IntVar(&otpPeriod, "period", 30, "TOTP time step in seconds")
+	setOTPCommand.Flags().BoolVar(&otpAppendEnter, "enter", false, "Press enter after typing the password")
+	otpCommand.AddCommand(setOTPCommand)
+	deleteOTPCommand := &cobra.Command{
+		Use:   "delete",
+		Short: "Clears an OTP slot",
+		Run:   deleteOTPSlot,
+	}
+	deleteOTPCommand.Flags().IntVar(&otpSlot, "slot", 1, "Slot number, 1 or 2")
+	otpCommand.AddCommand(deleteOTPCommand)
+	rootCmd.AddCommand(otpCommand)
+
+	smartCardCommand := &cobra.Command{
+		Use:   "smartcard",
+		Short: "Put the PIV card in a pcscd reader through virtualsmartcard's vpcd driver, without USB/IP",
+		Run:   serveSmartCard,
+	}
+	smartCardCommand.Flags().StringVar(&smartCardAddress, "address", vpcd.DefaultAddress, "Address vpcd listens on")
+	rootCmd.AddCommand(smartCardCommand)
+
+	sshKeyCommand := &cobra.Command{
+		Use:   "ssh-key",
+		Short: "Create an OpenSSH security key backed by a resident credential in the vault",
+		Run:   createSSHKey,
+	}
+	sshKeyCommand.Flags().StringVar(&sshKeyType, "type", string(identities.SSHKeyTypeECDSASK), "Key type, only ecdsa-sk")
+	sshKeyCommand.Flags().StringVar(&sshKeyFilename, "file", "", "Private key filename, with the public key next to it in .pub (default ~/.ssh/id_ecdsa_sk)")
+	sshKeyCommand.Flags().StringVar(&sshApplication, "application", identities.DefaultSSHApplication, "Application (RP ID) of the credential, starting with ssh:")
+	sshKeyCommand.Flags().StringVar(&sshUser, "user", "", "User name telling resident keys for the same application apart; a key replaces any with the same application and user")
+	sshKeyCommand.Flags().StringVar(&sshComment, "comment", "", "Comment of the key")
+	sshKeyCommand.Flags().BoolVar(&sshNoTouchRequired, "no-touch-required", false, "Let the key sign without approval, which the server must allow with no-touch-required")
+	sshKeyCommand.Flags().BoolVar(&sshVerifyRequired, "verify-required", false, "Require the PIN for every signature")
+	rootCmd.AddCommand(sshKeyCommand)
+
+	devToolsCommand := &cobra.Command{
+		Use:   "devtools",
+		Short: "Register the vault as a virtual authenticator of a Chrome page through the DevTools protocol, without USB",
+		Run:   serveDevTools,
+	}
+	devToolsCommand.Flags().StringVar(&devToolsAddress, "debugger-address", cdp.DefaultDebuggerAddress, "Address of Chrome's DevTools, from --remote-debugging-port")
+	devToolsCommand.Flags().StringVar(&devToolsPageURL, "page", "", "webSocketDebuggerUrl of the page to add the authenticator to (default the first page open)")
+	devToolsCommand.Flags().BoolVar(&devToolsUserVerified, "user-verified", true, "Pass user verification without asking")
+	rootCmd.AddCommand(devToolsCommand)
 }
 
 func main() {
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/cdp"
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/spf13/cobra"
+)
+
+var devToolsAddress string
+var devToolsPageURL string
+var devToolsUserVerified bool
+
+// serveDevTools registers the vault as a virtual authenticator of a Chrome page, until the
+// page is closed
+func serveDevTools(cmd *cobra.Command, args []string) {
+	client := createClient()
+	pageURL := devToolsPageURL
+	if pageURL == "" {
+		var err error
+		pageURL, err = cdp.PageURL(devToolsAddress)
+		checkErr(err, "Could not find a Chrome page")
+	}
+	conn, err := cdp.Dial(pageURL)
+	checkErr(err, "Could not connect to Chrome")
+	defer conn.Close()
+	options := fido_client.DefaultVirtualAuthenticatorOptions()
+	options.HasUserVerification = true
+	options.IsUserVerified = devToolsUserVerified
+	authenticator, err := cdp.AddAuthenticator(conn, client, options)
+	checkErr(err, "Could not add virtual authenticator")
+	fmt.Printf("Added virtual authenticator %s to %s\n", authenticator.ID(), pageURL)
+	<-conn.Done()
+	fmt.Println("Page closed")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	virtual_fido "github.com/bulwarkid/virtual-fido"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/inspector"
+)
+
+var inspectorAddress string
+
+// serveInspector streams the traffic seen by recorder and the device's events to browsers
+func serveInspector(recorder *ctap_hid.SessionRecorder) {
+	server := inspector.NewServer(hex.EncodeToString(crypto.RandomBytes(16)))
+	recorder.OnEvent(server.PublishSession)
+	go server.Forward(virtual_fido.SubscribeEvents(64))
+	go func() {
+		fmt.Printf("Inspector listening on http://%s/?token=%s\n", inspectorAddress, server.Token)
+		err := http.ListenAndServe(inspectorAddress, server.Handler())
+		checkErr(err, "Could not serve inspector")
+	}()
+}
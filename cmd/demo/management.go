@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+
+	virtual_fido "github.com/bulwarkid/virtual-fido"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/management"
+)
+
+var managementAddress string
+var managementToken string
+
+// managedDevice lets the management API detach the device and attach it again
+type managedDevice struct {
+	startDevice func()
+	lock        sync.Mutex
+	attached    bool
+}
+
+// run attaches the device and blocks until it's detached
+func (device *managedDevice) run() {
+	device.lock.Lock()
+	device.attached = true
+	device.lock.Unlock()
+	device.startDevice()
+	device.lock.Lock()
+	device.attached = false
+	device.lock.Unlock()
+}
+
+func (device *managedDevice) Attach() error {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if device.attached {
+		return fmt.Errorf("Device is already attached")
+	}
+	// Marked attached before run starts, so two requests can't both attach it
+	device.attached = true
+	go device.run()
+	go attachUSBIP()
+	return nil
+}
+
+func (device *managedDevice) Detach() error {
+	if !device.Attached() {
+		return fmt.Errorf("Device is not attached")
+	}
+	return virtualDevice.Stop()
+}
+
+func (device *managedDevice) Attached() bool {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	return device.attached
+}
+
+// serveManagement serves the management API for client, returning the device to start in
+// place of startDevice
+func serveManagement(startDevice func(), client virtual_fido.Client) *managedDevice {
+	device := &managedDevice{startDevice: startDevice}
+	server := &management.Server{Token: managementToken, Device: device}
+	if vault, ok := client.(management.Vault); ok {
+		server.Vault = vault
+	}
+	if remoteApprovals != nil {
+		server.Approvals = remoteApprovals
+	}
+	if server.Token == "" {
+		server.Token = hex.EncodeToString(crypto.RandomBytes(16))
+		fmt.Printf("Management API token: %s\n", server.Token)
+	}
+	go func() {
+		fmt.Printf("Management API listening on http://%s/\n", managementAddress)
+		err := http.ListenAndServe(managementAddress, server.Handler())
+		checkErr(err, "Could not serve management API")
+	}()
+	return device
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bulwarkid/virtual-fido/hidproxy"
+)
+
+var proxyDevice string
+var proxySoftwareRPs []string
+
+// proxyDevicePath resolves --proxy auto to the only FIDO key attached
+func proxyDevicePath() (string, error) {
+	if proxyDevice != "auto" {
+		return proxyDevice, nil
+	}
+	devices, err := hidproxy.FindDevices()
+	if err != nil {
+		return "", err
+	}
+	switch len(devices) {
+	case 0:
+		return "", fmt.Errorf("No FIDO keys found")
+	case 1:
+		return devices[0], nil
+	default:
+		return "", fmt.Errorf("Several FIDO keys found, choose one of: %s", strings.Join(devices, ", "))
+	}
+}
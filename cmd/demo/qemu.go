@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	virtual_fido "github.com/bulwarkid/virtual-fido"
+	"github.com/bulwarkid/virtual-fido/qemu"
+)
+
+var qemuMonitorPath string
+
+// attachQEMU passes the device through to the QEMU guest once USB/IP has attached it here,
+// giving the user time to answer sudo's password prompt
+func attachQEMU(client virtual_fido.Client) {
+	serial := ""
+	if identity, ok := client.(virtual_fido.DeviceIdentity); ok {
+		serial = identity.SerialNumber()
+	}
+	err := qemu.Attach(qemuMonitorPath, serial, 2*time.Minute)
+	if err != nil {
+		fmt.Printf("Could not pass the device through to QEMU: %s\n", err)
+		return
+	}
+	fmt.Printf("Passed the device through to the QEMU guest at %s\n", qemuMonitorPath)
+}
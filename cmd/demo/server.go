@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	virtual_fido "github.com/bulwarkid/virtual-fido"
-	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/filelock"
 )
 
 func prompt(prompt string) bool {
@@ -32,28 +35,86 @@ func prompt(prompt string) bool {
 type ClientSupport struct {
 	vaultFilename   string
 	vaultPassphrase string
+	// Copies of the vault kept as it's replaced
+	backups int
 }
 
-func (support *ClientSupport) ApproveClientAction(action fido_client.ClientAction, params fido_client.ClientActionRequestParams) bool {
-	switch action {
-	case fido_client.ClientActionFIDOGetAssertion:
-		return prompt(fmt.Sprintf("Approve login for \"%s\" with identity \"%s\" (Y/n)?", params.RelyingParty, params.UserName))
-	case fido_client.ClientActionFIDOMakeCredential:
-		return prompt(fmt.Sprintf("Approve account creation for \"%s\" (Y/n)?", params.RelyingParty))
-	case fido_client.ClientActionU2FAuthenticate:
-		return prompt("Approve registration of U2F device (Y/n)?")
-	case fido_client.ClientActionU2FRegister:
-		return prompt("Approve use of U2F device (Y/n)?")
+// SaveData writes a new file and renames it over the vault, so a crash leaves either the old
+// or the new vault
+func (support *ClientSupport) SaveData(data []byte) {
+	support.rotateBackups()
+	writeFileAtomically(support.vaultFilename, data)
+}
+
+// backupFilename numbers the backups from 1, the newest
+func (support *ClientSupport) backupFilename(n int) string {
+	return fmt.Sprintf("%s.%d", support.vaultFilename, n)
+}
+
+// rotateBackups moves each backup along, dropping the oldest, and copies the vault to the first
+func (support *ClientSupport) rotateBackups() {
+	if support.backups <= 0 {
+		return
 	}
-	fmt.Printf("Unknown client action for approval: %d\n", action)
-	return false
+	current, err := os.ReadFile(support.vaultFilename)
+	if os.IsNotExist(err) {
+		return
+	}
+	checkErr(err, "Could not read vault")
+	for n := support.backups - 1; n >= 1; n-- {
+		err := os.Rename(support.backupFilename(n), support.backupFilename(n+1))
+		if !os.IsNotExist(err) {
+			checkErr(err, "Could not rotate vault backups")
+		}
+	}
+	writeFileAtomically(support.backupFilename(1), current)
 }
 
-func (support *ClientSupport) SaveData(data []byte) {
-	f, err := os.OpenFile(support.vaultFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-	checkErr(err, "Could not open vault file")
+func writeFileAtomically(filename string, data []byte) {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	checkErr(err, "Could not create temporary file")
 	_, err = f.Write(data)
-	checkErr(err, "Could not write vault data")
+	checkErr(err, "Could not write data")
+	err = f.Sync()
+	checkErr(err, "Could not sync data")
+	err = f.Close()
+	checkErr(err, "Could not close temporary file")
+	err = os.Rename(f.Name(), filename)
+	checkErr(err, "Could not replace file")
+	// The rename only survives a power loss once the directory is synced, which Windows
+	// doesn't allow
+	if runtime.GOOS != "windows" {
+		dir, err := os.Open(filepath.Dir(filename))
+		checkErr(err, "Could not open directory")
+		err = dir.Sync()
+		dir.Close()
+		checkErr(err, "Could not sync directory")
+	}
+}
+
+// The rollback counters are kept next to the vault, one for each profile. That only stops
+// the vault from being restored on its own, but shows where a TPM counter would go.
+func (support *ClientSupport) counterFilename(profile string) string {
+	// Vaults from before profiles have a single counter
+	if profile == identities.DefaultProfile {
+		return support.vaultFilename + ".counter"
+	}
+	return support.vaultFilename + "." + profile + ".counter"
+}
+
+func (support *ClientSupport) ProfileRollbackCounter(profile string) uint64 {
+	data, err := os.ReadFile(support.counterFilename(profile))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	checkErr(err, "Could not read rollback counter")
+	counter, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	checkErr(err, "Invalid rollback counter")
+	return counter
+}
+
+func (support *ClientSupport) SetProfileRollbackCounter(profile string, version uint64) {
+	writeFileAtomically(support.counterFilename(profile), []byte(strconv.FormatUint(version, 10)))
 }
 
 func (support *ClientSupport) RetrieveData() []byte {
@@ -62,35 +123,64 @@ func (support *ClientSupport) RetrieveData() []byte {
 		return nil
 	}
 	checkErr(err, "Could not open vault")
+	defer f.Close()
 	data, err := io.ReadAll(f)
 	checkErr(err, "Could not read vault data")
+	_, err = identities.ParseProfiles(data)
+	exitIfDamaged(err, support.vaultFilename)
 	return data
 }
 
+// LockVault locks a file next to the vault, since the vault itself is replaced on each save.
+// A daemon and CLI commands saving at once then don't lose each other's profiles.
+func (support *ClientSupport) LockVault(exclusive bool) (func(), error) {
+	lock, err := filelock.Acquire(support.vaultFilename+".lock", exclusive)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		err := lock.Release()
+		checkErr(err, "Could not unlock vault")
+	}, nil
+}
+
 func (support *ClientSupport) Passphrase() string {
 	return support.vaultPassphrase
 }
 
-func runServer(client virtual_fido.FIDOClient) {
+func runServer(startDevice func()) {
+	if socketActivated {
+		startDevice()
+		return
+	}
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
-		virtual_fido.Start(client)
+		startDevice()
 		wg.Done()
 	}()
 	go func() {
-		time.Sleep(500 * time.Millisecond)
-		prog := platformUSBIPExec()
-		if prog != nil {
-			prog.Stdin = os.Stdin
-			prog.Stdout = os.Stdout
-			prog.Stderr = os.Stderr
-			err := prog.Run()
-			if err != nil {
-				fmt.Printf("Error: %s\n", err)
-			}
-		}
+		attachUSBIP()
 		wg.Done()
 	}()
 	wg.Wait()
 }
+
+// attachUSBIP runs the platform's USB/IP client once the device server has started
+func attachUSBIP() {
+	if usbredirAddress != "" {
+		// The guest connects to the device itself
+		return
+	}
+	time.Sleep(500 * time.Millisecond)
+	prog := platformUSBIPExec()
+	if prog != nil {
+		prog.Stdin = os.Stdin
+		prog.Stdout = os.Stdout
+		prog.Stderr = os.Stderr
+		err := prog.Run()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+	}
+}
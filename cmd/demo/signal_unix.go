@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Touch the simulated authenticator with kill -USR1
+func notifyTouchSignal(signals chan<- os.Signal) bool {
+	signal.Notify(signals, syscall.SIGUSR1)
+	return true
+}
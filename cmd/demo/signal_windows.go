@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows has no SIGUSR1, so only the touch API can touch the simulated authenticator
+func notifyTouchSignal(signals chan<- os.Signal) bool {
+	return false
+}
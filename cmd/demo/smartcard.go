@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	virtual_fido "github.com/bulwarkid/virtual-fido"
+	"github.com/spf13/cobra"
+)
+
+var smartCardAddress string
+
+// serveSmartCard keeps the PIV card in vpcd's reader, reconnecting when pcscd restarts
+func serveSmartCard(cmd *cobra.Command, args []string) {
+	setupLogging()
+	client := createClient()
+	for {
+		fmt.Printf("Connecting to vpcd at %s\n", smartCardAddress)
+		err := virtual_fido.StartSmartCard(smartCardAddress, client)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		} else {
+			fmt.Printf("vpcd disconnected\n")
+		}
+		time.Sleep(time.Second)
+	}
+}
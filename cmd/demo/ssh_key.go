@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/spf13/cobra"
+)
+
+var sshKeyType string
+var sshKeyFilename string
+var sshApplication string
+var sshUser string
+var sshComment string
+var sshNoTouchRequired bool
+var sshVerifyRequired bool
+
+// createSSHKey writes the key files ssh-keygen would for a resident security key, backed by
+// a new credential in the vault
+func createSSHKey(cmd *cobra.Command, args []string) {
+	filename := sshKeyFilename
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		checkErr(err, "Could not find home directory")
+		filename = filepath.Join(home, ".ssh", "id_"+strings.ReplaceAll(sshKeyType, "-", "_"))
+	}
+	for _, name := range []string{filename, filename + ".pub"} {
+		if _, err := os.Stat(name); err == nil {
+			cmd.PrintErrf("%s already exists\n", name)
+			return
+		}
+	}
+	flags := identities.SSHKeyFlagUserPresence
+	if sshNoTouchRequired {
+		flags = 0
+	}
+	if sshVerifyRequired {
+		flags |= identities.SSHKeyFlagUserVerificationReqd
+	}
+	client := createClient()
+	key, err := client.NewSSHKey(identities.SSHKeyType(sshKeyType), sshApplication, sshUser, flags, sshComment)
+	if err != nil {
+		cmd.PrintErrf("Could not create SSH key: %s\n", err)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	checkErr(err, "Could not create key directory")
+	err = os.WriteFile(filename, key.PrivateKey, 0600)
+	checkErr(err, "Could not write private key")
+	err = os.WriteFile(filename+".pub", key.PublicKey, 0644)
+	checkErr(err, "Could not write public key")
+	fmt.Printf("Wrote %s and %s.pub\n", filename, filename)
+	fmt.Printf("Log in with the device attached: ssh -i %s <host>\n", filename)
+}
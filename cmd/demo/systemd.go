@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/bulwarkid/virtual-fido/systemd"
+	"github.com/bulwarkid/virtual-fido/usbip"
+)
+
+// Set when systemd passed in the USB/IP socket, so whoever connected to it attaches the device
+var socketActivated bool
+
+// setupSystemd uses the USB/IP socket from systemd socket activation, if there is one, and
+// tells systemd the device is ready. A Type=notify service without socket activation listens
+// here first, so it's only ready once USB/IP connections are accepted.
+func setupSystemd() {
+	listeners, err := systemd.Listeners()
+	checkErr(err, "Could not use sockets from systemd")
+	if len(listeners) > 0 {
+		for _, extra := range listeners[1:] {
+			extra.Close()
+		}
+		virtualDevice.SetUSBIPListener(listeners[0])
+		socketActivated = true
+	} else if systemd.Notifying() {
+		listener, err := net.Listen("tcp", usbip.DefaultAddress)
+		checkErr(err, "Could not listen for USB/IP")
+		virtualDevice.SetUSBIPListener(listener)
+	}
+	if err := systemd.Notify(systemd.NotifyReady); err != nil {
+		fmt.Printf("Could not notify systemd: %s\n", err)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+var usbredirAddress string
+
+// serveUSBRedir makes startDevice serve the device to a usbredir guest instead of USB/IP,
+// listening again each time it's attached
+func serveUSBRedir(startDevice func()) func() {
+	return func() {
+		listener, err := net.Listen("tcp", usbredirAddress)
+		checkErr(err, "Could not listen for usbredir")
+		fmt.Printf("usbredir listening on %s\n", usbredirAddress)
+		virtualDevice.SetUSBRedirListener(listener)
+		startDevice()
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"os"
 
+	"github.com/bulwarkid/virtual-fido/bench"
+	"github.com/bulwarkid/virtual-fido/conformance"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/u2f"
 	"github.com/fxamacker/cbor/v2"
 	"github.com/spf13/cobra"
 )
@@ -25,6 +33,111 @@ func decodeCbor(cmd *cobra.Command, args []string) {
 	fmt.Printf("%#v\n", cborStruct)
 }
 
+type replayApprover struct{}
+
+func (approver *replayApprover) ApproveClientAction(action fido_client.ClientAction, params fido_client.ClientActionRequestParams) bool {
+	return true
+}
+
+// Keeps the vault in memory so that replaying never modifies the original file
+type replayDataSaver struct {
+	data       []byte
+	passphrase string
+}
+
+func (saver *replayDataSaver) SaveData(data []byte) {
+	saver.data = data
+}
+
+func (saver *replayDataSaver) RetrieveData() []byte {
+	return saver.data
+}
+
+func (saver *replayDataSaver) Passphrase() string {
+	return saver.passphrase
+}
+
+var replayVaultFilename string
+var replayVaultPassphrase string
+
+func replaySession(cmd *cobra.Command, args []string) {
+	sessionFile, err := os.Open(args[0])
+	checkErr(err, "Could not open session recording")
+	defer sessionFile.Close()
+	events, err := ctap_hid.ReadSession(sessionFile)
+	checkErr(err, "Could not read session recording")
+
+	saver := &replayDataSaver{passphrase: replayVaultPassphrase}
+	if replayVaultFilename != "" {
+		saver.data, err = os.ReadFile(replayVaultFilename)
+		checkErr(err, "Could not read vault")
+	}
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	checkErr(err, "Could not generate attestation CA private key")
+	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
+	checkErr(err, "Could not generate attestation CA")
+	encryptionKey := sha256.Sum256([]byte("test"))
+	client := fido_client.NewDefaultClient(certificateAuthority, caPrivateKey, encryptionKey, false, &replayApprover{}, saver)
+	server := ctap_hid.NewCTAPHIDServer(ctap.NewCTAPServer(client), u2f.NewU2FServer(client))
+
+	mismatches := ctap_hid.ReplaySession(server, events)
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("Replay found %d mismatched responses\n", len(mismatches))
+		os.Exit(1)
+	}
+	fmt.Printf("Replayed %d events, all responses matched\n", len(events))
+}
+
+var benchConfig bench.Config
+
+func runBench(cmd *cobra.Command, args []string) {
+	result, err := bench.Run(benchConfig)
+	checkErr(err, "Load test failed")
+	fmt.Printf("Registrations: %s\n", result.Registrations)
+	fmt.Printf("Assertions:    %s\n", result.Assertions)
+}
+
+var conformanceVerbose bool
+
+func printConformanceReport(report conformance.Report) {
+	for _, section := range report.Sections() {
+		results := report.Section(section)
+		passed := 0
+		for _, result := range results {
+			if result.Passed() {
+				passed++
+			}
+		}
+		fmt.Printf("%s: %d/%d passed\n", section, passed, len(results))
+		for _, result := range results {
+			if !result.Passed() {
+				fmt.Printf("  FAIL %s: %s\n", result.Name, result.Err)
+			} else if conformanceVerbose {
+				fmt.Printf("  PASS %s\n", result.Name)
+			}
+		}
+	}
+}
+
+func runConformance(cmd *cobra.Command, args []string) {
+	authenticator, err := conformance.NewAuthenticator()
+	checkErr(err, "Could not create authenticator")
+	report := conformance.Run(authenticator)
+	u2fAuthenticator, err := conformance.NewU2FAuthenticator()
+	checkErr(err, "Could not create U2F authenticator")
+	u2fReport := conformance.RunU2F(u2fAuthenticator)
+	printConformanceReport(report)
+	printConformanceReport(u2fReport)
+	total := len(report.Results) + len(u2fReport.Results)
+	if failed := report.Failed() + u2fReport.Failed(); failed > 0 {
+		fmt.Printf("%d of %d vectors failed\n", failed, total)
+		os.Exit(1)
+	}
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "tools",
 	Short: "Virtual FIDO Tools",
@@ -42,6 +155,37 @@ func init() {
 	}
 	rootCmd.AddCommand(cborCommand)
 
+	replayCommand := &cobra.Command{
+		Use:   "replay <session file>",
+		Short: "Replay a session recorded with demo start --record and compare the responses",
+		Args:  cobra.ExactArgs(1),
+		Run:   replaySession,
+	}
+	replayCommand.Flags().StringVar(&replayVaultFilename, "vault", "", "Vault to start from (not modified)")
+	replayCommand.Flags().StringVar(&replayVaultPassphrase, "passphrase", "passphrase", "Vault passphrase")
+	rootCmd.AddCommand(replayCommand)
+
+	benchCommand := &cobra.Command{
+		Use:   "bench",
+		Short: "Load test registrations and assertions in process, without USB/IP",
+		Args:  cobra.NoArgs,
+		Run:   runBench,
+	}
+	benchCommand.Flags().IntVar(&benchConfig.Registrations, "registrations", 100, "Credentials to register")
+	benchCommand.Flags().IntVar(&benchConfig.Assertions, "assertions", 1000, "Assertions to get, spread over the credentials")
+	benchCommand.Flags().BoolVar(&benchConfig.ResidentKeys, "resident-keys", false, "Register resident credentials")
+	benchCommand.Flags().DurationVar(&benchConfig.TouchLatency, "touch-latency", 0, "How long the simulated user takes to touch the authenticator")
+	benchCommand.Flags().DurationVar(&benchConfig.TouchJitter, "touch-jitter", 0, "Random extra delay added to each touch")
+	rootCmd.AddCommand(benchCommand)
+
+	conformanceCommand := &cobra.Command{
+		Use:   "conformance",
+		Short: "Check new in-process authenticators against CTAP2 and U2F request vectors, by section of the spec",
+		Args:  cobra.NoArgs,
+		Run:   runConformance,
+	}
+	conformanceCommand.Flags().BoolVarP(&conformanceVerbose, "verbose", "v", false, "List passing vectors too")
+	rootCmd.AddCommand(conformanceCommand)
 }
 
 func main() {
@@ -0,0 +1,157 @@
+// Package conformance checks a CTAP2 or U2F authenticator against request vectors based on
+// the CTAP 2.0 and U2F raw message specs, both well-formed and malformed, so regressions can
+// be caught without the FIDO Alliance conformance tools
+package conformance
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/u2f"
+)
+
+// Authenticator handles a CTAP2 message, a command byte followed by CBOR parameters, and
+// returns a status byte followed by the CBOR response. U2F servers take APDUs instead and
+// return the response followed by a status word.
+type Authenticator interface {
+	HandleMessage(data []byte) []byte
+}
+
+// Result is the outcome of one vector
+type Result struct {
+	Section string
+	Name    string
+	// Why the vector failed, or nil if it passed
+	Err error
+}
+
+func (result Result) Passed() bool {
+	return result.Err == nil
+}
+
+type Report struct {
+	Results []Result
+}
+
+// Sections returns the sections of the spec covered by the report, in the order they ran
+func (report Report) Sections() []string {
+	var sections []string
+	seen := make(map[string]bool)
+	for _, result := range report.Results {
+		if !seen[result.Section] {
+			seen[result.Section] = true
+			sections = append(sections, result.Section)
+		}
+	}
+	return sections
+}
+
+// Section returns the results of the vectors in section
+func (report Report) Section(section string) []Result {
+	var results []Result
+	for _, result := range report.Results {
+		if result.Section == section {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func (report Report) Failed() int {
+	failed := 0
+	for _, result := range report.Results {
+		if !result.Passed() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Run sends every vector to authenticator in order. Later vectors use the credential and PIN
+// set up by earlier ones, so authenticator should be new, e.g. from NewAuthenticator.
+func Run(authenticator Authenticator) Report {
+	session := &session{authenticator: authenticator}
+	report := Report{}
+	for _, vector := range vectors {
+		err := vector.run(session)
+		report.Results = append(report.Results, Result{Section: vector.section, Name: vector.name, Err: err})
+	}
+	return report
+}
+
+// RunU2F sends every U2F vector to authenticator in order, like Run
+func RunU2F(authenticator Authenticator) Report {
+	session := &u2fSession{authenticator: authenticator}
+	report := Report{}
+	for _, vector := range u2fVectors {
+		err := vector.run(session)
+		report.Results = append(report.Results, Result{Section: vector.section, Name: vector.name, Err: err})
+	}
+	return report
+}
+
+type memoryDataSaver struct {
+	data []byte
+}
+
+func (saver *memoryDataSaver) SaveData(data []byte) {
+	saver.data = data
+}
+
+func (saver *memoryDataSaver) RetrieveData() []byte {
+	return saver.data
+}
+
+func (saver *memoryDataSaver) Passphrase() string {
+	return "conformance"
+}
+
+func newClient() (*fido_client.DefaultFIDOClient, error) {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey := sha256.Sum256(crypto.RandomBytes(32))
+	presence := fido_client.NewSimulatedPresence(0, 0)
+	client := fido_client.NewDefaultClient(certificateAuthority, caPrivateKey, encryptionKey, false, presence, &memoryDataSaver{})
+	if err := client.SetKDFParameters(identities.Argon2idParameters{Time: 1, Memory: 64, Threads: 1}); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewAuthenticator creates a CTAP2 server with PIN support and an empty in-memory vault,
+// which approves every request by itself
+func NewAuthenticator() (*ctap.CTAPServer, error) {
+	client, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	client.EnablePIN()
+	return ctap.NewCTAPServer(client), nil
+}
+
+// NewU2FAuthenticator creates a U2F server with an empty in-memory vault, which approves
+// every request by itself
+func NewU2FAuthenticator() (*u2f.U2FServer, error) {
+	client, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	return u2f.NewU2FServer(client), nil
+}
+
+func expectStatus(status byte, expected byte) error {
+	if status != expected {
+		return fmt.Errorf("Expected status 0x%02x, got 0x%02x", expected, status)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package conformance
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestRun(t *testing.T) {
+	authenticator, err := NewAuthenticator()
+	test.Assert(t, err == nil, "Could not create authenticator")
+	report := Run(authenticator)
+	for _, result := range report.Results {
+		if !result.Passed() {
+			t.Errorf("%s: %s: %s", result.Section, result.Name, result.Err)
+		}
+	}
+	test.AssertEqual(t, len(report.Results), len(vectors), "Every vector should run")
+}
+
+type brokenAuthenticator struct{}
+
+func (authenticator brokenAuthenticator) HandleMessage(data []byte) []byte {
+	return []byte{statusSuccess}
+}
+
+func TestRunReportsFailures(t *testing.T) {
+	report := Run(brokenAuthenticator{})
+	test.Assert(t, report.Failed() == len(report.Results), "Every vector should fail")
+	test.AssertArrEqual(t, report.Sections(), []string{sectionMessageEncoding, sectionGetInfo, sectionMakeCredential, sectionGetAssertion, sectionClientPIN}, "Sections should be in order")
+	test.AssertEqual(t, len(report.Section(sectionGetInfo)), 2, "Results should be grouped by section")
+	report = RunU2F(brokenAuthenticator{})
+	test.Assert(t, report.Failed() == len(report.Results), "Every U2F vector should fail")
+}
+
+func TestRunU2F(t *testing.T) {
+	authenticator, err := NewU2FAuthenticator()
+	test.Assert(t, err == nil, "Could not create authenticator")
+	report := RunU2F(authenticator)
+	for _, result := range report.Results {
+		if !result.Passed() {
+			t.Errorf("%s: %s: %s", result.Section, result.Name, result.Err)
+		}
+	}
+	test.AssertEqual(t, len(report.Results), len(u2fVectors), "Every vector should run")
+}
@@ -0,0 +1,194 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/internal/verifier"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+var update = flag.Bool("update", false, "Rewrite testdata/golden.json from the current authenticator")
+
+var goldenPath = filepath.Join("testdata", "golden.json")
+
+// goldenExchange is one request and response, hex encoded so diffs show which bytes changed
+type goldenExchange struct {
+	Name     string `json:"name"`
+	Request  string `json:"request"`
+	Response string `json:"response"`
+	// Set when made from nonces, key agreement keys or the PIN token, which come from
+	// crypto/rand even when seeded, so they're different every run and aren't compared
+	RandomRequest  bool `json:"randomRequest,omitempty"`
+	RandomResponse bool `json:"randomResponse,omitempty"`
+}
+
+// recordingAuthenticator keeps every exchange, including the ClientPIN ones that set up a
+// PIN token, since later responses depend on them
+type recordingAuthenticator struct {
+	authenticator  Authenticator
+	name           string
+	randomRequest  bool
+	randomResponse bool
+	exchanges      []goldenExchange
+}
+
+func (recorder *recordingAuthenticator) HandleMessage(data []byte) []byte {
+	response := recorder.authenticator.HandleMessage(data)
+	recorder.exchanges = append(recorder.exchanges, goldenExchange{
+		Name:           recorder.name,
+		Request:        hex.EncodeToString(data),
+		Response:       hex.EncodeToString(response),
+		RandomRequest:  recorder.randomRequest,
+		RandomResponse: recorder.randomResponse,
+	})
+	return response
+}
+
+// runGoldenSession registers and asserts with a new authenticator in deterministic mode,
+// checking each response with the independent verifier
+func runGoldenSession(t *testing.T) []goldenExchange {
+	crypto.SetRandom(crypto.NewSeededRandom([]byte("virtual-fido golden vectors")))
+	defer crypto.SetRandom(nil)
+	util.SetClock(util.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+	defer util.SetClock(nil)
+	authenticator, err := NewAuthenticator()
+	test.Assert(t, err == nil, "Could not create authenticator")
+	recorder := &recordingAuthenticator{authenticator: authenticator}
+	session := &session{authenticator: recorder}
+	var credentials []*verifier.Credential
+
+	register := func(name string, args map[int]interface{}) *verifier.Credential {
+		recorder.name = name
+		response := recorder.HandleMessage(message(commandMakeCredential, args))
+		test.AssertEqual(t, response[0], statusSuccess, name+" should succeed")
+		credential, _, err := verifier.VerifyRegistration(response[1:], relyingPartyID, args[1].([]byte))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		credentials = append(credentials, credential)
+		return credential
+	}
+	assert := func(name string, args map[int]interface{}, allowed []*verifier.Credential) *verifier.AuthenticatorData {
+		recorder.name = name
+		response := recorder.HandleMessage(message(commandGetAssertion, args))
+		test.AssertEqual(t, response[0], statusSuccess, name+" should succeed")
+		_, authData, err := verifier.VerifyAssertion(response[1:], relyingPartyID, args[2].([]byte), allowed)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		return authData
+	}
+
+	credential := register("makeCredential", makeCredentialArgs())
+	args := makeCredentialArgs()
+	args[3] = map[string]interface{}{"id": []byte{5, 6, 7, 8}, "name": "resident", "displayName": "Resident"}
+	args[7] = map[string]bool{"rk": true}
+	register("makeCredential resident key", args)
+
+	session.credentialID = credential.ID
+	assert("getAssertion", session.assertionArgs(), []*verifier.Credential{credential})
+	args = session.assertionArgs()
+	args[5] = map[string]bool{"up": false}
+	authData := assert("getAssertion without user presence", args, []*verifier.Credential{credential})
+	test.AssertEqual(t, authData.Flags&verifier.FlagUserPresent, byte(0), "up=false should not set the user present flag")
+	args = session.assertionArgs()
+	delete(args, 3)
+	// Every credential of the default client is discoverable
+	assert("getAssertion discoverable", args, credentials)
+
+	recorder.name = "clientPIN setPIN"
+	// Every request from here on holds a key agreement key or the PIN token
+	recorder.randomRequest = true
+	recorder.randomResponse = true
+	setPIN, err := session.setPINArgs()
+	test.Assert(t, err == nil, "Could not agree on a shared secret")
+	test.AssertEqual(t, session.send(message(commandClientPIN, setPIN)), statusSuccess, "setPIN should succeed")
+	recorder.name = "clientPIN getPINToken"
+	token, err := session.pinToken(pin)
+	test.Assert(t, err == nil, "Could not get PIN token")
+	recorder.randomResponse = false
+	args = makeCredentialArgs()
+	args[8] = pinAuth(token, args[1].([]byte))
+	args[9] = 1
+	register("makeCredential with pinAuth", args)
+	args = session.assertionArgs()
+	args[6] = pinAuth(token, args[2].([]byte))
+	args[7] = 1
+	authData = assert("getAssertion with pinAuth", args, []*verifier.Credential{credential})
+	test.Assert(t, authData.Flags&verifier.FlagUserVerified != 0, "pinAuth should set the user verified flag")
+	return recorder.exchanges
+}
+
+func TestGoldenVectors(t *testing.T) {
+	exchanges := runGoldenSession(t)
+	if *update {
+		data, err := json.MarshalIndent(exchanges, "", "  ")
+		test.Assert(t, err == nil, "Could not encode golden vectors")
+		test.Assert(t, os.WriteFile(goldenPath, append(data, '\n'), 0644) == nil, "Could not write golden vectors")
+		return
+	}
+	data, err := os.ReadFile(goldenPath)
+	test.Assert(t, err == nil, "Could not read golden vectors, run with -update to create them")
+	var golden []goldenExchange
+	test.Assert(t, json.Unmarshal(data, &golden) == nil, "Could not decode golden vectors")
+	test.AssertEqual(t, len(exchanges), len(golden), "Every golden exchange should be replayed")
+	for i, exchange := range exchanges {
+		expected := golden[i]
+		if !expected.RandomRequest && exchange.Request != expected.Request {
+			t.Fatalf("%s: request changed, so later responses can't be compared\ngot:      %s\nexpected: %s", expected.Name, exchange.Request, expected.Request)
+		}
+		if !expected.RandomResponse && exchange.Response != expected.Response {
+			t.Errorf("%s: response changed\ngot:      %s\nexpected: %s", expected.Name, exchange.Response, expected.Response)
+		}
+	}
+}
+
+// TestGoldenVectorsVerify checks the committed corpus itself with the verifier, so a
+// regenerated corpus can't capture a broken encoding
+func TestGoldenVectorsVerify(t *testing.T) {
+	data, err := os.ReadFile(goldenPath)
+	test.Assert(t, err == nil, "Could not read golden vectors")
+	var golden []goldenExchange
+	test.Assert(t, json.Unmarshal(data, &golden) == nil, "Could not decode golden vectors")
+	var credentials []*verifier.Credential
+	for _, exchange := range golden {
+		request, _ := hex.DecodeString(exchange.Request)
+		response, _ := hex.DecodeString(exchange.Response)
+		test.Assert(t, len(request) > 0 && len(response) > 0, exchange.Name+" should not be empty")
+		var args map[int]interface{}
+		switch request[0] {
+		case commandMakeCredential:
+			test.Assert(t, cbor.Unmarshal(request[1:], &args) == nil, "Could not decode request")
+			credential, _, err := verifier.VerifyRegistration(response[1:], relyingPartyID, args[1].([]byte))
+			if err != nil {
+				t.Fatalf("%s: %s", exchange.Name, err)
+			}
+			credentials = append(credentials, credential)
+		case commandGetAssertion:
+			test.Assert(t, cbor.Unmarshal(request[1:], &args) == nil, "Could not decode request")
+			if _, _, err := verifier.VerifyAssertion(response[1:], relyingPartyID, args[2].([]byte), credentials); err != nil {
+				t.Fatalf("%s: %s", exchange.Name, err)
+			}
+		}
+	}
+
+	// Flags that don't match what was signed must be caught
+	request, _ := hex.DecodeString(golden[0].Request)
+	response, _ := hex.DecodeString(golden[0].Response)
+	var args map[int]interface{}
+	test.Assert(t, cbor.Unmarshal(request[1:], &args) == nil, "Could not decode request")
+	flags := bytes.Index(response, crypto.HashSHA256([]byte(relyingPartyID))) + 32
+	response[flags] ^= verifier.FlagUserVerified
+	_, _, err = verifier.VerifyRegistration(response[1:], relyingPartyID, args[1].([]byte))
+	test.Assert(t, err != nil, "Tampered authenticator data should not verify")
+}
@@ -0,0 +1,243 @@
+package conformance
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+const (
+	u2fRegister     = byte(0x01)
+	u2fAuthenticate = byte(0x02)
+	u2fVersion      = byte(0x03)
+
+	u2fControlCheckOnly       = byte(0x07)
+	u2fControlEnforcePresence = byte(0x03)
+	u2fControlDontEnforce     = byte(0x08)
+
+	swNoError                 = uint16(0x9000)
+	swConditionsNotSatisfied  = uint16(0x6985)
+	swWrongData               = uint16(0x6A80)
+	swWrongLength             = uint16(0x6700)
+	swCLANotSupported         = uint16(0x6E00)
+	swInstructionNotSupported = uint16(0x6D00)
+)
+
+const (
+	sectionU2FEncoding       = "U2F 3 APDU encoding"
+	sectionU2FRegistration   = "U2F 4 Registration messages"
+	sectionU2FAuthentication = "U2F 5 Authentication messages"
+	sectionU2FOther          = "U2F 6 Other messages"
+)
+
+var (
+	u2fApplication      = crypto.HashSHA256([]byte("https://conformance.example"))
+	u2fOtherApplication = crypto.HashSHA256([]byte("https://other.example"))
+	u2fChallenge        = crypto.HashSHA256([]byte("u2f challenge"))
+)
+
+type u2fVector struct {
+	section string
+	name    string
+	run     func(session *u2fSession) error
+}
+
+// u2fVectors run in order, sharing the session
+var u2fVectors = []u2fVector{
+	{sectionU2FEncoding, "Message shorter than a header is rejected", func(session *u2fSession) error {
+		_, status := session.send([]byte{0x00, u2fVersion})
+		return expectStatusWord(status, swWrongData)
+	}},
+	{sectionU2FEncoding, "Unsupported CLA is rejected", func(session *u2fSession) error {
+		_, status := session.send([]byte{0x80, u2fVersion, 0, 0, 0, 0, 0})
+		return expectStatusWord(status, swCLANotSupported)
+	}},
+	{sectionU2FEncoding, "Unknown instruction is rejected", func(session *u2fSession) error {
+		_, status := session.send(u2fAPDU(0x40, 0, nil))
+		return expectStatusWord(status, swInstructionNotSupported)
+	}},
+
+	{sectionU2FOther, "VERSION returns U2F_V2", func(session *u2fSession) error {
+		data, status := session.send(u2fAPDU(u2fVersion, 0, nil))
+		if err := expectStatusWord(status, swNoError); err != nil {
+			return err
+		}
+		if string(data) != "U2F_V2" {
+			return fmt.Errorf("Expected version U2F_V2, got %q", data)
+		}
+		return nil
+	}},
+
+	{sectionU2FRegistration, "Request with the wrong length is rejected", func(session *u2fSession) error {
+		_, status := session.send(u2fAPDU(u2fRegister, 0, make([]byte, 63)))
+		return expectStatusWord(status, swWrongLength)
+	}},
+	{sectionU2FRegistration, "Registers a key with a signed response", func(session *u2fSession) error {
+		return session.register()
+	}},
+
+	{sectionU2FAuthentication, "Check-only with a valid key handle needs user presence", func(session *u2fSession) error {
+		if session.keyHandle == nil {
+			return errNoKeyHandle
+		}
+		_, status := session.send(u2fAPDU(u2fAuthenticate, u2fControlCheckOnly, session.authenticateRequest(u2fApplication, session.keyHandle)))
+		return expectStatusWord(status, swConditionsNotSatisfied)
+	}},
+	{sectionU2FAuthentication, "Check-only with another application's key handle is wrong data", func(session *u2fSession) error {
+		if session.keyHandle == nil {
+			return errNoKeyHandle
+		}
+		_, status := session.send(u2fAPDU(u2fAuthenticate, u2fControlCheckOnly, session.authenticateRequest(u2fOtherApplication, session.keyHandle)))
+		return expectStatusWord(status, swWrongData)
+	}},
+	{sectionU2FAuthentication, "Changed key handle is rejected", func(session *u2fSession) error {
+		if session.keyHandle == nil {
+			return errNoKeyHandle
+		}
+		keyHandle := append([]byte{}, session.keyHandle...)
+		keyHandle[len(keyHandle)/2] ^= 0xFF
+		_, status := session.send(u2fAPDU(u2fAuthenticate, u2fControlEnforcePresence, session.authenticateRequest(u2fApplication, keyHandle)))
+		return expectStatusWord(status, swWrongData)
+	}},
+	{sectionU2FAuthentication, "Key handle longer than the request is rejected", func(session *u2fSession) error {
+		request := util.Concat(u2fChallenge, u2fApplication, []byte{64}, make([]byte, 10))
+		_, status := session.send(u2fAPDU(u2fAuthenticate, u2fControlEnforcePresence, request))
+		return expectStatusWord(status, swWrongLength)
+	}},
+	{sectionU2FAuthentication, "Signs with the registered key", func(session *u2fSession) error {
+		userPresence, _, err := session.authenticate(u2fControlEnforcePresence)
+		if err != nil {
+			return err
+		}
+		if userPresence&0x01 == 0 {
+			return fmt.Errorf("User presence byte is 0x%02x", userPresence)
+		}
+		return nil
+	}},
+	{sectionU2FAuthentication, "Counter increases", func(session *u2fSession) error {
+		_, first, err := session.authenticate(u2fControlEnforcePresence)
+		if err != nil {
+			return err
+		}
+		_, second, err := session.authenticate(u2fControlEnforcePresence)
+		if err != nil {
+			return err
+		}
+		if second <= first {
+			return fmt.Errorf("Counter went from %d to %d", first, second)
+		}
+		return nil
+	}},
+	{sectionU2FAuthentication, "Dont-enforce-user-presence-and-sign signs", func(session *u2fSession) error {
+		_, _, err := session.authenticate(u2fControlDontEnforce)
+		return err
+	}},
+}
+
+var errNoKeyHandle = fmt.Errorf("No key handle from an earlier vector")
+
+type u2fSession struct {
+	authenticator Authenticator
+	keyHandle     []byte
+	publicKey     *ecdsa.PublicKey
+}
+
+// u2fAPDU encodes a request as an extended length APDU, as in the raw message spec
+func u2fAPDU(instruction byte, param1 byte, data []byte) []byte {
+	apdu := []byte{0x00, instruction, param1, 0x00, 0x00}
+	if len(data) > 0 {
+		apdu = append(apdu, util.ToBE(uint16(len(data)))...)
+		apdu = append(apdu, data...)
+	}
+	return append(apdu, 0x00, 0x00)
+}
+
+// send returns the data and status word of the response
+func (session *u2fSession) send(message []byte) ([]byte, uint16) {
+	response := session.authenticator.HandleMessage(message)
+	if len(response) < 2 {
+		// Not a valid status word, so it never matches what a vector expects
+		return nil, 0
+	}
+	return response[:len(response)-2], binary.BigEndian.Uint16(response[len(response)-2:])
+}
+
+func expectStatusWord(status uint16, expected uint16) error {
+	if status != expected {
+		return fmt.Errorf("Expected status word 0x%04x, got 0x%04x", expected, status)
+	}
+	return nil
+}
+
+// register checks the registration response and saves the key handle for later vectors
+func (session *u2fSession) register() error {
+	data, status := session.send(u2fAPDU(u2fRegister, 0, util.Concat(u2fChallenge, u2fApplication)))
+	if err := expectStatusWord(status, swNoError); err != nil {
+		return err
+	}
+	if len(data) < 67 || data[0] != 0x05 {
+		return fmt.Errorf("Response should start with 0x05 and a public key")
+	}
+	encodedPublicKey := data[1:66]
+	x, y := elliptic.Unmarshal(elliptic.P256(), encodedPublicKey)
+	if x == nil {
+		return fmt.Errorf("Public key is not an uncompressed P-256 point")
+	}
+	keyHandleLength := int(data[66])
+	if len(data) < 67+keyHandleLength {
+		return fmt.Errorf("Key handle of %d bytes does not fit in the response", keyHandleLength)
+	}
+	keyHandle := data[67 : 67+keyHandleLength]
+	// The certificate is DER, so its length comes from its header
+	var certificateValue asn1.RawValue
+	signature, err := asn1.Unmarshal(data[67+keyHandleLength:], &certificateValue)
+	if err != nil {
+		return fmt.Errorf("Could not find attestation certificate: %w", err)
+	}
+	certificate, err := x509.ParseCertificate(certificateValue.FullBytes)
+	if err != nil {
+		return fmt.Errorf("Could not parse attestation certificate: %w", err)
+	}
+	certificateKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Attestation certificate does not have an ECDSA key")
+	}
+	signedData := util.Concat([]byte{0x00}, u2fApplication, u2fChallenge, keyHandle, encodedPublicKey)
+	if !crypto.VerifyECDSA(certificateKey, signedData, signature) {
+		return fmt.Errorf("Registration signature does not verify")
+	}
+	session.keyHandle = keyHandle
+	session.publicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	return nil
+}
+
+func (session *u2fSession) authenticateRequest(application []byte, keyHandle []byte) []byte {
+	return util.Concat(u2fChallenge, application, []byte{byte(len(keyHandle))}, keyHandle)
+}
+
+// authenticate checks the signature over the response and returns its user presence byte
+// and counter
+func (session *u2fSession) authenticate(control byte) (byte, uint32, error) {
+	if session.keyHandle == nil {
+		return 0, 0, errNoKeyHandle
+	}
+	data, status := session.send(u2fAPDU(u2fAuthenticate, control, session.authenticateRequest(u2fApplication, session.keyHandle)))
+	if err := expectStatusWord(status, swNoError); err != nil {
+		return 0, 0, err
+	}
+	if len(data) < 6 {
+		return 0, 0, fmt.Errorf("Response is too short: %d bytes", len(data))
+	}
+	userPresence := data[0]
+	counter := binary.BigEndian.Uint32(data[1:5])
+	if !crypto.VerifyECDSA(session.publicKey, util.Concat(u2fApplication, data[:5], u2fChallenge), data[5:]) {
+		return 0, 0, fmt.Errorf("Authentication signature does not verify")
+	}
+	return userPresence, counter, nil
+}
@@ -0,0 +1,537 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	commandMakeCredential = byte(0x01)
+	commandGetAssertion   = byte(0x02)
+	commandGetInfo        = byte(0x04)
+	commandClientPIN      = byte(0x06)
+
+	statusSuccess              = byte(0x00)
+	statusInvalidCommand       = byte(0x01)
+	statusInvalidParameter     = byte(0x02)
+	statusInvalidLength        = byte(0x03)
+	statusInvalidCBOR          = byte(0x12)
+	statusMissingParameter     = byte(0x14)
+	statusCredentialExcluded   = byte(0x19)
+	statusUnsupportedAlgorithm = byte(0x26)
+	statusNoCredentials        = byte(0x2E)
+	statusPINInvalid           = byte(0x31)
+	statusPINAuthInvalid       = byte(0x33)
+	statusPINRequired          = byte(0x36)
+
+	clientPINGetRetries      = 1
+	clientPINGetKeyAgreement = 2
+	clientPINSetPIN          = 3
+	clientPINGetPINToken     = 5
+
+	authDataFlagUserPresent  = byte(0x01)
+	authDataFlagUserVerified = byte(0x04)
+	authDataFlagAttestedData = byte(0x40)
+
+	relyingPartyID = "conformance.example"
+	pin            = "123456"
+)
+
+const (
+	sectionMessageEncoding = "6 Message encoding"
+	sectionGetInfo         = "5.4 authenticatorGetInfo"
+	sectionMakeCredential  = "5.1 authenticatorMakeCredential"
+	sectionGetAssertion    = "5.2 authenticatorGetAssertion"
+	sectionClientPIN       = "5.5 authenticatorClientPIN"
+)
+
+type vector struct {
+	section string
+	name    string
+	run     func(session *session) error
+}
+
+// vectors run in order, sharing the session
+var vectors = []vector{
+	{sectionMessageEncoding, "Empty message is rejected", func(session *session) error {
+		return expectStatus(session.send(nil), statusInvalidLength)
+	}},
+	{sectionMessageEncoding, "Unknown command is rejected", func(session *session) error {
+		return expectStatus(session.send([]byte{0x3F}), statusInvalidCommand)
+	}},
+	{sectionMessageEncoding, "Truncated CBOR is rejected", func(session *session) error {
+		return expectStatus(session.send([]byte{commandMakeCredential, 0xA2, 0x01}), statusInvalidCBOR)
+	}},
+	{sectionMessageEncoding, "Trailing bytes after the CBOR map are rejected", func(session *session) error {
+		message := util.Concat([]byte{commandGetAssertion}, util.MarshalCBOR(session.assertionArgs()), []byte{0x00})
+		return expectStatus(session.send(message), statusInvalidCBOR)
+	}},
+
+	{sectionGetInfo, "Reports FIDO_2_0 and a 16 byte AAGUID", func(session *session) error {
+		var info struct {
+			Versions []string `cbor:"1,keyasint"`
+			AAGUID   []byte   `cbor:"3,keyasint"`
+		}
+		if err := session.request(commandGetInfo, nil, &info); err != nil {
+			return err
+		}
+		if !contains(info.Versions, "FIDO_2_0") {
+			return fmt.Errorf("Versions %v do not include FIDO_2_0", info.Versions)
+		}
+		if len(info.AAGUID) != 16 {
+			return fmt.Errorf("AAGUID is %d bytes", len(info.AAGUID))
+		}
+		return nil
+	}},
+	{sectionGetInfo, "Reports clientPin once PIN support is enabled", func(session *session) error {
+		var info struct {
+			Options map[string]bool `cbor:"4,keyasint"`
+		}
+		if err := session.request(commandGetInfo, nil, &info); err != nil {
+			return err
+		}
+		if _, ok := info.Options["clientPin"]; !ok {
+			return fmt.Errorf("Options %v do not include clientPin", info.Options)
+		}
+		return nil
+	}},
+
+	{sectionMakeCredential, "Missing clientDataHash is rejected", func(session *session) error {
+		args := makeCredentialArgs()
+		delete(args, 1)
+		return expectStatus(session.send(message(commandMakeCredential, args)), statusMissingParameter)
+	}},
+	{sectionMakeCredential, "Missing rp is rejected", func(session *session) error {
+		args := makeCredentialArgs()
+		delete(args, 2)
+		return expectStatus(session.send(message(commandMakeCredential, args)), statusMissingParameter)
+	}},
+	{sectionMakeCredential, "Unsupported algorithms are rejected", func(session *session) error {
+		args := makeCredentialArgs()
+		args[4] = []map[string]interface{}{{"alg": -257, "type": "public-key"}}
+		return expectStatus(session.send(message(commandMakeCredential, args)), statusUnsupportedAlgorithm)
+	}},
+	{sectionMakeCredential, "Creates an ES256 credential with packed attestation", func(session *session) error {
+		return session.makeCredential(makeCredentialArgs())
+	}},
+	{sectionMakeCredential, "Credentials in the excludeList are refused", func(session *session) error {
+		if session.credentialID == nil {
+			return errNoCredential
+		}
+		args := makeCredentialArgs()
+		args[5] = []map[string]interface{}{{"type": "public-key", "id": session.credentialID}}
+		return expectStatus(session.send(message(commandMakeCredential, args)), statusCredentialExcluded)
+	}},
+
+	{sectionGetAssertion, "Missing rpId is rejected", func(session *session) error {
+		args := session.assertionArgs()
+		delete(args, 1)
+		return expectStatus(session.send(message(commandGetAssertion, args)), statusMissingParameter)
+	}},
+	{sectionGetAssertion, "Unknown credentials are not found", func(session *session) error {
+		args := session.assertionArgs()
+		args[3] = []map[string]interface{}{{"type": "public-key", "id": crypto.RandomBytes(32)}}
+		return expectStatus(session.send(message(commandGetAssertion, args)), statusNoCredentials)
+	}},
+	{sectionGetAssertion, "Credentials are not found for another RP", func(session *session) error {
+		if session.credentialID == nil {
+			return errNoCredential
+		}
+		args := session.assertionArgs()
+		args[1] = "other.example"
+		return expectStatus(session.send(message(commandGetAssertion, args)), statusNoCredentials)
+	}},
+	{sectionGetAssertion, "Signs with the registered credential", func(session *session) error {
+		authData, err := session.getAssertion(session.assertionArgs())
+		if err != nil {
+			return err
+		}
+		if authData[32]&authDataFlagUserPresent == 0 {
+			return fmt.Errorf("User present flag is not set")
+		}
+		return nil
+	}},
+	{sectionGetAssertion, "Signature counter increases", func(session *session) error {
+		first, err := session.getAssertion(session.assertionArgs())
+		if err != nil {
+			return err
+		}
+		second, err := session.getAssertion(session.assertionArgs())
+		if err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(second[33:37]) <= binary.BigEndian.Uint32(first[33:37]) {
+			return fmt.Errorf("Counter went from %d to %d", binary.BigEndian.Uint32(first[33:37]), binary.BigEndian.Uint32(second[33:37]))
+		}
+		return nil
+	}},
+	{sectionGetAssertion, "Option up=false skips user presence", func(session *session) error {
+		args := session.assertionArgs()
+		args[5] = map[string]bool{"up": false}
+		authData, err := session.getAssertion(args)
+		if err != nil {
+			return err
+		}
+		if authData[32]&authDataFlagUserPresent != 0 {
+			return fmt.Errorf("User present flag is set")
+		}
+		return nil
+	}},
+
+	{sectionClientPIN, "Unsupported pinProtocol is rejected", func(session *session) error {
+		args := map[int]interface{}{1: 2, 2: clientPINGetRetries}
+		return expectStatus(session.send(message(commandClientPIN, args)), statusInvalidParameter)
+	}},
+	{sectionClientPIN, "getRetries starts at 8", func(session *session) error {
+		retries, err := session.retries()
+		if err != nil {
+			return err
+		}
+		if retries != 8 {
+			return fmt.Errorf("Expected 8 retries, got %d", retries)
+		}
+		return nil
+	}},
+	{sectionClientPIN, "getKeyAgreement returns a P-256 point", func(session *session) error {
+		_, err := session.sharedSecret()
+		return err
+	}},
+	{sectionClientPIN, "setPIN with the wrong pinAuth is rejected", func(session *session) error {
+		args, err := session.setPINArgs()
+		if err != nil {
+			return err
+		}
+		args[4] = make([]byte, 16)
+		return expectStatus(session.send(message(commandClientPIN, args)), statusPINAuthInvalid)
+	}},
+	{sectionClientPIN, "setPIN sets the PIN", func(session *session) error {
+		args, err := session.setPINArgs()
+		if err != nil {
+			return err
+		}
+		return expectStatus(session.send(message(commandClientPIN, args)), statusSuccess)
+	}},
+	{sectionClientPIN, "getPINToken with the wrong PIN uses up a retry", func(session *session) error {
+		_, err := session.pinToken("654321")
+		if err := expectStatus(statusOf(err), statusPINInvalid); err != nil {
+			return err
+		}
+		retries, err := session.retries()
+		if err != nil {
+			return err
+		}
+		if retries != 7 {
+			return fmt.Errorf("Expected 7 retries, got %d", retries)
+		}
+		return nil
+	}},
+	{sectionClientPIN, "getPINToken returns a token for the PIN", func(session *session) error {
+		token, err := session.pinToken(pin)
+		if err != nil {
+			return err
+		}
+		if len(token) != 16 && len(token) != 32 {
+			return fmt.Errorf("PIN token is %d bytes", len(token))
+		}
+		session.token = token
+		return nil
+	}},
+	{sectionClientPIN, "makeCredential needs pinAuth once a PIN is set", func(session *session) error {
+		return expectStatus(session.send(message(commandMakeCredential, makeCredentialArgs())), statusPINRequired)
+	}},
+	{sectionClientPIN, "makeCredential with pinAuth verifies the user", func(session *session) error {
+		if session.token == nil {
+			return fmt.Errorf("No PIN token from an earlier vector")
+		}
+		args := makeCredentialArgs()
+		args[8] = pinAuth(session.token, args[1].([]byte))
+		args[9] = 1
+		if err := session.makeCredential(args); err != nil {
+			return err
+		}
+		if session.authData[32]&authDataFlagUserVerified == 0 {
+			return fmt.Errorf("User verified flag is not set")
+		}
+		return nil
+	}},
+}
+
+var errNoCredential = fmt.Errorf("No credential from an earlier vector")
+
+// statusError is returned when the authenticator answers with an error status
+type statusError byte
+
+func (err statusError) Error() string {
+	return fmt.Sprintf("Authenticator returned status 0x%02x", byte(err))
+}
+
+func statusOf(err error) byte {
+	if status, ok := err.(statusError); ok {
+		return byte(status)
+	}
+	return statusSuccess
+}
+
+type session struct {
+	authenticator Authenticator
+	credentialID  []byte
+	publicKey     *cose.SupportedCOSEPublicKey
+	// Authenticator data of the last credential created
+	authData []byte
+	token    []byte
+}
+
+func message(command byte, args interface{}) []byte {
+	return util.Concat([]byte{command}, util.MarshalCBOR(args))
+}
+
+// send returns the status of the response to message
+func (session *session) send(message []byte) byte {
+	response := session.authenticator.HandleMessage(message)
+	if len(response) == 0 {
+		// Not a valid status, so it never matches what a vector expects
+		return 0xFF
+	}
+	return response[0]
+}
+
+// request decodes a successful response into response
+func (session *session) request(command byte, args interface{}, response interface{}) error {
+	var data []byte
+	if args == nil {
+		data = []byte{command}
+	} else {
+		data = message(command, args)
+	}
+	responseBytes := session.authenticator.HandleMessage(data)
+	if len(responseBytes) == 0 {
+		return fmt.Errorf("Empty response")
+	}
+	if responseBytes[0] != statusSuccess {
+		return statusError(responseBytes[0])
+	}
+	if err := cbor.Unmarshal(responseBytes[1:], response); err != nil {
+		return fmt.Errorf("Could not decode response: %w", err)
+	}
+	return nil
+}
+
+func makeCredentialArgs() map[int]interface{} {
+	return map[int]interface{}{
+		1: crypto.HashSHA256([]byte("make credential client data")),
+		2: map[string]string{"id": relyingPartyID, "name": "Conformance"},
+		3: map[string]interface{}{"id": []byte{1, 2, 3, 4}, "name": "user", "displayName": "User"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+	}
+}
+
+// makeCredential checks the attestation and saves the new credential for later vectors
+func (session *session) makeCredential(args map[int]interface{}) error {
+	var attestation struct {
+		Format    string `cbor:"1,keyasint"`
+		AuthData  []byte `cbor:"2,keyasint"`
+		Statement struct {
+			Alg int      `cbor:"alg"`
+			Sig []byte   `cbor:"sig"`
+			X5c [][]byte `cbor:"x5c"`
+		} `cbor:"3,keyasint"`
+	}
+	if err := session.request(commandMakeCredential, args, &attestation); err != nil {
+		return err
+	}
+	authData := attestation.AuthData
+	if err := checkAuthData(authData, 55); err != nil {
+		return err
+	}
+	if authData[32]&authDataFlagAttestedData == 0 || authData[32]&authDataFlagUserPresent == 0 {
+		return fmt.Errorf("Flags 0x%02x should include user present and attested data", authData[32])
+	}
+	length := int(binary.BigEndian.Uint16(authData[53:55]))
+	if len(authData) < 55+length {
+		return fmt.Errorf("Credential ID of %d bytes does not fit in authenticator data", length)
+	}
+	id := authData[55 : 55+length]
+	var encodedKey cbor.RawMessage
+	if err := cbor.NewDecoder(bytes.NewReader(authData[55+length:])).Decode(&encodedKey); err != nil {
+		return fmt.Errorf("Could not decode credential public key: %w", err)
+	}
+	publicKey, err := cose.UnmarshalCOSEPublicKey(encodedKey)
+	if err != nil {
+		return fmt.Errorf("Could not decode credential public key: %w", err)
+	}
+
+	if attestation.Format != "packed" {
+		return fmt.Errorf("Expected packed attestation, got %q", attestation.Format)
+	}
+	if attestation.Statement.Alg != int(cose.COSE_ALGORITHM_ID_ES256) || len(attestation.Statement.X5c) == 0 {
+		return fmt.Errorf("Attestation statement should have an ES256 signature and certificate")
+	}
+	certificate, err := x509.ParseCertificate(attestation.Statement.X5c[0])
+	if err != nil {
+		return fmt.Errorf("Could not parse attestation certificate: %w", err)
+	}
+	certificateKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Attestation certificate does not have an ECDSA key")
+	}
+	if !crypto.VerifyECDSA(certificateKey, util.Concat(authData, args[1].([]byte)), attestation.Statement.Sig) {
+		return fmt.Errorf("Attestation signature does not verify")
+	}
+	session.credentialID = id
+	session.publicKey = publicKey
+	session.authData = authData
+	return nil
+}
+
+func (session *session) assertionArgs() map[int]interface{} {
+	return map[int]interface{}{
+		1: relyingPartyID,
+		2: crypto.HashSHA256([]byte("get assertion client data")),
+		3: []map[string]interface{}{{"type": "public-key", "id": session.credentialID}},
+	}
+}
+
+// getAssertion checks the assertion was signed by the saved credential and returns its
+// authenticator data
+func (session *session) getAssertion(args map[int]interface{}) ([]byte, error) {
+	if session.credentialID == nil {
+		return nil, errNoCredential
+	}
+	var assertion struct {
+		Credential struct {
+			ID []byte `cbor:"id"`
+		} `cbor:"1,keyasint"`
+		AuthData  []byte `cbor:"2,keyasint"`
+		Signature []byte `cbor:"3,keyasint"`
+	}
+	if err := session.request(commandGetAssertion, args, &assertion); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(assertion.Credential.ID, session.credentialID) {
+		return nil, fmt.Errorf("Assertion is for another credential")
+	}
+	if err := checkAuthData(assertion.AuthData, 37); err != nil {
+		return nil, err
+	}
+	if !session.publicKey.Verify(util.Concat(assertion.AuthData, args[2].([]byte)), assertion.Signature) {
+		return nil, fmt.Errorf("Assertion signature does not verify")
+	}
+	return assertion.AuthData, nil
+}
+
+func checkAuthData(authData []byte, minLength int) error {
+	if len(authData) < minLength {
+		return fmt.Errorf("Authenticator data is too short: %d bytes", len(authData))
+	}
+	rpIDHash := sha256.Sum256([]byte(relyingPartyID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return fmt.Errorf("Authenticator data has the wrong RP ID hash")
+	}
+	return nil
+}
+
+func (session *session) retries() (int, error) {
+	var response struct {
+		Retries int `cbor:"3,keyasint"`
+	}
+	err := session.request(commandClientPIN, map[int]interface{}{1: 1, 2: clientPINGetRetries}, &response)
+	return response.Retries, err
+}
+
+// sharedSecret agrees on a PIN protocol 1 secret with the authenticator, returning the
+// platform's key to send with it
+func (session *session) sharedSecret() (*pinSecret, error) {
+	var response struct {
+		KeyAgreement cose.COSEEC2Key `cbor:"1,keyasint"`
+	}
+	if err := session.request(commandClientPIN, map[int]interface{}{1: 1, 2: clientPINGetKeyAgreement}, &response); err != nil {
+		return nil, err
+	}
+	x := new(big.Int).SetBytes(response.KeyAgreement.X)
+	y := new(big.Int).SetBytes(response.KeyAgreement.Y)
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return nil, fmt.Errorf("Key agreement point is not on P-256")
+	}
+	key := crypto.GenerateECDHKey()
+	return &pinSecret{
+		secret: crypto.HashSHA256(key.ECDH(x, y)),
+		keyAgreement: map[int]interface{}{
+			1: 2, -1: 1, 3: -25,
+			-2: key.X.Bytes(),
+			-3: key.Y.Bytes(),
+		},
+	}, nil
+}
+
+type pinSecret struct {
+	secret       []byte
+	keyAgreement map[int]interface{}
+}
+
+func pinAuth(key []byte, data []byte) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write(data)
+	return hash.Sum(nil)[:16]
+}
+
+func (session *session) setPINArgs() (map[int]interface{}, error) {
+	secret, err := session.sharedSecret()
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, 64)
+	copy(padded, pin)
+	newPINEncoding := crypto.EncryptAESCBC(secret.secret, padded)
+	args := map[int]interface{}{
+		1: 1,
+		2: clientPINSetPIN,
+		3: secret.keyAgreement,
+		4: pinAuth(secret.secret, newPINEncoding),
+		5: newPINEncoding,
+	}
+	return args, nil
+}
+
+func (session *session) pinToken(pin string) ([]byte, error) {
+	secret, err := session.sharedSecret()
+	if err != nil {
+		return nil, err
+	}
+	args := map[int]interface{}{
+		1: 1,
+		2: clientPINGetPINToken,
+		3: secret.keyAgreement,
+		6: crypto.EncryptAESCBC(secret.secret, crypto.HashSHA256([]byte(pin))[:16]),
+	}
+	var response struct {
+		PINToken []byte `cbor:"2,keyasint"`
+	}
+	if err := session.request(commandClientPIN, args, &response); err != nil {
+		return nil, err
+	}
+	if len(response.PINToken) == 0 || len(response.PINToken)%16 != 0 {
+		return nil, fmt.Errorf("Encrypted PIN token is %d bytes", len(response.PINToken))
+	}
+	return crypto.DecryptAESCBC(secret.secret, response.PINToken), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package cose
 
 import (
+	"bytes"
+	gocrypto "crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
@@ -40,13 +42,68 @@ const (
 	COSE_KEY_TYPE_SYMMETRIC coseKeyType = 0b100
 )
 
+// Signer is a private key kept somewhere else, e.g. by a delegate, that signs on request
+type Signer interface {
+	Public() *SupportedCOSEPublicKey
+	Sign(data []byte) []byte
+}
+
 type SupportedCOSEPrivateKey struct {
 	ECDSA   *ecdsa.PrivateKey
 	Ed25519 *ed25519.PrivateKey
 	RSA     *rsa.PrivateKey
+	// Set instead of the others when the key isn't in this process. It can only be marshaled
+	// if it came from GenerateECDSAKey.
+	Signer Signer
+}
+
+// providerKey is a P-256 key the crypto.Provider keeps to itself. Only its handle is marshaled.
+type providerKey struct {
+	handle    []byte
+	signer    gocrypto.Signer
+	publicKey *SupportedCOSEPublicKey
+}
+
+func (key *providerKey) Public() *SupportedCOSEPublicKey {
+	return key.publicKey
+}
+
+func (key *providerKey) Sign(data []byte) []byte {
+	return crypto.SignWithSigner(key.signer, data)
+}
+
+// GenerateECDSAKey creates a P-256 credential key with the crypto.Provider, which may keep
+// the private key to itself
+func GenerateECDSAKey() *SupportedCOSEPrivateKey {
+	key, err := newProviderKey(crypto.GenerateKey())
+	util.CheckErr(err, "Could not generate credential key")
+	return key
+}
+
+func newProviderKey(handle []byte, signer gocrypto.Signer) (*SupportedCOSEPrivateKey, error) {
+	if privateKey := crypto.InMemoryKey(signer); privateKey != nil {
+		return &SupportedCOSEPrivateKey{ECDSA: privateKey}, nil
+	}
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("Provider key isn't a P-256 key")
+	}
+	return &SupportedCOSEPrivateKey{Signer: &providerKey{
+		handle:    handle,
+		signer:    signer,
+		publicKey: &SupportedCOSEPublicKey{ECDSA: publicKey},
+	}}, nil
 }
 
 func (key *SupportedCOSEPrivateKey) Equal(otherKey *SupportedCOSEPrivateKey) bool {
+	if key.Signer != nil || otherKey.Signer != nil {
+		handleKey, ok := key.Signer.(*providerKey)
+		otherHandleKey, otherOk := otherKey.Signer.(*providerKey)
+		if ok && otherOk {
+			return bytes.Equal(handleKey.handle, otherHandleKey.handle)
+		}
+		return key.Signer == otherKey.Signer
+	}
 	if (key.ECDSA == nil) != (otherKey.ECDSA == nil) {
 		// One is non-nil and the other is nil
 		return false
@@ -72,7 +129,9 @@ func (key *SupportedCOSEPrivateKey) Equal(otherKey *SupportedCOSEPrivateKey) boo
 
 func (key *SupportedCOSEPrivateKey) Public() *SupportedCOSEPublicKey {
 	coseKey := SupportedCOSEPublicKey{}
-	if key.ECDSA != nil {
+	if key.Signer != nil {
+		return key.Signer.Public()
+	} else if key.ECDSA != nil {
 		coseKey.ECDSA = &key.ECDSA.PublicKey
 	} else if key.Ed25519 != nil {
 		edPublicKey := key.Ed25519.Public().(ed25519.PublicKey)
@@ -86,7 +145,9 @@ func (key *SupportedCOSEPrivateKey) Public() *SupportedCOSEPublicKey {
 }
 
 func (key *SupportedCOSEPrivateKey) Sign(data []byte) []byte {
-	if key.ECDSA != nil {
+	if key.Signer != nil {
+		return key.Signer.Sign(data)
+	} else if key.ECDSA != nil {
 		return crypto.SignECDSA(key.ECDSA, data)
 	} else if key.Ed25519 != nil {
 		return crypto.SignEd25519(key.Ed25519, data)
@@ -146,6 +207,8 @@ type COSEEC2Key struct {
 	X         []byte `cbor:"-2,keyasint"`
 	Y         []byte `cbor:"-3,keyasint"`
 	D         []byte `cbor:"-4,keyasint,omitempty"`
+	// Private use label for the crypto.Provider handle of a key without D
+	Handle []byte `cbor:"-70001,keyasint,omitempty"`
 }
 
 func (key *COSEEC2Key) String() string {
@@ -387,8 +450,35 @@ func UnmarshalCOSEPublicKey(publicKeyBytes []byte) (*SupportedCOSEPublicKey, err
 	}
 }
 
+func encodeProviderKey(key *providerKey) []byte {
+	publicKey := key.publicKey.ECDSA
+	return util.MarshalCBOR(COSEEC2Key{
+		KeyType:   int8(COSE_KEY_TYPE_EC2),
+		Algorithm: int8(COSE_ALGORITHM_ID_ES256),
+		Curve:     int8(COSE_CURVE_ID_P256),
+		X:         publicKey.X.Bytes(),
+		Y:         publicKey.Y.Bytes(),
+		Handle:    key.handle,
+	})
+}
+
+func decodeProviderKey(privateKeyBytes []byte) (*SupportedCOSEPrivateKey, bool, error) {
+	key := COSEEC2Key{}
+	if err := cbor.Unmarshal(privateKeyBytes, &key); err != nil || key.Handle == nil {
+		return nil, false, nil
+	}
+	signer, err := crypto.OpenKey(key.Handle)
+	if err != nil {
+		return nil, true, err
+	}
+	privateKey, err := newProviderKey(key.Handle, signer)
+	return privateKey, true, err
+}
+
 func MarshalCOSEPrivateKey(privateKey *SupportedCOSEPrivateKey) []byte {
-	if privateKey.ECDSA != nil {
+	if key, ok := privateKey.Signer.(*providerKey); ok {
+		return encodeProviderKey(key)
+	} else if privateKey.ECDSA != nil {
 		return encodeECDSAPrivateKey(privateKey.ECDSA)
 	} else if privateKey.Ed25519 != nil {
 		return encodeEd215519PrivateKey(privateKey.Ed25519)
@@ -406,6 +496,9 @@ func UnmarshalCOSEPrivateKey(privateKeyBytes []byte) (*SupportedCOSEPrivateKey,
 		return nil, fmt.Errorf("Could not decode CBOR for private key")
 	}
 	if header.Algorithm == int8(COSE_ALGORITHM_ID_ES256) {
+		if coseKey, ok, err := decodeProviderKey(privateKeyBytes); ok {
+			return coseKey, err
+		}
 		privateKey := decodeECDSAPrivateKey(privateKeyBytes)
 		coseKey := SupportedCOSEPrivateKey{ECDSA: privateKey}
 		return &coseKey, nil
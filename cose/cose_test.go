@@ -1,12 +1,16 @@
 package cose
 
 import (
+	gocrypto "crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/fxamacker/cbor/v2"
 )
 
 func checkErr(t *testing.T, err error) {
@@ -49,3 +53,35 @@ func TestRSA(t *testing.T) {
 	cosePrivateKey := &SupportedCOSEPrivateKey{RSA: privateKey}
 	testCOSEKey(t, cosePrivateKey)
 }
+
+// tokenProvider keeps its keys to itself, like a PKCS#11 token
+type tokenProvider struct {
+	crypto.StdlibProvider
+	keys map[string]*ecdsa.PrivateKey
+}
+
+func (p *tokenProvider) GenerateKey() ([]byte, gocrypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handle := []byte{byte(len(p.keys))}
+	p.keys[string(handle)] = key
+	return handle, key, err
+}
+
+func (p *tokenProvider) OpenKey(handle []byte) (gocrypto.Signer, error) {
+	return p.keys[string(handle)], nil
+}
+
+func TestProviderKey(t *testing.T) {
+	crypto.SetProvider(&tokenProvider{keys: make(map[string]*ecdsa.PrivateKey)})
+	defer crypto.SetProvider(crypto.StdlibProvider{})
+	key := GenerateECDSAKey()
+	if key.ECDSA != nil {
+		t.Fatalf("Provider key should stay in the provider")
+	}
+	testCOSEKey(t, key)
+	encoded := COSEEC2Key{}
+	checkErr(t, cbor.Unmarshal(MarshalCOSEPrivateKey(key), &encoded))
+	if encoded.D != nil || encoded.Handle == nil {
+		t.Fatalf("Only the provider key's handle should be marshaled: %s", encoded.String())
+	}
+}
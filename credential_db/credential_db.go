@@ -0,0 +1,350 @@
+// Package credential_db keeps vault credentials in a bbolt database, indexed by credential
+// ID and RP ID, for vaults with thousands of credentials. Each credential is sealed on its
+// own with a key that's wrapped with the vault passphrase, so a request only decrypts the
+// credentials it uses.
+package credential_db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets:
+//
+//	meta                      "key": the sealing key, wrapped with identities.SealVaultKey
+//	profiles/<name>/credentials      credential ID: sealed credential
+//	profiles/<name>/relying_parties  RP ID index and credential ID: nothing
+//
+// The RP ID index is an HMAC of the RP ID, so the RPs aren't readable from the database.
+var (
+	metaBucket           = []byte("meta")
+	keyName              = []byte("key")
+	profilesBucket       = []byte("profiles")
+	credentialsBucket    = []byte("credentials")
+	relyingPartiesBucket = []byte("relying_parties")
+)
+
+const relyingPartyIndexLength = 16
+
+// How long Open waits for another process that has the database open
+const openTimeout = time.Second
+
+type sealedCredential struct {
+	RelyingPartyIndex []byte `json:"relying_party_index"`
+	Nonce             []byte `json:"nonce"`
+	EncryptedData     []byte `json:"encrypted_data"`
+}
+
+type DB struct {
+	db  *bolt.DB
+	key []byte
+}
+
+// Open opens the database at filename, creating it with a new key sealed with passphrase
+// and params if it doesn't exist. Only one process can have it open at a time.
+func Open(filename string, passphrase string, params identities.Argon2idParameters) (*DB, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: openTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("Could not open credential database, which another process has open: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open credential database: %w", err)
+	}
+	credentialDB := &DB{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if sealed := meta.Get(keyName); sealed != nil {
+			credentialDB.key, err = identities.OpenVaultKey(sealed, passphrase)
+			if err != nil {
+				return fmt.Errorf("Could not open credential database key: %w", err)
+			}
+			return nil
+		}
+		credentialDB.key = crypto.GenerateSymmetricKey()
+		sealed, err := identities.SealVaultKey(credentialDB.key, passphrase, params)
+		if err != nil {
+			return err
+		}
+		return meta.Put(keyName, sealed)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return credentialDB, nil
+}
+
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// ChangePassphrase seals the key with a new passphrase. The credentials are left as they are.
+func (db *DB) ChangePassphrase(passphrase string, params identities.Argon2idParameters) error {
+	sealed, err := identities.SealVaultKey(db.key, passphrase, params)
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(keyName, sealed)
+	})
+}
+
+// Profile returns the credentials of a vault profile
+func (db *DB) Profile(name string) *Store {
+	return &Store{db: db, profile: []byte(name)}
+}
+
+func (db *DB) DeleteProfile(name string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		profiles := tx.Bucket(profilesBucket)
+		if profiles == nil || profiles.Bucket([]byte(name)) == nil {
+			return nil
+		}
+		return profiles.DeleteBucket([]byte(name))
+	})
+}
+
+// Store is the identities.CredentialStore of one profile
+type Store struct {
+	db      *DB
+	profile []byte
+}
+
+func (store *Store) relyingPartyIndex(relyingPartyID string) []byte {
+	return crypto.HMACSHA256(store.db.key, []byte("relying_party:"+relyingPartyID))[:relyingPartyIndexLength]
+}
+
+// The profile and credential ID are bound to the credential, so it can't be moved
+func (store *Store) associatedData(id []byte) []byte {
+	data := append([]byte("credential:"), store.profile...)
+	data = append(data, 0)
+	return append(data, id...)
+}
+
+func (store *Store) seal(source identities.SavedCredentialSource) ([]byte, error) {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode credential: %w", err)
+	}
+	encryptedData, nonce, err := crypto.EncryptWithAssociatedData(store.db.key, data, store.associatedData(source.ID))
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt credential: %w", err)
+	}
+	return json.Marshal(sealedCredential{
+		RelyingPartyIndex: store.relyingPartyIndex(source.RelyingParty.ID),
+		Nonce:             nonce,
+		EncryptedData:     encryptedData,
+	})
+}
+
+func (store *Store) open(id []byte, data []byte) (*identities.SavedCredentialSource, error) {
+	sealed := sealedCredential{}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("Could not decode stored credential: %w", err)
+	}
+	decrypted, err := crypto.DecryptWithAssociatedData(store.db.key, sealed.EncryptedData, sealed.Nonce, store.associatedData(id))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt stored credential: %w", err)
+	}
+	source := identities.SavedCredentialSource{}
+	if err := json.Unmarshal(decrypted, &source); err != nil {
+		return nil, fmt.Errorf("Could not decode stored credential: %w", err)
+	}
+	return &source, nil
+}
+
+// buckets returns the profile's credential and RP ID index buckets, or nil if the profile
+// has no credentials and tx is read-only
+func (store *Store) buckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	if !tx.Writable() {
+		profile := tx.Bucket(profilesBucket)
+		if profile != nil {
+			profile = profile.Bucket(store.profile)
+		}
+		if profile == nil {
+			return nil, nil, nil
+		}
+		return profile.Bucket(credentialsBucket), profile.Bucket(relyingPartiesBucket), nil
+	}
+	profiles, err := tx.CreateBucketIfNotExists(profilesBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	profile, err := profiles.CreateBucketIfNotExists(store.profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	credentials, err := profile.CreateBucketIfNotExists(credentialsBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	relyingParties, err := profile.CreateBucketIfNotExists(relyingPartiesBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return credentials, relyingParties, nil
+}
+
+func (store *Store) Credential(id []byte) (*identities.SavedCredentialSource, error) {
+	var source *identities.SavedCredentialSource
+	err := store.db.db.View(func(tx *bolt.Tx) error {
+		credentials, _, err := store.buckets(tx)
+		if err != nil || credentials == nil {
+			return err
+		}
+		data := credentials.Get(id)
+		if data == nil {
+			return nil
+		}
+		source, err = store.open(id, data)
+		return err
+	})
+	return source, err
+}
+
+func (store *Store) RelyingPartyCredentials(relyingPartyID string) ([]identities.SavedCredentialSource, error) {
+	sources := make([]identities.SavedCredentialSource, 0)
+	prefix := store.relyingPartyIndex(relyingPartyID)
+	err := store.db.db.View(func(tx *bolt.Tx) error {
+		credentials, relyingParties, err := store.buckets(tx)
+		if err != nil || credentials == nil {
+			return err
+		}
+		cursor := relyingParties.Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			id := key[len(prefix):]
+			source, err := store.open(id, credentials.Get(id))
+			if err != nil {
+				return err
+			}
+			// Guards against an index entry of another RP with the same HMAC prefix
+			if source.RelyingParty.ID == relyingPartyID {
+				sources = append(sources, *source)
+			}
+		}
+		return nil
+	})
+	return sources, err
+}
+
+func (store *Store) Credentials() ([]identities.SavedCredentialSource, error) {
+	sources := make([]identities.SavedCredentialSource, 0)
+	err := store.db.db.View(func(tx *bolt.Tx) error {
+		credentials, _, err := store.buckets(tx)
+		if err != nil || credentials == nil {
+			return err
+		}
+		return credentials.ForEach(func(id []byte, data []byte) error {
+			source, err := store.open(id, data)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, *source)
+			return nil
+		})
+	})
+	return sources, err
+}
+
+func (store *Store) CredentialCount() (int, error) {
+	count := 0
+	err := store.db.db.View(func(tx *bolt.Tx) error {
+		credentials, _, err := store.buckets(tx)
+		if err != nil || credentials == nil {
+			return err
+		}
+		count = credentials.Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+func (store *Store) put(credentials *bolt.Bucket, relyingParties *bolt.Bucket, source identities.SavedCredentialSource) error {
+	if err := store.deleteIndex(credentials, relyingParties, source.ID); err != nil {
+		return err
+	}
+	data, err := store.seal(source)
+	if err != nil {
+		return err
+	}
+	if err := credentials.Put(source.ID, data); err != nil {
+		return err
+	}
+	index := append(store.relyingPartyIndex(source.RelyingParty.ID), source.ID...)
+	return relyingParties.Put(index, nil)
+}
+
+// deleteIndex removes the RP ID index entry of the credential stored with id, if any
+func (store *Store) deleteIndex(credentials *bolt.Bucket, relyingParties *bolt.Bucket, id []byte) error {
+	data := credentials.Get(id)
+	if data == nil {
+		return nil
+	}
+	sealed := sealedCredential{}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return fmt.Errorf("Could not decode stored credential: %w", err)
+	}
+	return relyingParties.Delete(append(sealed.RelyingPartyIndex, id...))
+}
+
+func (store *Store) PutCredentials(sources []identities.SavedCredentialSource) error {
+	return store.db.db.Update(func(tx *bolt.Tx) error {
+		credentials, relyingParties, err := store.buckets(tx)
+		if err != nil {
+			return err
+		}
+		for _, source := range sources {
+			if err := store.put(credentials, relyingParties, source); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *Store) DeleteCredential(id []byte) error {
+	return store.db.db.Update(func(tx *bolt.Tx) error {
+		credentials, relyingParties, err := store.buckets(tx)
+		if err != nil {
+			return err
+		}
+		if err := store.deleteIndex(credentials, relyingParties, id); err != nil {
+			return err
+		}
+		return credentials.Delete(id)
+	})
+}
+
+func (store *Store) ReplaceCredentials(sources []identities.SavedCredentialSource) error {
+	return store.db.db.Update(func(tx *bolt.Tx) error {
+		profiles, err := tx.CreateBucketIfNotExists(profilesBucket)
+		if err != nil {
+			return err
+		}
+		if profiles.Bucket(store.profile) != nil {
+			if err := profiles.DeleteBucket(store.profile); err != nil {
+				return err
+			}
+		}
+		credentials, relyingParties, err := store.buckets(tx)
+		if err != nil {
+			return err
+		}
+		for _, source := range sources {
+			if err := store.put(credentials, relyingParties, source); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,103 @@
+package credential_db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+var testParameters = identities.Argon2idParameters{Time: 1, Memory: 64, Threads: 1}
+
+func testCredential(id byte, relyingPartyID string) identities.SavedCredentialSource {
+	return identities.SavedCredentialSource{
+		Type:         "public-key",
+		ID:           []byte{id},
+		RelyingParty: webauthn.PublicKeyCredentialRPEntity{ID: relyingPartyID},
+		Nickname:     relyingPartyID,
+	}
+}
+
+func openTestDB(t *testing.T) (*DB, string) {
+	filename := filepath.Join(t.TempDir(), "credentials.db")
+	db, err := Open(filename, "passphrase", testParameters)
+	test.Assert(t, err == nil, "Could not open database")
+	return db, filename
+}
+
+func TestCredentialLookup(t *testing.T) {
+	db, _ := openTestDB(t)
+	defer db.Close()
+	store := db.Profile("default")
+	err := store.PutCredentials([]identities.SavedCredentialSource{
+		testCredential(1, "example.com"),
+		testCredential(2, "example.com"),
+		testCredential(3, "example.org"),
+	})
+	test.Assert(t, err == nil, "Could not store credentials")
+
+	source, err := store.Credential([]byte{3})
+	test.Assert(t, err == nil && source != nil, "Could not find credential by ID")
+	test.AssertEqual(t, source.RelyingParty.ID, "example.org", "Credential should round trip")
+	source, err = store.Credential([]byte{4})
+	test.Assert(t, err == nil && source == nil, "Missing credential should be nil")
+	sources, err := store.RelyingPartyCredentials("example.com")
+	test.Assert(t, err == nil, "Could not find credentials by RP ID")
+	test.AssertEqual(t, len(sources), 2, "RP should have two credentials")
+	count, _ := store.CredentialCount()
+	test.AssertEqual(t, count, 3, "Store should count every credential")
+
+	// Moving a credential to another RP moves its index entry
+	err = store.PutCredentials([]identities.SavedCredentialSource{testCredential(1, "example.org")})
+	test.Assert(t, err == nil, "Could not replace credential")
+	sources, _ = store.RelyingPartyCredentials("example.com")
+	test.AssertEqual(t, len(sources), 1, "Replaced credential should leave the old RP")
+	err = store.DeleteCredential([]byte{2})
+	test.Assert(t, err == nil, "Could not delete credential")
+	sources, _ = store.RelyingPartyCredentials("example.com")
+	test.AssertEqual(t, len(sources), 0, "Deleted credential should leave the index")
+	sources, _ = store.RelyingPartyCredentials("example.org")
+	test.AssertEqual(t, len(sources), 2, "Other RP should have both credentials")
+}
+
+func TestProfilesAndReplace(t *testing.T) {
+	db, _ := openTestDB(t)
+	defer db.Close()
+	work := db.Profile("work")
+	personal := db.Profile("personal")
+	work.PutCredentials([]identities.SavedCredentialSource{testCredential(1, "example.com")})
+	count, err := personal.CredentialCount()
+	test.Assert(t, err == nil, "Could not count credentials of an empty profile")
+	test.AssertEqual(t, count, 0, "Profiles should have their own credentials")
+
+	err = work.ReplaceCredentials([]identities.SavedCredentialSource{testCredential(2, "example.net")})
+	test.Assert(t, err == nil, "Could not replace credentials")
+	sources, _ := work.Credentials()
+	test.AssertEqual(t, len(sources), 1, "Replace should delete the other credentials")
+	test.AssertEqual(t, sources[0].RelyingParty.ID, "example.net", "Replace should store the new credentials")
+	sources, _ = work.RelyingPartyCredentials("example.com")
+	test.AssertEqual(t, len(sources), 0, "Replace should clear the index")
+
+	err = db.DeleteProfile("work")
+	test.Assert(t, err == nil, "Could not delete profile")
+	count, _ = work.CredentialCount()
+	test.AssertEqual(t, count, 0, "Deleted profile should have no credentials")
+}
+
+func TestPassphrase(t *testing.T) {
+	db, filename := openTestDB(t)
+	db.Profile("default").PutCredentials([]identities.SavedCredentialSource{testCredential(1, "example.com")})
+	err := db.ChangePassphrase("new", testParameters)
+	test.Assert(t, err == nil, "Could not change passphrase")
+	db.Close()
+
+	_, err = Open(filename, "passphrase", testParameters)
+	test.Assert(t, err != nil, "Old passphrase should fail")
+	db, err = Open(filename, "new", testParameters)
+	test.Assert(t, err == nil, "Could not open with new passphrase")
+	defer db.Close()
+	source, err := db.Profile("default").Credential([]byte{1})
+	test.Assert(t, err == nil && source != nil, "Credential should be kept through a passphrase change")
+}
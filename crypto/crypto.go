@@ -7,10 +7,12 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"math/big"
 
 	util "github.com/bulwarkid/virtual-fido/util"
@@ -22,15 +24,37 @@ func GenerateSymmetricKey() []byte {
 	return RandomBytes(32)
 }
 
+// GenerateECDSAKey creates a P-256 key in memory, for keys that have to be exported, such as
+// attestation keys. Credential keys come from GenerateKey.
 func GenerateECDSAKey() *ecdsa.PrivateKey {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key, err := generateP256Key()
 	util.CheckErr(err, "Could not generate ecdsa private key")
 	return key
 }
 
+// GenerateKey creates a P-256 key with the Provider, returning the handle OpenKey finds it
+// with again
+func GenerateKey() ([]byte, crypto.Signer) {
+	handle, signer, err := currentProvider().GenerateKey()
+	util.CheckErr(err, "Could not generate key")
+	return handle, signer
+}
+
+func OpenKey(handle []byte) (crypto.Signer, error) {
+	return currentProvider().OpenKey(handle)
+}
+
+// InMemoryKey returns the private key of a signer from GenerateKey or OpenKey if the
+// Provider keeps it in memory, or nil if it stays in the provider
+func InMemoryKey(signer crypto.Signer) *ecdsa.PrivateKey {
+	if signer, ok := signer.(ecdsaSigner); ok {
+		return signer.key
+	}
+	return nil
+}
+
 func GenerateEd25519Key() *ed25519.PrivateKey {
-	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
-	util.CheckErr(err, "Could not generate Ed25519 private key")
+	privateKey := ed25519.NewKeyFromSeed(KeyRandomBytes(ed25519.SeedSize))
 	return &privateKey
 }
 
@@ -51,47 +75,47 @@ func DecodePublicKey(publicKeyBytes []byte) *ecdsa.PublicKey {
 }
 
 func Encrypt(key []byte, data []byte) ([]byte, []byte, error) {
-	// TODO: Handle errors more reliably than panicing
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Could not create device cipher: %w", err)
-	}
-	nonce := RandomBytes(12)
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Could not create GCM mode: %w", err)
-	}
-	encryptedData := gcm.Seal(nil, nonce, data, nil)
-	return encryptedData, nonce, nil
+	return EncryptWithAssociatedData(key, data, nil)
 }
 
 func Decrypt(key []byte, data []byte, nonce []byte) ([]byte, error) {
-	// TODO: Handle errors more reliably than panicing
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("Could not create device cipher: %w", err)
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("Could not create GCM mode: %w", err)
-	}
-	decryptedData, err := gcm.Open(nil, nonce, data, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Could not decrypt data: %w", err)
-	}
-	return decryptedData, nil
+	return DecryptWithAssociatedData(key, data, nonce, nil)
+}
+
+// EncryptWithAssociatedData encrypts data with the Provider, AES-GCM by default,
+// authenticating (but not encrypting) the associated data, which must be supplied again on
+// decryption
+func EncryptWithAssociatedData(key []byte, data []byte, associatedData []byte) ([]byte, []byte, error) {
+	return currentProvider().Seal(key, data, associatedData)
+}
+
+func DecryptWithAssociatedData(key []byte, data []byte, nonce []byte, associatedData []byte) ([]byte, error) {
+	return currentProvider().Open(key, data, nonce, associatedData)
 }
 
 func SignECDSA(key *ecdsa.PrivateKey, data []byte) []byte {
 	hash := sha256.Sum256(data)
-	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	signature, err := currentECDSAProvider().SignECDSA(key, hash[:])
+	util.CheckErr(err, "Could not sign data")
+	return signature
+}
+
+// SignWithSigner signs the SHA-256 of data with a key from GenerateKey or OpenKey
+func SignWithSigner(signer crypto.Signer, data []byte) []byte {
+	hash := sha256.Sum256(data)
+	signature, err := signer.Sign(rand.Reader, hash[:], crypto.SHA256)
 	util.CheckErr(err, "Could not sign data")
 	return signature
 }
 
+// VerifyECDSA only accepts DER signatures, as checked by ParseECDSASignature
 func VerifyECDSA(key *ecdsa.PublicKey, data []byte, signature []byte) bool {
+	r, s, err := ParseECDSASignature(key.Curve, signature)
+	if err != nil {
+		return false
+	}
 	hash := sha256.Sum256(data)
-	return ecdsa.VerifyASN1(key, hash[:], signature)
+	return ecdsa.Verify(key, hash[:], r, s)
 }
 
 func SignEd25519(key *ed25519.PrivateKey, data []byte) []byte {
@@ -139,6 +163,12 @@ func HashSHA256(bytes []byte) []byte {
 	return hash.Sum(nil)
 }
 
+func HMACSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
 func EncryptAESCBC(key []byte, data []byte) []byte {
 	aesCipher, err := aes.NewCipher(key)
 	util.CheckErr(err, "Could not create AES cipher")
@@ -165,10 +195,11 @@ type ECDHKey struct {
 	X, Y *big.Int
 }
 
+// GenerateECDHKey creates an ephemeral key from crypto/rand, even when SetRandom is seeded
 func GenerateECDHKey() *ECDHKey {
-	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	util.CheckErr(err, "Could not generate ECDH key")
-	return &ECDHKey{Priv: priv, X: x, Y: y}
+	return &ECDHKey{Priv: key.D.FillBytes(make([]byte, 32)), X: key.X, Y: key.Y}
 }
 
 func (key *ECDHKey) ECDH(remoteX, remoteY *big.Int) []byte {
@@ -180,9 +211,40 @@ func (key *ECDHKey) PublicKeyBytes() []byte {
 	return elliptic.Marshal(elliptic.P256(), key.X, key.Y)
 }
 
+// RandomBytes reads from crypto/rand, even when SetRandom is seeded, for nonces, salts,
+// tokens and secrets
 func RandomBytes(length int) []byte {
 	randBytes := make([]byte, length)
-	_, err := rand.Read(randBytes)
+	_, err := io.ReadFull(rand.Reader, randBytes)
 	util.CheckErr(err, "Could not generate random bytes")
 	return randBytes
 }
+
+// KeyRandomBytes reads from Random, for credential IDs and keys, which SetRandom can seed
+func KeyRandomBytes(length int) []byte {
+	randBytes := make([]byte, length)
+	_, err := io.ReadFull(Random(), randBytes)
+	util.CheckErr(err, "Could not generate random bytes")
+	return randBytes
+}
+
+type ecdsaSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+// ECDSASigner signs SHA-256 digests with an in-memory key like SignECDSA, so certificates
+// signed with x509.CreateCertificate get the same signatures as everything else
+func ECDSASigner(key *ecdsa.PrivateKey) crypto.Signer {
+	return ecdsaSigner{key: key}
+}
+
+func (signer ecdsaSigner) Public() crypto.PublicKey {
+	return &signer.key.PublicKey
+}
+
+func (signer ecdsaSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("Unsupported signature hash: %s", opts.HashFunc())
+	}
+	return currentECDSAProvider().SignECDSA(signer.key, digest)
+}
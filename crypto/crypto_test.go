@@ -2,8 +2,17 @@ package crypto
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/hex"
+	"math/big"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -61,6 +70,145 @@ func TestSealOpen(t *testing.T) {
 	}
 }
 
+func newPKCS11Provider(t *testing.T) *PKCS11Provider {
+	// A software AES-GCM cipher stands in for the token's
+	block, err := aes.NewCipher(GenerateSymmetricKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As do software keys kept by ID for its key pairs
+	keyPairs := make(map[string]*ecdsa.PrivateKey)
+	return &PKCS11Provider{
+		AEAD:   aead,
+		Random: rand.Reader,
+		GenerateKeyPair: func(id []byte) (crypto.Signer, error) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			keyPairs[string(id)] = key
+			return key, err
+		},
+		FindKeyPair: func(id []byte) (crypto.Signer, error) {
+			if key, ok := keyPairs[string(id)]; ok {
+				return key, nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+func TestProviders(t *testing.T) {
+	fileKey, err := LoadOrCreateFileKey(filepath.Join(t.TempDir(), "key.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]Provider{
+		"stdlib":   StdlibProvider{},
+		"pkcs11":   newPKCS11Provider(t),
+		"file key": fileKey,
+	}
+	data := []byte("data")
+	associatedData := []byte("associated data")
+	for name, provider := range providers {
+		key := GenerateSymmetricKey()
+		encryptedData, nonce, err := provider.Seal(key, data, associatedData)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		decryptedData, err := provider.Open(key, encryptedData, nonce, associatedData)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(decryptedData, data) {
+			t.Fatalf("%s: '%s' does not match '%s'", name, decryptedData, data)
+		}
+		if _, err := provider.Open(GenerateSymmetricKey(), encryptedData, nonce, associatedData); err == nil {
+			t.Fatalf("%s: opened with the wrong key", name)
+		}
+		if _, err := provider.Open(key, encryptedData, nonce, []byte("other")); err == nil {
+			t.Fatalf("%s: opened with the wrong associated data", name)
+		}
+		handle, signer, err := provider.GenerateKey()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		opened, err := provider.OpenKey(handle)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		publicKey := signer.Public().(*ecdsa.PublicKey)
+		if !VerifyECDSA(publicKey, data, SignWithSigner(opened, data)) {
+			t.Fatalf("%s: signature of opened key not correct", name)
+		}
+		if _, err := provider.OpenKey([]byte("unknown")); err == nil {
+			t.Fatalf("%s: opened an unknown key", name)
+		}
+	}
+	if InMemoryKey(signerFrom(t, newPKCS11Provider(t))) != nil {
+		t.Fatalf("PKCS#11 keys should stay on the token")
+	}
+	if InMemoryKey(signerFrom(t, StdlibProvider{})) == nil {
+		t.Fatalf("Standard library keys should be in memory")
+	}
+}
+
+func signerFrom(t *testing.T, provider Provider) crypto.Signer {
+	_, signer, err := provider.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestFileKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.txt")
+	created, err := LoadOrCreateFileKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateFileKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(created.PublicKey(), loaded.PublicKey()) {
+		t.Fatalf("Loaded key %x does not match created key %x", loaded.PublicKey(), created.PublicKey())
+	}
+	key := GenerateSymmetricKey()
+	encryptedData, nonce, err := created.Seal(key, []byte("data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Open(key, encryptedData, nonce, nil); err != nil {
+		t.Fatalf("Could not open with the loaded key: %s", err)
+	}
+	other, err := LoadOrCreateFileKey(filepath.Join(t.TempDir(), "other.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(key, encryptedData, nonce, nil); err == nil {
+		t.Fatalf("Opened with another file key")
+	}
+	if _, err := LoadFileKey(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Fatalf("Loaded a missing file key")
+	}
+}
+
+func TestSetProvider(t *testing.T) {
+	provider := newPKCS11Provider(t)
+	SetProvider(provider)
+	defer SetProvider(StdlibProvider{})
+	key := GenerateSymmetricKey()
+	box := Seal(key, []byte("data"))
+	if _, err := (StdlibProvider{}).Open(key, box.Data, box.IV, nil); err == nil {
+		t.Fatalf("Seal did not use the provider")
+	}
+	if _, err := provider.Open(key, box.Data, box.IV, nil); err != nil {
+		t.Fatalf("Could not open with the provider: %s", err)
+	}
+}
+
 func TestHashSHA256(t *testing.T) {
 	data := []byte("test")
 	target := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
@@ -80,3 +228,172 @@ func TestEncryptDecryptAESCBC(t *testing.T) {
 		t.Fatalf("'%s' does not equal '%s'", hex.EncodeToString(decryptedData), hex.EncodeToString(data))
 	}
 }
+
+func BenchmarkSignECDSA(b *testing.B) {
+	key := GenerateECDSAKey()
+	data := RandomBytes(32)
+	for i := 0; i < b.N; i++ {
+		SignECDSA(key, data)
+	}
+}
+
+func BenchmarkVerifyECDSA(b *testing.B) {
+	key := GenerateECDSAKey()
+	data := RandomBytes(32)
+	signature := SignECDSA(key, data)
+	for i := 0; i < b.N; i++ {
+		VerifyECDSA(&key.PublicKey, data, signature)
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	key := GenerateSymmetricKey()
+	data := RandomBytes(256)
+	for i := 0; i < b.N; i++ {
+		Seal(key, data)
+	}
+}
+
+func BenchmarkHMACSHA256(b *testing.B) {
+	key := RandomBytes(32)
+	data := RandomBytes(64)
+	for i := 0; i < b.N; i++ {
+		HMACSHA256(key, data)
+	}
+}
+
+func BenchmarkECDH(b *testing.B) {
+	remote := GenerateECDSAKey()
+	for i := 0; i < b.N; i++ {
+		GenerateECDHKey().ECDH(remote.PublicKey.X, remote.PublicKey.Y)
+	}
+}
+
+// rfc6979Key is the P-256 key from RFC 6979 appendix A.2.5
+func rfc6979Key(t *testing.T) *ecdsa.PrivateKey {
+	d, _ := new(big.Int).SetString("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721", 16)
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d.Bytes())
+	x, _ := new(big.Int).SetString("60FED4BA255A9D31C961EB74C6356D68C049B8923B61FA6CE669622E60F29FB6", 16)
+	if key.X.Cmp(x) != 0 {
+		t.Fatalf("Public key %x does not match RFC 6979", key.X)
+	}
+	return key
+}
+
+func TestRFC6979(t *testing.T) {
+	key := rfc6979Key(t)
+	vectors := []struct {
+		message string
+		k       string
+		r       string
+	}{
+		{"sample", "A6E3C57DD01ABE90086538398355DD4C3B17AA873382B0F24D6129493D8AAD60", "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716"},
+		{"test", "D16B6AE827F17175E040871A1C7EC3500192C4C92677336EC2537ACAEE0008E0", "F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367"},
+	}
+	for _, vector := range vectors {
+		digest := HashSHA256([]byte(vector.message))
+		k := newRFC6979Nonces(key.D, digest, key.Curve.Params().N).next()
+		if hex.EncodeToString(k.FillBytes(make([]byte, 32))) != strings.ToLower(vector.k) {
+			t.Fatalf("%s: k is %x, expected %s", vector.message, k, vector.k)
+		}
+		signature, err := DeterministicProvider{StdlibProvider{}}.SignECDSA(key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _, err := ParseECDSASignature(key.Curve, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(r.FillBytes(make([]byte, 32))) != strings.ToLower(vector.r) {
+			t.Fatalf("%s: r is %x, expected %s", vector.message, r, vector.r)
+		}
+		if !VerifyECDSA(&key.PublicKey, []byte(vector.message), signature) {
+			t.Fatalf("%s: signature not correct: %x", vector.message, signature)
+		}
+		again, err := DeterministicProvider{StdlibProvider{}}.SignECDSA(key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(signature, again) {
+			t.Fatalf("%s: signatures differ: %x and %x", vector.message, signature, again)
+		}
+	}
+	if _, err := (DeterministicProvider{StdlibProvider{}}).SignECDSA(generateP384Key(t), HashSHA256([]byte("sample"))); err == nil {
+		t.Fatalf("Signed with a P-384 key")
+	}
+}
+
+func generateP384Key(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestParseECDSASignature(t *testing.T) {
+	key := GenerateECDSAKey()
+	data := []byte("data")
+	signature := SignECDSA(key, data)
+	if _, _, err := ParseECDSASignature(key.Curve, signature); err != nil {
+		t.Fatal(err)
+	}
+	n := key.Curve.Params().N
+	one := []byte{0x02, 0x01, 0x01}
+	invalid := map[string][]byte{
+		"empty":            {},
+		"trailing data":    append(append([]byte{}, signature...), 0x00),
+		"long form length": {0x30, 0x81, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01},
+		"padded integer":   {0x30, 0x07, 0x02, 0x02, 0x00, 0x01, 0x02, 0x01, 0x01},
+		"negative integer": {0x30, 0x06, 0x02, 0x01, 0xFF, 0x02, 0x01, 0x01},
+		"zero":             {0x30, 0x06, 0x02, 0x01, 0x00, 0x02, 0x01, 0x01},
+		"one integer":      {0x30, 0x03, 0x02, 0x01, 0x01},
+		"three integers":   append([]byte{0x30, 0x09}, append(append(append([]byte{}, one...), one...), one...)...),
+		"not a SEQUENCE":   {0x31, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01},
+		"r equal to order": encodeECDSASignature(n, big.NewInt(1)),
+		"raw r and s":      make([]byte, 64),
+		"truncated":        signature[:len(signature)-1],
+	}
+	for name, signature := range invalid {
+		if _, _, err := ParseECDSASignature(key.Curve, signature); err == nil {
+			t.Fatalf("%s: parsed %x", name, signature)
+		}
+		if VerifyECDSA(&key.PublicKey, data, signature) {
+			t.Fatalf("%s: verified %x", name, signature)
+		}
+	}
+	if _, _, err := ParseECDSASignature(key.Curve, []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01}); err != nil {
+		t.Fatalf("Could not parse r = s = 1: %s", err)
+	}
+}
+
+func TestSeededRandom(t *testing.T) {
+	defer SetRandom(nil)
+	generate := func() ([]byte, []byte, []byte, []byte, []byte) {
+		SetRandom(NewSeededRandom([]byte("seed")))
+		key := GenerateECDSAKey()
+		signature := SignECDSA(key, []byte("data"))
+		encrypted, nonce, err := Encrypt(GenerateSymmetricKey(), []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return EncodePublicKey(&key.PublicKey), signature, KeyRandomBytes(16), append(encrypted, nonce...), GenerateECDHKey().PublicKeyBytes()
+	}
+	publicKey, signature, id, sealed, ecdhKey := generate()
+	publicKey2, signature2, id2, sealed2, ecdhKey2 := generate()
+	if !bytes.Equal(publicKey, publicKey2) || !bytes.Equal(signature, signature2) || !bytes.Equal(id, id2) {
+		t.Fatalf("Seeded keys, signatures and credential IDs should be reproducible")
+	}
+	if bytes.Equal(sealed, sealed2) || bytes.Equal(ecdhKey, ecdhKey2) || bytes.Equal(RandomBytes(16), RandomBytes(16)) {
+		t.Fatalf("Nonces, symmetric keys and key agreement keys should stay random when seeded")
+	}
+	if !VerifyECDSA(DecodePublicKey(publicKey), []byte("data"), signature) {
+		t.Fatalf("Seeded signature should verify")
+	}
+	SetRandom(nil)
+	if bytes.Equal(EncodePublicKey(&GenerateECDSAKey().PublicKey), publicKey) {
+		t.Fatalf("Keys should be random again once the seed is removed")
+	}
+}
@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	fileKeyPrefix = "VIRTUAL-FIDO-SECRET-KEY-"
+	fileKeyLength = 32
+	fileKeyInfo   = "virtual-fido file key"
+)
+
+// FileKeyProvider seals to an X25519 key kept in its own file, like an age identity: each
+// seal uses a new ephemeral key, so the file is needed to open anything sealed with it.
+// Keys are generated and used in memory, as with StdlibProvider.
+type FileKeyProvider struct {
+	StdlibProvider
+	private []byte
+	public  []byte
+}
+
+func newFileKeyProvider(private []byte) (*FileKeyProvider, error) {
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid file key: %w", err)
+	}
+	return &FileKeyProvider{private: private, public: public}, nil
+}
+
+// LoadFileKey reads a key written by LoadOrCreateFileKey. Lines starting with # are comments.
+func LoadFileKey(path string) (*FileKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read file key: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, fileKeyPrefix) {
+			return nil, fmt.Errorf("File key must start with %s", fileKeyPrefix)
+		}
+		private, err := hex.DecodeString(strings.TrimPrefix(line, fileKeyPrefix))
+		if err != nil || len(private) != fileKeyLength {
+			return nil, fmt.Errorf("File key must be %d hex encoded bytes", fileKeyLength)
+		}
+		return newFileKeyProvider(private)
+	}
+	return nil, fmt.Errorf("No key in %s", path)
+}
+
+// LoadOrCreateFileKey reads the key at path, generating and saving a new one if the file
+// doesn't exist
+func LoadOrCreateFileKey(path string) (*FileKeyProvider, error) {
+	p, err := LoadFileKey(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return p, err
+	}
+	p, err = newFileKeyProvider(RandomBytes(fileKeyLength))
+	if err != nil {
+		return nil, err
+	}
+	contents := fmt.Sprintf("# created: %s\n# public key: %x\n%s%X\n", time.Now().Format(time.RFC3339), p.public, fileKeyPrefix, p.private)
+	// O_EXCL so a key written by another process at the same time isn't replaced
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create file key: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(contents); err != nil {
+		return nil, fmt.Errorf("Could not write file key: %w", err)
+	}
+	return p, nil
+}
+
+// PublicKey identifies the file key without revealing it
+func (p *FileKeyProvider) PublicKey() []byte {
+	return p.public
+}
+
+// cipher derives an AES-GCM cipher for one ephemeral share. The software key is mixed in,
+// so it's needed as well as the file key.
+func (p *FileKeyProvider) cipher(shared []byte, ephemeral []byte, key []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), p.public...)
+	pseudoRandomKey := HMACSHA256(salt, shared)
+	info := append([]byte(fileKeyInfo), HashSHA256(key)...)
+	aesKey := HMACSHA256(pseudoRandomKey, append(info, 1))
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create file key cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal returns the ephemeral public key as the nonce. Every seal has its own AES key, so
+// the GCM nonce can be fixed.
+func (p *FileKeyProvider) Seal(key []byte, data []byte, associatedData []byte) ([]byte, []byte, error) {
+	ephemeralPrivate := RandomBytes(fileKeyLength)
+	ephemeral, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := curve25519.X25519(ephemeralPrivate, p.public)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := p.cipher(shared, ephemeral, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm.Seal(nil, make([]byte, gcm.NonceSize()), data, associatedData), ephemeral, nil
+}
+
+func (p *FileKeyProvider) Open(key []byte, data []byte, nonce []byte, associatedData []byte) ([]byte, error) {
+	if len(nonce) != fileKeyLength {
+		return nil, fmt.Errorf("Invalid nonce length: %d", len(nonce))
+	}
+	shared, err := curve25519.X25519(p.private, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ephemeral key: %w", err)
+	}
+	gcm, err := p.cipher(shared, nonce, key)
+	if err != nil {
+		return nil, err
+	}
+	decryptedData, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), data, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt data: %w", err)
+	}
+	return decryptedData, nil
+}
@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Provider does the private-key operations of the authenticator: generating credential keys,
+// signing with them, and sealing the vault and key handles. Embedders that need every key
+// operation to go through an HSM can install their own with SetProvider.
+type Provider interface {
+	// GenerateKey creates a P-256 key pair, like C_GenerateKeyPair, returning a handle that
+	// OpenKey finds it with again. The private key can stay in the provider, since all that's
+	// needed of it is the signer's Sign, like C_Sign.
+	GenerateKey() (handle []byte, signer crypto.Signer, err error)
+	OpenKey(handle []byte) (crypto.Signer, error)
+	// Seal encrypts and authenticates data with key and associatedData, returning the
+	// encrypted data and a nonce that Open needs along with the same key
+	Seal(key []byte, data []byte, associatedData []byte) ([]byte, []byte, error)
+	Open(key []byte, data []byte, nonce []byte, associatedData []byte) ([]byte, error)
+}
+
+// ECDSAProvider is implemented by providers that also sign with keys held in memory, such as
+// attestation keys and keys sealed into U2F key handles. Other providers' in-memory keys are
+// signed by StdlibProvider.
+type ECDSAProvider interface {
+	// SignECDSA returns an ASN.1 signature over the SHA-256 digest
+	SignECDSA(key *ecdsa.PrivateKey, digest []byte) ([]byte, error)
+}
+
+var providerLock sync.RWMutex
+var provider Provider = StdlibProvider{}
+
+// SetProvider routes key generation, signing and sealing to p. Data sealed by one provider
+// can only be opened by the same provider, so it must be set before any vault is opened.
+func SetProvider(p Provider) {
+	providerLock.Lock()
+	defer providerLock.Unlock()
+	provider = p
+}
+
+func currentProvider() Provider {
+	providerLock.RLock()
+	defer providerLock.RUnlock()
+	return provider
+}
+
+func currentECDSAProvider() ECDSAProvider {
+	if p, ok := currentProvider().(ECDSAProvider); ok {
+		return p
+	}
+	return StdlibProvider{}
+}
+
+// StdlibProvider keeps every key in memory and uses the Go standard library, with AES-GCM
+// for sealing. Its key handles are the encoded private keys.
+type StdlibProvider struct{}
+
+func (StdlibProvider) GenerateKey() ([]byte, crypto.Signer, error) {
+	key, err := generateP256Key()
+	if err != nil {
+		return nil, nil, err
+	}
+	handle, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return handle, ECDSASigner(key), nil
+}
+
+func (StdlibProvider) OpenKey(handle []byte) (crypto.Signer, error) {
+	key, err := x509.ParseECPrivateKey(handle)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key handle: %w", err)
+	}
+	return ECDSASigner(key), nil
+}
+
+// SignECDSA uses RFC 6979 nonces when the random source is seeded, since the standard
+// library mixes its own randomness into signatures
+func (StdlibProvider) SignECDSA(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	if seeded() {
+		return DeterministicProvider{}.SignECDSA(key, digest)
+	}
+	return ecdsa.SignASN1(rand.Reader, key, digest)
+}
+
+func (StdlibProvider) Seal(key []byte, data []byte, associatedData []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create device cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create GCM mode: %w", err)
+	}
+	return sealAEAD(gcm, rand.Reader, data, associatedData)
+}
+
+func (StdlibProvider) Open(key []byte, data []byte, nonce []byte, associatedData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create device cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create GCM mode: %w", err)
+	}
+	return openAEAD(gcm, data, nonce, associatedData)
+}
+
+func sealAEAD(aead cipher.AEAD, random io.Reader, data []byte, associatedData []byte) ([]byte, []byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, nil, fmt.Errorf("Could not generate nonce: %w", err)
+	}
+	return aead.Seal(nil, nonce, data, associatedData), nonce, nil
+}
+
+func openAEAD(aead cipher.AEAD, data []byte, nonce []byte, associatedData []byte) ([]byte, error) {
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid nonce length: %d", len(nonce))
+	}
+	decryptedData, err := aead.Open(nil, nonce, data, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt data: %w", err)
+	}
+	return decryptedData, nil
+}
+
+// PKCS11Provider generates credential keys on a PKCS#11 token and signs with them there, so
+// they never leave it, and seals with an AES key that never leaves it either. Key handles
+// are the keys' CKA_ID. Everything comes from the embedder's PKCS#11 library, e.g. with
+// github.com/ThalesIgnite/crypto11:
+//
+//	key, _ := context.FindKey(nil, []byte("virtual-fido"))
+//	aead, _ := key.NewGCM()
+//	random, _ := context.NewRandomReader()
+//	crypto.SetProvider(&crypto.PKCS11Provider{
+//		AEAD:   aead,
+//		Random: random,
+//		GenerateKeyPair: func(id []byte) (gocrypto.Signer, error) {
+//			return context.GenerateECDSAKeyPair(id, elliptic.P256())
+//		},
+//		FindKeyPair: func(id []byte) (gocrypto.Signer, error) {
+//			return context.FindKeyPair(id, nil)
+//		},
+//	})
+type PKCS11Provider struct {
+	AEAD   cipher.AEAD
+	Random io.Reader
+	// GenerateKeyPair creates a P-256 key pair on the token with CKA_ID id
+	GenerateKeyPair func(id []byte) (crypto.Signer, error)
+	// FindKeyPair finds a key pair created by GenerateKeyPair
+	FindKeyPair func(id []byte) (crypto.Signer, error)
+}
+
+const pkcs11KeyIDLength = 16
+
+func (p *PKCS11Provider) GenerateKey() ([]byte, crypto.Signer, error) {
+	id := make([]byte, pkcs11KeyIDLength)
+	if _, err := io.ReadFull(p.Random, id); err != nil {
+		return nil, nil, fmt.Errorf("Could not generate key ID: %w", err)
+	}
+	signer, err := p.GenerateKeyPair(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not generate key pair on token: %w", err)
+	}
+	return id, signer, nil
+}
+
+func (p *PKCS11Provider) OpenKey(handle []byte) (crypto.Signer, error) {
+	signer, err := p.FindKeyPair(handle)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find key pair %x on token: %w", handle, err)
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("No key pair %x on token", handle)
+	}
+	return signer, nil
+}
+
+// Seal binds the software key into the associated data, so the token's key and the
+// software key are both needed to open the data
+func (p *PKCS11Provider) Seal(key []byte, data []byte, associatedData []byte) ([]byte, []byte, error) {
+	return sealAEAD(p.AEAD, p.Random, data, keyAssociatedData(key, associatedData))
+}
+
+func (p *PKCS11Provider) Open(key []byte, data []byte, nonce []byte, associatedData []byte) ([]byte, error) {
+	return openAEAD(p.AEAD, data, nonce, keyAssociatedData(key, associatedData))
+}
+
+func keyAssociatedData(key []byte, associatedData []byte) []byte {
+	return append(HashSHA256(key), associatedData...)
+}
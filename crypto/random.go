@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+)
+
+var randomLock sync.RWMutex
+var random io.Reader = rand.Reader
+
+// SetRandom replaces the random source for credential and attestation keys and credential
+// IDs, or restores crypto/rand if nil. With a SeededRandom, test suites get byte-identical
+// credentials, attestation objects and assertions across runs. Nonces, salts, tokens and
+// every other secret always come from crypto/rand, as do RSA keys and the keys of providers
+// with their own random source like PKCS11Provider.
+//
+// Anything generated from a seeded source can be reproduced by anyone with the seed, so it
+// must never be used outside tests.
+func SetRandom(r io.Reader) {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	if r == nil {
+		r = rand.Reader
+	}
+	random = r
+}
+
+// Random is the random source set by SetRandom. Only read it for credential and attestation
+// keys and what's made from them, such as attestation certificates.
+func Random() io.Reader {
+	randomLock.RLock()
+	defer randomLock.RUnlock()
+	return random
+}
+
+func seeded() bool {
+	return Random() != rand.Reader
+}
+
+// SeededRandom is a deterministic stream of bytes, the AES-256-CTR keystream of a key
+// derived from the seed
+type SeededRandom struct {
+	lock   sync.Mutex
+	stream cipher.Stream
+}
+
+func NewSeededRandom(seed []byte) *SeededRandom {
+	key := sha256.Sum256(seed)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	return &SeededRandom{stream: cipher.NewCTR(block, make([]byte, block.BlockSize()))}
+}
+
+func (r *SeededRandom) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range p {
+		p[i] = 0
+	}
+	r.stream.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// generateP256Key uses the standard library unless the random source is seeded. The
+// standard library doesn't derive keys from the bytes it reads, so seeded keys are derived
+// here as in FIPS 186-4 appendix B.4.1.
+func generateP256Key() (*ecdsa.PrivateKey, error) {
+	if !seeded() {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	curve := elliptic.P256()
+	n := curve.Params().N
+	b := make([]byte, n.BitLen()/8+8)
+	if _, err := io.ReadFull(Random(), b); err != nil {
+		return nil, fmt.Errorf("Could not generate key: %w", err)
+	}
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, new(big.Int).Sub(n, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, (n.BitLen()+7)/8)))
+	return key, nil
+}
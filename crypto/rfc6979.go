@@ -0,0 +1,178 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// DeterministicProvider signs with nonces derived from the key and digest as in RFC 6979,
+// instead of from a random number generator, so a weak or compromised generator can't leak
+// credential keys. Everything else goes to the wrapped Provider, including signing with keys
+// it keeps to itself.
+//
+// The signature is computed with math/big, which isn't constant-time, so its timing depends
+// on the nonce and the private key, and someone who can time many signatures locally may be
+// able to recover the key. The nonce is blinded with a value from Random, which makes that
+// harder but doesn't close it. Don't use it where signing can be timed by an attacker.
+type DeterministicProvider struct {
+	Provider
+}
+
+func (p DeterministicProvider) SignECDSA(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := signRFC6979(key, digest)
+	if err != nil {
+		return nil, err
+	}
+	return encodeECDSASignature(r, s), nil
+}
+
+func signRFC6979(key *ecdsa.PrivateKey, digest []byte) (*big.Int, *big.Int, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, nil, fmt.Errorf("Deterministic signatures need a P-256 key")
+	}
+	n := key.Curve.Params().N
+	e := hashToInt(digest, n)
+	nonces := newRFC6979Nonces(key.D, digest, n)
+	for {
+		k := nonces.next()
+		x, _ := key.Curve.ScalarBaseMult(k.FillBytes(make([]byte, (n.BitLen()+7)/8)))
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		blind, err := rand.Int(Random(), new(big.Int).Sub(n, big.NewInt(1)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not generate blinding value: %w", err)
+		}
+		blind.Add(blind, big.NewInt(1))
+		// s = (k*b)^-1 * (b*e + b*r*d), which is k^-1 * (e + r*d)
+		blindedK := new(big.Int).Mul(k, blind)
+		blindedK.Mod(blindedK, n)
+		s := new(big.Int).Mul(blind, r)
+		s.Mul(s, key.D)
+		s.Add(s, new(big.Int).Mul(blind, e))
+		s.Mul(s, fermatInverse(blindedK, n))
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+		return r, s, nil
+	}
+}
+
+// fermatInverse computes k^(n-2) mod n. big.Int.Exp still takes time depending on k.
+func fermatInverse(k *big.Int, n *big.Int) *big.Int {
+	exponent := new(big.Int).Sub(n, big.NewInt(2))
+	return new(big.Int).Exp(k, exponent, n)
+}
+
+// hashToInt is bits2int from RFC 6979 section 2.3.2, keeping the leftmost bits of the digest
+func hashToInt(digest []byte, n *big.Int) *big.Int {
+	orderBits := n.BitLen()
+	orderBytes := (orderBits + 7) / 8
+	if len(digest) > orderBytes {
+		digest = digest[:orderBytes]
+	}
+	value := new(big.Int).SetBytes(digest)
+	if excess := len(digest)*8 - orderBits; excess > 0 {
+		value.Rsh(value, uint(excess))
+	}
+	return value
+}
+
+// rfc6979Nonces is the HMAC_DRBG of RFC 6979 section 3.2 with SHA-256
+type rfc6979Nonces struct {
+	n *big.Int
+	k []byte
+	v []byte
+	// Whether K and V need updating before the next candidate, after one was rejected
+	retry bool
+}
+
+func newRFC6979Nonces(privateKey *big.Int, digest []byte, n *big.Int) *rfc6979Nonces {
+	length := (n.BitLen() + 7) / 8
+	x := privateKey.FillBytes(make([]byte, length))
+	h := hashToInt(digest, n)
+	if h.Cmp(n) >= 0 {
+		h.Sub(h, n)
+	}
+	h1 := h.FillBytes(make([]byte, length))
+	nonces := &rfc6979Nonces{n: n, k: make([]byte, sha256.Size), v: make([]byte, sha256.Size)}
+	for i := range nonces.v {
+		nonces.v[i] = 0x01
+	}
+	nonces.k = nonces.mac(nonces.v, []byte{0x00}, x, h1)
+	nonces.v = nonces.mac(nonces.v)
+	nonces.k = nonces.mac(nonces.v, []byte{0x01}, x, h1)
+	nonces.v = nonces.mac(nonces.v)
+	return nonces
+}
+
+func (nonces *rfc6979Nonces) mac(data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, nonces.k)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// next returns the next candidate in [1, n-1]
+func (nonces *rfc6979Nonces) next() *big.Int {
+	length := (nonces.n.BitLen() + 7) / 8
+	for {
+		if nonces.retry {
+			nonces.k = nonces.mac(nonces.v, []byte{0x00})
+			nonces.v = nonces.mac(nonces.v)
+		}
+		nonces.retry = true
+		var t []byte
+		for len(t) < length {
+			nonces.v = nonces.mac(nonces.v)
+			t = append(t, nonces.v...)
+		}
+		k := hashToInt(t, nonces.n)
+		if k.Sign() > 0 && k.Cmp(nonces.n) < 0 {
+			return k
+		}
+	}
+}
+
+func encodeECDSASignature(r, s *big.Int) []byte {
+	var builder cryptobyte.Builder
+	builder.AddASN1(asn1.SEQUENCE, func(child *cryptobyte.Builder) {
+		child.AddASN1BigInt(r)
+		child.AddASN1BigInt(s)
+	})
+	return builder.BytesOrPanic()
+}
+
+var errInvalidSignature = errors.New("Invalid ECDSA signature")
+
+// ParseECDSASignature checks that signature is a DER encoded ECDSA-Sig-Value for curve: a
+// SEQUENCE of two minimally encoded INTEGERs in [1, n-1], with nothing after it. BER, e.g.
+// long form lengths that fit in short form, is rejected.
+func ParseECDSASignature(curve elliptic.Curve, signature []byte) (*big.Int, *big.Int, error) {
+	input := cryptobyte.String(signature)
+	var inner cryptobyte.String
+	r, s := new(big.Int), new(big.Int)
+	if !input.ReadASN1(&inner, asn1.SEQUENCE) || !input.Empty() {
+		return nil, nil, fmt.Errorf("%w: not a single DER SEQUENCE", errInvalidSignature)
+	}
+	if !inner.ReadASN1Integer(r) || !inner.ReadASN1Integer(s) || !inner.Empty() {
+		return nil, nil, fmt.Errorf("%w: SEQUENCE must hold exactly two DER INTEGERs", errInvalidSignature)
+	}
+	n := curve.Params().N
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return nil, nil, fmt.Errorf("%w: r and s must be in [1, n-1]", errInvalidSignature)
+	}
+	return r, s, nil
+}
@@ -0,0 +1,114 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+const (
+	attestationFormatPacked           = "packed"
+	attestationFormatApple            = "apple"
+	attestationFormatAndroidKey       = "android-key"
+	attestationFormatAndroidSafetyNet = "android-safetynet"
+)
+
+// Version of Google Play Services reported in android-safetynet statements
+const safetyNetVersion = "1"
+
+// CTAPAttestationChainClient is implemented by clients whose attestation certificates are
+// issued by intermediate CAs, which are sent after the attestation certificate in x5c
+type CTAPAttestationChainClient interface {
+	AttestationIntermediates() [][]byte
+}
+
+// CTAPAppleAttestationClient is implemented by clients that can emulate the anonymous "apple"
+// attestation format, for testing RP verifiers. While AppleAttestation reports true,
+// MakeCredential attests with a certificate for the credential's own key holding the nonce
+// of the request, and no signature.
+type CTAPAppleAttestationClient interface {
+	AppleAttestation() bool
+	CreateAppleAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, nonce []byte) []byte
+}
+
+// CTAPAndroidAttestationClient is implemented by clients that can emulate the attestation
+// formats of Android, for testing RP verifiers. AndroidAttestation reports android-key,
+// android-safetynet, or nothing to use neither.
+type CTAPAndroidAttestationClient interface {
+	AndroidAttestation() string
+	// A certificate for the credential's own key whose KeyDescription holds challenge
+	CreateAndroidKeyAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, challenge []byte) []byte
+	// A SafetyNet attestation JWS for nonce
+	CreateSafetyNetResponse(nonce []byte) []byte
+}
+
+type basicAttestationStatement struct {
+	Alg cose.COSEAlgorithmID `cbor:"alg"`
+	Sig []byte               `cbor:"sig"`
+	X5c [][]byte             `cbor:"x5c"`
+	// Only in android-safetynet statements
+	Ver      string `cbor:"ver"`
+	Response []byte `cbor:"response"`
+	// Decides which fields are encoded
+	format string
+}
+
+func (statement basicAttestationStatement) MarshalCBOR() ([]byte, error) {
+	switch statement.format {
+	case attestationFormatApple:
+		return ctapEncMode.Marshal(struct {
+			X5c [][]byte `cbor:"x5c"`
+		}{statement.X5c})
+	case attestationFormatAndroidSafetyNet:
+		return ctapEncMode.Marshal(struct {
+			Ver      string `cbor:"ver"`
+			Response []byte `cbor:"response"`
+		}{statement.Ver, statement.Response})
+	default:
+		return ctapEncMode.Marshal(struct {
+			Alg cose.COSEAlgorithmID `cbor:"alg"`
+			Sig []byte               `cbor:"sig"`
+			X5c [][]byte             `cbor:"x5c"`
+		}{statement.Alg, statement.Sig, statement.X5c})
+	}
+}
+
+// makeAttestationStatement attests a new credential in the format the client asks for.
+// Conformance tools only know the packed format, so it's always used in conformance mode.
+func (server *CTAPServer) makeAttestationStatement(credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) basicAttestationStatement {
+	signedData := util.Concat(authenticatorData, clientDataHash)
+	format := attestationFormatPacked
+	android, isAndroid := server.client.(CTAPAndroidAttestationClient)
+	if apple, ok := server.client.(CTAPAppleAttestationClient); ok && apple.AppleAttestation() {
+		format = attestationFormatApple
+	} else if isAndroid && android.AndroidAttestation() != "" {
+		format = android.AndroidAttestation()
+	}
+	if server.conformance {
+		format = attestationFormatPacked
+	}
+	var statement basicAttestationStatement
+	switch format {
+	case attestationFormatApple:
+		nonce := crypto.HashSHA256(signedData)
+		statement.X5c = [][]byte{server.client.(CTAPAppleAttestationClient).CreateAppleAttestationCertificate(credentialSource.PrivateKey, nonce)}
+	case attestationFormatAndroidKey:
+		statement.Alg = cose.COSE_ALGORITHM_ID_ES256
+		statement.Sig = credentialSource.PrivateKey.Sign(signedData)
+		statement.X5c = [][]byte{android.CreateAndroidKeyAttestationCertificate(credentialSource.PrivateKey, clientDataHash)}
+	case attestationFormatAndroidSafetyNet:
+		statement.Ver = safetyNetVersion
+		statement.Response = android.CreateSafetyNetResponse(crypto.HashSHA256(signedData))
+	default:
+		format = attestationFormatPacked
+		statement.Alg = cose.COSE_ALGORITHM_ID_ES256
+		statement.Sig = credentialSource.PrivateKey.Sign(signedData)
+		statement.X5c = [][]byte{server.client.CreateAttestationCertificiate(credentialSource.PrivateKey)}
+	}
+	statement.format = format
+	if chainClient, ok := server.client.(CTAPAttestationChainClient); ok && statement.X5c != nil {
+		statement.X5c = append(statement.X5c, chainClient.AttestationIntermediates()...)
+	}
+	return statement
+}
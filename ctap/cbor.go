@@ -0,0 +1,142 @@
+package ctap
+
+import (
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Deeper requests aren't sent by any platform, and bound the recursion when checking them
+const cborMaxNestedLevels = 16
+
+// Responses use CTAP2 canonical CBOR: shortest integers and lengths, definite lengths, no
+// tags, and map keys sorted by length then bytes
+var ctapEncMode = newCTAPEncMode()
+
+// Requests are decoded strictly, after checkCanonicalCBOR has rejected anything not
+// canonically encoded
+var ctapDecMode = newCTAPDecMode()
+
+func newCTAPEncMode() cbor.EncMode {
+	encMode, err := cbor.CTAP2EncOptions().EncMode()
+	util.CheckErr(err, "Could not get CTAP2 encoding mode")
+	return encMode
+}
+
+func newCTAPDecMode() cbor.DecMode {
+	decMode, err := cbor.DecOptions{
+		DupMapKey:       cbor.DupMapKeyEnforcedAPF,
+		IndefLength:     cbor.IndefLengthForbidden,
+		TagsMd:          cbor.TagsForbidden,
+		MaxNestedLevels: cborMaxNestedLevels,
+	}.DecMode()
+	util.CheckErr(err, "Could not get CTAP2 decoding mode")
+	return decMode
+}
+
+func marshalCBOR(value interface{}) []byte {
+	data, err := ctapEncMode.Marshal(value)
+	util.CheckErr(err, "Could not marshal CBOR")
+	return data
+}
+
+// unmarshalCBOR decodes a request, failing on duplicate map keys and on anything that isn't
+// canonical CBOR, so it can be answered with CTAP2_ERR_INVALID_CBOR
+func unmarshalCBOR(data []byte, value interface{}) error {
+	if err := checkCanonicalCBOR(data); err != nil {
+		return err
+	}
+	return ctapDecMode.Unmarshal(data, value)
+}
+
+// checkCanonicalCBOR checks that data is a single data item whose integers, lengths and
+// simple values are all encoded in their shortest form, without indefinite lengths
+func checkCanonicalCBOR(data []byte) error {
+	length, err := checkCanonicalItem(data, 0)
+	if err != nil {
+		return err
+	}
+	if length != len(data) {
+		return fmt.Errorf("%d bytes of extraneous data", len(data)-length)
+	}
+	return nil
+}
+
+// checkCanonicalItem returns the length of the data item at the start of data
+func checkCanonicalItem(data []byte, depth int) (int, error) {
+	if depth > cborMaxNestedLevels {
+		return 0, fmt.Errorf("Nested more than %d levels", cborMaxNestedLevels)
+	}
+	if len(data) == 0 {
+		return 0, fmt.Errorf("Unexpected end of data")
+	}
+	majorType := data[0] >> 5
+	additional := data[0] & 0x1f
+	var argument uint64
+	headerLength := 1
+	switch {
+	case additional < 24:
+		argument = uint64(additional)
+	case additional <= 27:
+		argumentLength := 1 << (additional - 24)
+		if len(data) < 1+argumentLength {
+			return 0, fmt.Errorf("Unexpected end of data")
+		}
+		for _, b := range data[1 : 1+argumentLength] {
+			argument = argument<<8 | uint64(b)
+		}
+		headerLength += argumentLength
+		// Floats are the only values whose length doesn't depend on their size
+		if majorType != 7 && argument < minimumArgument(additional) {
+			return 0, fmt.Errorf("Non-canonical argument 0x%x for major type %d", argument, majorType)
+		}
+		if majorType == 7 && additional == 24 && argument < 32 {
+			return 0, fmt.Errorf("Non-canonical simple value %d", argument)
+		}
+	case additional == 31:
+		return 0, fmt.Errorf("Indefinite length for major type %d", majorType)
+	default:
+		return 0, fmt.Errorf("Reserved additional information %d", additional)
+	}
+	switch majorType {
+	case 2, 3:
+		if argument > uint64(len(data)-headerLength) {
+			return 0, fmt.Errorf("Unexpected end of data")
+		}
+		return headerLength + int(argument), nil
+	case 4, 5:
+		items := argument
+		if majorType == 5 {
+			items *= 2
+		}
+		offset := headerLength
+		for i := uint64(0); i < items; i++ {
+			length, err := checkCanonicalItem(data[offset:], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			offset += length
+		}
+		return offset, nil
+	case 6:
+		length, err := checkCanonicalItem(data[headerLength:], depth+1)
+		return headerLength + length, err
+	default:
+		return headerLength, nil
+	}
+}
+
+// minimumArgument is the smallest argument that needs the given additional information
+func minimumArgument(additional byte) uint64 {
+	switch additional {
+	case 24:
+		return 24
+	case 25:
+		return 1 << 8
+	case 26:
+		return 1 << 16
+	default:
+		return 1 << 32
+	}
+}
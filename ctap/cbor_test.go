@@ -0,0 +1,121 @@
+package ctap
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestCanonicalEncoding(t *testing.T) {
+	vectors := []struct {
+		value    interface{}
+		expected string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{255, "18ff"},
+		{256, "190100"},
+		{65536, "1a00010000"},
+		{4294967296, "1b0000000100000000"},
+		{-1, "20"},
+		{-25, "3818"},
+		{[]byte{1, 2}, "420102"},
+		{"a", "6161"},
+		{[]int{1, 2}, "820102"},
+		// Keys sorted by length of their encoding, then bytewise
+		{map[interface{}]int{"aa": 0, "b": 0, -1: 0, 10: 0, 1: 0}, "a501000a00200061620062616100"},
+		{makeCredentialResponse{FormatIdentifer: "none", AuthData: []byte{}}, "a301646e6f6e65024003a363616c670063736967f663783563f6"},
+	}
+	for _, vector := range vectors {
+		encoded := hex.EncodeToString(marshalCBOR(vector.value))
+		test.AssertEqual(t, encoded, vector.expected, "Encoding is not canonical")
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	valid := []string{
+		"00",
+		"17",
+		"1818",
+		"190100",
+		"3818",
+		"a201020304",
+		"a10182f5f6",
+		"f93c00",
+	}
+	for _, vector := range valid {
+		data, _ := hex.DecodeString(vector)
+		var value interface{}
+		test.Assert(t, unmarshalCBOR(data, &value) == nil, "Canonical CBOR "+vector+" should decode")
+	}
+	invalid := []string{
+		// Integers and lengths not in their shortest form
+		"1801",
+		"1900ff",
+		"1a0000ffff",
+		"1b00000000ffffffff",
+		"3800",
+		"580101",
+		"78016161",
+		"980100",
+		"b8010102",
+		"a119000102",
+		// Duplicate map keys
+		"a201010102",
+		"a2616101616102",
+		// Indefinite lengths
+		"9f01ff",
+		"5f4101ff",
+		// Simple value 1 in two bytes, reserved additional information, tags
+		"f801",
+		"1c",
+		"c0617a",
+		// Truncated and trailing data
+		"1901",
+		"a101",
+		"0000",
+	}
+	for _, vector := range invalid {
+		data, _ := hex.DecodeString(vector)
+		var value interface{}
+		test.Assert(t, unmarshalCBOR(data, &value) != nil, "Non-canonical CBOR "+vector+" should be rejected")
+	}
+}
+
+func TestInvalidCBORRequest(t *testing.T) {
+	ctap := NewCTAPServer(&dummyCTAPClient{})
+	// getAssertion with the RP ID (key 1) twice
+	args, _ := hex.DecodeString("a3016172016173025820" + hex.EncodeToString(make([]byte, 32)))
+	response := ctap.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, args))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrInvalidCBOR, "Duplicate keys should be invalid CBOR")
+	// clientDataHash length 32 encoded in two bytes
+	args, _ = hex.DecodeString("a20161720259" + "0020" + hex.EncodeToString(make([]byte, 32)))
+	response = ctap.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, args))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrInvalidCBOR, "Non-canonical lengths should be invalid CBOR")
+}
+
+func BenchmarkMarshalCBOR(b *testing.B) {
+	response := makeCredentialResponse{FormatIdentifer: "packed", AuthData: make([]byte, 164)}
+	for i := 0; i < b.N; i++ {
+		marshalCBOR(response)
+	}
+}
+
+func BenchmarkUnmarshalCBOR(b *testing.B) {
+	data := marshalCBOR(getAssertionArgs{
+		RPID:           "example.com",
+		ClientDataHash: make([]byte, 32),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: make([]byte, 64)}},
+	})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var args getAssertionArgs
+		if err := unmarshalCBOR(data, &args); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ctap
+
+import (
+	"bytes"
+
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CTAPAlwaysUVClient is implemented by clients that keep the CTAP 2.1 alwaysUv setting, which
+// platforms toggle with authenticatorConfig. While it's on, every MakeCredential and
+// GetAssertion needs user verification and U2F is turned off.
+type CTAPAlwaysUVClient interface {
+	AlwaysUV() bool
+	SetAlwaysUV(enabled bool)
+}
+
+type configSubcommand uint32
+
+const (
+	configSubcommandToggleAlwaysUV configSubcommand = 0x02
+)
+
+type configArgs struct {
+	SubCommand        configSubcommand `cbor:"1,keyasint"`
+	SubCommandParams  cbor.RawMessage  `cbor:"2,keyasint,omitempty"`
+	PINUVAuthProtocol uint32           `cbor:"3,keyasint,omitempty"`
+	PINUVAuthParam    []byte           `cbor:"4,keyasint,omitempty"`
+}
+
+// SetMakeCredUVNotRequired lets MakeCredential create non-resident credentials without the
+// PIN while alwaysUv is off, as the CTAP 2.1 makeCredUvNotRqd option describes
+func (server *CTAPServer) SetMakeCredUVNotRequired(enabled bool) {
+	server.makeCredUVNotRequired = enabled
+}
+
+func (server *CTAPServer) alwaysUV() bool {
+	client, ok := server.client.(CTAPAlwaysUVClient)
+	return ok && client.AlwaysUV()
+}
+
+func (server *CTAPServer) handleConfig(trace util.TraceID, data []byte) []byte {
+	logger := ctapLogger.WithTrace(trace)
+	client, ok := server.client.(CTAPAlwaysUVClient)
+	if !ok {
+		logger.Printf("ERROR: Authenticator config not supported\n\n")
+		return []byte{byte(ctap1ErrInvalidCommand)}
+	}
+	var args configArgs
+	if err := unmarshalCBOR(data, &args); err != nil {
+		logger.Printf("ERROR: Could not decode CBOR for CONFIG: %s %v\n\n", err, data)
+		return []byte{byte(decodeErrorStatus(err))}
+	}
+	if args.SubCommand == 0 {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
+	if server.readOnly {
+		logger.Printf("ERROR: CONFIG refused in read-only mode\n\n")
+		return []byte{byte(ctap2ErrOperationDenied)}
+	}
+	if server.client.SupportsPIN() && (server.pinSet() || args.PINUVAuthParam != nil) {
+		if args.PINUVAuthParam == nil {
+			return []byte{byte(ctap2ErrPINRequired)}
+		}
+		if args.PINUVAuthProtocol == 0 {
+			return []byte{byte(ctap2ErrMissingParam)}
+		}
+		if args.PINUVAuthProtocol != 1 {
+			return []byte{byte(ctap1ErrInvalidParameter)}
+		}
+		// pinUvAuthParam is the MAC of 32 bytes of 0xff, the command and the subcommand
+		message := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandConfig), byte(args.SubCommand)}, []byte(args.SubCommandParams))
+		if !server.checkPINAuth(trace, pinPermissionAuthenticatorConfig, "", message, args.PINUVAuthParam) {
+			return []byte{byte(ctap2ErrPINAuthInvalid)}
+		}
+	}
+	switch args.SubCommand {
+	case configSubcommandToggleAlwaysUV:
+		client.SetAlwaysUV(!client.AlwaysUV())
+		logger.Printf("CONFIG: alwaysUv is now %t\n\n", client.AlwaysUV())
+		return []byte{byte(ctap1ErrSuccess)}
+	default:
+		logger.Printf("ERROR: Unsupported config subcommand: %d\n\n", args.SubCommand)
+		return []byte{byte(ctap2ErrInvalidSubcommand)}
+	}
+}
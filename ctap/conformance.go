@@ -0,0 +1,67 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// CTAPResetClient is implemented by clients that can be wiped with authenticatorReset, which
+// is only handled in conformance mode
+type CTAPResetClient interface {
+	ApproveReset() bool
+	ResetVault()
+}
+
+// SetConformanceMode makes the server answer as the FIDO Alliance conformance tools expect
+// from a CTAP 2.0 authenticator, where the default behavior departs from it for platforms:
+//
+//   - GetInfo reports only the CTAP 2.0 fields and extensions, leaving out transports,
+//     algorithms, credBlob and the remaining credential count
+//   - authenticatorReset deletes every credential and the PIN once the user approves, if the
+//     client is a CTAPResetClient. The tools reset between tests, and a virtual device
+//     can't be power cycled, so the reset isn't limited to 10 seconds after power up.
+//
+// Errors follow the precedence of the CTAP 2.0 spec in either mode, see runChecks.
+func (server *CTAPServer) SetConformanceMode(enabled bool) {
+	server.conformance = enabled
+}
+
+// conformanceGetInfo leaves out what CTAP 2.0 doesn't define
+func conformanceGetInfo(response getInfoResponse) getInfoResponse {
+	extensions := []string{}
+	for _, extension := range response.Extensions {
+		if extension != extensionCredBlob {
+			extensions = append(extensions, extension)
+		}
+	}
+	response.Extensions = extensions
+	response.Transports = nil
+	response.Algorithms = nil
+	response.MaxCredBlobLength = 0
+	response.RemainingDiscoverableCredentials = nil
+	response.Options.AlwaysUV = nil
+	response.Options.AuthenticatorConfig = nil
+	response.Options.PINUVAuthToken = nil
+	response.Options.MakeCredUVNotRequired = nil
+	return response
+}
+
+func (server *CTAPServer) handleReset(trace util.TraceID) []byte {
+	logger := ctapLogger.WithTrace(trace)
+	resetClient, ok := server.client.(CTAPResetClient)
+	if !server.conformance || !ok {
+		logger.Printf("ERROR: Reset is only supported in conformance mode\n\n")
+		return []byte{byte(ctap1ErrInvalidCommand)}
+	}
+	if server.readOnly {
+		logger.Printf("ERROR: RESET refused in read-only mode\n\n")
+		return []byte{byte(ctap2ErrOperationDenied)}
+	}
+	status := server.askUser(trace, resetClient.ApproveReset)
+	if status != ctap1ErrSuccess {
+		logger.Printf("ERROR: Unapproved action (Reset)\n\n")
+		return []byte{byte(status)}
+	}
+	resetClient.ResetVault()
+	server.pinToken = pinTokenState{}
+	return []byte{byte(ctap1ErrSuccess)}
+}
@@ -0,0 +1,48 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type resetCTAPClient struct {
+	dummyPINCTAPClient
+	resets int
+}
+
+func (client *resetCTAPClient) ApproveReset() bool {
+	return true
+}
+func (client *resetCTAPClient) ResetVault() {
+	client.resets++
+	client.pinHash = nil
+}
+
+func TestConformanceMode(t *testing.T) {
+	client := &resetCTAPClient{dummyPINCTAPClient: *newDummyPINCTAPClient()}
+	client.pinHash = []byte{1}
+	server := NewCTAPServer(client)
+	checkStatus := func(message []byte, expected ctapStatusCode, description string) {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), expected, description)
+	}
+	checkStatus([]byte{byte(ctapCommandReset)}, ctap1ErrInvalidCommand, "Reset should only be handled in conformance mode")
+
+	server.SetConformanceMode(true)
+	response := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &info), "Could not decode response")
+	test.AssertArrEqual(t, info.Versions, []string{"FIDO_2_0", "U2F_V2"}, "Wrong versions")
+	test.AssertEqual(t, len(info.Extensions), 0, "CTAP 2.1 extensions shouldn't be advertised")
+	test.AssertEqual(t, len(info.Transports), 0, "Transports shouldn't be reported")
+	test.AssertEqual(t, info.MaxCredBlobLength, uint32(0), "maxCredBlobLength shouldn't be reported")
+
+	server.SetReadOnly(true)
+	checkStatus([]byte{byte(ctapCommandReset)}, ctap2ErrOperationDenied, "Reset should be refused in read-only mode")
+	server.SetReadOnly(false)
+	checkStatus([]byte{byte(ctapCommandReset)}, ctap1ErrSuccess, "Reset should succeed")
+	test.AssertEqual(t, client.resets, 1, "Vault should be reset")
+	test.Assert(t, client.pinHash == nil, "PIN should be cleared")
+}
@@ -2,24 +2,30 @@ package ctap
 
 import (
 	"bytes"
+	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/bulwarkid/virtual-fido/audit"
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/fault_injection"
 	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/metrics"
 	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
-
-	"github.com/fxamacker/cbor/v2"
 )
 
-var ctapLogger = util.NewLogger("[CTAP] ", util.LogLevelDebug)
-var unsafeCtapLogger = util.NewLogger("[CTAP] ", util.LogLevelUnsafe)
+var ctapLogger = util.NewLogger("[CTAP] ", util.LogSubsystemCTAP, util.LogLevelDebug)
 
-var aaguid = [16]byte{117, 108, 90, 245, 236, 166, 1, 163, 47, 198, 211, 12, 226, 242, 1, 197}
+var ctapCommandCounter = metrics.NewCounter("virtual_fido_ctap_commands_total", "CTAP2 commands handled", "command", "status")
+var ctapCommandDuration = metrics.NewHistogram("virtual_fido_ctap_command_duration_seconds", "Time to handle a CTAP2 command, including user approval", metrics.DefaultBuckets, "command")
+var unsafeCtapLogger = util.NewLogger("[CTAP] ", util.LogSubsystemCTAP, util.LogLevelUnsafe)
 
 type ctapCommand uint8
 
@@ -30,6 +36,9 @@ const (
 	ctapCommandClientPIN        ctapCommand = 0x06
 	ctapCommandReset            ctapCommand = 0x07
 	ctapCommandGetNextAssertion ctapCommand = 0x08
+	ctapCommandCredentialMgmt   ctapCommand = 0x0A
+	ctapCommandSelection        ctapCommand = 0x0B
+	ctapCommandConfig           ctapCommand = 0x0D
 )
 
 var ctapCommandDescriptions = map[ctapCommand]string{
@@ -39,6 +48,9 @@ var ctapCommandDescriptions = map[ctapCommand]string{
 	ctapCommandClientPIN:        "ctapCommandClientPIN",
 	ctapCommandReset:            "ctapCommandReset",
 	ctapCommandGetNextAssertion: "ctapCommandGetNextAssertion",
+	ctapCommandCredentialMgmt:   "ctapCommandCredentialMgmt",
+	ctapCommandSelection:        "ctapCommandSelection",
+	ctapCommandConfig:           "ctapCommandConfig",
 }
 
 type ctapStatusCode byte
@@ -52,18 +64,26 @@ const (
 	ctap1ErrTimeout          ctapStatusCode = 0x05
 	ctap1ErrChannelBusy      ctapStatusCode = 0x06
 
-	ctap2ErrUnsupportedAlgorithm ctapStatusCode = 0x26
-	ctap2ErrInvalidCBOR          ctapStatusCode = 0x12
-	ctap2ErrNoCredentials        ctapStatusCode = 0x2E
-	ctap2ErrOperationDenied      ctapStatusCode = 0x27
-	ctap2ErrMissingParam         ctapStatusCode = 0x14
-	ctap2ErrPINInvalid           ctapStatusCode = 0x31
-	ctap2ErrPINBlocked           ctapStatusCode = 0x32
-	ctap2ErrPINAuthInvalid       ctapStatusCode = 0x33
-	ctap2ErrNoPINSet             ctapStatusCode = 0x35
-	ctap2ErrPINRequired          ctapStatusCode = 0x36
-	ctap2ErrPINPolicyViolation   ctapStatusCode = 0x37
-	ctap2ErrPINExpired           ctapStatusCode = 0x38
+	ctap2ErrUnsupportedAlgorithm   ctapStatusCode = 0x26
+	ctap2ErrCBORUnexpectedType     ctapStatusCode = 0x11
+	ctap2ErrInvalidCBOR            ctapStatusCode = 0x12
+	ctap2ErrNoCredentials          ctapStatusCode = 0x2E
+	ctap2ErrUserActionTimeout      ctapStatusCode = 0x2F
+	ctap2ErrCredentialExcluded     ctapStatusCode = 0x19
+	ctap2ErrOperationDenied        ctapStatusCode = 0x27
+	ctap2ErrKeyStoreFull           ctapStatusCode = 0x28
+	ctap2ErrMissingParam           ctapStatusCode = 0x14
+	ctap2ErrUnsupportedOption      ctapStatusCode = 0x2B
+	ctap2ErrInvalidOption          ctapStatusCode = 0x2C
+	ctap2ErrPINInvalid             ctapStatusCode = 0x31
+	ctap2ErrPINBlocked             ctapStatusCode = 0x32
+	ctap2ErrPINAuthInvalid         ctapStatusCode = 0x33
+	ctap2ErrNoPINSet               ctapStatusCode = 0x35
+	ctap2ErrPINRequired            ctapStatusCode = 0x36
+	ctap2ErrPINPolicyViolation     ctapStatusCode = 0x37
+	ctap2ErrPINExpired             ctapStatusCode = 0x38
+	ctap2ErrInvalidSubcommand      ctapStatusCode = 0x3E
+	ctap2ErrUnauthorizedPermission ctapStatusCode = 0x40
 )
 
 type CTAPClient interface {
@@ -83,34 +103,220 @@ type CTAPClient interface {
 	PINRetries() int32
 	SetPINRetries(retries int32)
 	PINKeyAgreement() *crypto.ECDHKey
-	PINToken() []byte
 
 	ApproveAccountCreation(relyingParty string) bool
 	ApproveAccountLogin(credentialSource *identities.CredentialSource) bool
 }
 
+// CTAPUserVerificationClient is implemented by clients with built-in user verification,
+// used when the platform asks for "uv" instead of using the PIN
+type CTAPUserVerificationClient interface {
+	SupportsUserVerification() bool
+	VerifyUser() bool
+}
+
+// CTAPUserApprovalClient is implemented by clients that show the user account being created,
+// not just the RP name. ApproveUserAccountCreation is asked instead of ApproveAccountCreation.
+type CTAPUserApprovalClient interface {
+	ApproveUserAccountCreation(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) bool
+}
+
+// CTAPPINVerifierClient is implemented by clients that check the PIN themselves instead of
+// handing out its hash, e.g. a delegate's front-end. PINHash isn't called then.
+type CTAPPINVerifierClient interface {
+	PINSet() bool
+	// Reports whether pinHash, the first 16 bytes of the PIN's SHA-256, is the PIN's
+	CheckPINHash(pinHash []byte) bool
+}
+
+// CTAPSelectionClient is implemented by clients that can ask the user to pick this
+// authenticator while the platform waits for a tap on one of several. Other clients decline
+// to be picked.
+type CTAPSelectionClient interface {
+	ApproveSelection() bool
+}
+
+// CTAPCredBlobClient is implemented by clients that store the credBlob extension with their
+// credentials. The extension isn't offered otherwise.
+type CTAPCredBlobClient interface {
+	SetCredBlob(credentialSource *identities.CredentialSource, credBlob []byte)
+}
+
+// CTAPCredentialLookupClient is implemented by clients that can check exclude and allow lists
+// without using the credentials, and that can use U2F key handles as CTAP2 credentials
+type CTAPCredentialLookupClient interface {
+	// Reports whether id is a credential or U2F key handle of this authenticator bound to
+	// relyingPartyID, without using it
+	HasCredential(relyingPartyID string, id []byte) bool
+	// Wraps a U2F key handle registered for relyingPartyID (an RP ID or appid), or returns nil
+	U2FCredentialSource(relyingPartyID string, keyHandle []byte) *identities.CredentialSource
+}
+
+// CTAPAAGUIDClient is implemented by clients with their own AAGUID. Other clients report
+// identities.DefaultAAGUID.
+type CTAPAAGUIDClient interface {
+	AAGUID() [16]byte
+}
+
+// CTAPTransactionClient is implemented by clients whose state can change between requests,
+// e.g. when the vault is reloaded. Each request is handled between BeginTransaction and
+// EndTransaction.
+type CTAPTransactionClient interface {
+	BeginTransaction()
+	EndTransaction()
+}
+
+// CTAPDisplayClient is implemented by clients that can show the user the text of the
+// txAuthSimple extension. DisplayTransaction reports whether the user confirmed it.
+type CTAPDisplayClient interface {
+	DisplayTransaction(text string) bool
+}
+
+// CTAPCredentialStoreClient is implemented by clients with room for a limited number of
+// credentials. MakeCredential fails with CTAP2_ERR_KEY_STORE_FULL when a credential doesn't
+// fit, and the remaining room is reported in GetInfo and credential management metadata.
+type CTAPCredentialStoreClient interface {
+	// Reports whether the credential MakeCredential would create for user fits, e.g. because
+	// it replaces one or isn't stored at all
+	CanStoreCredential(residentKey bool, relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) bool
+	ResidentCredentialCount() int
+	// How many more resident credentials fit, or -1 without a limit
+	RemainingResidentCredentials() int
+}
+
+// CTAPNonResidentClient is implemented by clients that create credentials differently when
+// the platform doesn't ask for a resident key, e.g. without storing them
+type CTAPNonResidentClient interface {
+	NewNonResidentCredentialSource(
+		PubKeyCredParams []webauthn.PublicKeyCredentialParams,
+		ExcludeList []webauthn.PublicKeyCredentialDescriptor,
+		relyingParty *webauthn.PublicKeyCredentialRPEntity,
+		user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource
+}
+
 type CTAPServer struct {
-	client CTAPClient
+	client         CTAPClient
+	faults         *fault_injection.FaultInjector
+	maxMessageSize uint32
+	transports     []string
+	timeouts       Timeouts
+	pinToken       pinTokenState
+	// Refuses requests that would change the vault, see SetReadOnly
+	readOnly bool
+	auditor  audit.Auditor
+	// Matches the FIDO conformance tools, see SetConformanceMode
+	conformance bool
+	// Reported as makeCredUvNotRqd, see SetMakeCredUVNotRequired
+	makeCredUVNotRequired bool
+	// Limits GetAssertion by RP ID, see SetAssertionRateLimit
+	assertionLimiter *util.RateLimiter
 }
 
 func NewCTAPServer(client CTAPClient) *CTAPServer {
-	return &CTAPServer{client: client}
+	return &CTAPServer{
+		client:         client,
+		maxMessageSize: defaultMaxMessageSize,
+		transports:     []string{"usb"},
+		timeouts:       DefaultTimeouts(),
+	}
+}
+
+// SetTransport describes the transport carrying CTAP messages, as reported in GetInfo.
+// Larger messages are rejected.
+func (server *CTAPServer) SetTransport(maxMessageSize uint32, transports ...string) {
+	server.maxMessageSize = maxMessageSize
+	server.transports = transports
+}
+
+func (server *CTAPServer) SetTimeouts(timeouts Timeouts) {
+	server.timeouts = timeouts
+}
+
+func (server *CTAPServer) SetFaultInjector(faults *fault_injection.FaultInjector) {
+	server.faults = faults
+}
+
+// SetReadOnly makes the server refuse MakeCredential and setting or changing the PIN with
+// CTAP2_ERR_OPERATION_DENIED, so the credentials can be used but never changed
+func (server *CTAPServer) SetReadOnly(readOnly bool) {
+	server.readOnly = readOnly
+}
+
+// SetAuditor tells auditor about every GetAssertion request and how it was answered
+func (server *CTAPServer) SetAuditor(auditor audit.Auditor) {
+	server.auditor = auditor
+}
+
+// SetAssertionRateLimit fails GetAssertion requests for an RP past limit with
+// CTAP2_ERR_USER_ACTION_TIMEOUT before the user is asked, so scripts can't keep the user
+// answering approvals. Requests that fail the checks before that aren't counted.
+func (server *CTAPServer) SetAssertionRateLimit(limit util.RateLimit) {
+	server.assertionLimiter = util.NewRateLimiter(limit)
 }
 
 func (server *CTAPServer) HandleMessage(data []byte) []byte {
+	return server.HandleTracedMessage(util.NewTraceID(), data)
+}
+
+// HandleTracedMessage handles a message traced by the transport, tagging what's logged and
+// published while handling it with the trace
+func (server *CTAPServer) HandleTracedMessage(trace util.TraceID, data []byte) []byte {
+	logger := ctapLogger.WithTrace(trace)
+	if len(data) == 0 {
+		logger.Printf("ERROR: Empty CTAP message\n\n")
+		return []byte{byte(ctap1ErrInvalidLength)}
+	}
+	if uint32(len(data)) > server.maxMessageSize {
+		logger.Printf("ERROR: CTAP message of %d bytes is larger than maxMsgSize %d\n\n", len(data), server.maxMessageSize)
+		return []byte{byte(ctap1ErrInvalidLength)}
+	}
+	if transactionClient, ok := server.client.(CTAPTransactionClient); ok {
+		transactionClient.BeginTransaction()
+		defer transactionClient.EndTransaction()
+	}
 	command := ctapCommand(data[0])
-	ctapLogger.Printf("CTAP COMMAND: %s\n\n", ctapCommandDescriptions[command])
+	logger.Printf("CTAP COMMAND: %s\n\n", ctapCommandDescriptions[command])
+	start := time.Now()
+	response := server.handleCommand(trace, command, data[1:])
+	commandName, ok := ctapCommandDescriptions[command]
+	if !ok {
+		commandName = "unknown"
+	}
+	ctapCommandCounter.Inc(commandName, fmt.Sprintf("0x%02x", response[0]))
+	ctapCommandDuration.ObserveSince(start, commandName)
+	return response
+}
+
+func (server *CTAPServer) handleCommand(trace util.TraceID, command ctapCommand, data []byte) []byte {
+	if status, ok := server.faults.CTAPError(uint8(command)); ok {
+		return []byte{status}
+	}
 	switch command {
 	case ctapCommandMakeCredential:
-		return server.handleMakeCredential(data[1:])
+		if server.readOnly {
+			ctapLogger.WithTrace(trace).Printf("ERROR: MAKE_CREDENTIAL refused in read-only mode\n\n")
+			return []byte{byte(ctap2ErrOperationDenied)}
+		}
+		return server.handleMakeCredential(trace, data)
 	case ctapCommandGetInfo:
-		return server.handleGetInfo()
+		return server.handleGetInfo(trace)
 	case ctapCommandGetAssertion:
-		return server.handleGetAssertion(data[1:])
+		response := server.handleGetAssertion(trace, data)
+		server.auditAssertion(data, response)
+		return response
 	case ctapCommandClientPIN:
-		return server.handleClientPIN(data[1:])
+		return server.handleClientPIN(trace, data)
+	case ctapCommandCredentialMgmt:
+		return server.handleCredentialManagement(trace, data)
+	case ctapCommandSelection:
+		return server.handleSelection(trace)
+	case ctapCommandReset:
+		return server.handleReset(trace)
+	case ctapCommandConfig:
+		return server.handleConfig(trace, data)
 	default:
-		panic(fmt.Sprintf("Invalid CTAP Command: %d", command))
+		ctapLogger.WithTrace(trace).Printf("ERROR: Invalid CTAP Command: %d\n\n", command)
+		return []byte{byte(ctap1ErrInvalidCommand)}
 	}
 }
 
@@ -126,6 +332,8 @@ type authDataFlags uint8
 const (
 	authDataFlagUserPresent           authDataFlags = 0b00000001
 	authDataFlagUserVerified          authDataFlags = 0b00000100
+	authDataFlagBackupEligible        authDataFlags = 0b00001000
+	authDataFlagBackedUp              authDataFlags = 0b00010000
 	authDataFlagAttestedDataIncluded  authDataFlags = 0b01000000
 	authDataFlagExtensionDataIncluded authDataFlags = 0b10000000
 )
@@ -141,27 +349,71 @@ type selfAttestationStatement struct {
 	Sig []byte               `cbor:"sig"`
 }
 
-type basicAttestationStatement struct {
-	Alg cose.COSEAlgorithmID `cbor:"alg"`
-	Sig []byte               `cbor:"sig"`
-	X5c [][]byte             `cbor:"x5c"`
-}
-
-func makeAttestedCredentialData(credentialSource *identities.CredentialSource) []byte {
+func makeAttestedCredentialData(aaguid [16]byte, credentialSource *identities.CredentialSource) []byte {
 	encodedCredentialPublicKey := cose.MarshalCOSEPublicKey(credentialSource.PrivateKey.Public())
 	return util.Concat(aaguid[:], util.ToBE(uint16(len(credentialSource.ID))), credentialSource.ID, encodedCredentialPublicKey)
 }
 
-func makeAuthData(rpID string, credentialSource *identities.CredentialSource, attestedCredentialData []byte, flags authDataFlags) []byte {
+// backupFlags are the BE and BS flags of a credential. BS is never set without BE.
+func backupFlags(credentialSource *identities.CredentialSource) authDataFlags {
+	var flags authDataFlags = 0
+	if credentialSource.BackupEligible {
+		flags = flags | authDataFlagBackupEligible
+		if credentialSource.BackedUp {
+			flags = flags | authDataFlagBackedUp
+		}
+	}
+	return flags
+}
+
+func makeAuthData(rpID string, signatureCounter int32, attestedCredentialData []byte, extensions map[string]interface{}, flags authDataFlags) []byte {
 	if attestedCredentialData != nil {
 		flags = flags | authDataFlagAttestedDataIncluded
 	} else {
 		attestedCredentialData = []byte{}
 	}
+	extensionData := []byte{}
+	if len(extensions) > 0 {
+		flags = flags | authDataFlagExtensionDataIncluded
+		extensionData = marshalCBOR(extensions)
+	}
 	rpIdHash := sha256.Sum256([]byte(rpID))
-	return util.Concat(rpIdHash[:], []byte{uint8(flags)}, util.ToBE(credentialSource.SignatureCounter), attestedCredentialData)
+	return util.Concat(rpIdHash[:], []byte{uint8(flags)}, util.ToBE(signatureCounter), attestedCredentialData, extensionData)
 }
 
+const (
+	extensionCredBlob = "credBlob"
+	// WebAuthn appid and appidExclude, which let U2F registrations made under an
+	// AppID be used with (or excluded from) a CTAP2 request for the RP ID
+	extensionAppID        = "appid"
+	extensionAppIDExclude = "appidExclude"
+	// WebAuthn Level 1 transaction confirmation, where the authenticator shows the RP's text
+	// and returns it in the assertion once the user confirms it
+	extensionTxAuthSimple = "txAuthSimple"
+	// Largest credBlob we store; CTAP 2.1 requires at least 32 bytes
+	maxCredBlobLength = 32
+)
+
+var supportedAlgorithms = []webauthn.PublicKeyCredentialParams{
+	{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256},
+}
+
+func supportsES256(params []webauthn.PublicKeyCredentialParams) bool {
+	for _, param := range params {
+		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// Message size platforms can assume when the authenticator doesn't report one
+	defaultMaxMessageSize = 1024
+	// Larger allow and exclude lists are split by the platform
+	maxCredentialCountInList = 64
+)
+
 type makeCredentialOptions struct {
 	ResidentKey      bool  `cbor:"rk,omitempty"`
 	UserVerification bool  `cbor:"uv,omitempty"`
@@ -200,115 +452,231 @@ type makeCredentialResponse struct {
 	AttestationStatement basicAttestationStatement `cbor:"3,keyasint"`
 }
 
-func (server *CTAPServer) handleMakeCredential(data []byte) []byte {
+func (server *CTAPServer) handleMakeCredential(trace util.TraceID, data []byte) []byte {
+	logger := ctapLogger.WithTrace(trace)
 	var args makeCredentialArgs
-	err := cbor.Unmarshal(data, &args)
-	util.CheckErr(err, fmt.Sprintf("Could not decode CBOR for MAKE_CREDENTIAL: %s %v", err, data))
-	ctapLogger.Printf("MAKE CREDENTIAL: %s\n\n", args)
-	var flags authDataFlags = 0
-
-	supported := false
-	for _, param := range args.PubKeyCredParams {
-		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
-			supported = true
-		}
+	err := unmarshalCBOR(data, &args)
+	if err != nil {
+		logger.Printf("ERROR: Could not decode CBOR for MAKE_CREDENTIAL: %s %v\n\n", err, data)
+		return []byte{byte(decodeErrorStatus(err))}
 	}
-	if !supported {
-		ctapLogger.Printf("ERROR: Unsupported Algorithm\n\n")
-		return []byte{byte(ctap2ErrUnsupportedAlgorithm)}
+	logger.Printf("MAKE CREDENTIAL: %s\n\n", args)
+	var flags authDataFlags = 0
+	if status := runChecks(trace, server.makeCredentialChecks(trace, args, &flags)); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
 	}
 
-	if server.client.SupportsPIN() {
-		if args.PINUVAuthProtocol == 1 && args.PINUVAuthParam != nil {
-			pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-			if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
-			}
-			flags = flags | authDataFlagUserVerified
-		} else if args.PINUVAuthParam == nil && server.client.PINHash() != nil {
-			return []byte{byte(ctap2ErrPINRequired)}
-		} else if args.PINUVAuthParam != nil && args.PINUVAuthProtocol != 1 {
-			return []byte{byte(ctap2ErrPINAuthInvalid)}
+	userVerification := args.Options != nil && args.Options.UserVerification
+	if (userVerification || server.alwaysUV()) && flags&authDataFlagUserVerified == 0 {
+		status := server.verifyUser(trace)
+		if status != ctap1ErrSuccess {
+			return []byte{byte(status)}
 		}
+		flags = flags | authDataFlagUserVerified
 	}
 
-	if !server.client.ApproveAccountCreation(args.RP.Name) {
-		ctapLogger.Printf("ERROR: Unapproved action (Create account)")
-		return []byte{byte(ctap2ErrOperationDenied)}
+	pinAuthorized := args.PINUVAuthParam != nil && flags&authDataFlagUserVerified != 0
+	status := server.collectUserPresence(trace, pinAuthorized, func() bool { return server.approveAccountCreation(args.RP, args.User) })
+	if status != ctap1ErrSuccess {
+		logger.Printf("ERROR: Unapproved action (Create account)")
+		return []byte{byte(status)}
 	}
 	flags = flags | authDataFlagUserPresent
 
-	credentialSource := server.client.NewCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RP, args.User)
+	residentKey := args.Options != nil && args.Options.ResidentKey
+	if store, ok := server.client.(CTAPCredentialStoreClient); ok && !store.CanStoreCredential(residentKey, args.RP, args.User) {
+		logger.Printf("ERROR: No room for another credential\n\n")
+		return []byte{byte(ctap2ErrKeyStoreFull)}
+	}
+	var credentialSource *identities.CredentialSource
+	nonResidentClient, ok := server.client.(CTAPNonResidentClient)
+	if ok && !residentKey {
+		credentialSource = nonResidentClient.NewNonResidentCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RP, args.User)
+	} else {
+		credentialSource = server.client.NewCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RP, args.User)
+	}
 	if credentialSource == nil {
-		ctapLogger.Printf("ERROR: Unsupported Algorithm\n\n")
+		logger.Printf("ERROR: Unsupported Algorithm\n\n")
 		return []byte{byte(ctap2ErrUnsupportedAlgorithm)}
 	}
-	attestedCredentialData := makeAttestedCredentialData(credentialSource)
-	authenticatorData := makeAuthData(args.RP.ID, credentialSource, attestedCredentialData, flags)
-
-	attestationCert := server.client.CreateAttestationCertificiate(credentialSource.PrivateKey)
-	attestationSignature := credentialSource.PrivateKey.Sign(append(authenticatorData, args.ClientDataHash...))
-	attestationStatement := basicAttestationStatement{
-		Alg: cose.COSE_ALGORITHM_ID_ES256,
-		Sig: attestationSignature,
-		X5c: [][]byte{attestationCert},
+	extensions := make(map[string]interface{})
+	if credBlob, ok := args.Extensions[extensionCredBlob].([]byte); ok {
+		credBlobClient, supported := server.client.(CTAPCredBlobClient)
+		stored := supported && len(credBlob) <= maxCredBlobLength
+		if stored {
+			credBlobClient.SetCredBlob(credentialSource, credBlob)
+		}
+		extensions[extensionCredBlob] = stored
 	}
+	attestedCredentialData := makeAttestedCredentialData(server.aaguid(), credentialSource)
+	flags = flags | backupFlags(credentialSource)
+	authenticatorData := makeAuthData(args.RP.ID, credentialSource.SignatureCounter, attestedCredentialData, extensions, flags)
+
+	attestationStatement := server.makeAttestationStatement(credentialSource, authenticatorData, args.ClientDataHash)
 
 	response := makeCredentialResponse{
 		AuthData:             authenticatorData,
-		FormatIdentifer:      "packed",
+		FormatIdentifer:      attestationStatement.format,
 		AttestationStatement: attestationStatement,
 	}
-	ctapLogger.Printf("MAKE CREDENTIAL RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	logger.Printf("MAKE CREDENTIAL RESPONSE: %#v\n\n", response)
+	events.Publish(events.Event{
+		Type:           events.EventCredentialCreated,
+		Protocol:       events.ProtocolCTAP2,
+		RelyingPartyID: args.RP.ID,
+		CredentialID:   credentialSource.ID,
+		TraceID:        trace,
+	})
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
 }
 
 type getInfoOptions struct {
-	IsPlatform      bool  `cbor:"plat"`
-	CanResidentKey  bool  `cbor:"rk"`
-	HasClientPIN    *bool `cbor:"clientPin,omitempty"`
-	CanUserPresence bool  `cbor:"up"`
-	// CanUserVerification bool  `cbor:"uv"`
+	IsPlatform          bool  `cbor:"plat"`
+	CanResidentKey      bool  `cbor:"rk"`
+	HasClientPIN        *bool `cbor:"clientPin,omitempty"`
+	CanUserPresence     bool  `cbor:"up"`
+	CanUserVerification *bool `cbor:"uv,omitempty"`
+	AlwaysUV            *bool `cbor:"alwaysUv,omitempty"`
+	AuthenticatorConfig *bool `cbor:"authnrCfg,omitempty"`
+	PINUVAuthToken      *bool `cbor:"pinUvAuthToken,omitempty"`
+	// Left out unless set with SetMakeCredUVNotRequired
+	MakeCredUVNotRequired *bool `cbor:"makeCredUvNotRqd,omitempty"`
 }
 
 type getInfoResponse struct {
-	Versions []string `cbor:"1,keyasint,omitempty"`
-	//Extensions []string `cbor:"2,keyasint,omitempty"`
-	AAGUID  [16]byte       `cbor:"3,keyasint,omitempty"`
-	Options getInfoOptions `cbor:"4,keyasint,omitempty"`
-	//MaxMessageSize uint32   `cbor:"5,keyasint,omitempty"`
-	PINUVAuthProtocols []uint32 `cbor:"6,keyasint,omitempty"`
+	Versions                 []string                             `cbor:"1,keyasint,omitempty"`
+	Extensions               []string                             `cbor:"2,keyasint,omitempty"`
+	AAGUID                   [16]byte                             `cbor:"3,keyasint,omitempty"`
+	Options                  getInfoOptions                       `cbor:"4,keyasint,omitempty"`
+	MaxMessageSize           uint32                               `cbor:"5,keyasint,omitempty"`
+	PINUVAuthProtocols       []uint32                             `cbor:"6,keyasint,omitempty"`
+	MaxCredentialCountInList uint32                               `cbor:"7,keyasint,omitempty"`
+	Transports               []string                             `cbor:"9,keyasint,omitempty"`
+	Algorithms               []webauthn.PublicKeyCredentialParams `cbor:"10,keyasint,omitempty"`
+	MaxCredBlobLength        uint32                               `cbor:"15,keyasint,omitempty"`
+	// Left out without a limit
+	RemainingDiscoverableCredentials *uint32 `cbor:"20,keyasint,omitempty"`
+}
+
+func (server *CTAPServer) supportedExtensions() []string {
+	extensions := []string{}
+	if _, ok := server.client.(CTAPCredBlobClient); ok {
+		extensions = append(extensions, extensionCredBlob)
+	}
+	if _, ok := server.client.(CTAPDisplayClient); ok {
+		extensions = append(extensions, extensionTxAuthSimple)
+	}
+	return extensions
+}
+
+func (server *CTAPServer) aaguid() [16]byte {
+	if client, ok := server.client.(CTAPAAGUIDClient); ok {
+		return client.AAGUID()
+	}
+	return identities.DefaultAAGUID
+}
+
+func (server *CTAPServer) supportsUserVerification() bool {
+	client, ok := server.client.(CTAPUserVerificationClient)
+	return ok && client.SupportsUserVerification()
+}
+
+func (server *CTAPServer) approveAccountCreation(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	if client, ok := server.client.(CTAPUserApprovalClient); ok {
+		return client.ApproveUserAccountCreation(relyingParty, user)
+	}
+	return server.client.ApproveAccountCreation(relyingParty.Name)
+}
+
+func (server *CTAPServer) pinSet() bool {
+	if verifier, ok := server.client.(CTAPPINVerifierClient); ok {
+		return verifier.PINSet()
+	}
+	return server.client.PINHash() != nil
+}
+
+func (server *CTAPServer) checkPINHash(pinHash []byte) bool {
+	if verifier, ok := server.client.(CTAPPINVerifierClient); ok {
+		return verifier.CheckPINHash(pinHash)
+	}
+	return bytes.Equal(server.client.PINHash(), pinHash)
 }
 
-func (server *CTAPServer) handleGetInfo() []byte {
+func (server *CTAPServer) approveSelection() bool {
+	if client, ok := server.client.(CTAPSelectionClient); ok {
+		return client.ApproveSelection()
+	}
+	return false
+}
+
+func (server *CTAPServer) handleGetInfo(trace util.TraceID) []byte {
+	// FIDO_2_1 also requires credential management, which isn't fully implemented
 	response := getInfoResponse{
-		Versions: []string{"FIDO_2_0", "U2F_V2"},
-		AAGUID:   aaguid,
+		Versions:                 []string{"FIDO_2_0", "U2F_V2"},
+		Extensions:               server.supportedExtensions(),
+		AAGUID:                   server.aaguid(),
+		MaxMessageSize:           server.maxMessageSize,
+		MaxCredentialCountInList: maxCredentialCountInList,
+		Transports:               server.transports,
+		Algorithms:               supportedAlgorithms,
 		Options: getInfoOptions{
 			IsPlatform:      false,
 			CanResidentKey:  server.client.SupportsResidentKey(),
 			CanUserPresence: true,
-			// CanUserVerification: true,
 		},
 	}
+	if _, ok := server.client.(CTAPCredBlobClient); ok {
+		response.MaxCredBlobLength = maxCredBlobLength
+	}
+	if server.supportsUserVerification() {
+		userVerification := true
+		response.Options.CanUserVerification = &userVerification
+	}
 	if server.client.SupportsPIN() {
-		var clientPIN bool = server.client.PINHash() != nil
+		var clientPIN bool = server.pinSet()
 		response.Options.HasClientPIN = &clientPIN
+		pinUVAuthToken := true
+		response.Options.PINUVAuthToken = &pinUVAuthToken
 		response.PINUVAuthProtocols = []uint32{1}
 	}
-	ctapLogger.Printf("GET_INFO RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	if store, ok := server.client.(CTAPCredentialStoreClient); ok {
+		if remaining := store.RemainingResidentCredentials(); remaining >= 0 {
+			count := uint32(remaining)
+			response.RemainingDiscoverableCredentials = &count
+		}
+	}
+	if _, ok := server.client.(CTAPAlwaysUVClient); ok {
+		alwaysUV, config := server.alwaysUV(), true
+		response.Options.AlwaysUV = &alwaysUV
+		response.Options.AuthenticatorConfig = &config
+		if alwaysUV {
+			// U2F can't verify the user
+			response.Versions = []string{"FIDO_2_0"}
+		}
+	}
+	if server.makeCredUVNotRequired {
+		notRequired := !server.alwaysUV()
+		response.Options.MakeCredUVNotRequired = &notRequired
+	}
+	if server.conformance {
+		response = conformanceGetInfo(response)
+	}
+	ctapLogger.WithTrace(trace).Printf("GET_INFO RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
 }
 
 type getAssertionOptions struct {
 	UserVerification bool  `cbor:"uv,omitempty"`
 	UserPresence     *bool `cbor:"up,omitempty"`
+	// Not valid for GetAssertion, only decoded to refuse it in conformance mode
+	ResidentKey *bool `cbor:"rk,omitempty"`
 }
 
 type getAssertionArgs struct {
 	RPID              string                                   `cbor:"1,keyasint"`
 	ClientDataHash    []byte                                   `cbor:"2,keyasint"`
 	AllowList         []webauthn.PublicKeyCredentialDescriptor `cbor:"3,keyasint"`
+	Extensions        map[string]interface{}                   `cbor:"4,keyasint,omitempty"`
 	Options           getAssertionOptions                      `cbor:"5,keyasint"`
 	PINUVAuthParam    []byte                                   `cbor:"6,keyasint,omitempty"`
 	PINUVAuthProtocol uint32                                   `cbor:"7,keyasint,omitempty"`
@@ -322,46 +690,133 @@ type getAssertionResponse struct {
 	//NumberOfCredentials int32 `cbor:"5,keyasint"`
 }
 
-func (server *CTAPServer) handleGetAssertion(data []byte) []byte {
+// isExcluded reports whether the exclude list has a credential of this authenticator for the
+// RP, or a U2F key handle registered under the appidExclude AppID. Clients that can't look
+// credentials up check the exclude list in NewCredentialSource.
+func (server *CTAPServer) isExcluded(args makeCredentialArgs) bool {
+	lookup, ok := server.client.(CTAPCredentialLookupClient)
+	if !ok {
+		return false
+	}
+	appID, hasAppID := args.Extensions[extensionAppIDExclude].(string)
+	for _, descriptor := range args.ExcludeList {
+		if lookup.HasCredential(args.RP.ID, descriptor.ID) {
+			return true
+		}
+		if hasAppID && lookup.HasCredential(appID, descriptor.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// u2fAssertionSource looks for a U2F key handle in the allow list that was registered
+// for the RP ID, or for the AppID given with the appid extension
+func (server *CTAPServer) u2fAssertionSource(trace util.TraceID, args getAssertionArgs) *identities.CredentialSource {
+	lookup, ok := server.client.(CTAPCredentialLookupClient)
+	if !ok {
+		return nil
+	}
+	relyingPartyIDs := []string{args.RPID}
+	if appID, ok := args.Extensions[extensionAppID].(string); ok {
+		relyingPartyIDs = append(relyingPartyIDs, appID)
+	}
+	for _, descriptor := range args.AllowList {
+		for _, relyingPartyID := range relyingPartyIDs {
+			if source := lookup.U2FCredentialSource(relyingPartyID, descriptor.ID); source != nil {
+				ctapLogger.WithTrace(trace).Printf("Using U2F credential registered for %s\n\n", relyingPartyID)
+				return source
+			}
+		}
+	}
+	return nil
+}
+
+func (server *CTAPServer) handleGetAssertion(trace util.TraceID, data []byte) []byte {
+	logger := ctapLogger.WithTrace(trace)
 	var flags authDataFlags = 0
 	var args getAssertionArgs
-	err := cbor.Unmarshal(data, &args)
+	err := unmarshalCBOR(data, &args)
 	if err != nil {
-		ctapLogger.Printf("ERROR: %s", err)
-		return []byte{byte(ctap2ErrInvalidCBOR)}
+		logger.Printf("ERROR: %s", err)
+		return []byte{byte(decodeErrorStatus(err))}
+	}
+	logger.Printf("GET ASSERTION: %#v\n\n", args)
+	if status := runChecks(trace, server.getAssertionChecks(trace, args, &flags)); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	if !server.assertionLimiter.Allow(args.RPID) {
+		logger.Printf("ERROR: Too many assertions for %s\n\n", args.RPID)
+		return []byte{byte(ctap2ErrUserActionTimeout)}
 	}
-	ctapLogger.Printf("GET ASSERTION: %#v\n\n", args)
 
-	if server.client.SupportsPIN() {
-		if args.PINUVAuthParam != nil {
-			if args.PINUVAuthProtocol != 1 {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
-			}
-			pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-			if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
-			}
-			flags = flags | authDataFlagUserVerified
+	if (args.Options.UserVerification || server.alwaysUV()) && flags&authDataFlagUserVerified == 0 {
+		status := server.verifyUser(trace)
+		if status != ctap1ErrSuccess {
+			return []byte{byte(status)}
 		}
+		flags = flags | authDataFlagUserVerified
 	}
 
 	credentialSource := server.client.GetAssertionSource(args.RPID, args.AllowList)
-	unsafeCtapLogger.Printf("CREDENTIAL SOURCE: %#v\n\n", credentialSource)
 	if credentialSource == nil {
-		ctapLogger.Printf("ERROR: No Credentials\n\n")
+		credentialSource = server.u2fAssertionSource(trace, args)
+	}
+	unsafeCtapLogger.WithTrace(trace).Printf("CREDENTIAL SOURCE: %#v\n\n", credentialSource)
+	if credentialSource == nil {
+		logger.Printf("ERROR: No Credentials\n\n")
 		return []byte{byte(ctap2ErrNoCredentials)}
 	}
 
-	if args.Options.UserPresence == nil || *args.Options.UserPresence {
-		if !server.client.ApproveAccountLogin(credentialSource) {
-			ctapLogger.Printf("ERROR: Unapproved action (Account login)")
-			return []byte{byte(ctap2ErrOperationDenied)}
+	if credentialSource.Policy == identities.CredentialPolicyRequirePIN && flags&authDataFlagUserVerified == 0 {
+		if !server.supportsUserVerification() {
+			// The platform has to collect the PIN and try again
+			logger.Printf("ERROR: Credential requires user verification\n\n")
+			return []byte{byte(ctap2ErrPINRequired)}
 		}
+		status := server.verifyUser(trace)
+		if status != ctap1ErrSuccess {
+			return []byte{byte(status)}
+		}
+		flags = flags | authDataFlagUserVerified
+	}
+
+	extensions := make(map[string]interface{})
+	display, canDisplay := server.client.(CTAPDisplayClient)
+	if text, ok := args.Extensions[extensionTxAuthSimple].(string); ok && canDisplay {
+		// Confirming the text is the user's approval, so the login isn't asked about as well
+		status := server.askUser(trace, func() bool { return display.DisplayTransaction(text) })
+		if status != ctap1ErrSuccess {
+			logger.Printf("ERROR: Transaction not confirmed\n\n")
+			return []byte{byte(status)}
+		}
+		extensions[extensionTxAuthSimple] = text
 		flags = flags | authDataFlagUserPresent
 	}
 
-	authData := makeAuthData(args.RPID, credentialSource, nil, flags)
+	if (args.Options.UserPresence == nil || *args.Options.UserPresence) && flags&authDataFlagUserPresent == 0 {
+		pinAuthorized := args.PINUVAuthParam != nil && flags&authDataFlagUserVerified != 0
+		status := server.collectUserPresence(trace, pinAuthorized, func() bool { return server.client.ApproveAccountLogin(credentialSource) })
+		if status != ctap1ErrSuccess {
+			logger.Printf("ERROR: Unapproved action (Account login)")
+			return []byte{byte(status)}
+		}
+		flags = flags | authDataFlagUserPresent
+	}
+
+	signatureCounter := int32(server.faults.MaybeStaleCounter(uint32(credentialSource.SignatureCounter)))
+	if requested, ok := args.Extensions[extensionCredBlob].(bool); ok && requested {
+		credBlob := credentialSource.CredBlob
+		if credBlob == nil {
+			credBlob = []byte{}
+		}
+		extensions[extensionCredBlob] = credBlob
+	}
+	// U2F credentials found through the appid extension sign for the AppID rather than the RP ID
+	flags = flags | backupFlags(credentialSource)
+	authData := makeAuthData(credentialSource.RelyingParty.ID, signatureCounter, nil, extensions, flags)
 	signature := credentialSource.PrivateKey.Sign(util.Concat(authData, args.ClientDataHash))
+	signature = server.faults.MaybeCorruptSignature(signature)
 
 	credentialDescriptor := credentialSource.CTAPDescriptor()
 	response := getAssertionResponse{
@@ -372,9 +827,152 @@ func (server *CTAPServer) handleGetAssertion(data []byte) []byte {
 		//NumberOfCredentials: 1,
 	}
 
-	ctapLogger.Printf("GET ASSERTION RESPONSE: %#v\n\n", response)
+	logger.Printf("GET ASSERTION RESPONSE: %#v\n\n", response)
+	events.Publish(events.Event{
+		Type:           events.EventAssertionMade,
+		Protocol:       events.ProtocolCTAP2,
+		RelyingPartyID: credentialSource.RelyingParty.ID,
+		CredentialID:   credentialSource.ID,
+		TraceID:        trace,
+	})
 
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
+}
+
+func (server *CTAPServer) auditAssertion(data []byte, response []byte) {
+	if server.auditor == nil {
+		return
+	}
+	status := ctapStatusCode(response[0])
+	attempt := audit.Attempt{
+		Time:     time.Now(),
+		Protocol: events.ProtocolCTAP2,
+		Origin:   strings.Join(server.transports, ","),
+		Status:   uint16(status),
+	}
+	// Malformed requests are recorded too, with whatever could be decoded
+	var args getAssertionArgs
+	if unmarshalCBOR(data, &args) == nil {
+		attempt.RelyingPartyID = args.RPID
+		attempt.ClientDataHash = args.ClientDataHash
+		for _, descriptor := range args.AllowList {
+			attempt.AllowList = append(attempt.AllowList, descriptor.ID)
+		}
+	}
+	switch status {
+	case ctap1ErrSuccess:
+		attempt.Outcome = audit.OutcomeSuccess
+		var assertion getAssertionResponse
+		if unmarshalCBOR(response[1:], &assertion) == nil && assertion.Credential != nil {
+			attempt.CredentialID = assertion.Credential.ID
+		}
+	case ctap2ErrNoCredentials:
+		attempt.Outcome = audit.OutcomeNoCredentials
+	case ctap2ErrOperationDenied, ctap2ErrUserActionTimeout, ctap2ErrPINAuthInvalid, ctap2ErrPINRequired, ctap2ErrPINBlocked:
+		attempt.Outcome = audit.OutcomeDenied
+	default:
+		attempt.Outcome = audit.OutcomeError
+	}
+	server.auditor.Audit(attempt)
+}
+
+func (server *CTAPServer) handleSelection(trace util.TraceID) []byte {
+	status := server.askUser(trace, server.approveSelection)
+	if status != ctap1ErrSuccess {
+		ctapLogger.WithTrace(trace).Printf("ERROR: Unapproved action (Selection)\n\n")
+	}
+	return []byte{byte(status)}
+}
+
+type credentialMgmtSubcommand uint32
+
+const credentialMgmtSubcommandGetCredsMetadata credentialMgmtSubcommand = 0x01
+
+type credentialMgmtArgs struct {
+	SubCommand        credentialMgmtSubcommand `cbor:"1,keyasint"`
+	PINUVAuthProtocol uint32                   `cbor:"3,keyasint,omitempty"`
+	PINUVAuthParam    []byte                   `cbor:"4,keyasint,omitempty"`
+}
+
+type credentialMgmtMetadataResponse struct {
+	ExistingResidentCredentialsCount uint32 `cbor:"1,keyasint"`
+	// Left out without a limit
+	MaxPossibleRemainingResidentCredentialsCount *uint32 `cbor:"2,keyasint,omitempty"`
+}
+
+// handleCredentialManagement only answers getCredsMetadata, so credMgmt isn't advertised in
+// GetInfo and platforms don't expect to enumerate or delete credentials
+func (server *CTAPServer) handleCredentialManagement(trace util.TraceID, data []byte) []byte {
+	logger := ctapLogger.WithTrace(trace)
+	store, ok := server.client.(CTAPCredentialStoreClient)
+	if !ok {
+		logger.Printf("ERROR: Credential management not supported\n\n")
+		return []byte{byte(ctap1ErrInvalidCommand)}
+	}
+	var args credentialMgmtArgs
+	if err := unmarshalCBOR(data, &args); err != nil {
+		logger.Printf("ERROR: Could not decode CBOR for CREDENTIAL_MGMT: %s %v\n\n", err, data)
+		return []byte{byte(decodeErrorStatus(err))}
+	}
+	if args.SubCommand != credentialMgmtSubcommandGetCredsMetadata {
+		logger.Printf("ERROR: Unsupported credential management subcommand: %d\n\n", args.SubCommand)
+		return []byte{byte(ctap2ErrInvalidSubcommand)}
+	}
+	if args.PINUVAuthParam == nil {
+		return []byte{byte(ctap2ErrPINRequired)}
+	}
+	if args.PINUVAuthProtocol != 1 {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	if !server.client.SupportsPIN() || !server.checkPINAuth(trace, pinPermissionCredentialManagement, "", []byte{byte(args.SubCommand)}, args.PINUVAuthParam) {
+		return []byte{byte(ctap2ErrPINAuthInvalid)}
+	}
+	response := credentialMgmtMetadataResponse{ExistingResidentCredentialsCount: uint32(store.ResidentCredentialCount())}
+	if remaining := store.RemainingResidentCredentials(); remaining >= 0 {
+		count := uint32(remaining)
+		response.MaxPossibleRemainingResidentCredentialsCount = &count
+	}
+	logger.Printf("CREDENTIAL_MGMT METADATA RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
+}
+
+func (server *CTAPServer) verifyUser(trace util.TraceID) ctapStatusCode {
+	if !server.supportsUserVerification() {
+		ctapLogger.WithTrace(trace).Printf("ERROR: User verification requested but not supported\n\n")
+		return ctap2ErrUnsupportedOption
+	}
+	status := server.askUser(trace, server.client.(CTAPUserVerificationClient).VerifyUser)
+	if status != ctap1ErrSuccess {
+		ctapLogger.WithTrace(trace).Printf("ERROR: User verification failed\n\n")
+	}
+	return status
+}
+
+// checkPINAuth checks that pinAuth was made with a PIN token that hasn't expired and has
+// permission, and binds the token to relyingPartyID if it isn't bound yet
+func (server *CTAPServer) checkPINAuth(trace util.TraceID, permission pinPermission, relyingPartyID string, clientDataHash []byte, pinAuth []byte) bool {
+	token := server.pinToken.current()
+	if token == nil {
+		return false
+	}
+	if !hmac.Equal(server.derivePINAuth(token, clientDataHash), pinAuth) {
+		return false
+	}
+	return server.pinToken.use(trace, util.Now(), permission, relyingPartyID, server.timeouts)
+}
+
+// collectUserPresence asks for user presence with approve, unless the user was present for
+// the previous request authorized with the same PIN token within the UserPresence timeout
+func (server *CTAPServer) collectUserPresence(trace util.TraceID, pinAuthorized bool, approve func() bool) ctapStatusCode {
+	if pinAuthorized && server.pinToken.takeUserPresence(util.Now(), server.timeouts) {
+		ctapLogger.WithTrace(trace).Printf("Using user presence collected for the previous request\n\n")
+		return ctap1ErrSuccess
+	}
+	status := server.askUser(trace, approve)
+	if status == ctap1ErrSuccess && pinAuthorized {
+		server.pinToken.recordUserPresence(util.Now())
+	}
+	return status
 }
 
 type clientPINSubcommand uint32
@@ -385,14 +983,19 @@ const (
 	clientPINSubcommandSetPIN          clientPINSubcommand = 3
 	clientPINSubcommandChangePIN       clientPINSubcommand = 4
 	clientPinSubcommandGetPINToken     clientPINSubcommand = 5
+	// CTAP 2.1 subcommands for PIN tokens with permissions
+	clientPINSubcommandGetUVTokenWithPermissions  clientPINSubcommand = 6
+	clientPINSubcommandGetPINTokenWithPermissions clientPINSubcommand = 9
 )
 
 var clientPINSubcommandDescriptions = map[clientPINSubcommand]string{
-	clientPINSubcommandGetRetries:      "clientPINSubcommandGetRetries",
-	clientPinSubcommandGetKeyAgreement: "clientPinSubcommandGetKeyAgreement",
-	clientPINSubcommandSetPIN:          "clientPINSubcommandSetPIN",
-	clientPINSubcommandChangePIN:       "clientPINSubcommandChangePIN",
-	clientPinSubcommandGetPINToken:     "clientPinSubcommandGetPINToken",
+	clientPINSubcommandGetRetries:                 "clientPINSubcommandGetRetries",
+	clientPinSubcommandGetKeyAgreement:            "clientPinSubcommandGetKeyAgreement",
+	clientPINSubcommandSetPIN:                     "clientPINSubcommandSetPIN",
+	clientPINSubcommandChangePIN:                  "clientPINSubcommandChangePIN",
+	clientPinSubcommandGetPINToken:                "clientPinSubcommandGetPINToken",
+	clientPINSubcommandGetUVTokenWithPermissions:  "clientPINSubcommandGetUVTokenWithPermissions",
+	clientPINSubcommandGetPINTokenWithPermissions: "clientPINSubcommandGetPINTokenWithPermissions",
 }
 
 type clientPINArgs struct {
@@ -402,16 +1005,20 @@ type clientPINArgs struct {
 	PINUVAuthParam    []byte              `cbor:"4,keyasint,omitempty"`
 	NewPINEncoding    []byte              `cbor:"5,keyasint,omitempty"`
 	PINHashEncoding   []byte              `cbor:"6,keyasint,omitempty"`
+	Permissions       pinPermission       `cbor:"9,keyasint,omitempty"`
+	RelyingPartyID    string              `cbor:"10,keyasint,omitempty"`
 }
 
 func (args clientPINArgs) String() string {
-	return fmt.Sprintf("ctapClientPINArgs{PinProtocol: %d, SubCommand: %s, KeyAgreement: %v, PINAuth: 0x%s, NewPINEncoding: 0x%s, PINHashEncoding: 0x%s}",
+	return fmt.Sprintf("ctapClientPINArgs{PinProtocol: %d, SubCommand: %s, KeyAgreement: %v, PINAuth: 0x%s, NewPINEncoding: 0x%s, PINHashEncoding: 0x%s, Permissions: %s, RPID: %s}",
 		args.PINUVAuthProtocol,
 		clientPINSubcommandDescriptions[args.SubCommand],
 		args.KeyAgreement,
 		hex.EncodeToString(args.PINUVAuthParam),
 		hex.EncodeToString(args.NewPINEncoding),
-		hex.EncodeToString(args.PINHashEncoding))
+		hex.EncodeToString(args.PINHashEncoding),
+		args.Permissions,
+		args.RelyingPartyID)
 }
 
 type clientPINResponse struct {
@@ -427,9 +1034,14 @@ func (args clientPINResponse) String() string {
 		args.Retries)
 }
 
-func (server *CTAPServer) getPINSharedSecret(remoteKey cose.COSEEC2Key) []byte {
+func (server *CTAPServer) getPINSharedSecret(remoteKey cose.COSEEC2Key) ([]byte, error) {
+	x := util.BytesToBigInt(remoteKey.X)
+	y := util.BytesToBigInt(remoteKey.Y)
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return nil, fmt.Errorf("Key agreement point is not on P-256")
+	}
 	pinKey := server.client.PINKeyAgreement()
-	return crypto.HashSHA256(pinKey.ECDH(util.BytesToBigInt(remoteKey.X), util.BytesToBigInt(remoteKey.Y)))
+	return crypto.HashSHA256(pinKey.ECDH(x, y)), nil
 }
 
 func (server *CTAPServer) derivePINAuth(sharedSecret []byte, data []byte) []byte {
@@ -454,49 +1066,63 @@ func (server *CTAPServer) decryptPIN(sharedSecret []byte, pinEncoding []byte) []
 	return decryptedPIN
 }
 
-func (server *CTAPServer) handleClientPIN(data []byte) []byte {
+// Encrypted PINs are padded to a multiple of the AES block size before encryption
+func validPINEncoding(encoding []byte) bool {
+	return len(encoding) >= 16 && len(encoding)%16 == 0
+}
+
+func (server *CTAPServer) handleClientPIN(trace util.TraceID, data []byte) []byte {
+	logger := ctapLogger.WithTrace(trace)
 	if !server.client.SupportsPIN() {
 		return []byte{byte(ctap1ErrInvalidCommand)}
 	}
 	var args clientPINArgs
-	err := cbor.Unmarshal(data, &args)
+	err := unmarshalCBOR(data, &args)
 	if err != nil {
-		ctapLogger.Printf("ERROR: %s", err)
-		return []byte{byte(ctap2ErrInvalidCBOR)}
+		logger.Printf("ERROR: %s", err)
+		return []byte{byte(decodeErrorStatus(err))}
 	}
 	if args.PINUVAuthProtocol != 1 {
 		return []byte{byte(ctap1ErrInvalidParameter)}
 	}
-	ctapLogger.Printf("CLIENT_PIN: %v\n\n", args)
+	logger.Printf("CLIENT_PIN: %v\n\n", args)
+	if server.readOnly && (args.SubCommand == clientPINSubcommandSetPIN || args.SubCommand == clientPINSubcommandChangePIN) {
+		logger.Printf("ERROR: %s refused in read-only mode\n\n", clientPINSubcommandDescriptions[args.SubCommand])
+		return []byte{byte(ctap2ErrOperationDenied)}
+	}
 	var response []byte
 	switch args.SubCommand {
 	case clientPINSubcommandGetRetries:
-		response = server.handleGetRetries()
+		response = server.handleGetRetries(trace)
 	case clientPinSubcommandGetKeyAgreement:
-		response = server.handleGetKeyAgreement()
+		response = server.handleGetKeyAgreement(trace)
 	case clientPINSubcommandSetPIN:
-		response = server.handleSetPIN(args)
+		response = server.handleSetPIN(trace, args)
 	case clientPINSubcommandChangePIN:
-		response = server.handleChangePIN(args)
+		response = server.handleChangePIN(trace, args)
 	case clientPinSubcommandGetPINToken:
-		response = server.handleGetPINToken(args)
+		response = server.handleGetPINToken(trace, args, legacyPINPermissions, "")
+	case clientPINSubcommandGetPINTokenWithPermissions:
+		response = server.handleGetPINTokenWithPermissions(trace, args)
+	case clientPINSubcommandGetUVTokenWithPermissions:
+		response = server.handleGetUVTokenWithPermissions(trace, args)
 	default:
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
-	ctapLogger.Printf("CLIENT_PIN RESPONSE: %#v\n\n", response)
+	logger.Printf("CLIENT_PIN RESPONSE: %#v\n\n", response)
 	return response
 }
 
-func (server *CTAPServer) handleGetRetries() []byte {
+func (server *CTAPServer) handleGetRetries(trace util.TraceID) []byte {
 	retries := uint8(server.client.PINRetries())
 	response := clientPINResponse{
 		Retries: &retries,
 	}
-	ctapLogger.Printf("CLIENT_PIN_GET_RETRIES: %v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	ctapLogger.WithTrace(trace).Printf("CLIENT_PIN_GET_RETRIES: %v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
 }
 
-func (server *CTAPServer) handleGetKeyAgreement() []byte {
+func (server *CTAPServer) handleGetKeyAgreement(trace util.TraceID) []byte {
 	key := server.client.PINKeyAgreement()
 	response := clientPINResponse{
 		KeyAgreement: &cose.COSEEC2Key{
@@ -506,18 +1132,25 @@ func (server *CTAPServer) handleGetKeyAgreement() []byte {
 			Y:         key.Y.Bytes(),
 		},
 	}
-	ctapLogger.Printf("CLIENT_PIN_GET_KEY_AGREEMENT RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	ctapLogger.WithTrace(trace).Printf("CLIENT_PIN_GET_KEY_AGREEMENT RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
 }
 
-func (server *CTAPServer) handleSetPIN(args clientPINArgs) []byte {
-	if server.client.PINHash() != nil {
+func (server *CTAPServer) handleSetPIN(trace util.TraceID, args clientPINArgs) []byte {
+	if server.pinSet() {
 		return []byte{byte(ctap2ErrPINAuthInvalid)}
 	}
 	if args.KeyAgreement == nil || args.PINUVAuthParam == nil || args.NewPINEncoding == nil {
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
+	if !validPINEncoding(args.NewPINEncoding) {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	sharedSecret, err := server.getPINSharedSecret(*args.KeyAgreement)
+	if err != nil {
+		ctapLogger.WithTrace(trace).Printf("ERROR: %s\n\n", err)
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
 	pinAuth := server.derivePINAuth(sharedSecret, args.NewPINEncoding)
 	if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
 		return []byte{byte(ctap2ErrPINAuthInvalid)}
@@ -529,26 +1162,34 @@ func (server *CTAPServer) handleSetPIN(args clientPINArgs) []byte {
 	pinHash := crypto.HashSHA256(decryptedPIN)[:16]
 	server.client.SetPINRetries(8)
 	server.client.SetPINHash(pinHash)
-	ctapLogger.Printf("SETTING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
+	ctapLogger.WithTrace(trace).Printf("PIN SET\n\n")
 	return []byte{byte(ctap1ErrSuccess)}
 }
 
-func (server *CTAPServer) handleChangePIN(args clientPINArgs) []byte {
-	if args.KeyAgreement == nil || args.PINUVAuthParam == nil {
+func (server *CTAPServer) handleChangePIN(trace util.TraceID, args clientPINArgs) []byte {
+	if args.KeyAgreement == nil || args.PINUVAuthParam == nil || args.NewPINEncoding == nil || args.PINHashEncoding == nil {
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
+	if !validPINEncoding(args.NewPINEncoding) || len(args.PINHashEncoding) != 16 {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
 	if server.client.PINRetries() == 0 {
 		return []byte{byte(ctap2ErrPINBlocked)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
+	sharedSecret, err := server.getPINSharedSecret(*args.KeyAgreement)
+	if err != nil {
+		ctapLogger.WithTrace(trace).Printf("ERROR: %s\n\n", err)
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
 	pinAuth := server.derivePINAuth(sharedSecret, append(args.NewPINEncoding, args.PINHashEncoding...))
 	if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
 		return []byte{byte(ctap2ErrPINAuthInvalid)}
 	}
 	server.client.SetPINRetries(server.client.PINRetries() - 1)
 	decryptedPINHash := crypto.DecryptAESCBC(sharedSecret, args.PINHashEncoding)
-	if !bytes.Equal(server.client.PINHash(), decryptedPINHash) {
+	if !server.checkPINHash(decryptedPINHash) {
 		// TODO: Mismatch detected, handle it
+		events.Publish(events.Event{Type: events.EventPINFailed, PINRetries: server.client.PINRetries(), TraceID: trace})
 		return []byte{byte(ctap2ErrPINInvalid)}
 	}
 	server.client.SetPINRetries(8)
@@ -561,26 +1202,37 @@ func (server *CTAPServer) handleChangePIN(args clientPINArgs) []byte {
 	return []byte{byte(ctap1ErrSuccess)}
 }
 
-func (server *CTAPServer) handleGetPINToken(args clientPINArgs) []byte {
-	if args.PINHashEncoding == nil || args.KeyAgreement.X == nil {
+// handleGetPINToken issues a PIN token with permissions, bound to relyingPartyID if it isn't
+// empty, once the PIN hash is checked
+func (server *CTAPServer) handleGetPINToken(trace util.TraceID, args clientPINArgs, permissions pinPermission, relyingPartyID string) []byte {
+	logger := ctapLogger.WithTrace(trace)
+	if args.PINHashEncoding == nil || args.KeyAgreement == nil || args.KeyAgreement.X == nil {
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
+	if len(args.PINHashEncoding) != 16 {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
 	if server.client.PINRetries() <= 0 {
 		return []byte{byte(ctap2ErrPINBlocked)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
+	sharedSecret, err := server.getPINSharedSecret(*args.KeyAgreement)
+	if err != nil {
+		logger.Printf("ERROR: %s\n\n", err)
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
 	server.client.SetPINRetries(server.client.PINRetries() - 1)
 	pinHash := server.decryptPINHash(sharedSecret, args.PINHashEncoding)
-	ctapLogger.Printf("TRYING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
-	if !bytes.Equal(pinHash, server.client.PINHash()) {
+	if !server.checkPINHash(pinHash) {
 		// TODO: Handle mismatch here by regening the key agreement key
-		ctapLogger.Printf("MISMATCH: Provided PIN %v doesn't match stored PIN %v\n\n", hex.EncodeToString(pinHash), hex.EncodeToString(server.client.PINHash()))
+		logger.Printf("MISMATCH: Provided PIN doesn't match stored PIN\n\n")
+		events.Publish(events.Event{Type: events.EventPINFailed, PINRetries: server.client.PINRetries(), TraceID: trace})
 		return []byte{byte(ctap2ErrPINInvalid)}
 	}
 	server.client.SetPINRetries(8)
+	token := server.pinToken.issueWithPermissions(util.Now(), permissions, relyingPartyID)
 	response := clientPINResponse{
-		PinToken: crypto.EncryptAESCBC(sharedSecret, server.client.PINToken()),
+		PinToken: crypto.EncryptAESCBC(sharedSecret, token),
 	}
-	ctapLogger.Printf("GET_PIN_TOKEN RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	logger.Printf("GET_PIN_TOKEN RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
 }
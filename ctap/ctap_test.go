@@ -2,12 +2,16 @@ package ctap
 
 import (
 	"bytes"
+	"crypto/x509"
 	"testing"
+	"time"
 
+	"github.com/bulwarkid/virtual-fido/audit"
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
 	"github.com/bulwarkid/virtual-fido/identities"
-	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/internal/verifier"
 	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
 	"github.com/fxamacker/cbor/v2"
@@ -15,6 +19,8 @@ import (
 
 type dummyCTAPClient struct {
 	vault identities.IdentityVault
+	// Stand-ins for sealed U2F key handles, matched by ID and RP ID
+	u2fCredentials []*identities.CredentialSource
 }
 func (client *dummyCTAPClient) SupportsResidentKey() bool {
 	return true
@@ -23,6 +29,13 @@ func (client *dummyCTAPClient) SupportsPIN() bool {
 	return false
 }
 
+func (client *dummyCTAPClient) SupportsUserVerification() bool {
+	return false
+}
+func (client *dummyCTAPClient) VerifyUser() bool {
+	return false
+}
+
 func (client *dummyCTAPClient) NewCredentialSource(
 	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
 	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
@@ -40,6 +53,26 @@ func (client *dummyCTAPClient) GetAssertionSource(
 		return nil
 	}
 }
+func (client *dummyCTAPClient) SetCredBlob(credentialSource *identities.CredentialSource, credBlob []byte) {
+	credentialSource.CredBlob = credBlob
+}
+func (client *dummyCTAPClient) HasCredential(relyingPartyID string, id []byte) bool {
+	if source := client.vault.GetIdentity(id); source != nil && source.RelyingParty.ID == relyingPartyID {
+		return true
+	}
+	return client.U2FCredentialSource(relyingPartyID, id) != nil
+}
+func (client *dummyCTAPClient) U2FCredentialSource(relyingPartyID string, keyHandle []byte) *identities.CredentialSource {
+	for _, source := range client.u2fCredentials {
+		if bytes.Equal(source.ID, keyHandle) && source.RelyingParty.ID == relyingPartyID {
+			return source
+		}
+	}
+	return nil
+}
+func (client *dummyCTAPClient) AAGUID() [16]byte {
+	return identities.DefaultAAGUID
+}
 func (client *dummyCTAPClient) CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte {
 	return nil
 }
@@ -55,9 +88,6 @@ func (client *dummyCTAPClient) SetPINRetries(retries int32) {}
 func (client *dummyCTAPClient) PINKeyAgreement() *crypto.ECDHKey {
 	return nil
 }
-func (client *dummyCTAPClient) PINToken() []byte {
-	return nil
-}
 
 func (client *dummyCTAPClient) ApproveAccountCreation(relyingParty string) bool {
 	return true
@@ -65,13 +95,16 @@ func (client *dummyCTAPClient) ApproveAccountCreation(relyingParty string) bool
 func (client *dummyCTAPClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
 	return true
 }
+func (client *dummyCTAPClient) ApproveSelection() bool {
+	return true
+}
 
 func TestMakeCredential(t *testing.T) {
 	client := &dummyCTAPClient{}
 	ctap := NewCTAPServer(client)
 
 	args := makeCredentialArgs{
-		ClientDataHash: []byte{},
+		ClientDataHash: crypto.HashSHA256([]byte{0,1,2,3,4}),
 		RP: &webauthn.PublicKeyCredentialRPEntity{
 			ID: "example.com",
 			Name: "Example",
@@ -149,6 +182,126 @@ func TestGetAssertion(t *testing.T) {
 	test.Assert(t, bytes.Equal(response.Credential.ID, identity.ID), "Did not return correct identity")
 }
 
+func TestCredBlob(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	makeCredential := func(credBlob []byte) ([]byte, map[string]bool) {
+		args := makeCredentialArgs{
+			ClientDataHash:   crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+			User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{0, 1, 2, 3, 4}, Name: "Alice"},
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			Extensions:       map[string]interface{}{"credBlob": credBlob},
+		}
+		responseBytes := ctap.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "MakeCredential failed")
+		var response makeCredentialResponse
+		util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode response")
+		test.Assert(t, response.AuthData[32]&byte(authDataFlagExtensionDataIncluded) != 0, "Extension data flag not set")
+		// Attested credential data is followed by the extension map
+		idLength := int(response.AuthData[53])<<8 | int(response.AuthData[54])
+		id := response.AuthData[55 : 55+idLength]
+		decoder := cbor.NewDecoder(bytes.NewReader(response.AuthData[55+idLength:]))
+		var publicKey interface{}
+		util.CheckErr(decoder.Decode(&publicKey), "Could not decode public key")
+		var extensions map[string]bool
+		util.CheckErr(decoder.Decode(&extensions), "Could not decode extensions")
+		return id, extensions
+	}
+
+	blob := []byte("device-bound metadata")
+	id, extensions := makeCredential(blob)
+	test.Assert(t, extensions["credBlob"], "credBlob was not stored")
+	_, extensions = makeCredential(make([]byte, maxCredBlobLength+1))
+	test.Assert(t, !extensions["credBlob"], "Oversized credBlob was stored")
+
+	args := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: id}},
+		Extensions:     map[string]interface{}{"credBlob": true},
+	}
+	responseBytes := ctap.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "GetAssertion failed")
+	var response getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode response")
+	var assertionExtensions map[string][]byte
+	util.CheckErr(cbor.Unmarshal(response.AuthenticatorData[37:], &assertionExtensions), "Could not decode extensions")
+	test.Assert(t, bytes.Equal(assertionExtensions["credBlob"], blob), "Wrong credBlob returned")
+}
+
+func TestAppIDExtensions(t *testing.T) {
+	appID := "https://rp/appid.json"
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	u2fCredential := &identities.CredentialSource{
+		Type:         "public-key",
+		ID:           []byte("u2f key handle"),
+		PrivateKey:   &cose.SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()},
+		RelyingParty: &webauthn.PublicKeyCredentialRPEntity{ID: appID, Name: appID},
+		User:         &webauthn.PublicKeyCrendentialUserEntity{},
+	}
+	client.u2fCredentials = append(client.u2fCredentials, u2fCredential)
+	descriptors := []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: u2fCredential.ID}}
+
+	getAssertion := func(extensions map[string]interface{}) []byte {
+		args := getAssertionArgs{
+			RPID:           "rp",
+			ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			AllowList:      descriptors,
+			Extensions:     extensions,
+		}
+		return ctap.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	}
+	responseBytes := getAssertion(nil)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNoCredentials, "U2F credential matched without appid")
+	responseBytes = getAssertion(map[string]interface{}{"appid": appID})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "U2F credential not found with appid")
+	var response getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode response")
+	test.Assert(t, bytes.Equal(response.AuthenticatorData[:32], crypto.HashSHA256([]byte(appID))), "Assertion not signed for the appid")
+
+	makeCredential := func(extensions map[string]interface{}) ctapStatusCode {
+		args := makeCredentialArgs{
+			ClientDataHash:   crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+			User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{0, 1, 2, 3, 4}, Name: "Alice"},
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			ExcludeList:      descriptors,
+			Extensions:       extensions,
+		}
+		return ctapStatusCode(ctap.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))[0])
+	}
+	test.AssertEqual(t, makeCredential(map[string]interface{}{"appidExclude": appID}), ctap2ErrCredentialExcluded, "U2F credential not excluded")
+	test.AssertEqual(t, makeCredential(map[string]interface{}{"appidExclude": "https://other/appid.json"}), ctap1ErrSuccess, "Credential excluded for another appid")
+}
+
+func TestBackupFlags(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"}, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{0, 1, 2, 3, 4}, Name: "Alice"})
+	getAssertionFlags := func() authDataFlags {
+		args := getAssertionArgs{
+			RPID:           "rp",
+			ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: identity.ID}},
+		}
+		responseBytes := ctap.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "GetAssertion failed")
+		var response getAssertionResponse
+		util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode response")
+		return authDataFlags(response.AuthenticatorData[32]) & (authDataFlagBackupEligible | authDataFlagBackedUp)
+	}
+
+	test.AssertEqual(t, getAssertionFlags(), authDataFlags(0), "Device-bound credential should have neither flag")
+	identity.BackedUp = true
+	test.AssertEqual(t, getAssertionFlags(), authDataFlags(0), "BS should not be set without BE")
+	identity.BackupEligible = true
+	test.AssertEqual(t, getAssertionFlags(), authDataFlagBackupEligible|authDataFlagBackedUp, "Backed up passkey should have both flags")
+	identity.BackedUp = false
+	test.AssertEqual(t, getAssertionFlags(), authDataFlagBackupEligible, "Passkey that isn't backed up should only have BE")
+}
+
 func TestGetInfo(t *testing.T) {
 	client := &dummyCTAPClient{}
 	ctap := NewCTAPServer(client)
@@ -164,4 +317,505 @@ func TestGetInfo(t *testing.T) {
 	test.Assert(t, !bytes.Equal(make([]byte,16), response.AAGUID[:]), "AAGUID is empty")
 	test.Assert(t, response.Options.CanResidentKey, "Cant use resident keys")
 	test.Assert(t, !response.Options.IsPlatform, "Is not marked a non-platform auth")
-}
\ No newline at end of file
+	test.AssertContains(t, response.Extensions, "credBlob", "credBlob not advertised")
+	test.AssertEqual(t, response.MaxCredBlobLength, uint32(maxCredBlobLength), "Wrong maxCredBlobLength")
+	test.AssertEqual(t, response.MaxMessageSize, uint32(defaultMaxMessageSize), "Wrong maxMsgSize")
+	test.AssertContains(t, response.Transports, "usb", "USB transport not advertised")
+	test.Assert(t, response.Options.HasClientPIN == nil, "Client PIN advertised without PIN support")
+	test.Assert(t, response.Options.CanUserVerification == nil, "uv advertised without user verification")
+
+	pinResponseBytes := NewCTAPServer(newDummyPINCTAPClient()).HandleMessage(argBytes)
+	var pinResponse getInfoResponse
+	util.CheckErr(cbor.Unmarshal(pinResponseBytes[1:], &pinResponse), "Could not decode response")
+	test.Assert(t, pinResponse.Options.HasClientPIN != nil && !*pinResponse.Options.HasClientPIN, "Unset PIN should be advertised as false")
+	test.AssertContains(t, pinResponse.PINUVAuthProtocols, uint32(1), "PIN protocol 1 not advertised")
+}
+func TestMalformedMessages(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	checkStatus := func(message []byte, expected ctapStatusCode, description string) {
+		responseBytes := ctap.HandleMessage(message)
+		test.AssertNotNil(t, responseBytes, "Response is nil")
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), expected, description)
+	}
+	checkStatus([]byte{}, ctap1ErrInvalidLength, "Empty message accepted")
+	checkStatus([]byte{0x55}, ctap1ErrInvalidCommand, "Unknown command accepted")
+	checkStatus(make([]byte, defaultMaxMessageSize+1), ctap1ErrInvalidLength, "Message larger than maxMsgSize accepted")
+	checkStatus([]byte{byte(ctapCommandSelection)}, ctap1ErrSuccess, "Selection rejected")
+	checkStatus([]byte{byte(ctapCommandMakeCredential), 0xFF, 0x00}, ctap2ErrInvalidCBOR, "Invalid CBOR accepted for MakeCredential")
+	checkStatus([]byte{byte(ctapCommandGetAssertion), 0xFF, 0x00}, ctap2ErrInvalidCBOR, "Invalid CBOR accepted for GetAssertion")
+	missingRP := makeCredentialArgs{ClientDataHash: []byte{1}}
+	checkStatus(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(missingRP)), ctap2ErrMissingParam, "MakeCredential without RP accepted")
+	missingRPID := getAssertionArgs{ClientDataHash: []byte{1}}
+	checkStatus(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(missingRPID)), ctap2ErrMissingParam, "GetAssertion without RP ID accepted")
+}
+
+type dummyPINCTAPClient struct {
+	dummyCTAPClient
+	pinKeyAgreement *crypto.ECDHKey
+	pinHash         []byte
+	pinRetries      int32
+}
+
+func (client *dummyPINCTAPClient) SupportsPIN() bool {
+	return true
+}
+func (client *dummyPINCTAPClient) PINHash() []byte {
+	return client.pinHash
+}
+func (client *dummyPINCTAPClient) SetPINHash(pin []byte) {
+	client.pinHash = pin
+}
+func (client *dummyPINCTAPClient) PINRetries() int32 {
+	return client.pinRetries
+}
+func (client *dummyPINCTAPClient) SetPINRetries(retries int32) {
+	client.pinRetries = retries
+}
+func (client *dummyPINCTAPClient) PINKeyAgreement() *crypto.ECDHKey {
+	return client.pinKeyAgreement
+}
+
+func newDummyPINCTAPClient() *dummyPINCTAPClient {
+	return &dummyPINCTAPClient{
+		pinKeyAgreement: crypto.GenerateECDHKey(),
+		pinRetries:      8,
+	}
+}
+
+// featureCTAPClient is a dummyPINCTAPClient with the optional client interfaces, all off
+// until a test turns them on
+type featureCTAPClient struct {
+	dummyPINCTAPClient
+	alwaysUV      bool
+	intermediates [][]byte
+	apple         bool
+	androidFormat string
+	description   identities.AndroidKeyDescription
+}
+
+func newFeatureCTAPClient() *featureCTAPClient {
+	return &featureCTAPClient{dummyPINCTAPClient: *newDummyPINCTAPClient()}
+}
+
+func (client *featureCTAPClient) AlwaysUV() bool {
+	return client.alwaysUV
+}
+func (client *featureCTAPClient) SetAlwaysUV(enabled bool) {
+	client.alwaysUV = enabled
+}
+
+func (client *featureCTAPClient) AttestationIntermediates() [][]byte {
+	return client.intermediates
+}
+
+func (client *featureCTAPClient) AppleAttestation() bool {
+	return client.apple
+}
+
+// newTestCA returns a throwaway attestation CA and its key
+func newTestCA() (*x509.Certificate, *cose.SupportedCOSEPrivateKey) {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	util.CheckErr(err, "Could not create CA private key")
+	ca, err := identities.CreateSelfSignedCA(caPrivateKey)
+	util.CheckErr(err, "Could not create CA")
+	return ca, caPrivateKey
+}
+
+func (client *featureCTAPClient) CreateAppleAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, nonce []byte) []byte {
+	ca, caPrivateKey := newTestCA()
+	cert, err := identities.CreateAppleAttestationCertificate(ca, caPrivateKey, privateKey, nonce)
+	util.CheckErr(err, "Could not create certificate")
+	return cert.Raw
+}
+
+func (client *featureCTAPClient) AndroidAttestation() string {
+	return client.androidFormat
+}
+
+func (client *featureCTAPClient) CreateAndroidKeyAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, challenge []byte) []byte {
+	ca, caPrivateKey := newTestCA()
+	cert, err := identities.CreateAndroidKeyAttestationCertificate(ca, caPrivateKey, privateKey, client.description, challenge)
+	util.CheckErr(err, "Could not create certificate")
+	return cert.Raw
+}
+
+func (client *featureCTAPClient) CreateSafetyNetResponse(nonce []byte) []byte {
+	ca, caPrivateKey := newTestCA()
+	response, err := identities.CreateSafetyNetResponse(ca, caPrivateKey, nil, nonce)
+	util.CheckErr(err, "Could not create SafetyNet response")
+	return response
+}
+
+func TestReadOnly(t *testing.T) {
+	client := newDummyPINCTAPClient()
+	server := NewCTAPServer(client)
+	server.SetReadOnly(true)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice", DisplayName: "Alice"})
+
+	makeCredential := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "rp", "name": "rp"},
+		3: map[string]interface{}{"id": []byte{2}, "name": "Bob", "displayName": "Bob"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredential)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrOperationDenied, "MakeCredential should be refused")
+
+	setPIN := clientPINArgs{PINUVAuthProtocol: 1, SubCommand: clientPINSubcommandSetPIN}
+	response = server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(setPIN)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrOperationDenied, "Setting the PIN should be refused")
+	getRetries := clientPINArgs{PINUVAuthProtocol: 1, SubCommand: clientPINSubcommandGetRetries}
+	response = server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(getRetries)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Reading the PIN retries should work")
+
+	getAssertion := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte("client data")),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: identity.ID}},
+	}
+	response = server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertion)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "GetAssertion should work")
+}
+
+type recordingAuditor struct {
+	attempts []audit.Attempt
+}
+
+func (auditor *recordingAuditor) Audit(attempt audit.Attempt) {
+	auditor.attempts = append(auditor.attempts, attempt)
+}
+
+type displayCTAPClient struct {
+	dummyCTAPClient
+	confirm   bool
+	displayed []string
+}
+
+func (client *displayCTAPClient) DisplayTransaction(text string) bool {
+	client.displayed = append(client.displayed, text)
+	return client.confirm
+}
+
+func TestTxAuthSimple(t *testing.T) {
+	client := &displayCTAPClient{confirm: true}
+	server := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice", DisplayName: "Alice"})
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode info")
+	test.AssertContains(t, info.Extensions, "txAuthSimple", "txAuthSimple not advertised")
+
+	text := "Send 100 EUR to Bob?"
+	args := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: identity.ID}},
+		Extensions:     map[string]interface{}{"txAuthSimple": text},
+	}
+	request := util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args))
+	responseBytes := server.HandleMessage(request)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "GetAssertion failed")
+	test.AssertArrEqual(t, client.displayed, []string{text}, "Transaction should be displayed")
+	var response getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode response")
+	test.Assert(t, response.AuthenticatorData[32]&byte(authDataFlagUserPresent) != 0, "Confirming should count as user presence")
+	var extensions map[string]string
+	util.CheckErr(cbor.Unmarshal(response.AuthenticatorData[37:], &extensions), "Could not decode extensions")
+	test.AssertEqual(t, extensions["txAuthSimple"], text, "Displayed text should be returned")
+
+	client.confirm = false
+	responseBytes = server.HandleMessage(request)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrOperationDenied, "Unconfirmed transaction should be denied")
+}
+
+func TestAuditAssertion(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	auditor := &recordingAuditor{}
+	server.SetAuditor(auditor)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice", DisplayName: "Alice"})
+
+	clientDataHash := crypto.HashSHA256([]byte("client data"))
+	for _, rpID := range []string{"rp", "other"} {
+		args := getAssertionArgs{
+			RPID:           rpID,
+			ClientDataHash: clientDataHash,
+			AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: identity.ID}},
+		}
+		server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	}
+	test.AssertEqual(t, len(auditor.attempts), 2, "Every assertion attempt should be audited")
+	success := auditor.attempts[0]
+	test.AssertEqual(t, success.Outcome, audit.OutcomeSuccess, "First attempt should succeed")
+	test.AssertEqual(t, success.RelyingPartyID, "rp", "Attempt should have the RP ID")
+	test.AssertArrEqual(t, success.ClientDataHash, clientDataHash, "Attempt should have the client data hash")
+	test.AssertArrEqual(t, success.CredentialID, identity.ID, "Attempt should have the credential used")
+	test.AssertEqual(t, success.Origin, "usb", "Attempt should have the transport")
+	failure := auditor.attempts[1]
+	test.AssertEqual(t, failure.Outcome, audit.OutcomeNoCredentials, "Second attempt should find no credentials")
+	test.AssertArrEqual(t, failure.AllowList[0], identity.ID, "Attempt should have the allow list")
+}
+
+func FuzzCTAPMessage(f *testing.F) {
+	f.Add([]byte{byte(ctapCommandGetInfo)})
+	f.Add(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertionArgs{RPID: "rp", ClientDataHash: []byte{1}})))
+	f.Add(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(clientPINArgs{PINUVAuthProtocol: 1, SubCommand: clientPINSubcommandGetRetries})))
+	invalidKey := cose.COSEEC2Key{X: []byte{1}, Y: []byte{2}}
+	f.Add(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(clientPINArgs{PINUVAuthProtocol: 1, SubCommand: clientPinSubcommandGetPINToken, KeyAgreement: &invalidKey, PINHashEncoding: make([]byte, 16)})))
+	f.Add(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredentialArgs{
+		ClientDataHash:   []byte{1},
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+	})))
+	f.Fuzz(func(t *testing.T, message []byte) {
+		for _, client := range []CTAPClient{&dummyCTAPClient{}, newDummyPINCTAPClient()} {
+			response := NewCTAPServer(client).HandleMessage(message)
+			if len(response) == 0 {
+				t.Fatalf("Empty CTAP response")
+			}
+		}
+	})
+}
+
+// storeCTAPClient has room for max credentials in its vault
+type storeCTAPClient struct {
+	dummyPINCTAPClient
+	max int
+}
+
+func (client *storeCTAPClient) CanStoreCredential(residentKey bool, relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	return len(client.vault.CredentialSources) < client.max
+}
+func (client *storeCTAPClient) ResidentCredentialCount() int {
+	return len(client.vault.CredentialSources)
+}
+func (client *storeCTAPClient) RemainingResidentCredentials() int {
+	return client.max - len(client.vault.CredentialSources)
+}
+
+func TestKeyStoreFull(t *testing.T) {
+	client := &storeCTAPClient{dummyPINCTAPClient: *newDummyPINCTAPClient(), max: 1}
+	server := NewCTAPServer(client)
+	getInfo := func() getInfoResponse {
+		var response getInfoResponse
+		util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &response), "Could not decode response")
+		return response
+	}
+	test.Assert(t, getInfo().RemainingDiscoverableCredentials != nil, "Remaining credentials should be advertised")
+	test.AssertEqual(t, *getInfo().RemainingDiscoverableCredentials, uint32(1), "Wrong remaining credentials")
+
+	makeCredential := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "rp", "name": "rp"},
+		3: map[string]interface{}{"id": []byte{1}, "name": "Alice", "displayName": "Alice"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+		7: map[string]bool{"rk": true},
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredential)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "First credential should fit")
+	test.AssertEqual(t, *getInfo().RemainingDiscoverableCredentials, uint32(0), "Store should be full")
+	makeCredential[3] = map[string]interface{}{"id": []byte{2}, "name": "Bob", "displayName": "Bob"}
+	response = server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredential)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrKeyStoreFull, "Second credential shouldn't fit")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 1, "Refused credential shouldn't be stored")
+
+	getMetadata := func(pinAuth []byte) []byte {
+		args := credentialMgmtArgs{SubCommand: credentialMgmtSubcommandGetCredsMetadata, PINUVAuthProtocol: 1, PINUVAuthParam: pinAuth}
+		return server.HandleMessage(util.Concat([]byte{byte(ctapCommandCredentialMgmt)}, util.MarshalCBOR(args)))
+	}
+	response = getMetadata(nil)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrPINRequired, "Metadata should need a PIN token")
+	server.pinToken.issueWithPermissions(util.Now(), pinPermissionCredentialManagement, "")
+	response = getMetadata(make([]byte, 16))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrPINAuthInvalid, "Wrong pinUvAuthParam should be refused")
+	response = getMetadata(server.derivePINAuth(server.pinToken.current(), []byte{byte(credentialMgmtSubcommandGetCredsMetadata)}))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Could not get metadata")
+	var metadata credentialMgmtMetadataResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &metadata), "Could not decode metadata")
+	test.AssertEqual(t, metadata.ExistingResidentCredentialsCount, uint32(1), "Wrong credential count")
+	test.Assert(t, metadata.MaxPossibleRemainingResidentCredentialsCount != nil, "Remaining credentials should be reported")
+	test.AssertEqual(t, *metadata.MaxPossibleRemainingResidentCredentialsCount, uint32(0), "Wrong remaining credentials")
+
+	args := credentialMgmtArgs{SubCommand: 0x02, PINUVAuthProtocol: 1, PINUVAuthParam: make([]byte, 16)}
+	response = server.HandleMessage(util.Concat([]byte{byte(ctapCommandCredentialMgmt)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrInvalidSubcommand, "Only metadata is supported")
+	response = NewCTAPServer(&dummyCTAPClient{}).HandleMessage(util.Concat([]byte{byte(ctapCommandCredentialMgmt)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrInvalidCommand, "Credential management needs a credential store")
+}
+
+func TestAssertionRateLimit(t *testing.T) {
+	client := newDummyPINCTAPClient()
+	client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice", DisplayName: "Alice"})
+	server := NewCTAPServer(client)
+	server.SetAssertionRateLimit(util.RateLimit{Requests: 1, Per: time.Hour})
+	checkStatus := func(message []byte, expected ctapStatusCode, description string) {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), expected, description)
+	}
+	checkStatus(getAssertionMessage(nil), ctap1ErrSuccess, "The first assertion should be allowed")
+	checkStatus(getAssertionMessage(nil), ctap2ErrUserActionTimeout, "Assertions past the limit should be refused")
+	checkStatus(getAssertionMessage(map[int]interface{}{5: map[string]bool{"rk": true}}), ctap2ErrInvalidOption, "Invalid requests should fail their checks before the limit")
+	checkStatus(getAssertionMessage(map[int]interface{}{1: "other"}), ctap2ErrNoCredentials, "Other RPs should have their own limit")
+	checkStatus(makeCredentialMessage(nil), ctap1ErrSuccess, "MakeCredential shouldn't be limited")
+}
+
+func decodedGetInfo(t *testing.T, server *CTAPServer) getInfoResponse {
+	response := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "GetInfo should succeed")
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &info), "Could not decode response")
+	return info
+}
+
+func TestToggleAlwaysUV(t *testing.T) {
+	client := newFeatureCTAPClient()
+	client.pinHash = []byte{1}
+	server := NewCTAPServer(client)
+	toggle := func(pinAuth []byte) ctapStatusCode {
+		args := map[int]interface{}{1: uint32(configSubcommandToggleAlwaysUV)}
+		if pinAuth != nil {
+			args[3] = 1
+			args[4] = pinAuth
+		}
+		return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(args)))[0])
+	}
+	message := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandConfig), byte(configSubcommandToggleAlwaysUV)})
+
+	test.AssertEqual(t, toggle(nil), ctap2ErrPINRequired, "Toggling should need the PIN once set")
+	test.AssertEqual(t, toggle(server.derivePINAuth(crypto.RandomBytes(pinTokenLength), message)), ctap2ErrPINAuthInvalid, "Toggling should need a PIN token")
+	pinAuth := server.derivePINAuth(server.pinToken.issueWithPermissions(util.Now(), pinPermissionAuthenticatorConfig, ""), message)
+	test.AssertEqual(t, toggle([]byte{1}), ctap2ErrPINAuthInvalid, "Wrong pinAuth")
+	test.AssertEqual(t, toggle(pinAuth), ctap1ErrSuccess, "Toggling should succeed")
+	test.Assert(t, client.alwaysUV, "alwaysUv should be on")
+
+	info := decodedGetInfo(t, server)
+	test.Assert(t, info.Options.AlwaysUV != nil && *info.Options.AlwaysUV, "alwaysUv should be reported")
+	test.Assert(t, info.Options.AuthenticatorConfig != nil && *info.Options.AuthenticatorConfig, "authnrCfg should be reported")
+	test.AssertArrEqual(t, info.Versions, []string{"FIDO_2_0"}, "U2F should be turned off")
+
+	test.AssertEqual(t, toggle(pinAuth), ctap1ErrSuccess, "Toggling should succeed")
+	test.Assert(t, !client.alwaysUV, "alwaysUv should be off")
+	server.SetReadOnly(true)
+	test.AssertEqual(t, toggle(pinAuth), ctap2ErrOperationDenied, "Toggling should be refused in read-only mode")
+}
+
+func TestAlwaysUV(t *testing.T) {
+	client := newFeatureCTAPClient()
+	client.alwaysUV = true
+	server := NewCTAPServer(client)
+	checkStatus := func(message []byte, expected ctapStatusCode, description string) {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), expected, description)
+	}
+	checkStatus(makeCredentialMessage(nil), ctap2ErrNoPINSet, "alwaysUv without a PIN")
+	checkStatus(getAssertionMessage(nil), ctap2ErrNoPINSet, "alwaysUv without a PIN")
+	client.pinHash = []byte{1}
+	checkStatus(makeCredentialMessage(nil), ctap2ErrPINRequired, "alwaysUv should need the PIN")
+	checkStatus(getAssertionMessage(nil), ctap2ErrPINRequired, "alwaysUv should need the PIN")
+	checkStatus(makeCredentialMessage(map[int]interface{}{7: map[string]bool{"up": false}}), ctap2ErrInvalidOption, "Options go before alwaysUv")
+
+	pinAuth := server.derivePINAuth(server.pinToken.issue(util.Now()), crypto.HashSHA256([]byte("client data")))
+	checkStatus(makeCredentialMessage(map[int]interface{}{8: pinAuth, 9: 1}), ctap1ErrSuccess, "The PIN should verify the user")
+}
+
+func TestMakeCredUVNotRequired(t *testing.T) {
+	client := newFeatureCTAPClient()
+	client.pinHash = []byte{1}
+	server := NewCTAPServer(client)
+	checkStatus := func(message []byte, expected ctapStatusCode, description string) {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), expected, description)
+	}
+	test.Assert(t, decodedGetInfo(t, server).Options.MakeCredUVNotRequired == nil, "makeCredUvNotRqd should only be reported once set")
+	checkStatus(makeCredentialMessage(nil), ctap2ErrPINRequired, "The PIN should be required by default")
+
+	server.SetMakeCredUVNotRequired(true)
+	info := decodedGetInfo(t, server)
+	test.Assert(t, info.Options.MakeCredUVNotRequired != nil && *info.Options.MakeCredUVNotRequired, "makeCredUvNotRqd should be reported")
+	checkStatus(makeCredentialMessage(nil), ctap1ErrSuccess, "Non-resident credentials shouldn't need the PIN")
+	checkStatus(makeCredentialMessage(map[int]interface{}{7: map[string]bool{"rk": true}}), ctap2ErrPINRequired, "Resident credentials should need the PIN")
+
+	client.alwaysUV = true
+	info = decodedGetInfo(t, server)
+	test.Assert(t, info.Options.MakeCredUVNotRequired != nil && !*info.Options.MakeCredUVNotRequired, "alwaysUv should override makeCredUvNotRqd")
+	checkStatus(makeCredentialMessage(nil), ctap2ErrPINRequired, "alwaysUv should need the PIN")
+}
+
+func TestAttestationIntermediates(t *testing.T) {
+	client := newFeatureCTAPClient()
+	client.intermediates = [][]byte{{1}, {2}}
+	server := NewCTAPServer(client)
+	response := server.HandleMessage(makeCredentialMessage(nil))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Could not make credential")
+	var decoded makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode response")
+	x5c := decoded.AttestationStatement.X5c
+	test.AssertEqual(t, len(x5c), 3, "x5c should hold the attestation certificate and intermediates")
+	test.AssertArrEqual(t, x5c[1], []byte{1}, "Wrong intermediate")
+	test.AssertArrEqual(t, x5c[2], []byte{2}, "Wrong intermediate")
+}
+
+func TestAppleAttestation(t *testing.T) {
+	// Keeps the credential keys the same, so the verifier sees the same P-256 coordinates
+	crypto.SetRandom(crypto.NewSeededRandom([]byte("apple attestation")))
+	defer crypto.SetRandom(nil)
+	client := newFeatureCTAPClient()
+	client.apple = true
+	server := NewCTAPServer(client)
+	makeCredential := func() []byte {
+		response := server.HandleMessage(makeCredentialMessage(nil))
+		test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Could not make credential")
+		return response[1:]
+	}
+	format := func(response []byte) string {
+		var decoded makeCredentialResponse
+		util.CheckErr(cbor.Unmarshal(response, &decoded), "Could not decode response")
+		return decoded.FormatIdentifer
+	}
+	response := makeCredential()
+	test.AssertEqual(t, format(response), "apple", "Apple attestation should be used")
+	if _, _, err := verifier.VerifyRegistration(response, "rp", crypto.HashSHA256([]byte("client data"))); err != nil {
+		t.Fatalf("Apple attestation should verify: %s", err)
+	}
+	server.SetConformanceMode(true)
+	test.AssertEqual(t, format(makeCredential()), "packed", "Conformance mode should keep packed attestation")
+	server.SetConformanceMode(false)
+	client.apple = false
+	test.AssertEqual(t, format(makeCredential()), "packed", "Packed attestation should be used once Apple attestation is off")
+}
+
+func TestAndroidAttestation(t *testing.T) {
+	// Keeps the credential keys the same, so the verifier sees the same P-256 coordinates
+	crypto.SetRandom(crypto.NewSeededRandom([]byte("android attestation")))
+	defer crypto.SetRandom(nil)
+	client := newFeatureCTAPClient()
+	client.description = identities.DefaultAndroidKeyDescription()
+	server := NewCTAPServer(client)
+	register := func() (string, error) {
+		response := server.HandleMessage(makeCredentialMessage(nil))
+		test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Could not make credential")
+		var decoded makeCredentialResponse
+		util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode response")
+		_, _, err := verifier.VerifyRegistration(response[1:], "rp", crypto.HashSHA256([]byte("client data")))
+		return decoded.FormatIdentifer, err
+	}
+
+	for _, format := range []string{attestationFormatAndroidKey, attestationFormatAndroidSafetyNet} {
+		client.androidFormat = format
+		used, err := register()
+		test.AssertEqual(t, used, format, "Wrong attestation format")
+		if err != nil {
+			t.Fatalf("%s attestation should verify: %s", format, err)
+		}
+	}
+
+	client.androidFormat = attestationFormatAndroidKey
+	client.description.SoftwareEnforced = true
+	_, err := register()
+	test.Assert(t, err == nil, "Software-enforced keys should verify")
+	client.description.AllApplications = true
+	_, err = register()
+	test.Assert(t, err != nil, "Keys for all applications should be refused")
+}
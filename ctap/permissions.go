@@ -0,0 +1,110 @@
+package ctap
+
+import (
+	"strings"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// pinPermission is a set of the CTAP 2.1 pinUvAuthToken permissions, which limit the
+// commands a PIN token can authorize
+type pinPermission uint32
+
+const (
+	pinPermissionMakeCredential       pinPermission = 0x01
+	pinPermissionGetAssertion         pinPermission = 0x02
+	pinPermissionCredentialManagement pinPermission = 0x04
+	pinPermissionBioEnrollment        pinPermission = 0x08
+	pinPermissionLargeBlobWrite       pinPermission = 0x10
+	pinPermissionAuthenticatorConfig  pinPermission = 0x20
+)
+
+// Tokens from getPINToken can only be used for MakeCredential and GetAssertion, as in CTAP 2.1
+const legacyPINPermissions = pinPermissionMakeCredential | pinPermissionGetAssertion
+
+var pinPermissionNames = []struct {
+	permission pinPermission
+	name       string
+}{
+	{pinPermissionMakeCredential, "mc"},
+	{pinPermissionGetAssertion, "ga"},
+	{pinPermissionCredentialManagement, "cm"},
+	{pinPermissionBioEnrollment, "be"},
+	{pinPermissionLargeBlobWrite, "lbw"},
+	{pinPermissionAuthenticatorConfig, "acfg"},
+}
+
+func (permissions pinPermission) String() string {
+	names := []string{}
+	for _, permission := range pinPermissionNames {
+		if permissions&permission.permission != 0 {
+			names = append(names, permission.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// supportedPINPermissions are the permissions the client has commands for. Bio enrollment
+// and large blobs aren't implemented.
+func (server *CTAPServer) supportedPINPermissions() pinPermission {
+	permissions := pinPermissionMakeCredential | pinPermissionGetAssertion
+	if _, ok := server.client.(CTAPCredentialStoreClient); ok {
+		permissions |= pinPermissionCredentialManagement
+	}
+	if _, ok := server.client.(CTAPAlwaysUVClient); ok {
+		permissions |= pinPermissionAuthenticatorConfig
+	}
+	return permissions
+}
+
+// checkPINPermissions checks the permissions and RP ID of a request for a PIN token
+func (server *CTAPServer) checkPINPermissions(trace util.TraceID, args clientPINArgs) ctapStatusCode {
+	if args.Permissions == 0 {
+		return ctap2ErrMissingParam
+	}
+	if unsupported := args.Permissions &^ server.supportedPINPermissions(); unsupported != 0 {
+		ctapLogger.WithTrace(trace).Printf("ERROR: Unsupported PIN token permissions %s\n\n", unsupported)
+		return ctap2ErrUnauthorizedPermission
+	}
+	if args.Permissions&legacyPINPermissions != 0 && args.RelyingPartyID == "" {
+		return ctap2ErrMissingParam
+	}
+	return ctap1ErrSuccess
+}
+
+func (server *CTAPServer) handleGetPINTokenWithPermissions(trace util.TraceID, args clientPINArgs) []byte {
+	if status := server.checkPINPermissions(trace, args); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	return server.handleGetPINToken(trace, args, args.Permissions, args.RelyingPartyID)
+}
+
+// handleGetUVTokenWithPermissions issues a PIN token after built-in user verification
+func (server *CTAPServer) handleGetUVTokenWithPermissions(trace util.TraceID, args clientPINArgs) []byte {
+	logger := ctapLogger.WithTrace(trace)
+	if !server.supportsUserVerification() {
+		logger.Printf("ERROR: Built-in user verification not supported\n\n")
+		return []byte{byte(ctap2ErrInvalidSubcommand)}
+	}
+	if args.KeyAgreement == nil || args.KeyAgreement.X == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
+	if status := server.checkPINPermissions(trace, args); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	sharedSecret, err := server.getPINSharedSecret(*args.KeyAgreement)
+	if err != nil {
+		logger.Printf("ERROR: %s\n\n", err)
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	if status := server.verifyUser(trace); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	token := server.pinToken.issueWithPermissions(util.Now(), args.Permissions, args.RelyingPartyID)
+	response := clientPINResponse{
+		PinToken: crypto.EncryptAESCBC(sharedSecret, token),
+	}
+	logger.Printf("GET_UV_TOKEN RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, marshalCBOR(response)...)
+}
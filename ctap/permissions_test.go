@@ -0,0 +1,98 @@
+package ctap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func getPINTokenWithPermissions(t *testing.T, server *CTAPServer, client *dummyPINCTAPClient, permissions pinPermission, relyingPartyID string) ctapStatusCode {
+	platformKey := crypto.GenerateECDHKey()
+	sharedSecret := crypto.HashSHA256(platformKey.ECDH(client.pinKeyAgreement.X, client.pinKeyAgreement.Y))
+	args := clientPINArgs{
+		PINUVAuthProtocol: 1,
+		SubCommand:        clientPINSubcommandGetPINTokenWithPermissions,
+		KeyAgreement: &cose.COSEEC2Key{
+			KeyType:   int8(cose.COSE_KEY_TYPE_EC2),
+			Algorithm: int8(cose.COSE_ALGORITHM_ID_ECDH_HKDF_256),
+			X:         platformKey.X.Bytes(),
+			Y:         platformKey.Y.Bytes(),
+		},
+		PINHashEncoding: crypto.EncryptAESCBC(sharedSecret, client.pinHash),
+		Permissions:     permissions,
+		RelyingPartyID:  relyingPartyID,
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	if ctapStatusCode(response[0]) == ctap1ErrSuccess {
+		var token clientPINResponse
+		util.CheckErr(cbor.Unmarshal(response[1:], &token), "Could not decode PIN token")
+		test.Assert(t, bytes.Equal(crypto.DecryptAESCBC(sharedSecret, token.PinToken), server.pinToken.current()), "Wrong PIN token")
+	}
+	return ctapStatusCode(response[0])
+}
+
+func TestPINTokenPermissions(t *testing.T) {
+	client := newDummyPINCTAPClient()
+	client.pinHash = crypto.HashSHA256([]byte("1234"))[:16]
+	server := NewCTAPServer(client)
+	makeCredential := func(relyingPartyID string) ctapStatusCode {
+		pinAuth := server.derivePINAuth(server.pinToken.current(), crypto.HashSHA256([]byte("client data")))
+		message := makeCredentialMessage(map[int]interface{}{2: map[string]string{"id": relyingPartyID, "name": relyingPartyID}, 8: pinAuth, 9: 1})
+		return ctapStatusCode(server.HandleMessage(message)[0])
+	}
+
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, 0, "rp"), ctap2ErrMissingParam, "Permissions are required")
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionMakeCredential, ""), ctap2ErrMissingParam, "mc needs an RP ID")
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionBioEnrollment, ""), ctap2ErrUnauthorizedPermission, "be isn't supported")
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionCredentialManagement, ""), ctap2ErrUnauthorizedPermission, "cm needs a credential store")
+
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionGetAssertion, "rp"), ctap1ErrSuccess, "Could not get PIN token")
+	test.AssertEqual(t, makeCredential("rp"), ctap2ErrPINAuthInvalid, "ga token shouldn't allow MakeCredential")
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionMakeCredential, "other"), ctap1ErrSuccess, "Could not get PIN token")
+	test.AssertEqual(t, makeCredential("rp"), ctap2ErrPINAuthInvalid, "Token should be bound to its RP ID")
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionMakeCredential, "rp"), ctap1ErrSuccess, "Could not get PIN token")
+	test.AssertEqual(t, makeCredential("rp"), ctap1ErrSuccess, "mc token should allow MakeCredential")
+
+	info := decodedGetInfo(t, server)
+	test.Assert(t, info.Options.PINUVAuthToken != nil && *info.Options.PINUVAuthToken, "pinUvAuthToken should be reported")
+	server.SetConformanceMode(true)
+	test.Assert(t, decodedGetInfo(t, server).Options.PINUVAuthToken == nil, "pinUvAuthToken isn't in CTAP 2.0")
+}
+
+func TestPINTokenRegenerated(t *testing.T) {
+	client := newDummyPINCTAPClient()
+	client.pinHash = crypto.HashSHA256([]byte("1234"))[:16]
+	server := NewCTAPServer(client)
+	clientDataHash := crypto.HashSHA256([]byte("client data"))
+	makeCredential := func(token []byte) ctapStatusCode {
+		message := makeCredentialMessage(map[int]interface{}{8: server.derivePINAuth(token, clientDataHash), 9: 1})
+		return ctapStatusCode(server.HandleMessage(message)[0])
+	}
+
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionMakeCredential, "rp"), ctap1ErrSuccess, "Could not get PIN token")
+	oldToken := server.pinToken.current()
+	test.AssertEqual(t, getPINTokenWithPermissions(t, server, client, pinPermissionMakeCredential, "rp"), ctap1ErrSuccess, "Could not get PIN token")
+	newToken := server.pinToken.current()
+	test.Assert(t, !bytes.Equal(oldToken, newToken), "Each issue should make a new PIN token")
+	test.AssertEqual(t, makeCredential(oldToken), ctap2ErrPINAuthInvalid, "Old PIN token should be refused")
+	test.AssertEqual(t, makeCredential(newToken), ctap1ErrSuccess, "New PIN token should be accepted")
+}
+
+func TestLegacyPINTokenPermissions(t *testing.T) {
+	client := newFeatureCTAPClient()
+	server := NewCTAPServer(client)
+	message := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandConfig), byte(configSubcommandToggleAlwaysUV)})
+	toggle := func(token []byte) []byte {
+		args := map[int]interface{}{1: uint32(configSubcommandToggleAlwaysUV), 3: 1, 4: server.derivePINAuth(token, message)}
+		return server.HandleMessage(util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(args)))
+	}
+	response := toggle(server.pinToken.issue(util.Now()))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrPINAuthInvalid, "getPINToken tokens shouldn't allow acfg")
+	response = toggle(server.pinToken.issueWithPermissions(util.Now(), pinPermissionAuthenticatorConfig, ""))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "acfg token should allow config")
+}
@@ -0,0 +1,150 @@
+package ctap
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// Timeouts are the timers of the CTAP2 spec. They can be changed to test how platforms handle
+// slow users and expired tokens.
+type Timeouts struct {
+	// How long user presence collected for a request authorized with the PIN token can be
+	// used once by the next request for the same RP, without asking the user again
+	UserPresence time.Duration
+	// How long a new PIN token can go unused before it expires
+	PINTokenInitialUse time.Duration
+	// How long a PIN token can be used after it's issued
+	PINTokenLifetime time.Duration
+	// How long a request waits for the user before failing with CTAP2_ERR_USER_ACTION_TIMEOUT,
+	// or 0 to wait forever
+	UserAction time.Duration
+}
+
+// DefaultTimeouts are the limits in the CTAP 2.1 spec for USB authenticators
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		UserPresence:       30 * time.Second,
+		PINTokenInitialUse: 30 * time.Second,
+		PINTokenLifetime:   10 * time.Minute,
+		UserAction:         30 * time.Second,
+	}
+}
+
+// CTAP 2.1 pinUvAuthTokens are 32 bytes
+const pinTokenLength = 32
+
+// pinTokenState tracks the PIN token issued by clientPIN. Every issue makes a new token, so
+// earlier ones stop working. A token can only authorize the requests its permissions allow,
+// and is bound to the RP it was issued for or, failing that, the RP of the first request it
+// authorizes.
+type pinTokenState struct {
+	lock           sync.Mutex
+	token          []byte
+	issuedAt       time.Time
+	firstUsedAt    time.Time
+	permissions    pinPermission
+	relyingPartyID string
+	userPresentAt  time.Time
+}
+
+// issue starts a token with the permissions getPINToken grants
+func (state *pinTokenState) issue(now time.Time) []byte {
+	return state.issueWithPermissions(now, legacyPINPermissions, "")
+}
+
+func (state *pinTokenState) issueWithPermissions(now time.Time, permissions pinPermission, relyingPartyID string) []byte {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.token = crypto.RandomBytes(pinTokenLength)
+	state.issuedAt = now
+	state.firstUsedAt = time.Time{}
+	state.permissions = permissions
+	state.relyingPartyID = relyingPartyID
+	state.userPresentAt = time.Time{}
+	return state.token
+}
+
+// current is the last token issued, or nil before the first
+func (state *pinTokenState) current() []byte {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.token
+}
+
+// use checks that the token can still authorize a request needing permission for
+// relyingPartyID, which is empty for requests that aren't for an RP
+func (state *pinTokenState) use(trace util.TraceID, now time.Time, permission pinPermission, relyingPartyID string, timeouts Timeouts) bool {
+	logger := ctapLogger.WithTrace(trace)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.issuedAt.IsZero() {
+		logger.Printf("ERROR: PIN token was not issued\n\n")
+		return false
+	}
+	if now.Sub(state.issuedAt) > timeouts.PINTokenLifetime ||
+		(state.firstUsedAt.IsZero() && now.Sub(state.issuedAt) > timeouts.PINTokenInitialUse) {
+		logger.Printf("ERROR: PIN token expired\n\n")
+		state.issuedAt = time.Time{}
+		return false
+	}
+	if state.permissions&permission == 0 {
+		logger.Printf("ERROR: PIN token has permissions %s, not %s\n\n", state.permissions, permission)
+		return false
+	}
+	if state.relyingPartyID == "" {
+		state.relyingPartyID = relyingPartyID
+	} else if state.relyingPartyID != relyingPartyID {
+		logger.Printf("ERROR: PIN token is bound to %s, not %q\n\n", state.relyingPartyID, relyingPartyID)
+		return false
+	}
+	if state.firstUsedAt.IsZero() {
+		state.firstUsedAt = now
+	}
+	return true
+}
+
+func (state *pinTokenState) recordUserPresence(now time.Time) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.userPresentAt = now
+}
+
+// takeUserPresence reports whether user presence was collected recently enough to be used
+// instead of asking again. It can only be used once.
+func (state *pinTokenState) takeUserPresence(now time.Time, timeouts Timeouts) bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	present := !state.userPresentAt.IsZero() && now.Sub(state.userPresentAt) <= timeouts.UserPresence
+	state.userPresentAt = time.Time{}
+	return present
+}
+
+// askUser waits for the user to answer ask, failing if they take longer than the
+// UserAction timeout. The question stays open after a timeout, but its answer is ignored.
+func (server *CTAPServer) askUser(trace util.TraceID, ask func() bool) ctapStatusCode {
+	if server.timeouts.UserAction == 0 {
+		if !ask() {
+			return ctap2ErrOperationDenied
+		}
+		return ctap1ErrSuccess
+	}
+	answer := make(chan bool, 1)
+	go func() {
+		answer <- ask()
+	}()
+	timer := util.NewTimer(server.timeouts.UserAction)
+	defer timer.Stop()
+	select {
+	case approved := <-answer:
+		if !approved {
+			return ctap2ErrOperationDenied
+		}
+		return ctap1ErrSuccess
+	case <-timer.C():
+		ctapLogger.WithTrace(trace).Printf("ERROR: User did not answer within %s\n\n", server.timeouts.UserAction)
+		return ctap2ErrUserActionTimeout
+	}
+}
@@ -0,0 +1,95 @@
+package ctap
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+type slowCTAPClient struct {
+	dummyPINCTAPClient
+	delay  time.Duration
+	logins int32
+}
+
+func (client *slowCTAPClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
+	atomic.AddInt32(&client.logins, 1)
+	time.Sleep(client.delay)
+	return true
+}
+
+func newTimeoutsTestServer(timeouts Timeouts) (*CTAPServer, *slowCTAPClient) {
+	client := &slowCTAPClient{dummyPINCTAPClient: *newDummyPINCTAPClient()}
+	for _, id := range []string{"a.example", "b.example"} {
+		client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: id, Name: id}, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"})
+	}
+	server := NewCTAPServer(client)
+	server.SetTimeouts(timeouts)
+	return server, client
+}
+
+func getAssertionWithPINToken(server *CTAPServer, client *slowCTAPClient, relyingPartyID string) ctapStatusCode {
+	clientDataHash := crypto.HashSHA256([]byte(relyingPartyID))
+	args := getAssertionArgs{
+		RPID:              relyingPartyID,
+		ClientDataHash:    clientDataHash,
+		PINUVAuthParam:    server.derivePINAuth(server.pinToken.current(), clientDataHash),
+		PINUVAuthProtocol: 1,
+	}
+	return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))[0])
+}
+
+func TestPINTokenExpiry(t *testing.T) {
+	timeouts := DefaultTimeouts()
+	timeouts.PINTokenInitialUse = 20 * time.Millisecond
+	timeouts.PINTokenLifetime = 100 * time.Millisecond
+	server, client := newTimeoutsTestServer(timeouts)
+
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap2ErrPINAuthInvalid, "PIN token should not be usable before it's issued")
+	server.pinToken.issue(time.Now())
+	time.Sleep(40 * time.Millisecond)
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap2ErrPINAuthInvalid, "Unused PIN token should expire")
+
+	server.pinToken.issue(time.Now())
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap1ErrSuccess, "New PIN token should be usable")
+	time.Sleep(40 * time.Millisecond)
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap1ErrSuccess, "Used PIN token should stay usable")
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "b.example"), ctap2ErrPINAuthInvalid, "PIN token should be bound to its first RP")
+	time.Sleep(80 * time.Millisecond)
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap2ErrPINAuthInvalid, "PIN token should expire after its lifetime")
+}
+
+func TestUserPresenceWindow(t *testing.T) {
+	timeouts := DefaultTimeouts()
+	timeouts.UserPresence = 50 * time.Millisecond
+	server, client := newTimeoutsTestServer(timeouts)
+	server.pinToken.issue(time.Now())
+
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap1ErrSuccess, "Could not get assertion")
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap1ErrSuccess, "Could not get assertion")
+	test.AssertEqual(t, atomic.LoadInt32(&client.logins), int32(1), "User presence should be reused within the window")
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap1ErrSuccess, "Could not get assertion")
+	test.AssertEqual(t, atomic.LoadInt32(&client.logins), int32(2), "User presence should only be reused once")
+	time.Sleep(80 * time.Millisecond)
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap1ErrSuccess, "Could not get assertion")
+	test.AssertEqual(t, atomic.LoadInt32(&client.logins), int32(3), "User presence should expire")
+}
+
+func TestUserActionTimeout(t *testing.T) {
+	timeouts := DefaultTimeouts()
+	timeouts.UserAction = 10 * time.Millisecond
+	server, client := newTimeoutsTestServer(timeouts)
+	server.pinToken.issue(time.Now())
+	client.delay = 100 * time.Millisecond
+
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap2ErrUserActionTimeout, "Slow approval should time out")
+	timeouts.UserAction = 0
+	server.SetTimeouts(timeouts)
+	test.AssertEqual(t, getAssertionWithPINToken(server, client, "a.example"), ctap1ErrSuccess, "Approval should wait without a timeout")
+}
@@ -0,0 +1,212 @@
+package ctap
+
+import (
+	"errors"
+
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// requestCheck is one rule a request has to follow before the command acts on it
+type requestCheck struct {
+	description string
+	check       func() ctapStatusCode
+}
+
+// runChecks returns the status of the first check that fails. Commands list their checks in
+// the order of the steps in the CTAP 2.0 spec, which decides the error a request gets when
+// it breaks several rules.
+func runChecks(trace util.TraceID, checks []requestCheck) ctapStatusCode {
+	for _, check := range checks {
+		if status := check.check(); status != ctap1ErrSuccess {
+			ctapLogger.WithTrace(trace).Printf("ERROR: %s: 0x%02x\n\n", check.description, byte(status))
+			return status
+		}
+	}
+	return ctap1ErrSuccess
+}
+
+// decodeErrorStatus is the status of a request that couldn't be decoded
+func decodeErrorStatus(err error) ctapStatusCode {
+	var typeError *cbor.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return ctap2ErrCBORUnexpectedType
+	}
+	return ctap2ErrInvalidCBOR
+}
+
+// checkZeroLengthPINAuth handles the zero length pinAuth platforms send to have the user pick
+// one of several authenticators: once the user is present, the request fails with the error
+// that makes the platform set or ask for the PIN
+func (server *CTAPServer) checkZeroLengthPINAuth(trace util.TraceID, pinAuth []byte) ctapStatusCode {
+	if !server.client.SupportsPIN() || pinAuth == nil || len(pinAuth) > 0 {
+		return ctap1ErrSuccess
+	}
+	status := server.askUser(trace, server.approveSelection)
+	if status != ctap1ErrSuccess {
+		return status
+	}
+	if !server.pinSet() {
+		return ctap2ErrNoPINSet
+	}
+	return ctap2ErrPINInvalid
+}
+
+func (server *CTAPServer) checkPINProtocolPresent(pinAuth []byte, pinProtocol uint32) ctapStatusCode {
+	if server.client.SupportsPIN() && pinAuth != nil && pinProtocol == 0 {
+		return ctap2ErrMissingParam
+	}
+	return ctap1ErrSuccess
+}
+
+// checkPINAuthParam verifies the pinAuth of a request, adding the UV flag to flags
+func (server *CTAPServer) checkPINAuthParam(trace util.TraceID, permission pinPermission, relyingPartyID string, clientDataHash []byte, pinAuth []byte, pinProtocol uint32, flags *authDataFlags) ctapStatusCode {
+	if !server.client.SupportsPIN() || pinAuth == nil || pinProtocol != 1 {
+		return ctap1ErrSuccess
+	}
+	if !server.checkPINAuth(trace, permission, relyingPartyID, clientDataHash, pinAuth) {
+		return ctap2ErrPINAuthInvalid
+	}
+	*flags = *flags | authDataFlagUserVerified
+	return ctap1ErrSuccess
+}
+
+func (server *CTAPServer) checkPINProtocolSupported(pinAuth []byte, pinProtocol uint32) ctapStatusCode {
+	if server.client.SupportsPIN() && pinAuth != nil && pinProtocol != 1 {
+		return ctap2ErrPINAuthInvalid
+	}
+	return ctap1ErrSuccess
+}
+
+// checkUserVerificationOption refuses "uv" without built-in user verification, unless the
+// request has a pinAuth, which verifies the user instead
+func (server *CTAPServer) checkUserVerificationOption(userVerification bool, pinAuth []byte) ctapStatusCode {
+	if userVerification && pinAuth == nil && !server.supportsUserVerification() {
+		return ctap2ErrUnsupportedOption
+	}
+	return ctap1ErrSuccess
+}
+
+// checkAlwaysUV fails requests that can't verify the user while alwaysUv is on: without a
+// pinAuth, the PIN is the only way left unless the client has built-in user verification
+func (server *CTAPServer) checkAlwaysUV(pinAuth []byte) ctapStatusCode {
+	if !server.alwaysUV() || pinAuth != nil || server.supportsUserVerification() {
+		return ctap1ErrSuccess
+	}
+	if !server.client.SupportsPIN() {
+		return ctap2ErrOperationDenied
+	}
+	if !server.pinSet() {
+		return ctap2ErrNoPINSet
+	}
+	return ctap2ErrPINRequired
+}
+
+// makeCredentialChecks follow authenticatorMakeCredential in CTAP 2.0, section 5.1. A pinAuth
+// that verifies adds the UV flag to flags.
+func (server *CTAPServer) makeCredentialChecks(trace util.TraceID, args makeCredentialArgs, flags *authDataFlags) []requestCheck {
+	return []requestCheck{
+		{"Missing MAKE_CREDENTIAL parameter", func() ctapStatusCode {
+			if args.ClientDataHash == nil || args.RP == nil || args.User == nil || args.PubKeyCredParams == nil {
+				return ctap2ErrMissingParam
+			}
+			if args.RP.ID == "" || args.User.ID == nil {
+				return ctap2ErrMissingParam
+			}
+			for _, param := range args.PubKeyCredParams {
+				if param.Type == "" || param.Algorithm == 0 {
+					return ctap2ErrMissingParam
+				}
+			}
+			return ctap1ErrSuccess
+		}},
+		{"Zero length pinAuth", func() ctapStatusCode {
+			return server.checkZeroLengthPINAuth(trace, args.PINUVAuthParam)
+		}},
+		{"pinAuth without pinProtocol", func() ctapStatusCode {
+			return server.checkPINProtocolPresent(args.PINUVAuthParam, args.PINUVAuthProtocol)
+		}},
+		{"Credential excluded", func() ctapStatusCode {
+			if !server.isExcluded(args) {
+				return ctap1ErrSuccess
+			}
+			// The RP only learns the credential exists once the user has confirmed
+			status := server.askUser(trace, func() bool { return server.approveAccountCreation(args.RP, args.User) })
+			if status != ctap1ErrSuccess {
+				return status
+			}
+			return ctap2ErrCredentialExcluded
+		}},
+		{"Unsupported Algorithm", func() ctapStatusCode {
+			if !supportsES256(args.PubKeyCredParams) {
+				return ctap2ErrUnsupportedAlgorithm
+			}
+			return ctap1ErrSuccess
+		}},
+		{"Invalid MAKE_CREDENTIAL option", func() ctapStatusCode {
+			if args.Options == nil {
+				return ctap1ErrSuccess
+			}
+			if args.Options.UserPresence != nil && !*args.Options.UserPresence {
+				return ctap2ErrInvalidOption
+			}
+			if args.Options.ResidentKey && !server.client.SupportsResidentKey() {
+				return ctap2ErrUnsupportedOption
+			}
+			return server.checkUserVerificationOption(args.Options.UserVerification, args.PINUVAuthParam)
+		}},
+		{"User verification required by alwaysUv", func() ctapStatusCode {
+			return server.checkAlwaysUV(args.PINUVAuthParam)
+		}},
+		{"Invalid pinAuth", func() ctapStatusCode {
+			return server.checkPINAuthParam(trace, pinPermissionMakeCredential, args.RP.ID, args.ClientDataHash, args.PINUVAuthParam, args.PINUVAuthProtocol, flags)
+		}},
+		{"PIN required", func() ctapStatusCode {
+			residentKey := args.Options != nil && args.Options.ResidentKey
+			if server.makeCredUVNotRequired && !residentKey && !server.alwaysUV() {
+				return ctap1ErrSuccess
+			}
+			if server.client.SupportsPIN() && args.PINUVAuthParam == nil && server.pinSet() {
+				return ctap2ErrPINRequired
+			}
+			return ctap1ErrSuccess
+		}},
+		{"Unsupported pinProtocol", func() ctapStatusCode {
+			return server.checkPINProtocolSupported(args.PINUVAuthParam, args.PINUVAuthProtocol)
+		}},
+	}
+}
+
+// getAssertionChecks follow authenticatorGetAssertion in CTAP 2.0, section 5.2. A pinAuth
+// that verifies adds the UV flag to flags.
+func (server *CTAPServer) getAssertionChecks(trace util.TraceID, args getAssertionArgs, flags *authDataFlags) []requestCheck {
+	return []requestCheck{
+		{"Missing GET_ASSERTION parameter", func() ctapStatusCode {
+			if args.RPID == "" || args.ClientDataHash == nil {
+				return ctap2ErrMissingParam
+			}
+			return ctap1ErrSuccess
+		}},
+		{"Zero length pinAuth", func() ctapStatusCode {
+			return server.checkZeroLengthPINAuth(trace, args.PINUVAuthParam)
+		}},
+		{"pinAuth without pinProtocol", func() ctapStatusCode {
+			return server.checkPINProtocolPresent(args.PINUVAuthParam, args.PINUVAuthProtocol)
+		}},
+		{"Invalid pinAuth", func() ctapStatusCode {
+			return server.checkPINAuthParam(trace, pinPermissionGetAssertion, args.RPID, args.ClientDataHash, args.PINUVAuthParam, args.PINUVAuthProtocol, flags)
+		}},
+		{"Unsupported pinProtocol", func() ctapStatusCode {
+			return server.checkPINProtocolSupported(args.PINUVAuthParam, args.PINUVAuthProtocol)
+		}},
+		{"Invalid GET_ASSERTION option", func() ctapStatusCode {
+			if args.Options.ResidentKey != nil {
+				return ctap2ErrInvalidOption
+			}
+			return server.checkUserVerificationOption(args.Options.UserVerification, args.PINUVAuthParam)
+		}},
+		{"User verification required by alwaysUv", func() ctapStatusCode {
+			return server.checkAlwaysUV(args.PINUVAuthParam)
+		}},
+	}
+}
@@ -0,0 +1,67 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func makeCredentialMessage(changes map[int]interface{}) []byte {
+	args := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "rp", "name": "rp"},
+		3: map[string]interface{}{"id": []byte{2}, "name": "Bob", "displayName": "Bob"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+	}
+	for key, value := range changes {
+		args[key] = value
+	}
+	return util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args))
+}
+
+func getAssertionMessage(changes map[int]interface{}) []byte {
+	args := map[int]interface{}{
+		1: "rp",
+		2: crypto.HashSHA256([]byte("client data")),
+	}
+	for key, value := range changes {
+		args[key] = value
+	}
+	return util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args))
+}
+
+func TestErrorPrecedence(t *testing.T) {
+	client := newDummyPINCTAPClient()
+	server := NewCTAPServer(client)
+	checkStatus := func(message []byte, expected ctapStatusCode, description string) {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), expected, description)
+	}
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice", DisplayName: "Alice"})
+	excluded := []map[string]interface{}{{"type": "public-key", "id": identity.ID}}
+	unsupported := []map[string]interface{}{{"alg": -257, "type": "public-key"}}
+
+	checkStatus(makeCredentialMessage(map[int]interface{}{2: "rp"}), ctap2ErrCBORUnexpectedType, "RP of the wrong type")
+	checkStatus(getAssertionMessage(map[int]interface{}{2: "hash"}), ctap2ErrCBORUnexpectedType, "clientDataHash of the wrong type")
+	checkStatus(makeCredentialMessage(map[int]interface{}{3: map[string]interface{}{"name": "Bob"}, 8: []byte{}}), ctap2ErrMissingParam, "Missing user ID goes first")
+	checkStatus(makeCredentialMessage(map[int]interface{}{4: []map[string]interface{}{{"type": "public-key"}}}), ctap2ErrMissingParam, "Algorithm without alg")
+	checkStatus(makeCredentialMessage(map[int]interface{}{8: []byte{}, 5: excluded}), ctap2ErrNoPINSet, "Zero length pinAuth goes before the exclude list")
+	checkStatus(makeCredentialMessage(map[int]interface{}{8: []byte{1}, 5: excluded}), ctap2ErrMissingParam, "pinAuth without pinProtocol goes before the exclude list")
+	checkStatus(makeCredentialMessage(map[int]interface{}{4: unsupported, 5: excluded}), ctap2ErrCredentialExcluded, "Exclude list goes before the algorithms")
+	checkStatus(makeCredentialMessage(map[int]interface{}{4: unsupported, 7: map[string]bool{"up": false}}), ctap2ErrUnsupportedAlgorithm, "Algorithms go before the options")
+	checkStatus(makeCredentialMessage(map[int]interface{}{7: map[string]bool{"up": false}, 8: []byte{1}, 9: 1}), ctap2ErrInvalidOption, "Options go before the pinAuth")
+	checkStatus(makeCredentialMessage(map[int]interface{}{7: map[string]bool{"uv": true}}), ctap2ErrUnsupportedOption, "uv without user verification")
+	checkStatus(makeCredentialMessage(map[int]interface{}{8: []byte{1}, 9: 2}), ctap2ErrPINAuthInvalid, "Unsupported pinProtocol")
+	checkStatus(getAssertionMessage(map[int]interface{}{5: map[string]bool{"rk": true}}), ctap2ErrInvalidOption, "rk isn't a GetAssertion option")
+	checkStatus(getAssertionMessage(map[int]interface{}{6: []byte{1}, 5: map[string]bool{"rk": true}}), ctap2ErrMissingParam, "pinAuth without pinProtocol goes before the options")
+	checkStatus(getAssertionMessage(map[int]interface{}{6: []byte{1}, 7: 1, 5: map[string]bool{"rk": true}}), ctap2ErrPINAuthInvalid, "pinAuth goes before the options")
+
+	client.pinHash = []byte{1}
+	checkStatus(makeCredentialMessage(map[int]interface{}{4: unsupported}), ctap2ErrUnsupportedAlgorithm, "Algorithms go before the PIN")
+	checkStatus(makeCredentialMessage(nil), ctap2ErrPINRequired, "PIN should be required once set")
+	checkStatus(getAssertionMessage(map[int]interface{}{6: []byte{}}), ctap2ErrPINInvalid, "Zero length pinAuth with a PIN")
+}
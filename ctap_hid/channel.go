@@ -3,15 +3,105 @@ package ctap_hid
 import (
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/bulwarkid/virtual-fido/events"
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
+// ChannelState is where a channel is in a transaction
+type ChannelState uint8
+
+const (
+	// Waiting for an initialization packet
+	ChannelIdle ChannelState = iota
+	// Reassembling a message from continuation packets
+	ChannelReceiving
+	// Waiting on the client's handler, sending keepalives for CBOR requests
+	ChannelProcessing
+	// Sending the response or an error
+	ChannelResponding
+)
+
+var channelStateDescriptions = map[ChannelState]string{
+	ChannelIdle:       "idle",
+	ChannelReceiving:  "receiving",
+	ChannelProcessing: "processing",
+	ChannelResponding: "responding",
+}
+
+func (state ChannelState) String() string {
+	if s, ok := channelStateDescriptions[state]; ok {
+		return s
+	}
+	return fmt.Sprintf("%d", state)
+}
+
+type channelEvent uint8
+
+const (
+	// A packet that leaves the message incomplete
+	channelEventPartialMessage channelEvent = iota
+	// The packet completing the message
+	channelEventMessage
+	// CTAPHID_CANCEL, which isn't answered
+	channelEventCancel
+	// A response or error is ready to send
+	channelEventRespond
+	// The last packet of the response was sent
+	channelEventSent
+)
+
+var channelTransitions = map[ChannelState]map[channelEvent]ChannelState{
+	ChannelIdle: {
+		channelEventPartialMessage: ChannelReceiving,
+		channelEventMessage:        ChannelProcessing,
+		channelEventCancel:         ChannelIdle,
+		channelEventRespond:        ChannelResponding,
+	},
+	ChannelReceiving: {
+		channelEventPartialMessage: ChannelReceiving,
+		channelEventMessage:        ChannelProcessing,
+		channelEventCancel:         ChannelIdle,
+		channelEventRespond:        ChannelResponding,
+	},
+	ChannelProcessing: {
+		channelEventRespond: ChannelResponding,
+	},
+	ChannelResponding: {
+		channelEventSent: ChannelIdle,
+	},
+}
+
+// nextChannelState returns the state event moves a channel in state to, or false if event
+// can't happen in state
+func nextChannelState(state ChannelState, event channelEvent) (ChannelState, bool) {
+	next, ok := channelTransitions[state][event]
+	return next, ok
+}
+
+// ChannelInfo is a channel as listed by CTAPHIDServer.Channels
+type ChannelInfo struct {
+	ID    uint32
+	State ChannelState
+	// Trace of the transaction in progress, or of the last one when idle
+	Trace util.TraceID
+	// When the channel entered State
+	Since time.Time
+}
+
 type ctapHIDChannel struct {
-	server      *CTAPHIDServer
-	channelId   ctapHIDChannelID
+	server    *CTAPHIDServer
+	channelId ctapHIDChannelID
+	// Held while a packet is handled, which includes processing a completed message unless
+	// the server detaches it
 	messageLock sync.Locker
 	transaction *ctapHIDTransaction
+	// Guards the state separately so the channel table can be read during processing
+	stateLock sync.Mutex
+	state     ChannelState
+	trace     util.TraceID
+	since     time.Time
 }
 
 func newCTAPHIDChannel(server *CTAPHIDServer, channelId ctapHIDChannelID) *ctapHIDChannel {
@@ -20,33 +110,90 @@ func newCTAPHIDChannel(server *CTAPHIDServer, channelId ctapHIDChannelID) *ctapH
 		channelId:   channelId,
 		messageLock: &sync.Mutex{},
 		transaction: nil,
+		state:       ChannelIdle,
+		since:       time.Now(),
 	}
 }
 
-func (channel *ctapHIDChannel) handleMessage(message []byte) {
+// transition moves the channel along event, or logs and stays put if event is invalid in
+// the current state
+func (channel *ctapHIDChannel) transition(trace util.TraceID, event channelEvent) {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	next, ok := nextChannelState(channel.state, event)
+	if !ok {
+		ctapHIDLogger.WithTrace(trace).Printf("ERROR: Invalid event %d for channel 0x%x in state %s\n\n", event, channel.channelId, channel.state)
+		return
+	}
+	if next != channel.state {
+		channel.since = time.Now()
+	}
+	channel.state = next
+	channel.trace = trace
+}
+
+func (channel *ctapHIDChannel) info() ChannelInfo {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	return ChannelInfo{ID: uint32(channel.channelId), State: channel.state, Trace: channel.trace, Since: channel.since}
+}
+
+func (channel *ctapHIDChannel) currentState() ChannelState {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	return channel.state
+}
+
+func (channel *ctapHIDChannel) handleMessage(trace util.TraceID, message []byte) {
 	channel.messageLock.Lock()
 	defer channel.messageLock.Unlock()
-	if channel.transaction == nil {
-		channel.transaction = newCTAPHIDTransaction(message)
+	if channel.currentState() != ChannelReceiving {
+		channel.transaction = newCTAPHIDTransaction(trace, message, channel.server.MaxMessageSize())
 	} else {
+		ctapHIDLogger.WithTrace(trace).Printf("CTAPHID CONTINUATION: Part of trace %s\n\n", channel.transaction.trace)
 		channel.transaction.addMessage(message)
 	}
-	if channel.transaction.done {
-		if channel.transaction.errorCode != 0 {
-			channel.server.sendError(channel.channelId, channel.transaction.errorCode)
-		} else if !channel.transaction.cancelled {
-			channel.handleFinalizedMessage(channel.transaction.result.header, channel.transaction.result.payload)
-		}
-		channel.transaction = nil
+	transaction := channel.transaction
+	switch {
+	case !transaction.done:
+		channel.transition(transaction.trace, channelEventPartialMessage)
+		return
+	case transaction.errorCode != 0:
+		channel.fail(transaction.trace, transaction.errorCode)
+	case transaction.cancelled:
+		channel.transition(transaction.trace, channelEventCancel)
+	default:
+		channel.transition(transaction.trace, channelEventMessage)
+		channel.handleFinalizedMessage(transaction.trace, transaction.result.header, transaction.result.payload)
 	}
+	channel.transaction = nil
 }
 
-func (channel *ctapHIDChannel) handleFinalizedMessage(header ctapHIDMessageHeader, payload []byte) {
-	ctapHIDLogger.Printf("CTAPHID FINALIZED MESSAGE: %s %#v\n\n", header, payload)
+// respond sends the response to the channel's message, which ends the transaction
+func (channel *ctapHIDChannel) respond(trace util.TraceID, command ctapHIDCommand, payload []byte) {
+	channel.transition(trace, channelEventRespond)
+	channel.server.sendResponse(trace, channel.channelId, command, payload)
+	channel.transition(trace, channelEventSent)
+}
+
+// fail answers the channel's message with an error, which ends the transaction
+func (channel *ctapHIDChannel) fail(trace util.TraceID, errorCode ctapHIDErrorCode) {
+	channel.transition(trace, channelEventRespond)
+	channel.server.sendError(trace, channel.channelId, errorCode)
+	channel.transition(trace, channelEventSent)
+}
+
+func (channel *ctapHIDChannel) handleFinalizedMessage(trace util.TraceID, header ctapHIDMessageHeader, payload []byte) {
+	ctapHIDLogger.WithTrace(trace).Printf("CTAPHID FINALIZED MESSAGE: %s %#v\n\n", header, payload)
+	commandName, ok := ctapHIDCommandDescriptions[header.Command]
+	if !ok {
+		commandName = "unknown"
+	}
+	hidTransactionCounter.Inc(commandName)
 	if channel.channelId == ctapHIDBroadcastChannel {
-		channel.handleBroadcastMessage(header, payload)
+		channel.handleBroadcastMessage(trace, header, payload)
 	} else {
-		channel.handleDataMessage(header, payload)
+		channel.handleDataMessage(trace, header, payload)
 	}
 }
 
@@ -60,9 +207,14 @@ type ctapHIDInitResponse struct {
 	CapabilitiesFlags  ctapHIDCapabilityFlag
 }
 
-func (channel *ctapHIDChannel) handleBroadcastMessage(header ctapHIDMessageHeader, payload []byte) {
+func (channel *ctapHIDChannel) handleBroadcastMessage(trace util.TraceID, header ctapHIDMessageHeader, payload []byte) {
+	logger := ctapHIDLogger.WithTrace(trace)
 	switch header.Command {
 	case ctapHIDCommandInit:
+		if len(payload) != 8 {
+			channel.fail(trace, ctapHIDErrorInvalidLength)
+			return
+		}
 		newChannel := channel.server.newChannel()
 		nonce := payload[:8]
 		response := ctapHIDInitResponse{
@@ -74,36 +226,90 @@ func (channel *ctapHIDChannel) handleBroadcastMessage(header ctapHIDMessageHeade
 			CapabilitiesFlags:  ctapHIDCapabilityCBOR,
 		}
 		copy(response.Nonce[:], nonce)
-		ctapHIDLogger.Printf("CTAPHID INIT RESPONSE: %#v\n\n", response)
-		channel.server.sendResponse(ctapHIDBroadcastChannel, ctapHIDCommandInit, util.ToLE(response))
+		logger.Printf("CTAPHID INIT RESPONSE: %#v\n\n", response)
+		channel.respond(trace, ctapHIDCommandInit, util.ToLE(response))
+		events.Publish(events.Event{Type: events.EventChannelOpened, ChannelID: uint32(newChannel.channelId), TraceID: trace})
 	case ctapHIDCommandPing:
-		channel.server.sendResponse(ctapHIDBroadcastChannel, ctapHIDCommandPing, payload)
+		channel.respond(trace, ctapHIDCommandPing, payload)
 	default:
-		util.Panic(fmt.Sprintf("Invalid CTAPHID Broadcast command: %#v", header))
+		logger.Printf("ERROR: Invalid CTAPHID Broadcast command: %s\n\n", header)
+		channel.fail(trace, ctapHIDErrorInvalidCommand)
 	}
 }
 
-func (channel *ctapHIDChannel) handleDataMessage(header ctapHIDMessageHeader, payload []byte) {
+// isAssertion reports whether a message asks for a CTAP2 assertion or U2F authentication
+// that's more than a check of the key handle
+func isAssertion(command ctapHIDCommand, payload []byte) bool {
+	switch command {
+	case ctapHIDCommandCBOR:
+		return len(payload) > 0 && payload[0] == ctapCommandGetAssertion
+	case ctapHIDCommandMsg:
+		return len(payload) > 2 && payload[1] == u2fInsAuthenticate && payload[2] != u2fAuthCheckOnly
+	}
+	return false
+}
+
+func (channel *ctapHIDChannel) handleDataMessage(trace util.TraceID, header ctapHIDMessageHeader, payload []byte) {
+	logger := ctapHIDLogger.WithTrace(trace)
+	// Keyed on the device rather than the channel, since a host can always open another
+	if isAssertion(header.Command, payload) && !channel.server.assertionLimiter.Allow("device") {
+		logger.Printf("ERROR: Too many assertions on the device, refusing channel %x\n\n", header.ChannelID)
+		channel.fail(trace, ctapHIDErrorChannelBusy)
+		return
+	}
 	switch header.Command {
 	case ctapHIDCommandMsg:
-		responsePayload := channel.server.u2fServer.HandleMessage(payload)
-		ctapHIDLogger.Printf("CTAPHID MSG RESPONSE: %d %#v\n\n", len(responsePayload), responsePayload)
-		channel.server.sendResponse(header.ChannelID, ctapHIDCommandMsg, responsePayload)
+		channel.server.detach(channel.channelId, func() {
+			var responsePayload []byte
+			if !channel.server.watchdog.Run(trace.Describe(header), func() {
+				responsePayload = handleClientMessage(channel.server.u2fServer, trace, uint32(channel.channelId), payload)
+			}) {
+				channel.fail(trace, ctapHIDErrorOther)
+				return
+			}
+			logger.Printf("CTAPHID MSG RESPONSE: %d %#v\n\n", len(responsePayload), responsePayload)
+			channel.server.recorder.recordMessage(trace, header.ChannelID, header.Command, payload, responsePayload)
+			channel.respond(trace, ctapHIDCommandMsg, responsePayload)
+		})
 	case ctapHIDCommandCBOR:
-		stop := util.StartRecurringFunction(keepConnectionAlive(channel.server, channel.channelId, ctapHIDStatusUpneeded), 50)
-		responsePayload := channel.server.ctapServer.HandleMessage(payload)
-		stop <- 0
-		ctapHIDLogger.Printf("CTAPHID CBOR RESPONSE: %#v\n\n", responsePayload)
-		channel.server.sendResponse(header.ChannelID, ctapHIDCommandCBOR, responsePayload)
+		channel.server.detach(channel.channelId, func() {
+			stop := util.StartRecurringFunction(channel.keepAlive(trace, ctapHIDStatusUpneeded), 50)
+			var responsePayload []byte
+			finished := channel.server.watchdog.Run(trace.Describe(header), func() {
+				responsePayload = handleClientMessage(channel.server.ctapServer, trace, uint32(channel.channelId), payload)
+			})
+			stop <- 0
+			if !finished {
+				channel.fail(trace, ctapHIDErrorOther)
+				return
+			}
+			logger.Printf("CTAPHID CBOR RESPONSE: %#v\n\n", responsePayload)
+			channel.server.recorder.recordMessage(trace, header.ChannelID, header.Command, payload, responsePayload)
+			channel.respond(trace, ctapHIDCommandCBOR, responsePayload)
+		})
 	case ctapHIDCommandPing:
-		channel.server.sendResponse(header.ChannelID, ctapHIDCommandPing, payload)
+		channel.respond(trace, ctapHIDCommandPing, payload)
 	default:
-		panic(fmt.Sprintf("Invalid CTAPHID Channel command: %s", header))
+		logger.Printf("ERROR: Invalid CTAPHID Channel command: %s\n\n", header)
+		channel.fail(trace, ctapHIDErrorInvalidCommand)
 	}
 }
 
-func keepConnectionAlive(server *CTAPHIDServer, channelId ctapHIDChannelID, status byte) func() {
+func handleClientMessage(client CTAPHIDClient, trace util.TraceID, session uint32, payload []byte) []byte {
+	if sessions, ok := client.(SessionCTAPHIDClient); ok {
+		return sessions.HandleSessionMessage(trace, session, payload)
+	}
+	if traced, ok := client.(TracedCTAPHIDClient); ok {
+		return traced.HandleTracedMessage(trace, payload)
+	}
+	return client.HandleMessage(payload)
+}
+
+// keepAlive sends keepalives while the channel is processing, so none trail its response
+func (channel *ctapHIDChannel) keepAlive(trace util.TraceID, status byte) func() {
 	return func() {
-		server.sendResponse(channelId, ctapHIDCommandKeepalive, []byte{status})
+		if channel.currentState() == ChannelProcessing {
+			channel.server.sendKeepalive(trace, channel.channelId, status)
+		}
 	}
 }
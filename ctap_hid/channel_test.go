@@ -0,0 +1,101 @@
+package ctap_hid
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+func TestChannelTransitions(t *testing.T) {
+	transitions := []struct {
+		state ChannelState
+		event channelEvent
+		next  ChannelState
+		valid bool
+	}{
+		{ChannelIdle, channelEventPartialMessage, ChannelReceiving, true},
+		{ChannelIdle, channelEventMessage, ChannelProcessing, true},
+		{ChannelIdle, channelEventCancel, ChannelIdle, true},
+		{ChannelIdle, channelEventRespond, ChannelResponding, true},
+		{ChannelIdle, channelEventSent, ChannelIdle, false},
+		{ChannelReceiving, channelEventPartialMessage, ChannelReceiving, true},
+		{ChannelReceiving, channelEventMessage, ChannelProcessing, true},
+		{ChannelReceiving, channelEventCancel, ChannelIdle, true},
+		{ChannelReceiving, channelEventRespond, ChannelResponding, true},
+		{ChannelProcessing, channelEventPartialMessage, ChannelIdle, false},
+		{ChannelProcessing, channelEventCancel, ChannelIdle, false},
+		{ChannelProcessing, channelEventRespond, ChannelResponding, true},
+		{ChannelResponding, channelEventMessage, ChannelIdle, false},
+		{ChannelResponding, channelEventSent, ChannelIdle, true},
+	}
+	for _, transition := range transitions {
+		next, ok := nextChannelState(transition.state, transition.event)
+		if ok != transition.valid || (ok && next != transition.next) {
+			t.Fatalf("Event %d in state %s should lead to %s (valid: %t), got %s (valid: %t)",
+				transition.event, transition.state, transition.next, transition.valid, next, ok)
+		}
+	}
+}
+
+func TestInvalidTransitionKeepsState(t *testing.T) {
+	channel := newCTAPHIDChannel(NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{}), 1)
+	channel.transition(1, channelEventPartialMessage)
+	channel.transition(2, channelEventSent)
+	test.AssertEqual(t, channel.currentState(), ChannelReceiving, "Invalid event should be ignored")
+	test.AssertEqual(t, channel.info().Trace, util.TraceID(1), "Invalid event shouldn't take over the trace")
+}
+
+func TestChannelTable(t *testing.T) {
+	handler := &hungHandler{release: make(chan struct{})}
+	server := NewCTAPHIDServer(handler, handler)
+	responses := make(chan []byte, 64)
+	server.SetResponseHandler(func(response []byte) {
+		responses <- response
+	})
+	channels := server.Channels()
+	test.AssertEqual(t, len(channels), 1, "Only the broadcast channel should be open")
+	test.AssertEqual(t, channels[0].ID, uint32(ctapHIDBroadcastChannel), "Broadcast channel should be listed")
+
+	initPacket := util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](8), make([]byte, 8))
+	server.HandleMessage(util.Pad(initPacket, ctapHIDMaxPacketSize))
+	<-responses
+	channels = server.Channels()
+	test.AssertEqual(t, len(channels), 2, "INIT should open a channel")
+	test.AssertEqual(t, channels[0].ID, uint32(1), "Channels should be ordered by ID")
+	test.AssertEqual(t, channels[0].State, ChannelIdle, "New channel should be idle")
+	test.AssertEqual(t, channels[1].State, ChannelIdle, "Broadcast channel should be idle after answering")
+
+	packets := createResponsePackets(ctapHIDMaxPacketSize, 1, ctapHIDCommandCBOR, make([]byte, 80))
+	server.HandleTracedMessage(5, packets[0])
+	channels = server.Channels()
+	test.AssertEqual(t, channels[0].State, ChannelReceiving, "Channel should wait for the continuation packet")
+	test.AssertEqual(t, channels[0].Trace, util.TraceID(5), "Channel should show the transaction's trace")
+
+	done := make(chan struct{})
+	go func() {
+		server.HandleTracedMessage(6, packets[1])
+		close(done)
+	}()
+	for server.Channels()[0].State != ChannelProcessing {
+		time.Sleep(time.Millisecond)
+	}
+	test.AssertEqual(t, server.Channels()[0].Trace, util.TraceID(5), "Continuation packets should keep the trace")
+	close(handler.release)
+	<-done
+	test.AssertEqual(t, server.Channels()[0].State, ChannelIdle, "Channel should be idle once it responded")
+}
+
+func TestCancelledChannelIsIdle(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	server.SetResponseHandler(func(response []byte) {
+		t.Fatalf("Cancelled message shouldn't be answered: %#v", response)
+	})
+	channel := server.newChannel()
+	packets := createResponsePackets(ctapHIDMaxPacketSize, 1, ctapHIDCommandCBOR, make([]byte, 80))
+	server.HandleMessage(packets[0])
+	test.AssertEqual(t, channel.currentState(), ChannelReceiving, "Channel should wait for the continuation packet")
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE[ctapHIDChannelID](1), []byte{byte(ctapHIDCommandCancel)}), ctapHIDMaxPacketSize))
+	test.AssertEqual(t, channel.currentState(), ChannelIdle, "Cancel should end the transaction")
+}
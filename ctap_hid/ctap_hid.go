@@ -2,35 +2,79 @@ package ctap_hid
 
 import (
 	"bytes"
+	"encoding/binary"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/bulwarkid/virtual-fido/fault_injection"
+	"github.com/bulwarkid/virtual-fido/metrics"
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
-var ctapHIDLogger = util.NewLogger("[CTAPHID] ", util.LogLevelDebug)
+var ctapHIDLogger = util.NewLogger("[CTAPHID] ", util.LogSubsystemHID, util.LogLevelDebug)
+
+var hidTransactionCounter = metrics.NewCounter("virtual_fido_hid_transactions_total", "Completed CTAPHID transactions", "command")
+var hidPacketCounter = metrics.NewCounter("virtual_fido_hid_packets_total", "CTAPHID packets", "direction")
+var hidDroppedPacketCounter = metrics.NewCounter("virtual_fido_hid_dropped_packets_total", "CTAPHID packets turned away because the worker pool's queues were full")
+
+// Worker pool sizing for clients. A channel's queue holds two maximum-size messages, and
+// the pool as a whole as much as eight channels.
+const (
+	DefaultWorkers            = 4
+	DefaultChannelQueueLength = 2 * 129
+	DefaultTotalQueueLength   = 8 * DefaultChannelQueueLength
+)
 
 type CTAPHIDClient interface {
 	HandleMessage(data []byte) []byte
 }
 
+// TracedCTAPHIDClient is implemented by clients that tag what they log and publish while
+// handling a message with its trace
+type TracedCTAPHIDClient interface {
+	HandleTracedMessage(trace util.TraceID, data []byte) []byte
+}
+
+// SessionCTAPHIDClient is implemented by clients that keep state between the messages of a
+// channel, like U2F's APDU chaining. The session is the channel ID, and a channel's messages
+// are handled one at a time.
+type SessionCTAPHIDClient interface {
+	HandleSessionMessage(trace util.TraceID, session uint32, data []byte) []byte
+}
+
 type CTAPHIDServer struct {
 	ctapServer      CTAPHIDClient
 	u2fServer       CTAPHIDClient
+	channelsLock    sync.Locker
 	maxChannelID    ctapHIDChannelID
 	channels        map[ctapHIDChannelID]*ctapHIDChannel
-	responsesLock   sync.Locker
+	workers         *util.WorkerPool
+	watchdog        *util.Watchdog
+	responses       *responseQueue
 	responseHandler func(response []byte)
+	// Set instead of responseHandler by callers that follow traces
+	tracedResponseHandler func(trace util.TraceID, response []byte)
+	faults                *fault_injection.FaultInjector
+	recorder              *SessionRecorder
+	packetSize            int
+	// Largest request accepted and advertised, or 0 for as much as fits in the packets
+	maxMessageSize uint32
+	// Limits assertions on all channels together, see SetAssertionRateLimit
+	assertionLimiter *util.RateLimiter
 }
 
 func NewCTAPHIDServer(ctapServer CTAPHIDClient, u2fServer CTAPHIDClient) *CTAPHIDServer {
 	server := &CTAPHIDServer{
 		ctapServer:      ctapServer,
 		u2fServer:       u2fServer,
+		channelsLock:    &sync.Mutex{},
 		maxChannelID:    0,
 		channels:        make(map[ctapHIDChannelID]*ctapHIDChannel),
-		responsesLock:   &sync.Mutex{},
 		responseHandler: nil,
+		packetSize:      ctapHIDMaxPacketSize,
 	}
+	server.responses = newResponseQueue(DefaultResponseQueueLength, server.deliverResponsePackets)
 	server.channels[ctapHIDBroadcastChannel] = newCTAPHIDChannel(server, ctapHIDBroadcastChannel)
 	return server
 }
@@ -39,68 +83,240 @@ func (server *CTAPHIDServer) SetResponseHandler(handler func(response []byte)) {
 	server.responseHandler = handler
 }
 
-func (server *CTAPHIDServer) sendResponsePackets(packets [][]byte) {
-	// Packets should be sequential and continuous per transaction
-	server.responsesLock.Lock()
-	defer server.responsesLock.Unlock()
-	// ctapHIDLogger.Printf("ADDING MESSAGE: %#v\n\n", response)
-	if server.responseHandler != nil {
+// SetTracedResponseHandler is SetResponseHandler, also passing the trace of the request
+// each packet answers
+func (server *CTAPHIDServer) SetTracedResponseHandler(handler func(trace util.TraceID, response []byte)) {
+	server.tracedResponseHandler = handler
+}
+
+func (server *CTAPHIDServer) SetFaultInjector(faults *fault_injection.FaultInjector) {
+	server.faults = faults
+}
+
+// SetSessionRecorder records all traffic through the server; nil stops recording
+func (server *CTAPHIDServer) SetSessionRecorder(recorder *SessionRecorder) {
+	server.recorder = recorder
+}
+
+// SetWorkerPool hands packets to the pool instead of handling them on the caller's goroutine.
+// Each channel gets its own queue, so packets of a channel stay in order while a slow
+// request on one channel doesn't hold up the others. U2F and CTAP requests are handled off
+// the pool's workers, so waiting on the user doesn't take one up. Packets the pool has no
+// room for are answered with ERR_CHANNEL_BUSY.
+func (server *CTAPHIDServer) SetWorkerPool(workers *util.WorkerPool) {
+	server.workers = workers
+}
+
+// SetWatchdog fails U2F and CTAP requests whose handler runs past the watchdog's deadline
+// with ERR_OTHER, instead of sending keepalives for them forever
+func (server *CTAPHIDServer) SetWatchdog(watchdog *util.Watchdog) {
+	server.watchdog = watchdog
+}
+
+// SetPacketSize matches the HID report size of the USB device, which can be larger than
+// 64 bytes at high speed
+func (server *CTAPHIDServer) SetPacketSize(packetSize int) {
+	server.packetSize = packetSize
+}
+
+// SetMaxMessageSize limits requests to size bytes, answering larger ones with
+// ERR_INVALID_LEN. It's capped at what fits in the packets, which is also the default.
+func (server *CTAPHIDServer) SetMaxMessageSize(size uint32) {
+	server.maxMessageSize = size
+}
+
+// SetAssertionRateLimit fails CTAP2 GetAssertion and U2F authentication requests past limit
+// with ERR_CHANNEL_BUSY. The limit is shared by all channels, since hosts can allocate new
+// ones with INIT. U2F check-only requests aren't counted.
+func (server *CTAPHIDServer) SetAssertionRateLimit(limit util.RateLimit) {
+	server.assertionLimiter = util.NewRateLimiter(limit)
+}
+
+// SetResponseQueueLength limits how many packets a channel can have waiting for the host
+// to read them, after which sending another response waits. A single response longer than
+// that is still sent.
+func (server *CTAPHIDServer) SetResponseQueueLength(packets int) {
+	server.responses.setMaxPackets(packets)
+}
+
+// MaxMessageSize is the largest request accepted, to be reported as maxMsgSize in GetInfo.
+// Unless limited with SetMaxMessageSize, it's the largest message that fits in an
+// initialization packet and 128 continuation packets.
+func (server *CTAPHIDServer) MaxMessageSize() uint32 {
+	size := maxMessageSize(server.packetSize)
+	if server.maxMessageSize != 0 && server.maxMessageSize < size {
+		return server.maxMessageSize
+	}
+	return size
+}
+
+func (server *CTAPHIDServer) sendResponsePackets(trace util.TraceID, channelID ctapHIDChannelID, packets [][]byte) {
+	if delay := server.faults.ResponseDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	packets = server.faults.MaybeDropContinuationPacket(packets)
+	server.responses.push(trace, channelID, packets)
+}
+
+// deliverResponsePackets hands the packets of one message to the response handler. The
+// response queue never calls it concurrently.
+func (server *CTAPHIDServer) deliverResponsePackets(trace util.TraceID, packets [][]byte) {
+	if server.responseHandler != nil || server.tracedResponseHandler != nil {
 		for _, packet := range packets {
-			server.responseHandler(packet)
+			server.recorder.recordPacket(trace, SessionEventPacketIn, packet)
+			if server.tracedResponseHandler != nil {
+				server.tracedResponseHandler(trace, packet)
+			} else {
+				server.responseHandler(packet)
+			}
 		}
+		hidPacketCounter.Add(uint64(len(packets)), "in")
 	}
 }
 
+// HandleMessage handles a packet that isn't traced yet, starting a trace for it
 func (server *CTAPHIDServer) HandleMessage(message []byte) {
+	server.HandleTracedMessage(util.NewTraceID(), message)
+}
+
+// HandleTracedMessage handles a packet traced by the caller, e.g. by the URB that carried it.
+// A transaction keeps the trace of its initialization packet.
+func (server *CTAPHIDServer) HandleTracedMessage(trace util.TraceID, message []byte) {
+	if server.workers == nil {
+		server.handlePacket(trace, message)
+		return
+	}
+	if len(message) < int(util.SizeOf[ctapHIDChannelID]())+1 {
+		server.handlePacket(trace, message)
+		return
+	}
+	channelID := util.ReadLE[ctapHIDChannelID](bytes.NewBuffer(message))
+	server.channelsLock.Lock()
+	_, exists := server.channels[channelID]
+	server.channelsLock.Unlock()
+	if !exists {
+		hidPacketCounter.Inc("out")
+		server.recorder.recordPacket(trace, SessionEventPacketOut, message)
+		server.rejectPacket(trace, channelID, ctapHIDErrorInvalidChannel)
+		return
+	}
+	if err := server.workers.Submit(channelID, func() { server.handlePacket(trace, message) }); err != nil {
+		ctapHIDLogger.WithTrace(trace).Printf("ERROR: %s, turning away packet for channel %d\n\n", err, channelID)
+		hidDroppedPacketCounter.Inc()
+		server.rejectPacket(trace, channelID, ctapHIDErrorChannelBusy)
+	}
+}
+
+// rejectPacket answers a packet that won't reach a worker on the caller's goroutine, so it
+// drops the error rather than wait for the host to make room for it
+func (server *CTAPHIDServer) rejectPacket(trace util.TraceID, channelID ctapHIDChannelID, errorCode ctapHIDErrorCode) {
+	ctapHIDLogger.WithTrace(trace).Printf("CTAPHID ERROR: %s\n\n", ctapHIDErrorCodeDescriptions[errorCode])
+	server.responses.offer(trace, channelID, ctapHidError(server.packetSize, channelID, errorCode))
+}
+
+// detach runs task, which handles a request for channelID, on its own goroutine when packets
+// go through the worker pool, so it doesn't keep a worker while waiting on the client. Later
+// packets for the channel stay queued until it's done.
+func (server *CTAPHIDServer) detach(channelID ctapHIDChannelID, task func()) {
+	if server.workers == nil {
+		task()
+		return
+	}
+	release := server.workers.Hold(channelID)
+	go func() {
+		defer release()
+		task()
+	}()
+}
+
+func (server *CTAPHIDServer) handlePacket(trace util.TraceID, message []byte) {
+	hidPacketCounter.Inc("out")
+	server.recorder.recordPacket(trace, SessionEventPacketOut, message)
+	if len(message) < int(util.SizeOf[ctapHIDChannelID]())+1 {
+		ctapHIDLogger.WithTrace(trace).Printf("ERROR: CTAPHID packet too short: %#v\n\n", message)
+		return
+	}
 	buffer := bytes.NewBuffer(message)
 	channelId := util.ReadLE[ctapHIDChannelID](buffer)
+	server.channelsLock.Lock()
 	channel, exists := server.channels[channelId]
+	server.channelsLock.Unlock()
 	if !exists {
-		server.sendError(channelId, ctapHIDErrorInvalidChannel)
+		server.sendError(trace, channelId, ctapHIDErrorInvalidChannel)
 		return
 	}
-	channel.handleMessage(message)
+	channel.handleMessage(trace, message)
 }
 
 func (server *CTAPHIDServer) newChannel() *ctapHIDChannel {
+	server.channelsLock.Lock()
+	defer server.channelsLock.Unlock()
 	channel := newCTAPHIDChannel(server, server.maxChannelID+1)
 	server.maxChannelID += 1
 	server.channels[channel.channelId] = channel
 	return channel
 }
 
-func (server *CTAPHIDServer) sendResponse(channelID ctapHIDChannelID, command ctapHIDCommand, payload []byte) {
-	packets := createResponsePackets(channelID, command, payload)
-	server.sendResponsePackets(packets)
+// Channels returns the channel table, including the broadcast channel, ordered by ID
+func (server *CTAPHIDServer) Channels() []ChannelInfo {
+	server.channelsLock.Lock()
+	channels := make([]*ctapHIDChannel, 0, len(server.channels))
+	for _, channel := range server.channels {
+		channels = append(channels, channel)
+	}
+	server.channelsLock.Unlock()
+	infos := make([]ChannelInfo, len(channels))
+	for i, channel := range channels {
+		infos[i] = channel.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
 }
 
-func (server *CTAPHIDServer) sendError(channelID ctapHIDChannelID, errorCode ctapHIDErrorCode) {
-	response := ctapHidError(channelID, errorCode)
-	server.sendResponsePackets(response)
+func (server *CTAPHIDServer) sendResponse(trace util.TraceID, channelID ctapHIDChannelID, command ctapHIDCommand, payload []byte) {
+	packets := createResponsePackets(server.packetSize, channelID, command, payload)
+	server.sendResponsePackets(trace, channelID, packets)
 }
 
-func createResponsePackets(channelId ctapHIDChannelID, command ctapHIDCommand, payload []byte) [][]byte {
-	packets := [][]byte{}
-	sequence := -1
-	for len(payload) > 0 {
-		packet := []byte{}
-		if sequence < 0 {
-			packet = append(packet, util.ToLE(channelId)...)
-			packet = append(packet, util.ToLE(command)...)
-			packet = append(packet, util.ToBE(uint16(len(payload)))...)
+// sendKeepalive sends a keepalive ahead of other responses, without waiting for the host
+func (server *CTAPHIDServer) sendKeepalive(trace util.TraceID, channelID ctapHIDChannelID, status byte) {
+	packets := createResponsePackets(server.packetSize, channelID, ctapHIDCommandKeepalive, []byte{status})
+	server.responses.pushKeepalive(trace, channelID, packets)
+}
+
+func (server *CTAPHIDServer) sendError(trace util.TraceID, channelID ctapHIDChannelID, errorCode ctapHIDErrorCode) {
+	ctapHIDLogger.WithTrace(trace).Printf("CTAPHID ERROR: %s\n\n", ctapHIDErrorCodeDescriptions[errorCode])
+	response := ctapHidError(server.packetSize, channelID, errorCode)
+	server.sendResponsePackets(trace, channelID, response)
+}
+
+func createResponsePackets(packetSize int, channelId ctapHIDChannelID, command ctapHIDCommand, payload []byte) [][]byte {
+	if len(payload) == 0 {
+		return [][]byte{}
+	}
+	initPayloadSize := packetSize - ctapHIDInitHeaderSize
+	continuationPayloadSize := packetSize - ctapHIDContinuationHeaderSize
+	count := 1
+	if len(payload) > initPayloadSize {
+		count += (len(payload) - initPayloadSize + continuationPayloadSize - 1) / continuationPayloadSize
+	}
+	// One allocation backs every report in the message
+	reports := make([]byte, count*packetSize)
+	packets := make([][]byte, count)
+	for i := range packets {
+		packet := reports[i*packetSize : (i+1)*packetSize : (i+1)*packetSize]
+		binary.LittleEndian.PutUint32(packet, uint32(channelId))
+		var data []byte
+		if i == 0 {
+			packet[4] = uint8(command)
+			binary.BigEndian.PutUint16(packet[5:7], uint16(len(payload)))
+			data = packet[ctapHIDInitHeaderSize:]
 		} else {
-			packet = append(packet, util.ToLE(channelId)...)
-			packet = append(packet, byte(uint8(sequence)))
-		}
-		sequence++
-		bytesLeft := ctapHIDMaxPacketSize - len(packet)
-		if bytesLeft > len(payload) {
-			bytesLeft = len(payload)
+			packet[4] = uint8(i - 1)
+			data = packet[ctapHIDContinuationHeaderSize:]
 		}
-		packet = append(packet, payload[:bytesLeft]...)
-		payload = payload[bytesLeft:]
-		packet = util.Pad(packet, ctapHIDMaxPacketSize)
-		packets = append(packets, packet)
+		payload = payload[copy(data, payload):]
+		packets[i] = packet
 	}
 	return packets
 }
@@ -2,7 +2,9 @@ package ctap_hid
 
 import (
 	"bytes"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/crypto"
 	"github.com/bulwarkid/virtual-fido/util"
@@ -42,3 +44,346 @@ func TestOpenChannel(t *testing.T) {
 	server.SetResponseHandler(responseHandler)
 	server.HandleMessage(initializationMessage)
 }
+
+func TestInvalidBroadcastCommand(t *testing.T) {
+	dummyCTAP := dummyHandler{}
+	dummyU2F := dummyHandler{}
+	server := NewCTAPHIDServer(&dummyCTAP, &dummyU2F)
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandWink)}, util.ToBE[uint16](0)))
+	server.HandleMessage(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](2), []byte{1, 2}))
+	server.HandleMessage([]byte{1, 2})
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 error responses, got %d", len(responses))
+	}
+	expectedErrors := []ctapHIDErrorCode{ctapHIDErrorInvalidCommand, ctapHIDErrorInvalidLength}
+	for i, response := range responses {
+		if ctapHIDCommand(response[4]) != ctapHIDCommandError || ctapHIDErrorCode(response[7]) != expectedErrors[i] {
+			t.Fatalf("Incorrect error response: %#v", response)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	if server.MaxMessageSize() != MaxMessageSize {
+		t.Fatalf("Default max message size should fill 128 continuation packets, got %d", server.MaxMessageSize())
+	}
+	server.SetMaxMessageSize(1 << 20)
+	if server.MaxMessageSize() != MaxMessageSize {
+		t.Fatalf("Max message size should be capped by the packets, got %d", server.MaxMessageSize())
+	}
+	server.SetMaxMessageSize(1024)
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandPing)}, util.ToBE[uint16](1024), make([]byte, 57)))
+	if len(responses) != 0 {
+		t.Fatalf("Message within the limit should not be rejected")
+	}
+	server.HandleMessage(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandCancel)}))
+	server.HandleMessage(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandPing)}, util.ToBE[uint16](1025), make([]byte, 57)))
+	if len(responses) != 1 || ctapHIDCommand(responses[0][4]) != ctapHIDCommandError || ctapHIDErrorCode(responses[0][7]) != ctapHIDErrorInvalidLength {
+		t.Fatalf("Oversized message should be answered with ERR_INVALID_LEN: %#v", responses)
+	}
+}
+
+func FuzzHIDPacket(f *testing.F) {
+	initPacket := util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](8), make([]byte, 8))
+	f.Add(util.Pad(initPacket, ctapHIDMaxPacketSize))
+	pingPacket := util.Concat(util.ToLE[ctapHIDChannelID](1), []byte{byte(ctapHIDCommandPing)}, util.ToBE[uint16](100), make([]byte, 57))
+	continuationPacket := util.Concat(util.ToLE[ctapHIDChannelID](1), []byte{0}, make([]byte, 59))
+	f.Add(util.Concat(util.Pad(initPacket, ctapHIDMaxPacketSize), pingPacket, continuationPacket))
+	cborPacket := util.Concat(util.ToLE[ctapHIDChannelID](1), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{4})
+	f.Add(util.Concat(util.Pad(initPacket, ctapHIDMaxPacketSize), util.Pad(cborPacket, ctapHIDMaxPacketSize)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+		server.SetResponseHandler(func(response []byte) {
+			if len(response) != ctapHIDMaxPacketSize {
+				t.Fatalf("Response packet has incorrect size: %d", len(response))
+			}
+		})
+		for len(data) > 0 {
+			packetLength := ctapHIDMaxPacketSize
+			if packetLength > len(data) {
+				packetLength = len(data)
+			}
+			server.HandleMessage(data[:packetLength])
+			data = data[packetLength:]
+		}
+	})
+}
+
+type statusHandler struct {
+	status byte
+}
+
+func (handler *statusHandler) HandleMessage(data []byte) []byte {
+	return []byte{handler.status, 0xA0}
+}
+
+func TestRecordReplaySession(t *testing.T) {
+	output := &bytes.Buffer{}
+	server := NewCTAPHIDServer(&statusHandler{status: 0}, &dummyHandler{})
+	server.SetResponseHandler(func(response []byte) {})
+	server.SetSessionRecorder(NewSessionRecorder(output))
+	initPacket := util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](8), make([]byte, 8))
+	cborPacket := util.Concat(util.ToLE[ctapHIDChannelID](1), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{4})
+	server.HandleMessage(util.Pad(initPacket, ctapHIDMaxPacketSize))
+	server.HandleMessage(util.Pad(cborPacket, ctapHIDMaxPacketSize))
+
+	events, err := ReadSession(output)
+	if err != nil {
+		t.Fatalf("Could not read session: %s", err)
+	}
+	messages := 0
+	for _, event := range events {
+		if event.Type == SessionEventMessage {
+			messages++
+		}
+	}
+	if messages != 1 {
+		t.Fatalf("Expected 1 recorded message, got %d", messages)
+	}
+
+	replayServer := NewCTAPHIDServer(&statusHandler{status: 0}, &dummyHandler{})
+	if mismatches := ReplaySession(replayServer, events); len(mismatches) != 0 {
+		t.Fatalf("Replay should match recording: %v", mismatches)
+	}
+	failingServer := NewCTAPHIDServer(&statusHandler{status: 0x27}, &dummyHandler{})
+	if mismatches := ReplaySession(failingServer, events); len(mismatches) != 1 {
+		t.Fatalf("Replay with a different status should mismatch: %v", mismatches)
+	}
+}
+
+func TestWorkerPoolKeepsPacketOrder(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	pool := util.NewWorkerPool(DefaultWorkers, DefaultChannelQueueLength)
+	defer pool.Stop()
+	server.SetWorkerPool(pool)
+	responses := make(chan []byte, 16)
+	server.SetResponseHandler(func(response []byte) {
+		responses <- response
+	})
+	initPacket := util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](8), make([]byte, 8))
+	server.HandleMessage(util.Pad(initPacket, ctapHIDMaxPacketSize))
+	<-responses
+
+	payload := crypto.RandomBytes(57 + 59*3)
+	packets := createResponsePackets(ctapHIDMaxPacketSize, 1, ctapHIDCommandPing, payload)
+	for _, packet := range packets {
+		server.HandleMessage(packet)
+	}
+	echoed := []byte{}
+	for range packets {
+		response := <-responses
+		if len(echoed) == 0 {
+			echoed = append(echoed, response[7:]...)
+		} else {
+			echoed = append(echoed, response[5:]...)
+		}
+	}
+	if !bytes.Equal(echoed[:len(payload)], payload) {
+		t.Fatalf("Ping through the worker pool should echo the payload in order")
+	}
+}
+
+func TestCreateResponsePackets(t *testing.T) {
+	for _, packetSize := range []int{ctapHIDMaxPacketSize, 512} {
+		initPayloadSize := packetSize - ctapHIDInitHeaderSize
+		for _, length := range []int{1, initPayloadSize, initPayloadSize + 1, int(maxMessageSize(packetSize))} {
+			payload := crypto.RandomBytes(length)
+			packets := createResponsePackets(packetSize, 1, ctapHIDCommandCBOR, payload)
+			transaction := newCTAPHIDTransaction(0, packets[0], maxMessageSize(packetSize))
+			for _, packet := range packets[1:] {
+				if len(packet) != packetSize {
+					t.Fatalf("Packet has incorrect size: %d", len(packet))
+				}
+				transaction.addMessage(packet)
+			}
+			if !transaction.done || !bytes.Equal(transaction.result.payload, payload) {
+				t.Fatalf("Packets for a %d byte payload don't reassemble with %d byte packets", length, packetSize)
+			}
+		}
+	}
+}
+
+type hungHandler struct {
+	release chan struct{}
+}
+
+func (handler *hungHandler) HandleMessage(data []byte) []byte {
+	<-handler.release
+	return []byte{0}
+}
+
+func TestWatchdog(t *testing.T) {
+	handler := &hungHandler{release: make(chan struct{})}
+	defer close(handler.release)
+	server := NewCTAPHIDServer(handler, handler)
+	server.SetWatchdog(util.NewWatchdog(100 * time.Millisecond))
+	var lock sync.Mutex
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		responses = append(responses, response)
+	})
+	server.newChannel()
+	server.HandleMessage(util.Concat(util.ToLE[ctapHIDChannelID](1), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{4}))
+	lock.Lock()
+	defer lock.Unlock()
+	last := responses[len(responses)-1]
+	if ctapHIDCommand(last[4]) != ctapHIDCommandError || ctapHIDErrorCode(last[7]) != ctapHIDErrorOther {
+		t.Fatalf("Hung request should be failed with ERR_OTHER: %#v", last)
+	}
+	for _, response := range responses[:len(responses)-1] {
+		if ctapHIDCommand(response[4]) != ctapHIDCommandKeepalive {
+			t.Fatalf("Only keepalives should be sent before the error: %#v", response)
+		}
+	}
+}
+
+type tracedHandler struct {
+	trace util.TraceID
+}
+
+func (handler *tracedHandler) HandleMessage(data []byte) []byte {
+	return []byte{0}
+}
+
+func (handler *tracedHandler) HandleTracedMessage(trace util.TraceID, data []byte) []byte {
+	handler.trace = trace
+	return []byte{0}
+}
+
+func TestTracePropagation(t *testing.T) {
+	handler := &tracedHandler{}
+	server := NewCTAPHIDServer(handler, &dummyHandler{})
+	traces := []util.TraceID{}
+	server.SetTracedResponseHandler(func(trace util.TraceID, response []byte) {
+		traces = append(traces, trace)
+	})
+	server.newChannel()
+	// A request split over two packets keeps the trace of the first
+	payload := append([]byte{4}, make([]byte, 80)...)
+	packets := createResponsePackets(ctapHIDMaxPacketSize, 1, ctapHIDCommandCBOR, payload)
+	server.HandleTracedMessage(7, packets[0])
+	server.HandleTracedMessage(8, packets[1])
+	if handler.trace != 7 {
+		t.Fatalf("Handler should get the trace of the initialization packet, got %s", handler.trace)
+	}
+	if len(traces) == 0 {
+		t.Fatalf("No response was sent")
+	}
+	for _, trace := range traces {
+		if trace != 7 {
+			t.Fatalf("Responses should carry the trace of the request, got %s", trace)
+		}
+	}
+}
+
+func TestWorkerPoolRejectsUnknownChannel(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	// Without workers anything that reaches the pool stays queued
+	pool := util.NewWorkerPool(0, DefaultChannelQueueLength)
+	defer pool.Stop()
+	server.SetWorkerPool(pool)
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE[ctapHIDChannelID](5), []byte{byte(ctapHIDCommandPing)}, util.ToBE[uint16](0)), ctapHIDMaxPacketSize))
+	if len(responses) != 1 || ctapHIDCommand(responses[0][4]) != ctapHIDCommandError || ctapHIDErrorCode(responses[0][7]) != ctapHIDErrorInvalidChannel {
+		t.Fatalf("Unknown channel should be answered without queueing: %#v", responses)
+	}
+}
+
+func TestWorkerPoolShedsLoad(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	pool := util.NewWorkerPool(0, DefaultChannelQueueLength)
+	defer pool.Stop()
+	pool.SetTotalQueueLength(2)
+	server.SetWorkerPool(pool)
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	initPacket := util.Pad(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](8), make([]byte, 8)), ctapHIDMaxPacketSize)
+	for i := 0; i < 3; i++ {
+		server.HandleMessage(initPacket)
+	}
+	if len(responses) != 1 || ctapHIDCommand(responses[0][4]) != ctapHIDCommandError || ctapHIDErrorCode(responses[0][7]) != ctapHIDErrorChannelBusy {
+		t.Fatalf("Packets past the pool's queue should be answered with ERR_CHANNEL_BUSY: %#v", responses)
+	}
+}
+
+func TestWorkerPoolInitDuringApproval(t *testing.T) {
+	handler := &hungHandler{release: make(chan struct{})}
+	defer close(handler.release)
+	server := NewCTAPHIDServer(handler, handler)
+	pool := util.NewWorkerPool(DefaultWorkers, DefaultChannelQueueLength)
+	defer pool.Stop()
+	server.SetWorkerPool(pool)
+	inits := make(chan []byte, 1)
+	server.SetResponseHandler(func(response []byte) {
+		if ctapHIDCommand(response[4]) == ctapHIDCommandInit {
+			inits <- response
+		}
+	})
+	// More requests waiting on the user than there are workers
+	for i := 0; i < DefaultWorkers+1; i++ {
+		channel := server.newChannel()
+		server.HandleMessage(util.Pad(util.Concat(util.ToLE(channel.channelId), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{4}), ctapHIDMaxPacketSize))
+	}
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](8), make([]byte, 8)), ctapHIDMaxPacketSize))
+	select {
+	case <-inits:
+	case <-time.After(time.Second):
+		t.Fatalf("INIT should be answered while requests wait on the user")
+	}
+}
+
+func TestAssertionRateLimit(t *testing.T) {
+	server := NewCTAPHIDServer(&statusHandler{status: 0}, &statusHandler{status: 0x90})
+	server.SetAssertionRateLimit(util.RateLimit{Requests: 1, Per: time.Hour})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	send := func(channel ctapHIDChannelID, command ctapHIDCommand, payload []byte) []byte {
+		responses = nil
+		packet := util.Concat(util.ToLE(channel), []byte{byte(command)}, util.ToBE(uint16(len(payload))), payload)
+		server.HandleMessage(util.Pad(packet, ctapHIDMaxPacketSize))
+		return responses[len(responses)-1]
+	}
+	for range []int{1, 2} {
+		send(ctapHIDBroadcastChannel, ctapHIDCommandInit, make([]byte, 8))
+	}
+	getAssertion := []byte{ctapCommandGetAssertion, 0xA0}
+	checkOnly := []byte{0, u2fInsAuthenticate, u2fAuthCheckOnly, 0}
+	isBusy := func(response []byte) bool {
+		return ctapHIDCommand(response[4]) == ctapHIDCommandError && ctapHIDErrorCode(response[7]) == ctapHIDErrorChannelBusy
+	}
+
+	if isBusy(send(1, ctapHIDCommandCBOR, getAssertion)) {
+		t.Fatalf("The first assertion should be allowed")
+	}
+	if !isBusy(send(1, ctapHIDCommandCBOR, getAssertion)) {
+		t.Fatalf("Assertions past the limit should be refused")
+	}
+	if isBusy(send(1, ctapHIDCommandCBOR, []byte{0x04})) || isBusy(send(1, ctapHIDCommandMsg, checkOnly)) {
+		t.Fatalf("Other commands and U2F check-only requests shouldn't be limited")
+	}
+	if !isBusy(send(2, ctapHIDCommandCBOR, getAssertion)) {
+		t.Fatalf("Channels should share the limit")
+	}
+	send(ctapHIDBroadcastChannel, ctapHIDCommandInit, make([]byte, 8))
+	if !isBusy(send(3, ctapHIDCommandCBOR, getAssertion)) {
+		t.Fatalf("A new channel shouldn't reset the limit")
+	}
+}
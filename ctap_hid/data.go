@@ -6,10 +6,33 @@ import (
 
 const (
 	ctapHIDMaxPacketSize int = 64
+	// Channel, command and payload length of an initialization packet
+	ctapHIDInitHeaderSize int = 7
+	// Channel and sequence number of a continuation packet
+	ctapHIDContinuationHeaderSize int = 5
+	// Largest message with 64 byte packets
+	MaxMessageSize uint32 = uint32(ctapHIDMaxPacketSize - ctapHIDInitHeaderSize + 128*(ctapHIDMaxPacketSize-ctapHIDContinuationHeaderSize))
 )
 
+// An initialization packet followed by all 128 continuation packets, as far as the
+// 16 bit payload length allows
+func maxMessageSize(packetSize int) uint32 {
+	size := uint32(packetSize - ctapHIDInitHeaderSize + 128*(packetSize-ctapHIDContinuationHeaderSize))
+	if size > 0xFFFF {
+		return 0xFFFF
+	}
+	return size
+}
+
 const ctapHIDStatusUpneeded uint8 = 2
 
+// The parts of CTAP2 and U2F requests needed to tell assertions apart, see isAssertion
+const (
+	ctapCommandGetAssertion byte = 0x02
+	u2fInsAuthenticate      byte = 0x02
+	u2fAuthCheckOnly        byte = 0x07
+)
+
 type ctapHIDChannelID uint32
 
 const (
@@ -69,9 +92,8 @@ var ctapHIDErrorCodeDescriptions = map[ctapHIDErrorCode]string{
 	ctapHIDErrorOther:            "ctapHIDErrOther",
 }
 
-func ctapHidError(channelId ctapHIDChannelID, err ctapHIDErrorCode) [][]byte {
-	ctapHIDLogger.Printf("CTAPHID ERROR: %s\n\n", ctapHIDErrorCodeDescriptions[err])
-	return createResponsePackets(channelId, ctapHIDCommandError, []byte{byte(err)})
+func ctapHidError(packetSize int, channelId ctapHIDChannelID, err ctapHIDErrorCode) [][]byte {
+	return createResponsePackets(packetSize, channelId, ctapHIDCommandError, []byte{byte(err)})
 }
 
 type ctapHIDCapabilityFlag uint8
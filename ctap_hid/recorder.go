@@ -0,0 +1,233 @@
+package ctap_hid
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type SessionEventType string
+
+const (
+	// Raw packet from the host to the device
+	SessionEventPacketOut SessionEventType = "packet_out"
+	// Raw packet from the device to the host
+	SessionEventPacketIn SessionEventType = "packet_in"
+	// A reassembled CTAPHID_MSG or CTAPHID_CBOR request and its response
+	SessionEventMessage SessionEventType = "message"
+)
+
+type SessionEvent struct {
+	Time      time.Time        `json:"time"`
+	Type      SessionEventType `json:"type"`
+	Packet    []byte           `json:"packet,omitempty"`
+	ChannelID uint32           `json:"channel_id,omitempty"`
+	Command   string           `json:"command,omitempty"`
+	Request   []byte           `json:"request,omitempty"`
+	Response  []byte           `json:"response,omitempty"`
+	// Trace of the request the packet or message belongs to
+	TraceID util.TraceID `json:"trace_id,omitempty"`
+	// CBOR requests and responses decoded for reading, with byte strings as hex
+	DecodedRequest  interface{} `json:"decoded_request,omitempty"`
+	DecodedResponse interface{} `json:"decoded_response,omitempty"`
+}
+
+// SessionRecorder writes every packet and message handled by a CTAPHIDServer
+// as JSON lines, which can be fed back through a server with ReplaySession
+type SessionRecorder struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	onEvent func(event SessionEvent)
+}
+
+// NewSessionRecorder writes events to output. It can be nil if events are only passed to a
+// listener set with OnEvent.
+func NewSessionRecorder(output io.Writer) *SessionRecorder {
+	recorder := &SessionRecorder{}
+	if output != nil {
+		recorder.encoder = json.NewEncoder(output)
+	}
+	return recorder
+}
+
+// OnEvent passes every event to listener as it's recorded, e.g. to stream it. The listener
+// runs while the server handles the packet, so it must not block.
+func (recorder *SessionRecorder) OnEvent(listener func(event SessionEvent)) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.onEvent = listener
+}
+
+func (recorder *SessionRecorder) record(event SessionEvent) {
+	if recorder == nil {
+		return
+	}
+	event.Time = util.Now().UTC()
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if recorder.encoder != nil {
+		err := recorder.encoder.Encode(event)
+		if err != nil {
+			ctapHIDLogger.Printf("ERROR: Could not record session event: %s\n\n", err)
+		}
+	}
+	if recorder.onEvent != nil {
+		recorder.onEvent(event)
+	}
+}
+
+func (recorder *SessionRecorder) recordPacket(trace util.TraceID, eventType SessionEventType, packet []byte) {
+	if recorder == nil {
+		return
+	}
+	recorder.record(SessionEvent{Type: eventType, Packet: packet, TraceID: trace})
+}
+
+func (recorder *SessionRecorder) recordMessage(trace util.TraceID, channelID ctapHIDChannelID, command ctapHIDCommand, request []byte, response []byte) {
+	if recorder == nil {
+		return
+	}
+	event := SessionEvent{
+		Type:      SessionEventMessage,
+		ChannelID: uint32(channelID),
+		Command:   ctapHIDCommandDescriptions[command],
+		Request:   request,
+		Response:  response,
+		TraceID:   trace,
+	}
+	if command == ctapHIDCommandCBOR {
+		event.DecodedRequest = decodeCTAPPayload(request)
+		event.DecodedResponse = decodeCTAPPayload(response)
+	}
+	recorder.record(event)
+}
+
+// CTAP payloads are a command or status byte followed by optional CBOR
+func decodeCTAPPayload(payload []byte) interface{} {
+	if len(payload) == 0 {
+		return nil
+	}
+	decoded := map[string]interface{}{"code": payload[0]}
+	if len(payload) > 1 {
+		var body interface{}
+		if err := cbor.Unmarshal(payload[1:], &body); err == nil {
+			decoded["body"] = readableCBOR(body)
+		}
+	}
+	return decoded
+}
+
+func readableCBOR(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = readableCBOR(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = readableCBOR(item)
+		}
+		return result
+	case []byte:
+		return hex.EncodeToString(v)
+	default:
+		return v
+	}
+}
+
+func ReadSession(input io.Reader) ([]SessionEvent, error) {
+	events := make([]SessionEvent, 0)
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event SessionEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode session event %d: %w", len(events)+1, err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read session: %w", err)
+	}
+	return events, nil
+}
+
+type ReplayMismatch struct {
+	Index    int
+	Command  string
+	Expected []byte
+	Actual   []byte
+}
+
+func (mismatch ReplayMismatch) String() string {
+	return fmt.Sprintf("Message %d (%s): expected status %x, got %x", mismatch.Index, mismatch.Command, mismatch.Expected, mismatch.Actual)
+}
+
+// Signatures, credential IDs and keys differ between runs, so replays compare
+// only the CTAP status byte or U2F status word of each response
+func responseStatus(command string, response []byte) []byte {
+	if len(response) == 0 {
+		return nil
+	}
+	if command == ctapHIDCommandDescriptions[ctapHIDCommandMsg] {
+		if len(response) < 2 {
+			return response
+		}
+		return response[len(response)-2:]
+	}
+	return response[:1]
+}
+
+// ReplaySession feeds the recorded host packets through server and compares the
+// resulting messages with the recording. The server should start in the same
+// state as the recorded device (e.g. a copy of the same vault).
+func ReplaySession(server *CTAPHIDServer, events []SessionEvent) []ReplayMismatch {
+	recorded := make([]SessionEvent, 0)
+	for _, event := range events {
+		if event.Type == SessionEventMessage {
+			recorded = append(recorded, event)
+		}
+	}
+	// Messages are handled synchronously, so the events arrive in order
+	replayed := make([]SessionEvent, 0)
+	previousRecorder := server.recorder
+	server.recorder = &SessionRecorder{
+		onEvent: func(event SessionEvent) {
+			if event.Type == SessionEventMessage {
+				replayed = append(replayed, event)
+			}
+		},
+	}
+	defer func() { server.recorder = previousRecorder }()
+	for _, event := range events {
+		if event.Type == SessionEventPacketOut {
+			server.HandleMessage(event.Packet)
+		}
+	}
+	mismatches := make([]ReplayMismatch, 0)
+	for i, expected := range recorded {
+		var actual []byte
+		if i < len(replayed) {
+			actual = responseStatus(replayed[i].Command, replayed[i].Response)
+		}
+		expectedStatus := responseStatus(expected.Command, expected.Response)
+		if string(expectedStatus) != string(actual) {
+			mismatches = append(mismatches, ReplayMismatch{Index: i, Command: expected.Command, Expected: expectedStatus, Actual: actual})
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,166 @@
+package ctap_hid
+
+import (
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// Packets a channel may have waiting for the host, two maximum-size messages
+const DefaultResponseQueueLength = 2 * 129
+
+type queuedResponse struct {
+	trace   util.TraceID
+	packets [][]byte
+	sent    bool
+}
+
+// responseQueue orders responses for the interrupt IN endpoint. Each message is delivered
+// whole, so fragments of different messages never interleave, keepalives go before any
+// other message, and channels take turns so a large response doesn't hold up the others.
+// A channel with more than maxPackets waiting blocks until the host catches up, and a
+// channel only keeps its latest keepalive. Whoever queues a message while nothing is
+// being delivered delivers until the queue is empty, so the handler is never called
+// concurrently and a push returns once its message has been handed to the handler.
+type responseQueue struct {
+	lock       sync.Mutex
+	changed    *sync.Cond
+	delivering bool
+	maxPackets int
+	keepalives map[ctapHIDChannelID]*queuedResponse
+	// Channels with a keepalive, oldest first
+	keepaliveOrder []ctapHIDChannelID
+	messages       map[ctapHIDChannelID][]*queuedResponse
+	queuedPackets  map[ctapHIDChannelID]int
+	// Channels with messages, in the order they get their turn
+	channelOrder []ctapHIDChannelID
+	deliver      func(trace util.TraceID, packets [][]byte)
+}
+
+func newResponseQueue(maxPackets int, deliver func(trace util.TraceID, packets [][]byte)) *responseQueue {
+	queue := &responseQueue{
+		maxPackets:    maxPackets,
+		keepalives:    make(map[ctapHIDChannelID]*queuedResponse),
+		messages:      make(map[ctapHIDChannelID][]*queuedResponse),
+		queuedPackets: make(map[ctapHIDChannelID]int),
+		deliver:       deliver,
+	}
+	queue.changed = sync.NewCond(&queue.lock)
+	return queue
+}
+
+func (queue *responseQueue) setMaxPackets(maxPackets int) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.maxPackets = maxPackets
+	queue.changed.Broadcast()
+}
+
+// push queues a message for channelID. Messages larger than the limit are still taken
+// once the channel has nothing else waiting.
+func (queue *responseQueue) push(trace util.TraceID, channelID ctapHIDChannelID, packets [][]byte) {
+	if len(packets) == 0 {
+		return
+	}
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for queue.queuedPackets[channelID] > 0 && queue.queuedPackets[channelID]+len(packets) > queue.maxPackets {
+		queue.changed.Wait()
+	}
+	response := &queuedResponse{trace: trace, packets: packets}
+	if len(queue.messages[channelID]) == 0 {
+		queue.channelOrder = append(queue.channelOrder, channelID)
+	}
+	queue.messages[channelID] = append(queue.messages[channelID], response)
+	queue.queuedPackets[channelID] += len(packets)
+	queue.flush(response)
+}
+
+// offer is push, except it drops the message and returns false instead of waiting if the
+// channel has too much waiting already
+func (queue *responseQueue) offer(trace util.TraceID, channelID ctapHIDChannelID, packets [][]byte) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.queuedPackets[channelID] > 0 && queue.queuedPackets[channelID]+len(packets) > queue.maxPackets {
+		return false
+	}
+	response := &queuedResponse{trace: trace, packets: packets}
+	if len(queue.messages[channelID]) == 0 {
+		queue.channelOrder = append(queue.channelOrder, channelID)
+	}
+	queue.messages[channelID] = append(queue.messages[channelID], response)
+	queue.queuedPackets[channelID] += len(packets)
+	queue.flush(response)
+	return true
+}
+
+// pushKeepalive queues a keepalive for channelID ahead of other messages, replacing one
+// that's still waiting. It doesn't wait for the keepalive to be delivered.
+func (queue *responseQueue) pushKeepalive(trace util.TraceID, channelID ctapHIDChannelID, packets [][]byte) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if pending, ok := queue.keepalives[channelID]; ok {
+		pending.trace = trace
+		pending.packets = packets
+		return
+	}
+	queue.keepalives[channelID] = &queuedResponse{trace: trace, packets: packets}
+	queue.keepaliveOrder = append(queue.keepaliveOrder, channelID)
+	queue.flush(nil)
+}
+
+// flush delivers until the queue is empty, unless someone else already is, and then waits
+// for response, if any, to be delivered. It's called with the lock held.
+func (queue *responseQueue) flush(response *queuedResponse) {
+	if queue.delivering {
+		for response != nil && !response.sent {
+			queue.changed.Wait()
+		}
+		return
+	}
+	queue.delivering = true
+	for {
+		next, channelID, keepalive := queue.next()
+		if next == nil {
+			break
+		}
+		queue.lock.Unlock()
+		queue.deliver(next.trace, next.packets)
+		queue.lock.Lock()
+		next.sent = true
+		if !keepalive {
+			queue.queuedPackets[channelID] -= len(next.packets)
+			if queue.queuedPackets[channelID] == 0 {
+				delete(queue.queuedPackets, channelID)
+			}
+		}
+		queue.changed.Broadcast()
+	}
+	queue.delivering = false
+}
+
+// next takes the response to deliver next, keepalives first and then one message of the
+// channel whose turn it is. It's called with the lock held.
+func (queue *responseQueue) next() (*queuedResponse, ctapHIDChannelID, bool) {
+	if len(queue.keepaliveOrder) > 0 {
+		channelID := queue.keepaliveOrder[0]
+		queue.keepaliveOrder = queue.keepaliveOrder[1:]
+		response := queue.keepalives[channelID]
+		delete(queue.keepalives, channelID)
+		return response, channelID, true
+	}
+	if len(queue.channelOrder) == 0 {
+		return nil, 0, false
+	}
+	channelID := queue.channelOrder[0]
+	queue.channelOrder = queue.channelOrder[1:]
+	messages := queue.messages[channelID]
+	response := messages[0]
+	if len(messages) > 1 {
+		queue.messages[channelID] = messages[1:]
+		queue.channelOrder = append(queue.channelOrder, channelID)
+	} else {
+		delete(queue.messages, channelID)
+	}
+	return response, channelID, false
+}
@@ -0,0 +1,128 @@
+package ctap_hid
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// blockingDelivery records delivered messages by trace, each waiting for a release
+type blockingDelivery struct {
+	started   chan util.TraceID
+	release   chan struct{}
+	delivered chan util.TraceID
+}
+
+func newBlockingDelivery() *blockingDelivery {
+	return &blockingDelivery{
+		started:   make(chan util.TraceID, 16),
+		release:   make(chan struct{}, 16),
+		delivered: make(chan util.TraceID, 16),
+	}
+}
+
+func (delivery *blockingDelivery) deliver(trace util.TraceID, packets [][]byte) {
+	delivery.started <- trace
+	<-delivery.release
+	delivery.delivered <- trace
+}
+
+// waitUntilQueued waits for a push made on another goroutine to leave channelID with
+// messages waiting, and keepalives channels with a keepalive
+func waitUntilQueued(queue *responseQueue, channelID ctapHIDChannelID, messages int, keepalives int) {
+	for {
+		queue.lock.Lock()
+		queued := len(queue.messages[channelID]) == messages && len(queue.keepaliveOrder) == keepalives
+		queue.lock.Unlock()
+		if queued {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResponseQueuePriority(t *testing.T) {
+	delivery := newBlockingDelivery()
+	queue := newResponseQueue(DefaultResponseQueueLength, delivery.deliver)
+	packets := [][]byte{{1}, {2}}
+	go queue.push(1, 1, packets)
+	test.AssertEqual(t, <-delivery.started, util.TraceID(1), "First message should be delivered right away")
+
+	go queue.push(2, 2, packets)
+	waitUntilQueued(queue, 2, 1, 0)
+	go queue.push(3, 2, packets)
+	waitUntilQueued(queue, 2, 2, 0)
+	go queue.push(4, 3, packets)
+	waitUntilQueued(queue, 3, 1, 0)
+	queue.pushKeepalive(5, 1, packets)
+	queue.pushKeepalive(6, 1, packets)
+	waitUntilQueued(queue, 3, 1, 1)
+
+	for i := 0; i < 4; i++ {
+		delivery.release <- struct{}{}
+	}
+	order := []util.TraceID{}
+	for i := 0; i < 4; i++ {
+		order = append(order, <-delivery.delivered)
+	}
+	// Channel 2's second message waits for channel 3's turn
+	test.AssertArrEqual(t, order, []util.TraceID{1, 6, 2, 4}, "Keepalives should go first, then channels take turns")
+	delivery.release <- struct{}{}
+	test.AssertEqual(t, <-delivery.delivered, util.TraceID(3), "Last message should be delivered")
+}
+
+func TestResponseQueueBound(t *testing.T) {
+	delivery := newBlockingDelivery()
+	queue := newResponseQueue(3, delivery.deliver)
+	go queue.push(1, 1, [][]byte{{1}, {2}})
+	<-delivery.started
+	pushed := make(chan struct{})
+	go func() {
+		queue.push(2, 1, [][]byte{{1}, {2}})
+		close(pushed)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	queue.lock.Lock()
+	test.AssertEqual(t, len(queue.messages[1]), 0, "Push past the limit should wait")
+	queue.lock.Unlock()
+	delivery.release <- struct{}{}
+	delivery.release <- struct{}{}
+	<-pushed
+	test.AssertEqual(t, <-delivery.delivered, util.TraceID(1), "First message should be delivered first")
+	test.AssertEqual(t, <-delivery.delivered, util.TraceID(2), "Waiting message should be delivered once there's room")
+}
+
+func TestConcurrentResponsesDontInterleave(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	packets := make(chan []byte, 64)
+	server.SetResponseHandler(func(response []byte) {
+		time.Sleep(time.Millisecond)
+		packets <- response
+	})
+	server.newChannel()
+	server.newChannel()
+	done := make(chan struct{}, 2)
+	for _, channelID := range []ctapHIDChannelID{1, 2} {
+		go func(channelID ctapHIDChannelID) {
+			for _, packet := range createResponsePackets(ctapHIDMaxPacketSize, channelID, ctapHIDCommandPing, make([]byte, 500)) {
+				server.HandleMessage(packet)
+			}
+			done <- struct{}{}
+		}(channelID)
+	}
+	<-done
+	<-done
+	close(packets)
+	var channelID ctapHIDChannelID
+	for packet := range packets {
+		packetChannel := util.ReadLE[ctapHIDChannelID](bytes.NewBuffer(packet))
+		if packet[4]&0x80 != 0 {
+			channelID = packetChannel
+		} else if packetChannel != channelID {
+			t.Fatalf("Continuation packet of channel %d interleaved with channel %d's message", packetChannel, channelID)
+		}
+	}
+}
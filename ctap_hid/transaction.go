@@ -14,20 +14,27 @@ type transactionResult struct {
 
 // Combines either single messages or multiple messages into a single command header and payload
 type ctapHIDTransaction struct {
+	// Trace of the initialization packet, kept by the continuation packets and the response
+	trace     util.TraceID
 	done      bool
 	cancelled bool
 	errorCode ctapHIDErrorCode
 	result    *transactionResult
 }
 
-func newCTAPHIDTransaction(message []byte) *ctapHIDTransaction {
-	transaction := ctapHIDTransaction{}
+// newCTAPHIDTransaction starts reassembling a message of at most maxMessageSize bytes
+func newCTAPHIDTransaction(trace util.TraceID, message []byte, maxMessageSize uint32) *ctapHIDTransaction {
+	transaction := ctapHIDTransaction{trace: trace}
 	buffer := bytes.NewBuffer(message)
 	channelId := util.ReadLE[ctapHIDChannelID](buffer)
 	command := util.ReadLE[ctapHIDCommand](buffer)
+	if command != ctapHIDCommandCancel && buffer.Len() < 2 {
+		transaction.error(ctapHIDErrorInvalidLength)
+		return &transaction
+	}
 	if command&(1<<7) == 0 {
 		// Non-command (likely a sequence number)
-		ctapHIDLogger.Printf("INVALID COMMAND: %x", command)
+		transaction.logger().Printf("INVALID COMMAND: %x", command)
 		transaction.error(ctapHIDErrorInvalidCommand)
 		return &transaction
 	}
@@ -36,6 +43,11 @@ func newCTAPHIDTransaction(message []byte) *ctapHIDTransaction {
 		return &transaction
 	}
 	payloadLength := util.ReadBE[uint16](buffer)
+	if uint32(payloadLength) > maxMessageSize {
+		transaction.logger().Printf("ERROR: Message of %d bytes is larger than %d\n\n", payloadLength, maxMessageSize)
+		transaction.error(ctapHIDErrorInvalidLength)
+		return &transaction
+	}
 	result := transactionResult{
 		header: ctapHIDMessageHeader{
 			ChannelID:     channelId,
@@ -50,7 +62,7 @@ func newCTAPHIDTransaction(message []byte) *ctapHIDTransaction {
 		transaction.result.payload = transaction.result.payload[:transaction.result.header.PayloadLength]
 		transaction.finish()
 	} else {
-		ctapHIDLogger.Printf("CTAPHID: Read %d bytes, Need %d more\n\n",
+		transaction.logger().Printf("CTAPHID: Read %d bytes, Need %d more\n\n",
 			len(transaction.result.payload),
 			int(payloadLength)-len(transaction.result.payload))
 	}
@@ -59,7 +71,7 @@ func newCTAPHIDTransaction(message []byte) *ctapHIDTransaction {
 
 func (transaction *ctapHIDTransaction) addMessage(message []byte) {
 	if transaction.done {
-		ctapHIDLogger.Printf("ERROR - MESSAGE ADDED AFTER SEQUENCE COMPLETED")
+		transaction.logger().Printf("ERROR - MESSAGE ADDED AFTER SEQUENCE COMPLETED")
 		transaction.error(ctapHIDErrorOther)
 		return
 	}
@@ -87,26 +99,30 @@ func (transaction *ctapHIDTransaction) addMessage(message []byte) {
 		transaction.finish()
 	} else {
 		// We need another followup message
-		ctapHIDLogger.Printf("CTAPHID: Read %d bytes, Need %d more\n\n",
+		transaction.logger().Printf("CTAPHID: Read %d bytes, Need %d more\n\n",
 			len(transaction.result.payload),
 			int(transaction.result.header.PayloadLength)-len(transaction.result.payload))
 		transaction.result.sequenceNumber += 1
 	}
 }
 
+func (transaction *ctapHIDTransaction) logger() util.Logger {
+	return ctapHIDLogger.WithTrace(transaction.trace)
+}
+
 func (transaction *ctapHIDTransaction) finish() {
 	transaction.done = true
 }
 
 func (transaction *ctapHIDTransaction) error(code ctapHIDErrorCode) {
-	ctapHIDLogger.Printf("CTAPHID TRANSACTION ERROR: %v\n\n", ctapHIDErrorCodeDescriptions[code])
+	transaction.logger().Printf("CTAPHID TRANSACTION ERROR: %v\n\n", ctapHIDErrorCodeDescriptions[code])
 	transaction.done = true
 	transaction.errorCode = code
 	transaction.result = nil
 }
 
 func (transaction *ctapHIDTransaction) cancel() {
-	ctapHIDLogger.Printf("CTAPHID COMMAND: CTAPHID_COMMAND_CANCEL\n\n")
+	transaction.logger().Printf("CTAPHID COMMAND: CTAPHID_COMMAND_CANCEL\n\n")
 	transaction.done = true
 	transaction.cancelled = true
 	transaction.result = nil
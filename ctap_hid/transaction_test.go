@@ -3,7 +3,7 @@ package ctap_hid
 import (
 	"testing"
 
-	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/internal/test"
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
@@ -14,7 +14,7 @@ func makeHeader(channelId ctapHIDChannelID, command uint8, payloadLength uint16)
 func TestSingleMessage(t *testing.T) {
 	payload := []byte{1, 2, 3, 4}
 	message := util.Concat(makeHeader(1, uint8(ctapHIDCommandCBOR), uint16(len(payload))), payload)
-	transaction := newCTAPHIDTransaction(message)
+	transaction := newCTAPHIDTransaction(0, message, MaxMessageSize)
 	test.Assert(t, transaction.done, "Transaction is not done")
 	result := transaction.result
 	test.AssertEqual(t, result.header.ChannelID, 1, "Channel ID is incorrect")
@@ -29,7 +29,7 @@ func TestMultipleMessages(t *testing.T) {
 	payload1 := payload[:4]
 	payload2 := payload[4:]
 	message := util.Concat(makeHeader(channelId, uint8(ctapHIDCommandCBOR), uint16(len(payload))), payload1)
-	transaction := newCTAPHIDTransaction(message)
+	transaction := newCTAPHIDTransaction(0, message, MaxMessageSize)
 	test.Assert(t, !transaction.done, "Transaction is done after one message")
 	transaction.addMessage(util.Concat(util.ToLE(channelId), []byte{0}, payload2))
 	test.Assert(t, transaction.done, "Transaction is not done")
@@ -39,3 +39,31 @@ func TestMultipleMessages(t *testing.T) {
 	test.AssertEqual(t, result.header.PayloadLength, uint16(len(payload1)+len(payload2)), "Payload length is incorrect")
 	test.AssertArrEqual(t, result.payload, payload, "Payload is incorrect")
 }
+
+func TestOversizedMessage(t *testing.T) {
+	message := util.Concat(makeHeader(1, uint8(ctapHIDCommandCBOR), 1025), []byte{1, 2, 3, 4})
+	transaction := newCTAPHIDTransaction(0, message, 1024)
+	test.Assert(t, transaction.done, "Oversized transaction should end immediately")
+	test.AssertEqual(t, transaction.errorCode, ctapHIDErrorInvalidLength, "Oversized message should be an invalid length")
+}
+
+func BenchmarkCreateResponsePackets(b *testing.B) {
+	payload := make([]byte, 1024)
+	for i := 0; i < b.N; i++ {
+		createResponsePackets(64, 1, ctapHIDCommandCBOR, payload)
+	}
+}
+
+func BenchmarkTransactionReassembly(b *testing.B) {
+	packets := createResponsePackets(64, 1, ctapHIDCommandCBOR, make([]byte, 1024))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transaction := newCTAPHIDTransaction(0, packets[0], MaxMessageSize)
+		for _, packet := range packets[1:] {
+			transaction.addMessage(packet)
+		}
+		if !transaction.done {
+			b.Fatal("Transaction is not done")
+		}
+	}
+}
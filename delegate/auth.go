@@ -0,0 +1,124 @@
+package delegate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	handshakeNonceLength = 32
+	handshakeTimeout     = 10 * time.Second
+	proofLabelDelegate   = "virtual-fido delegate"
+	proofLabelFrontEnd   = "virtual-fido delegate front-end"
+)
+
+// Listen listens on a Unix socket at path that only this user can connect to, replacing a
+// socket left behind by an earlier delegate
+func Listen(path string) (net.Listener, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Could not restrict delegate socket: %w", err)
+	}
+	return listener, nil
+}
+
+func handshakeProof(secret []byte, label string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// secretCredentials lets a connection through once both sides have proven they know the
+// secret, without sending it. The connection isn't encrypted, so it has to stay on the host.
+type secretCredentials struct {
+	secret []byte
+}
+
+type secretAuthInfo struct {
+	credentials.CommonAuthInfo
+}
+
+func (secretAuthInfo) AuthType() string {
+	return "virtual-fido-secret"
+}
+
+func newSecretCredentials(secret []byte) credentials.TransportCredentials {
+	return &secretCredentials{secret: secret}
+}
+
+// ClientHandshake sends a nonce, checks the delegate's proof for it, then proves itself for
+// the delegate's nonce
+func (creds *secretCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	nonce := crypto.RandomBytes(handshakeNonceLength)
+	if _, err := conn.Write(nonce); err != nil {
+		return nil, nil, err
+	}
+	delegateHello := make([]byte, handshakeNonceLength+sha256.Size)
+	if _, err := io.ReadFull(conn, delegateHello); err != nil {
+		return nil, nil, fmt.Errorf("Could not read delegate handshake: %w", err)
+	}
+	delegateNonce, proof := delegateHello[:handshakeNonceLength], delegateHello[handshakeNonceLength:]
+	if !hmac.Equal(proof, handshakeProof(creds.secret, proofLabelDelegate, nonce)) {
+		return nil, nil, fmt.Errorf("Delegate does not know the secret")
+	}
+	if _, err := conn.Write(handshakeProof(creds.secret, proofLabelFrontEnd, delegateNonce)); err != nil {
+		return nil, nil, err
+	}
+	return conn, secretAuthInfo{}, nil
+}
+
+func (creds *secretCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	frontEndNonce := make([]byte, handshakeNonceLength)
+	if _, err := io.ReadFull(conn, frontEndNonce); err != nil {
+		return nil, nil, fmt.Errorf("Could not read front-end handshake: %w", err)
+	}
+	nonce := crypto.RandomBytes(handshakeNonceLength)
+	if _, err := conn.Write(append(nonce, handshakeProof(creds.secret, proofLabelDelegate, frontEndNonce)...)); err != nil {
+		return nil, nil, err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return nil, nil, fmt.Errorf("Could not read front-end proof: %w", err)
+	}
+	if !hmac.Equal(proof, handshakeProof(creds.secret, proofLabelFrontEnd, nonce)) {
+		delegateLogger.Printf("ERROR: Front-end from %s does not know the secret\n\n", conn.RemoteAddr())
+		return nil, nil, fmt.Errorf("Front-end does not know the secret")
+	}
+	delegateLogger.Printf("Front-end connected from %s\n\n", conn.RemoteAddr())
+	return conn, secretAuthInfo{}, nil
+}
+
+func (creds *secretCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "virtual-fido-secret"}
+}
+
+func (creds *secretCredentials) Clone() credentials.TransportCredentials {
+	return &secretCredentials{secret: creds.secret}
+}
+
+func (creds *secretCredentials) OverrideServerName(name string) error {
+	return nil
+}
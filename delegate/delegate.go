@@ -0,0 +1,532 @@
+package delegate
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"google.golang.org/grpc"
+)
+
+var delegateLogger = util.NewLogger("[DELEGATE] ", util.LogSubsystemDelegate, util.LogLevelDebug)
+
+// Client is the interface served by a delegate: everything the CTAP and U2F servers ask of
+// their client
+type Client interface {
+	u2f.U2FClient
+	ctap.CTAPClient
+}
+
+// wireCredentialSource is a CredentialSource with only its public key. The private key stays
+// with the delegate, which signs with it by credential ID.
+type wireCredentialSource struct {
+	Type             string
+	ID               []byte
+	PublicKey        []byte
+	RelyingParty     *webauthn.PublicKeyCredentialRPEntity
+	User             *webauthn.PublicKeyCrendentialUserEntity
+	SignatureCounter int32
+	CreatedAt        time.Time
+	LastUsedAt       time.Time
+	UsageCount       uint32
+	Nickname         string
+	CredBlob         []byte
+	BackupEligible   bool
+	BackedUp         bool
+	Policy           identities.CredentialPolicy
+}
+
+func encodeCredentialSource(source *identities.CredentialSource) *wireCredentialSource {
+	if source == nil {
+		return nil
+	}
+	return &wireCredentialSource{
+		Type:             source.Type,
+		ID:               source.ID,
+		PublicKey:        cose.MarshalCOSEPublicKey(source.PrivateKey.Public()),
+		RelyingParty:     source.RelyingParty,
+		User:             source.User,
+		SignatureCounter: source.SignatureCounter,
+		CreatedAt:        source.CreatedAt,
+		LastUsedAt:       source.LastUsedAt,
+		UsageCount:       source.UsageCount,
+		Nickname:         source.Nickname,
+		CredBlob:         source.CredBlob,
+		BackupEligible:   source.BackupEligible,
+		BackedUp:         source.BackedUp,
+		Policy:           source.Policy,
+	}
+}
+
+func decodeCredentialSource(client *RemoteClient, source *wireCredentialSource) (*identities.CredentialSource, error) {
+	if source == nil {
+		return nil, nil
+	}
+	publicKey, err := cose.UnmarshalCOSEPublicKey(source.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode credential public key: %w", err)
+	}
+	return &identities.CredentialSource{
+		Type:             source.Type,
+		ID:               source.ID,
+		PrivateKey:       client.remoteKey(source.ID, publicKey),
+		RelyingParty:     source.RelyingParty,
+		User:             source.User,
+		SignatureCounter: source.SignatureCounter,
+		CreatedAt:        source.CreatedAt,
+		LastUsedAt:       source.LastUsedAt,
+		UsageCount:       source.UsageCount,
+		Nickname:         source.Nickname,
+		CredBlob:         source.CredBlob,
+		BackupEligible:   source.BackupEligible,
+		BackedUp:         source.BackedUp,
+		Policy:           source.Policy,
+	}, nil
+}
+
+type Empty struct{}
+
+type NewCredentialSourceArgs struct {
+	PubKeyCredParams []webauthn.PublicKeyCredentialParams
+	ExcludeList      []webauthn.PublicKeyCredentialDescriptor
+	RelyingParty     *webauthn.PublicKeyCredentialRPEntity
+	User             *webauthn.PublicKeyCrendentialUserEntity
+}
+
+type GetAssertionSourceArgs struct {
+	RelyingPartyID string
+	AllowList      []webauthn.PublicKeyCredentialDescriptor
+}
+
+type SetCredBlobArgs struct {
+	CredentialID []byte
+	CredBlob     []byte
+}
+
+type HasCredentialArgs struct {
+	RelyingPartyID string
+	CredentialID   []byte
+}
+
+type U2FCredentialSourceArgs struct {
+	RelyingPartyID string
+	KeyHandle      []byte
+}
+
+type SignArgs struct {
+	KeyID []byte
+	Data  []byte
+}
+
+type AppleAttestationCertificateArgs struct {
+	KeyID []byte
+	Nonce []byte
+}
+
+type AndroidKeyAttestationCertificateArgs struct {
+	KeyID     []byte
+	Challenge []byte
+}
+
+type U2FKeyArgs struct {
+	Application []byte
+	KeyHandle   []byte
+}
+
+type CanStoreCredentialArgs struct {
+	ResidentKey  bool
+	RelyingParty *webauthn.PublicKeyCredentialRPEntity
+	User         *webauthn.PublicKeyCrendentialUserEntity
+}
+
+type ApproveAccountCreationArgs struct {
+	RelyingParty *webauthn.PublicKeyCredentialRPEntity
+	User         *webauthn.PublicKeyCrendentialUserEntity
+}
+
+type CredentialSourceReply struct {
+	Source *wireCredentialSource
+}
+
+type U2FKeyReply struct {
+	KeyHandle []byte
+	PublicKey []byte
+}
+
+// Service exposes a Client over gRPC. Its methods are only exported for the service
+// descriptor.
+type Service struct {
+	client Client
+	// Credential sources and U2F keys handed out, by hex ID or key handle, so later calls act
+	// on the client's own copy
+	sourcesLock sync.Mutex
+	sources     map[string]*identities.CredentialSource
+	keys        map[string]*cose.SupportedCOSEPrivateKey
+}
+
+func newService(client Client) *Service {
+	return &Service{
+		client:  client,
+		sources: make(map[string]*identities.CredentialSource),
+		keys:    make(map[string]*cose.SupportedCOSEPrivateKey),
+	}
+}
+
+func (service *Service) remember(source *identities.CredentialSource) *wireCredentialSource {
+	if source == nil {
+		return nil
+	}
+	service.sourcesLock.Lock()
+	service.sources[hex.EncodeToString(source.ID)] = source
+	service.keys[hex.EncodeToString(source.ID)] = source.PrivateKey
+	service.sourcesLock.Unlock()
+	return encodeCredentialSource(source)
+}
+
+func (service *Service) rememberKey(keyHandle []byte, privateKey *cose.SupportedCOSEPrivateKey) *U2FKeyReply {
+	service.sourcesLock.Lock()
+	service.keys[hex.EncodeToString(keyHandle)] = privateKey
+	service.sourcesLock.Unlock()
+	return &U2FKeyReply{KeyHandle: keyHandle, PublicKey: cose.MarshalCOSEPublicKey(privateKey.Public())}
+}
+
+func (service *Service) lookup(id []byte) *identities.CredentialSource {
+	service.sourcesLock.Lock()
+	defer service.sourcesLock.Unlock()
+	return service.sources[hex.EncodeToString(id)]
+}
+
+func (service *Service) lookupKey(id []byte) (*cose.SupportedCOSEPrivateKey, error) {
+	service.sourcesLock.Lock()
+	defer service.sourcesLock.Unlock()
+	key := service.keys[hex.EncodeToString(id)]
+	if key == nil {
+		return nil, fmt.Errorf("Unknown key: %x", id)
+	}
+	return key, nil
+}
+
+// Ping lets Dial check the connection
+func (service *Service) Ping(args Empty, reply *Empty) error {
+	return nil
+}
+
+func (service *Service) SupportsResidentKey(args Empty, reply *bool) error {
+	*reply = service.client.SupportsResidentKey()
+	return nil
+}
+
+func (service *Service) SupportsPIN(args Empty, reply *bool) error {
+	*reply = service.client.SupportsPIN()
+	return nil
+}
+
+func (service *Service) SupportsUserVerification(args Empty, reply *bool) error {
+	if verifier, ok := service.client.(ctap.CTAPUserVerificationClient); ok {
+		*reply = verifier.SupportsUserVerification()
+	}
+	return nil
+}
+
+func (service *Service) VerifyUser(args Empty, reply *bool) error {
+	if verifier, ok := service.client.(ctap.CTAPUserVerificationClient); ok {
+		*reply = verifier.VerifyUser()
+	}
+	return nil
+}
+
+func (service *Service) NewCredentialSource(args NewCredentialSourceArgs, reply *CredentialSourceReply) error {
+	source := service.client.NewCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RelyingParty, args.User)
+	reply.Source = service.remember(source)
+	return nil
+}
+
+// NewNonResidentCredentialSource falls back to a resident credential if the client doesn't
+// create them differently
+func (service *Service) NewNonResidentCredentialSource(args NewCredentialSourceArgs, reply *CredentialSourceReply) error {
+	var source *identities.CredentialSource
+	if nonResident, ok := service.client.(ctap.CTAPNonResidentClient); ok {
+		source = nonResident.NewNonResidentCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RelyingParty, args.User)
+	} else {
+		source = service.client.NewCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RelyingParty, args.User)
+	}
+	reply.Source = service.remember(source)
+	return nil
+}
+
+// Clients without a limited credential store have room for everything
+func (service *Service) CanStoreCredential(args CanStoreCredentialArgs, reply *bool) error {
+	*reply = true
+	if store, ok := service.client.(ctap.CTAPCredentialStoreClient); ok {
+		*reply = store.CanStoreCredential(args.ResidentKey, args.RelyingParty, args.User)
+	}
+	return nil
+}
+
+func (service *Service) ResidentCredentialCount(args Empty, reply *int) error {
+	if store, ok := service.client.(ctap.CTAPCredentialStoreClient); ok {
+		*reply = store.ResidentCredentialCount()
+	}
+	return nil
+}
+
+func (service *Service) RemainingResidentCredentials(args Empty, reply *int) error {
+	*reply = -1
+	if store, ok := service.client.(ctap.CTAPCredentialStoreClient); ok {
+		*reply = store.RemainingResidentCredentials()
+	}
+	return nil
+}
+
+func (service *Service) AlwaysUV(args Empty, reply *bool) error {
+	if config, ok := service.client.(ctap.CTAPAlwaysUVClient); ok {
+		*reply = config.AlwaysUV()
+	}
+	return nil
+}
+
+func (service *Service) SetAlwaysUV(enabled bool, reply *Empty) error {
+	config, ok := service.client.(ctap.CTAPAlwaysUVClient)
+	if !ok {
+		return fmt.Errorf("Client doesn't support alwaysUv")
+	}
+	config.SetAlwaysUV(enabled)
+	return nil
+}
+
+func (service *Service) HasCredential(args HasCredentialArgs, reply *bool) error {
+	if lookup, ok := service.client.(ctap.CTAPCredentialLookupClient); ok {
+		*reply = lookup.HasCredential(args.RelyingPartyID, args.CredentialID)
+	}
+	return nil
+}
+
+func (service *Service) GetAssertionSource(args GetAssertionSourceArgs, reply *CredentialSourceReply) error {
+	source := service.client.GetAssertionSource(args.RelyingPartyID, args.AllowList)
+	reply.Source = service.remember(source)
+	return nil
+}
+
+func (service *Service) SetCredBlob(args SetCredBlobArgs, reply *Empty) error {
+	credBlobClient, ok := service.client.(ctap.CTAPCredBlobClient)
+	if !ok {
+		return fmt.Errorf("Client doesn't support credBlob")
+	}
+	source := service.lookup(args.CredentialID)
+	if source == nil {
+		return fmt.Errorf("Unknown credential: %x", args.CredentialID)
+	}
+	credBlobClient.SetCredBlob(source, args.CredBlob)
+	return nil
+}
+
+func (service *Service) U2FCredentialSource(args U2FCredentialSourceArgs, reply *CredentialSourceReply) error {
+	if lookup, ok := service.client.(ctap.CTAPCredentialLookupClient); ok {
+		reply.Source = service.remember(lookup.U2FCredentialSource(args.RelyingPartyID, args.KeyHandle))
+	}
+	return nil
+}
+
+func (service *Service) Sign(args SignArgs, reply *[]byte) error {
+	key, err := service.lookupKey(args.KeyID)
+	if err != nil {
+		return err
+	}
+	*reply = key.Sign(args.Data)
+	return nil
+}
+
+func (service *Service) CreateAttestationCertificiate(keyID []byte, reply *[]byte) error {
+	key, err := service.lookupKey(keyID)
+	if err != nil {
+		return err
+	}
+	*reply = service.client.CreateAttestationCertificiate(key)
+	return nil
+}
+
+func (service *Service) AppleAttestation(args Empty, reply *bool) error {
+	if apple, ok := service.client.(ctap.CTAPAppleAttestationClient); ok {
+		*reply = apple.AppleAttestation()
+	}
+	return nil
+}
+
+func (service *Service) CreateAppleAttestationCertificate(args AppleAttestationCertificateArgs, reply *[]byte) error {
+	apple, ok := service.client.(ctap.CTAPAppleAttestationClient)
+	if !ok {
+		return fmt.Errorf("Client doesn't support Apple attestation")
+	}
+	key, err := service.lookupKey(args.KeyID)
+	if err != nil {
+		return err
+	}
+	*reply = apple.CreateAppleAttestationCertificate(key, args.Nonce)
+	return nil
+}
+
+func (service *Service) AndroidAttestation(args Empty, reply *string) error {
+	if android, ok := service.client.(ctap.CTAPAndroidAttestationClient); ok {
+		*reply = android.AndroidAttestation()
+	}
+	return nil
+}
+
+func (service *Service) CreateAndroidKeyAttestationCertificate(args AndroidKeyAttestationCertificateArgs, reply *[]byte) error {
+	android, ok := service.client.(ctap.CTAPAndroidAttestationClient)
+	if !ok {
+		return fmt.Errorf("Client doesn't support Android attestation")
+	}
+	key, err := service.lookupKey(args.KeyID)
+	if err != nil {
+		return err
+	}
+	*reply = android.CreateAndroidKeyAttestationCertificate(key, args.Challenge)
+	return nil
+}
+
+func (service *Service) CreateSafetyNetResponse(nonce []byte, reply *[]byte) error {
+	android, ok := service.client.(ctap.CTAPAndroidAttestationClient)
+	if !ok {
+		return fmt.Errorf("Client doesn't support Android attestation")
+	}
+	*reply = android.CreateSafetyNetResponse(nonce)
+	return nil
+}
+
+func (service *Service) AttestationIntermediates(args Empty, reply *[][]byte) error {
+	if chainClient, ok := service.client.(ctap.CTAPAttestationChainClient); ok {
+		*reply = chainClient.AttestationIntermediates()
+	}
+	return nil
+}
+
+func (service *Service) AAGUID(args Empty, reply *[16]byte) error {
+	*reply = identities.DefaultAAGUID
+	if aaguidClient, ok := service.client.(ctap.CTAPAAGUIDClient); ok {
+		*reply = aaguidClient.AAGUID()
+	}
+	return nil
+}
+
+func (service *Service) PINSet(args Empty, reply *bool) error {
+	if verifier, ok := service.client.(ctap.CTAPPINVerifierClient); ok {
+		*reply = verifier.PINSet()
+	} else {
+		*reply = service.client.PINHash() != nil
+	}
+	return nil
+}
+
+func (service *Service) CheckPINHash(pinHash []byte, reply *bool) error {
+	if verifier, ok := service.client.(ctap.CTAPPINVerifierClient); ok {
+		*reply = verifier.CheckPINHash(pinHash)
+	} else {
+		stored := service.client.PINHash()
+		*reply = stored != nil && hmac.Equal(stored, pinHash)
+	}
+	return nil
+}
+
+func (service *Service) SetPINHash(pinHash []byte, reply *Empty) error {
+	service.client.SetPINHash(pinHash)
+	return nil
+}
+
+func (service *Service) PINRetries(args Empty, reply *int32) error {
+	*reply = service.client.PINRetries()
+	return nil
+}
+
+func (service *Service) SetPINRetries(retries int32, reply *Empty) error {
+	service.client.SetPINRetries(retries)
+	return nil
+}
+
+func (service *Service) ApproveAccountCreation(args ApproveAccountCreationArgs, reply *bool) error {
+	if approver, ok := service.client.(ctap.CTAPUserApprovalClient); ok {
+		*reply = approver.ApproveUserAccountCreation(args.RelyingParty, args.User)
+	} else {
+		*reply = service.client.ApproveAccountCreation(args.RelyingParty.Name)
+	}
+	return nil
+}
+
+func (service *Service) ApproveAccountLogin(credentialID []byte, reply *bool) error {
+	source := service.lookup(credentialID)
+	if source == nil {
+		return fmt.Errorf("Unknown credential: %x", credentialID)
+	}
+	*reply = service.client.ApproveAccountLogin(source)
+	return nil
+}
+
+func (service *Service) DisplayTransaction(text string, reply *bool) error {
+	display, ok := service.client.(ctap.CTAPDisplayClient)
+	if !ok {
+		return fmt.Errorf("Client can't display transactions")
+	}
+	*reply = display.DisplayTransaction(text)
+	return nil
+}
+
+func (service *Service) ApproveSelection(args Empty, reply *bool) error {
+	if selector, ok := service.client.(ctap.CTAPSelectionClient); ok {
+		*reply = selector.ApproveSelection()
+	}
+	return nil
+}
+
+func (service *Service) NewAuthenticationCounterId(args Empty, reply *uint32) error {
+	*reply = service.client.NewAuthenticationCounterId()
+	return nil
+}
+
+func (service *Service) ApproveU2FRegistration(keyHandle webauthn.KeyHandle, reply *bool) error {
+	*reply = service.client.ApproveU2FRegistration(&keyHandle)
+	return nil
+}
+
+func (service *Service) ApproveU2FAuthentication(keyHandle webauthn.KeyHandle, reply *bool) error {
+	*reply = service.client.ApproveU2FAuthentication(&keyHandle)
+	return nil
+}
+
+func (service *Service) NewU2FKey(application []byte, reply *U2FKeyReply) error {
+	keyHandle, privateKey, err := u2f.NewKey(service.client, application)
+	if err != nil {
+		return err
+	}
+	*reply = *service.rememberKey(keyHandle, privateKey)
+	return nil
+}
+
+func (service *Service) OpenU2FKey(args U2FKeyArgs, reply *U2FKeyReply) error {
+	privateKey, err := u2f.OpenKey(service.client, args.Application, args.KeyHandle)
+	if err != nil {
+		return err
+	}
+	*reply = *service.rememberKey(args.KeyHandle, privateKey)
+	return nil
+}
+
+// Serve answers delegate calls for client on every connection accepted by listener, until
+// the listener is closed. Only front-ends that know secret are let in, and they only get
+// public keys, signatures and yes/no answers, never private keys, the sealing key or the PIN.
+func Serve(listener net.Listener, client Client, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("Delegate needs a secret")
+	}
+	server := grpc.NewServer(grpc.Creds(newSecretCredentials(secret)), grpc.ForceServerCodec(cborCodec{}))
+	server.RegisterService(&serviceDesc, newService(client))
+	return server.Serve(listener)
+}
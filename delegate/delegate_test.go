@@ -0,0 +1,163 @@
+package delegate
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type approveAll struct{}
+
+func (approver *approveAll) ApproveClientAction(action fido_client.ClientAction, params fido_client.ClientActionRequestParams) bool {
+	return true
+}
+
+type memoryDataSaver struct {
+	data []byte
+}
+
+func (saver *memoryDataSaver) SaveData(data []byte) {
+	saver.data = data
+}
+
+func (saver *memoryDataSaver) RetrieveData() []byte {
+	return saver.data
+}
+
+func (saver *memoryDataSaver) Passphrase() string {
+	return "passphrase"
+}
+
+func listenDelegate(t *testing.T) (net.Listener, string) {
+	directory, err := os.MkdirTemp("", "delegate")
+	test.Assert(t, err == nil, "Could not create socket directory")
+	t.Cleanup(func() { os.RemoveAll(directory) })
+	path := filepath.Join(directory, "delegate.sock")
+	listener, err := Listen(path)
+	test.Assert(t, err == nil, "Could not listen")
+	t.Cleanup(func() { listener.Close() })
+	return listener, path
+}
+
+func startDelegate(t *testing.T) (*fido_client.DefaultFIDOClient, *RemoteClient) {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA private key")
+	ca, err := identities.CreateSelfSignedCA(caPrivateKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	encryptionKey := [32]byte{}
+	copy(encryptionKey[:], crypto.RandomBytes(32))
+	client := fido_client.NewDefaultClient(ca, caPrivateKey, encryptionKey, false, &approveAll{}, &memoryDataSaver{})
+	listener, path := listenDelegate(t)
+	go Serve(listener, client, []byte("secret"))
+	remote, err := Dial("unix", path, []byte("secret"))
+	test.Assert(t, err == nil, "Could not dial delegate")
+	t.Cleanup(func() { remote.Close() })
+	return client, remote
+}
+
+func TestRemoteCTAP(t *testing.T) {
+	client, remote := startDelegate(t)
+	server := ctap.NewCTAPServer(remote)
+	clientDataHash := crypto.HashSHA256([]byte("client data"))
+	makeCredential := map[int]interface{}{
+		1: clientDataHash,
+		2: map[string]string{"id": "example.com", "name": "Example"},
+		3: map[string]interface{}{"id": []byte{1, 2, 3}, "name": "alice", "displayName": "Alice"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+		6: map[string]interface{}{"credBlob": []byte("blob")},
+	}
+	response := server.HandleMessage(append([]byte{0x01}, util.MarshalCBOR(makeCredential)...))
+	test.AssertEqual(t, response[0], 0, "Could not make credential through the delegate")
+	credentials := client.ListCredentials()
+	test.AssertEqual(t, len(credentials), 1, "Credential should be stored by the delegate")
+	test.AssertArrEqual(t, client.Identities()[0].CredBlob, []byte("blob"), "CredBlob should be stored by the delegate")
+
+	getAssertion := map[int]interface{}{1: "example.com", 2: clientDataHash}
+	response = server.HandleMessage(append([]byte{0x02}, util.MarshalCBOR(getAssertion)...))
+	test.AssertEqual(t, response[0], 0, "Could not get assertion through the delegate")
+
+	source := remote.GetAssertionSource("example.com", nil)
+	test.Assert(t, source.PrivateKey.ECDSA == nil && source.PrivateKey.Signer != nil, "Private key should stay with the delegate")
+	data := []byte("data")
+	test.Assert(t, source.PrivateKey.Public().Verify(data, source.PrivateKey.Sign(data)), "Delegate should sign with the credential key")
+
+	test.AssertEqual(t, remote.RemainingResidentCredentials(), -1, "Vault should have no limit")
+	client.SetMaxCredentials(1)
+	test.AssertEqual(t, remote.RemainingResidentCredentials(), 0, "Vault should be full")
+	makeCredential[3] = map[string]interface{}{"id": []byte{4}, "name": "bob", "displayName": "Bob"}
+	response = server.HandleMessage(append([]byte{0x01}, util.MarshalCBOR(makeCredential)...))
+	test.AssertEqual(t, response[0], 0x28, "Full vault should be reported through the delegate")
+}
+
+func TestRemoteU2F(t *testing.T) {
+	_, remote := startDelegate(t)
+	test.Assert(t, remote.SealingEncryptionKey() == nil, "Sealing key should stay with the delegate")
+	server := u2f.NewU2FServer(remote)
+	challenge := crypto.RandomBytes(32)
+	application := crypto.RandomBytes(32)
+	response := server.HandleMessage(util.Concat([]byte{0, 0x01, 0, 0, 0, 0, 64}, challenge, application))
+	test.AssertEqual(t, response[0], 0x05, "Could not register through the delegate")
+	test.AssertArrEqual(t, response[len(response)-2:], []byte{0x90, 0x00}, "Registration should succeed")
+	publicKey := crypto.DecodePublicKey(response[1:66])
+	keyHandle := response[67 : 67+int(response[66])]
+
+	request := util.Concat(challenge, application, []byte{byte(len(keyHandle))}, keyHandle)
+	response = server.HandleMessage(util.Concat([]byte{0, 0x02, 0x03, 0, 0}, util.ToBE(uint16(len(request))), request))
+	test.AssertArrEqual(t, response[len(response)-2:], []byte{0x90, 0x00}, "Could not authenticate through the delegate")
+	signedData := util.Concat(application, response[:5], challenge)
+	test.Assert(t, crypto.VerifyECDSA(publicKey, signedData, response[5:len(response)-2]), "Delegate should sign with the registered key")
+}
+
+func TestRemoteClientState(t *testing.T) {
+	client, remote := startDelegate(t)
+	remote.SetPINRetries(5)
+	test.AssertEqual(t, client.PINRetries(), 5, "PIN retries should be set on the delegate")
+	test.AssertEqual(t, remote.PINRetries(), 5, "PIN retries should be read from the delegate")
+	test.AssertEqual(t, remote.AAGUID(), client.AAGUID(), "AAGUID should come from the delegate")
+	counter := remote.NewAuthenticationCounterId()
+	test.AssertEqual(t, remote.NewAuthenticationCounterId(), counter+1, "Counter should be kept by the delegate")
+	var _ u2f.U2FClient = remote
+
+	pinHash := crypto.HashSHA256([]byte("1234"))[:16]
+	test.Assert(t, !remote.PINSet(), "No PIN should be set")
+	remote.SetPINHash(pinHash)
+	test.AssertArrEqual(t, client.PINHash(), pinHash, "PIN should be set on the delegate")
+	test.Assert(t, remote.PINSet(), "PIN should be set")
+	test.Assert(t, remote.PINHash() == nil, "PIN hash should stay with the delegate")
+	test.Assert(t, remote.CheckPINHash(pinHash), "PIN should be checked by the delegate")
+	test.Assert(t, !remote.CheckPINHash(crypto.HashSHA256([]byte("4321"))[:16]), "Wrong PIN should be refused")
+	test.Assert(t, !bytes.Equal(remote.PINKeyAgreement().Priv, client.PINKeyAgreement().Priv), "PIN key agreement should stay with the delegate")
+
+	remote.Close()
+	test.Assert(t, !remote.ApproveSelection(), "Requests should be denied without a delegate")
+}
+
+func TestDelegateSecret(t *testing.T) {
+	listener, path := listenDelegate(t)
+	go Serve(listener, nil, []byte("secret"))
+	_, err := Dial("unix", path, []byte("wrong secret"))
+	test.Assert(t, err != nil, "Front-end with the wrong secret should be refused")
+	test.Assert(t, Serve(listener, nil, nil) != nil, "Delegate should need a secret")
+}
+
+func TestDelegateSocketPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix socket permissions aren't enforced on Windows")
+	}
+	_, path := listenDelegate(t)
+	info, err := os.Stat(path)
+	test.Assert(t, err == nil, "Could not stat socket")
+	test.AssertEqual(t, info.Mode().Perm(), os.FileMode(0600), "Socket should only be reachable by this user")
+}
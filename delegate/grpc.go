@@ -0,0 +1,99 @@
+package delegate
+
+import (
+	"context"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/grpc"
+)
+
+// Name the delegate service is registered under
+const serviceName = "virtualfido.Delegate"
+
+// cborCodec encodes gRPC messages as CBOR, like the rest of the authenticator, so the
+// argument structs don't need protobuf definitions
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+// handler adapts a Service method to gRPC
+func handler[Args any, Reply any](name string, method func(*Service, Args, *Reply) error) grpc.MethodDesc {
+	call := func(service interface{}, ctx context.Context, args interface{}) (interface{}, error) {
+		reply := new(Reply)
+		err := method(service.(*Service), *args.(*Args), reply)
+		return reply, err
+	}
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(service interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			args := new(Args)
+			if err := decode(args); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(service, ctx, args)
+			}
+			info := &grpc.UnaryServerInfo{Server: service, FullMethod: "/" + serviceName + "/" + name}
+			return interceptor(ctx, args, info, func(ctx context.Context, args interface{}) (interface{}, error) {
+				return call(service, ctx, args)
+			})
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		handler("Ping", (*Service).Ping),
+		handler("SupportsResidentKey", (*Service).SupportsResidentKey),
+		handler("SupportsPIN", (*Service).SupportsPIN),
+		handler("SupportsUserVerification", (*Service).SupportsUserVerification),
+		handler("VerifyUser", (*Service).VerifyUser),
+		handler("NewCredentialSource", (*Service).NewCredentialSource),
+		handler("NewNonResidentCredentialSource", (*Service).NewNonResidentCredentialSource),
+		handler("CanStoreCredential", (*Service).CanStoreCredential),
+		handler("ResidentCredentialCount", (*Service).ResidentCredentialCount),
+		handler("RemainingResidentCredentials", (*Service).RemainingResidentCredentials),
+		handler("AlwaysUV", (*Service).AlwaysUV),
+		handler("SetAlwaysUV", (*Service).SetAlwaysUV),
+		handler("HasCredential", (*Service).HasCredential),
+		handler("GetAssertionSource", (*Service).GetAssertionSource),
+		handler("SetCredBlob", (*Service).SetCredBlob),
+		handler("U2FCredentialSource", (*Service).U2FCredentialSource),
+		handler("Sign", (*Service).Sign),
+		handler("CreateAttestationCertificiate", (*Service).CreateAttestationCertificiate),
+		handler("AppleAttestation", (*Service).AppleAttestation),
+		handler("CreateAppleAttestationCertificate", (*Service).CreateAppleAttestationCertificate),
+		handler("AndroidAttestation", (*Service).AndroidAttestation),
+		handler("CreateAndroidKeyAttestationCertificate", (*Service).CreateAndroidKeyAttestationCertificate),
+		handler("CreateSafetyNetResponse", (*Service).CreateSafetyNetResponse),
+		handler("AttestationIntermediates", (*Service).AttestationIntermediates),
+		handler("AAGUID", (*Service).AAGUID),
+		handler("PINSet", (*Service).PINSet),
+		handler("CheckPINHash", (*Service).CheckPINHash),
+		handler("SetPINHash", (*Service).SetPINHash),
+		handler("PINRetries", (*Service).PINRetries),
+		handler("SetPINRetries", (*Service).SetPINRetries),
+		handler("ApproveAccountCreation", (*Service).ApproveAccountCreation),
+		handler("ApproveAccountLogin", (*Service).ApproveAccountLogin),
+		handler("DisplayTransaction", (*Service).DisplayTransaction),
+		handler("ApproveSelection", (*Service).ApproveSelection),
+		handler("NewAuthenticationCounterId", (*Service).NewAuthenticationCounterId),
+		handler("ApproveU2FRegistration", (*Service).ApproveU2FRegistration),
+		handler("ApproveU2FAuthentication", (*Service).ApproveU2FAuthentication),
+		handler("NewU2FKey", (*Service).NewU2FKey),
+		handler("OpenU2FKey", (*Service).OpenU2FKey),
+	},
+	Metadata: "delegate/grpc.go",
+}
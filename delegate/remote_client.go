@@ -0,0 +1,359 @@
+package delegate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"google.golang.org/grpc"
+)
+
+// RemoteClient implements Client by calling a delegate served with Serve. Private keys stay
+// with the delegate, which signs on request, and the PIN is checked there. If the delegate
+// can't be reached, requests are denied and lookups find nothing.
+type RemoteClient struct {
+	connection *grpc.ClientConn
+	// Only used to decrypt PINs on their way to the delegate, so it doesn't need to be shared
+	pinKeyAgreement *crypto.ECDHKey
+}
+
+// Dial connects to a delegate, e.g. Dial("unix", "/run/virtual-fido.sock", secret), and
+// checks it knows secret
+func Dial(network string, address string, secret []byte) (*RemoteClient, error) {
+	dialer := func(ctx context.Context, address string) (net.Conn, error) {
+		var netDialer net.Dialer
+		return netDialer.DialContext(ctx, network, address)
+	}
+	connection, err := grpc.NewClient("passthrough:///"+address,
+		grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(newSecretCredentials(secret)),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(cborCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to delegate: %w", err)
+	}
+	client := &RemoteClient{connection: connection, pinKeyAgreement: crypto.GenerateECDHKey()}
+	if err := client.invoke("Ping", Empty{}, &Empty{}); err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("Could not connect to delegate: %w", err)
+	}
+	return client, nil
+}
+
+func (client *RemoteClient) Close() error {
+	return client.connection.Close()
+}
+
+func (client *RemoteClient) invoke(method string, args interface{}, reply interface{}) error {
+	return client.connection.Invoke(context.Background(), "/"+serviceName+"/"+method, args, reply)
+}
+
+// call logs failures, so callers only need to fall back to a safe value
+func (client *RemoteClient) call(method string, args interface{}, reply interface{}) bool {
+	err := client.invoke(method, args, reply)
+	if err != nil {
+		delegateLogger.Printf("ERROR: Delegate call %s failed: %s\n\n", method, err)
+		return false
+	}
+	return true
+}
+
+// remoteKey is a private key held by the delegate
+type remoteKey struct {
+	client    *RemoteClient
+	id        []byte
+	publicKey *cose.SupportedCOSEPublicKey
+}
+
+func (key *remoteKey) Public() *cose.SupportedCOSEPublicKey {
+	return key.publicKey
+}
+
+func (key *remoteKey) Sign(data []byte) []byte {
+	var signature []byte
+	key.client.call("Sign", SignArgs{KeyID: key.id, Data: data}, &signature)
+	return signature
+}
+
+func (client *RemoteClient) remoteKey(id []byte, publicKey *cose.SupportedCOSEPublicKey) *cose.SupportedCOSEPrivateKey {
+	return &cose.SupportedCOSEPrivateKey{Signer: &remoteKey{client: client, id: id, publicKey: publicKey}}
+}
+
+// keyID finds which of the delegate's keys privateKey is
+func (client *RemoteClient) keyID(privateKey *cose.SupportedCOSEPrivateKey) []byte {
+	if key, ok := privateKey.Signer.(*remoteKey); ok && key.client == client {
+		return key.id
+	}
+	delegateLogger.Printf("ERROR: Key isn't held by the delegate\n\n")
+	return nil
+}
+
+func (client *RemoteClient) callBool(method string, args interface{}) bool {
+	var reply bool
+	return client.call(method, args, &reply) && reply
+}
+
+func (client *RemoteClient) credentialSource(method string, args interface{}) *identities.CredentialSource {
+	var reply CredentialSourceReply
+	if !client.call(method, args, &reply) {
+		return nil
+	}
+	source, err := decodeCredentialSource(client, reply.Source)
+	if err != nil {
+		delegateLogger.Printf("ERROR: Invalid credential from %s: %s\n\n", method, err)
+		return nil
+	}
+	return source
+}
+
+func (client *RemoteClient) SupportsResidentKey() bool {
+	return client.callBool("SupportsResidentKey", Empty{})
+}
+
+func (client *RemoteClient) SupportsPIN() bool {
+	return client.callBool("SupportsPIN", Empty{})
+}
+
+func (client *RemoteClient) SupportsUserVerification() bool {
+	return client.callBool("SupportsUserVerification", Empty{})
+}
+
+func (client *RemoteClient) VerifyUser() bool {
+	return client.callBool("VerifyUser", Empty{})
+}
+
+func (client *RemoteClient) NewCredentialSource(
+	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
+	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
+	args := NewCredentialSourceArgs{
+		PubKeyCredParams: PubKeyCredParams,
+		ExcludeList:      ExcludeList,
+		RelyingParty:     relyingParty,
+		User:             user,
+	}
+	return client.credentialSource("NewCredentialSource", args)
+}
+
+func (client *RemoteClient) NewNonResidentCredentialSource(
+	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
+	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
+	args := NewCredentialSourceArgs{
+		PubKeyCredParams: PubKeyCredParams,
+		ExcludeList:      ExcludeList,
+		RelyingParty:     relyingParty,
+		User:             user,
+	}
+	return client.credentialSource("NewNonResidentCredentialSource", args)
+}
+
+func (client *RemoteClient) CanStoreCredential(
+	residentKey bool,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	return client.callBool("CanStoreCredential", CanStoreCredentialArgs{ResidentKey: residentKey, RelyingParty: relyingParty, User: user})
+}
+
+func (client *RemoteClient) ResidentCredentialCount() int {
+	var count int
+	client.call("ResidentCredentialCount", Empty{}, &count)
+	return count
+}
+
+func (client *RemoteClient) RemainingResidentCredentials() int {
+	remaining := -1
+	client.call("RemainingResidentCredentials", Empty{}, &remaining)
+	return remaining
+}
+
+func (client *RemoteClient) AlwaysUV() bool {
+	var enabled bool
+	client.call("AlwaysUV", Empty{}, &enabled)
+	return enabled
+}
+
+func (client *RemoteClient) SetAlwaysUV(enabled bool) {
+	client.call("SetAlwaysUV", enabled, &Empty{})
+}
+
+func (client *RemoteClient) HasCredential(relyingPartyID string, id []byte) bool {
+	return client.callBool("HasCredential", HasCredentialArgs{RelyingPartyID: relyingPartyID, CredentialID: id})
+}
+
+func (client *RemoteClient) GetAssertionSource(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource {
+	return client.credentialSource("GetAssertionSource", GetAssertionSourceArgs{RelyingPartyID: relyingPartyID, AllowList: allowList})
+}
+
+func (client *RemoteClient) SetCredBlob(credentialSource *identities.CredentialSource, credBlob []byte) {
+	if client.call("SetCredBlob", SetCredBlobArgs{CredentialID: credentialSource.ID, CredBlob: credBlob}, &Empty{}) {
+		credentialSource.CredBlob = credBlob
+	}
+}
+
+func (client *RemoteClient) U2FCredentialSource(relyingPartyID string, keyHandle []byte) *identities.CredentialSource {
+	return client.credentialSource("U2FCredentialSource", U2FCredentialSourceArgs{RelyingPartyID: relyingPartyID, KeyHandle: keyHandle})
+}
+
+func (client *RemoteClient) CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte {
+	var certificate []byte
+	keyID := client.keyID(privateKey)
+	if keyID == nil {
+		return nil
+	}
+	client.call("CreateAttestationCertificiate", keyID, &certificate)
+	return certificate
+}
+
+func (client *RemoteClient) AppleAttestation() bool {
+	var enabled bool
+	client.call("AppleAttestation", Empty{}, &enabled)
+	return enabled
+}
+
+func (client *RemoteClient) CreateAppleAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, nonce []byte) []byte {
+	var certificate []byte
+	keyID := client.keyID(privateKey)
+	if keyID == nil {
+		return nil
+	}
+	client.call("CreateAppleAttestationCertificate", AppleAttestationCertificateArgs{KeyID: keyID, Nonce: nonce}, &certificate)
+	return certificate
+}
+
+func (client *RemoteClient) AndroidAttestation() string {
+	var format string
+	client.call("AndroidAttestation", Empty{}, &format)
+	return format
+}
+
+func (client *RemoteClient) CreateAndroidKeyAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, challenge []byte) []byte {
+	var certificate []byte
+	keyID := client.keyID(privateKey)
+	if keyID == nil {
+		return nil
+	}
+	client.call("CreateAndroidKeyAttestationCertificate", AndroidKeyAttestationCertificateArgs{KeyID: keyID, Challenge: challenge}, &certificate)
+	return certificate
+}
+
+func (client *RemoteClient) CreateSafetyNetResponse(nonce []byte) []byte {
+	var response []byte
+	client.call("CreateSafetyNetResponse", nonce, &response)
+	return response
+}
+
+func (client *RemoteClient) AttestationIntermediates() [][]byte {
+	var intermediates [][]byte
+	client.call("AttestationIntermediates", Empty{}, &intermediates)
+	return intermediates
+}
+
+func (client *RemoteClient) AAGUID() [16]byte {
+	var aaguid [16]byte
+	client.call("AAGUID", Empty{}, &aaguid)
+	return aaguid
+}
+
+// PINHash is never sent by the delegate, which checks PINs itself with CheckPINHash
+func (client *RemoteClient) PINHash() []byte {
+	return nil
+}
+
+func (client *RemoteClient) PINSet() bool {
+	return client.callBool("PINSet", Empty{})
+}
+
+func (client *RemoteClient) CheckPINHash(pinHash []byte) bool {
+	return client.callBool("CheckPINHash", pinHash)
+}
+
+func (client *RemoteClient) SetPINHash(pinHash []byte) {
+	client.call("SetPINHash", pinHash, &Empty{})
+}
+
+func (client *RemoteClient) PINRetries() int32 {
+	var retries int32
+	client.call("PINRetries", Empty{}, &retries)
+	return retries
+}
+
+func (client *RemoteClient) SetPINRetries(retries int32) {
+	client.call("SetPINRetries", retries, &Empty{})
+}
+
+func (client *RemoteClient) PINKeyAgreement() *crypto.ECDHKey {
+	return client.pinKeyAgreement
+}
+
+func (client *RemoteClient) ApproveAccountCreation(relyingParty string) bool {
+	return client.ApproveUserAccountCreation(&webauthn.PublicKeyCredentialRPEntity{Name: relyingParty}, nil)
+}
+
+func (client *RemoteClient) ApproveUserAccountCreation(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	return client.callBool("ApproveAccountCreation", ApproveAccountCreationArgs{RelyingParty: relyingParty, User: user})
+}
+
+func (client *RemoteClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
+	return client.callBool("ApproveAccountLogin", credentialSource.ID)
+}
+
+func (client *RemoteClient) DisplayTransaction(text string) bool {
+	return client.callBool("DisplayTransaction", text)
+}
+
+func (client *RemoteClient) ApproveSelection() bool {
+	return client.callBool("ApproveSelection", Empty{})
+}
+
+// SealingEncryptionKey is never sent by the delegate, which seals U2F key handles itself
+// with NewU2FKey
+func (client *RemoteClient) SealingEncryptionKey() []byte {
+	return nil
+}
+
+// NewPrivateKey isn't used, since U2F keys are created by the delegate with NewU2FKey
+func (client *RemoteClient) NewPrivateKey() *ecdsa.PrivateKey {
+	return nil
+}
+
+func (client *RemoteClient) NewAuthenticationCounterId() uint32 {
+	var counter uint32
+	client.call("NewAuthenticationCounterId", Empty{}, &counter)
+	return counter
+}
+
+func (client *RemoteClient) ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool {
+	return client.callBool("ApproveU2FRegistration", *keyHandle)
+}
+
+func (client *RemoteClient) ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool {
+	return client.callBool("ApproveU2FAuthentication", *keyHandle)
+}
+
+func (client *RemoteClient) u2fKey(method string, args interface{}) ([]byte, *cose.SupportedCOSEPrivateKey, error) {
+	var reply U2FKeyReply
+	if err := client.invoke(method, args, &reply); err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := cose.UnmarshalCOSEPublicKey(reply.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not decode U2F public key: %w", err)
+	}
+	return reply.KeyHandle, client.remoteKey(reply.KeyHandle, publicKey), nil
+}
+
+func (client *RemoteClient) NewU2FKey(application []byte) ([]byte, *cose.SupportedCOSEPrivateKey, error) {
+	return client.u2fKey("NewU2FKey", application)
+}
+
+func (client *RemoteClient) OpenU2FKey(application []byte, keyHandle []byte) (*cose.SupportedCOSEPrivateKey, error) {
+	_, privateKey, err := client.u2fKey("OpenU2FKey", U2FKeyArgs{Application: application, KeyHandle: keyHandle})
+	return privateKey, err
+}
@@ -0,0 +1,11 @@
+// Package virtual_fido runs a software FIDO2/U2F security key that the host sees as a USB
+// device, over USB/IP on Linux and Windows and through a driver on macOS.
+//
+// This package is the stable API for embedders. Implement Client, or use
+// fido_client.DefaultFIDOClient, create a Device with NewDevice from Options, then call its
+// Start, which blocks until Stop. Optional client features, like showing the user an
+// account before creating it, are interfaces in ctap and u2f that the client can also
+// implement. Clients that also implement Vault can have their credentials listed and
+// backed up, and SubscribeEvents reports what the device does.
+// Packages under internal/ are not part of the API and may change at any time.
+package virtual_fido
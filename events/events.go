@@ -0,0 +1,121 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type EventType string
+
+const (
+	EventDeviceAttached    EventType = "device_attached"
+	EventDeviceDetached    EventType = "device_detached"
+	EventChannelOpened     EventType = "channel_opened"
+	EventCredentialCreated EventType = "credential_created"
+	EventAssertionMade     EventType = "assertion_made"
+	EventPINFailed         EventType = "pin_failed"
+	EventReset             EventType = "reset"
+	EventVaultReloaded     EventType = "vault_reloaded"
+)
+
+// Protocols of credential and assertion events
+const (
+	ProtocolCTAP2 = "ctap2"
+	ProtocolU2F   = "u2f"
+)
+
+// Event is something the device did. Fields that don't apply to the type are left empty.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// USB/IP bus ID of device events
+	BusID string `json:"bus_id,omitempty"`
+	// CTAPHID channel of channel events
+	ChannelID uint32 `json:"channel_id,omitempty"`
+	// ProtocolCTAP2 or ProtocolU2F for credential and assertion events
+	Protocol string `json:"protocol,omitempty"`
+	// Relying party of CTAP2 credentials; U2F only knows the application parameter
+	RelyingPartyID string `json:"relying_party_id,omitempty"`
+	CredentialID   []byte `json:"credential_id,omitempty"`
+	// Tries left after a failed PIN
+	PINRetries int32 `json:"pin_retries,omitempty"`
+	// Trace of the request that caused the event, to find its log lines
+	TraceID util.TraceID `json:"trace_id,omitempty"`
+}
+
+// Subscription receives the events published after it was created
+type Subscription struct {
+	bus    *EventBus
+	events chan Event
+	// Events not delivered because the subscriber wasn't keeping up
+	dropped uint64
+}
+
+// Events is closed by Unsubscribe
+func (subscription *Subscription) Events() <-chan Event {
+	return subscription.events
+}
+
+// Dropped returns how many events were skipped because the channel was full
+func (subscription *Subscription) Dropped() uint64 {
+	subscription.bus.lock.Lock()
+	defer subscription.bus.lock.Unlock()
+	return subscription.dropped
+}
+
+func (subscription *Subscription) Unsubscribe() {
+	subscription.bus.lock.Lock()
+	defer subscription.bus.lock.Unlock()
+	if _, ok := subscription.bus.subscriptions[subscription]; ok {
+		delete(subscription.bus.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+// EventBus fans events out to subscribers. Publishing never blocks the device: events for a
+// subscriber whose channel is full are dropped.
+type EventBus struct {
+	lock          sync.Mutex
+	subscriptions map[*Subscription]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscriptions: make(map[*Subscription]bool)}
+}
+
+// Subscribe buffers up to buffer events for the subscriber
+func (bus *EventBus) Subscribe(buffer int) *Subscription {
+	subscription := &Subscription{bus: bus, events: make(chan Event, buffer)}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.subscriptions[subscription] = true
+	return subscription
+}
+
+func (bus *EventBus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = util.Now()
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	for subscription := range bus.subscriptions {
+		select {
+		case subscription.events <- event:
+		default:
+			subscription.dropped++
+		}
+	}
+}
+
+// DefaultBus is where the library publishes its events
+var DefaultBus = NewEventBus()
+
+func Subscribe(buffer int) *Subscription {
+	return DefaultBus.Subscribe(buffer)
+}
+
+func Publish(event Event) {
+	DefaultBus.Publish(event)
+}
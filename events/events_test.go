@@ -0,0 +1,31 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestPublish(t *testing.T) {
+	bus := NewEventBus()
+	first := bus.Subscribe(1)
+	second := bus.Subscribe(2)
+	bus.Publish(Event{Type: EventChannelOpened, ChannelID: 5})
+	bus.Publish(Event{Type: EventPINFailed, PINRetries: 7})
+
+	event := <-first.Events()
+	test.AssertEqual(t, event.Type, EventChannelOpened, "Incorrect event type")
+	test.AssertEqual(t, event.ChannelID, 5, "Incorrect channel ID")
+	test.Assert(t, !event.Time.IsZero(), "Event time should be set")
+	test.AssertEqual(t, first.Dropped(), 1, "Full subscriber should drop events")
+	test.AssertEqual(t, (<-second.Events()).Type, EventChannelOpened, "Events should arrive in order")
+	test.AssertEqual(t, (<-second.Events()).PINRetries, 7, "Incorrect PIN retries")
+	test.AssertEqual(t, second.Dropped(), 0, "Nothing should be dropped")
+
+	first.Unsubscribe()
+	first.Unsubscribe()
+	_, open := <-first.Events()
+	test.Assert(t, !open, "Unsubscribing should close the channel")
+	bus.Publish(Event{Type: EventReset})
+	test.AssertEqual(t, (<-second.Events()).Type, EventReset, "Remaining subscribers should still get events")
+}
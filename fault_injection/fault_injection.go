@@ -0,0 +1,162 @@
+package fault_injection
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var faultLogger = util.NewLogger("[FAULT] ", util.LogSubsystemGeneral, util.LogLevelEnabled)
+
+// Pass as a count to keep injecting a fault until it is cleared
+const Always = -1
+
+// A count of remaining injections; Always never runs out
+type faultCount int
+
+func (count *faultCount) take() bool {
+	if *count == 0 {
+		return false
+	}
+	if *count > 0 {
+		*count--
+	}
+	return true
+}
+
+type ctapErrorFault struct {
+	status uint8
+	count  faultCount
+}
+
+// FaultInjector makes the authenticator misbehave in specific ways so relying
+// parties can test their error handling. A nil *FaultInjector injects nothing,
+// so servers can call it unconditionally.
+type FaultInjector struct {
+	lock                 sync.Mutex
+	ctapErrors           map[uint8]*ctapErrorFault
+	corruptSignatures    faultCount
+	staleCounters        faultCount
+	responseDelay        time.Duration
+	droppedContinuations faultCount
+}
+
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{ctapErrors: make(map[uint8]*ctapErrorFault)}
+}
+
+// ForceCTAPError answers the next count CTAP2 commands with the given status code
+func (injector *FaultInjector) ForceCTAPError(command uint8, status uint8, count int) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	injector.ctapErrors[command] = &ctapErrorFault{status: status, count: faultCount(count)}
+}
+
+// CorruptSignatures flips a bit in the next count assertion or U2F authentication signatures
+func (injector *FaultInjector) CorruptSignatures(count int) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	injector.corruptSignatures = faultCount(count)
+}
+
+// StaleCounters reports the previous signature counter for the next count assertions,
+// which relying parties should treat as a sign of a cloned authenticator
+func (injector *FaultInjector) StaleCounters(count int) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	injector.staleCounters = faultCount(count)
+}
+
+// DelayResponses holds every CTAPHID response for the given duration
+func (injector *FaultInjector) DelayResponses(delay time.Duration) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	injector.responseDelay = delay
+}
+
+// DropContinuationPackets drops a continuation packet from the next count
+// multi-packet CTAPHID responses
+func (injector *FaultInjector) DropContinuationPackets(count int) {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	injector.droppedContinuations = faultCount(count)
+}
+
+func (injector *FaultInjector) Clear() {
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	injector.ctapErrors = make(map[uint8]*ctapErrorFault)
+	injector.corruptSignatures = 0
+	injector.staleCounters = 0
+	injector.responseDelay = 0
+	injector.droppedContinuations = 0
+}
+
+func (injector *FaultInjector) CTAPError(command uint8) (uint8, bool) {
+	if injector == nil {
+		return 0, false
+	}
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	fault, ok := injector.ctapErrors[command]
+	if !ok || !fault.count.take() {
+		return 0, false
+	}
+	faultLogger.Printf("Forcing CTAP status 0x%x for command 0x%x\n\n", fault.status, command)
+	return fault.status, true
+}
+
+// MaybeCorruptSignature returns the signature, with a bit flipped if a corruption is pending
+func (injector *FaultInjector) MaybeCorruptSignature(signature []byte) []byte {
+	if injector == nil || len(signature) == 0 {
+		return signature
+	}
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	if !injector.corruptSignatures.take() {
+		return signature
+	}
+	faultLogger.Printf("Corrupting signature\n\n")
+	corrupted := append([]byte{}, signature...)
+	corrupted[len(corrupted)-1] ^= 0x01
+	return corrupted
+}
+
+// MaybeStaleCounter returns the counter, or the one before it if a stale counter is pending
+func (injector *FaultInjector) MaybeStaleCounter(counter uint32) uint32 {
+	if injector == nil || counter == 0 {
+		return counter
+	}
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	if !injector.staleCounters.take() {
+		return counter
+	}
+	faultLogger.Printf("Reporting stale counter %d\n\n", counter-1)
+	return counter - 1
+}
+
+func (injector *FaultInjector) ResponseDelay() time.Duration {
+	if injector == nil {
+		return 0
+	}
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	return injector.responseDelay
+}
+
+// MaybeDropContinuationPacket removes the first continuation packet of a response
+// if a drop is pending
+func (injector *FaultInjector) MaybeDropContinuationPacket(packets [][]byte) [][]byte {
+	if injector == nil || len(packets) < 2 {
+		return packets
+	}
+	injector.lock.Lock()
+	defer injector.lock.Unlock()
+	if !injector.droppedContinuations.take() {
+		return packets
+	}
+	faultLogger.Printf("Dropping continuation packet\n\n")
+	return append([][]byte{packets[0]}, packets[2:]...)
+}
@@ -0,0 +1,42 @@
+package fault_injection
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestNilInjector(t *testing.T) {
+	var injector *FaultInjector
+	_, ok := injector.CTAPError(0x01)
+	test.Assert(t, !ok, "Nil injector should not force errors")
+	test.AssertEqual(t, injector.MaybeStaleCounter(5), uint32(5), "Nil injector should not change counters")
+	test.Assert(t, bytes.Equal(injector.MaybeCorruptSignature([]byte{1, 2}), []byte{1, 2}), "Nil injector should not corrupt signatures")
+}
+
+func TestFaultCounts(t *testing.T) {
+	injector := NewFaultInjector()
+	injector.ForceCTAPError(0x02, 0x27, 1)
+	status, ok := injector.CTAPError(0x02)
+	test.Assert(t, ok && status == 0x27, "Error should be forced once")
+	_, ok = injector.CTAPError(0x02)
+	test.Assert(t, !ok, "Error should only be forced once")
+
+	injector.StaleCounters(Always)
+	for i := 0; i < 3; i++ {
+		test.AssertEqual(t, injector.MaybeStaleCounter(10), uint32(9), "Counter should always be stale")
+	}
+	injector.Clear()
+	test.AssertEqual(t, injector.MaybeStaleCounter(10), uint32(10), "Cleared injector should not change counters")
+
+	injector.CorruptSignatures(1)
+	signature := []byte{1, 2, 3}
+	test.Assert(t, !bytes.Equal(injector.MaybeCorruptSignature(signature), signature), "Signature should be corrupted")
+	test.Assert(t, bytes.Equal(signature, []byte{1, 2, 3}), "Original signature should not be modified")
+
+	injector.DropContinuationPackets(1)
+	packets := injector.MaybeDropContinuationPacket([][]byte{{0}, {1}, {2}})
+	test.AssertEqual(t, len(packets), 2, "A continuation packet should be dropped")
+	test.AssertEqual(t, packets[1][0], byte(2), "The first continuation packet should be dropped")
+}
@@ -0,0 +1,47 @@
+package fido_client
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+func TestApprovalDisplayMetadata(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	approver := client.requestApprover.(*countingApprover)
+	server := ctap.NewCTAPServer(client)
+	rpIcon := "data:image/png;base64,cnA="
+	userIcon := "https://example.com/alice.png"
+
+	args := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "example.com", "name": "Example", "icon": rpIcon},
+		3: map[string]interface{}{"id": []byte{1, 2, 3}, "name": "alice", "displayName": "Alice", "icon": userIcon},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+		7: map[string]bool{"rk": true},
+	}
+	response := server.HandleMessage(append([]byte{0x01}, util.MarshalCBOR(args)...))
+	test.AssertEqual(t, response[0], byte(0), "Could not make credential")
+	expected := ClientActionRequestParams{
+		RelyingParty:     "Example",
+		RelyingPartyID:   "example.com",
+		UserName:         "alice",
+		UserDisplayName:  "Alice",
+		RelyingPartyIcon: rpIcon,
+		UserIcon:         userIcon,
+	}
+	test.AssertEqual(t, approver.params, expected, "Account creation approval should describe the RP and user")
+
+	// Login only has the RP ID, so the rest comes from the stored credential
+	assertion := map[int]interface{}{
+		1: "example.com",
+		2: crypto.HashSHA256([]byte("client data")),
+	}
+	response = server.HandleMessage(append([]byte{0x02}, util.MarshalCBOR(assertion)...))
+	test.AssertEqual(t, response[0], byte(0), "Could not get assertion")
+	test.AssertEqual(t, approver.params, expected, "Login approval should describe the stored RP and user")
+}
@@ -0,0 +1,91 @@
+package fido_client
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type ApprovalRequest struct {
+	Action ClientAction
+	Params ClientActionRequestParams
+}
+
+func (request ApprovalRequest) Title() string {
+	return fmt.Sprintf("Virtual FIDO: %s requested", request.Action)
+}
+
+func (request ApprovalRequest) Details() string {
+	return strings.TrimSpace(formatApprovalDetails(request.Action, request.Params))
+}
+
+// ApprovalUI is implemented by GUI frontends. Approve must return immediately;
+// the user's decision is delivered on the returned channel.
+type ApprovalUI interface {
+	Approve(request ApprovalRequest) <-chan bool
+}
+
+type approvalUIApprover struct {
+	ui      ApprovalUI
+	timeout time.Duration
+}
+
+// NewApprovalUIApprover adapts an ApprovalUI to a ClientRequestApprover. Requests
+// that aren't answered within the timeout are denied; a zero timeout waits forever.
+func NewApprovalUIApprover(ui ApprovalUI, timeout time.Duration) ClientRequestApprover {
+	return &approvalUIApprover{ui: ui, timeout: timeout}
+}
+
+func (approver *approvalUIApprover) ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool {
+	result := approver.ui.Approve(ApprovalRequest{Action: action, Params: params})
+	var timeout <-chan time.Time
+	if approver.timeout > 0 {
+		timer := time.NewTimer(approver.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case approved := <-result:
+		return approved
+	case <-timeout:
+		clientLogger.Printf("Approval for %s timed out\n\n", action)
+		return false
+	}
+}
+
+// commandRunner runs a notification helper and returns what it printed, exec.Cmd.Output
+// unless a test stubs it
+type commandRunner func(cmd *exec.Cmd) ([]byte, error)
+
+func (run commandRunner) output(cmd *exec.Cmd) ([]byte, error) {
+	if run == nil {
+		return cmd.Output()
+	}
+	return run(cmd)
+}
+
+// findApprovalCommand looks up a notification helper, so a missing one is reported when the
+// UI is created rather than as a denial of every request
+func findApprovalCommand(name string, description string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("Desktop notifications need %s: %w", description, err)
+	}
+	return path, nil
+}
+
+// Runs a notification helper and approves if it prints the approve action
+func runApprovalCommand(run commandRunner, cmd *exec.Cmd, approveAction string) <-chan bool {
+	result := make(chan bool, 1)
+	go func() {
+		output, err := run.output(cmd)
+		if err != nil {
+			clientLogger.Printf("ERROR: Approval command %s failed, denying: %s\n\n", cmd.Path, err)
+			result <- false
+			return
+		}
+		result <- strings.TrimSpace(string(output)) == approveAction
+	}()
+	return result
+}
@@ -0,0 +1,46 @@
+package fido_client
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+// stubRunner answers every command with output, recording the commands it was given
+type stubRunner struct {
+	output   string
+	err      error
+	commands chan *exec.Cmd
+}
+
+func newStubRunner(output string, err error) *stubRunner {
+	return &stubRunner{output: output, err: err, commands: make(chan *exec.Cmd, 1)}
+}
+
+func (runner *stubRunner) run(cmd *exec.Cmd) ([]byte, error) {
+	runner.commands <- cmd
+	return []byte(runner.output), runner.err
+}
+
+func TestRunApprovalCommand(t *testing.T) {
+	approved := newStubRunner("approve\n", nil)
+	test.Assert(t, <-runApprovalCommand(approved.run, exec.Command("helper"), "approve"), "Printing the approve action should approve")
+	denied := newStubRunner("deny\n", nil)
+	test.Assert(t, !<-runApprovalCommand(denied.run, exec.Command("helper"), "approve"), "Other output should deny")
+	failed := newStubRunner("approve\n", errors.New("exit status 1"))
+	test.Assert(t, !<-runApprovalCommand(failed.run, exec.Command("helper"), "approve"), "A failed command should deny")
+}
+
+type silentApprovalUI struct{}
+
+func (silentApprovalUI) Approve(request ApprovalRequest) <-chan bool {
+	return make(chan bool)
+}
+
+func TestApprovalUITimeout(t *testing.T) {
+	approver := NewApprovalUIApprover(silentApprovalUI{}, 10*time.Millisecond)
+	test.Assert(t, !approver.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{}), "Unanswered approvals should be denied")
+}
@@ -0,0 +1,413 @@
+package fido_client
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// VirtualAuthenticatorOptions mirrors the authenticator configuration of the
+// WebDriver Virtual Authenticator extension
+type VirtualAuthenticatorOptions struct {
+	Protocol            string `json:"protocol"`
+	Transport           string `json:"transport"`
+	HasResidentKey      bool   `json:"hasResidentKey"`
+	HasUserVerification bool   `json:"hasUserVerification"`
+	IsUserConsenting    bool   `json:"isUserConsenting"`
+	IsUserVerified      bool   `json:"isUserVerified"`
+	// BE and BS flags of credentials created while automation is enabled
+	DefaultBackupEligibility bool `json:"defaultBackupEligibility"`
+	DefaultBackupState       bool `json:"defaultBackupState"`
+}
+
+func DefaultVirtualAuthenticatorOptions() VirtualAuthenticatorOptions {
+	return VirtualAuthenticatorOptions{
+		Protocol:            "ctap2",
+		Transport:           "usb",
+		HasResidentKey:      true,
+		HasUserVerification: false,
+		IsUserConsenting:    true,
+		IsUserVerified:      false,
+	}
+}
+
+// VirtualCredential mirrors the WebDriver Credential Parameters. The private key
+// is a PKCS#8 encoded P-256 key. All credentials are stored in the vault, so
+// non-resident credentials are still discoverable.
+type VirtualCredential struct {
+	CredentialID         []byte `json:"credentialId"`
+	IsResidentCredential bool   `json:"isResidentCredential"`
+	RPID                 string `json:"rpId"`
+	PrivateKey           []byte `json:"privateKey"`
+	UserHandle           []byte `json:"userHandle,omitempty"`
+	SignCount            int32  `json:"signCount"`
+	BackupEligibility    bool   `json:"backupEligibility"`
+	BackupState          bool   `json:"backupState"`
+}
+
+// AutomationController scripts user presence, user verification and credentials
+// so that test suites can drive the device without a human approving requests
+type AutomationController struct {
+	client        *DefaultFIDOClient
+	lock          sync.Mutex
+	options       VirtualAuthenticatorOptions
+	failNext      map[ClientAction]int
+	approvalDelay time.Duration
+}
+
+// EnableAutomation puts the client in test automation mode: approvals are answered
+// from the options instead of the ClientRequestApprover
+func (client *DefaultFIDOClient) EnableAutomation(options VirtualAuthenticatorOptions) (*AutomationController, error) {
+	if options.Protocol != "ctap2" && options.Protocol != "" {
+		return nil, fmt.Errorf("Unsupported virtual authenticator protocol: %q", options.Protocol)
+	}
+	if options.Transport != "usb" && options.Transport != "" {
+		return nil, fmt.Errorf("Unsupported virtual authenticator transport: %q", options.Transport)
+	}
+	controller := &AutomationController{
+		client:   client,
+		options:  options,
+		failNext: make(map[ClientAction]int),
+	}
+	client.automation = controller
+	return controller, nil
+}
+
+func (client *DefaultFIDOClient) DisableAutomation() {
+	client.automation = nil
+}
+
+func (controller *AutomationController) Options() VirtualAuthenticatorOptions {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	return controller.options
+}
+
+func (controller *AutomationController) SetUserVerified(verified bool) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.options.IsUserVerified = verified
+}
+
+func (controller *AutomationController) SetUserConsenting(consenting bool) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.options.IsUserConsenting = consenting
+}
+
+// InjectFailure denies the next count requests for the action, regardless of consent
+func (controller *AutomationController) InjectFailure(action ClientAction, count int) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.failNext[action] += count
+}
+
+// SetApprovalDelay simulates the time a user takes to touch the device
+func (controller *AutomationController) SetApprovalDelay(delay time.Duration) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	controller.approvalDelay = delay
+}
+
+func (controller *AutomationController) approve(action ClientAction, params ClientActionRequestParams) bool {
+	controller.lock.Lock()
+	delay := controller.approvalDelay
+	consenting := controller.options.IsUserConsenting
+	failed := controller.failNext[action] > 0
+	if failed {
+		controller.failNext[action]--
+	}
+	controller.lock.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if failed {
+		clientLogger.Printf("AUTOMATION: Injected failure for %s\n\n", action)
+		return false
+	}
+	clientLogger.Printf("AUTOMATION: %s for '%s' consenting=%t\n\n", action, params.RelyingPartyID, consenting)
+	return consenting
+}
+
+func (controller *AutomationController) supportsUserVerification() bool {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	return controller.options.HasUserVerification
+}
+
+func (controller *AutomationController) verifyUser() bool {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	return controller.options.HasUserVerification && controller.options.IsUserVerified
+}
+
+func (controller *AutomationController) AddCredential(credential VirtualCredential) error {
+	return controller.client.AddVirtualCredential(credential)
+}
+
+func (controller *AutomationController) Credentials() ([]VirtualCredential, error) {
+	return controller.client.VirtualCredentials()
+}
+
+// AddVirtualCredential stores a credential given to a virtual authenticator in the vault
+func (client *DefaultFIDOClient) AddVirtualCredential(credential VirtualCredential) error {
+	parsedKey, err := x509.ParsePKCS8PrivateKey(credential.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("Could not parse credential private key: %w", err)
+	}
+	privateKey, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("Credential private key is not an ECDSA key")
+	}
+	if len(credential.CredentialID) == 0 {
+		return fmt.Errorf("Credential ID is required")
+	}
+	if client.vault.GetIdentity(credential.CredentialID) != nil {
+		return fmt.Errorf("Credential already exists")
+	}
+	source := &identities.CredentialSource{
+		Type:             "public-key",
+		ID:               credential.CredentialID,
+		PrivateKey:       &cose.SupportedCOSEPrivateKey{ECDSA: privateKey},
+		RelyingParty:     &webauthn.PublicKeyCredentialRPEntity{ID: credential.RPID, Name: credential.RPID},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: credential.UserHandle},
+		SignatureCounter: credential.SignCount,
+		CreatedAt:        util.Now().UTC(),
+		BackupEligible:   credential.BackupEligibility,
+		BackedUp:         credential.BackupEligibility && credential.BackupState,
+	}
+	client.vault.AddIdentity(source)
+	client.saveData()
+	return nil
+}
+
+// UpdateVirtualCredential stores a credential a virtual authenticator created or used,
+// adding it if it's new and otherwise advancing its signature counter
+func (client *DefaultFIDOClient) UpdateVirtualCredential(credential VirtualCredential) error {
+	source := client.vault.GetIdentity(credential.CredentialID)
+	if source == nil {
+		return client.AddVirtualCredential(credential)
+	}
+	if credential.SignCount <= source.SignatureCounter {
+		return nil
+	}
+	source.SignatureCounter = credential.SignCount
+	source.LastUsedAt = util.Now().UTC()
+	source.UsageCount++
+	client.saveData()
+	return nil
+}
+
+// VirtualCredentials returns the credentials a virtual authenticator can hold, which are
+// the vault's ECDSA credentials
+func (client *DefaultFIDOClient) VirtualCredentials() ([]VirtualCredential, error) {
+	credentials := make([]VirtualCredential, 0)
+	for _, source := range client.vault.All() {
+		if source.PrivateKey.ECDSA == nil {
+			continue
+		}
+		key, err := x509.MarshalPKCS8PrivateKey(source.PrivateKey.ECDSA)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode private key: %w", err)
+		}
+		credentials = append(credentials, VirtualCredential{
+			CredentialID:         source.ID,
+			IsResidentCredential: true,
+			RPID:                 source.RelyingParty.ID,
+			PrivateKey:           key,
+			UserHandle:           source.User.ID,
+			SignCount:            source.SignatureCounter,
+			BackupEligibility:    source.BackupEligible,
+			BackupState:          source.BackedUp,
+		})
+	}
+	return credentials, nil
+}
+
+// SetCredentialProperties changes the backup state of a credential, as the WebDriver Set
+// Credential Properties command does. Backup eligibility is left alone when nil.
+func (controller *AutomationController) SetCredentialProperties(id []byte, backupEligibility *bool, backupState *bool) bool {
+	source := controller.client.vault.GetIdentity(id)
+	if source == nil {
+		return false
+	}
+	if backupEligibility != nil {
+		source.BackupEligible = *backupEligibility
+	}
+	if backupState != nil {
+		source.BackedUp = *backupState
+	}
+	controller.client.saveData()
+	return true
+}
+
+func (controller *AutomationController) RemoveCredential(id []byte) bool {
+	return controller.client.DeleteIdentity(id)
+}
+
+func (controller *AutomationController) RemoveAllCredentials() {
+	err := controller.client.vault.Replace(nil)
+	util.CheckErr(err, "Could not delete credentials")
+	controller.client.saveData()
+}
+
+// Handler serves the credential and user verification commands of the WebDriver
+// Virtual Authenticator extension as JSON, relative to where it's mounted:
+//
+//	GET    credentials       list credentials
+//	POST   credential        add a credential
+//	DELETE credentials       remove all credentials
+//	DELETE credentials/{id}  remove a credential (base64url ID)
+//	POST   credentials/{id}/props  {"backupEligibility": bool, "backupState": bool}
+//	POST   uv                {"isUserVerified": bool}
+//
+// Binary fields use base64url as in the WebDriver protocol.
+func (controller *AutomationController) Handler() http.Handler {
+	return http.HandlerFunc(controller.serveHTTP)
+}
+
+type webDriverCredential struct {
+	CredentialID         string `json:"credentialId"`
+	IsResidentCredential bool   `json:"isResidentCredential"`
+	RPID                 string `json:"rpId"`
+	PrivateKey           string `json:"privateKey"`
+	UserHandle           string `json:"userHandle,omitempty"`
+	SignCount            int32  `json:"signCount"`
+	BackupEligibility    bool   `json:"backupEligibility"`
+	BackupState          bool   `json:"backupState"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": "invalid argument", "message": err.Error()})
+}
+
+func (controller *AutomationController) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	route := strings.Trim(r.URL.Path, "/")
+	switch {
+	case route == "credentials" && r.Method == http.MethodGet:
+		credentials, err := controller.Credentials()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		encoded := make([]webDriverCredential, 0, len(credentials))
+		for _, credential := range credentials {
+			encoded = append(encoded, webDriverCredential{
+				CredentialID:         base64.RawURLEncoding.EncodeToString(credential.CredentialID),
+				IsResidentCredential: credential.IsResidentCredential,
+				RPID:                 credential.RPID,
+				PrivateKey:           base64.RawURLEncoding.EncodeToString(credential.PrivateKey),
+				UserHandle:           base64.RawURLEncoding.EncodeToString(credential.UserHandle),
+				SignCount:            credential.SignCount,
+				BackupEligibility:    credential.BackupEligibility,
+				BackupState:          credential.BackupState,
+			})
+		}
+		writeJSON(w, http.StatusOK, encoded)
+	case route == "credential" && r.Method == http.MethodPost:
+		var encoded webDriverCredential
+		err := json.NewDecoder(r.Body).Decode(&encoded)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		credential, err := decodeWebDriverCredential(encoded)
+		if err == nil {
+			err = controller.AddCredential(*credential)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, nil)
+	case route == "credentials" && r.Method == http.MethodDelete:
+		controller.RemoveAllCredentials()
+		writeJSON(w, http.StatusOK, nil)
+	case strings.HasPrefix(route, "credentials/") && r.Method == http.MethodDelete:
+		id, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(route, "credentials/"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !controller.RemoveCredential(id) {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("No credential with that ID"))
+			return
+		}
+		writeJSON(w, http.StatusOK, nil)
+	case strings.HasPrefix(route, "credentials/") && strings.HasSuffix(route, "/props") && r.Method == http.MethodPost:
+		id, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(route, "credentials/"), "/props"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		var body struct {
+			BackupEligibility *bool `json:"backupEligibility"`
+			BackupState       *bool `json:"backupState"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !controller.SetCredentialProperties(id, body.BackupEligibility, body.BackupState) {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("No credential with that ID"))
+			return
+		}
+		writeJSON(w, http.StatusOK, nil)
+	case route == "uv" && r.Method == http.MethodPost:
+		var body struct {
+			IsUserVerified bool `json:"isUserVerified"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		controller.SetUserVerified(body.IsUserVerified)
+		writeJSON(w, http.StatusOK, nil)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("Unknown command: %s %s", r.Method, route))
+	}
+}
+
+func decodeWebDriverCredential(encoded webDriverCredential) (*VirtualCredential, error) {
+	id, err := base64.RawURLEncoding.DecodeString(encoded.CredentialID)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid credentialId: %w", err)
+	}
+	privateKey, err := base64.RawURLEncoding.DecodeString(encoded.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid privateKey: %w", err)
+	}
+	userHandle, err := base64.RawURLEncoding.DecodeString(encoded.UserHandle)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid userHandle: %w", err)
+	}
+	return &VirtualCredential{
+		CredentialID:         id,
+		IsResidentCredential: encoded.IsResidentCredential,
+		RPID:                 encoded.RPID,
+		PrivateKey:           privateKey,
+		UserHandle:           userHandle,
+		SignCount:            encoded.SignCount,
+		BackupEligibility:    encoded.BackupEligibility,
+		BackupState:          encoded.BackupState,
+	}, nil
+}
@@ -0,0 +1,140 @@
+package fido_client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type memoryDataSaver struct {
+	data []byte
+}
+
+func (saver *memoryDataSaver) SaveData(data []byte) {
+	saver.data = data
+}
+
+func (saver *memoryDataSaver) RetrieveData() []byte {
+	return saver.data
+}
+
+func (saver *memoryDataSaver) Passphrase() string {
+	return "passphrase"
+}
+
+func makeCredential(server *ctap.CTAPServer, userVerification bool) []byte {
+	args := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "example.com", "name": "Example"},
+		3: map[string]interface{}{"id": []byte{1, 2, 3}, "name": "alice", "displayName": "Alice"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+	}
+	if userVerification {
+		args[7] = map[string]bool{"uv": true}
+	}
+	return server.HandleMessage(append([]byte{0x01}, util.MarshalCBOR(args)...))
+}
+
+func TestAutomationUserVerification(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	server := ctap.NewCTAPServer(client)
+	options := DefaultVirtualAuthenticatorOptions()
+	controller, err := client.EnableAutomation(options)
+	test.Assert(t, err == nil, "Could not enable automation")
+
+	response := makeCredential(server, true)
+	test.AssertEqual(t, response[0], byte(0x2B), "UV should be unsupported without hasUserVerification")
+
+	client.DisableAutomation()
+	options.HasUserVerification = true
+	options.IsUserVerified = true
+	controller, err = client.EnableAutomation(options)
+	test.Assert(t, err == nil, "Could not enable automation")
+	response = makeCredential(server, true)
+	test.AssertEqual(t, response[0], byte(0x00), "MakeCredential with UV should succeed")
+	var decoded map[int]interface{}
+	err = cbor.Unmarshal(response[1:], &decoded)
+	test.Assert(t, err == nil, "Could not decode response")
+	authData := decoded[2].([]byte)
+	test.Assert(t, authData[32]&0b101 == 0b101, fmt.Sprintf("UP and UV flags should be set: %b", authData[32]))
+
+	controller.SetUserVerified(false)
+	response = makeCredential(server, true)
+	test.AssertEqual(t, response[0], byte(0x27), "Failed UV should deny the request")
+
+	controller.InjectFailure(ClientActionFIDOMakeCredential, 1)
+	test.AssertEqual(t, makeCredential(server, false)[0], byte(0x27), "Injected failure should deny the request")
+	test.AssertEqual(t, makeCredential(server, false)[0], byte(0x00), "Injected failure should only apply once")
+
+	controller.SetUserConsenting(false)
+	test.AssertEqual(t, makeCredential(server, false)[0], byte(0x27), "Request should be denied without consent")
+}
+
+func TestAutomationHandler(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	controller, err := client.EnableAutomation(DefaultVirtualAuthenticatorOptions())
+	test.Assert(t, err == nil, "Could not enable automation")
+	server := httptest.NewServer(controller.Handler())
+	defer server.Close()
+
+	key, err := x509.MarshalPKCS8PrivateKey(crypto.GenerateECDSAKey())
+	test.Assert(t, err == nil, "Could not marshal key")
+	body := fmt.Sprintf(`{"credentialId":"AQID","isResidentCredential":true,"rpId":"example.com","privateKey":"%s","userHandle":"BAU","signCount":3}`,
+		base64.RawURLEncoding.EncodeToString(key))
+	response, err := http.Post(server.URL+"/credential", "application/json", bytes.NewBufferString(body))
+	test.Assert(t, err == nil, "Could not add credential")
+	test.AssertEqual(t, response.StatusCode, http.StatusOK, "Adding credential should succeed")
+
+	credentials, err := controller.Credentials()
+	test.Assert(t, err == nil, "Could not list credentials")
+	test.AssertEqual(t, len(credentials), 1, "Credential should be added")
+	test.Assert(t, bytes.Equal(credentials[0].CredentialID, []byte{1, 2, 3}), "Wrong credential ID")
+	test.AssertEqual(t, credentials[0].SignCount, int32(3), "Wrong sign count")
+
+	request, _ := http.NewRequest(http.MethodDelete, server.URL+"/credentials/AQID", nil)
+	response, err = http.DefaultClient.Do(request)
+	test.Assert(t, err == nil, "Could not remove credential")
+	test.AssertEqual(t, response.StatusCode, http.StatusOK, "Removing credential should succeed")
+	test.AssertEqual(t, len(client.ListCredentials()), 0, "Credential should be removed")
+}
+
+func TestAutomationBackupState(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	server := ctap.NewCTAPServer(client)
+	options := DefaultVirtualAuthenticatorOptions()
+	options.DefaultBackupEligibility = true
+	controller, err := client.EnableAutomation(options)
+	test.Assert(t, err == nil, "Could not enable automation")
+
+	response := makeCredential(server, false)
+	test.AssertEqual(t, response[0], byte(0x00), "MakeCredential should succeed")
+	var decoded map[int]interface{}
+	err = cbor.Unmarshal(response[1:], &decoded)
+	test.Assert(t, err == nil, "Could not decode response")
+	authData := decoded[2].([]byte)
+	test.Assert(t, authData[32]&0b11000 == 0b01000, fmt.Sprintf("Only the BE flag should be set: %b", authData[32]))
+
+	credentials, err := controller.Credentials()
+	test.Assert(t, err == nil, "Could not list credentials")
+	test.Assert(t, credentials[0].BackupEligibility && !credentials[0].BackupState, "Credential should be eligible but not backed up")
+
+	httpServer := httptest.NewServer(controller.Handler())
+	defer httpServer.Close()
+	id := base64.RawURLEncoding.EncodeToString(credentials[0].CredentialID)
+	httpResponse, err := http.Post(httpServer.URL+"/credentials/"+id+"/props", "application/json", bytes.NewBufferString(`{"backupState":true}`))
+	test.Assert(t, err == nil, "Could not set credential properties")
+	test.AssertEqual(t, httpResponse.StatusCode, http.StatusOK, "Setting credential properties should succeed")
+	credentials, _ = controller.Credentials()
+	test.Assert(t, credentials[0].BackupEligibility && credentials[0].BackupState, "Credential should be backed up")
+}
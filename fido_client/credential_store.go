@@ -0,0 +1,32 @@
+package fido_client
+
+import "github.com/bulwarkid/virtual-fido/identities"
+
+// WithCredentialStore returns saver with the vault's credentials kept in store, e.g. a
+// database, instead of in the data it saves. Requests then only read and write the
+// credentials they use, and saving the vault no longer encrypts every credential.
+func WithCredentialStore(saver ClientDataSaver, store identities.CredentialStore) ClientDataSaver {
+	stored := &storedCredentialsSaver{ClientDataSaver: saver, CredentialStore: store}
+	if _, ok := saver.(RollbackCounter); ok {
+		return &countedStoredCredentialsSaver{stored}
+	}
+	return stored
+}
+
+type storedCredentialsSaver struct {
+	ClientDataSaver
+	identities.CredentialStore
+}
+
+// countedStoredCredentialsSaver keeps the RollbackCounter of the saver it wraps
+type countedStoredCredentialsSaver struct {
+	*storedCredentialsSaver
+}
+
+func (saver *countedStoredCredentialsSaver) RollbackCounter() uint64 {
+	return saver.ClientDataSaver.(RollbackCounter).RollbackCounter()
+}
+
+func (saver *countedStoredCredentialsSaver) SetRollbackCounter(version uint64) {
+	saver.ClientDataSaver.(RollbackCounter).SetRollbackCounter(version)
+}
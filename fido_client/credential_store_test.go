@@ -0,0 +1,58 @@
+package fido_client
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/credential_db"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func openTestCredentialDB(t *testing.T) *credential_db.DB {
+	db, err := credential_db.Open(filepath.Join(t.TempDir(), "credentials.db"), "passphrase", identities.DefaultArgon2idParameters())
+	test.Assert(t, err == nil, "Could not open credential database")
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCredentialStore(t *testing.T) {
+	db := openTestCredentialDB(t)
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, WithCredentialStore(saver, db.Profile("default")))
+	server := ctap.NewCTAPServer(client)
+	credentialID := makeCredentialWithResidentKey(server, true)
+	test.Assert(t, credentialID != nil, "Could not make credential")
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0), "Could not get assertion")
+
+	state, err := identities.DecryptFIDOState(saver.data, saver.Passphrase())
+	test.Assert(t, err == nil, "Could not decrypt vault")
+	test.Assert(t, state.CredentialsStored, "Vault should say its credentials are stored")
+	test.AssertEqual(t, len(state.Sources), 0, "Credentials shouldn't be saved in the vault")
+	stored, err := db.Profile("default").Credential(credentialID)
+	test.Assert(t, err == nil && stored != nil, "Credential should be in the store")
+	test.AssertEqual(t, stored.SignatureCounter, int32(1), "Assertion should update the stored counter")
+
+	restarted := newTestClient(t, WithCredentialStore(saver, db.Profile("default")))
+	test.AssertEqual(t, getAssertion(ctap.NewCTAPServer(restarted), credentialID), byte(0), "Stored credential should work after a restart")
+	test.Assert(t, loadPanics(t, saver), "Vault shouldn't load without its credential store")
+}
+
+func TestCredentialStoreMigration(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	credentialID := makeCredentialWithResidentKey(ctap.NewCTAPServer(client), true)
+	test.Assert(t, credentialID != nil, "Could not make credential")
+
+	db := openTestCredentialDB(t)
+	migrated := newTestClient(t, WithCredentialStore(saver, db.Profile("default")))
+	test.AssertEqual(t, migrated.ResidentCredentialCount(), 1, "Vault credentials should move into the store")
+	test.AssertEqual(t, getAssertion(ctap.NewCTAPServer(migrated), credentialID), byte(0), "Moved credential should work")
+	state, _ := identities.DecryptFIDOState(saver.data, saver.Passphrase())
+	test.AssertEqual(t, len(state.Sources), 0, "Saving should drop the credentials from the vault")
+
+	migrated.ResetVault()
+	count, _ := db.Profile("default").CredentialCount()
+	test.AssertEqual(t, count, 0, "Reset should delete the stored credentials")
+}
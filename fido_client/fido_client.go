@@ -1,13 +1,21 @@
 package fido_client
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"crypto/sha256"
 	"crypto/x509"
-	"log"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/events"
 	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/metrics"
 	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
 )
@@ -15,8 +23,16 @@ import (
 type ClientAction uint8
 
 type ClientActionRequestParams struct {
-	RelyingParty string
-	UserName     string
+	RelyingParty    string
+	RelyingPartyID  string
+	UserName        string
+	UserDisplayName string
+	// Image URLs from the request or stored with the credential, for UIs that can show them.
+	// They come from the RP, so they're untrusted and often data: URLs.
+	RelyingPartyIcon string
+	UserIcon         string
+	// Text the RP asked the user to confirm with the txAuthSimple extension
+	Transaction string
 }
 
 const (
@@ -24,35 +40,102 @@ const (
 	ClientActionU2FAuthenticate    ClientAction = 1
 	ClientActionFIDOMakeCredential ClientAction = 2
 	ClientActionFIDOGetAssertion   ClientAction = 3
+	ClientActionSelection          ClientAction = 4
+	ClientActionTransaction        ClientAction = 5
+	ClientActionReset              ClientAction = 6
 )
 
-var clientLogger *log.Logger = util.NewLogger("[CLIENT] ", util.LogLevelDebug)
+var clientActionDescriptions = map[ClientAction]string{
+	ClientActionU2FRegister:        "U2F registration",
+	ClientActionU2FAuthenticate:    "U2F authentication",
+	ClientActionFIDOMakeCredential: "Account creation",
+	ClientActionFIDOGetAssertion:   "Account login",
+	ClientActionSelection:          "Authenticator selection",
+	ClientActionTransaction:        "Transaction confirmation",
+	ClientActionReset:              "Authenticator reset",
+}
+
+func (action ClientAction) String() string {
+	if description, ok := clientActionDescriptions[action]; ok {
+		return description
+	}
+	return fmt.Sprintf("Unknown action %d", action)
+}
+
+var clientLogger = util.NewLogger("[CLIENT] ", util.LogSubsystemVault, util.LogLevelDebug)
+
+var approvalWaitDuration = metrics.NewHistogram("virtual_fido_approval_wait_seconds", "Time spent waiting for the user to approve a request", metrics.DefaultBuckets, "action", "approved")
 
 type ClientRequestApprover interface {
 	ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool
 }
 
+// SaveData should replace the saved data atomically, e.g. by writing a new file and renaming
+// it over the old one, so the PIN retry counter is never lost to a crash
 type ClientDataSaver interface {
 	SaveData(data []byte)
 	RetrieveData() []byte
 	Passphrase() string
 }
 
+// RollbackCounter can be implemented by a ClientDataSaver that stores a counter outside the
+// vault, e.g. in a TPM or a separate file. The vault's version is recorded after every save,
+// and an older vault is refused, so restoring an old copy can't reset the PIN retries.
+type RollbackCounter interface {
+	RollbackCounter() uint64
+	SetRollbackCounter(version uint64)
+}
+
 type DefaultFIDOClient struct {
 	deviceEncryptionKey   []byte
 	certificateAuthority  *x509.Certificate
 	certPrivateKey        *cose.SupportedCOSEPrivateKey
 	authenticationCounter uint32
+	aaguid                [16]byte
+	serialNumber          string
+	alwaysUV              bool
+	attestationFormat     AttestationFormat
+	androidKeyDescription *identities.AndroidKeyDescription
+	// Intermediate CAs between certificateAuthority and attestation certificates
+	attestationIntermediateCount int
+	attestationChain             *attestationChain
+	attestationChainLock         *sync.Mutex
+	// Whether the vault holds the serial number, AAGUID and attestation CA in use
+	identitySaved bool
 
 	pinEnabled      bool
-	pinToken        []byte
 	pinKeyAgreement *crypto.ECDHKey
 	pinRetries      int32
 	pinHash         []byte
+	uvRetries       int32
+	// Increases on every save, see RollbackCounter
+	pinStateVersion uint64
 
 	vault           *identities.IdentityVault
+	importedU2FKeys []identities.SavedU2FKeyHandle
+	piv             *identities.PIVState
+	otpSlots        map[int]*identities.OTPSlot
 	requestApprover ClientRequestApprover
 	dataSaver       ClientDataSaver
+	automation      *AutomationController
+	// Stretch the passphrase into the vault key
+	kdfParameters identities.Argon2idParameters
+	// Create non-resident credentials without storing them
+	derivedCredentials bool
+	credentialIDFormat CredentialIDFormat
+	vaultSaved         bool
+	backupEligibility  BackupEligibility
+	// Most credentials the vault may hold, or 0 for no limit
+	maxCredentials int
+	// Peers and deleted credentials, once sync has been used
+	syncState *identities.SavedSyncState
+	// Vault records saved by a newer version, kept so saving doesn't drop them
+	unknownVaultRecords []identities.VaultRecord
+	// Held for reading by each request, and for writing while the vault is reloaded
+	transactionLock *sync.RWMutex
+	savedDataLock   *sync.Mutex
+	// Hash of the vault as this client last saved or loaded it, to notice changes by others
+	savedDataHash []byte
 }
 
 func NewDefaultClient(
@@ -68,43 +151,274 @@ func NewDefaultClient(
 		certificateAuthority:  rootAttestationCertificate,
 		certPrivateKey:        rootAttestationCertPrivateKey,
 		authenticationCounter: 1,
-		pinToken:              crypto.RandomBytes(16),
+		aaguid:                identities.DefaultAAGUID,
+		attestationFormat:     AttestationFormatPacked,
+		serialNumber:          identities.NewSerialNumber(),
 		pinKeyAgreement:       crypto.GenerateECDHKey(),
-		pinRetries:            8,
+		pinRetries:            identities.DefaultPINRetries,
 		pinHash:               nil,
-		vault:                 identities.NewIdentityVault(),
+		uvRetries:             identities.DefaultPINRetries,
+		vault:                 newIdentityVault(dataSaver),
+		piv:                   identities.NewPIVState(),
+		otpSlots:              make(map[int]*identities.OTPSlot),
 		requestApprover:       requestApprover,
 		dataSaver:             dataSaver,
+		kdfParameters:         identities.DefaultArgon2idParameters(),
+		transactionLock:       &sync.RWMutex{},
+		savedDataLock:         &sync.Mutex{},
+		attestationChainLock:  &sync.Mutex{},
 	}
 	client.loadData()
 	return client
 }
 
 func (client *DefaultFIDOClient) SupportsResidentKey() bool {
+	if client.automation != nil {
+		return client.automation.Options().HasResidentKey
+	}
 	return true
 }
 
+func (client *DefaultFIDOClient) SupportsUserVerification() bool {
+	if client.automation != nil {
+		return client.automation.supportsUserVerification()
+	}
+	return false
+}
+
+func (client *DefaultFIDOClient) VerifyUser() bool {
+	if client.automation != nil {
+		return client.automation.verifyUser()
+	}
+	return false
+}
+
+func (client *DefaultFIDOClient) approve(action ClientAction, params ClientActionRequestParams) bool {
+	start := time.Now()
+	var approved bool
+	if client.automation != nil {
+		approved = client.automation.approve(action, params)
+	} else {
+		approved = client.requestApprover.ApproveClientAction(action, params)
+	}
+	approvalWaitDuration.ObserveSince(start, action.String(), strconv.FormatBool(approved))
+	return approved
+}
+
+func supportsES256(PubKeyCredParams []webauthn.PublicKeyCredentialParams) bool {
+	for _, param := range PubKeyCredParams {
+		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCredentialSource creates a resident credential, replacing any resident credential the
+// vault already has for the same RP and user account
 func (client *DefaultFIDOClient) NewCredentialSource(
 	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
 	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
 	relyingParty *webauthn.PublicKeyCredentialRPEntity,
 	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
-	supported := false
-	for _, param := range PubKeyCredParams {
-		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
-			supported = true
-			break
+	if !supportsES256(PubKeyCredParams) {
+		return nil
+	}
+	if existing := client.residentCredential(relyingParty, user); existing != nil {
+		clientLogger.Printf("Replacing credential %x for %s\n\n", existing.ID, relyingParty.ID)
+		client.deleteCredential(existing.ID)
+	}
+	return client.newStoredCredentialSource(relyingParty, user)
+}
+
+// residentCredential is the credential NewCredentialSource replaces for user
+func (client *DefaultFIDOClient) residentCredential(
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
+	for _, existing := range client.vault.GetMatchingCredentialSources(relyingParty.ID, nil) {
+		if len(user.ID) > 0 && bytes.Equal(existing.User.ID, user.ID) {
+			return existing
 		}
 	}
-	if !supported {
-		return nil
+	return nil
+}
+
+// SetMaxCredentials limits how many credentials the vault holds, 0 for no limit, so RPs can
+// be tested against a full authenticator. Credentials that aren't stored, i.e. derived or
+// wrapped non-resident ones, don't count. A vault that's already fuller keeps its
+// credentials but takes no new ones.
+func (client *DefaultFIDOClient) SetMaxCredentials(max int) {
+	client.maxCredentials = max
+}
+
+func (client *DefaultFIDOClient) CanStoreCredential(
+	residentKey bool,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	if client.maxCredentials == 0 {
+		return true
+	}
+	if residentKey && client.residentCredential(relyingParty, user) != nil {
+		return true
 	}
-	newSource := client.vault.NewIdentity(relyingParty, user)
+	if !residentKey && (client.derivedCredentials || client.credentialIDFormat == CredentialIDFormatWrapped) {
+		return true
+	}
+	return client.vault.Count() < client.maxCredentials
+}
+
+func (client *DefaultFIDOClient) ResidentCredentialCount() int {
+	return client.vault.Count()
+}
+
+func (client *DefaultFIDOClient) RemainingResidentCredentials() int {
+	if client.maxCredentials == 0 {
+		return -1
+	}
+	if remaining := client.maxCredentials - client.vault.Count(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func (client *DefaultFIDOClient) newStoredCredentialSource(
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
+	idLength := identities.DefaultCredentialIDLength
+	if client.credentialIDFormat == CredentialIDFormatRandom32 {
+		idLength = 32
+	}
+	newSource := client.vault.NewIdentityWithIDLength(relyingParty, user, idLength)
+	client.setBackupFlags(newSource)
 	client.saveData()
 	return newSource
 }
 
+// BackupEligibility decides whether new credentials are multi-device credentials (passkeys)
+// that may be copied to other instances, which is reported to RPs with the BE flag. A
+// credential keeps the eligibility it was created with.
+type BackupEligibility uint8
+
+const (
+	// Eligible if this instance has sync peers when the credential is created
+	BackupEligibilitySync BackupEligibility = iota
+	BackupEligibilityNever
+	BackupEligibilityAlways
+)
+
+func (client *DefaultFIDOClient) SetBackupEligibility(eligibility BackupEligibility) {
+	client.backupEligibility = eligibility
+}
+
+func (client *DefaultFIDOClient) setBackupFlags(source *identities.CredentialSource) {
+	if client.automation != nil {
+		options := client.automation.Options()
+		source.BackupEligible = options.DefaultBackupEligibility
+		source.BackedUp = options.DefaultBackupEligibility && options.DefaultBackupState
+		return
+	}
+	switch client.backupEligibility {
+	case BackupEligibilitySync:
+		source.BackupEligible = client.syncState != nil && len(client.syncState.Peers) > 0
+	case BackupEligibilityAlways:
+		source.BackupEligible = true
+	}
+	// Not backed up until the next sync
+	source.BackedUp = false
+}
+
+// SetDerivedCredentials makes non-resident credentials derived from the device key instead
+// of stored in the vault, so they work statelessly. Derived credentials keep working after
+// it's turned off, until the vault is reset.
+func (client *DefaultFIDOClient) SetDerivedCredentials(enabled bool) {
+	client.derivedCredentials = enabled
+}
+
+// CredentialIDFormat chooses the IDs of new credentials that aren't derived
+type CredentialIDFormat uint8
+
+const (
+	// A random 16 byte ID of a credential stored in the vault
+	CredentialIDFormatRandom16 CredentialIDFormat = iota
+	// A random 32 byte ID of a credential stored in the vault
+	CredentialIDFormatRandom32
+	// The private key of a non-resident credential sealed into its ID like a U2F key handle,
+	// so it isn't stored. Resident credentials get random 16 byte IDs.
+	CredentialIDFormatWrapped
+)
+
+func (client *DefaultFIDOClient) SetCredentialIDFormat(format CredentialIDFormat) {
+	client.credentialIDFormat = format
+}
+
+func (client *DefaultFIDOClient) credentialDeriver() *identities.CredentialDeriver {
+	return identities.NewCredentialDeriver(crypto.HMACSHA256(client.deviceEncryptionKey, []byte("virtual-fido derived credentials")))
+}
+
+func (client *DefaultFIDOClient) NewNonResidentCredentialSource(
+	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
+	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
+	if !supportsES256(PubKeyCredParams) {
+		return nil
+	}
+	if !client.derivedCredentials && client.credentialIDFormat != CredentialIDFormatWrapped {
+		return client.newStoredCredentialSource(relyingParty, user)
+	}
+	if !client.vaultSaved {
+		// The device key of a new vault has to be kept to use the credential again
+		client.saveData()
+	}
+	if !client.derivedCredentials {
+		return client.newWrappedCredentialSource(relyingParty, user)
+	}
+	return client.credentialDeriver().NewCredential(relyingParty, user)
+}
+
+// newWrappedCredentialSource seals the private key into the credential ID, which opens as a
+// U2F key handle for the RP ID. A credential that doesn't fit in a U2F key handle is stored
+// instead.
+func (client *DefaultFIDOClient) newWrappedCredentialSource(
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
+	privateKey := crypto.GenerateECDSAKey()
+	encodedPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
+	util.CheckErr(err, "Could not encode private key")
+	applicationID := sha256.Sum256([]byte(relyingParty.ID))
+	id, err := webauthn.SealKeyHandle(client.deviceEncryptionKey, &webauthn.KeyHandle{PrivateKey: encodedPrivateKey, ApplicationID: applicationID[:]})
+	if err != nil {
+		clientLogger.Printf("ERROR: Could not wrap credential, storing it instead: %s\n\n", err)
+		return client.newStoredCredentialSource(relyingParty, user)
+	}
+	return &identities.CredentialSource{
+		Type:             "public-key",
+		ID:               id,
+		PrivateKey:       &cose.SupportedCOSEPrivateKey{ECDSA: privateKey},
+		RelyingParty:     relyingParty,
+		User:             user,
+		SignatureCounter: 0,
+		CreatedAt:        util.Now().UTC(),
+	}
+}
+
+func (client *DefaultFIDOClient) HasCredential(relyingPartyID string, id []byte) bool {
+	if client.credentialDeriver().Credential(relyingPartyID, id) != nil {
+		return true
+	}
+	if source := client.vault.GetIdentity(id); source != nil && source.RelyingParty.ID == relyingPartyID {
+		return true
+	}
+	return client.u2fKeyHandle(relyingPartyID, id) != nil
+}
+
 func (client *DefaultFIDOClient) GetAssertionSource(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource {
+	deriver := client.credentialDeriver()
+	for _, descriptor := range allowList {
+		if source := deriver.Credential(relyingPartyID, descriptor.ID); source != nil {
+			return source
+		}
+	}
 	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList)
 	if len(sources) == 0 {
 		clientLogger.Printf("ERROR: No Credentials\n\n")
@@ -113,24 +427,66 @@ func (client *DefaultFIDOClient) GetAssertionSource(relyingPartyID string, allow
 
 	// TODO: Allow user to choose credential source
 	credentialSource := sources[0]
-	credentialSource.SignatureCounter++
+	credentialSource.RecordUse()
 	client.saveData()
 	return credentialSource
 }
 
+// ApproveSelection asks the user to confirm this is the authenticator they want
+// to use, while the platform waits for a tap on one of several authenticators
+func (client *DefaultFIDOClient) ApproveSelection() bool {
+	clientLogger.Printf("WINK: Authenticator selection requested\n\n")
+	return client.approve(ClientActionSelection, ClientActionRequestParams{})
+}
+
+// ApproveReset asks the user before authenticatorReset deletes every credential and the PIN
+func (client *DefaultFIDOClient) ApproveReset() bool {
+	return client.approve(ClientActionReset, ClientActionRequestParams{})
+}
+
+// DisplayTransaction shows the text of a txAuthSimple request with the approval prompt.
+// Confirming it also approves the login it's part of.
+func (client *DefaultFIDOClient) DisplayTransaction(text string) bool {
+	return client.approve(ClientActionTransaction, ClientActionRequestParams{Transaction: text})
+}
+
+func (client *DefaultFIDOClient) SetCredBlob(credentialSource *identities.CredentialSource, credBlob []byte) {
+	credentialSource.CredBlob = credBlob
+	client.saveData()
+}
+
 func (client DefaultFIDOClient) ApproveAccountCreation(relyingParty string) bool {
+	return client.approve(ClientActionFIDOMakeCredential, ClientActionRequestParams{RelyingParty: relyingParty})
+}
+
+// ApproveUserAccountCreation asks for approval with the user account and icons, not just
+// the RP name
+func (client DefaultFIDOClient) ApproveUserAccountCreation(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) bool {
 	params := ClientActionRequestParams{
-		RelyingParty: relyingParty,
+		RelyingParty:     relyingParty.Name,
+		RelyingPartyID:   relyingParty.ID,
+		UserName:         user.Name,
+		UserDisplayName:  user.DisplayName,
+		RelyingPartyIcon: relyingParty.Icon,
+		UserIcon:         user.Icon,
 	}
-	return client.requestApprover.ApproveClientAction(ClientActionFIDOMakeCredential, params)
+	return client.approve(ClientActionFIDOMakeCredential, params)
 }
 
 func (client DefaultFIDOClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
+	if credentialSource.Policy == identities.CredentialPolicySilent {
+		clientLogger.Printf("Approving login to '%s' silently\n\n", credentialSource.RelyingParty.ID)
+		return true
+	}
 	params := ClientActionRequestParams{
-		RelyingParty: credentialSource.RelyingParty.Name,
-		UserName:     credentialSource.User.Name,
+		RelyingParty:     credentialSource.RelyingParty.Name,
+		RelyingPartyID:   credentialSource.RelyingParty.ID,
+		UserName:         credentialSource.User.Name,
+		UserDisplayName:  credentialSource.User.DisplayName,
+		RelyingPartyIcon: credentialSource.RelyingParty.Icon,
+		UserIcon:         credentialSource.User.Icon,
 	}
-	return client.requestApprover.ApproveClientAction(ClientActionFIDOGetAssertion, params)
+	return client.approve(ClientActionFIDOGetAssertion, params)
 }
 
 // -----------------------
@@ -166,20 +522,28 @@ func (client *DefaultFIDOClient) SetPINHash(newHash []byte) {
 }
 
 func (client *DefaultFIDOClient) PINRetries() int32 {
-	util.Assert(client.pinRetries > 0 && client.pinRetries <= 8, "Invalid PIN Retries")
+	util.Assert(client.pinRetries >= 0 && client.pinRetries <= identities.DefaultPINRetries, "Invalid PIN Retries")
 	return client.pinRetries
 }
 
+// SetPINRetries saves immediately, since the CTAP server decrements the retries before
+// checking a PIN
 func (client *DefaultFIDOClient) SetPINRetries(retries int32) {
 	client.pinRetries = retries
+	client.saveData()
 }
 
-func (client *DefaultFIDOClient) PINKeyAgreement() *crypto.ECDHKey {
-	return client.pinKeyAgreement
+func (client *DefaultFIDOClient) UVRetries() int32 {
+	return client.uvRetries
+}
+
+func (client *DefaultFIDOClient) SetUVRetries(retries int32) {
+	client.uvRetries = retries
+	client.saveData()
 }
 
-func (client *DefaultFIDOClient) PINToken() []byte {
-	return client.pinToken
+func (client *DefaultFIDOClient) PINKeyAgreement() *crypto.ECDHKey {
+	return client.pinKeyAgreement
 }
 
 // -----------------------------
@@ -200,85 +564,637 @@ func (client *DefaultFIDOClient) NewAuthenticationCounterId() uint32 {
 	return num
 }
 
+func (client *DefaultFIDOClient) AAGUID() [16]byte {
+	return client.aaguid
+}
+
+// SetAAGUID changes the AAGUID reported for this device, which identifies it in FIDO metadata
+func (client *DefaultFIDOClient) SetAAGUID(aaguid [16]byte) {
+	client.aaguid = aaguid
+	client.saveData()
+}
+
+// AlwaysUV is whether every request needs user verification, see CTAP 2.1 alwaysUv
+func (client *DefaultFIDOClient) AlwaysUV() bool {
+	return client.alwaysUV
+}
+
+func (client *DefaultFIDOClient) SetAlwaysUV(enabled bool) {
+	client.alwaysUV = enabled
+	client.saveData()
+}
+
+// SerialNumber is the USB serial number of the device, kept in the vault with the AAGUID and
+// attestation CA
+func (client *DefaultFIDOClient) SerialNumber() string {
+	return client.serialNumber
+}
+
+// PersistDeviceIdentity saves the vault if the serial number, AAGUID or attestation CA were
+// generated rather than loaded from it, so the host sees the same device after a restart
+func (client *DefaultFIDOClient) PersistDeviceIdentity() {
+	if !client.identitySaved {
+		client.saveData()
+	}
+}
+
+// AttestationCA is the root certificate that attestation certificates chain to
+func (client *DefaultFIDOClient) AttestationCA() *x509.Certificate {
+	return client.certificateAuthority
+}
+
+// attestationChain is the intermediate CAs issued under root, the issuer of attestation
+// certificates first
+type attestationChain struct {
+	root          *x509.Certificate
+	intermediates []*x509.Certificate
+	issuerKey     *cose.SupportedCOSEPrivateKey
+}
+
+func (chain *attestationChain) issuer() *x509.Certificate {
+	if len(chain.intermediates) == 0 {
+		return chain.root
+	}
+	return chain.intermediates[0]
+}
+
+// SetAttestationIntermediates issues attestation certificates through count intermediate CAs
+// under the attestation CA, so RPs have to build the chain from x5c. The intermediates are
+// generated for each run rather than saved in the vault.
+func (client *DefaultFIDOClient) SetAttestationIntermediates(count int) {
+	client.attestationChainLock.Lock()
+	defer client.attestationChainLock.Unlock()
+	client.attestationIntermediateCount = count
+	client.attestationChain = nil
+}
+
+// currentAttestationChain issues the intermediates again once the vault's attestation CA
+// changes, e.g. when it's reloaded
+func (client *DefaultFIDOClient) currentAttestationChain() *attestationChain {
+	client.attestationChainLock.Lock()
+	defer client.attestationChainLock.Unlock()
+	chain := client.attestationChain
+	if chain != nil && bytes.Equal(chain.root.Raw, client.certificateAuthority.Raw) {
+		return chain
+	}
+	chain = &attestationChain{root: client.certificateAuthority, issuerKey: client.certPrivateKey}
+	for depth := 1; depth <= client.attestationIntermediateCount; depth++ {
+		privateKey, err := identities.CreateCAPrivateKey()
+		util.CheckErr(err, "Could not generate intermediate CA private key")
+		intermediate, err := identities.CreateIntermediateCA(chain.issuer(), chain.issuerKey, privateKey, depth)
+		util.CheckErr(err, "Could not create intermediate CA")
+		chain.intermediates = append([]*x509.Certificate{intermediate}, chain.intermediates...)
+		chain.issuerKey = privateKey
+	}
+	client.attestationChain = chain
+	return chain
+}
+
 func (client *DefaultFIDOClient) CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte {
-	cert, err := identities.CreateSelfSignedAttestationCertificate(client.certificateAuthority, client.certPrivateKey, privateKey)
+	chain := client.currentAttestationChain()
+	cert, err := identities.CreateSelfSignedAttestationCertificate(chain.issuer(), chain.issuerKey, privateKey)
+	util.CheckErr(err, "Could not create attestation certificate")
+	return cert.Raw
+}
+
+// AttestationFormat is the attestation statement format of new credentials, kept in the vault
+// for each profile
+type AttestationFormat string
+
+const (
+	AttestationFormatPacked AttestationFormat = "packed"
+	// Emulates the anonymous attestation of Apple's platform authenticator, for testing how
+	// RP verifiers handle it. The certificates are issued by the attestation CA, not Apple's.
+	AttestationFormatApple AttestationFormat = "apple"
+	// Emulates Android Keystore attestation, with the KeyDescription set with
+	// SetAndroidKeyDescription
+	AttestationFormatAndroidKey AttestationFormat = "android-key"
+	// Emulates SafetyNet attestation, signed for attest.android.com by the attestation CA
+	AttestationFormatAndroidSafetyNet AttestationFormat = "android-safetynet"
+)
+
+func ParseAttestationFormat(text string) (AttestationFormat, error) {
+	switch format := AttestationFormat(text); format {
+	case AttestationFormatPacked, AttestationFormatApple, AttestationFormatAndroidKey, AttestationFormatAndroidSafetyNet:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Expected packed, apple, android-key or android-safetynet, got %q", text)
+	}
+}
+
+func (client *DefaultFIDOClient) AttestationFormat() AttestationFormat {
+	return client.attestationFormat
+}
+
+func (client *DefaultFIDOClient) SetAttestationFormat(format AttestationFormat) {
+	client.attestationFormat = format
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) AppleAttestation() bool {
+	return client.attestationFormat == AttestationFormatApple
+}
+
+func (client *DefaultFIDOClient) CreateAppleAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, nonce []byte) []byte {
+	chain := client.currentAttestationChain()
+	cert, err := identities.CreateAppleAttestationCertificate(chain.issuer(), chain.issuerKey, privateKey, nonce)
 	util.CheckErr(err, "Could not create attestation certificate")
 	return cert.Raw
 }
 
+// AndroidAttestation is the android-key or android-safetynet format in use, or empty
+func (client *DefaultFIDOClient) AndroidAttestation() string {
+	switch client.attestationFormat {
+	case AttestationFormatAndroidKey, AttestationFormatAndroidSafetyNet:
+		return string(client.attestationFormat)
+	default:
+		return ""
+	}
+}
+
+func (client *DefaultFIDOClient) AndroidKeyDescription() identities.AndroidKeyDescription {
+	if client.androidKeyDescription == nil {
+		return identities.DefaultAndroidKeyDescription()
+	}
+	return *client.androidKeyDescription
+}
+
+// SetAndroidKeyDescription changes the KeyDescription of android-key attestation certificates,
+// kept in the vault for each profile
+func (client *DefaultFIDOClient) SetAndroidKeyDescription(description identities.AndroidKeyDescription) {
+	client.androidKeyDescription = &description
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) CreateAndroidKeyAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey, challenge []byte) []byte {
+	chain := client.currentAttestationChain()
+	cert, err := identities.CreateAndroidKeyAttestationCertificate(chain.issuer(), chain.issuerKey, privateKey, client.AndroidKeyDescription(), challenge)
+	util.CheckErr(err, "Could not create attestation certificate")
+	return cert.Raw
+}
+
+func (client *DefaultFIDOClient) CreateSafetyNetResponse(nonce []byte) []byte {
+	chain := client.currentAttestationChain()
+	response, err := identities.CreateSafetyNetResponse(chain.issuer(), chain.issuerKey, client.AttestationIntermediates(), nonce)
+	util.CheckErr(err, "Could not create SafetyNet response")
+	return response
+}
+
+// AttestationIntermediates are the certificates that follow attestation certificates in
+// x5c, from their issuer up to the attestation CA, which is left out
+func (client *DefaultFIDOClient) AttestationIntermediates() [][]byte {
+	intermediates := make([][]byte, 0)
+	for _, intermediate := range client.currentAttestationChain().intermediates {
+		intermediates = append(intermediates, intermediate.Raw)
+	}
+	return intermediates
+}
+
 func (client DefaultFIDOClient) ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool {
-	params := ClientActionRequestParams{}
-	return client.requestApprover.ApproveClientAction(ClientActionU2FRegister, params)
+	// U2F only gives us the hash of the application ID
+	params := ClientActionRequestParams{RelyingPartyID: hex.EncodeToString(keyHandle.ApplicationID)}
+	return client.approve(ClientActionU2FRegister, params)
 }
 
 func (client DefaultFIDOClient) ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool {
-	params := ClientActionRequestParams{}
-	return client.requestApprover.ApproveClientAction(ClientActionU2FAuthenticate, params)
+	params := ClientActionRequestParams{RelyingPartyID: hex.EncodeToString(keyHandle.ApplicationID)}
+	return client.approve(ClientActionU2FAuthenticate, params)
 }
 
-func (client *DefaultFIDOClient) exportData(passphrase string) []byte {
+func (client *DefaultFIDOClient) ImportedKeyHandle(keyHandle []byte) *webauthn.KeyHandle {
+	for _, imported := range client.importedU2FKeys {
+		if bytes.Equal(imported.KeyHandle, keyHandle) {
+			return &webauthn.KeyHandle{
+				PrivateKey:    imported.PrivateKey,
+				ApplicationID: imported.ApplicationID,
+			}
+		}
+	}
+	return nil
+}
+
+// CredentialKeyHandle lets a CTAP2 credential be used through U2F. The U2F counter is
+// moved past the credential's own counter so the RP never sees it go backwards.
+func (client *DefaultFIDOClient) CredentialKeyHandle(credentialID []byte) *webauthn.KeyHandle {
+	source := client.vault.GetIdentity(credentialID)
+	// U2F can't verify the user
+	if source == nil || source.PrivateKey.ECDSA == nil || source.Policy == identities.CredentialPolicyRequirePIN {
+		return nil
+	}
+	privateKey, err := x509.MarshalECPrivateKey(source.PrivateKey.ECDSA)
+	if err != nil {
+		return nil
+	}
+	if client.authenticationCounter <= uint32(source.SignatureCounter) {
+		client.authenticationCounter = uint32(source.SignatureCounter) + 1
+	}
+	source.SignatureCounter = int32(client.authenticationCounter)
+	client.saveData()
+	applicationID := sha256.Sum256([]byte(source.RelyingParty.ID))
+	return &webauthn.KeyHandle{PrivateKey: privateKey, ApplicationID: applicationID[:]}
+}
+
+// u2fKeyHandle opens a U2F key handle, returning nil unless it was registered for relyingPartyID
+func (client *DefaultFIDOClient) u2fKeyHandle(relyingPartyID string, keyHandleBytes []byte) *webauthn.KeyHandle {
+	applicationID := sha256.Sum256([]byte(relyingPartyID))
+	keyHandle := client.ImportedKeyHandle(keyHandleBytes)
+	if keyHandle == nil {
+		opened, err := webauthn.OpenKeyHandle(client.deviceEncryptionKey, applicationID[:], keyHandleBytes)
+		if err != nil {
+			return nil
+		}
+		keyHandle = opened
+	}
+	if !bytes.Equal(keyHandle.ApplicationID, applicationID[:]) {
+		return nil
+	}
+	return keyHandle
+}
+
+// U2FCredentialSource wraps a U2F registration for relyingPartyID (an RP ID or appid)
+// so it can sign CTAP2 assertions. It uses the shared U2F counter.
+func (client *DefaultFIDOClient) U2FCredentialSource(relyingPartyID string, keyHandleBytes []byte) *identities.CredentialSource {
+	keyHandle := client.u2fKeyHandle(relyingPartyID, keyHandleBytes)
+	if keyHandle == nil {
+		return nil
+	}
+	privateKey, err := x509.ParseECPrivateKey(keyHandle.PrivateKey)
+	if err != nil {
+		return nil
+	}
+	counter := client.NewAuthenticationCounterId()
+	client.saveData()
+	return &identities.CredentialSource{
+		Type:             "public-key",
+		ID:               keyHandleBytes,
+		PrivateKey:       &cose.SupportedCOSEPrivateKey{ECDSA: privateKey},
+		RelyingParty:     &webauthn.PublicKeyCredentialRPEntity{ID: relyingPartyID, Name: relyingPartyID},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{},
+		SignatureCounter: int32(counter),
+	}
+}
+
+// ImportU2FCredentials adds registrations exported from another software token,
+// keeping their key handles so existing registrations with relying parties keep working
+func (client *DefaultFIDOClient) ImportU2FCredentials(format identities.U2FImportFormat, data []byte) (int, error) {
+	keys, counter, err := identities.ParseU2FExport(format, data)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, key := range keys {
+		if client.ImportedKeyHandle(key.KeyHandle) != nil {
+			continue
+		}
+		client.importedU2FKeys = append(client.importedU2FKeys, key)
+		imported++
+	}
+	// Relying parties reject counters that go backwards
+	if counter >= client.authenticationCounter {
+		client.authenticationCounter = counter + 1
+	}
+	client.saveData()
+	return imported, nil
+}
+
+// deviceConfig returns the whole device state, which reads every credential of a store
+func (client *DefaultFIDOClient) deviceConfig() identities.FIDODeviceConfig {
+	config := client.deviceState()
+	config.Sources = client.vault.Export()
+	return config
+}
+
+// deviceState returns the device state without the credentials
+func (client *DefaultFIDOClient) deviceState() identities.FIDODeviceConfig {
 	privKeyBytes := cose.MarshalCOSEPrivateKey(client.certPrivateKey)
-	identityData := client.vault.Export()
-	state := identities.FIDODeviceConfig{
+	pinState := &identities.PINState{
+		Version:    client.pinStateVersion,
+		PINHash:    client.pinHash,
+		PINRetries: client.pinRetries,
+		UVRetries:  client.uvRetries,
+	}
+	pinState.Seal(client.deviceEncryptionKey)
+	otpSlots := make([]identities.OTPSlot, 0)
+	for number := 1; number <= identities.OTPSlotCount; number++ {
+		if slot, ok := client.otpSlots[number]; ok {
+			otpSlots = append(otpSlots, *slot)
+		}
+	}
+	return identities.FIDODeviceConfig{
 		EncryptionKey:          client.deviceEncryptionKey,
 		AttestationCertificate: client.certificateAuthority.Raw,
 		AttestationPrivateKey:  privKeyBytes,
 		AuthenticationCounter:  client.authenticationCounter,
 		PINEnabled:             client.pinEnabled,
-		PINHash:                client.pinHash,
-		Sources:                identityData,
+		ImportedU2FKeys:        client.importedU2FKeys,
+		AAGUID:                 client.aaguid[:],
+		SerialNumber:           client.serialNumber,
+		AlwaysUV:               client.alwaysUV,
+		AttestationFormat:      string(client.attestationFormat),
+		AndroidKeyDescription:  client.androidKeyDescription,
+		PIV:                    client.piv.Export(),
+		OTPSlots:               otpSlots,
+		PINState:               pinState,
+		Sync:                   client.syncState,
+		UnknownRecords:         client.unknownVaultRecords,
 	}
-	savedBytes, err := identities.EncryptFIDOState(state, passphrase)
-	util.CheckErr(err, "Could not encode saved state")
-	return savedBytes
 }
 
-func (client *DefaultFIDOClient) importData(data []byte, passphrase string) error {
-	state, err := identities.DecryptFIDOState(data, passphrase)
-	util.CheckErr(err, "Could not decrypt vault data")
+func (client *DefaultFIDOClient) applyDeviceConfig(state *identities.FIDODeviceConfig) error {
 	cert, err := x509.ParseCertificate(state.AttestationCertificate)
-	util.CheckErr(err, "Could not parse x509 cert")
+	if err != nil {
+		return fmt.Errorf("Could not parse x509 cert: %w", err)
+	}
 	privateKey, err := cose.UnmarshalCOSEPrivateKey(state.AttestationPrivateKey)
 	if err != nil {
 		privateKeyECDSA, err := x509.ParseECPrivateKey(state.AttestationPrivateKey)
-		util.CheckErr(err, "Could not parse private key")
+		if err != nil {
+			return fmt.Errorf("Could not parse private key: %w", err)
+		}
 		privateKey = &cose.SupportedCOSEPrivateKey{ECDSA: privateKeyECDSA}
 	}
+	if _, ok := client.dataSaver.(identities.CredentialStore); !ok && state.CredentialsStored {
+		return fmt.Errorf("Vault credentials are kept in a credential store this client doesn't have")
+	}
+	vault := identities.NewIdentityVault()
+	err = vault.Import(state.Sources)
+	if err != nil {
+		return fmt.Errorf("Could not import credentials: %w", err)
+	}
+	pivState := identities.NewPIVState()
+	if state.PIV != nil {
+		pivState, err = identities.ImportPIVState(state.PIV)
+		if err != nil {
+			return fmt.Errorf("Could not import PIV state: %w", err)
+		}
+	}
+	pinState := identities.PINState{
+		PINHash:    state.PINHash,
+		PINRetries: identities.DefaultPINRetries,
+		UVRetries:  identities.DefaultPINRetries,
+	}
+	if state.PINState != nil {
+		if err := state.PINState.Verify(state.EncryptionKey); err != nil {
+			return err
+		}
+		pinState = *state.PINState
+	} else if state.PINRetries != nil {
+		pinState.PINRetries = *state.PINRetries
+	}
+	otpSlots := make(map[int]*identities.OTPSlot)
+	for i := range state.OTPSlots {
+		slot := state.OTPSlots[i]
+		if err := slot.Validate(); err != nil {
+			return fmt.Errorf("Invalid OTP slot: %w", err)
+		}
+		otpSlots[slot.Slot] = &slot
+	}
+	if store, ok := client.dataSaver.(identities.CredentialStore); ok {
+		vault = identities.NewStoredIdentityVault(store)
+		// Credentials saved in the vault itself, e.g. before the store was used, move into it
+		if !state.CredentialsStored {
+			if err := vault.Replace(state.Sources); err != nil {
+				return fmt.Errorf("Could not import credentials: %w", err)
+			}
+		}
+	}
 	client.deviceEncryptionKey = state.EncryptionKey
 	client.certificateAuthority = cert
 	client.certPrivateKey = privateKey
 	client.authenticationCounter = state.AuthenticationCounter
 	client.pinEnabled = state.PINEnabled
-	client.pinHash = state.PINHash
-	client.vault = identities.NewIdentityVault()
-	client.vault.Import(state.Sources)
+	client.pinHash = pinState.PINHash
+	client.pinRetries = pinState.PINRetries
+	client.uvRetries = pinState.UVRetries
+	client.pinStateVersion = pinState.Version
+	client.vault = vault
+	client.importedU2FKeys = state.ImportedU2FKeys
+	client.piv = pivState
+	client.otpSlots = otpSlots
+	client.syncState = state.Sync
+	client.unknownVaultRecords = state.UnknownRecords
+	client.aaguid = identities.DefaultAAGUID
+	if len(state.AAGUID) == len(client.aaguid) {
+		copy(client.aaguid[:], state.AAGUID)
+	}
+	client.alwaysUV = state.AlwaysUV
+	client.attestationFormat = AttestationFormatPacked
+	if state.AttestationFormat != "" {
+		client.attestationFormat = AttestationFormat(state.AttestationFormat)
+	}
+	client.androidKeyDescription = state.AndroidKeyDescription
+	// Older vaults keep the serial number generated for this client until they're saved
+	if state.SerialNumber != "" {
+		client.serialNumber = state.SerialNumber
+	}
+	client.identitySaved = state.SerialNumber != ""
+	return nil
+}
+
+func (client *DefaultFIDOClient) exportData(passphrase string) []byte {
+	config := client.deviceState()
+	if client.vault.Stored() {
+		err := client.vault.Flush()
+		util.CheckErr(err, "Could not save credentials")
+		config.CredentialsStored = true
+	} else {
+		config.Sources = client.vault.Export()
+	}
+	savedBytes, err := identities.EncryptFIDOStateWithParameters(config, passphrase, client.kdfParameters)
+	util.CheckErr(err, "Could not encode saved state")
+	return savedBytes
+}
+
+func (client *DefaultFIDOClient) importData(data []byte, passphrase string) error {
+	state, err := identities.DecryptFIDOState(data, passphrase)
+	if err != nil {
+		return fmt.Errorf("Could not decrypt vault data: %w", err)
+	}
+	return client.applyDeviceConfig(state)
+}
+
+// ExportVault produces a versioned, passphrase-encrypted backup of all credentials,
+// counters and PIN state that can be moved to another machine with ImportVault
+func (client *DefaultFIDOClient) ExportVault(passphrase string) ([]byte, error) {
+	return identities.ExportVaultWithParameters(client.deviceConfig(), passphrase, client.kdfParameters)
+}
+
+// ImportVault replaces the current device state with the contents of a backup
+// created by ExportVault and persists it through the ClientDataSaver
+func (client *DefaultFIDOClient) ImportVault(data []byte, passphrase string) error {
+	state, err := identities.ImportVault(data, passphrase)
+	if err != nil {
+		return err
+	}
+	err = client.applyDeviceConfig(state)
+	if err != nil {
+		return err
+	}
+	// A backup is expected to be older than the vault it replaces
+	if counter, ok := client.dataSaver.(RollbackCounter); ok && client.pinStateVersion < counter.RollbackCounter() {
+		client.pinStateVersion = counter.RollbackCounter()
+	}
+	client.saveData()
 	return nil
 }
 
 func (client *DefaultFIDOClient) saveData() {
+	client.pinStateVersion++
 	data := client.exportData(client.dataSaver.Passphrase())
 	client.dataSaver.SaveData(data)
+	client.setSavedData(data)
+	client.vaultSaved = true
+	client.identitySaved = true
+	// Only recorded once the vault is saved, so a crash in between can't lock the vault out
+	if counter, ok := client.dataSaver.(RollbackCounter); ok {
+		counter.SetRollbackCounter(client.pinStateVersion)
+	}
 }
 
 func (client *DefaultFIDOClient) loadData() {
 	data := client.dataSaver.RetrieveData()
 	if data != nil {
-		client.importData(data, client.dataSaver.Passphrase())
+		err := client.importData(data, client.dataSaver.Passphrase())
+		util.CheckErr(err, "Could not load vault data")
+		client.setSavedData(data)
+		client.kdfParameters, err = identities.PassphraseParameters(data)
+		util.CheckErr(err, "Could not load vault data")
+		client.vaultSaved = true
+	}
+	if counter, ok := client.dataSaver.(RollbackCounter); ok && client.pinStateVersion < counter.RollbackCounter() {
+		err := fmt.Errorf("Vault was rolled back from version %d to %d", counter.RollbackCounter(), client.pinStateVersion)
+		util.CheckErr(err, "Could not load vault data")
+	}
+}
+
+// SetKDFParameters changes how the passphrase is stretched into the vault key, and saves the
+// vault with them. They're also used for exports.
+func (client *DefaultFIDOClient) SetKDFParameters(params identities.Argon2idParameters) error {
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	client.kdfParameters = params
+	client.saveData()
+	return nil
+}
+
+func (client *DefaultFIDOClient) KDFParameters() identities.Argon2idParameters {
+	return client.kdfParameters
+}
+
+// PIVState is the state of the PIV applet, kept in the same vault as the FIDO credentials
+func (client *DefaultFIDOClient) PIVState() *identities.PIVState {
+	return client.piv
+}
+
+func (client *DefaultFIDOClient) SavePIVState() {
+	client.saveData()
+}
+
+// OTPSlot returns the configuration of an OTP slot, or nil if it's empty
+func (client *DefaultFIDOClient) OTPSlot(number int) *identities.OTPSlot {
+	return client.otpSlots[number]
+}
+
+// SetOTPSlot replaces the configuration of slot.Slot and saves it
+func (client *DefaultFIDOClient) SetOTPSlot(slot identities.OTPSlot) error {
+	if err := slot.Validate(); err != nil {
+		return err
 	}
+	client.otpSlots[slot.Slot] = &slot
+	client.saveData()
+	return nil
+}
+
+func (client *DefaultFIDOClient) DeleteOTPSlot(number int) {
+	delete(client.otpSlots, number)
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) SaveOTPSlots() {
+	client.saveData()
 }
 
 func (client *DefaultFIDOClient) Identities() []identities.CredentialSource {
 	sources := make([]identities.CredentialSource, 0)
-	for _, source := range client.vault.CredentialSources {
+	for _, source := range client.vault.All() {
 		sources = append(sources, *source)
 	}
 	return sources
 }
 
+// ListCredentials returns display metadata for every credential in the vault
+func (client *DefaultFIDOClient) ListCredentials() []identities.CredentialMetadata {
+	credentials := make([]identities.CredentialMetadata, 0)
+	for _, source := range client.vault.All() {
+		credentials = append(credentials, source.Metadata())
+	}
+	return credentials
+}
+
+func (client *DefaultFIDOClient) SetCredentialNickname(id []byte, nickname string) bool {
+	source := client.vault.GetIdentity(id)
+	if source == nil {
+		return false
+	}
+	source.Nickname = nickname
+	client.saveData()
+	return true
+}
+
+// SetCredentialPolicy changes what assertions with a credential require
+func (client *DefaultFIDOClient) SetCredentialPolicy(id []byte, policy identities.CredentialPolicy) bool {
+	source := client.vault.GetIdentity(id)
+	if source == nil {
+		return false
+	}
+	source.Policy = policy
+	client.saveData()
+	return true
+}
+
+// newIdentityVault returns the vault of a new client, kept in saver if it's a CredentialStore
+func newIdentityVault(saver ClientDataSaver) *identities.IdentityVault {
+	if store, ok := saver.(identities.CredentialStore); ok {
+		return identities.NewStoredIdentityVault(store)
+	}
+	return identities.NewIdentityVault()
+}
+
+// ResetVault deletes every credential and clears the PIN and alwaysUv. A new device key is
+// generated, so previously issued U2F key handles stop working as well.
+func (client *DefaultFIDOClient) ResetVault() {
+	client.deviceEncryptionKey = crypto.GenerateSymmetricKey()
+	err := client.vault.Replace(nil)
+	util.CheckErr(err, "Could not delete credentials")
+	client.importedU2FKeys = nil
+	client.pinHash = nil
+	client.pinRetries = identities.DefaultPINRetries
+	client.uvRetries = identities.DefaultPINRetries
+	client.alwaysUV = false
+	// Peers would restore the deleted credentials
+	client.syncState = nil
+	client.unknownVaultRecords = nil
+	client.saveData()
+	events.Publish(events.Event{Type: events.EventReset})
+}
+
 func (client *DefaultFIDOClient) DeleteIdentity(id []byte) bool {
-	success := client.vault.DeleteIdentity(id)
+	success := client.deleteCredential(id)
 	if success {
 		client.saveData()
 	}
 	return success
 }
+
+// deleteCredential removes a credential from the vault without saving it
+func (client *DefaultFIDOClient) deleteCredential(id []byte) bool {
+	if !client.vault.DeleteIdentity(id) {
+		return false
+	}
+	if client.syncState != nil {
+		tombstone := identities.CredentialTombstone{ID: id, DeletedAt: util.Now().UTC()}
+		client.syncState.Tombstones = append(client.syncState.Tombstones, tombstone)
+	}
+	return true
+}
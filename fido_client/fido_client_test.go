@@ -0,0 +1,416 @@
+package fido_client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// newTestClient returns a client with PIN support, a new attestation CA and a new encryption
+// key. New vaults get cheap KDF parameters, so tests don't spend their time in Argon2id.
+func newTestClient(t *testing.T, saver ClientDataSaver) *DefaultFIDOClient {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA private key")
+	ca, err := identities.CreateSelfSignedCA(caPrivateKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	encryptionKey := [32]byte{}
+	copy(encryptionKey[:], crypto.RandomBytes(32))
+	newVault := saver.RetrieveData() == nil
+	client := NewDefaultClient(ca, caPrivateKey, encryptionKey, true, &countingApprover{}, saver)
+	if newVault {
+		err = client.SetKDFParameters(identities.Argon2idParameters{Time: 1, Memory: 64, Threads: 1})
+		test.Assert(t, err == nil, "Could not set KDF parameters")
+	}
+	return client
+}
+
+func verifyAttestationChain(t *testing.T, client *DefaultFIDOClient) [][]byte {
+	privateKey := &cose.SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+	certificate, err := x509.ParseCertificate(client.CreateAttestationCertificiate(privateKey))
+	test.Assert(t, err == nil, "Could not parse attestation certificate")
+	roots := x509.NewCertPool()
+	roots.AddCert(client.AttestationCA())
+	intermediates := x509.NewCertPool()
+	chain := client.AttestationIntermediates()
+	for _, encoded := range chain {
+		intermediate, err := x509.ParseCertificate(encoded)
+		test.Assert(t, err == nil, "Could not parse intermediate")
+		intermediates.AddCert(intermediate)
+	}
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	test.Assert(t, err == nil, "Attestation certificate should chain to the attestation CA")
+	return chain
+}
+
+func TestAttestationIntermediates(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	test.AssertEqual(t, len(verifyAttestationChain(t, client)), 0, "Attestation CA should issue certificates by default")
+
+	client.SetAttestationIntermediates(2)
+	chain := verifyAttestationChain(t, client)
+	test.AssertEqual(t, len(chain), 2, "Wrong number of intermediates")
+	test.AssertEqual(t, len(verifyAttestationChain(t, client)), 2, "Intermediates should be reused")
+	test.Assert(t, bytes.Equal(client.AttestationIntermediates()[0], chain[0]), "Intermediates should be reused")
+}
+
+func TestAttestationFormatPersists(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	test.AssertEqual(t, client.AttestationFormat(), AttestationFormatPacked, "New vaults should use packed attestation")
+	_, err := ParseAttestationFormat("tpm")
+	test.Assert(t, err != nil, "Unsupported formats should be refused")
+	format, err := ParseAttestationFormat("apple")
+	test.Assert(t, err == nil, "Could not parse apple")
+	client.SetAttestationFormat(format)
+	restarted := newTestClient(t, saver)
+	test.AssertEqual(t, restarted.AttestationFormat(), AttestationFormatApple, "Attestation format should survive a restart")
+	test.Assert(t, restarted.AppleAttestation(), "Apple attestation should be on")
+}
+
+type rollbackDataSaver struct {
+	memoryDataSaver
+	counter uint64
+}
+
+func (saver *rollbackDataSaver) RollbackCounter() uint64 {
+	return saver.counter
+}
+
+func (saver *rollbackDataSaver) SetRollbackCounter(version uint64) {
+	saver.counter = version
+}
+
+func loadPanics(t *testing.T, saver ClientDataSaver) bool {
+	panicked := false
+	util.Try(func() {
+		newTestClient(t, saver)
+	}, func(err interface{}) {
+		panicked = true
+	})
+	return panicked
+}
+
+func TestPINRetriesPersisted(t *testing.T) {
+	saver := &rollbackDataSaver{}
+	client := newTestClient(t, saver)
+	client.SetPIN([]byte("1234"))
+	// A failed attempt decrements the retries before the PIN is checked
+	client.SetPINRetries(client.PINRetries() - 1)
+	client.SetUVRetries(2)
+
+	restarted := newTestClient(t, saver)
+	test.AssertEqual(t, restarted.PINRetries(), int32(identities.DefaultPINRetries-1), "PIN retries should survive a restart")
+	test.AssertEqual(t, restarted.UVRetries(), int32(2), "UV retries should survive a restart")
+	test.AssertArrEqual(t, restarted.PINHash(), client.PINHash(), "PIN hash should survive a restart")
+}
+
+func TestRollbackRejected(t *testing.T) {
+	saver := &rollbackDataSaver{}
+	client := newTestClient(t, saver)
+	client.SetPIN([]byte("1234"))
+	oldVault := saver.data
+	client.SetPINRetries(3)
+
+	saver.data = oldVault
+	test.Assert(t, loadPanics(t, saver), "An old copy of the vault should be refused")
+}
+
+func TestTamperedPINStateRejected(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	client.SetPIN([]byte("1234"))
+	client.SetPINRetries(1)
+
+	config := client.deviceConfig()
+	config.PINState.PINRetries = identities.DefaultPINRetries
+	test.Assert(t, client.applyDeviceConfig(&config) != nil, "PIN state with an invalid MAC should be refused")
+	test.AssertEqual(t, client.PINRetries(), int32(1), "Refused PIN state should not be applied")
+}
+
+func TestImportOlderBackup(t *testing.T) {
+	saver := &rollbackDataSaver{}
+	client := newTestClient(t, saver)
+	backup, err := client.ExportVault("backup")
+	test.Assert(t, err == nil, "Could not export vault")
+	client.SetPIN([]byte("1234"))
+	client.SetPINRetries(5)
+
+	err = client.ImportVault(backup, "backup")
+	test.Assert(t, err == nil, "Could not import backup")
+	test.Assert(t, !loadPanics(t, saver), "An imported backup should become the current vault")
+}
+
+func TestLegacyPINState(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	config := client.deviceConfig()
+	retries := int32(4)
+	config.PINState = nil
+	config.PINHash = []byte("legacy hash")
+	config.PINRetries = &retries
+	test.Assert(t, client.applyDeviceConfig(&config) == nil, "Could not apply legacy config")
+	test.AssertEqual(t, client.PINRetries(), int32(4), "Legacy PIN retries should be read")
+	test.AssertArrEqual(t, client.PINHash(), []byte("legacy hash"), "Legacy PIN hash should be read")
+}
+
+func makeCredentialWithResidentKey(server *ctap.CTAPServer, residentKey bool) []byte {
+	args := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "example.com", "name": "Example"},
+		3: map[string]interface{}{"id": []byte{1, 2, 3}, "name": "alice", "displayName": "Alice"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+		7: map[string]bool{"rk": residentKey},
+	}
+	response := server.HandleMessage(append([]byte{0x01}, util.MarshalCBOR(args)...))
+	if response[0] != 0 {
+		return nil
+	}
+	var decoded map[int]interface{}
+	cbor.Unmarshal(response[1:], &decoded)
+	authData := decoded[2].([]byte)
+	// RP ID hash, flags, counter and AAGUID come before the credential ID
+	idLength := int(authData[53])<<8 | int(authData[54])
+	return authData[55 : 55+idLength]
+}
+
+func getAssertion(server *ctap.CTAPServer, credentialID []byte) byte {
+	args := map[int]interface{}{
+		1: "example.com",
+		2: crypto.HashSHA256([]byte("client data")),
+		3: []map[string]interface{}{{"type": "public-key", "id": credentialID}},
+	}
+	return server.HandleMessage(append([]byte{0x02}, util.MarshalCBOR(args)...))[0]
+}
+
+func TestDerivedCredentials(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	client.SetDerivedCredentials(true)
+	server := ctap.NewCTAPServer(client)
+
+	credentialID := makeCredentialWithResidentKey(server, false)
+	test.Assert(t, credentialID != nil, "Could not make derived credential")
+	test.AssertEqual(t, len(client.ListCredentials()), 0, "Derived credentials should not be stored")
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0), "Could not get assertion with derived credential")
+
+	// Only the device key is needed to use the credential again
+	restarted := newTestClient(t, saver)
+	test.AssertEqual(t, getAssertion(ctap.NewCTAPServer(restarted), credentialID), byte(0), "Derived credential should work after a restart")
+
+	residentID := makeCredentialWithResidentKey(server, true)
+	test.Assert(t, residentID != nil, "Could not make resident credential")
+	test.AssertEqual(t, len(client.ListCredentials()), 1, "Resident credentials should still be stored")
+
+	client.ResetVault()
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0x2E), "Reset should invalidate derived credentials")
+}
+
+func TestCredentialPolicy(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	approver := client.requestApprover.(*countingApprover)
+	server := ctap.NewCTAPServer(client)
+
+	credentialID := makeCredentialWithResidentKey(server, true)
+	test.Assert(t, credentialID != nil, "Could not make credential")
+	approver.calls = 0
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0), "Could not get assertion")
+	test.AssertEqual(t, approver.calls, 1, "Logins should ask for approval by default")
+
+	test.Assert(t, client.SetCredentialPolicy(credentialID, identities.CredentialPolicySilent), "Could not set policy")
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0), "Could not get silent assertion")
+	test.AssertEqual(t, approver.calls, 1, "Silent logins should not ask for approval")
+
+	test.Assert(t, client.SetCredentialPolicy(credentialID, identities.CredentialPolicyRequirePIN), "Could not set policy")
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0x36), "Login without user verification should require the PIN")
+	test.Assert(t, client.CredentialKeyHandle(credentialID) == nil, "U2F can't verify the user, so the credential should not be usable")
+
+	options := DefaultVirtualAuthenticatorOptions()
+	options.HasUserVerification = true
+	options.IsUserVerified = true
+	_, err := client.EnableAutomation(options)
+	test.Assert(t, err == nil, "Could not enable automation")
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0), "Built-in user verification should satisfy the policy")
+
+	restarted := newTestClient(t, client.dataSaver)
+	test.AssertEqual(t, restarted.ListCredentials()[0].Policy, identities.CredentialPolicyRequirePIN, "Policy should be saved")
+}
+
+func makeCredentialExcluding(server *ctap.CTAPServer, excluded []byte, userID []byte) byte {
+	args := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "example.com", "name": "Example"},
+		3: map[string]interface{}{"id": userID, "name": "bob", "displayName": "Bob"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+		5: []map[string]interface{}{{"type": "public-key", "id": excluded}},
+		7: map[string]bool{"rk": true},
+	}
+	return server.HandleMessage(append([]byte{0x01}, util.MarshalCBOR(args)...))[0]
+}
+
+func TestExcludeList(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	approver := client.requestApprover.(*countingApprover)
+	client.SetDerivedCredentials(true)
+	server := ctap.NewCTAPServer(client)
+
+	residentID := makeCredentialWithResidentKey(server, true)
+	derivedID := makeCredentialWithResidentKey(server, false)
+	test.Assert(t, residentID != nil && derivedID != nil, "Could not make credentials")
+	for _, id := range [][]byte{residentID, derivedID} {
+		calls := approver.calls
+		test.AssertEqual(t, makeCredentialExcluding(server, id, []byte{4}), byte(0x19), "Existing credential should be excluded")
+		test.AssertEqual(t, approver.calls, calls+1, "User presence should be required before excluding")
+	}
+	test.AssertEqual(t, len(client.ListCredentials()), 1, "Excluded credential should not be created")
+	test.AssertEqual(t, makeCredentialExcluding(server, crypto.RandomBytes(32), []byte{4}), byte(0), "Unknown credentials should not be excluded")
+}
+
+func TestResidentCredentialReplacesSameUser(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	server := ctap.NewCTAPServer(client)
+
+	first := makeCredentialWithResidentKey(server, true)
+	second := makeCredentialWithResidentKey(server, true)
+	credentials := client.ListCredentials()
+	test.AssertEqual(t, len(credentials), 1, "Credential for the same user should be replaced")
+	test.AssertArrEqual(t, credentials[0].ID, second, "Newest credential should be kept")
+	test.Assert(t, !client.HasCredential("example.com", first), "Replaced credential should be gone")
+
+	makeCredentialExcluding(server, nil, []byte{4})
+	test.AssertEqual(t, len(client.ListCredentials()), 2, "Credentials for other users should be kept")
+}
+
+func TestDeviceIdentityPersists(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	test.Assert(t, client.SerialNumber() != "", "New client should have a serial number")
+	saved := saver.data
+	client.PersistDeviceIdentity()
+	test.Assert(t, bytes.Equal(saver.data, saved), "Saved identity should not be saved again")
+
+	restarted := newTestClient(t, saver)
+	test.AssertEqual(t, restarted.SerialNumber(), client.SerialNumber(), "Serial number should survive a restart")
+	test.AssertEqual(t, restarted.AAGUID(), client.AAGUID(), "AAGUID should survive a restart")
+	test.Assert(t, bytes.Equal(restarted.AttestationCA().Raw, client.AttestationCA().Raw), "Attestation CA should survive a restart")
+}
+
+func TestDeviceIdentityOlderVault(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	config := client.deviceConfig()
+	config.SerialNumber = ""
+	data, err := identities.EncryptFIDOStateWithParameters(config, saver.Passphrase(), client.KDFParameters())
+	test.Assert(t, err == nil, "Could not encrypt vault")
+	saver.data = data
+
+	upgraded := newTestClient(t, saver)
+	serialNumber := upgraded.SerialNumber()
+	test.Assert(t, serialNumber != "", "Vault without a serial number should get one")
+	upgraded.PersistDeviceIdentity()
+	test.AssertEqual(t, newTestClient(t, saver).SerialNumber(), serialNumber, "Generated serial number should be saved")
+}
+
+func TestRandomCredentialIDs(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	server := ctap.NewCTAPServer(client)
+
+	credentialID := makeCredentialWithResidentKey(server, false)
+	test.AssertEqual(t, len(credentialID), 16, "Credential IDs should be 16 bytes by default")
+
+	client.SetCredentialIDFormat(CredentialIDFormatRandom32)
+	credentialID = makeCredentialWithResidentKey(server, false)
+	test.AssertEqual(t, len(credentialID), 32, "Credential ID should be 32 bytes")
+	test.AssertEqual(t, len(client.ListCredentials()), 2, "Random credential IDs should be stored")
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0), "Could not get assertion with 32 byte credential ID")
+}
+
+func TestWrappedCredentialIDs(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	client.SetCredentialIDFormat(CredentialIDFormatWrapped)
+	server := ctap.NewCTAPServer(client)
+
+	credentialID := makeCredentialWithResidentKey(server, false)
+	test.Assert(t, credentialID != nil, "Could not make wrapped credential")
+	test.Assert(t, len(credentialID) <= 255, "Wrapped credential ID should fit in a U2F key handle")
+	test.AssertEqual(t, len(client.ListCredentials()), 0, "Wrapped credentials should not be stored")
+	test.AssertEqual(t, getAssertion(server, credentialID), byte(0), "Could not get assertion with wrapped credential")
+
+	restarted := newTestClient(t, saver)
+	test.AssertEqual(t, getAssertion(ctap.NewCTAPServer(restarted), credentialID), byte(0), "Wrapped credential should work after a restart")
+
+	residentID := makeCredentialWithResidentKey(server, true)
+	test.AssertEqual(t, len(residentID), 16, "Resident credentials should get random IDs")
+	test.AssertEqual(t, len(client.ListCredentials()), 1, "Resident credentials should still be stored")
+}
+
+// largeNonceProvider makes every sealed key handle too long for U2F
+type largeNonceProvider struct {
+	crypto.StdlibProvider
+}
+
+func (p largeNonceProvider) Seal(key []byte, data []byte, associatedData []byte) ([]byte, []byte, error) {
+	encrypted, nonce, err := p.StdlibProvider.Seal(key, data, associatedData)
+	return encrypted, append(nonce, make([]byte, 256)...), err
+}
+
+func (p largeNonceProvider) Open(key []byte, data []byte, nonce []byte, associatedData []byte) ([]byte, error) {
+	return p.StdlibProvider.Open(key, data, nonce[:len(nonce)-256], associatedData)
+}
+
+func TestWrappedCredentialIDTooLong(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	client.SetCredentialIDFormat(CredentialIDFormatWrapped)
+	server := ctap.NewCTAPServer(client)
+	crypto.SetProvider(largeNonceProvider{})
+	defer crypto.SetProvider(crypto.StdlibProvider{})
+
+	credentialID := makeCredentialWithResidentKey(server, false)
+	test.Assert(t, credentialID != nil, "Credential should be stored when it can't be wrapped")
+	test.AssertEqual(t, len(credentialID), 16, "Stored credential should get a random ID")
+	test.AssertEqual(t, len(client.ListCredentials()), 1, "Credential should be stored when it can't be wrapped")
+}
+
+func TestDeterministicMakeCredential(t *testing.T) {
+	defer crypto.SetRandom(nil)
+	defer util.SetClock(nil)
+	register := func() []byte {
+		crypto.SetRandom(crypto.NewSeededRandom([]byte("seed")))
+		util.SetClock(util.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+		return makeCredential(ctap.NewCTAPServer(newTestClient(t, &memoryDataSaver{})), false)
+	}
+	first := register()
+	test.AssertEqual(t, first[0], byte(0), "Registration should succeed")
+	test.Assert(t, bytes.Equal(register(), first), "Seeded registrations should be byte-identical")
+}
+
+func TestMaxCredentials(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	client.SetDerivedCredentials(true)
+	client.SetMaxCredentials(1)
+	server := ctap.NewCTAPServer(client)
+	test.AssertEqual(t, client.RemainingResidentCredentials(), 1, "Empty vault should have room for one credential")
+
+	test.Assert(t, makeCredentialWithResidentKey(server, true) != nil, "First credential should fit")
+	test.AssertEqual(t, client.RemainingResidentCredentials(), 0, "Vault should be full")
+	test.Assert(t, makeCredentialWithResidentKey(server, true) != nil, "Credential replacing the same user should fit")
+	test.Assert(t, makeCredentialWithResidentKey(server, false) != nil, "Derived credentials aren't stored")
+	test.AssertEqual(t, makeCredentialExcluding(server, nil, []byte{4}), byte(0x28), "Credential for another user shouldn't fit")
+	test.AssertEqual(t, client.ResidentCredentialCount(), 1, "Refused credential shouldn't be stored")
+
+	client.SetMaxCredentials(0)
+	test.AssertEqual(t, client.RemainingResidentCredentials(), -1, "Vault should have no limit")
+	test.AssertEqual(t, makeCredentialExcluding(server, nil, []byte{4}), byte(0), "Credential should fit without a limit")
+}
@@ -0,0 +1,34 @@
+package fido_client
+
+import (
+	"os/exec"
+)
+
+// NotifySendApprovalUI shows approvals as freedesktop notifications with Approve/Deny
+// actions by running notify-send, which needs libnotify 0.7.9 or newer for --action and
+// --wait. It doesn't talk to D-Bus itself.
+type NotifySendApprovalUI struct {
+	NotifySendPath string
+	runCommand     commandRunner
+}
+
+// NewDesktopApprovalUI fails if notify-send isn't installed
+func NewDesktopApprovalUI() (ApprovalUI, error) {
+	path, err := findApprovalCommand("notify-send", "notify-send from libnotify")
+	if err != nil {
+		return nil, err
+	}
+	return &NotifySendApprovalUI{NotifySendPath: path}, nil
+}
+
+func (ui *NotifySendApprovalUI) Approve(request ApprovalRequest) <-chan bool {
+	cmd := exec.Command(ui.NotifySendPath,
+		"--app-name=Virtual FIDO",
+		"--urgency=critical",
+		"--wait",
+		"--action=approve=Approve",
+		"--action=deny=Deny",
+		request.Title(),
+		request.Details())
+	return runApprovalCommand(ui.runCommand, cmd, "approve")
+}
@@ -0,0 +1,28 @@
+package fido_client
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestNotifySendApprovalUI(t *testing.T) {
+	runner := newStubRunner("approve\n", nil)
+	ui := &NotifySendApprovalUI{NotifySendPath: "/usr/bin/notify-send", runCommand: runner.run}
+	request := ApprovalRequest{Action: ClientActionFIDOGetAssertion, Params: ClientActionRequestParams{RelyingPartyID: "example.com"}}
+	test.Assert(t, <-ui.Approve(request), "Approve action should approve")
+	cmd := <-runner.commands
+	test.AssertEqual(t, cmd.Path, "/usr/bin/notify-send", "notify-send should be run from the path found")
+	test.AssertArrEqual(t, cmd.Args[1:], []string{
+		"--app-name=Virtual FIDO", "--urgency=critical", "--wait", "--action=approve=Approve", "--action=deny=Deny",
+		"Virtual FIDO: Account login requested", "Relying party: example.com",
+	}, "notify-send should get the actions, title and details")
+}
+
+func TestNotifySendMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	ui, err := NewDesktopApprovalUI()
+	test.Assert(t, ui == nil && errors.Is(err, exec.ErrNotFound), "A missing notify-send should be reported")
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package fido_client
+
+// NewDesktopApprovalUI returns nil on platforms without a desktop notification implementation
+func NewDesktopApprovalUI() (ApprovalUI, error) {
+	return nil, nil
+}
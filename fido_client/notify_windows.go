@@ -0,0 +1,49 @@
+package fido_client
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+)
+
+// The toast is raised from a PowerShell process using PowerShell's own AppUserModelID,
+// which then waits for a button to be clicked and prints that button's arguments
+const windowsToastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
+$xml.LoadXml($env:VIRTUAL_FIDO_TOAST)
+$toast = New-Object Windows.UI.Notifications.ToastNotification $xml
+Register-ObjectEvent -InputObject $toast -EventName Activated -SourceIdentifier VirtualFIDOApproval | Out-Null
+$appId = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($appId).Show($toast)
+$event = Wait-Event -SourceIdentifier VirtualFIDOApproval -Timeout 120
+if ($event) { Write-Output $event.SourceArgs[1].Arguments }
+`
+
+// PowerShellToastApprovalUI shows approvals as Windows toast notifications with
+// Approve/Deny buttons, raised by running Windows PowerShell
+type PowerShellToastApprovalUI struct {
+	PowerShellPath string
+	runCommand     commandRunner
+}
+
+// NewDesktopApprovalUI fails if Windows PowerShell isn't installed
+func NewDesktopApprovalUI() (ApprovalUI, error) {
+	path, err := findApprovalCommand("powershell.exe", "Windows PowerShell")
+	if err != nil {
+		return nil, err
+	}
+	return &PowerShellToastApprovalUI{PowerShellPath: path}, nil
+}
+
+func (ui *PowerShellToastApprovalUI) Approve(request ApprovalRequest) <-chan bool {
+	toast := fmt.Sprintf(`<toast scenario="reminder"><visual><binding template="ToastGeneric"><text>%s</text><text>%s</text></binding></visual>`+
+		`<actions><action content="Approve" arguments="approve" activationType="foreground"/>`+
+		`<action content="Deny" arguments="deny" activationType="foreground"/></actions></toast>`,
+		html.EscapeString(request.Title()), html.EscapeString(request.Details()))
+	cmd := exec.Command(ui.PowerShellPath, "-NoProfile", "-NonInteractive", "-Command", windowsToastScript)
+	cmd.Env = append(os.Environ(), "VIRTUAL_FIDO_TOAST="+toast)
+	return runApprovalCommand(ui.runCommand, cmd, "approve")
+}
@@ -0,0 +1,31 @@
+package fido_client
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestPowerShellToastApprovalUI(t *testing.T) {
+	runner := newStubRunner("deny\r\n", nil)
+	ui := &PowerShellToastApprovalUI{PowerShellPath: "powershell.exe", runCommand: runner.run}
+	request := ApprovalRequest{Action: ClientActionFIDOGetAssertion, Params: ClientActionRequestParams{RelyingPartyID: "<example>"}}
+	test.Assert(t, !<-ui.Approve(request), "Deny button should deny")
+	cmd := <-runner.commands
+	toast := ""
+	for _, variable := range cmd.Env {
+		if strings.HasPrefix(variable, "VIRTUAL_FIDO_TOAST=") {
+			toast = variable
+		}
+	}
+	test.Assert(t, strings.Contains(toast, "&lt;example&gt;"), "Toast details should be escaped")
+}
+
+func TestPowerShellMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	ui, err := NewDesktopApprovalUI()
+	test.Assert(t, ui == nil && errors.Is(err, exec.ErrNotFound), "A missing PowerShell should be reported")
+}
@@ -0,0 +1,134 @@
+package fido_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+type PolicyDecision string
+
+const (
+	PolicyAllow PolicyDecision = "allow"
+	PolicyDeny  PolicyDecision = "deny"
+	PolicyAsk   PolicyDecision = "ask"
+)
+
+var policyActionNames = map[string]ClientAction{
+	"u2f_register":     ClientActionU2FRegister,
+	"u2f_authenticate": ClientActionU2FAuthenticate,
+	"make_credential":  ClientActionFIDOMakeCredential,
+	"get_assertion":    ClientActionFIDOGetAssertion,
+	"selection":        ClientActionSelection,
+	"transaction":      ClientActionTransaction,
+	"reset":            ClientActionReset,
+}
+
+// PolicyRule matches requests whose relying party ID matches the RPID glob
+// (path.Match syntax, e.g. "*.test"). U2F requests only carry the hash of the
+// application ID, so they are matched against its hex encoding.
+type PolicyRule struct {
+	RPID     string         `json:"rp_id"`
+	Actions  []string       `json:"actions,omitempty"`
+	Decision PolicyDecision `json:"decision"`
+}
+
+func (rule PolicyRule) matches(action ClientAction, params ClientActionRequestParams) bool {
+	if len(rule.Actions) > 0 {
+		found := false
+		for _, name := range rule.Actions {
+			if policyActionNames[name] == action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	matched, err := path.Match(strings.ToLower(rule.RPID), strings.ToLower(params.RelyingPartyID))
+	return err == nil && matched
+}
+
+type Policy struct {
+	Rules   []PolicyRule   `json:"rules"`
+	Default PolicyDecision `json:"default,omitempty"`
+}
+
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := Policy{}
+	err := json.Unmarshal(data, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode policy: %w", err)
+	}
+	if policy.Default == "" {
+		policy.Default = PolicyAsk
+	}
+	err = policy.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func validPolicyDecision(decision PolicyDecision) bool {
+	return decision == PolicyAllow || decision == PolicyDeny || decision == PolicyAsk
+}
+
+func (policy *Policy) validate() error {
+	if !validPolicyDecision(policy.Default) {
+		return fmt.Errorf("Invalid default policy decision: %q", policy.Default)
+	}
+	for i, rule := range policy.Rules {
+		if _, err := path.Match(rule.RPID, ""); err != nil {
+			return fmt.Errorf("Invalid rp_id pattern in rule %d: %q", i, rule.RPID)
+		}
+		for _, name := range rule.Actions {
+			if _, ok := policyActionNames[name]; !ok {
+				return fmt.Errorf("Unknown action in rule %d: %q", i, name)
+			}
+		}
+		if !validPolicyDecision(rule.Decision) {
+			return fmt.Errorf("Invalid decision in rule %d: %q", i, rule.Decision)
+		}
+	}
+	return nil
+}
+
+// Evaluate returns the decision of the first matching rule, or the default
+func (policy *Policy) Evaluate(action ClientAction, params ClientActionRequestParams) PolicyDecision {
+	for _, rule := range policy.Rules {
+		if rule.matches(action, params) {
+			return rule.Decision
+		}
+	}
+	if policy.Default == "" {
+		return PolicyAsk
+	}
+	return policy.Default
+}
+
+type policyApprover struct {
+	policy   *Policy
+	approver ClientRequestApprover
+}
+
+// NewPolicyApprover evaluates the policy before each request, only falling back
+// to the wrapped approver for requests the policy says to ask about
+func NewPolicyApprover(policy *Policy, approver ClientRequestApprover) ClientRequestApprover {
+	return &policyApprover{policy: policy, approver: approver}
+}
+
+func (approver *policyApprover) ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool {
+	switch approver.policy.Evaluate(action, params) {
+	case PolicyAllow:
+		clientLogger.Printf("POLICY: Allowed %s for '%s'\n\n", action, params.RelyingPartyID)
+		return true
+	case PolicyDeny:
+		clientLogger.Printf("POLICY: Denied %s for '%s'\n\n", action, params.RelyingPartyID)
+		return false
+	default:
+		return approver.approver.ApproveClientAction(action, params)
+	}
+}
@@ -0,0 +1,43 @@
+package fido_client
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+type countingApprover struct {
+	calls int
+	// Of the latest call
+	params ClientActionRequestParams
+}
+
+func (approver *countingApprover) ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool {
+	approver.calls++
+	approver.params = params
+	return true
+}
+
+func TestPolicyApprover(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"rules": [
+			{"rp_id": "*.test", "actions": ["make_credential"], "decision": "allow"},
+			{"rp_id": "evil.example.com", "decision": "deny"}
+		],
+		"default": "ask"
+	}`))
+	test.Assert(t, err == nil, "Could not parse policy")
+	fallback := &countingApprover{}
+	approver := NewPolicyApprover(policy, fallback)
+
+	test.Assert(t, approver.ApproveClientAction(ClientActionFIDOMakeCredential, ClientActionRequestParams{RelyingPartyID: "webauthn.test"}), "Test RP registration should be allowed")
+	test.AssertEqual(t, fallback.calls, 0, "Allowed request should not ask")
+	test.Assert(t, !approver.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{RelyingPartyID: "evil.example.com"}), "Denied RP should be denied")
+	test.Assert(t, approver.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{RelyingPartyID: "webauthn.test"}), "Unmatched action should ask")
+	test.AssertEqual(t, fallback.calls, 1, "Unmatched request should ask")
+
+	_, err = ParsePolicy([]byte(`{"rules": [{"rp_id": "*", "decision": "maybe"}]}`))
+	test.Assert(t, err != nil, "Invalid decision should be rejected")
+	_, err = ParsePolicy([]byte(`{"rules": [{"rp_id": "*", "actions": ["login"], "decision": "allow"}]}`))
+	test.Assert(t, err != nil, "Unknown action should be rejected")
+}
@@ -0,0 +1,212 @@
+package fido_client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// ProfileVault keeps several named profiles, e.g. work and personal, in the data of one
+// ClientDataSaver. Each profile has its own credentials, counters, PIN and AAGUID, and is
+// opened by creating a DefaultFIDOClient with the saver returned by Profile.
+type ProfileVault struct {
+	saver ClientDataSaver
+	// Profiles share the saver, so each save has to read and write it in one go
+	lock sync.RWMutex
+}
+
+// VaultLocker can be implemented by the saver of a ProfileVault whose data other processes
+// use too, like the file shared by a daemon and CLI commands. The vault is locked from
+// reading the data until it's written back, so processes saving at once don't lose each
+// other's profiles.
+type VaultLocker interface {
+	// LockVault waits for the vault, exclusively to update it or shared to read it, and
+	// returns the function that unlocks it
+	LockVault(exclusive bool) (func(), error)
+}
+
+// ProfileRollbackCounter can be implemented by the saver of a ProfileVault to keep a
+// RollbackCounter for each profile
+type ProfileRollbackCounter interface {
+	ProfileRollbackCounter(profile string) uint64
+	SetProfileRollbackCounter(profile string, version uint64)
+}
+
+func NewProfileVault(saver ClientDataSaver) *ProfileVault {
+	return &ProfileVault{saver: saver}
+}
+
+// lockVault locks the vault in this process, and in others if the saver is a VaultLocker
+func (vault *ProfileVault) lockVault(exclusive bool) (func(), error) {
+	unlock := vault.lock.RUnlock
+	if exclusive {
+		vault.lock.Lock()
+		unlock = vault.lock.Unlock
+	} else {
+		vault.lock.RLock()
+	}
+	locker, ok := vault.saver.(VaultLocker)
+	if !ok {
+		return unlock, nil
+	}
+	unlockOthers, err := locker.LockVault(exclusive)
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("Could not lock vault: %w", err)
+	}
+	return func() {
+		unlockOthers()
+		unlock()
+	}, nil
+}
+
+func (vault *ProfileVault) load() (*identities.SavedProfiles, error) {
+	return identities.ParseProfiles(vault.saver.RetrieveData())
+}
+
+func (vault *ProfileVault) store(profiles *identities.SavedProfiles) error {
+	data, err := profiles.Marshal()
+	if err != nil {
+		return err
+	}
+	vault.saver.SaveData(data)
+	return nil
+}
+
+// Profiles returns the names of the saved profiles, in alphabetical order
+func (vault *ProfileVault) Profiles() ([]string, error) {
+	unlock, err := vault.lockVault(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	profiles, err := vault.load()
+	if err != nil {
+		return nil, err
+	}
+	return profiles.Names(), nil
+}
+
+// ActiveProfile is the profile used when none is chosen. It's the first one saved until
+// SetActiveProfile is called, or DefaultProfile in a new vault.
+func (vault *ProfileVault) ActiveProfile() (string, error) {
+	unlock, err := vault.lockVault(false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	profiles, err := vault.load()
+	if err != nil {
+		return "", err
+	}
+	if profiles.ActiveProfile == "" {
+		return identities.DefaultProfile, nil
+	}
+	return profiles.ActiveProfile, nil
+}
+
+func (vault *ProfileVault) SetActiveProfile(name string) error {
+	unlock, err := vault.lockVault(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	profiles, err := vault.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := profiles.Profiles[name]; !ok {
+		return fmt.Errorf("No profile named %q", name)
+	}
+	profiles.ActiveProfile = name
+	return vault.store(profiles)
+}
+
+// DeleteProfile removes a profile and its credentials. The active profile can't be deleted.
+func (vault *ProfileVault) DeleteProfile(name string) error {
+	unlock, err := vault.lockVault(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	profiles, err := vault.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := profiles.Profiles[name]; !ok {
+		return fmt.Errorf("No profile named %q", name)
+	}
+	if name == profiles.ActiveProfile {
+		return fmt.Errorf("Can't delete the active profile %q", name)
+	}
+	delete(profiles.Profiles, name)
+	return vault.store(profiles)
+}
+
+// Profile returns the saver of a profile, which is created the first time it's saved
+func (vault *ProfileVault) Profile(name string) (ClientDataSaver, error) {
+	if err := identities.ValidateProfileName(name); err != nil {
+		return nil, err
+	}
+	saver := &ProfileDataSaver{vault: vault, name: name}
+	if _, ok := vault.saver.(ProfileRollbackCounter); ok {
+		return &countedProfileDataSaver{saver}, nil
+	}
+	return saver, nil
+}
+
+// ProfileDataSaver saves one profile of a ProfileVault
+type ProfileDataSaver struct {
+	vault *ProfileVault
+	name  string
+}
+
+func (saver *ProfileDataSaver) Name() string {
+	return saver.name
+}
+
+func (saver *ProfileDataSaver) SaveData(data []byte) {
+	unlock, err := saver.vault.lockVault(true)
+	util.CheckErr(err, "Could not save vault profiles")
+	defer unlock()
+	profiles, err := saver.vault.load()
+	util.CheckErr(err, "Could not read vault profiles")
+	profiles.Profiles[saver.name] = data
+	if profiles.ActiveProfile == "" {
+		profiles.ActiveProfile = saver.name
+	}
+	err = saver.vault.store(profiles)
+	util.CheckErr(err, "Could not save vault profiles")
+}
+
+func (saver *ProfileDataSaver) RetrieveData() []byte {
+	unlock, err := saver.vault.lockVault(false)
+	util.CheckErr(err, "Could not read vault profiles")
+	defer unlock()
+	profiles, err := saver.vault.load()
+	util.CheckErr(err, "Could not read vault profiles")
+	data, ok := profiles.Profiles[saver.name]
+	if !ok {
+		return nil
+	}
+	return data
+}
+
+func (saver *ProfileDataSaver) Passphrase() string {
+	return saver.vault.saver.Passphrase()
+}
+
+// countedProfileDataSaver is a ProfileDataSaver whose vault keeps rollback counters
+type countedProfileDataSaver struct {
+	*ProfileDataSaver
+}
+
+func (saver *countedProfileDataSaver) RollbackCounter() uint64 {
+	return saver.vault.saver.(ProfileRollbackCounter).ProfileRollbackCounter(saver.name)
+}
+
+func (saver *countedProfileDataSaver) SetRollbackCounter(version uint64) {
+	saver.vault.saver.(ProfileRollbackCounter).SetProfileRollbackCounter(saver.name, version)
+}
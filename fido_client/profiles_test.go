@@ -0,0 +1,155 @@
+package fido_client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/filelock"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+type countingProfileSaver struct {
+	memoryDataSaver
+	counters map[string]uint64
+}
+
+func (saver *countingProfileSaver) ProfileRollbackCounter(profile string) uint64 {
+	return saver.counters[profile]
+}
+
+func (saver *countingProfileSaver) SetProfileRollbackCounter(profile string, version uint64) {
+	saver.counters[profile] = version
+}
+
+func newProfileClient(t *testing.T, vault *ProfileVault, name string) *DefaultFIDOClient {
+	saver, err := vault.Profile(name)
+	test.Assert(t, err == nil, "Could not open profile")
+	client := newTestClient(t, saver)
+	err = client.SetKDFParameters(identities.Argon2idParameters{Time: 1, Memory: 64, Threads: 1})
+	test.Assert(t, err == nil, "Could not set KDF parameters")
+	return client
+}
+
+func TestProfilesAreSeparate(t *testing.T) {
+	vault := NewProfileVault(&memoryDataSaver{})
+	work := newProfileClient(t, vault, "work")
+	personal := newProfileClient(t, vault, "personal")
+	work.SetAAGUID([16]byte{1})
+	makeCredential(ctap.NewCTAPServer(work), false)
+	test.AssertEqual(t, len(work.ListCredentials()), 1, "Credential should be created in its profile")
+	test.AssertEqual(t, len(personal.ListCredentials()), 0, "Credential should not be in other profiles")
+
+	restarted := newProfileClient(t, vault, "work")
+	test.AssertEqual(t, len(restarted.ListCredentials()), 1, "Profile should be saved")
+	test.AssertEqual(t, restarted.AAGUID(), [16]byte{1}, "Profile should keep its AAGUID")
+	test.Assert(t, newProfileClient(t, vault, "personal").AAGUID() != [16]byte{1}, "AAGUID should be per profile")
+
+	names, err := vault.Profiles()
+	test.Assert(t, err == nil, "Could not list profiles")
+	test.AssertArrEqual(t, names, []string{"personal", "work"}, "Both profiles should be saved")
+	active, err := vault.ActiveProfile()
+	test.Assert(t, err == nil, "Could not get active profile")
+	test.AssertEqual(t, active, "work", "First saved profile should be active")
+}
+
+func TestProfilesFromVaultWithoutProfiles(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	makeCredential(ctap.NewCTAPServer(client), false)
+
+	vault := NewProfileVault(saver)
+	active, err := vault.ActiveProfile()
+	test.Assert(t, err == nil, "Could not get active profile")
+	test.AssertEqual(t, active, identities.DefaultProfile, "Old vault should be the default profile")
+	test.AssertEqual(t, len(newProfileClient(t, vault, active).ListCredentials()), 1, "Default profile should have the old credentials")
+	newProfileClient(t, vault, "test").PersistDeviceIdentity()
+	names, err := vault.Profiles()
+	test.Assert(t, err == nil, "Could not list profiles")
+	test.AssertArrEqual(t, names, []string{identities.DefaultProfile, "test"}, "New profile should be added next to the old vault")
+}
+
+func TestSwitchAndDeleteProfiles(t *testing.T) {
+	vault := NewProfileVault(&memoryDataSaver{})
+	test.Assert(t, vault.SetActiveProfile("work") != nil, "Missing profile should not become active")
+	newProfileClient(t, vault, "work").PersistDeviceIdentity()
+	newProfileClient(t, vault, "test").PersistDeviceIdentity()
+	test.Assert(t, vault.DeleteProfile("work") != nil, "Active profile should not be deleted")
+
+	err := vault.SetActiveProfile("test")
+	test.Assert(t, err == nil, "Could not switch profile")
+	active, _ := vault.ActiveProfile()
+	test.AssertEqual(t, active, "test", "Profile should be switched")
+	err = vault.DeleteProfile("work")
+	test.Assert(t, err == nil, "Could not delete profile")
+	names, _ := vault.Profiles()
+	test.AssertArrEqual(t, names, []string{"test"}, "Profile should be deleted")
+
+	_, err = vault.Profile("../work")
+	test.Assert(t, err != nil, "Invalid profile name should be refused")
+}
+
+func TestProfileRollbackCounters(t *testing.T) {
+	saver := &countingProfileSaver{counters: make(map[string]uint64)}
+	vault := NewProfileVault(saver)
+	work := newProfileClient(t, vault, "work")
+	work.SetPINRetries(work.PINRetries() - 1)
+	newProfileClient(t, vault, "personal").PersistDeviceIdentity()
+	test.Assert(t, saver.counters["work"] > saver.counters["personal"], "Each profile should have its own counter")
+}
+
+// fileSaver is a vault file shared by several ProfileVaults, as by several processes
+type fileSaver struct {
+	filename string
+}
+
+func (saver *fileSaver) SaveData(data []byte) {
+	os.WriteFile(saver.filename+".tmp", data, 0600)
+	os.Rename(saver.filename+".tmp", saver.filename)
+}
+
+func (saver *fileSaver) RetrieveData() []byte {
+	data, err := os.ReadFile(saver.filename)
+	if err != nil {
+		return nil
+	}
+	// Leaves time for the other vault to save in between
+	time.Sleep(time.Millisecond)
+	return data
+}
+
+func (saver *fileSaver) Passphrase() string {
+	return "passphrase"
+}
+
+func (saver *fileSaver) LockVault(exclusive bool) (func(), error) {
+	lock, err := filelock.Acquire(saver.filename+".lock", exclusive)
+	if err != nil {
+		return nil, err
+	}
+	return func() { lock.Release() }, nil
+}
+
+func TestProfileVaultLocking(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "vault.json")
+	done := make(chan struct{})
+	for _, name := range []string{"work", "personal"} {
+		go func(name string) {
+			vault := NewProfileVault(&fileSaver{filename: filename})
+			for i := 0; i < 10; i++ {
+				saver, _ := vault.Profile(fmt.Sprintf("%s-%d", name, i))
+				saver.SaveData([]byte(`{}`))
+			}
+			done <- struct{}{}
+		}(name)
+	}
+	<-done
+	<-done
+	profiles, err := NewProfileVault(&fileSaver{filename: filename}).Profiles()
+	test.Assert(t, err == nil, "Could not read profiles")
+	test.AssertEqual(t, len(profiles), 20, "No profile should be lost")
+}
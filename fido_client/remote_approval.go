@@ -0,0 +1,203 @@
+package fido_client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+// Header carrying the hex HMAC-SHA256 of webhook bodies, keyed with the shared secret
+const RemoteApprovalSignatureHeader = "X-Virtual-FIDO-Signature"
+
+// PendingApproval is a request waiting for a decision from outside the process
+type PendingApproval struct {
+	ID              string `json:"id"`
+	Action          string `json:"action"`
+	RelyingParty    string `json:"relying_party,omitempty"`
+	RelyingPartyID  string `json:"relying_party_id,omitempty"`
+	UserName        string `json:"user_name,omitempty"`
+	UserDisplayName string `json:"user_display_name,omitempty"`
+	// Image URLs supplied by the RP, which shouldn't be fetched without care
+	RelyingPartyIcon string    `json:"relying_party_icon,omitempty"`
+	UserIcon         string    `json:"user_icon,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	// When the device stops waiting and denies the request, if it has a timeout
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type pendingRemoteApproval struct {
+	request PendingApproval
+	result  chan bool
+}
+
+// RemoteApprovalUI hands approvals to another device, e.g. a phone. Each request gets an ID
+// that's posted to a webhook and listed by Handler, and is completed by Resolve or a POST to
+// Handler. The CTAP transaction is kept alive while it waits.
+type RemoteApprovalUI struct {
+	webhookURL string
+	// Signs webhooks and authenticates Handler requests as a bearer token
+	secret     string
+	timeout    time.Duration
+	httpClient *http.Client
+	lock       sync.Mutex
+	pending    map[string]*pendingRemoteApproval
+}
+
+// NewRemoteApprovalUI posts new approvals to webhookURL, if it isn't empty. Wrap it with
+// NewApprovalUIApprover using the same timeout, after which approvals are dropped.
+func NewRemoteApprovalUI(webhookURL string, secret string, timeout time.Duration) *RemoteApprovalUI {
+	return &RemoteApprovalUI{
+		webhookURL: webhookURL,
+		secret:     secret,
+		timeout:    timeout,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		pending:    make(map[string]*pendingRemoteApproval),
+	}
+}
+
+func (ui *RemoteApprovalUI) Approve(request ApprovalRequest) <-chan bool {
+	approval := &pendingRemoteApproval{
+		request: PendingApproval{
+			ID:               hex.EncodeToString(crypto.RandomBytes(16)),
+			Action:           request.Action.String(),
+			RelyingParty:     request.Params.RelyingParty,
+			RelyingPartyID:   request.Params.RelyingPartyID,
+			UserName:         request.Params.UserName,
+			UserDisplayName:  request.Params.UserDisplayName,
+			RelyingPartyIcon: request.Params.RelyingPartyIcon,
+			UserIcon:         request.Params.UserIcon,
+			CreatedAt:        time.Now(),
+		},
+		result: make(chan bool, 1),
+	}
+	if ui.timeout > 0 {
+		expiresAt := approval.request.CreatedAt.Add(ui.timeout)
+		approval.request.ExpiresAt = &expiresAt
+	}
+	ui.lock.Lock()
+	ui.pending[approval.request.ID] = approval
+	ui.lock.Unlock()
+	if ui.webhookURL != "" {
+		go ui.notify(approval)
+	}
+	return approval.result
+}
+
+// notify posts the approval to the webhook, denying it if the webhook can't be reached
+func (ui *RemoteApprovalUI) notify(approval *pendingRemoteApproval) {
+	body, err := json.Marshal(approval.request)
+	if err != nil {
+		clientLogger.Printf("ERROR: Could not encode approval: %s\n\n", err)
+		ui.Resolve(approval.request.ID, false)
+		return
+	}
+	request, err := http.NewRequest(http.MethodPost, ui.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		clientLogger.Printf("ERROR: Invalid approval webhook: %s\n\n", err)
+		ui.Resolve(approval.request.ID, false)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if ui.secret != "" {
+		request.Header.Set(RemoteApprovalSignatureHeader, ui.sign(body))
+	}
+	response, err := ui.httpClient.Do(request)
+	if err != nil {
+		clientLogger.Printf("ERROR: Approval webhook failed: %s\n\n", err)
+		ui.Resolve(approval.request.ID, false)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		clientLogger.Printf("ERROR: Approval webhook returned %s\n\n", response.Status)
+		ui.Resolve(approval.request.ID, false)
+	}
+}
+
+func (ui *RemoteApprovalUI) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(ui.secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Resolve completes a pending approval
+func (ui *RemoteApprovalUI) Resolve(id string, approved bool) error {
+	ui.lock.Lock()
+	approval, ok := ui.pending[id]
+	delete(ui.pending, id)
+	ui.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("No pending approval with ID %s", id)
+	}
+	approval.result <- approved
+	return nil
+}
+
+// Pending lists the approvals waiting for a decision, oldest first
+func (ui *RemoteApprovalUI) Pending() []PendingApproval {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+	requests := make([]PendingApproval, 0, len(ui.pending))
+	now := time.Now()
+	for id, approval := range ui.pending {
+		if approval.request.ExpiresAt != nil && now.After(*approval.request.ExpiresAt) {
+			// The device already gave up on it
+			delete(ui.pending, id)
+			continue
+		}
+		requests = append(requests, approval.request)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].CreatedAt.Before(requests[j].CreatedAt)
+	})
+	return requests
+}
+
+type remoteApprovalDecision struct {
+	Approved bool `json:"approved"`
+}
+
+// Handler serves GET /approvals to list pending approvals and POST /approvals/<id> with
+// {"approved": true} to complete one. Requests must carry the secret as a bearer token.
+func (ui *RemoteApprovalUI) Handler() http.Handler {
+	return http.HandlerFunc(ui.serveHTTP)
+}
+
+func (ui *RemoteApprovalUI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if ui.secret != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ui.secret)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("Invalid approval secret"))
+			return
+		}
+	}
+	route := strings.Trim(r.URL.Path, "/")
+	switch {
+	case route == "approvals" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, ui.Pending())
+	case strings.HasPrefix(route, "approvals/") && r.Method == http.MethodPost:
+		var decision remoteApprovalDecision
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Invalid decision: %w", err))
+			return
+		}
+		if err := ui.Resolve(strings.TrimPrefix(route, "approvals/"), decision.Approved); err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("Unknown command: %s %s", r.Method, route))
+	}
+}
@@ -0,0 +1,72 @@
+package fido_client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestRemoteApproval(t *testing.T) {
+	webhooks := make(chan PendingApproval, 1)
+	var signature string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature = r.Header.Get(RemoteApprovalSignatureHeader)
+		var approval PendingApproval
+		json.Unmarshal(body, &approval)
+		webhooks <- approval
+	}))
+	defer webhook.Close()
+	ui := NewRemoteApprovalUI(webhook.URL, "secret", 5*time.Second)
+	approver := NewApprovalUIApprover(ui, 5*time.Second)
+	results := make(chan bool, 1)
+	go func() {
+		results <- approver.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{RelyingPartyID: "example.com"})
+	}()
+	var approval PendingApproval
+	select {
+	case approval = <-webhooks:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Webhook was not called")
+	}
+	test.AssertEqual(t, approval.RelyingPartyID, "example.com", "Webhook should describe the request")
+	test.AssertEqual(t, approval.Action, ClientActionFIDOGetAssertion.String(), "Webhook should describe the action")
+	test.AssertNotEqual(t, signature, "", "Webhook should be signed")
+	test.Assert(t, approval.ExpiresAt != nil, "Webhook should say when the approval expires")
+
+	server := httptest.NewServer(ui.Handler())
+	defer server.Close()
+	response, err := http.Get(server.URL + "/approvals")
+	test.Assert(t, err == nil, "Could not list approvals")
+	test.AssertEqual(t, response.StatusCode, http.StatusUnauthorized, "Secret should be required")
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/approvals/"+approval.ID, strings.NewReader(`{"approved": true}`))
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err = http.DefaultClient.Do(request)
+	test.Assert(t, err == nil, "Could not resolve approval")
+	test.AssertEqual(t, response.StatusCode, http.StatusNoContent, "Approval should be resolved")
+	select {
+	case approved := <-results:
+		test.Assert(t, approved, "Request should be approved")
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Approval was not delivered")
+	}
+	test.AssertEqual(t, len(ui.Pending()), 0, "Resolved approvals shouldn't be pending")
+	test.Assert(t, ui.Resolve(approval.ID, false) != nil, "Approvals can only be resolved once")
+}
+
+func TestRemoteApprovalWebhookFailure(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer webhook.Close()
+	approver := NewApprovalUIApprover(NewRemoteApprovalUI(webhook.URL, "", 5*time.Second), 5*time.Second)
+	approved := approver.ApproveClientAction(ClientActionFIDOMakeCredential, ClientActionRequestParams{})
+	test.Assert(t, !approved, "Requests should be denied if the webhook fails")
+}
@@ -0,0 +1,102 @@
+package fido_client
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SimulatedPresence is a ClientRequestApprover that touches the authenticator by itself, so
+// load tests and demos don't need anyone to approve requests. Each request is approved after
+// Latency plus a random delay of up to Jitter, or as soon as Touch is called. If Manual is
+// set, requests wait for Touch.
+type SimulatedPresence struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Manual  bool
+
+	lock sync.Mutex
+	// Requests waiting for a touch, oldest first
+	waiting []chan struct{}
+}
+
+func NewSimulatedPresence(latency time.Duration, jitter time.Duration) *SimulatedPresence {
+	return &SimulatedPresence{Latency: latency, Jitter: jitter}
+}
+
+// NewManualPresence approves requests only when Touch is called, e.g. from a signal handler
+func NewManualPresence() *SimulatedPresence {
+	return &SimulatedPresence{Manual: true}
+}
+
+func (presence *SimulatedPresence) delay() time.Duration {
+	delay := presence.Latency
+	if presence.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(presence.Jitter) + 1))
+	}
+	return delay
+}
+
+func (presence *SimulatedPresence) ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool {
+	touched := make(chan struct{}, 1)
+	presence.lock.Lock()
+	presence.waiting = append(presence.waiting, touched)
+	presence.lock.Unlock()
+	defer presence.stopWaiting(touched)
+
+	var timeout <-chan time.Time
+	if !presence.Manual {
+		timer := time.NewTimer(presence.delay())
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-touched:
+		clientLogger.Printf("Touched for %s\n\n", action)
+	case <-timeout:
+		clientLogger.Printf("Touched automatically for %s\n\n", action)
+	}
+	return true
+}
+
+func (presence *SimulatedPresence) stopWaiting(touched chan struct{}) {
+	presence.lock.Lock()
+	defer presence.lock.Unlock()
+	for i, waiting := range presence.waiting {
+		if waiting == touched {
+			presence.waiting = append(presence.waiting[:i], presence.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// Touch approves the oldest request waiting for the user. Like touching a real authenticator,
+// it does nothing if no request is waiting, and returns false.
+func (presence *SimulatedPresence) Touch() bool {
+	presence.lock.Lock()
+	defer presence.lock.Unlock()
+	if len(presence.waiting) == 0 {
+		return false
+	}
+	presence.waiting[0] <- struct{}{}
+	presence.waiting = presence.waiting[1:]
+	return true
+}
+
+// Handler touches the authenticator on POST /touch, answering 409 if no request was waiting
+func (presence *SimulatedPresence) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/touch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !presence.Touch() {
+			http.Error(w, "No request is waiting for a touch", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
@@ -0,0 +1,48 @@
+package fido_client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestSimulatedPresenceLatency(t *testing.T) {
+	presence := NewSimulatedPresence(20*time.Millisecond, 20*time.Millisecond)
+	start := time.Now()
+	approved := presence.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{})
+	elapsed := time.Since(start)
+	test.Assert(t, approved, "Simulated touch should approve")
+	test.Assert(t, elapsed >= 20*time.Millisecond, "Touch should wait for the latency")
+	test.Assert(t, elapsed < time.Second, "Touch should not wait much longer than latency and jitter")
+}
+
+func TestManualPresence(t *testing.T) {
+	presence := NewManualPresence()
+	test.Assert(t, !presence.Touch(), "Touching without a waiting request should do nothing")
+
+	result := make(chan bool)
+	go func() {
+		result <- presence.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{})
+	}()
+	select {
+	case <-result:
+		t.Fatal("Manual presence should wait for a touch")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	server := httptest.NewServer(presence.Handler())
+	defer server.Close()
+	response, err := http.Post(server.URL+"/touch", "", nil)
+	test.Assert(t, err == nil, "Could not touch over HTTP")
+	response.Body.Close()
+	test.AssertEqual(t, response.StatusCode, http.StatusNoContent, "Touch should succeed")
+	test.Assert(t, <-result, "Touch should approve the waiting request")
+
+	response, err = http.Post(server.URL+"/touch", "", nil)
+	test.Assert(t, err == nil, "Could not touch over HTTP")
+	response.Body.Close()
+	test.AssertEqual(t, response.StatusCode, http.StatusConflict, "Touch without a waiting request should fail")
+}
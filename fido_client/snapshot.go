@@ -0,0 +1,59 @@
+package fido_client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/identities"
+)
+
+// Snapshot is the state of the authenticator at one point: credentials, counters, PIN state,
+// PIV and OTP slots. CTAPHID channels and requests in progress aren't part of it. It's kept
+// unencrypted in memory, so taking and restoring one skips the passphrase KDF of an export.
+type Snapshot struct {
+	// The device config as JSON, so the snapshot shares nothing with the client
+	config []byte
+	// Regenerated on power up rather than saved, but part of the PIN state a host relies on
+	pinKeyAgreement *crypto.ECDHKey
+}
+
+// Snapshot captures the current state, e.g. so test fixtures can roll the authenticator back
+// between test cases. It waits for requests in progress to finish.
+func (client *DefaultFIDOClient) Snapshot() (*Snapshot, error) {
+	client.transactionLock.Lock()
+	defer client.transactionLock.Unlock()
+	config, err := json.Marshal(client.deviceConfig())
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode snapshot: %w", err)
+	}
+	return &Snapshot{
+		config:          config,
+		pinKeyAgreement: client.pinKeyAgreement,
+	}, nil
+}
+
+// Restore rolls the authenticator back to snapshot and saves it through the ClientDataSaver.
+// It waits for requests in progress to finish. The PIN state version keeps counting up from
+// the current one, so a RollbackCounter doesn't refuse the restored vault.
+func (client *DefaultFIDOClient) Restore(snapshot *Snapshot) error {
+	var config identities.FIDODeviceConfig
+	if err := json.Unmarshal(snapshot.config, &config); err != nil {
+		return fmt.Errorf("Could not decode snapshot: %w", err)
+	}
+	client.transactionLock.Lock()
+	defer client.transactionLock.Unlock()
+	version := client.pinStateVersion
+	if err := client.applyDeviceConfig(&config); err != nil {
+		return err
+	}
+	if client.pinStateVersion < version {
+		client.pinStateVersion = version
+	}
+	client.pinKeyAgreement = snapshot.pinKeyAgreement
+	client.saveData()
+	clientLogger.Printf("Restored snapshot\n\n")
+	events.Publish(events.Event{Type: events.EventVaultReloaded})
+	return nil
+}
@@ -0,0 +1,40 @@
+package fido_client
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	saver := &rollbackDataSaver{}
+	client := newTestClient(t, saver)
+	client.SetPIN([]byte("1234"))
+	snapshot, err := client.Snapshot()
+	test.Assert(t, err == nil, "Could not take snapshot")
+	pinKeyAgreement := client.PINKeyAgreement()
+	counter := client.NewAuthenticationCounterId()
+
+	client.SetPIN([]byte("5678"))
+	client.SetPINRetries(3)
+	client.NewAuthenticationCounterId()
+	client.pinKeyAgreement = crypto.GenerateECDHKey()
+	client.SetOTPSlot(identities.OTPSlot{Slot: 1, Type: identities.OTPSlotHOTP, Secret: make([]byte, 20)})
+	test.Assert(t, client.OTPSlot(1) != nil, "OTP slot should be set")
+
+	err = client.Restore(snapshot)
+	test.Assert(t, err == nil, "Could not restore snapshot")
+	test.AssertArrEqual(t, client.PINHash(), crypto.HashSHA256([]byte("1234"))[:16], "PIN should be rolled back")
+	test.AssertEqual(t, client.PINRetries(), int32(identities.DefaultPINRetries), "PIN retries should be rolled back")
+	test.AssertEqual(t, client.NewAuthenticationCounterId(), counter, "Counter should be rolled back")
+	test.Assert(t, client.PINKeyAgreement() == pinKeyAgreement, "PIN key agreement should be rolled back")
+	test.Assert(t, client.OTPSlot(1) == nil, "OTP slots should be rolled back")
+	test.Assert(t, !loadPanics(t, saver), "Restored state should be saved without looking rolled back")
+
+	// A snapshot can be restored more than once
+	client.SetPINRetries(2)
+	test.Assert(t, client.Restore(snapshot) == nil, "Could not restore snapshot again")
+	test.AssertEqual(t, client.PINRetries(), int32(identities.DefaultPINRetries), "PIN retries should be rolled back again")
+}
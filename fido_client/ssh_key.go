@@ -0,0 +1,35 @@
+package fido_client
+
+import (
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// NewSSHKey creates a resident credential for application, usually "ssh:", and returns the
+// files of an OpenSSH security key backed by it, as `ssh-keygen -t ecdsa-sk -O resident`
+// would. user names the key among others for the same application and may be empty.
+func (client *DefaultFIDOClient) NewSSHKey(keyType identities.SSHKeyType, application string, user string, flags byte, comment string) (*identities.SSHKey, error) {
+	if keyType != identities.SSHKeyTypeECDSASK {
+		return nil, fmt.Errorf("Only %s keys are supported, credentials are always ECDSA P-256", identities.SSHKeyTypeECDSASK)
+	}
+	if !identities.ValidSSHApplication(application) {
+		return nil, fmt.Errorf("SSH application %q doesn't start with %q", application, identities.DefaultSSHApplication)
+	}
+	name := user
+	if name == "" {
+		name = "openssh"
+	}
+	source := client.NewCredentialSource(
+		[]webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		nil,
+		&webauthn.PublicKeyCredentialRPEntity{ID: application, Name: application},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: identities.SSHUserID(user), Name: name, DisplayName: name},
+	)
+	if source == nil {
+		return nil, fmt.Errorf("Could not create credential")
+	}
+	return identities.NewSSHKey(source, flags|identities.SSHKeyFlagResident, comment)
+}
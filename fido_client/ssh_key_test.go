@@ -0,0 +1,33 @@
+package fido_client
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewSSHKey(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	key, err := client.NewSSHKey(identities.SSHKeyTypeECDSASK, identities.DefaultSSHApplication, "", identities.SSHKeyFlagUserPresence, "")
+	test.Assert(t, err == nil, "Could not create SSH key")
+	_, _, _, _, err = ssh.ParseAuthorizedKey(key.PublicKey)
+	test.Assert(t, err == nil, "Public key should parse")
+	sources := client.Identities()
+	test.AssertEqual(t, len(sources), 1, "A resident credential should be created")
+	test.AssertEqual(t, sources[0].RelyingParty.ID, identities.DefaultSSHApplication, "Credential should be for the application")
+
+	_, err = client.NewSSHKey(identities.SSHKeyTypeECDSASK, identities.DefaultSSHApplication, "", identities.SSHKeyFlagUserPresence, "")
+	test.Assert(t, err == nil, "Could not create SSH key")
+	test.AssertEqual(t, len(client.Identities()), 1, "A key for the same application and user should replace the old one")
+	_, err = client.NewSSHKey(identities.SSHKeyTypeECDSASK, identities.DefaultSSHApplication, "work", identities.SSHKeyFlagUserPresence, "")
+	test.Assert(t, err == nil, "Could not create SSH key")
+	test.AssertEqual(t, len(client.Identities()), 2, "Keys for other users should be kept")
+
+	_, err = client.NewSSHKey(identities.SSHKeyTypeEd25519SK, identities.DefaultSSHApplication, "", identities.SSHKeyFlagUserPresence, "")
+	test.Assert(t, err != nil, "Ed25519 keys should be rejected")
+	_, err = client.NewSSHKey(identities.SSHKeyTypeECDSASK, "example.com", "", identities.SSHKeyFlagUserPresence, "")
+	test.Assert(t, err != nil, "Applications must start with ssh:")
+	test.AssertEqual(t, len(client.Identities()), 2, "Rejected keys should not create credentials")
+}
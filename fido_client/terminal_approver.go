@@ -0,0 +1,108 @@
+package fido_client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TerminalApprover is a ClientRequestApprover that asks for approval on a terminal.
+// If AutoApproveTimeout is set, requests without an answer are approved once it expires.
+type TerminalApprover struct {
+	AutoApproveTimeout time.Duration
+
+	input     io.Reader
+	output    io.Writer
+	lines     chan string
+	startOnce sync.Once
+	lock      sync.Mutex
+}
+
+func NewTerminalApprover(input io.Reader, output io.Writer, autoApproveTimeout time.Duration) *TerminalApprover {
+	return &TerminalApprover{
+		AutoApproveTimeout: autoApproveTimeout,
+		input:              input,
+		output:             output,
+		lines:              make(chan string, 16),
+	}
+}
+
+// Input is read on a single goroutine so that a prompt which timed out doesn't
+// leave a pending read around to swallow the answer to the next prompt
+func (approver *TerminalApprover) readLines() {
+	scanner := bufio.NewScanner(approver.input)
+	for scanner.Scan() {
+		approver.lines <- scanner.Text()
+	}
+	close(approver.lines)
+}
+
+func (approver *TerminalApprover) ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool {
+	approver.startOnce.Do(func() { go approver.readLines() })
+	approver.lock.Lock()
+	defer approver.lock.Unlock()
+
+	// Anything typed before the prompt was shown isn't an answer to it
+	for len(approver.lines) > 0 {
+		<-approver.lines
+	}
+	fmt.Fprintf(approver.output, "\n%s requested\n", action)
+	fmt.Fprint(approver.output, formatApprovalDetails(action, params))
+	if approver.AutoApproveTimeout > 0 {
+		fmt.Fprintf(approver.output, "Approve (y/n)? Approving automatically in %s\n", approver.AutoApproveTimeout)
+	} else {
+		fmt.Fprintf(approver.output, "Approve (y/n)?\n")
+	}
+	fmt.Fprint(approver.output, "--> ")
+
+	var timeout <-chan time.Time
+	if approver.AutoApproveTimeout > 0 {
+		timer := time.NewTimer(approver.AutoApproveTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case line, ok := <-approver.lines:
+		if !ok {
+			fmt.Fprintf(approver.output, "\nNo input available, denying\n")
+			return false
+		}
+		response := strings.ToLower(strings.TrimSpace(line))
+		return response == "y" || response == "yes"
+	case <-timeout:
+		fmt.Fprintf(approver.output, "\nApproved automatically\n")
+		return true
+	}
+}
+
+func formatApprovalDetails(action ClientAction, params ClientActionRequestParams) string {
+	var builder strings.Builder
+	if action == ClientActionSelection {
+		fmt.Fprintf(&builder, "  * Virtual FIDO is blinking * Approve if this is the authenticator you want to use\n")
+	}
+	if action == ClientActionReset {
+		fmt.Fprintf(&builder, "  Approving deletes every credential and the PIN\n")
+	}
+	if params.RelyingParty != "" || params.RelyingPartyID != "" {
+		fmt.Fprintf(&builder, "  Relying party: %s\n", formatNameAndID(params.RelyingParty, params.RelyingPartyID))
+	}
+	if params.UserDisplayName != "" || params.UserName != "" {
+		fmt.Fprintf(&builder, "  User:          %s\n", formatNameAndID(params.UserDisplayName, params.UserName))
+	}
+	if params.Transaction != "" {
+		fmt.Fprintf(&builder, "  Transaction:   %s\n", params.Transaction)
+	}
+	return builder.String()
+}
+
+func formatNameAndID(name string, id string) string {
+	if name == "" {
+		return id
+	} else if id == "" || id == name {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, id)
+}
@@ -0,0 +1,86 @@
+package fido_client
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// promptOutput answers each prompt with the next of answers
+type promptOutput struct {
+	lock    sync.Mutex
+	output  bytes.Buffer
+	input   *io.PipeWriter
+	answers []string
+}
+
+func (output *promptOutput) Write(data []byte) (int, error) {
+	output.lock.Lock()
+	defer output.lock.Unlock()
+	output.output.Write(data)
+	if strings.Contains(string(data), "--> ") && len(output.answers) > 0 {
+		answer := output.answers[0]
+		output.answers = output.answers[1:]
+		go output.input.Write([]byte(answer + "\n"))
+	}
+	return len(data), nil
+}
+
+func (output *promptOutput) String() string {
+	output.lock.Lock()
+	defer output.lock.Unlock()
+	return output.output.String()
+}
+
+func newPromptedApprover(timeout time.Duration, answers ...string) (*TerminalApprover, *promptOutput) {
+	reader, writer := io.Pipe()
+	output := &promptOutput{input: writer, answers: answers}
+	return NewTerminalApprover(reader, output, timeout), output
+}
+
+func TestTerminalApproverShowsDetails(t *testing.T) {
+	approver, output := newPromptedApprover(0, "y", "n")
+	params := ClientActionRequestParams{
+		RelyingParty:    "Example",
+		RelyingPartyID:  "example.com",
+		UserName:        "alice",
+		UserDisplayName: "Alice",
+	}
+	test.Assert(t, approver.ApproveClientAction(ClientActionFIDOMakeCredential, params), "Answering y should approve")
+	prompt := output.String()
+	test.Assert(t, strings.Contains(prompt, "Account creation requested"), "Prompt should name the action")
+	test.Assert(t, strings.Contains(prompt, "Relying party: Example (example.com)"), "Prompt should show the RP name and ID")
+	test.Assert(t, strings.Contains(prompt, "User:          Alice (alice)"), "Prompt should show the user's display name and name")
+	test.Assert(t, !approver.ApproveClientAction(ClientActionFIDOGetAssertion, params), "Answering n should deny")
+}
+
+func TestTerminalApproverTimeout(t *testing.T) {
+	approver, output := newPromptedApprover(10 * time.Millisecond)
+	test.Assert(t, approver.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{}), "Unanswered prompt should be approved once the timeout expires")
+	test.Assert(t, strings.Contains(output.String(), "Approved automatically"), "Automatic approval should be announced")
+
+	closed := NewTerminalApprover(strings.NewReader(""), io.Discard, 0)
+	test.Assert(t, !closed.ApproveClientAction(ClientActionFIDOGetAssertion, ClientActionRequestParams{}), "Closed input should deny")
+}
+
+func TestFormatApprovalDetails(t *testing.T) {
+	test.AssertEqual(t, formatApprovalDetails(ClientActionFIDOGetAssertion, ClientActionRequestParams{RelyingParty: "example.com", RelyingPartyID: "example.com"}),
+		"  Relying party: example.com\n", "Matching RP name and ID should be shown once")
+	test.AssertEqual(t, formatApprovalDetails(ClientActionFIDOGetAssertion, ClientActionRequestParams{UserName: "alice"}),
+		"  User:          alice\n", "A user without a display name should be shown by name")
+	test.AssertEqual(t, formatApprovalDetails(ClientActionFIDOGetAssertion, ClientActionRequestParams{}), "", "Missing details shouldn't be shown")
+	test.Assert(t, strings.Contains(formatApprovalDetails(ClientActionReset, ClientActionRequestParams{}), "deletes every credential"), "Reset should warn about deleting credentials")
+}
+
+func TestU2FApprovalShowsApplication(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	approver := client.requestApprover.(*countingApprover)
+	client.ApproveU2FAuthentication(&webauthn.KeyHandle{ApplicationID: []byte{0xab, 0xcd}})
+	test.AssertEqual(t, approver.params, ClientActionRequestParams{RelyingPartyID: "abcd"}, "U2F approval should show the application parameter")
+}
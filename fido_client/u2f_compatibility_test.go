@@ -0,0 +1,92 @@
+package fido_client
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const testAppID = "https://example.com/appid.json"
+
+func u2fRequest(command uint8, param1 uint8, data []byte) []byte {
+	return util.Concat([]byte{0, command, param1, 0, 0}, util.ToBE(uint16(len(data))), data)
+}
+
+func u2fRegister(t *testing.T, server *u2f.U2FServer, applicationID []byte) []byte {
+	response := server.HandleMessage(u2fRequest(0x01, 0, util.Concat(crypto.RandomBytes(32), applicationID)))
+	test.Assert(t, bytes.Equal(response[len(response)-2:], []byte{0x90, 0x00}), "U2F registration should succeed")
+	keyHandleLength := int(response[66])
+	return response[67 : 67+keyHandleLength]
+}
+
+func ctapGetAssertion(server *ctap.CTAPServer, keyHandle []byte, extensions map[string]interface{}) []byte {
+	args := map[int]interface{}{
+		1: "example.com",
+		2: crypto.HashSHA256([]byte("client data")),
+		3: []map[string]interface{}{{"type": "public-key", "id": keyHandle}},
+	}
+	if extensions != nil {
+		args[4] = extensions
+	}
+	return server.HandleMessage(append([]byte{0x02}, util.MarshalCBOR(args)...))
+}
+
+func TestU2FCredentialsWithCTAP2(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	u2fServer := u2f.NewU2FServer(client)
+	ctapServer := ctap.NewCTAPServer(client)
+	appIDHash := crypto.HashSHA256([]byte(testAppID))
+	keyHandle := u2fRegister(t, u2fServer, appIDHash)
+
+	response := ctapGetAssertion(ctapServer, keyHandle, nil)
+	test.AssertEqual(t, response[0], byte(0x2E), "U2F credential shouldn't match the RP ID without appid")
+
+	response = ctapGetAssertion(ctapServer, keyHandle, map[string]interface{}{"appid": testAppID})
+	test.AssertEqual(t, response[0], byte(0x00), "U2F credential should match the appid")
+	var decoded map[int]interface{}
+	err := cbor.Unmarshal(response[1:], &decoded)
+	test.Assert(t, err == nil, "Could not decode response")
+	authData := decoded[2].([]byte)
+	test.Assert(t, bytes.Equal(authData[:32], appIDHash), "Assertion should be signed for the appid")
+
+	args := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("client data")),
+		2: map[string]string{"id": "example.com", "name": "Example"},
+		3: map[string]interface{}{"id": []byte{1, 2, 3}, "name": "alice", "displayName": "Alice"},
+		4: []map[string]interface{}{{"alg": cose.COSE_ALGORITHM_ID_ES256, "type": "public-key"}},
+		5: []map[string]interface{}{{"type": "public-key", "id": keyHandle}},
+		6: map[string]interface{}{"appidExclude": testAppID},
+	}
+	response = ctapServer.HandleMessage(append([]byte{0x01}, util.MarshalCBOR(args)...))
+	test.AssertEqual(t, response[0], byte(0x19), "appidExclude should exclude the U2F credential")
+	test.AssertEqual(t, len(client.ListCredentials()), 0, "No credential should be created")
+}
+
+func TestCTAP2CredentialsWithU2F(t *testing.T) {
+	client := newTestClient(t, &memoryDataSaver{})
+	u2fServer := u2f.NewU2FServer(client)
+	ctapServer := ctap.NewCTAPServer(client)
+	response := makeCredential(ctapServer, false)
+	test.AssertEqual(t, response[0], byte(0x00), "MakeCredential should succeed")
+	credentials := client.ListCredentials()
+	test.AssertEqual(t, len(credentials), 1, "Credential should be created")
+	credentialID := credentials[0].ID
+
+	application := crypto.HashSHA256([]byte("example.com"))
+	request := util.Concat(crypto.RandomBytes(32), application, []byte{uint8(len(credentialID))}, credentialID)
+	response = u2fServer.HandleMessage(u2fRequest(0x02, 0x07, request))
+	test.Assert(t, bytes.Equal(response, []byte{0x69, 0x85}), fmt.Sprintf("Check-only should find the CTAP2 credential: %x", response))
+
+	response = u2fServer.HandleMessage(u2fRequest(0x02, 0x03, request))
+	test.Assert(t, bytes.Equal(response[len(response)-2:], []byte{0x90, 0x00}), "U2F authentication with a CTAP2 credential should succeed")
+	u2fCounter := util.FromBE[uint32](response[1:5])
+	test.Assert(t, u2fCounter > uint32(credentials[0].SignatureCounter), "U2F counter should be past the credential's counter")
+}
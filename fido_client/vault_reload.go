@@ -0,0 +1,95 @@
+package fido_client
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+func (client *DefaultFIDOClient) setSavedData(data []byte) {
+	client.savedDataLock.Lock()
+	defer client.savedDataLock.Unlock()
+	client.savedDataHash = crypto.HashSHA256(data)
+}
+
+// changedData returns the vault if it was changed by someone other than this client
+func (client *DefaultFIDOClient) changedData() []byte {
+	data := client.dataSaver.RetrieveData()
+	if data == nil {
+		return nil
+	}
+	client.savedDataLock.Lock()
+	defer client.savedDataLock.Unlock()
+	if bytes.Equal(crypto.HashSHA256(data), client.savedDataHash) {
+		return nil
+	}
+	return data
+}
+
+// BeginTransaction is called by the CTAP and U2F servers before each request, so the vault
+// isn't reloaded while it's being used
+func (client *DefaultFIDOClient) BeginTransaction() {
+	client.transactionLock.RLock()
+}
+
+func (client *DefaultFIDOClient) EndTransaction() {
+	client.transactionLock.RUnlock()
+}
+
+// ReloadVault loads the vault again if it was changed by something else, like a CLI command
+// run while the device is attached. It waits for requests in progress to finish, so no
+// request sees part of the old vault and part of the new one. It returns whether the vault
+// was reloaded.
+func (client *DefaultFIDOClient) ReloadVault() (bool, error) {
+	if client.changedData() == nil {
+		return false, nil
+	}
+	client.transactionLock.Lock()
+	defer client.transactionLock.Unlock()
+	// A request may have saved the vault while we waited
+	data := client.changedData()
+	if data == nil {
+		return false, nil
+	}
+	state, err := identities.DecryptFIDOState(data, client.dataSaver.Passphrase())
+	if err != nil {
+		return false, fmt.Errorf("Could not decrypt vault data: %w", err)
+	}
+	params, err := identities.PassphraseParameters(data)
+	if err != nil {
+		return false, err
+	}
+	if counter, ok := client.dataSaver.(RollbackCounter); ok {
+		var version uint64
+		if state.PINState != nil {
+			version = state.PINState.Version
+		}
+		if version < counter.RollbackCounter() {
+			return false, fmt.Errorf("Vault was rolled back from version %d to %d", counter.RollbackCounter(), version)
+		}
+	}
+	err = client.applyDeviceConfig(state)
+	if err != nil {
+		return false, err
+	}
+	client.kdfParameters = params
+	client.setSavedData(data)
+	clientLogger.Printf("Reloaded vault\n\n")
+	events.Publish(events.Event{Type: events.EventVaultReloaded})
+	return true, nil
+}
+
+// WatchVault checks every interval whether the vault was changed by something else and
+// reloads it, until a value is sent on the returned channel
+func (client *DefaultFIDOClient) WatchVault(interval time.Duration) chan interface{} {
+	return util.StartRecurringFunction(func() {
+		if _, err := client.ReloadVault(); err != nil {
+			clientLogger.Printf("ERROR: Could not reload vault: %s\n\n", err)
+		}
+	}, interval.Milliseconds())
+}
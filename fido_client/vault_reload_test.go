@@ -0,0 +1,60 @@
+package fido_client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestReloadVault(t *testing.T) {
+	saver := &memoryDataSaver{}
+	// tool stands in for a CLI command editing the vault while the device is attached
+	device, tool := newTestClient(t, saver), newTestClient(t, saver)
+	reloaded, err := device.ReloadVault()
+	test.Assert(t, err == nil, "Could not check vault")
+	test.Assert(t, !reloaded, "Unchanged vault should not be reloaded")
+
+	makeCredential(ctap.NewCTAPServer(tool), false)
+	test.AssertEqual(t, len(device.ListCredentials()), 0, "Device should not see the change before reloading")
+	reloaded, err = device.ReloadVault()
+	test.Assert(t, err == nil, "Could not reload vault")
+	test.Assert(t, reloaded, "Changed vault should be reloaded")
+	test.AssertEqual(t, len(device.ListCredentials()), 1, "Reloaded vault should have the new credential")
+
+	reloaded, err = device.ReloadVault()
+	test.Assert(t, err == nil, "Could not check vault")
+	test.Assert(t, !reloaded, "Vault should only be reloaded once")
+}
+
+func TestReloadVaultIgnoresOwnSaves(t *testing.T) {
+	device := newTestClient(t, &memoryDataSaver{})
+	makeCredential(ctap.NewCTAPServer(device), false)
+	reloaded, err := device.ReloadVault()
+	test.Assert(t, err == nil, "Could not check vault")
+	test.Assert(t, !reloaded, "Vault saved by the device should not be reloaded")
+}
+
+func TestReloadVaultWaitsForTransaction(t *testing.T) {
+	saver := &memoryDataSaver{}
+	// tool stands in for a CLI command editing the vault while the device is attached
+	device, tool := newTestClient(t, saver), newTestClient(t, saver)
+	makeCredential(ctap.NewCTAPServer(tool), false)
+
+	device.BeginTransaction()
+	done := make(chan bool)
+	go func() {
+		reloaded, _ := device.ReloadVault()
+		done <- reloaded
+	}()
+	select {
+	case <-done:
+		t.Fatal("Reload should wait for the transaction to end")
+	case <-time.After(20 * time.Millisecond):
+	}
+	test.AssertEqual(t, len(device.ListCredentials()), 0, "Vault should not change during a transaction")
+	device.EndTransaction()
+	test.Assert(t, <-done, "Vault should be reloaded after the transaction")
+	test.AssertEqual(t, len(device.ListCredentials()), 1, "Reloaded vault should have the new credential")
+}
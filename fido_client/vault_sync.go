@@ -0,0 +1,90 @@
+package fido_client
+
+import (
+	"bytes"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+func (client *DefaultFIDOClient) ensureSyncState() *identities.SavedSyncState {
+	if client.syncState == nil {
+		client.syncState = &identities.SavedSyncState{PrivateKey: crypto.RandomBytes(32)}
+		client.saveData()
+	}
+	return client.syncState
+}
+
+// SyncPrivateKey returns the key identifying this instance to its sync peers, creating it the
+// first time
+func (client *DefaultFIDOClient) SyncPrivateKey() []byte {
+	return client.ensureSyncState().PrivateKey
+}
+
+func (client *DefaultFIDOClient) SyncPeers() []identities.SyncPeer {
+	if client.syncState == nil {
+		return nil
+	}
+	return append([]identities.SyncPeer{}, client.syncState.Peers...)
+}
+
+// AddSyncPeer trusts a paired instance, replacing any peer with the same public key
+func (client *DefaultFIDOClient) AddSyncPeer(peer identities.SyncPeer) {
+	state := client.ensureSyncState()
+	for i := range state.Peers {
+		if bytes.Equal(state.Peers[i].PublicKey, peer.PublicKey) {
+			state.Peers[i] = peer
+			client.saveData()
+			return
+		}
+	}
+	state.Peers = append(state.Peers, peer)
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) RemoveSyncPeer(publicKey []byte) bool {
+	if client.syncState == nil {
+		return false
+	}
+	for i, peer := range client.syncState.Peers {
+		if bytes.Equal(peer.PublicKey, publicKey) {
+			client.syncState.Peers = append(client.syncState.Peers[:i], client.syncState.Peers[i+1:]...)
+			client.saveData()
+			return true
+		}
+	}
+	return false
+}
+
+// SyncSnapshot returns the credentials and deletions to send to a peer
+func (client *DefaultFIDOClient) SyncSnapshot() identities.SyncSnapshot {
+	snapshot := identities.SyncSnapshot{Sources: client.vault.Export()}
+	if client.syncState != nil {
+		snapshot.Tombstones = client.syncState.Tombstones
+	}
+	return snapshot
+}
+
+// ApplySyncSnapshot merges a peer's snapshot into the vault and saves it
+func (client *DefaultFIDOClient) ApplySyncSnapshot(peerPublicKey []byte, remote identities.SyncSnapshot) error {
+	merged := identities.MergeSyncSnapshots(client.SyncSnapshot(), remote)
+	for i := range merged.Sources {
+		// Both instances now have a copy
+		if merged.Sources[i].BackupEligible {
+			merged.Sources[i].BackedUp = true
+		}
+	}
+	if err := client.vault.Replace(merged.Sources); err != nil {
+		return err
+	}
+	state := client.ensureSyncState()
+	state.Tombstones = merged.Tombstones
+	for i := range state.Peers {
+		if bytes.Equal(state.Peers[i].PublicKey, peerPublicKey) {
+			state.Peers[i].LastSyncedAt = util.Now().UTC()
+		}
+	}
+	client.saveData()
+	return nil
+}
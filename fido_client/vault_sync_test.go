@@ -0,0 +1,71 @@
+package fido_client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestApplySyncSnapshot(t *testing.T) {
+	laptop := newTestClient(t, &memoryDataSaver{})
+	serverSaver := &memoryDataSaver{}
+	server := newTestClient(t, serverSaver)
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	alice := &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"}
+	bob := &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "bob"}
+	params := []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}}
+	kept := laptop.NewCredentialSource(params, nil, rp, alice)
+	deleted := laptop.NewCredentialSource(params, nil, rp, bob)
+
+	err := server.ApplySyncSnapshot(nil, laptop.SyncSnapshot())
+	test.Assert(t, err == nil, "Could not apply snapshot")
+	test.AssertEqual(t, len(server.ListCredentials()), 2, "Server should have the laptop's credentials")
+	restarted := newTestClient(t, serverSaver)
+	test.AssertEqual(t, len(restarted.ListCredentials()), 2, "Synced credentials should be saved")
+
+	laptop.SyncPrivateKey()
+	test.Assert(t, laptop.DeleteIdentity(deleted.ID), "Could not delete credential")
+	err = laptop.ApplySyncSnapshot(nil, server.SyncSnapshot())
+	test.Assert(t, err == nil, "Could not apply snapshot")
+	test.AssertEqual(t, len(laptop.ListCredentials()), 1, "Deleted credential should not come back from the server")
+
+	err = server.ApplySyncSnapshot(nil, laptop.SyncSnapshot())
+	test.Assert(t, err == nil, "Could not apply snapshot")
+	test.AssertEqual(t, len(server.ListCredentials()), 1, "Deletion should reach the server")
+	test.AssertArrEqual(t, server.ListCredentials()[0].ID, kept.ID, "Other credentials should be kept")
+}
+
+func TestBackupEligibilityFollowsSync(t *testing.T) {
+	saver := &memoryDataSaver{}
+	client := newTestClient(t, saver)
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	user := &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"}
+	params := []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}}
+
+	deviceBound := client.NewCredentialSource(params, nil, rp, user)
+	user = &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "bob"}
+	test.Assert(t, !deviceBound.BackupEligible, "Credentials should be device-bound without sync peers")
+
+	client.AddSyncPeer(identities.SyncPeer{Name: "server", PublicKey: []byte("server key")})
+	passkey := client.NewCredentialSource(params, nil, rp, user)
+	test.Assert(t, passkey.BackupEligible && !passkey.BackedUp, "Credentials should be eligible once paired")
+
+	err := client.ApplySyncSnapshot([]byte("server key"), identities.SyncSnapshot{})
+	test.Assert(t, err == nil, "Could not apply snapshot")
+	restarted := newTestClient(t, saver)
+	for _, credential := range restarted.ListCredentials() {
+		if bytes.Equal(credential.ID, passkey.ID) {
+			test.Assert(t, credential.BackupEligible && credential.BackedUp, "Synced passkey should be backed up")
+		} else {
+			test.Assert(t, !credential.BackupEligible && !credential.BackedUp, "Device-bound credential should stay device-bound")
+		}
+	}
+
+	client.SetBackupEligibility(BackupEligibilityNever)
+	user = &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{3}, Name: "carol"}
+	test.Assert(t, !client.NewCredentialSource(params, nil, rp, user).BackupEligible, "Eligibility should be configurable")
+}
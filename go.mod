@@ -5,11 +5,18 @@ go 1.19
 require (
 	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/spf13/cobra v1.5.0
+	go.etcd.io/bbolt v1.3.9
 	golang.org/x/crypto v0.22.0
+	golang.org/x/sys v0.19.0
+	google.golang.org/grpc v1.63.2
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240227224415-6ceb2ff114de // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -0,0 +1,157 @@
+// Package hidproxy forwards the CTAPHID reports of the virtual USB device to a real FIDO key
+// attached to this machine through Linux hidraw, so a physical key can be remoted into a VM
+// over USB/IP. Reports are passed through unchanged: the real key allocates channels and
+// answers CTAP2 and U2F itself, and never learns it isn't plugged into the host.
+//
+// Alternatively, Key sends single messages to the key as a host would, and CTAPRouter and
+// U2FRouter pick per relying party whether the key or a software authenticator answers.
+package hidproxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var proxyLogger = util.NewLogger("[PROXY] ", util.LogSubsystemProxy, util.LogLevelDebug)
+
+// FIDO keys use 64 byte reports, which is also what the virtual device must use
+const ReportSize = 64
+
+// FIDO Alliance usage page of the CTAPHID interface (CTAP 2.1 section 11.2.8.1)
+const fidoUsagePage = 0xF1D0
+
+const hidrawClassPath = "/sys/class/hidraw"
+
+// HIDProxy is a usb.USBDeviceDelegate backed by a hidraw device
+type HIDProxy struct {
+	device     io.ReadWriteCloser
+	writeLock  sync.Mutex
+	handler    func(response []byte)
+	handlerSet chan struct{}
+	closeOnce  sync.Once
+}
+
+// Open opens a hidraw device, e.g. /dev/hidraw3, after checking it's a FIDO key
+func Open(path string) (*HIDProxy, error) {
+	descriptor, err := os.ReadFile(filepath.Join(hidrawClassPath, filepath.Base(path), "device", "report_descriptor"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read report descriptor of %s: %w", path, err)
+	}
+	if !IsFIDOReportDescriptor(descriptor) {
+		return nil, fmt.Errorf("%s is not a FIDO device", path)
+	}
+	device, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", path, err)
+	}
+	proxyLogger.Printf("Forwarding to %s\n\n", path)
+	return NewHIDProxy(device), nil
+}
+
+// NewHIDProxy forwards to device, which reads and writes one report at a time like hidraw
+func NewHIDProxy(device io.ReadWriteCloser) *HIDProxy {
+	proxy := &HIDProxy{device: device, handlerSet: make(chan struct{})}
+	go proxy.readReports()
+	return proxy
+}
+
+// FindDevices returns the hidraw devices that are FIDO keys
+func FindDevices() ([]string, error) {
+	entries, err := os.ReadDir(hidrawClassPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list hidraw devices: %w", err)
+	}
+	devices := make([]string, 0)
+	for _, entry := range entries {
+		descriptor, err := os.ReadFile(filepath.Join(hidrawClassPath, entry.Name(), "device", "report_descriptor"))
+		if err == nil && IsFIDOReportDescriptor(descriptor) {
+			devices = append(devices, filepath.Join("/dev", entry.Name()))
+		}
+	}
+	return devices, nil
+}
+
+// IsFIDOReportDescriptor reports whether a HID report descriptor uses the FIDO usage page
+func IsFIDOReportDescriptor(descriptor []byte) bool {
+	for i := 0; i < len(descriptor); {
+		prefix := descriptor[i]
+		if prefix == 0xFE {
+			// Long item, with its data size in the next byte
+			if i+1 >= len(descriptor) {
+				return false
+			}
+			i += 3 + int(descriptor[i+1])
+			continue
+		}
+		size := int(prefix & 0x03)
+		if size == 3 {
+			size = 4
+		}
+		if i+1+size > len(descriptor) {
+			return false
+		}
+		// Usage Page is global item tag 0
+		if prefix&0xFC == 0x04 {
+			usagePage := 0
+			for j := size - 1; j >= 0; j-- {
+				usagePage = usagePage<<8 | int(descriptor[i+1+j])
+			}
+			if usagePage == fidoUsagePage {
+				return true
+			}
+		}
+		i += 1 + size
+	}
+	return false
+}
+
+// HandleMessage writes an output report to the key. hidraw takes the report ID first, 0 for
+// keys without report IDs, as FIDO keys are.
+func (proxy *HIDProxy) HandleMessage(report []byte) {
+	if len(report) > ReportSize {
+		proxyLogger.Printf("ERROR: Dropping %d byte report, keys take %d bytes\n\n", len(report), ReportSize)
+		return
+	}
+	output := make([]byte, 1+ReportSize)
+	copy(output[1:], report)
+	proxy.writeLock.Lock()
+	defer proxy.writeLock.Unlock()
+	proxyLogger.Printf("OUT: %x\n\n", report)
+	if _, err := proxy.device.Write(output); err != nil {
+		proxyLogger.Printf("ERROR: Could not write to key: %s\n\n", err)
+	}
+}
+
+// SetResponseHandler starts passing the key's input reports to handler
+func (proxy *HIDProxy) SetResponseHandler(handler func(response []byte)) {
+	proxy.handler = handler
+	close(proxy.handlerSet)
+}
+
+func (proxy *HIDProxy) readReports() {
+	<-proxy.handlerSet
+	report := make([]byte, ReportSize)
+	for {
+		n, err := proxy.device.Read(report)
+		if err != nil {
+			proxyLogger.Printf("ERROR: Stopped reading from key: %s\n\n", err)
+			return
+		}
+		proxyLogger.Printf("IN: %x\n\n", report[:n])
+		proxy.handler(append([]byte{}, report[:n]...))
+	}
+}
+
+// Close releases the key. Requests in progress are lost.
+func (proxy *HIDProxy) Close() error {
+	var err error
+	proxy.closeOnce.Do(func() {
+		err = proxy.device.Close()
+	})
+	return err
+}
@@ -0,0 +1,78 @@
+package hidproxy
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestIsFIDOReportDescriptor(t *testing.T) {
+	// Descriptor of a YubiKey's FIDO interface
+	fido := []byte{
+		0x06, 0xD0, 0xF1, 0x09, 0x01, 0xA1, 0x01, 0x09, 0x20, 0x15, 0x00, 0x26, 0xFF, 0x00,
+		0x75, 0x08, 0x95, 0x40, 0x81, 0x02, 0x09, 0x21, 0x15, 0x00, 0x26, 0xFF, 0x00, 0x75,
+		0x08, 0x95, 0x40, 0x91, 0x02, 0xC0,
+	}
+	test.Assert(t, IsFIDOReportDescriptor(fido), "FIDO usage page should be found")
+	keyboard := []byte{0x05, 0x01, 0x09, 0x06, 0xA1, 0x01, 0x05, 0x07, 0x19, 0xE0, 0x29, 0xE7, 0xC0}
+	test.Assert(t, !IsFIDOReportDescriptor(keyboard), "Keyboard should not be a FIDO device")
+	// 0xF1D0 as the data of a Usage item, not a Usage Page
+	usage := []byte{0x05, 0x01, 0x0A, 0xD0, 0xF1, 0xC0}
+	test.Assert(t, !IsFIDOReportDescriptor(usage), "Only the Usage Page should be checked")
+	test.Assert(t, !IsFIDOReportDescriptor(fido[:2]), "Truncated descriptor should not be a FIDO device")
+}
+
+// fakeKey answers each report written to it with the same report
+type fakeKey struct {
+	written chan []byte
+	reports chan []byte
+}
+
+func (key *fakeKey) Write(data []byte) (int, error) {
+	key.written <- append([]byte{}, data...)
+	key.reports <- append([]byte{}, data[1:]...)
+	return len(data), nil
+}
+
+func (key *fakeKey) Read(data []byte) (int, error) {
+	report, ok := <-key.reports
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(data, report), nil
+}
+
+func (key *fakeKey) Close() error {
+	close(key.reports)
+	return nil
+}
+
+func TestHIDProxy(t *testing.T) {
+	key := &fakeKey{written: make(chan []byte, 1), reports: make(chan []byte, 1)}
+	proxy := NewHIDProxy(key)
+	defer proxy.Close()
+	responses := make(chan []byte, 1)
+	proxy.SetResponseHandler(func(response []byte) { responses <- response })
+
+	proxy.HandleMessage([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x86, 0x00, 0x08})
+	written := <-key.written
+	test.AssertEqual(t, len(written), 1+ReportSize, "Reports should be written whole after the report ID")
+	test.AssertEqual(t, written[0], byte(0), "Report ID should be 0")
+	test.AssertEqual(t, written[5], byte(0x86), "Report should be written unchanged")
+	select {
+	case response := <-responses:
+		test.AssertEqual(t, len(response), ReportSize, "Input reports should be passed on whole")
+		test.AssertEqual(t, response[4], byte(0x86), "Input report should be passed on unchanged")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Input report was not passed on")
+	}
+
+	proxy.HandleMessage(make([]byte, ReportSize+1))
+	select {
+	case <-key.written:
+		t.Fatal("Oversized report should be dropped")
+	default:
+	}
+}
@@ -0,0 +1,229 @@
+package hidproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+)
+
+// CTAPHID commands and errors a host sends and receives (CTAP 2.1 section 11.2.9)
+const (
+	keyCommandMsg       byte = 0x83
+	keyCommandInit      byte = 0x86
+	keyCommandCBOR      byte = 0x90
+	keyCommandError     byte = 0xBF
+	keyCommandKeepalive byte = 0xBB
+
+	keyErrorInvalidChannel byte = 0x0B
+)
+
+const keyBroadcastChannel uint32 = 0xFFFFFFFF
+
+// Report payload after the channel, command and length, and after the channel and sequence
+const (
+	keyInitPayloadSize         = ReportSize - 7
+	keyContinuationPayloadSize = ReportSize - 5
+)
+
+// Key talks CTAPHID to a FIDO key the way a host does, so single CTAP2 and U2F messages can
+// be sent to it rather than every report
+type Key struct {
+	device  io.ReadWriteCloser
+	lock    sync.Mutex
+	channel uint32
+}
+
+// OpenKey opens a hidraw device, e.g. /dev/hidraw3, after checking it's a FIDO key
+func OpenKey(path string) (*Key, error) {
+	descriptor, err := os.ReadFile(filepath.Join(hidrawClassPath, filepath.Base(path), "device", "report_descriptor"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read report descriptor of %s: %w", path, err)
+	}
+	if !IsFIDOReportDescriptor(descriptor) {
+		return nil, fmt.Errorf("%s is not a FIDO device", path)
+	}
+	device, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", path, err)
+	}
+	proxyLogger.Printf("Sending messages to %s\n\n", path)
+	return NewKey(device), nil
+}
+
+// NewKey talks to device, which reads and writes one report at a time like hidraw
+func NewKey(device io.ReadWriteCloser) *Key {
+	return &Key{device: device, channel: keyBroadcastChannel}
+}
+
+// Transact sends one message to the key and waits for its response, skipping keepalives.
+// Messages are sent one at a time.
+func (key *Key) Transact(command byte, data []byte) ([]byte, error) {
+	key.lock.Lock()
+	defer key.lock.Unlock()
+	if key.channel == keyBroadcastChannel {
+		if err := key.allocateChannel(); err != nil {
+			return nil, err
+		}
+	}
+	response, err := key.transact(key.channel, command, data)
+	if err == errKeyInvalidChannel {
+		// The key forgot the channel, e.g. after being replugged
+		if err := key.allocateChannel(); err != nil {
+			return nil, err
+		}
+		response, err = key.transact(key.channel, command, data)
+	}
+	return response, err
+}
+
+var errKeyInvalidChannel = fmt.Errorf("Key rejected the channel")
+
+func (key *Key) allocateChannel() error {
+	nonce := crypto.RandomBytes(8)
+	for {
+		response, err := key.transact(keyBroadcastChannel, keyCommandInit, nonce)
+		if err != nil {
+			return fmt.Errorf("Could not allocate channel: %w", err)
+		}
+		// Responses to other hosts' INITs are broadcast too
+		if len(response) < 12 || string(response[:8]) != string(nonce) {
+			continue
+		}
+		key.channel = binary.BigEndian.Uint32(response[8:12])
+		proxyLogger.Printf("Allocated channel 0x%x on key\n\n", key.channel)
+		return nil
+	}
+}
+
+func (key *Key) transact(channel uint32, command byte, data []byte) ([]byte, error) {
+	if err := key.send(channel, command, data); err != nil {
+		return nil, err
+	}
+	return key.receive(channel, command)
+}
+
+func (key *Key) send(channel uint32, command byte, data []byte) error {
+	if len(data) > keyInitPayloadSize+0x80*keyContinuationPayloadSize {
+		return fmt.Errorf("%d byte message is too long for the key", len(data))
+	}
+	report := make([]byte, 1+ReportSize)
+	binary.BigEndian.PutUint32(report[1:5], channel)
+	report[5] = command
+	binary.BigEndian.PutUint16(report[6:8], uint16(len(data)))
+	sent := copy(report[8:], data)
+	if err := key.writeReport(report); err != nil {
+		return err
+	}
+	for sequence := byte(0); sent < len(data); sequence++ {
+		report = make([]byte, 1+ReportSize)
+		binary.BigEndian.PutUint32(report[1:5], channel)
+		report[5] = sequence
+		sent += copy(report[6:], data[sent:])
+		if err := key.writeReport(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReport writes report, which starts with report ID 0 as hidraw expects
+func (key *Key) writeReport(report []byte) error {
+	proxyLogger.Printf("OUT: %x\n\n", report[1:])
+	if _, err := key.device.Write(report); err != nil {
+		return fmt.Errorf("Could not write to key: %w", err)
+	}
+	return nil
+}
+
+func (key *Key) receive(channel uint32, command byte) ([]byte, error) {
+	report := make([]byte, ReportSize)
+	var response []byte
+	length := 0
+	sequence := byte(0)
+	for {
+		n, err := key.device.Read(report)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read from key: %w", err)
+		}
+		proxyLogger.Printf("IN: %x\n\n", report[:n])
+		if n < 5 || binary.BigEndian.Uint32(report[:4]) != channel {
+			continue
+		}
+		if response == nil {
+			if n < 7 || report[4]&0x80 == 0 {
+				continue
+			}
+			switch report[4] {
+			case keyCommandKeepalive:
+				continue
+			case keyCommandError:
+				if report[7] == keyErrorInvalidChannel {
+					return nil, errKeyInvalidChannel
+				}
+				return nil, fmt.Errorf("Key returned CTAPHID error 0x%x", report[7])
+			case command:
+			default:
+				return nil, fmt.Errorf("Key answered command 0x%x with 0x%x", command, report[4])
+			}
+			length = int(binary.BigEndian.Uint16(report[5:7]))
+			response = make([]byte, 0, length)
+			response = append(response, report[7:n]...)
+		} else {
+			if report[4] != sequence {
+				return nil, fmt.Errorf("Key sent packet %d out of sequence, expected %d", report[4], sequence)
+			}
+			sequence++
+			response = append(response, report[5:n]...)
+		}
+		if len(response) >= length {
+			return response[:length], nil
+		}
+	}
+}
+
+// Close releases the key
+func (key *Key) Close() error {
+	return key.device.Close()
+}
+
+type keyCTAPClient struct {
+	key *Key
+}
+
+// CTAPClient sends CTAP2 messages to the key, answering CTAP1_ERR_OTHER if it can't be reached
+func (key *Key) CTAPClient() ctap_hid.CTAPHIDClient {
+	return &keyCTAPClient{key: key}
+}
+
+func (client *keyCTAPClient) HandleMessage(data []byte) []byte {
+	response, err := client.key.Transact(keyCommandCBOR, data)
+	if err != nil || len(response) == 0 {
+		proxyLogger.Printf("ERROR: CTAP2 message to key failed: %v\n\n", err)
+		return []byte{0x7F}
+	}
+	return response
+}
+
+type keyU2FClient struct {
+	key *Key
+}
+
+// U2FClient sends U2F APDUs to the key, answering SW_UNKNOWN if it can't be reached
+func (key *Key) U2FClient() ctap_hid.CTAPHIDClient {
+	return &keyU2FClient{key: key}
+}
+
+func (client *keyU2FClient) HandleMessage(data []byte) []byte {
+	response, err := client.key.Transact(keyCommandMsg, data)
+	if err != nil || len(response) < 2 {
+		proxyLogger.Printf("ERROR: U2F message to key failed: %v\n\n", err)
+		return []byte{0x6F, 0x00}
+	}
+	return response
+}
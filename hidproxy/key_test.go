@@ -0,0 +1,94 @@
+package hidproxy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+// echoClient answers each message with its prefix followed by the message
+type echoClient struct {
+	prefix   []byte
+	messages [][]byte
+}
+
+func (client *echoClient) HandleMessage(data []byte) []byte {
+	client.messages = append(client.messages, data)
+	return append(append([]byte{}, client.prefix...), data...)
+}
+
+// ctapHIDKey is a hidraw device backed by a CTAPHIDServer, so it speaks CTAPHID like a key
+type ctapHIDKey struct {
+	server  *ctap_hid.CTAPHIDServer
+	reports chan []byte
+	closed  bool
+}
+
+func newCTAPHIDKey(ctap ctap_hid.CTAPHIDClient, u2f ctap_hid.CTAPHIDClient) *ctapHIDKey {
+	key := &ctapHIDKey{server: ctap_hid.NewCTAPHIDServer(ctap, u2f), reports: make(chan []byte, 64)}
+	key.server.SetResponseHandler(func(response []byte) { key.reports <- response })
+	return key
+}
+
+func (key *ctapHIDKey) Write(data []byte) (int, error) {
+	if key.closed {
+		return 0, io.ErrClosedPipe
+	}
+	key.server.HandleMessage(append([]byte{}, data[1:]...))
+	return len(data), nil
+}
+
+func (key *ctapHIDKey) Read(data []byte) (int, error) {
+	report, ok := <-key.reports
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(data, report), nil
+}
+
+func (key *ctapHIDKey) Close() error {
+	key.closed = true
+	close(key.reports)
+	return nil
+}
+
+func TestKeyTransact(t *testing.T) {
+	ctap := &echoClient{prefix: []byte{0x00}}
+	u2f := &echoClient{prefix: []byte{0x90, 0x00}}
+	device := newCTAPHIDKey(ctap, u2f)
+	key := NewKey(device)
+	defer key.Close()
+
+	// Long enough to need continuation packets both ways
+	message := bytes.Repeat([]byte{0x04, 0xA5}, 150)
+	response := key.CTAPClient().HandleMessage(message)
+	test.AssertArrEqual(t, response, append([]byte{0x00}, message...), "CTAP2 response should be reassembled")
+	test.AssertArrEqual(t, ctap.messages[0], message, "CTAP2 message should reach the key whole")
+	test.Assert(t, key.channel != keyBroadcastChannel, "A channel should be allocated")
+
+	response = key.U2FClient().HandleMessage([]byte{0x00, 0x03, 0x00, 0x00})
+	test.AssertArrEqual(t, response, []byte{0x90, 0x00, 0x00, 0x03, 0x00, 0x00}, "U2F messages should be sent with MSG")
+}
+
+func TestKeyReallocatesChannel(t *testing.T) {
+	ctap := &echoClient{}
+	device := newCTAPHIDKey(ctap, &echoClient{})
+	key := NewKey(device)
+	defer key.Close()
+	// A channel the key never allocated, as after the key is replugged
+	key.channel = 0x12345678
+	response := key.CTAPClient().HandleMessage([]byte{0x04})
+	test.AssertArrEqual(t, response, []byte{0x04}, "Message should be resent on a new channel")
+	test.Assert(t, key.channel != 0x12345678, "A new channel should be allocated")
+}
+
+func TestKeyUnreachable(t *testing.T) {
+	device := newCTAPHIDKey(&echoClient{}, &echoClient{})
+	key := NewKey(device)
+	key.Close()
+	test.AssertArrEqual(t, key.CTAPClient().HandleMessage([]byte{0x04}), []byte{0x7F}, "CTAP2 should fail with CTAP1_ERR_OTHER")
+	test.AssertArrEqual(t, key.U2FClient().HandleMessage([]byte{0x00, 0x03, 0x00, 0x00}), []byte{0x6F, 0x00}, "U2F should fail with SW_UNKNOWN")
+}
@@ -0,0 +1,263 @@
+package hidproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type Route string
+
+const (
+	RouteSoftware Route = "software"
+	RouteKey      Route = "key"
+)
+
+// RouteRule matches requests whose relying party ID matches the RPID glob (path.Match
+// syntax, e.g. "*.test"). U2F requests only carry the hash of the application ID, so they
+// match rules whose RPID hashes to it, or whose glob matches its hex encoding.
+type RouteRule struct {
+	RPID  string `json:"rp_id"`
+	Route Route  `json:"route"`
+}
+
+func (rule RouteRule) matches(rpID string) bool {
+	matched, err := path.Match(strings.ToLower(rule.RPID), strings.ToLower(rpID))
+	return err == nil && matched
+}
+
+func (rule RouteRule) matchesApplication(application []byte) bool {
+	if string(crypto.HashSHA256([]byte(strings.ToLower(rule.RPID)))) == string(application) {
+		return true
+	}
+	return rule.matches(hex.EncodeToString(application))
+}
+
+// Routes decide which authenticator answers each relying party, so RPs can be moved between
+// a physical key and the software credential store one at a time
+type Routes struct {
+	Rules   []RouteRule `json:"rules"`
+	Default Route       `json:"default,omitempty"`
+}
+
+func ParseRoutes(data []byte) (*Routes, error) {
+	routes := Routes{}
+	err := json.Unmarshal(data, &routes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode routes: %w", err)
+	}
+	if routes.Default == "" {
+		routes.Default = RouteKey
+	}
+	err = routes.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &routes, nil
+}
+
+// SoftwareRoutes sends the RPs matching any of rpIDs to software and the rest to the key
+func SoftwareRoutes(rpIDs []string) (*Routes, error) {
+	routes := Routes{Default: RouteKey}
+	for _, rpID := range rpIDs {
+		routes.Rules = append(routes.Rules, RouteRule{RPID: rpID, Route: RouteSoftware})
+	}
+	err := routes.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &routes, nil
+}
+
+func validRoute(route Route) bool {
+	return route == RouteSoftware || route == RouteKey
+}
+
+func (routes *Routes) validate() error {
+	if !validRoute(routes.Default) {
+		return fmt.Errorf("Invalid default route: %q", routes.Default)
+	}
+	for i, rule := range routes.Rules {
+		if _, err := path.Match(rule.RPID, ""); err != nil {
+			return fmt.Errorf("Invalid rp_id pattern in rule %d: %q", i, rule.RPID)
+		}
+		if !validRoute(rule.Route) {
+			return fmt.Errorf("Invalid route in rule %d: %q", i, rule.Route)
+		}
+	}
+	return nil
+}
+
+// Route returns the route of the first rule matching rpID, or the default
+func (routes *Routes) Route(rpID string) Route {
+	for _, rule := range routes.Rules {
+		if rule.matches(rpID) {
+			return rule.Route
+		}
+	}
+	return routes.defaultRoute()
+}
+
+// RouteApplication returns the route of the first rule matching a U2F application parameter
+func (routes *Routes) RouteApplication(application []byte) Route {
+	for _, rule := range routes.Rules {
+		if rule.matchesApplication(application) {
+			return rule.Route
+		}
+	}
+	return routes.defaultRoute()
+}
+
+func (routes *Routes) defaultRoute() Route {
+	if routes.Default == "" {
+		return RouteKey
+	}
+	return routes.Default
+}
+
+// CTAP2 commands that name a relying party, and the one that continues a getAssertion
+const (
+	ctapCommandMakeCredential   = 0x01
+	ctapCommandGetAssertion     = 0x02
+	ctapCommandGetNextAssertion = 0x08
+)
+
+type router struct {
+	routes   *Routes
+	software ctap_hid.CTAPHIDClient
+	key      ctap_hid.CTAPHIDClient
+}
+
+func (router *router) client(route Route) ctap_hid.CTAPHIDClient {
+	if route == RouteSoftware {
+		return router.software
+	}
+	return router.key
+}
+
+func (router *router) send(trace util.TraceID, session uint32, route Route, data []byte) []byte {
+	client := router.client(route)
+	if sessions, ok := client.(ctap_hid.SessionCTAPHIDClient); ok {
+		return sessions.HandleSessionMessage(trace, session, data)
+	}
+	if traced, ok := client.(ctap_hid.TracedCTAPHIDClient); ok {
+		return traced.HandleTracedMessage(trace, data)
+	}
+	return client.HandleMessage(data)
+}
+
+// CTAPRouter sends makeCredential and getAssertion to the authenticator routed for their RP,
+// and everything else, including getInfo and clientPIN, to the default route's. PIN tokens
+// come from that authenticator, so a pinAuth sent to the other one fails to verify.
+type CTAPRouter struct {
+	router
+	lock sync.Mutex
+	// Route of the last getAssertion, which getNextAssertion must follow
+	assertionRoute Route
+}
+
+func NewCTAPRouter(routes *Routes, software ctap_hid.CTAPHIDClient, key ctap_hid.CTAPHIDClient) *CTAPRouter {
+	return &CTAPRouter{router: router{routes: routes, software: software, key: key}, assertionRoute: routes.defaultRoute()}
+}
+
+func (router *CTAPRouter) HandleMessage(data []byte) []byte {
+	return router.HandleTracedMessage(0, data)
+}
+
+func (router *CTAPRouter) HandleTracedMessage(trace util.TraceID, data []byte) []byte {
+	route := router.route(data)
+	proxyLogger.Printf("ROUTE: CTAP2 command 0x%x to %s\n\n", byteAt(data, 0), route)
+	return router.send(trace, 0, route, data)
+}
+
+func (router *CTAPRouter) route(data []byte) Route {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if len(data) == 0 {
+		return router.routes.defaultRoute()
+	}
+	switch data[0] {
+	case ctapCommandMakeCredential:
+		var args struct {
+			RP struct {
+				ID string `cbor:"id"`
+			} `cbor:"2,keyasint"`
+		}
+		if cbor.Unmarshal(data[1:], &args) != nil {
+			break
+		}
+		return router.routes.Route(args.RP.ID)
+	case ctapCommandGetAssertion:
+		var args struct {
+			RPID string `cbor:"1,keyasint"`
+		}
+		if cbor.Unmarshal(data[1:], &args) != nil {
+			break
+		}
+		router.assertionRoute = router.routes.Route(args.RPID)
+		return router.assertionRoute
+	case ctapCommandGetNextAssertion:
+		return router.assertionRoute
+	}
+	// Malformed requests are rejected by whichever authenticator gets them
+	return router.routes.defaultRoute()
+}
+
+// U2FRouter sends register and authenticate APDUs to the authenticator routed for their
+// application parameter, and everything else, like version, to the default route's
+type U2FRouter struct {
+	router
+}
+
+func NewU2FRouter(routes *Routes, software ctap_hid.CTAPHIDClient, key ctap_hid.CTAPHIDClient) *U2FRouter {
+	return &U2FRouter{router: router{routes: routes, software: software, key: key}}
+}
+
+func (router *U2FRouter) HandleMessage(data []byte) []byte {
+	return router.HandleTracedMessage(0, data)
+}
+
+func (router *U2FRouter) HandleTracedMessage(trace util.TraceID, data []byte) []byte {
+	return router.HandleSessionMessage(trace, 0, data)
+}
+
+func (router *U2FRouter) HandleSessionMessage(trace util.TraceID, session uint32, data []byte) []byte {
+	route := router.routes.defaultRoute()
+	// Register and authenticate both start with the challenge and application parameters
+	if application := u2fApplication(data); application != nil {
+		route = router.routes.RouteApplication(application)
+	}
+	proxyLogger.Printf("ROUTE: U2F instruction 0x%x to %s\n\n", byteAt(data, 1), route)
+	return router.send(trace, session, route, data)
+}
+
+// u2fApplication returns the application parameter of a register or authenticate APDU
+func u2fApplication(data []byte) []byte {
+	if len(data) < 4 || (data[1] != 0x01 && data[1] != 0x02) {
+		return nil
+	}
+	// Short encoding has a one byte Lc, extended encoding a zero then two bytes
+	offset := 5
+	if len(data) > 4 && data[4] == 0 {
+		offset = 7
+	}
+	if len(data) < offset+64 {
+		return nil
+	}
+	return data[offset+32 : offset+64]
+}
+
+func byteAt(data []byte, i int) byte {
+	if i >= len(data) {
+		return 0
+	}
+	return data[i]
+}
@@ -0,0 +1,85 @@
+package hidproxy
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes([]byte(`{"rules": [{"rp_id": "*.Example.com", "route": "software"}, {"rp_id": "github.com", "route": "key"}]}`))
+	test.Assert(t, err == nil, "Routes should parse")
+	test.AssertEqual(t, routes.Default, RouteKey, "Default should be the key")
+	test.AssertEqual(t, routes.Route("login.example.com"), RouteSoftware, "Globs should match case-insensitively")
+	test.AssertEqual(t, routes.Route("github.com"), RouteKey, "Later rules should match")
+	test.AssertEqual(t, routes.Route("example.org"), RouteKey, "Unmatched RPs should take the default")
+
+	_, err = ParseRoutes([]byte(`{"rules": [{"rp_id": "[", "route": "software"}]}`))
+	test.Assert(t, err != nil, "Invalid globs should be rejected")
+	_, err = ParseRoutes([]byte(`{"rules": [{"rp_id": "example.com", "route": "hardware"}]}`))
+	test.Assert(t, err != nil, "Unknown routes should be rejected")
+	_, err = ParseRoutes([]byte(`{"default": "cloud"}`))
+	test.Assert(t, err != nil, "Unknown default routes should be rejected")
+}
+
+func TestRouteApplication(t *testing.T) {
+	routes, err := SoftwareRoutes([]string{"example.com"})
+	test.Assert(t, err == nil, "Routes should be valid")
+	test.AssertEqual(t, routes.RouteApplication(crypto.HashSHA256([]byte("example.com"))), RouteSoftware, "Hash of the RP ID should match")
+	test.AssertEqual(t, routes.RouteApplication(crypto.HashSHA256([]byte("example.org"))), RouteKey, "Other applications should take the default")
+}
+
+func ctapMessage(command byte, args map[int]interface{}) []byte {
+	data, err := cbor.Marshal(args)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{command}, data...)
+}
+
+func TestCTAPRouter(t *testing.T) {
+	software := &echoClient{prefix: []byte{0x00}}
+	key := &echoClient{prefix: []byte{0x00}}
+	routes, err := SoftwareRoutes([]string{"*.example.com"})
+	test.Assert(t, err == nil, "Routes should be valid")
+	router := NewCTAPRouter(routes, software, key)
+
+	router.HandleMessage(ctapMessage(ctapCommandMakeCredential, map[int]interface{}{2: map[string]string{"id": "login.example.com"}}))
+	test.AssertEqual(t, len(software.messages), 1, "makeCredential for a software RP should go to software")
+	router.HandleMessage(ctapMessage(ctapCommandMakeCredential, map[int]interface{}{2: map[string]string{"id": "github.com"}}))
+	test.AssertEqual(t, len(key.messages), 1, "makeCredential for other RPs should go to the key")
+
+	router.HandleMessage(ctapMessage(ctapCommandGetAssertion, map[int]interface{}{1: "login.example.com"}))
+	router.HandleMessage([]byte{ctapCommandGetNextAssertion})
+	test.AssertEqual(t, len(software.messages), 3, "getNextAssertion should follow its getAssertion")
+	router.HandleMessage(ctapMessage(ctapCommandGetAssertion, map[int]interface{}{1: "github.com"}))
+	router.HandleMessage([]byte{ctapCommandGetNextAssertion})
+	test.AssertEqual(t, len(key.messages), 3, "getNextAssertion should follow its getAssertion")
+
+	router.HandleMessage([]byte{0x04})
+	router.HandleMessage([]byte{0x01, 0xFF})
+	test.AssertEqual(t, len(key.messages), 5, "getInfo and malformed requests should take the default")
+	test.AssertEqual(t, len(software.messages), 3, "Software should only get its RPs")
+}
+
+func TestU2FRouter(t *testing.T) {
+	software := &echoClient{}
+	key := &echoClient{}
+	routes, err := SoftwareRoutes([]string{"example.com"})
+	test.Assert(t, err == nil, "Routes should be valid")
+	router := NewU2FRouter(routes, software, key)
+
+	challenge := make([]byte, 32)
+	register := append(append([]byte{0x00, 0x01, 0x00, 0x00, 64}, challenge...), crypto.HashSHA256([]byte("example.com"))...)
+	router.HandleMessage(register)
+	test.AssertEqual(t, len(software.messages), 1, "Register for a software RP should go to software")
+	extended := append(append([]byte{0x00, 0x02, 0x03, 0x00, 0x00, 0x00, 65}, challenge...), crypto.HashSHA256([]byte("example.com"))...)
+	router.HandleMessage(append(extended, 0x00))
+	test.AssertEqual(t, len(software.messages), 2, "Extended length APDUs should be routed")
+	other := append(append([]byte{0x00, 0x01, 0x00, 0x00, 64}, challenge...), crypto.HashSHA256([]byte("example.org"))...)
+	router.HandleMessage(other)
+	router.HandleMessage([]byte{0x00, 0x03, 0x00, 0x00})
+	test.AssertEqual(t, len(key.messages), 2, "Other RPs and version should go to the key")
+}
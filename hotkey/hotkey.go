@@ -0,0 +1,115 @@
+// Package hotkey listens for a global keyboard shortcut, so pressing it can stand in for
+// touching the authenticator, e.g. with fido_client.NewManualPresence
+package hotkey
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var hotkeyLogger = util.NewLogger("[HOTKEY] ", util.LogSubsystemHotkey, util.LogLevelDebug)
+
+type Modifiers uint8
+
+const (
+	ModifierCtrl Modifiers = 1 << iota
+	ModifierShift
+	ModifierAlt
+	ModifierSuper
+)
+
+var modifierNames = map[string]Modifiers{
+	"ctrl":    ModifierCtrl,
+	"control": ModifierCtrl,
+	"shift":   ModifierShift,
+	"alt":     ModifierAlt,
+	"super":   ModifierSuper,
+	"meta":    ModifierSuper,
+	"win":     ModifierSuper,
+}
+
+// Hotkey is a key pressed while holding modifiers, e.g. ctrl+alt+t
+type Hotkey struct {
+	Modifiers Modifiers
+	// One of a-z, 0-9, f1-f12, space or enter
+	Key string
+}
+
+// Parse reads a hotkey written as modifiers and a key joined by "+", e.g. "ctrl+shift+f9".
+// At least one modifier is needed, since the key isn't kept from the focused window on every
+// platform.
+func Parse(text string) (Hotkey, error) {
+	var hotkey Hotkey
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(text)), "+")
+	for _, part := range parts[:len(parts)-1] {
+		modifier, ok := modifierNames[part]
+		if !ok {
+			return Hotkey{}, fmt.Errorf("Unknown modifier %q in hotkey %q", part, text)
+		}
+		hotkey.Modifiers |= modifier
+	}
+	hotkey.Key = parts[len(parts)-1]
+	if !validKey(hotkey.Key) {
+		return Hotkey{}, fmt.Errorf("Unknown key %q in hotkey %q", hotkey.Key, text)
+	}
+	if hotkey.Modifiers == 0 {
+		return Hotkey{}, fmt.Errorf("Hotkey %q needs a modifier, e.g. ctrl+alt+%s", text, hotkey.Key)
+	}
+	return hotkey, nil
+}
+
+func (hotkey Hotkey) String() string {
+	parts := make([]string, 0, 5)
+	for _, modifier := range []struct {
+		modifier Modifiers
+		name     string
+	}{{ModifierCtrl, "ctrl"}, {ModifierShift, "shift"}, {ModifierAlt, "alt"}, {ModifierSuper, "super"}} {
+		if hotkey.Modifiers&modifier.modifier != 0 {
+			parts = append(parts, modifier.name)
+		}
+	}
+	return strings.Join(append(parts, hotkey.Key), "+")
+}
+
+// functionKey returns n for the function keys f1-f12
+func functionKey(key string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(key, "f"))
+	if !strings.HasPrefix(key, "f") || err != nil || n < 1 || n > 12 || key != "f"+strconv.Itoa(n) {
+		return 0, false
+	}
+	return n, true
+}
+
+func validKey(key string) bool {
+	if len(key) == 1 {
+		return (key[0] >= 'a' && key[0] <= 'z') || (key[0] >= '0' && key[0] <= '9')
+	}
+	_, function := functionKey(key)
+	return function || key == "space" || key == "enter"
+}
+
+// Listener calls a function every time its hotkey is pressed, until it's closed
+type Listener struct {
+	hotkey  Hotkey
+	pressed func()
+	stop    func()
+}
+
+// Listen calls pressed every time hotkey is pressed, in any window. On Linux it reads the
+// keyboards under /dev/input, which needs root or membership of the input group, and the key
+// still reaches the focused window. On Windows the hotkey is registered with RegisterHotKey.
+func Listen(hotkey Hotkey, pressed func()) (*Listener, error) {
+	listener := &Listener{hotkey: hotkey, pressed: pressed}
+	if err := listener.start(); err != nil {
+		return nil, err
+	}
+	hotkeyLogger.Printf("Listening for %s\n\n", hotkey)
+	return listener, nil
+}
+
+func (listener *Listener) Close() {
+	listener.stop()
+}
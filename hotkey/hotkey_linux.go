@@ -0,0 +1,186 @@
+package hotkey
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/cpu"
+	"golang.org/x/sys/unix"
+)
+
+const inputDevicesPath = "/proc/bus/input/devices"
+
+// Event types and key codes from linux/input-event-codes.h
+const (
+	evKey = 0x01
+	evRep = 0x14
+
+	keyValueRelease = 0
+	keyValuePress   = 1
+)
+
+var modifierKeyCodes = map[uint16]Modifiers{
+	29:  ModifierCtrl,
+	97:  ModifierCtrl,
+	42:  ModifierShift,
+	54:  ModifierShift,
+	56:  ModifierAlt,
+	100: ModifierAlt,
+	125: ModifierSuper,
+	126: ModifierSuper,
+}
+
+// Rows of keys on the keyboard, with the code of their first key
+var keyRows = []struct {
+	keys      string
+	firstCode uint16
+}{{"1234567890", 2}, {"qwertyuiop", 16}, {"asdfghjkl", 30}, {"zxcvbnm", 44}}
+
+func keyCode(key string) uint16 {
+	for _, row := range keyRows {
+		if i := strings.Index(row.keys, key); len(key) == 1 && i >= 0 {
+			return row.firstCode + uint16(i)
+		}
+	}
+	if n, ok := functionKey(key); ok {
+		if n > 10 {
+			// F11 and F12 came after the keypad
+			return 87 + uint16(n-11)
+		}
+		return 59 + uint16(n-1)
+	}
+	if key == "space" {
+		return 57
+	}
+	return 28 // enter
+}
+
+// inputEvent is struct input_event, whose timeval depends on the architecture
+type inputEvent struct {
+	Time  unix.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+func (listener *Listener) start() error {
+	paths, err := keyboardPaths()
+	if err != nil {
+		return err
+	}
+	var keyboards []*os.File
+	for _, path := range paths {
+		keyboard, err := os.Open(path)
+		if err != nil {
+			hotkeyLogger.Printf("ERROR: Could not open keyboard %s: %s\n\n", path, err)
+			continue
+		}
+		keyboards = append(keyboards, keyboard)
+	}
+	if len(keyboards) == 0 {
+		return fmt.Errorf("Could not open any keyboard under /dev/input, which needs root or the input group")
+	}
+	for _, keyboard := range keyboards {
+		go func(keyboard *os.File) {
+			err := watchKeyboard(keyboard, listener.hotkey, listener.pressed)
+			if !errors.Is(err, os.ErrClosed) {
+				hotkeyLogger.Printf("Stopped reading %s: %s\n\n", keyboard.Name(), err)
+			}
+		}(keyboard)
+	}
+	listener.stop = func() {
+		for _, keyboard := range keyboards {
+			keyboard.Close()
+		}
+	}
+	return nil
+}
+
+// keyboardPaths finds the event devices of keyboards, i.e. devices with keys that repeat.
+// Keyboards attached later aren't listened to.
+func keyboardPaths() ([]string, error) {
+	devices, err := os.Open(inputDevicesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list input devices: %w", err)
+	}
+	defer devices.Close()
+	return parseKeyboards(devices)
+}
+
+// parseKeyboards reads the format of /proc/bus/input/devices: a block of lines per device,
+// with its handlers on an "H:" line and its event types on a "B: EV=" line
+func parseKeyboards(devices io.Reader) ([]string, error) {
+	var paths []string
+	var handler string
+	var events uint64
+	flush := func() {
+		if handler != "" && events&(1<<evKey) != 0 && events&(1<<evRep) != 0 {
+			paths = append(paths, filepath.Join("/dev/input", handler))
+		}
+		handler, events = "", 0
+	}
+	scanner := bufio.NewScanner(devices)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "H: Handlers="):
+			for _, name := range strings.Fields(strings.TrimPrefix(line, "H: Handlers=")) {
+				if strings.HasPrefix(name, "event") {
+					handler = name
+				}
+			}
+		case strings.HasPrefix(line, "B: EV="):
+			events, _ = strconv.ParseUint(strings.TrimPrefix(line, "B: EV="), 16, 64)
+		}
+	}
+	flush()
+	return paths, scanner.Err()
+}
+
+// watchKeyboard calls pressed when hotkey's key goes down while exactly its modifiers are
+// held, until keyboard fails
+func watchKeyboard(keyboard io.Reader, hotkey Hotkey, pressed func()) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	if cpu.IsBigEndian {
+		order = binary.BigEndian
+	}
+	code := keyCode(hotkey.Key)
+	// Held modifier keys, as left and right keys are told apart
+	held := make(map[uint16]Modifiers)
+	for {
+		var event inputEvent
+		if err := binary.Read(keyboard, order, &event); err != nil {
+			return err
+		}
+		if event.Type != evKey {
+			continue
+		}
+		if modifier, ok := modifierKeyCodes[event.Code]; ok {
+			if event.Value == keyValueRelease {
+				delete(held, event.Code)
+			} else {
+				held[event.Code] = modifier
+			}
+			continue
+		}
+		if event.Code != code || event.Value != keyValuePress {
+			continue
+		}
+		var modifiers Modifiers
+		for _, modifier := range held {
+			modifiers |= modifier
+		}
+		if modifiers == hotkey.Modifiers {
+			pressed()
+		}
+	}
+}
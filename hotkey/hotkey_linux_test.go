@@ -0,0 +1,60 @@
+package hotkey
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+const testInputDevices = `I: Bus=0019 Vendor=0000 Product=0001 Version=0000
+N: Name="Power Button"
+H: Handlers=kbd event0
+B: EV=3
+
+I: Bus=0011 Vendor=0001 Product=0001 Version=ab41
+N: Name="AT Translated Set 2 keyboard"
+H: Handlers=sysrq kbd event3 leds
+B: EV=120013
+
+I: Bus=0003 Vendor=046d Product=c52b Version=0111
+N: Name="Logitech USB Receiver Mouse"
+H: Handlers=mouse0 event5
+B: EV=17
+`
+
+func TestParseKeyboards(t *testing.T) {
+	paths, err := parseKeyboards(strings.NewReader(testInputDevices))
+	test.Assert(t, err == nil, "Could not parse devices")
+	test.AssertArrEqual(t, paths, []string{"/dev/input/event3"}, "Only the keyboard should be found")
+}
+
+func keyEvents(events ...[2]int) io.Reader {
+	var buffer bytes.Buffer
+	for _, event := range events {
+		binary.Write(&buffer, binary.LittleEndian, inputEvent{Type: evKey, Code: uint16(event[0]), Value: int32(event[1])})
+	}
+	return &buffer
+}
+
+func TestWatchKeyboard(t *testing.T) {
+	const ctrl, rightAlt, shift, keyT = 29, 100, 42, 20
+	test.AssertEqual(t, keyCode("t"), uint16(keyT), "Wrong key code")
+	test.AssertEqual(t, keyCode("0"), uint16(11), "Wrong key code")
+	test.AssertEqual(t, keyCode("f12"), uint16(88), "Wrong key code")
+	hotkey := Hotkey{Modifiers: ModifierCtrl | ModifierAlt, Key: "t"}
+	presses := 0
+	keyboard := keyEvents(
+		[2]int{keyT, keyValuePress}, [2]int{keyT, keyValueRelease},
+		[2]int{ctrl, keyValuePress}, [2]int{rightAlt, keyValuePress},
+		[2]int{keyT, keyValuePress}, [2]int{keyT, 2}, [2]int{keyT, keyValueRelease},
+		[2]int{shift, keyValuePress}, [2]int{keyT, keyValuePress}, [2]int{shift, keyValueRelease},
+		[2]int{rightAlt, keyValueRelease}, [2]int{keyT, keyValuePress},
+	)
+	err := watchKeyboard(keyboard, hotkey, func() { presses++ })
+	test.Assert(t, err == io.EOF, "Should stop at the end of the events")
+	test.AssertEqual(t, presses, 1, "Only ctrl+alt+t should count, without repeats")
+}
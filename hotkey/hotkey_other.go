@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package hotkey
+
+import "fmt"
+
+func (listener *Listener) start() error {
+	return fmt.Errorf("Global hotkeys are only supported on Linux and Windows")
+}
@@ -0,0 +1,23 @@
+package hotkey
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestParse(t *testing.T) {
+	hotkey, err := Parse("Ctrl+Alt+T")
+	test.Assert(t, err == nil, "Could not parse hotkey")
+	test.AssertEqual(t, hotkey, Hotkey{Modifiers: ModifierCtrl | ModifierAlt, Key: "t"}, "Wrong hotkey")
+	test.AssertEqual(t, hotkey.String(), "ctrl+alt+t", "Wrong name")
+
+	hotkey, err = Parse("super+shift+f12")
+	test.Assert(t, err == nil, "Could not parse hotkey")
+	test.AssertEqual(t, hotkey.String(), "shift+super+f12", "Wrong name")
+
+	for _, invalid := range []string{"t", "ctrl+", "ctrl+f13", "ctrl+f01", "hyper+t", "ctrl+tab", ""} {
+		_, err := Parse(invalid)
+		test.Assert(t, err != nil, "Hotkey should be invalid: "+invalid)
+	}
+}
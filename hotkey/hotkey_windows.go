@@ -0,0 +1,98 @@
+package hotkey
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	user32                 = windows.NewLazySystemDLL("user32.dll")
+	procRegisterHotKey     = user32.NewProc("RegisterHotKey")
+	procUnregisterHotKey   = user32.NewProc("UnregisterHotKey")
+	procGetMessageW        = user32.NewProc("GetMessageW")
+	procPostThreadMessageW = user32.NewProc("PostThreadMessageW")
+)
+
+const (
+	modAlt      = 0x0001
+	modControl  = 0x0002
+	modShift    = 0x0004
+	modWin      = 0x0008
+	modNoRepeat = 0x4000
+
+	wmQuit   = 0x0012
+	wmHotkey = 0x0312
+
+	hotkeyID = 1
+)
+
+// msg is the MSG structure GetMessageW fills in
+type msg struct {
+	hwnd    uintptr
+	message uint32
+	wParam  uintptr
+	lParam  uintptr
+	time    uint32
+	x, y    int32
+	private uint32
+}
+
+// virtualKeyCode is the virtual-key code of key, which is the character for letters and digits
+func virtualKeyCode(key string) uintptr {
+	if len(key) == 1 {
+		return uintptr(strings.ToUpper(key)[0])
+	}
+	if n, ok := functionKey(key); ok {
+		return 0x70 + uintptr(n-1)
+	}
+	if key == "space" {
+		return 0x20
+	}
+	return 0x0D // enter
+}
+
+func (listener *Listener) start() error {
+	var modifiers uintptr = modNoRepeat
+	for modifier, flag := range map[Modifiers]uintptr{ModifierCtrl: modControl, ModifierShift: modShift, ModifierAlt: modAlt, ModifierSuper: modWin} {
+		if listener.hotkey.Modifiers&modifier != 0 {
+			modifiers |= flag
+		}
+	}
+	key := virtualKeyCode(listener.hotkey.Key)
+	registered := make(chan error, 1)
+	threadID := make(chan uint32, 1)
+	go func() {
+		// Hotkey messages go to the thread that registered the hotkey
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if ok, _, err := procRegisterHotKey.Call(0, hotkeyID, modifiers, key); ok == 0 {
+			registered <- fmt.Errorf("Could not register hotkey %s: %w", listener.hotkey, err)
+			return
+		}
+		defer procUnregisterHotKey.Call(0, hotkeyID)
+		threadID <- windows.GetCurrentThreadId()
+		registered <- nil
+		var message msg
+		for {
+			result, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&message)), 0, 0, 0)
+			if result == 0 || int32(result) == -1 {
+				return
+			}
+			if message.message == wmHotkey && message.wParam == hotkeyID {
+				listener.pressed()
+			}
+		}
+	}()
+	if err := <-registered; err != nil {
+		return err
+	}
+	thread := <-threadID
+	listener.stop = func() {
+		procPostThreadMessageW.Call(uintptr(thread), wmQuit, 0, 0)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package identities
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// OID of the KeyDescription extension of Android Keystore attestation certificates
+var oidAndroidKeyDescription = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 17}
+
+// Tags and values of the AuthorizationList of a KeyDescription, from the Keymaster HAL
+const (
+	androidTagPurpose         = 1
+	androidTagAllApplications = 600
+	androidTagOrigin          = 702
+
+	androidPurposeSign     = 2
+	androidOriginGenerated = 0
+)
+
+// AndroidKeyDescription configures the fake KeyDescription extension of android-key
+// attestation certificates, to test how RPs check it. Security levels are 0 for software,
+// 1 for a TEE and 2 for StrongBox.
+type AndroidKeyDescription struct {
+	AttestationVersion       int `json:"attestation_version"`
+	AttestationSecurityLevel int `json:"attestation_security_level"`
+	KeymasterVersion         int `json:"keymaster_version"`
+	KeymasterSecurityLevel   int `json:"keymaster_security_level"`
+	// Lists the key's purpose and origin as enforced by software rather than the TEE
+	SoftwareEnforced bool `json:"software_enforced,omitempty"`
+	// Lets every app use the key, which RPs must refuse
+	AllApplications bool `json:"all_applications,omitempty"`
+}
+
+// DefaultAndroidKeyDescription describes a key generated in a TEE with Keymaster 4
+func DefaultAndroidKeyDescription() AndroidKeyDescription {
+	return AndroidKeyDescription{
+		AttestationVersion:       3,
+		AttestationSecurityLevel: 1,
+		KeymasterVersion:         4,
+		KeymasterSecurityLevel:   1,
+	}
+}
+
+type keyDescription struct {
+	AttestationVersion       int
+	AttestationSecurityLevel asn1.Enumerated
+	KeymasterVersion         int
+	KeymasterSecurityLevel   asn1.Enumerated
+	AttestationChallenge     []byte
+	UniqueID                 []byte
+	SoftwareEnforced         asn1.RawValue
+	TEEEnforced              asn1.RawValue
+}
+
+// explicitTag wraps an encoded value in an explicit context-specific tag. encoding/asn1 can't
+// do this for raw values like NULL.
+func explicitTag(tag int, encoded []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: encoded}
+}
+
+func (description AndroidKeyDescription) authorizationLists() (software asn1.RawValue, tee asn1.RawValue, err error) {
+	purpose, err := asn1.MarshalWithParams([]int{androidPurposeSign}, "set")
+	if err != nil {
+		return
+	}
+	origin, err := asn1.Marshal(androidOriginGenerated)
+	if err != nil {
+		return
+	}
+	enforced := []asn1.RawValue{explicitTag(androidTagPurpose, purpose)}
+	if description.AllApplications {
+		enforced = append(enforced, explicitTag(androidTagAllApplications, asn1.NullBytes))
+	}
+	enforced = append(enforced, explicitTag(androidTagOrigin, origin))
+	var list []byte
+	for _, value := range enforced {
+		encoded, err := asn1.Marshal(value)
+		if err != nil {
+			return software, tee, err
+		}
+		list = append(list, encoded...)
+	}
+	software = asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: []byte{}}
+	tee = asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: []byte{}}
+	if description.SoftwareEnforced {
+		software.Bytes = list
+	} else {
+		tee.Bytes = list
+	}
+	return software, tee, nil
+}
+
+// CreateAndroidKeyAttestationCertificate issues a certificate like the credCert of the
+// android-key attestation format: it's for the credential's own key and its KeyDescription
+// holds challenge, the client data hash
+func CreateAndroidKeyAttestationCertificate(
+	certificateAuthority *x509.Certificate,
+	certificateAuthorityPrivateKey *cose.SupportedCOSEPrivateKey,
+	targetPrivateKey *cose.SupportedCOSEPrivateKey,
+	description AndroidKeyDescription,
+	challenge []byte) (*x509.Certificate, error) {
+	software, tee, err := description.authorizationLists()
+	if err != nil {
+		return nil, err
+	}
+	extension, err := asn1.Marshal(keyDescription{
+		AttestationVersion:       description.AttestationVersion,
+		AttestationSecurityLevel: asn1.Enumerated(description.AttestationSecurityLevel),
+		KeymasterVersion:         description.KeymasterVersion,
+		KeymasterSecurityLevel:   asn1.Enumerated(description.KeymasterSecurityLevel),
+		AttestationChallenge:     challenge,
+		UniqueID:                 []byte{},
+		SoftwareEnforced:         software,
+		TEEEnforced:              tee,
+	})
+	if err != nil {
+		return nil, err
+	}
+	templateCert := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "Android Keystore Key",
+		},
+		NotBefore:             util.Now(),
+		NotAfter:              util.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		IsCA:                  false,
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidAndroidKeyDescription, Value: extension}},
+	}
+	certBytes, err := x509.CreateCertificate(
+		crypto.Random(),
+		templateCert,
+		certificateAuthority,
+		extractPublicKey(targetPrivateKey.Public()),
+		extractPrivateKey(certificateAuthorityPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certBytes)
+}
+
+// SafetyNetHostname is the name attestation responses from Google Play Services are signed for
+const SafetyNetHostname = "attest.android.com"
+
+type safetyNetHeader struct {
+	Algorithm string   `json:"alg"`
+	X5C       []string `json:"x5c"`
+}
+
+type safetyNetPayload struct {
+	Nonce           string `json:"nonce"`
+	TimestampMs     int64  `json:"timestampMs"`
+	APKPackageName  string `json:"apkPackageName"`
+	CTSProfileMatch bool   `json:"ctsProfileMatch"`
+	BasicIntegrity  bool   `json:"basicIntegrity"`
+}
+
+// CreateSafetyNetResponse signs a SafetyNet attestation JWS for nonce, like the response of
+// the android-safetynet attestation format, with a certificate for attest.android.com issued
+// by certificateAuthority. chain follows the certificate in the x5c header.
+func CreateSafetyNetResponse(
+	certificateAuthority *x509.Certificate,
+	certificateAuthorityPrivateKey *cose.SupportedCOSEPrivateKey,
+	chain [][]byte,
+	nonce []byte) ([]byte, error) {
+	signerKey := crypto.GenerateECDSAKey()
+	templateCert := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Organization: []string{"Self-Signed Virtual FIDO"},
+			Country:      []string{"US"},
+			CommonName:   SafetyNetHostname,
+		},
+		DNSNames:              []string{SafetyNetHostname},
+		NotBefore:             util.Now(),
+		NotAfter:              util.Now().AddDate(10, 0, 0),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	certBytes, err := x509.CreateCertificate(
+		crypto.Random(),
+		templateCert,
+		certificateAuthority,
+		&signerKey.PublicKey,
+		extractPrivateKey(certificateAuthorityPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	header := safetyNetHeader{Algorithm: "ES256", X5C: []string{base64.StdEncoding.EncodeToString(certBytes)}}
+	for _, certificate := range chain {
+		header.X5C = append(header.X5C, base64.StdEncoding.EncodeToString(certificate))
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes, err := json.Marshal(safetyNetPayload{
+		Nonce:           base64.StdEncoding.EncodeToString(nonce),
+		TimestampMs:     util.Now().UnixMilli(),
+		APKPackageName:  "com.google.android.gms",
+		CTSProfileMatch: true,
+		BasicIntegrity:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(payloadBytes)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(crypto.Random(), signerKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// JWS uses the fixed-size r || s encoding rather than ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return []byte(signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)), nil
+}
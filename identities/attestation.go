@@ -1,15 +1,15 @@
 package identities
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
 	"math/big"
-	"time"
 
 	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
 )
 
 // We need two functions here because Go's type system isn't enough to support this
@@ -27,7 +27,7 @@ func extractPublicKey(key *cose.SupportedCOSEPublicKey) any {
 }
 func extractPrivateKey(key *cose.SupportedCOSEPrivateKey) any {
 	if key.ECDSA != nil {
-		return key.ECDSA
+		return crypto.ECDSASigner(key.ECDSA)
 	} else if key.Ed25519 != nil {
 		return *key.Ed25519
 	} else if key.RSA != nil {
@@ -52,15 +52,15 @@ func CreateSelfSignedAttestationCertificate(
 			CommonName:         "Self-Signed Virtual FIDO",
 			OrganizationalUnit: []string{"Authenticator Attestation"},
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
+		NotBefore:             util.Now(),
+		NotAfter:              util.Now().AddDate(10, 0, 0),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		IsCA:                  false,
 		BasicConstraintsValid: true,
 	}
 	certBytes, err := x509.CreateCertificate(
-		rand.Reader,
+		crypto.Random(),
 		templateCert,
 		certificateAuthority,
 		extractPublicKey(targetPrivateKey.Public()),
@@ -71,12 +71,85 @@ func CreateSelfSignedAttestationCertificate(
 	return x509.ParseCertificate(certBytes)
 }
 
-func CreateCAPrivateKey() (*cose.SupportedCOSEPrivateKey, error) {
-	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// OID of the extension holding the nonce in certificates of Apple's anonymous attestation
+var oidAppleNonce = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 2}
+
+type appleNonceExtension struct {
+	Nonce []byte `asn1:"explicit,tag:1"`
+}
+
+// CreateAppleAttestationCertificate issues a certificate like the credCert of the "apple"
+// attestation format: it's for the credential's own key and holds nonce, the hash of the
+// authenticator data and client data hash, in Apple's extension
+func CreateAppleAttestationCertificate(
+	certificateAuthority *x509.Certificate,
+	certificateAuthorityPrivateKey *cose.SupportedCOSEPrivateKey,
+	targetPrivateKey *cose.SupportedCOSEPrivateKey,
+	nonce []byte) (*x509.Certificate, error) {
+	extension, err := asn1.Marshal(appleNonceExtension{Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+	templateCert := &x509.Certificate{
+		SerialNumber: big.NewInt(0),
+		Subject: pkix.Name{
+			Organization:       []string{"Self-Signed Virtual FIDO"},
+			Country:            []string{"US"},
+			CommonName:         "Self-Signed Virtual FIDO",
+			OrganizationalUnit: []string{"Anonymous Attestation"},
+		},
+		NotBefore:             util.Now(),
+		NotAfter:              util.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		IsCA:                  false,
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidAppleNonce, Value: extension}},
+	}
+	certBytes, err := x509.CreateCertificate(
+		crypto.Random(),
+		templateCert,
+		certificateAuthority,
+		extractPublicKey(targetPrivateKey.Public()),
+		extractPrivateKey(certificateAuthorityPrivateKey))
 	if err != nil {
 		return nil, err
 	}
-	coseKey := cose.SupportedCOSEPrivateKey{ECDSA: ecdsaKey}
+	return x509.ParseCertificate(certBytes)
+}
+
+// CreateIntermediateCA issues the CA at depth below the attestation CA, or below another
+// intermediate, for attestation certificates that RPs have to build a chain for
+func CreateIntermediateCA(
+	parent *x509.Certificate,
+	parentPrivateKey *cose.SupportedCOSEPrivateKey,
+	privateKey *cose.SupportedCOSEPrivateKey,
+	depth int) (*x509.Certificate, error) {
+	intermediate := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(depth)),
+		Subject: pkix.Name{
+			Organization: []string{"Self-Signed Virtual FIDO"},
+			Country:      []string{"US"},
+			CommonName:   fmt.Sprintf("Self-Signed Virtual FIDO Intermediate CA %d", depth),
+		},
+		NotBefore:             util.Now(),
+		NotAfter:              util.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	certBytes, err := x509.CreateCertificate(
+		crypto.Random(),
+		intermediate, parent,
+		extractPublicKey(privateKey.Public()),
+		extractPrivateKey(parentPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certBytes)
+}
+
+func CreateCAPrivateKey() (*cose.SupportedCOSEPrivateKey, error) {
+	coseKey := cose.SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
 	return &coseKey, nil
 }
 
@@ -87,15 +160,15 @@ func CreateSelfSignedCA(privateKey *cose.SupportedCOSEPrivateKey) (*x509.Certifi
 			Organization: []string{"Self-Signed Virtual FIDO"},
 			Country:      []string{"US"},
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
+		NotBefore:             util.Now(),
+		NotAfter:              util.Now().AddDate(10, 0, 0),
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		BasicConstraintsValid: true,
 	}
 	certBytes, err := x509.CreateCertificate(
-		rand.Reader,
+		crypto.Random(),
 		authority, authority,
 		extractPublicKey(privateKey.Public()),
 		extractPrivateKey(privateKey))
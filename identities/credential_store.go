@@ -0,0 +1,17 @@
+package identities
+
+// CredentialStore keeps the credentials of a vault apart from the rest of it, e.g. in a
+// database, so a request reads and writes the credentials it uses instead of the whole
+// vault. Lookups by credential ID and RP ID should be indexed.
+type CredentialStore interface {
+	// Credential returns nil if there's no credential with id
+	Credential(id []byte) (*SavedCredentialSource, error)
+	RelyingPartyCredentials(relyingPartyID string) ([]SavedCredentialSource, error)
+	Credentials() ([]SavedCredentialSource, error)
+	CredentialCount() (int, error)
+	// PutCredentials adds sources, or replaces the ones with the same ID, all at once
+	PutCredentials(sources []SavedCredentialSource) error
+	DeleteCredential(id []byte) error
+	// ReplaceCredentials deletes every credential and stores sources instead, all at once
+	ReplaceCredentials(sources []SavedCredentialSource) error
+}
@@ -0,0 +1,94 @@
+package identities
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+const (
+	derivedCredentialVersion     = 1
+	derivedCredentialNonceLength = 32
+	derivedCredentialTagLength   = 16
+	derivedCredentialIDLength    = 1 + derivedCredentialNonceLength + derivedCredentialTagLength
+)
+
+// CredentialDeriver creates credentials whose private key is derived from a master secret,
+// the RP ID and a nonce carried in the credential ID, so nothing has to be stored for them.
+// A MAC in the ID ties it to the RP, so IDs from other authenticators or RPs are ignored.
+type CredentialDeriver struct {
+	masterSecret []byte
+}
+
+func NewCredentialDeriver(masterSecret []byte) *CredentialDeriver {
+	return &CredentialDeriver{masterSecret: masterSecret}
+}
+
+func (deriver *CredentialDeriver) prf(label string, relyingPartyID string, nonce []byte, counter byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(relyingPartyID))
+	mac := hmac.New(sha256.New, deriver.masterSecret)
+	mac.Write([]byte(label))
+	mac.Write(rpIDHash[:])
+	mac.Write(nonce)
+	mac.Write([]byte{counter})
+	return mac.Sum(nil)
+}
+
+// privateKey reduces 64 bytes of PRF output into [1, n-1], which keeps the bias negligible
+func (deriver *CredentialDeriver) privateKey(relyingPartyID string, nonce []byte) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	seed := append(deriver.prf("private key", relyingPartyID, nonce, 1), deriver.prf("private key", relyingPartyID, nonce, 2)...)
+	order := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+	d := new(big.Int).Mod(new(big.Int).SetBytes(seed), order)
+	d.Add(d, big.NewInt(1))
+	privateKey := &ecdsa.PrivateKey{D: d}
+	privateKey.PublicKey.Curve = curve
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, 32)))
+	return privateKey
+}
+
+func (deriver *CredentialDeriver) credentialSource(relyingPartyID string, id []byte, nonce []byte) *CredentialSource {
+	return &CredentialSource{
+		Type:         "public-key",
+		ID:           id,
+		PrivateKey:   &cose.SupportedCOSEPrivateKey{ECDSA: deriver.privateKey(relyingPartyID, nonce)},
+		RelyingParty: &webauthn.PublicKeyCredentialRPEntity{ID: relyingPartyID},
+		// Not stored, so the user isn't known when the credential is used
+		User: &webauthn.PublicKeyCrendentialUserEntity{},
+		// There's nowhere to keep a per-credential counter, and 0 tells the RP there isn't one
+		SignatureCounter: 0,
+	}
+}
+
+// NewCredential creates an ES256 credential for relyingParty
+func (deriver *CredentialDeriver) NewCredential(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
+	nonce := crypto.KeyRandomBytes(derivedCredentialNonceLength)
+	tag := deriver.prf("credential id", relyingParty.ID, nonce, 0)[:derivedCredentialTagLength]
+	id := append(append([]byte{derivedCredentialVersion}, nonce...), tag...)
+	source := deriver.credentialSource(relyingParty.ID, id, nonce)
+	source.RelyingParty = relyingParty
+	source.User = user
+	source.CreatedAt = util.Now().UTC()
+	return source
+}
+
+// Credential recreates the credential with this ID, or returns nil if it wasn't derived by
+// this deriver for relyingPartyID
+func (deriver *CredentialDeriver) Credential(relyingPartyID string, id []byte) *CredentialSource {
+	if len(id) != derivedCredentialIDLength || id[0] != derivedCredentialVersion {
+		return nil
+	}
+	nonce := id[1 : 1+derivedCredentialNonceLength]
+	tag := deriver.prf("credential id", relyingPartyID, nonce, 0)[:derivedCredentialTagLength]
+	if !hmac.Equal(tag, id[1+derivedCredentialNonceLength:]) {
+		return nil
+	}
+	return deriver.credentialSource(relyingPartyID, id, nonce)
+}
@@ -0,0 +1,32 @@
+package identities
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestDerivedCredential(t *testing.T) {
+	deriver := NewCredentialDeriver(crypto.RandomBytes(32))
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	user := &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"}
+	source := deriver.NewCredential(rp, user)
+	test.AssertEqual(t, len(source.ID), derivedCredentialIDLength, "Credential ID should carry the nonce and tag")
+
+	derived := deriver.Credential("example.com", source.ID)
+	test.Assert(t, derived != nil, "Credential should be derived again from its ID")
+	test.Assert(t, derived.PrivateKey.ECDSA.Equal(source.PrivateKey.ECDSA), "Derived private key should match")
+	test.Assert(t, source.PrivateKey.ECDSA.PublicKey.Curve.IsOnCurve(source.PrivateKey.ECDSA.X, source.PrivateKey.ECDSA.Y), "Public key should be on the curve")
+
+	test.Assert(t, deriver.Credential("other.com", source.ID) == nil, "Credential should only work for its RP")
+	test.Assert(t, NewCredentialDeriver(crypto.RandomBytes(32)).Credential("example.com", source.ID) == nil, "Credential should only work with its master secret")
+	tampered := append([]byte{}, source.ID...)
+	tampered[5] ^= 1
+	test.Assert(t, deriver.Credential("example.com", tampered) == nil, "Tampered credential IDs should be refused")
+	test.Assert(t, deriver.Credential("example.com", crypto.RandomBytes(16)) == nil, "Stored credential IDs should be ignored")
+
+	other := deriver.NewCredential(rp, user)
+	test.Assert(t, !other.PrivateKey.ECDSA.Equal(source.PrivateKey.ECDSA), "Each credential should get its own key")
+}
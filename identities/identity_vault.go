@@ -3,13 +3,46 @@ package identities
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
 )
 
+// CredentialPolicy decides what an assertion with a credential requires, so interactive and
+// silent credentials can be mixed in one vault
+type CredentialPolicy string
+
+const (
+	// Ask for approval, and use the PIN if the platform sends it
+	CredentialPolicyApprove CredentialPolicy = ""
+	// Also require user verification, with the PIN or built-in, even if the RP doesn't ask
+	CredentialPolicyRequirePIN CredentialPolicy = "pin"
+	// Assert without asking for approval, as if the user always consents
+	CredentialPolicySilent CredentialPolicy = "silent"
+)
+
+func ParseCredentialPolicy(value string) (CredentialPolicy, error) {
+	switch value {
+	case "", "approve":
+		return CredentialPolicyApprove, nil
+	case string(CredentialPolicyRequirePIN), string(CredentialPolicySilent):
+		return CredentialPolicy(value), nil
+	}
+	return CredentialPolicyApprove, fmt.Errorf("Invalid credential policy: %s", value)
+}
+
+func (policy CredentialPolicy) String() string {
+	if policy == CredentialPolicyApprove {
+		return "approve"
+	}
+	return string(policy)
+}
+
 type CredentialSource struct {
 	Type             string
 	ID               []byte
@@ -17,6 +50,59 @@ type CredentialSource struct {
 	RelyingParty     *webauthn.PublicKeyCredentialRPEntity
 	User             *webauthn.PublicKeyCrendentialUserEntity
 	SignatureCounter int32
+	CreatedAt        time.Time
+	LastUsedAt       time.Time
+	UsageCount       uint32
+	Nickname         string
+	// Opaque data stored by the RP with the credBlob extension
+	CredBlob []byte
+	// The BE and BS authenticator data flags. BE is decided when the credential is created,
+	// BS once it has been copied to another instance.
+	BackupEligible bool
+	BackedUp       bool
+	Policy         CredentialPolicy
+}
+
+// CredentialMetadata describes a credential for display without exposing its private key
+type CredentialMetadata struct {
+	ID               []byte
+	RelyingPartyID   string
+	RelyingPartyName string
+	UserName         string
+	UserDisplayName  string
+	Nickname         string
+	CreatedAt        time.Time
+	LastUsedAt       time.Time
+	UsageCount       uint32
+	SignatureCounter int32
+	BackupEligible   bool
+	BackedUp         bool
+	Policy           CredentialPolicy
+}
+
+func (source *CredentialSource) Metadata() CredentialMetadata {
+	return CredentialMetadata{
+		ID:               source.ID,
+		RelyingPartyID:   source.RelyingParty.ID,
+		RelyingPartyName: source.RelyingParty.Name,
+		UserName:         source.User.Name,
+		UserDisplayName:  source.User.DisplayName,
+		Nickname:         source.Nickname,
+		CreatedAt:        source.CreatedAt,
+		LastUsedAt:       source.LastUsedAt,
+		UsageCount:       source.UsageCount,
+		SignatureCounter: source.SignatureCounter,
+		BackupEligible:   source.BackupEligible,
+		BackedUp:         source.BackedUp,
+		Policy:           source.Policy,
+	}
+}
+
+// RecordUse updates the counters for a credential about to be used in an assertion
+func (source *CredentialSource) RecordUse() {
+	source.SignatureCounter++
+	source.UsageCount++
+	source.LastUsedAt = util.Now().UTC()
 }
 
 func (source *CredentialSource) CTAPDescriptor() webauthn.PublicKeyCredentialDescriptor {
@@ -28,7 +114,16 @@ func (source *CredentialSource) CTAPDescriptor() webauthn.PublicKeyCredentialDes
 }
 
 type IdentityVault struct {
+	// Unused by vaults whose credentials are kept in a CredentialStore
 	CredentialSources []*CredentialSource
+	store             CredentialStore
+	// Credentials read from the store, with how they were stored, so Flush writes back changes
+	loaded map[string]*loadedCredential
+}
+
+type loadedCredential struct {
+	source *CredentialSource
+	stored []byte
 }
 
 func NewIdentityVault() *IdentityVault {
@@ -36,27 +131,61 @@ func NewIdentityVault() *IdentityVault {
 	return &IdentityVault{CredentialSources: sources}
 }
 
+// NewStoredIdentityVault returns a vault whose credentials are read from store as they're
+// used. Changes to them are written back by Flush.
+func NewStoredIdentityVault(store CredentialStore) *IdentityVault {
+	return &IdentityVault{store: store, loaded: make(map[string]*loadedCredential)}
+}
+
+// Stored returns whether the credentials are kept in a CredentialStore
+func (vault *IdentityVault) Stored() bool {
+	return vault.store != nil
+}
+
+// DefaultCredentialIDLength is the length of the random IDs of stored credentials
+const DefaultCredentialIDLength = 16
+
 func (vault *IdentityVault) NewIdentity(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
-	credentialID := crypto.RandomBytes(16)
-	privateKey := crypto.GenerateECDSAKey()
-	cosePrivateKey := &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}
+	return vault.NewIdentityWithIDLength(relyingParty, user, DefaultCredentialIDLength)
+}
+
+// NewIdentityWithIDLength creates a credential with a random ID of idLength bytes
+func (vault *IdentityVault) NewIdentityWithIDLength(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity, idLength int) *CredentialSource {
+	credentialID := crypto.KeyRandomBytes(idLength)
 	credentialSource := CredentialSource{
 		Type:             "public-key",
 		ID:               credentialID,
-		PrivateKey:       cosePrivateKey,
+		PrivateKey:       cose.GenerateECDSAKey(),
 		RelyingParty:     relyingParty,
 		User:             user,
 		SignatureCounter: 0,
+		CreatedAt:        util.Now().UTC(),
 	}
 	vault.AddIdentity(&credentialSource)
 	return &credentialSource
 }
 
 func (vault *IdentityVault) AddIdentity(source *CredentialSource) {
+	if vault.store != nil {
+		saved := savedCredentialSource(source)
+		err := vault.store.PutCredentials([]SavedCredentialSource{saved})
+		util.CheckErr(err, "Could not store credential")
+		vault.cache(source, saved)
+		return
+	}
 	vault.CredentialSources = append(vault.CredentialSources, source)
 }
 
 func (vault *IdentityVault) DeleteIdentity(id []byte) bool {
+	if vault.store != nil {
+		if vault.GetIdentity(id) == nil {
+			return false
+		}
+		err := vault.store.DeleteCredential(id)
+		util.CheckErr(err, "Could not delete stored credential")
+		delete(vault.loaded, string(id))
+		return true
+	}
 	for i, source := range vault.CredentialSources {
 		if bytes.Equal(source.ID, id) {
 			vault.CredentialSources[i] = vault.CredentialSources[len(vault.CredentialSources)-1]
@@ -67,9 +196,38 @@ func (vault *IdentityVault) DeleteIdentity(id []byte) bool {
 	return false
 }
 
+func (vault *IdentityVault) GetIdentity(id []byte) *CredentialSource {
+	if vault.store != nil {
+		if loaded, ok := vault.loaded[string(id)]; ok {
+			return loaded.source
+		}
+		saved, err := vault.store.Credential(id)
+		util.CheckErr(err, "Could not read stored credential")
+		if saved == nil {
+			return nil
+		}
+		return vault.load(*saved)
+	}
+	for _, source := range vault.CredentialSources {
+		if bytes.Equal(source.ID, id) {
+			return source
+		}
+	}
+	return nil
+}
+
 func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) []*CredentialSource {
+	candidates := vault.CredentialSources
+	if vault.store != nil {
+		stored, err := vault.store.RelyingPartyCredentials(relyingPartyID)
+		util.CheckErr(err, "Could not read stored credentials")
+		candidates = make([]*CredentialSource, 0, len(stored))
+		for _, saved := range stored {
+			candidates = append(candidates, vault.load(saved))
+		}
+	}
 	sources := make([]*CredentialSource, 0)
-	for _, credentialSource := range vault.CredentialSources {
+	for _, credentialSource := range candidates {
 		if credentialSource.RelyingParty.ID == relyingPartyID {
 			if allowList != nil {
 				for _, allowedSource := range allowList {
@@ -86,42 +244,164 @@ func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string,
 	return sources
 }
 
+// All returns every credential, which reads the whole store of a stored vault
+func (vault *IdentityVault) All() []*CredentialSource {
+	if vault.store == nil {
+		return vault.CredentialSources
+	}
+	stored, err := vault.store.Credentials()
+	util.CheckErr(err, "Could not read stored credentials")
+	sources := make([]*CredentialSource, 0, len(stored))
+	for _, saved := range stored {
+		if loaded, ok := vault.loaded[string(saved.ID)]; ok {
+			sources = append(sources, loaded.source)
+			continue
+		}
+		source, err := decodeCredentialSource(saved)
+		util.CheckErr(err, "Could not read stored credential")
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+func (vault *IdentityVault) Count() int {
+	if vault.store == nil {
+		return len(vault.CredentialSources)
+	}
+	count, err := vault.store.CredentialCount()
+	util.CheckErr(err, "Could not read stored credentials")
+	return count
+}
+
+// load returns the credential read from the store, keeping the copy loaded before if any
+func (vault *IdentityVault) load(saved SavedCredentialSource) *CredentialSource {
+	if loaded, ok := vault.loaded[string(saved.ID)]; ok {
+		return loaded.source
+	}
+	source, err := decodeCredentialSource(saved)
+	util.CheckErr(err, "Could not read stored credential")
+	vault.cache(source, saved)
+	return source
+}
+
+func (vault *IdentityVault) cache(source *CredentialSource, saved SavedCredentialSource) {
+	stored, _ := json.Marshal(saved)
+	vault.loaded[string(source.ID)] = &loadedCredential{source: source, stored: stored}
+}
+
+// Flush writes the credentials changed since they were read back to the store
+func (vault *IdentityVault) Flush() error {
+	if vault.store == nil {
+		return nil
+	}
+	changed := make([]SavedCredentialSource, 0)
+	for _, loaded := range vault.loaded {
+		saved := savedCredentialSource(loaded.source)
+		stored, _ := json.Marshal(saved)
+		if !bytes.Equal(stored, loaded.stored) {
+			changed = append(changed, saved)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := vault.store.PutCredentials(changed); err != nil {
+		return fmt.Errorf("Could not store credentials: %w", err)
+	}
+	for _, saved := range changed {
+		vault.cache(vault.loaded[string(saved.ID)].source, saved)
+	}
+	return nil
+}
+
+func savedCredentialSource(source *CredentialSource) SavedCredentialSource {
+	key := cose.MarshalCOSEPrivateKey(source.PrivateKey)
+	return SavedCredentialSource{
+		Type:             source.Type,
+		ID:               source.ID,
+		PrivateKey:       key,
+		RelyingParty:     *source.RelyingParty,
+		User:             *source.User,
+		SignatureCounter: source.SignatureCounter,
+		CreatedAt:        source.CreatedAt,
+		LastUsedAt:       source.LastUsedAt,
+		UsageCount:       source.UsageCount,
+		Nickname:         source.Nickname,
+		CredBlob:         source.CredBlob,
+		BackupEligible:   source.BackupEligible,
+		BackedUp:         source.BackedUp,
+		Policy:           source.Policy,
+	}
+}
+
+func decodeCredentialSource(source SavedCredentialSource) (*CredentialSource, error) {
+	key, err := cose.UnmarshalCOSEPrivateKey(source.PrivateKey)
+	if err != nil {
+		oldFormatKey, err := x509.ParseECPrivateKey(source.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid private key for source: %w", err)
+		}
+		key = &cose.SupportedCOSEPrivateKey{ECDSA: oldFormatKey}
+	}
+	return &CredentialSource{
+		Type:             source.Type,
+		ID:               source.ID,
+		PrivateKey:       key,
+		RelyingParty:     &source.RelyingParty,
+		User:             &source.User,
+		SignatureCounter: source.SignatureCounter,
+		CreatedAt:        source.CreatedAt,
+		LastUsedAt:       source.LastUsedAt,
+		UsageCount:       source.UsageCount,
+		Nickname:         source.Nickname,
+		CredBlob:         source.CredBlob,
+		BackupEligible:   source.BackupEligible,
+		BackedUp:         source.BackedUp,
+		Policy:           source.Policy,
+	}, nil
+}
+
 func (vault *IdentityVault) Export() []SavedCredentialSource {
 	sources := make([]SavedCredentialSource, 0)
-	for _, source := range vault.CredentialSources {
-		key := cose.MarshalCOSEPrivateKey(source.PrivateKey)
-		savedSource := SavedCredentialSource{
-			Type:             source.Type,
-			ID:               source.ID,
-			PrivateKey:       key,
-			RelyingParty:     *source.RelyingParty,
-			User:             *source.User,
-			SignatureCounter: source.SignatureCounter,
-		}
-		sources = append(sources, savedSource)
+	for _, source := range vault.All() {
+		sources = append(sources, savedCredentialSource(source))
 	}
 	return sources
 }
 
 func (vault *IdentityVault) Import(sources []SavedCredentialSource) error {
+	decoded := make([]*CredentialSource, 0, len(sources))
 	for _, source := range sources {
-		key, err := cose.UnmarshalCOSEPrivateKey(source.PrivateKey)
+		decodedSource, err := decodeCredentialSource(source)
 		if err != nil {
-			oldFormatKey, err := x509.ParseECPrivateKey(source.PrivateKey)
-			if err != nil {
-				return fmt.Errorf("Invalid private key for source: %w", err)
-			}
-			key = &cose.SupportedCOSEPrivateKey{ECDSA: oldFormatKey}
+			return err
+		}
+		decoded = append(decoded, decodedSource)
+	}
+	if vault.store != nil {
+		if err := vault.store.PutCredentials(sources); err != nil {
+			return fmt.Errorf("Could not store credentials: %w", err)
 		}
-		decodedSource := CredentialSource{
-			Type:             source.Type,
-			ID:               source.ID,
-			PrivateKey:       key,
-			RelyingParty:     &source.RelyingParty,
-			User:             &source.User,
-			SignatureCounter: source.SignatureCounter,
+		return nil
+	}
+	vault.CredentialSources = append(vault.CredentialSources, decoded...)
+	return nil
+}
+
+// Replace deletes every credential and imports sources instead. Nothing changes if one of
+// them can't be imported.
+func (vault *IdentityVault) Replace(sources []SavedCredentialSource) error {
+	imported := NewIdentityVault()
+	if err := imported.Import(sources); err != nil {
+		return err
+	}
+	if vault.store != nil {
+		if err := vault.store.ReplaceCredentials(sources); err != nil {
+			return fmt.Errorf("Could not store credentials: %w", err)
 		}
-		vault.AddIdentity(&decodedSource)
+		vault.loaded = make(map[string]*loadedCredential)
+		return nil
 	}
+	vault.CredentialSources = imported.CredentialSources
 	return nil
 }
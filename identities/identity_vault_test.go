@@ -0,0 +1,31 @@
+package identities
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestCredentialMetadata(t *testing.T) {
+	vault := NewIdentityVault()
+	source := vault.NewIdentity(
+		&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"})
+	test.Assert(t, !source.CreatedAt.IsZero(), "Creation time not set")
+	test.Assert(t, source.LastUsedAt.IsZero(), "New credential should not have been used")
+	source.RecordUse()
+	source.RecordUse()
+	source.Nickname = "laptop"
+
+	imported := NewIdentityVault()
+	err := imported.Import(vault.Export())
+	test.Assert(t, err == nil, "Could not import vault")
+	metadata := imported.GetIdentity(source.ID).Metadata()
+	test.AssertEqual(t, metadata.UsageCount, uint32(2), "Usage count not preserved")
+	test.AssertEqual(t, metadata.SignatureCounter, int32(2), "Signature counter not preserved")
+	test.AssertEqual(t, metadata.Nickname, "laptop", "Nickname not preserved")
+	test.Assert(t, metadata.LastUsedAt.Equal(source.LastUsedAt), "Last used time not preserved")
+	test.Assert(t, metadata.CreatedAt.Equal(source.CreatedAt), "Creation time not preserved")
+	test.AssertEqual(t, metadata.RelyingPartyID, "example.com", "Wrong relying party")
+}
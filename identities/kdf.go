@@ -0,0 +1,119 @@
+package identities
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Vaults are written with Argon2id. Scrypt is only read, from vaults saved before Argon2id,
+// and those are written with Argon2id the next time they're saved.
+const (
+	KDFArgon2id = "argon2id"
+	KDFScrypt   = "scrypt"
+)
+
+// Argon2idParameters tune the passphrase KDF: Time passes over Memory KiB, with Threads
+// lanes that can be computed in parallel
+type Argon2idParameters struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultArgon2idParameters is the second recommendation of RFC 9106, which takes 64MB
+func DefaultArgon2idParameters() Argon2idParameters {
+	return Argon2idParameters{Time: 3, Memory: 64 * 1024, Threads: 4}
+}
+
+// Validate also bounds the parameters, so a crafted vault can't exhaust memory
+func (params Argon2idParameters) Validate() error {
+	if params.Time < 1 || params.Threads < 1 {
+		return fmt.Errorf("Argon2id time and threads must be positive: %#v", params)
+	}
+	if params.Memory < 8*uint32(params.Threads) {
+		return fmt.Errorf("Argon2id needs at least 8KiB of memory per thread: %#v", params)
+	}
+	if params.Time > 64 || params.Memory > 1<<20 || params.Threads > 64 {
+		return fmt.Errorf("KDF parameters are too expensive: %#v", params)
+	}
+	return nil
+}
+
+// ScryptParameters are those of vaults saved with scrypt. N sets both the memory
+// (128 * N * R bytes) and the work, R the block size and P the number of independent passes.
+type ScryptParameters struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	P int `json:"p"`
+}
+
+// Used by vaults saved before the parameters were stored
+var legacyScryptParameters = ScryptParameters{N: 32768, R: 8, P: 1}
+
+// Validate also bounds the parameters, so a crafted vault can't exhaust memory
+func (params ScryptParameters) Validate() error {
+	if params.N < 2 || params.N&(params.N-1) != 0 {
+		return fmt.Errorf("Scrypt N must be a power of two, not %d", params.N)
+	}
+	if params.R < 1 || params.P < 1 {
+		return fmt.Errorf("Scrypt R and P must be positive: %#v", params)
+	}
+	if params.N > 1<<20 || params.R > 32 || params.P > 16 {
+		return fmt.Errorf("KDF parameters are too expensive: %#v", params)
+	}
+	return nil
+}
+
+// passphraseKDF is how a header records the KDF and its parameters
+type passphraseKDF struct {
+	KDF      string              `json:"kdf"`
+	Scrypt   *ScryptParameters   `json:"scrypt,omitempty"`
+	Argon2id *Argon2idParameters `json:"argon2id,omitempty"`
+}
+
+func argon2idKDF(params Argon2idParameters) passphraseKDF {
+	return passphraseKDF{KDF: KDFArgon2id, Argon2id: &params}
+}
+
+func scryptKDF(params ScryptParameters) passphraseKDF {
+	return passphraseKDF{KDF: KDFScrypt, Scrypt: &params}
+}
+
+// argon2idParameters returns the parameters to save data read with kdf again with, which are
+// the defaults unless it was already saved with Argon2id
+func (kdf passphraseKDF) argon2idParameters() Argon2idParameters {
+	if kdf.KDF == KDFArgon2id && kdf.Argon2id != nil {
+		return *kdf.Argon2id
+	}
+	return DefaultArgon2idParameters()
+}
+
+func (kdf passphraseKDF) deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	switch kdf.KDF {
+	case KDFArgon2id:
+		if kdf.Argon2id == nil {
+			return nil, fmt.Errorf("Missing Argon2id parameters")
+		}
+		params := *kdf.Argon2id
+		if err := params.Validate(); err != nil {
+			return nil, err
+		}
+		return argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, 32), nil
+	case KDFScrypt:
+		if kdf.Scrypt == nil {
+			return nil, fmt.Errorf("Missing scrypt parameters")
+		}
+		params := *kdf.Scrypt
+		if err := params.Validate(); err != nil {
+			return nil, err
+		}
+		key, err := scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Could not derive key: %w", err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported KDF: %q", kdf.KDF)
+}
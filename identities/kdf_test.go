@@ -0,0 +1,84 @@
+package identities
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestPassphraseParametersStored(t *testing.T) {
+	params := Argon2idParameters{Time: 2, Memory: 128, Threads: 2}
+	encrypted, err := EncryptWithPassphraseParameters("passphrase", []byte("data"), params)
+	test.Assert(t, err == nil, "Could not encrypt")
+	stored, err := PassphraseParameters(encrypted)
+	test.Assert(t, err == nil, "Could not read parameters")
+	test.AssertEqual(t, stored, params, "Parameters should be stored with the ciphertext")
+	decrypted, err := DecryptWithPassphrase("passphrase", encrypted)
+	test.Assert(t, err == nil, "Could not decrypt")
+	test.Assert(t, bytes.Equal(decrypted, []byte("data")), "Data should round trip")
+}
+
+func TestLegacyPassphraseBlob(t *testing.T) {
+	encrypted, err := encryptWithPassphraseKDF("passphrase", []byte("data"), scryptKDF(legacyScryptParameters))
+	test.Assert(t, err == nil, "Could not encrypt")
+	blob := PassphraseEncryptedBlob{}
+	err = json.Unmarshal(encrypted, &blob)
+	test.Assert(t, err == nil, "Could not decode blob")
+	blob.KDF = ""
+	blob.Scrypt = nil
+	legacy, _ := json.Marshal(blob)
+
+	stored, err := PassphraseParameters(legacy)
+	test.Assert(t, err == nil, "Could not read parameters")
+	test.AssertEqual(t, stored, DefaultArgon2idParameters(), "Blobs saved with scrypt should be saved again with Argon2id")
+	decrypted, err := DecryptWithPassphrase("passphrase", legacy)
+	test.Assert(t, err == nil, "Could not decrypt legacy blob")
+	test.Assert(t, bytes.Equal(decrypted, []byte("data")), "Data should round trip")
+}
+
+// Saved with scrypt by an earlier version, with N=16, R=1 and P=1
+const (
+	scryptExport = `{"format":"virtual-fido-vault","version":1,"kdf":"scrypt","scrypt":{"n":16,"r":1,"p":1},"salt":"KCwJ+IrIuFtj7U8vtGmQ8w==","nonce":"pqfTwpu5g4SdwhzT","encrypted_data":"Cav7q4zrbqix8WWvvBqDWewhDh97tSmc96FxyBt5iSnplfuq9YmgA01EQ1JBIU+W+8IZYNNUld4DqdHX4+Ibg9W0apSA3EOpyoPi6fJwVIGrCyfsgMcvG9BEM/sz8tsNxuE+zzVyG3KLK8IglsFGg2Ar2MF84P896LEVyUJk/BA+CPk6S4hY7B1dRlMb4ME="}`
+	scryptVault  = `{"header":{"format":"virtual-fido-vault-state","version":2,"kdf":"scrypt","scrypt":{"n":16,"r":1,"p":1},"salt":"5aOZzN/h5FHGF8Fv++hO7A==","cipher":"aes-256-gcm"},"key_nonce":"HrtNGAKwlcsWbaDv","encrypted_key":"FHKoa2S6MbQe4Nr4xgXMWwsy9dJG7l3vo98NO7YzTxTdm0RLYdOmnhBTC1cVRwml","records":[{"name":"device","nonce":"tU9BPoue1ZeLYFz3","encrypted_data":"jPNBaIQjM9/Wn8eF+6+h54kQgR6mnhSVpbc7ry6pfZQVXIkfsC5lR7dqqPF4UOK+1XVbDvGuqX5rZpduw/5LCqD+DLsNOpRV+/I//mB5NeWXnJ5jgRVczEYwDEt92q3aV4u4Fc7AJVgMTWRGKPlCihnlaUroVQxbwmb8gc4xwIoMigMw23m7c7oUrJ2TBQA="}]}`
+)
+
+func TestScryptVaultsStillRead(t *testing.T) {
+	imported, err := ImportVault([]byte(scryptExport), "passphrase")
+	test.Assert(t, err == nil, "Could not import scrypt export")
+	test.AssertEqual(t, imported.AuthenticationCounter, 7, "Scrypt export should be read")
+	state, err := DecryptFIDOState([]byte(scryptVault), "passphrase")
+	test.Assert(t, err == nil, "Could not decrypt scrypt vault")
+	test.AssertEqual(t, state.AuthenticationCounter, 7, "Scrypt vault should be read")
+	params, err := PassphraseParameters([]byte(scryptVault))
+	test.Assert(t, err == nil, "Could not read parameters")
+	test.AssertEqual(t, params, DefaultArgon2idParameters(), "Scrypt vaults should be saved again with Argon2id")
+}
+
+func TestKDFParametersValidate(t *testing.T) {
+	test.Assert(t, DefaultArgon2idParameters().Validate() == nil, "Defaults should be valid")
+	test.Assert(t, Argon2idParameters{Time: 0, Memory: 64, Threads: 1}.Validate() != nil, "Time must be positive")
+	test.Assert(t, Argon2idParameters{Time: 1, Memory: 8, Threads: 2}.Validate() != nil, "Memory must cover the threads")
+	test.Assert(t, Argon2idParameters{Time: 1, Memory: 1 << 21, Threads: 1}.Validate() != nil, "Expensive parameters should be refused")
+	test.Assert(t, legacyScryptParameters.Validate() == nil, "Legacy scrypt parameters should be valid")
+	test.Assert(t, ScryptParameters{N: 1000, R: 8, P: 1}.Validate() != nil, "N must be a power of two")
+	test.Assert(t, ScryptParameters{N: 1024, R: 0, P: 1}.Validate() != nil, "R must be positive")
+	test.Assert(t, ScryptParameters{N: 1 << 21, R: 8, P: 1}.Validate() != nil, "Expensive parameters should be refused")
+	_, err := EncryptWithPassphraseParameters("passphrase", []byte("data"), Argon2idParameters{Time: 1, Memory: 1, Threads: 1})
+	test.Assert(t, err != nil, "Invalid parameters should not be used")
+}
+
+func TestExportVaultWithParameters(t *testing.T) {
+	params := Argon2idParameters{Time: 1, Memory: 256, Threads: 1}
+	exported, err := ExportVaultWithParameters(FIDODeviceConfig{AuthenticationCounter: 7}, "passphrase", params)
+	test.Assert(t, err == nil, "Could not export vault")
+	container := VaultExportContainer{}
+	err = json.Unmarshal(exported, &container)
+	test.Assert(t, err == nil, "Could not decode container")
+	test.AssertEqual(t, container.KDF, KDFArgon2id, "Export should use Argon2id")
+	test.AssertEqual(t, *container.Argon2id, params, "Export should record its parameters")
+	imported, err := ImportVault(exported, "passphrase")
+	test.Assert(t, err == nil, "Could not import vault")
+	test.AssertEqual(t, imported.AuthenticationCounter, 7, "Vault should round trip")
+}
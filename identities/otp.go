@@ -0,0 +1,59 @@
+package identities
+
+import (
+	"fmt"
+)
+
+// Like a YubiKey, there's a slot for a short touch and one for a long touch
+const OTPSlotCount = 2
+
+type OTPSlotType string
+
+const (
+	OTPSlotStatic OTPSlotType = "static"
+	OTPSlotHOTP   OTPSlotType = "hotp"
+	OTPSlotTOTP   OTPSlotType = "totp"
+)
+
+// OTPSlot is what the keyboard interface types when the slot is triggered
+type OTPSlot struct {
+	// Numbered from 1
+	Slot int         `json:"slot"`
+	Type OTPSlotType `json:"type"`
+	// Typed as is by static slots
+	Password string `json:"password,omitempty"`
+	// HMAC-SHA1 key of HOTP and TOTP slots
+	Secret []byte `json:"secret,omitempty"`
+	// Length of generated codes, 6 if unset
+	Digits int `json:"digits,omitempty"`
+	// TOTP time step in seconds, 30 if unset
+	Period int `json:"period,omitempty"`
+	// Next HOTP counter value
+	Counter     uint64 `json:"counter,omitempty"`
+	AppendEnter bool   `json:"append_enter,omitempty"`
+}
+
+func (slot *OTPSlot) Validate() error {
+	if slot.Slot < 1 || slot.Slot > OTPSlotCount {
+		return fmt.Errorf("OTP slot must be between 1 and %d, not %d", OTPSlotCount, slot.Slot)
+	}
+	switch slot.Type {
+	case OTPSlotStatic:
+		if slot.Password == "" {
+			return fmt.Errorf("Static OTP slot needs a password")
+		}
+	case OTPSlotHOTP, OTPSlotTOTP:
+		if len(slot.Secret) == 0 {
+			return fmt.Errorf("%s slot needs a secret", slot.Type)
+		}
+		if slot.Digits != 0 && (slot.Digits < 6 || slot.Digits > 8) {
+			return fmt.Errorf("OTP codes must have 6 to 8 digits, not %d", slot.Digits)
+		}
+		if slot.Period < 0 {
+			return fmt.Errorf("Invalid TOTP period: %d", slot.Period)
+		}
+	default:
+		return fmt.Errorf("Unknown OTP slot type: %s", slot.Type)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package identities
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Retries allowed before the PIN, or built-in user verification, is blocked
+const DefaultPINRetries = 8
+
+// PINState is saved as one unit so the PIN hash and retry counters can't be saved apart.
+// Version increases every time the vault is saved, so an old copy of the vault can be
+// detected and rejected instead of resetting the retry counters.
+type PINState struct {
+	Version    uint64 `json:"version"`
+	PINHash    []byte `json:"pin_hash,omitempty"`
+	PINRetries int32  `json:"pin_retries"`
+	UVRetries  int32  `json:"uv_retries"`
+	MAC        []byte `json:"mac"`
+}
+
+func (state *PINState) mac(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, binary.BigEndian, state.Version)
+	binary.Write(mac, binary.BigEndian, state.PINRetries)
+	binary.Write(mac, binary.BigEndian, state.UVRetries)
+	mac.Write(state.PINHash)
+	return mac.Sum(nil)
+}
+
+// Seal sets the MAC, keyed with the device encryption key
+func (state *PINState) Seal(key []byte) {
+	state.MAC = state.mac(key)
+}
+
+func (state *PINState) Verify(key []byte) error {
+	if !hmac.Equal(state.MAC, state.mac(key)) {
+		return fmt.Errorf("PIN state MAC is invalid")
+	}
+	if state.PINRetries < 0 || state.PINRetries > DefaultPINRetries || state.UVRetries < 0 || state.UVRetries > DefaultPINRetries {
+		return fmt.Errorf("Invalid PIN retries: %d PIN, %d UV", state.PINRetries, state.UVRetries)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package identities
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+// PINs and PUKs are padded with 0xFF to this length before they're hashed
+const PIVPINLength = 8
+
+// Tries before the PIN or PUK is blocked
+const PIVDefaultRetries = 3
+
+var (
+	PIVDefaultPIN = []byte("123456")
+	PIVDefaultPUK = []byte("12345678")
+	// The well-known default 3DES management key of PIV cards
+	PIVDefaultManagementKey = []byte{
+		1, 2, 3, 4, 5, 6, 7, 8,
+		1, 2, 3, 4, 5, 6, 7, 8,
+		1, 2, 3, 4, 5, 6, 7, 8,
+	}
+)
+
+// PIVKey is a private key generated in one of the PIV applet's slots
+type PIVKey struct {
+	Algorithm  uint8
+	PrivateKey *ecdsa.PrivateKey
+}
+
+// PIVState is everything the PIV applet keeps between sessions
+type PIVState struct {
+	PINHash       []byte
+	PINRetries    int32
+	PUKHash       []byte
+	PUKRetries    int32
+	ManagementKey []byte
+	// Keys by slot, e.g. 0x9A for PIV authentication
+	Keys map[uint8]*PIVKey
+	// Data objects written by the host, like certificates and the CHUID, by tag
+	Objects map[uint32][]byte
+}
+
+type SavedPIVKey struct {
+	Slot       uint8  `json:"slot"`
+	Algorithm  uint8  `json:"algorithm"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+type SavedPIVObject struct {
+	Tag  uint32 `json:"tag"`
+	Data []byte `json:"data"`
+}
+
+type SavedPIVState struct {
+	PINHash       []byte           `json:"pin_hash"`
+	PINRetries    int32            `json:"pin_retries"`
+	PUKHash       []byte           `json:"puk_hash"`
+	PUKRetries    int32            `json:"puk_retries"`
+	ManagementKey []byte           `json:"management_key"`
+	Keys          []SavedPIVKey    `json:"keys,omitempty"`
+	Objects       []SavedPIVObject `json:"objects,omitempty"`
+}
+
+// HashPIVPIN hashes a PIN or PUK, padding it the way it's sent in VERIFY
+func HashPIVPIN(pin []byte) []byte {
+	padded := make([]byte, PIVPINLength)
+	for i := range padded {
+		padded[i] = 0xFF
+	}
+	copy(padded, pin)
+	return crypto.HashSHA256(padded)
+}
+
+// NewPIVState returns a blank applet with the default PIN, PUK and management key
+func NewPIVState() *PIVState {
+	return &PIVState{
+		PINHash:       HashPIVPIN(PIVDefaultPIN),
+		PINRetries:    PIVDefaultRetries,
+		PUKHash:       HashPIVPIN(PIVDefaultPUK),
+		PUKRetries:    PIVDefaultRetries,
+		ManagementKey: PIVDefaultManagementKey,
+		Keys:          make(map[uint8]*PIVKey),
+		Objects:       make(map[uint32][]byte),
+	}
+}
+
+func (state *PIVState) Export() *SavedPIVState {
+	saved := &SavedPIVState{
+		PINHash:       state.PINHash,
+		PINRetries:    state.PINRetries,
+		PUKHash:       state.PUKHash,
+		PUKRetries:    state.PUKRetries,
+		ManagementKey: state.ManagementKey,
+		Keys:          make([]SavedPIVKey, 0),
+		Objects:       make([]SavedPIVObject, 0),
+	}
+	for slot, key := range state.Keys {
+		privateKey, err := x509.MarshalECPrivateKey(key.PrivateKey)
+		if err != nil {
+			continue
+		}
+		saved.Keys = append(saved.Keys, SavedPIVKey{Slot: slot, Algorithm: key.Algorithm, PrivateKey: privateKey})
+	}
+	for tag, data := range state.Objects {
+		saved.Objects = append(saved.Objects, SavedPIVObject{Tag: tag, Data: data})
+	}
+	return saved
+}
+
+func ImportPIVState(saved *SavedPIVState) (*PIVState, error) {
+	state := &PIVState{
+		PINHash:       saved.PINHash,
+		PINRetries:    saved.PINRetries,
+		PUKHash:       saved.PUKHash,
+		PUKRetries:    saved.PUKRetries,
+		ManagementKey: saved.ManagementKey,
+		Keys:          make(map[uint8]*PIVKey),
+		Objects:       make(map[uint32][]byte),
+	}
+	for _, key := range saved.Keys {
+		privateKey, err := x509.ParseECPrivateKey(key.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid private key for PIV slot 0x%x: %w", key.Slot, err)
+		}
+		state.Keys[key.Slot] = &PIVKey{Algorithm: key.Algorithm, PrivateKey: privateKey}
+	}
+	for _, object := range saved.Objects {
+		state.Objects[object.Tag] = object.Data
+	}
+	return state, nil
+}
@@ -0,0 +1,63 @@
+package identities
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// DefaultProfile holds the credentials of a vault saved before it had profiles
+const DefaultProfile = "default"
+
+var profileNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// SavedProfiles is a vault with several profiles. Each profile is encrypted on its own, like
+// a vault without profiles, so it can be saved without decrypting the others.
+type SavedProfiles struct {
+	ActiveProfile string                     `json:"active_profile"`
+	Profiles      map[string]json.RawMessage `json:"profiles"`
+}
+
+// ValidateProfileName only allows names that are safe to use in filenames
+func ValidateProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("Invalid profile name %q: use up to 32 letters, digits, '-' or '_'", name)
+	}
+	return nil
+}
+
+// ParseProfiles reads a vault with profiles. A vault without profiles becomes the default
+// profile, and no data becomes a vault without any.
+func ParseProfiles(data []byte) (*SavedProfiles, error) {
+	if data == nil {
+		return &SavedProfiles{Profiles: make(map[string]json.RawMessage)}, nil
+	}
+	profiles := &SavedProfiles{}
+	err := json.Unmarshal(data, profiles)
+	if err != nil {
+		return nil, vaultDamaged("Could not unmarshal JSON into vault profiles: %v", err)
+	}
+	if profiles.Profiles == nil {
+		profiles.ActiveProfile = DefaultProfile
+		profiles.Profiles = map[string]json.RawMessage{DefaultProfile: data}
+	}
+	return profiles, nil
+}
+
+func (profiles *SavedProfiles) Names() []string {
+	names := make([]string, 0, len(profiles.Profiles))
+	for name := range profiles.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (profiles *SavedProfiles) Marshal() ([]byte, error) {
+	data, err := json.Marshal(profiles)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode JSON: %w", err)
+	}
+	return data, nil
+}
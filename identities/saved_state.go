@@ -1,14 +1,14 @@
 package identities
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/crypto"
-	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
-
-	"golang.org/x/crypto/scrypt"
 )
 
 type SavedCredentialSource struct {
@@ -18,6 +18,39 @@ type SavedCredentialSource struct {
 	RelyingParty     webauthn.PublicKeyCredentialRPEntity    `json:"relying_party"`
 	User             webauthn.PublicKeyCrendentialUserEntity `json:"user"`
 	SignatureCounter int32                                   `json:"signature_counter"`
+	CreatedAt        time.Time                               `json:"created_at,omitempty"`
+	LastUsedAt       time.Time                               `json:"last_used_at,omitempty"`
+	UsageCount       uint32                                  `json:"usage_count,omitempty"`
+	Nickname         string                                  `json:"nickname,omitempty"`
+	CredBlob         []byte                                  `json:"cred_blob,omitempty"`
+	BackupEligible   bool                                    `json:"backup_eligible,omitempty"`
+	BackedUp         bool                                    `json:"backed_up,omitempty"`
+	Policy           CredentialPolicy                        `json:"policy,omitempty"`
+}
+
+// AAGUID reported by virtual-fido unless the device config overrides it
+var DefaultAAGUID = [16]byte{117, 108, 90, 245, 236, 166, 1, 163, 47, 198, 211, 12, 226, 242, 1, 197}
+
+// ParseAAGUID accepts an AAGUID in UUID form (with or without dashes)
+func ParseAAGUID(value string) ([16]byte, error) {
+	var aaguid [16]byte
+	decoded, err := hex.DecodeString(strings.ReplaceAll(value, "-", ""))
+	if err != nil || len(decoded) != len(aaguid) {
+		return aaguid, fmt.Errorf("Invalid AAGUID: %s", value)
+	}
+	copy(aaguid[:], decoded)
+	return aaguid, nil
+}
+
+// NewSerialNumber generates the USB serial number of a new device
+func NewSerialNumber() string {
+	return strings.ToUpper(hex.EncodeToString(crypto.RandomBytes(8)))
+}
+
+// FormatAAGUID returns the AAGUID in the UUID form used by FIDO metadata
+func FormatAAGUID(aaguid [16]byte) string {
+	encoded := hex.EncodeToString(aaguid[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", encoded[0:8], encoded[8:12], encoded[12:16], encoded[16:20], encoded[20:32])
 }
 
 type FIDODeviceConfig struct {
@@ -27,7 +60,26 @@ type FIDODeviceConfig struct {
 	AuthenticationCounter  uint32                  `json:"authentication_counter"`
 	PINEnabled             bool                    `json:"pin_enabled,omitempty"`
 	PINHash                []byte                  `json:"pin_hash,omitempty"`
+	PINRetries             *int32                  `json:"pin_retries,omitempty"`
 	Sources                []SavedCredentialSource `json:"sources"`
+	ImportedU2FKeys        []SavedU2FKeyHandle     `json:"imported_u2f_keys,omitempty"`
+	AAGUID                 []byte                  `json:"aaguid,omitempty"`
+	SerialNumber           string                  `json:"serial_number,omitempty"`
+	PIV                    *SavedPIVState          `json:"piv,omitempty"`
+	OTPSlots               []OTPSlot               `json:"otp_slots,omitempty"`
+	// Replaces PINHash and PINRetries, which are only read from older vaults
+	PINState *PINState       `json:"pin_state,omitempty"`
+	Sync     *SavedSyncState `json:"sync,omitempty"`
+	// Every request needs user verification, see CTAP 2.1 alwaysUv
+	AlwaysUV bool `json:"always_uv,omitempty"`
+	// Attestation statement format of new credentials, packed if empty
+	AttestationFormat string `json:"attestation_format,omitempty"`
+	// KeyDescription of android-key attestation, the default if nil
+	AndroidKeyDescription *AndroidKeyDescription `json:"android_key_description,omitempty"`
+	// Sources is empty since the credentials are kept in a CredentialStore
+	CredentialsStored bool `json:"credentials_stored,omitempty"`
+	// Records of a newer vault format, saved again as they were
+	UnknownRecords []VaultRecord `json:"-"`
 }
 
 type PassphraseEncryptedBlob struct {
@@ -36,11 +88,28 @@ type PassphraseEncryptedBlob struct {
 	KeyNonce      []byte `json:"key_nonce"`
 	EncryptedData []byte `json:"encrypted_data"`
 	DataNonce     []byte `json:"data_nonce"`
+	// Missing from older blobs, which used scrypt with the default parameters
+	passphraseKDF
+}
+
+func (blob *PassphraseEncryptedBlob) kdf() passphraseKDF {
+	if blob.KDF == "" {
+		return scryptKDF(legacyScryptParameters)
+	}
+	return blob.passphraseKDF
 }
 
 func EncryptWithPassphrase(passphrase string, data []byte) ([]byte, error) {
+	return EncryptWithPassphraseParameters(passphrase, data, DefaultArgon2idParameters())
+}
+
+func EncryptWithPassphraseParameters(passphrase string, data []byte, params Argon2idParameters) ([]byte, error) {
+	return encryptWithPassphraseKDF(passphrase, data, argon2idKDF(params))
+}
+
+func encryptWithPassphraseKDF(passphrase string, data []byte, kdf passphraseKDF) ([]byte, error) {
 	salt := crypto.RandomBytes(16)
-	keyEncryptionKey, err := scrypt.Key([]byte(passphrase), salt, 32768, 8, 1, 32)
+	keyEncryptionKey, err := kdf.deriveKey(passphrase, salt)
 	if err != nil {
 		return nil, fmt.Errorf("Could not create key encryption key: %w", err)
 	}
@@ -59,6 +128,7 @@ func EncryptWithPassphrase(passphrase string, data []byte) ([]byte, error) {
 		KeyNonce:      keyNonce,
 		EncryptedData: encryptedData,
 		DataNonce:     dataNonce,
+		passphraseKDF: kdf,
 	}
 	blobBytes, err := json.Marshal(blob)
 	if err != nil {
@@ -71,34 +141,70 @@ func DecryptWithPassphrase(passphrase string, data []byte) ([]byte, error) {
 	blob := PassphraseEncryptedBlob{}
 	err := json.Unmarshal(data, &blob)
 	if err != nil {
-		return nil, fmt.Errorf("Could not unmarshal JSON into encrypted data: %w", err)
+		return nil, vaultDamaged("Could not unmarshal JSON into encrypted data: %v", err)
+	}
+	keyEncryptionKey, err := blob.kdf().deriveKey(passphrase, blob.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create key encryption key: %w", err)
 	}
-	keyEncryptionKey, err := scrypt.Key([]byte(passphrase), blob.Salt, 32768, 8, 1, 32)
-	util.CheckErr(err, "Could not create key encryption key")
 	encryptionKey, err := crypto.Decrypt(keyEncryptionKey, blob.EncryptionKey, blob.KeyNonce)
 	if err != nil {
-		return nil, fmt.Errorf("Could not decrypt encryption key: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrWrongPassphrase, err)
 	}
 	decryptedData, err := crypto.Decrypt(encryptionKey, blob.EncryptedData, blob.DataNonce)
 	if err != nil {
-		return nil, fmt.Errorf("Could not decrypt data: %w", err)
+		return nil, vaultDamaged("Could not decrypt data: %v", err)
 	}
 	return decryptedData, nil
 }
 
+// PassphraseParameters returns the Argon2id parameters data was encrypted with, so it can be
+// encrypted again the same way. Data encrypted with scrypt gets the defaults.
+func PassphraseParameters(data []byte) (Argon2idParameters, error) {
+	container, header, err := parseVaultContainer(data)
+	if err != nil {
+		return Argon2idParameters{}, err
+	}
+	if container != nil {
+		return header.argon2idParameters(), nil
+	}
+	blob := PassphraseEncryptedBlob{}
+	err = json.Unmarshal(data, &blob)
+	if err != nil {
+		return Argon2idParameters{}, fmt.Errorf("Could not unmarshal JSON into encrypted data: %w", err)
+	}
+	return blob.kdf().argon2idParameters(), nil
+}
+
 func EncryptFIDOState(savedState FIDODeviceConfig, passphrase string) ([]byte, error) {
-	stateBytes, err := json.Marshal(savedState)
+	return EncryptFIDOStateWithParameters(savedState, passphrase, DefaultArgon2idParameters())
+}
+
+func EncryptFIDOStateWithParameters(savedState FIDODeviceConfig, passphrase string, params Argon2idParameters) ([]byte, error) {
+	records, err := deviceConfigRecords(savedState)
 	if err != nil {
-		return nil, fmt.Errorf("Could not encode JSON: %w", err)
+		return nil, err
 	}
-	blob, err := EncryptWithPassphrase(passphrase, stateBytes)
+	data, err := encryptVault(records, passphrase, argon2idKDF(params))
 	if err != nil {
 		return nil, fmt.Errorf("Could not encrypt data: %w", err)
 	}
-	return blob, nil
+	return data, nil
 }
 
+// DecryptFIDOState reads vaults of every format up to VaultFormatVersion
 func DecryptFIDOState(data []byte, passphrase string) (*FIDODeviceConfig, error) {
+	container, header, err := parseVaultContainer(data)
+	if err != nil {
+		return nil, err
+	}
+	if container != nil {
+		records, err := decryptVault(container, header, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decrypt data: %w", err)
+		}
+		return deviceConfigFromRecords(records)
+	}
 	stateBytes, err := DecryptWithPassphrase(passphrase, data)
 	if err != nil {
 		return nil, fmt.Errorf("Could not decrypt data: %w", err)
@@ -106,7 +212,7 @@ func DecryptFIDOState(data []byte, passphrase string) (*FIDODeviceConfig, error)
 	state := FIDODeviceConfig{}
 	err = json.Unmarshal(stateBytes, &state)
 	if err != nil {
-		return nil, fmt.Errorf("Could not decode JSON: %w", err)
+		return nil, vaultDamaged("Could not decode JSON: %v", err)
 	}
 	return &state, nil
 }
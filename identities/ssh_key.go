@@ -0,0 +1,135 @@
+package identities
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+type SSHKeyType string
+
+const (
+	SSHKeyTypeECDSASK   SSHKeyType = "ecdsa-sk"
+	SSHKeyTypeEd25519SK SSHKeyType = "ed25519-sk"
+)
+
+const (
+	sshKeyAlgorithmECDSASK   = "sk-ecdsa-sha2-nistp256@openssh.com"
+	sshKeyAlgorithmEd25519SK = "sk-ssh-ed25519@openssh.com"
+)
+
+// Flags of an OpenSSH security key (PROTOCOL.u2f)
+const (
+	SSHKeyFlagUserPresence         byte = 0x01
+	SSHKeyFlagUserVerificationReqd byte = 0x04
+	SSHKeyFlagResident             byte = 0x20
+)
+
+// DefaultSSHApplication is the RP ID OpenSSH uses unless told otherwise. Applications must
+// start with "ssh:".
+const DefaultSSHApplication = "ssh:"
+
+// SSHKey is an OpenSSH security key backed by a credential. The private key file holds the
+// credential ID as the key handle, not a private key, so it's useless without the vault.
+type SSHKey struct {
+	// openssh-key-v1 PEM, unencrypted as ssh-keygen writes security keys without a passphrase
+	PrivateKey []byte
+	// authorized_keys line
+	PublicKey []byte
+}
+
+// SSHUserID is the user ID OpenSSH gives resident keys: the user name, zero padded to 32
+// bytes, or all zeros without one. A new key replaces a resident key with the same
+// application and user.
+func SSHUserID(user string) []byte {
+	id := make([]byte, 32)
+	copy(id, user)
+	return id
+}
+
+// ValidSSHApplication reports whether OpenSSH accepts application
+func ValidSSHApplication(application string) bool {
+	return strings.HasPrefix(application, DefaultSSHApplication)
+}
+
+// NewSSHKey encodes source as an OpenSSH security key, with its RP ID as the application
+func NewSSHKey(source *CredentialSource, flags byte, comment string) (*SSHKey, error) {
+	application := source.RelyingParty.ID
+	if !ValidSSHApplication(application) {
+		return nil, fmt.Errorf("SSH application %q doesn't start with %q", application, DefaultSSHApplication)
+	}
+	publicKey, err := sshPublicKeyBlob(source, application)
+	if err != nil {
+		return nil, err
+	}
+	checkInt := crypto.RandomBytes(4)
+	private := cryptobyte.NewBuilder(nil)
+	private.AddBytes(checkInt)
+	private.AddBytes(checkInt)
+	// A security key's private fields are its public ones followed by the key handle
+	private.AddBytes(publicKey)
+	private.AddUint8(flags)
+	addSSHString(private, source.ID)
+	// Reserved
+	addSSHString(private, nil)
+	addSSHString(private, []byte(comment))
+	for i := byte(1); len(private.BytesOrPanic())%8 != 0; i++ {
+		private.AddUint8(i)
+	}
+
+	file := cryptobyte.NewBuilder([]byte("openssh-key-v1\x00"))
+	addSSHString(file, []byte("none"))
+	addSSHString(file, []byte("none"))
+	addSSHString(file, nil)
+	file.AddUint32(1)
+	addSSHString(file, publicKey)
+	addSSHString(file, private.BytesOrPanic())
+	fileBytes, err := file.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode SSH private key: %w", err)
+	}
+	line := sshKeyAlgorithm(source) + " " + base64.StdEncoding.EncodeToString(publicKey)
+	if comment != "" {
+		line += " " + comment
+	}
+	return &SSHKey{
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: fileBytes}),
+		PublicKey:  []byte(line + "\n"),
+	}, nil
+}
+
+func sshKeyAlgorithm(source *CredentialSource) string {
+	if source.PrivateKey.Ed25519 != nil {
+		return sshKeyAlgorithmEd25519SK
+	}
+	return sshKeyAlgorithmECDSASK
+}
+
+// sshPublicKeyBlob encodes the key type, the key and the application
+func sshPublicKeyBlob(source *CredentialSource, application string) ([]byte, error) {
+	blob := cryptobyte.NewBuilder(nil)
+	switch {
+	case source.PrivateKey.ECDSA != nil:
+		addSSHString(blob, []byte(sshKeyAlgorithmECDSASK))
+		addSSHString(blob, []byte("nistp256"))
+		addSSHString(blob, crypto.EncodePublicKey(&source.PrivateKey.ECDSA.PublicKey))
+	case source.PrivateKey.Ed25519 != nil:
+		addSSHString(blob, []byte(sshKeyAlgorithmEd25519SK))
+		addSSHString(blob, source.PrivateKey.Ed25519.Public().(ed25519.PublicKey))
+	default:
+		return nil, fmt.Errorf("SSH security keys must be ECDSA P-256 or Ed25519")
+	}
+	addSSHString(blob, []byte(application))
+	return blob.Bytes()
+}
+
+func addSSHString(builder *cryptobyte.Builder, data []byte) {
+	builder.AddUint32LengthPrefixed(func(builder *cryptobyte.Builder) {
+		builder.AddBytes(data)
+	})
+}
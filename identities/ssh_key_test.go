@@ -0,0 +1,50 @@
+package identities
+
+import (
+	"bytes"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewSSHKey(t *testing.T) {
+	vault := NewIdentityVault()
+	source := vault.NewIdentity(
+		&webauthn.PublicKeyCredentialRPEntity{ID: DefaultSSHApplication, Name: DefaultSSHApplication},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: SSHUserID(""), Name: "openssh"})
+	key, err := NewSSHKey(source, SSHKeyFlagUserPresence|SSHKeyFlagResident, "me@example.com")
+	test.Assert(t, err == nil, "Could not encode SSH key")
+
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(key.PublicKey)
+	test.Assert(t, err == nil, "Public key should parse")
+	test.AssertEqual(t, publicKey.Type(), ssh.KeyAlgoSKECDSA256, "Key should be an sk-ecdsa key")
+	test.AssertEqual(t, comment, "me@example.com", "Comment should be kept")
+
+	// Sign as the authenticator does when ssh asks for an assertion
+	data := []byte("session data")
+	rest := []byte{0x01, 0x00, 0x00, 0x00, 0x07}
+	authData := append(crypto.HashSHA256([]byte(DefaultSSHApplication)), rest...)
+	r, s, err := crypto.ParseECDSASignature(source.PrivateKey.ECDSA.Curve, crypto.SignECDSA(source.PrivateKey.ECDSA, append(authData, crypto.HashSHA256(data)...)))
+	test.Assert(t, err == nil, "Could not parse signature")
+	signature := &ssh.Signature{
+		Format: ssh.KeyAlgoSKECDSA256,
+		Blob:   ssh.Marshal(struct{ R, S *big.Int }{r, s}),
+		Rest:   rest,
+	}
+	test.Assert(t, publicKey.Verify(data, signature) == nil, "Assertions should verify with the public key")
+
+	block, _ := pem.Decode(key.PrivateKey)
+	test.Assert(t, block != nil && block.Type == "OPENSSH PRIVATE KEY", "Private key should be OpenSSH PEM")
+	test.Assert(t, bytes.HasPrefix(block.Bytes, []byte("openssh-key-v1\x00")), "Private key should be openssh-key-v1")
+	test.Assert(t, bytes.Contains(block.Bytes, publicKey.Marshal()), "Private key should hold the public key")
+	test.Assert(t, bytes.Contains(block.Bytes, source.ID), "Private key should hold the credential ID as key handle")
+
+	source.RelyingParty = &webauthn.PublicKeyCredentialRPEntity{ID: "example.com"}
+	_, err = NewSSHKey(source, SSHKeyFlagUserPresence, "")
+	test.Assert(t, err != nil, "Applications must start with ssh:")
+}
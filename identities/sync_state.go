@@ -0,0 +1,139 @@
+package identities
+
+import (
+	"bytes"
+	"time"
+)
+
+// CredentialTombstone records a deleted credential, so a peer that still has it can't bring it
+// back on the next sync
+type CredentialTombstone struct {
+	ID        []byte    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// SyncPeer is another virtual-fido instance paired to mirror credentials with this one
+type SyncPeer struct {
+	Name         string    `json:"name"`
+	PublicKey    []byte    `json:"public_key"`
+	PairedAt     time.Time `json:"paired_at"`
+	LastSyncedAt time.Time `json:"last_synced_at,omitempty"`
+}
+
+// SavedSyncState is only present once sync has been used
+type SavedSyncState struct {
+	// Curve25519 key identifying this instance to its peers
+	PrivateKey []byte                `json:"private_key"`
+	Peers      []SyncPeer            `json:"peers,omitempty"`
+	Tombstones []CredentialTombstone `json:"tombstones,omitempty"`
+}
+
+// SyncSnapshot is the state one instance sends to another during a sync
+type SyncSnapshot struct {
+	Sources    []SavedCredentialSource `json:"sources"`
+	Tombstones []CredentialTombstone   `json:"tombstones,omitempty"`
+}
+
+func findTombstone(tombstones []CredentialTombstone, id []byte) *CredentialTombstone {
+	for i := range tombstones {
+		if bytes.Equal(tombstones[i].ID, id) {
+			return &tombstones[i]
+		}
+	}
+	return nil
+}
+
+func findSavedSource(sources []SavedCredentialSource, id []byte) *SavedCredentialSource {
+	for i := range sources {
+		if bytes.Equal(sources[i].ID, id) {
+			return &sources[i]
+		}
+	}
+	return nil
+}
+
+// moreRecent decides which copy of a credential the metadata is taken from. Every field is
+// compared, so both instances pick the same copy whichever side they're on.
+func moreRecent(a *SavedCredentialSource, b *SavedCredentialSource) bool {
+	if a.SignatureCounter != b.SignatureCounter {
+		return a.SignatureCounter > b.SignatureCounter
+	}
+	if a.UsageCount != b.UsageCount {
+		return a.UsageCount > b.UsageCount
+	}
+	if !a.LastUsedAt.Equal(b.LastUsedAt) {
+		return a.LastUsedAt.After(b.LastUsedAt)
+	}
+	if a.Nickname != b.Nickname {
+		return a.Nickname > b.Nickname
+	}
+	return bytes.Compare(a.CredBlob, b.CredBlob) > 0
+}
+
+func mergeSavedSource(a SavedCredentialSource, b SavedCredentialSource) SavedCredentialSource {
+	merged := b
+	if moreRecent(&a, &b) {
+		merged = a
+	}
+	// The counter never goes backwards, so an RP never sees a counter it has already seen
+	// from the copy that was used less
+	if a.SignatureCounter > merged.SignatureCounter {
+		merged.SignatureCounter = a.SignatureCounter
+	}
+	if b.SignatureCounter > merged.SignatureCounter {
+		merged.SignatureCounter = b.SignatureCounter
+	}
+	if a.UsageCount > merged.UsageCount {
+		merged.UsageCount = a.UsageCount
+	}
+	if b.UsageCount > merged.UsageCount {
+		merged.UsageCount = b.UsageCount
+	}
+	if a.LastUsedAt.After(merged.LastUsedAt) {
+		merged.LastUsedAt = a.LastUsedAt
+	}
+	if b.LastUsedAt.After(merged.LastUsedAt) {
+		merged.LastUsedAt = b.LastUsedAt
+	}
+	merged.BackupEligible = a.BackupEligible || b.BackupEligible
+	merged.BackedUp = a.BackedUp || b.BackedUp
+	if !a.CreatedAt.IsZero() && (merged.CreatedAt.IsZero() || a.CreatedAt.Before(merged.CreatedAt)) {
+		merged.CreatedAt = a.CreatedAt
+	}
+	if !b.CreatedAt.IsZero() && (merged.CreatedAt.IsZero() || b.CreatedAt.Before(merged.CreatedAt)) {
+		merged.CreatedAt = b.CreatedAt
+	}
+	return merged
+}
+
+// MergeSyncSnapshots combines the credentials of two instances. Credentials on either side are
+// kept unless either side deleted them, and the counters of a credential on both sides are
+// the highest of the two. Merging is symmetric, so both instances end up with the same vault.
+func MergeSyncSnapshots(local SyncSnapshot, remote SyncSnapshot) SyncSnapshot {
+	tombstones := make([]CredentialTombstone, 0, len(local.Tombstones)+len(remote.Tombstones))
+	for _, side := range []SyncSnapshot{local, remote} {
+		for _, tombstone := range side.Tombstones {
+			existing := findTombstone(tombstones, tombstone.ID)
+			if existing == nil {
+				tombstones = append(tombstones, tombstone)
+			} else if tombstone.DeletedAt.Before(existing.DeletedAt) {
+				existing.DeletedAt = tombstone.DeletedAt
+			}
+		}
+	}
+	sources := make([]SavedCredentialSource, 0, len(local.Sources)+len(remote.Sources))
+	for _, side := range []SyncSnapshot{local, remote} {
+		for _, source := range side.Sources {
+			if findTombstone(tombstones, source.ID) != nil {
+				continue
+			}
+			existing := findSavedSource(sources, source.ID)
+			if existing == nil {
+				sources = append(sources, source)
+			} else {
+				*existing = mergeSavedSource(*existing, source)
+			}
+		}
+	}
+	return SyncSnapshot{Sources: sources, Tombstones: tombstones}
+}
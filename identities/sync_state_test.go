@@ -0,0 +1,45 @@
+package identities
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestMergeSyncSnapshotsCounters(t *testing.T) {
+	now := time.Now().UTC()
+	laptop := SyncSnapshot{Sources: []SavedCredentialSource{
+		{ID: []byte("shared"), SignatureCounter: 5, UsageCount: 5, LastUsedAt: now, Nickname: "laptop"},
+		{ID: []byte("laptop")},
+	}}
+	server := SyncSnapshot{Sources: []SavedCredentialSource{
+		{ID: []byte("shared"), SignatureCounter: 7, UsageCount: 3, LastUsedAt: now.Add(-time.Hour), Nickname: "server"},
+		{ID: []byte("server")},
+	}}
+
+	merged := MergeSyncSnapshots(laptop, server)
+	test.AssertEqual(t, len(merged.Sources), 3, "Credentials from both sides should be kept")
+	shared := findSavedSource(merged.Sources, []byte("shared"))
+	test.AssertEqual(t, shared.SignatureCounter, int32(7), "Highest signature counter should win")
+	test.AssertEqual(t, shared.UsageCount, uint32(5), "Highest usage count should win")
+	test.Assert(t, shared.LastUsedAt.Equal(now), "Latest use should win")
+	test.AssertEqual(t, shared.Nickname, "server", "Metadata should come from the copy with the highest counter")
+
+	reversed := MergeSyncSnapshots(server, laptop)
+	test.Assert(t, reflect.DeepEqual(*findSavedSource(reversed.Sources, []byte("shared")), *shared), "Merging should be symmetric")
+}
+
+func TestMergeSyncSnapshotsTombstones(t *testing.T) {
+	laptop := SyncSnapshot{
+		Sources:    []SavedCredentialSource{{ID: []byte("kept")}},
+		Tombstones: []CredentialTombstone{{ID: []byte("deleted"), DeletedAt: time.Now().UTC()}},
+	}
+	server := SyncSnapshot{Sources: []SavedCredentialSource{{ID: []byte("kept")}, {ID: []byte("deleted")}}}
+
+	merged := MergeSyncSnapshots(server, laptop)
+	test.AssertEqual(t, len(merged.Sources), 1, "Deleted credentials should not come back")
+	test.AssertArrEqual(t, merged.Sources[0].ID, []byte("kept"), "Other credentials should be kept")
+	test.AssertEqual(t, len(merged.Tombstones), 1, "Tombstones should be kept for other peers")
+}
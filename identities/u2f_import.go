@@ -0,0 +1,183 @@
+package identities
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+type U2FImportFormat string
+
+const (
+	// JSON array of registrations dumped from SoftU2F's keychain items
+	U2FImportFormatSoftU2F U2FImportFormat = "softu2f"
+	// The secrets file written by the rust-u2f (softu2f for Linux) user daemon
+	U2FImportFormatRustU2F U2FImportFormat = "rust-u2f"
+	// canokey-virt derives U2F keys from a device master secret inside its
+	// littlefs image, so there are no per-credential keys to import
+	U2FImportFormatCanokey U2FImportFormat = "canokey-virt"
+)
+
+// SavedU2FKeyHandle is a U2F registration imported from another soft token. The
+// key handle is the foreign token's opaque handle, which we can't unseal ourselves.
+type SavedU2FKeyHandle struct {
+	KeyHandle     []byte `json:"key_handle"`
+	ApplicationID []byte `json:"application_id"`
+	PrivateKey    []byte `json:"private_key"`
+	Source        string `json:"source,omitempty"`
+}
+
+type softU2FRegistration struct {
+	KeyHandle            string `json:"keyHandle"`
+	ApplicationParameter string `json:"applicationParameter"`
+	PrivateKey           string `json:"privateKey"`
+	Counter              uint32 `json:"counter"`
+}
+
+type rustU2FApplicationKey struct {
+	Application string `json:"application"`
+	Handle      string `json:"handle"`
+	Key         string `json:"key"`
+}
+
+type rustU2FSecrets struct {
+	ApplicationKeys map[string]rustU2FApplicationKey `json:"application_keys"`
+	Counter         uint32                           `json:"counter"`
+}
+
+// ParseU2FExport converts credentials exported by another software token into
+// registrations for the vault, along with the highest counter the old token used
+func ParseU2FExport(format U2FImportFormat, data []byte) ([]SavedU2FKeyHandle, uint32, error) {
+	switch format {
+	case U2FImportFormatSoftU2F:
+		return parseSoftU2FExport(data)
+	case U2FImportFormatRustU2F:
+		return parseRustU2FExport(data)
+	case U2FImportFormatCanokey:
+		return nil, 0, fmt.Errorf("canokey-virt credentials are derived from the device master secret and cannot be imported individually")
+	default:
+		return nil, 0, fmt.Errorf("Unknown U2F import format: %q", format)
+	}
+}
+
+func parseSoftU2FExport(data []byte) ([]SavedU2FKeyHandle, uint32, error) {
+	registrations := []softU2FRegistration{}
+	err := json.Unmarshal(data, &registrations)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not decode SoftU2F export: %w", err)
+	}
+	var counter uint32 = 0
+	keys := make([]SavedU2FKeyHandle, 0)
+	for i, registration := range registrations {
+		key, err := newImportedU2FKey(registration.KeyHandle, registration.ApplicationParameter, registration.PrivateKey, U2FImportFormatSoftU2F)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Invalid SoftU2F registration %d: %w", i, err)
+		}
+		if registration.Counter > counter {
+			counter = registration.Counter
+		}
+		keys = append(keys, *key)
+	}
+	return keys, counter, nil
+}
+
+func parseRustU2FExport(data []byte) ([]SavedU2FKeyHandle, uint32, error) {
+	secrets := rustU2FSecrets{}
+	err := json.Unmarshal(data, &secrets)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not decode rust-u2f secrets: %w", err)
+	}
+	keys := make([]SavedU2FKeyHandle, 0)
+	for name, applicationKey := range secrets.ApplicationKeys {
+		application := applicationKey.Application
+		if application == "" {
+			application = name
+		}
+		key, err := newImportedU2FKey(applicationKey.Handle, application, applicationKey.Key, U2FImportFormatRustU2F)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Invalid rust-u2f key for %s: %w", name, err)
+		}
+		keys = append(keys, *key)
+	}
+	return keys, secrets.Counter, nil
+}
+
+func newImportedU2FKey(keyHandle string, application string, privateKey string, format U2FImportFormat) (*SavedU2FKeyHandle, error) {
+	keyHandleBytes, err := decodeExportedBytes(keyHandle)
+	if err != nil || len(keyHandleBytes) == 0 || len(keyHandleBytes) > 255 {
+		return nil, fmt.Errorf("Invalid key handle")
+	}
+	applicationBytes, err := decodeExportedBytes(application)
+	if err != nil || len(applicationBytes) != 32 {
+		return nil, fmt.Errorf("Invalid application parameter")
+	}
+	key, err := decodeExportedPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode private key: %w", err)
+	}
+	return &SavedU2FKeyHandle{
+		KeyHandle:     keyHandleBytes,
+		ApplicationID: applicationBytes,
+		PrivateKey:    keyBytes,
+		Source:        string(format),
+	}, nil
+}
+
+// Other tokens variously export binary fields as hex, base64 or base64url
+func decodeExportedBytes(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if decoded, err := hex.DecodeString(value); err == nil {
+		return decoded, nil
+	}
+	encodings := []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding}
+	for _, encoding := range encodings {
+		if decoded, err := encoding.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not decode %q as hex or base64", value)
+}
+
+// Accepts PEM, SEC1 or PKCS#8 DER, or a raw 32-byte P-256 scalar
+func decodeExportedPrivateKey(value string) (*ecdsa.PrivateKey, error) {
+	var keyBytes []byte
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		keyBytes = block.Bytes
+	} else {
+		decoded, err := decodeExportedBytes(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid private key encoding: %w", err)
+		}
+		keyBytes = decoded
+	}
+	if len(keyBytes) == 32 {
+		curve := elliptic.P256()
+		key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(keyBytes)}
+		key.Curve = curve
+		key.X, key.Y = curve.ScalarBaseMult(keyBytes)
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(keyBytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse private key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("Private key is not a P-256 ECDSA key")
+	}
+	return key, nil
+}
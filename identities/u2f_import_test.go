@@ -0,0 +1,51 @@
+package identities
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestParseSoftU2FExport(t *testing.T) {
+	privateKey := crypto.GenerateECDSAKey()
+	keyHandle := []byte{1, 2, 3, 4}
+	application := crypto.HashSHA256([]byte("https://example.com"))
+	data := fmt.Sprintf(`[{"keyHandle":"%s","applicationParameter":"%s","privateKey":"%s","counter":17}]`,
+		base64.RawURLEncoding.EncodeToString(keyHandle),
+		hex.EncodeToString(application),
+		base64.StdEncoding.EncodeToString(privateKey.D.FillBytes(make([]byte, 32))))
+	keys, counter, err := ParseU2FExport(U2FImportFormatSoftU2F, []byte(data))
+	test.Assert(t, err == nil, "Could not parse SoftU2F export")
+	test.AssertEqual(t, counter, uint32(17), "Counter not imported")
+	test.AssertEqual(t, len(keys), 1, "Wrong number of keys")
+	test.Assert(t, bytes.Equal(keys[0].KeyHandle, keyHandle), "Key handle not preserved")
+	test.Assert(t, bytes.Equal(keys[0].ApplicationID, application), "Application not preserved")
+	parsed, err := x509.ParseECPrivateKey(keys[0].PrivateKey)
+	test.Assert(t, err == nil, "Could not parse imported private key")
+	test.Assert(t, parsed.Equal(privateKey), "Private key not preserved")
+}
+
+func TestParseRustU2FExport(t *testing.T) {
+	privateKey := crypto.GenerateECDSAKey()
+	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	test.Assert(t, err == nil, "Could not marshal private key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	application := base64.StdEncoding.EncodeToString(crypto.HashSHA256([]byte("https://example.com")))
+	data := fmt.Sprintf(`{"application_keys":{"%s":{"application":"%s","handle":"%s","key":%q}},"counter":5}`,
+		application, application, base64.StdEncoding.EncodeToString([]byte{9, 8, 7}), string(keyPEM))
+	keys, counter, err := ParseU2FExport(U2FImportFormatRustU2F, []byte(data))
+	test.Assert(t, err == nil, "Could not parse rust-u2f export")
+	test.AssertEqual(t, counter, uint32(5), "Counter not imported")
+	test.AssertEqual(t, len(keys), 1, "Wrong number of keys")
+	test.Assert(t, bytes.Equal(keys[0].KeyHandle, []byte{9, 8, 7}), "Key handle not preserved")
+
+	_, _, err = ParseU2FExport(U2FImportFormatCanokey, []byte{})
+	test.Assert(t, err != nil, "canokey-virt import should be rejected")
+}
@@ -0,0 +1,99 @@
+package identities
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+const vaultExportFormat = "virtual-fido-vault"
+const vaultExportVersion uint32 = 1
+
+// The header fields are bound to the ciphertext as associated data, so
+// tampering with the version or KDF parameters fails decryption. Exports made with scrypt
+// encode the same as before, so they can still be imported.
+type vaultExportHeader struct {
+	Format  string `json:"format"`
+	Version uint32 `json:"version"`
+	passphraseKDF
+	Salt []byte `json:"salt"`
+}
+
+type VaultExportContainer struct {
+	vaultExportHeader
+	Nonce         []byte `json:"nonce"`
+	EncryptedData []byte `json:"encrypted_data"`
+}
+
+func (header vaultExportHeader) associatedData() []byte {
+	data, _ := json.Marshal(header)
+	return data
+}
+
+func ExportVault(state FIDODeviceConfig, passphrase string) ([]byte, error) {
+	return ExportVaultWithParameters(state, passphrase, DefaultArgon2idParameters())
+}
+
+func ExportVaultWithParameters(state FIDODeviceConfig, passphrase string, params Argon2idParameters) ([]byte, error) {
+	return exportVault(state, passphrase, argon2idKDF(params))
+}
+
+func exportVault(state FIDODeviceConfig, passphrase string, kdf passphraseKDF) ([]byte, error) {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode JSON: %w", err)
+	}
+	header := vaultExportHeader{
+		Format:        vaultExportFormat,
+		Version:       vaultExportVersion,
+		passphraseKDF: kdf,
+		Salt:          crypto.RandomBytes(16),
+	}
+	key, err := header.deriveKey(passphrase, header.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not derive export key: %w", err)
+	}
+	encryptedData, nonce, err := crypto.EncryptWithAssociatedData(key, stateBytes, header.associatedData())
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt vault: %w", err)
+	}
+	container := VaultExportContainer{
+		vaultExportHeader: header,
+		Nonce:             nonce,
+		EncryptedData:     encryptedData,
+	}
+	containerBytes, err := json.Marshal(container)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal JSON: %w", err)
+	}
+	return containerBytes, nil
+}
+
+func ImportVault(data []byte, passphrase string) (*FIDODeviceConfig, error) {
+	container := VaultExportContainer{}
+	err := json.Unmarshal(data, &container)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unmarshal vault export: %w", err)
+	}
+	if container.Format != vaultExportFormat {
+		return nil, fmt.Errorf("Unknown vault export format: %q", container.Format)
+	}
+	if container.Version != vaultExportVersion {
+		return nil, fmt.Errorf("Unsupported vault export version: %d", container.Version)
+	}
+	key, err := container.deriveKey(passphrase, container.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not derive export key: %w", err)
+	}
+	stateBytes, err := crypto.DecryptWithAssociatedData(key, container.EncryptedData, container.Nonce, container.vaultExportHeader.associatedData())
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt vault (wrong passphrase?): %w", err)
+	}
+	state := FIDODeviceConfig{}
+	err = json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode JSON: %w", err)
+	}
+	return &state, nil
+}
@@ -0,0 +1,53 @@
+package identities
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestExportImportVault(t *testing.T) {
+	vault := NewIdentityVault()
+	source := vault.NewIdentity(
+		&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"})
+	source.SignatureCounter = 12
+	pinRetries := int32(5)
+	state := FIDODeviceConfig{
+		EncryptionKey:         []byte{1, 2, 3},
+		AuthenticationCounter: 42,
+		PINEnabled:            true,
+		PINHash:               []byte{4, 5, 6},
+		PINRetries:            &pinRetries,
+		Sources:               vault.Export(),
+	}
+	exported, err := ExportVault(state, "passphrase")
+	test.Assert(t, err == nil, "Could not export vault")
+
+	_, err = ImportVault(exported, "wrong passphrase")
+	test.Assert(t, err != nil, "Vault imported with wrong passphrase")
+
+	imported, err := ImportVault(exported, "passphrase")
+	test.Assert(t, err == nil, "Could not import vault")
+	test.AssertEqual(t, imported.AuthenticationCounter, 42, "Authentication counter not preserved")
+	test.AssertEqual(t, *imported.PINRetries, 5, "PIN retries not preserved")
+	test.Assert(t, bytes.Equal(imported.PINHash, state.PINHash), "PIN hash not preserved")
+	test.AssertEqual(t, len(imported.Sources), 1, "Credential count not preserved")
+	test.AssertEqual(t, imported.Sources[0].SignatureCounter, 12, "Signature counter not preserved")
+	test.Assert(t, bytes.Equal(imported.Sources[0].PrivateKey, state.Sources[0].PrivateKey), "Private key not preserved")
+}
+
+func TestImportVaultRejectsTamperedHeader(t *testing.T) {
+	exported, err := ExportVault(FIDODeviceConfig{}, "passphrase")
+	test.Assert(t, err == nil, "Could not export vault")
+	container := VaultExportContainer{}
+	err = json.Unmarshal(exported, &container)
+	test.Assert(t, err == nil, "Could not decode container")
+	container.Argon2id.Time = 1
+	tampered, _ := json.Marshal(container)
+	_, err = ImportVault(tampered, "passphrase")
+	test.Assert(t, err != nil, "Tampered header was accepted")
+}
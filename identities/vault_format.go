@@ -0,0 +1,275 @@
+package identities
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+// Saved vaults are containers of records, each sealed on its own with a random data key
+// that's wrapped with a key derived from the passphrase. The header names the format
+// version, KDF and cipher suite, and is bound to the key and every record as associated
+// data, along with each record's position, so nothing can be changed, dropped or reordered
+// without the passphrase. Vaults saved before version 2 are a PassphraseEncryptedBlob,
+// which is still read and replaced on the next save.
+//
+// Readers refuse versions newer than VaultFormatVersion and keep records they don't know,
+// so that saving doesn't lose what a newer version added.
+const (
+	vaultFormat = "virtual-fido-vault-state"
+	// Vaults without a header
+	vaultFormatVersionLegacy uint32 = 1
+	VaultFormatVersion       uint32 = 2
+	// Sealed through the crypto.Provider, which uses AES-256-GCM unless replaced
+	VaultCipherAESGCM = "aes-256-gcm"
+)
+
+// A vault has one device record and a record for each credential. Keys sealed with
+// SealVaultKey have a single key record.
+const (
+	vaultRecordDevice     = "device"
+	vaultRecordCredential = "credential"
+	vaultRecordKey        = "key"
+)
+
+// ErrVaultDamaged is wrapped by errors reading a vault that's truncated or malformed, or fails
+// authentication although the passphrase is right
+var ErrVaultDamaged = errors.New("Vault is damaged")
+
+// ErrWrongPassphrase is wrapped when the vault key fails authentication, because the
+// passphrase is wrong or the key itself is damaged
+var ErrWrongPassphrase = errors.New("Wrong passphrase, or the vault key is damaged")
+
+func vaultDamaged(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrVaultDamaged, fmt.Sprintf(format, args...))
+}
+
+type vaultHeader struct {
+	Format  string `json:"format"`
+	Version uint32 `json:"version"`
+	passphraseKDF
+	Salt   []byte `json:"salt"`
+	Cipher string `json:"cipher"`
+}
+
+type vaultRecord struct {
+	Name          string `json:"name"`
+	Nonce         []byte `json:"nonce"`
+	EncryptedData []byte `json:"encrypted_data"`
+}
+
+type vaultContainer struct {
+	// Kept as saved, since it's authenticated byte for byte and newer versions may add fields
+	Header       json.RawMessage `json:"header"`
+	KeyNonce     []byte          `json:"key_nonce"`
+	EncryptedKey []byte          `json:"encrypted_key"`
+	Records      []vaultRecord   `json:"records"`
+}
+
+// VaultRecord is a decrypted record this version doesn't know, saved again as it was
+type VaultRecord struct {
+	Name string
+	Data []byte
+}
+
+func recordAssociatedData(header []byte, index int, count int, name string) []byte {
+	data := append(append([]byte{}, header...), 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(index))
+	data = binary.BigEndian.AppendUint32(data, uint32(count))
+	return append(data, name...)
+}
+
+// VaultFormatOf returns the format version of a saved vault
+func VaultFormatOf(data []byte) (uint32, error) {
+	container, header, err := parseVaultContainer(data)
+	if err != nil {
+		return 0, err
+	}
+	if container == nil {
+		return vaultFormatVersionLegacy, nil
+	}
+	return header.Version, nil
+}
+
+// parseVaultContainer returns a nil container for vaults without a header
+func parseVaultContainer(data []byte) (*vaultContainer, *vaultHeader, error) {
+	container := vaultContainer{}
+	err := json.Unmarshal(data, &container)
+	if err != nil {
+		return nil, nil, vaultDamaged("Could not unmarshal vault: %v", err)
+	}
+	if container.Header == nil {
+		return nil, nil, nil
+	}
+	header := vaultHeader{}
+	err = json.Unmarshal(container.Header, &header)
+	if err != nil {
+		return nil, nil, vaultDamaged("Could not unmarshal vault header: %v", err)
+	}
+	if header.Format != vaultFormat {
+		return nil, nil, fmt.Errorf("Unknown vault format: %q", header.Format)
+	}
+	if header.Version > VaultFormatVersion {
+		return nil, nil, fmt.Errorf("Vault format version %d is newer than the supported version %d", header.Version, VaultFormatVersion)
+	}
+	if header.Version < VaultFormatVersion {
+		return nil, nil, fmt.Errorf("Unsupported vault format version: %d", header.Version)
+	}
+	if header.Cipher != VaultCipherAESGCM {
+		return nil, nil, fmt.Errorf("Unsupported vault cipher: %q", header.Cipher)
+	}
+	return &container, &header, nil
+}
+
+func encryptVault(records []VaultRecord, passphrase string, kdf passphraseKDF) ([]byte, error) {
+	header := vaultHeader{
+		Format:        vaultFormat,
+		Version:       VaultFormatVersion,
+		passphraseKDF: kdf,
+		Salt:          crypto.RandomBytes(16),
+		Cipher:        VaultCipherAESGCM,
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal vault header: %w", err)
+	}
+	keyEncryptionKey, err := header.deriveKey(passphrase, header.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create key encryption key: %w", err)
+	}
+	encryptionKey := crypto.GenerateSymmetricKey()
+	encryptedKey, keyNonce, err := crypto.EncryptWithAssociatedData(keyEncryptionKey, encryptionKey, headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt key: %w", err)
+	}
+	container := vaultContainer{
+		Header:       headerBytes,
+		KeyNonce:     keyNonce,
+		EncryptedKey: encryptedKey,
+		Records:      make([]vaultRecord, len(records)),
+	}
+	for i, record := range records {
+		associatedData := recordAssociatedData(headerBytes, i, len(records), record.Name)
+		encryptedData, nonce, err := crypto.EncryptWithAssociatedData(encryptionKey, record.Data, associatedData)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encrypt %s record: %w", record.Name, err)
+		}
+		container.Records[i] = vaultRecord{Name: record.Name, Nonce: nonce, EncryptedData: encryptedData}
+	}
+	containerBytes, err := json.Marshal(container)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal JSON: %w", err)
+	}
+	return containerBytes, nil
+}
+
+func decryptVault(container *vaultContainer, header *vaultHeader, passphrase string) ([]VaultRecord, error) {
+	keyEncryptionKey, err := header.deriveKey(passphrase, header.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create key encryption key: %w", err)
+	}
+	encryptionKey, err := crypto.DecryptWithAssociatedData(keyEncryptionKey, container.EncryptedKey, container.KeyNonce, container.Header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrongPassphrase, err)
+	}
+	records := make([]VaultRecord, len(container.Records))
+	for i, record := range container.Records {
+		associatedData := recordAssociatedData(container.Header, i, len(container.Records), record.Name)
+		data, err := crypto.DecryptWithAssociatedData(encryptionKey, record.EncryptedData, record.Nonce, associatedData)
+		if err != nil {
+			return nil, vaultDamaged("Could not decrypt %s record %d: %v", record.Name, i, err)
+		}
+		records[i] = VaultRecord{Name: record.Name, Data: data}
+	}
+	return records, nil
+}
+
+func deviceConfigRecords(savedState FIDODeviceConfig) ([]VaultRecord, error) {
+	sources := savedState.Sources
+	savedState.Sources = nil
+	device, err := json.Marshal(savedState)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode JSON: %w", err)
+	}
+	records := []VaultRecord{{Name: vaultRecordDevice, Data: device}}
+	for _, source := range sources {
+		data, err := json.Marshal(source)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode JSON: %w", err)
+		}
+		records = append(records, VaultRecord{Name: vaultRecordCredential, Data: data})
+	}
+	return append(records, savedState.UnknownRecords...), nil
+}
+
+func deviceConfigFromRecords(records []VaultRecord) (*FIDODeviceConfig, error) {
+	var state *FIDODeviceConfig
+	sources := []SavedCredentialSource{}
+	unknown := []VaultRecord{}
+	for _, record := range records {
+		switch record.Name {
+		case vaultRecordDevice:
+			if state != nil {
+				return nil, vaultDamaged("Vault has more than one device record")
+			}
+			state = &FIDODeviceConfig{}
+			if err := json.Unmarshal(record.Data, state); err != nil {
+				return nil, vaultDamaged("Could not decode device record: %v", err)
+			}
+		case vaultRecordCredential:
+			source := SavedCredentialSource{}
+			if err := json.Unmarshal(record.Data, &source); err != nil {
+				return nil, vaultDamaged("Could not decode credential record: %v", err)
+			}
+			sources = append(sources, source)
+		default:
+			unknown = append(unknown, record)
+		}
+	}
+	if state == nil {
+		return nil, vaultDamaged("Vault has no device record")
+	}
+	state.Sources = sources
+	if len(unknown) > 0 {
+		state.UnknownRecords = unknown
+	}
+	return state, nil
+}
+
+// SealVaultKey wraps key with passphrase in the vault format, for stores that seal their
+// records with it
+func SealVaultKey(key []byte, passphrase string, params Argon2idParameters) ([]byte, error) {
+	return encryptVault([]VaultRecord{{Name: vaultRecordKey, Data: key}}, passphrase, argon2idKDF(params))
+}
+
+func OpenVaultKey(data []byte, passphrase string) ([]byte, error) {
+	container, header, err := parseVaultContainer(data)
+	if err != nil {
+		return nil, err
+	}
+	if container == nil {
+		return nil, fmt.Errorf("Sealed key has no header")
+	}
+	records, err := decryptVault(container, header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Name == vaultRecordKey {
+			return record.Data, nil
+		}
+	}
+	return nil, fmt.Errorf("Sealed key has no key record")
+}
+
+// ChangeVaultPassphrase encrypts a saved vault again with newPassphrase, in the current format
+func ChangeVaultPassphrase(data []byte, passphrase string, newPassphrase string, params Argon2idParameters) ([]byte, error) {
+	state, err := DecryptFIDOState(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptFIDOStateWithParameters(*state, newPassphrase, params)
+}
@@ -0,0 +1,137 @@
+package identities
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+var testVaultParameters = Argon2idParameters{Time: 1, Memory: 64, Threads: 1}
+
+func testVaultState() FIDODeviceConfig {
+	return FIDODeviceConfig{
+		AuthenticationCounter: 7,
+		SerialNumber:          "0123456789ABCDEF",
+		Sources: []SavedCredentialSource{
+			{Type: "public-key", ID: []byte{1}, Nickname: "first"},
+			{Type: "public-key", ID: []byte{2}, Nickname: "second"},
+		},
+	}
+}
+
+func decodeVaultContainer(t *testing.T, data []byte) vaultContainer {
+	container := vaultContainer{}
+	err := json.Unmarshal(data, &container)
+	test.Assert(t, err == nil, "Could not decode container")
+	return container
+}
+
+func TestVaultFormatRoundTrip(t *testing.T) {
+	data, err := EncryptFIDOStateWithParameters(testVaultState(), "passphrase", testVaultParameters)
+	test.Assert(t, err == nil, "Could not encrypt vault")
+	version, err := VaultFormatOf(data)
+	test.Assert(t, err == nil, "Could not read format")
+	test.AssertEqual(t, version, VaultFormatVersion, "Vaults should be saved in the current format")
+	test.AssertEqual(t, len(decodeVaultContainer(t, data).Records), 3, "Vault should have a device record and one per credential")
+	params, err := PassphraseParameters(data)
+	test.Assert(t, err == nil, "Could not read parameters")
+	test.AssertEqual(t, params, testVaultParameters, "Header should hold the KDF parameters")
+
+	state, err := DecryptFIDOState(data, "passphrase")
+	test.Assert(t, err == nil, "Could not decrypt vault")
+	test.AssertEqual(t, state.AuthenticationCounter, uint32(7), "Device record should round trip")
+	test.AssertEqual(t, len(state.Sources), 2, "Credentials should round trip")
+	test.AssertEqual(t, state.Sources[1].Nickname, "second", "Credentials should keep their order")
+	_, err = DecryptFIDOState(data, "wrong")
+	test.Assert(t, errors.Is(err, ErrWrongPassphrase), "Wrong passphrase should fail")
+	_, err = DecryptFIDOState(data[:len(data)/2], "passphrase")
+	test.Assert(t, errors.Is(err, ErrVaultDamaged), "Truncated vault should be reported as damaged")
+}
+
+func TestLegacyVaultMigration(t *testing.T) {
+	stateBytes, _ := json.Marshal(testVaultState())
+	legacy, err := encryptWithPassphraseKDF("passphrase", stateBytes, scryptKDF(ScryptParameters{N: 1024, R: 8, P: 1}))
+	test.Assert(t, err == nil, "Could not encrypt legacy vault")
+	version, _ := VaultFormatOf(legacy)
+	test.AssertEqual(t, version, vaultFormatVersionLegacy, "Blobs should be read as the legacy format")
+
+	state, err := DecryptFIDOState(legacy, "passphrase")
+	test.Assert(t, err == nil, "Could not decrypt legacy vault")
+	test.AssertEqual(t, len(state.Sources), 2, "Legacy credentials should be read")
+	migrated, err := ChangeVaultPassphrase(legacy, "passphrase", "new", testVaultParameters)
+	test.Assert(t, err == nil, "Could not change passphrase")
+	version, _ = VaultFormatOf(migrated)
+	test.AssertEqual(t, version, VaultFormatVersion, "Saving should migrate to the current format")
+	params, _ := PassphraseParameters(migrated)
+	test.AssertEqual(t, params, testVaultParameters, "Saving should migrate to Argon2id")
+	state, err = DecryptFIDOState(migrated, "new")
+	test.Assert(t, err == nil, "Could not decrypt migrated vault")
+	test.AssertEqual(t, state.SerialNumber, "0123456789ABCDEF", "Migration should keep the device state")
+}
+
+func TestVaultTampering(t *testing.T) {
+	data, _ := EncryptFIDOStateWithParameters(testVaultState(), "passphrase", testVaultParameters)
+	tamper := func(change func(container *vaultContainer)) []byte {
+		container := decodeVaultContainer(t, data)
+		change(&container)
+		tampered, _ := json.Marshal(container)
+		return tampered
+	}
+
+	headerChanged := tamper(func(container *vaultContainer) {
+		header := vaultHeader{}
+		json.Unmarshal(container.Header, &header)
+		header.Argon2id.Time = 2
+		container.Header, _ = json.Marshal(header)
+	})
+	_, err := DecryptFIDOState(headerChanged, "passphrase")
+	test.Assert(t, err != nil, "Changed header should fail to decrypt")
+	dropped := tamper(func(container *vaultContainer) {
+		container.Records = container.Records[:2]
+	})
+	_, err = DecryptFIDOState(dropped, "passphrase")
+	test.Assert(t, errors.Is(err, ErrVaultDamaged), "Dropped record should fail to decrypt")
+	swapped := tamper(func(container *vaultContainer) {
+		container.Records[1], container.Records[2] = container.Records[2], container.Records[1]
+	})
+	_, err = DecryptFIDOState(swapped, "passphrase")
+	test.Assert(t, err != nil, "Reordered records should fail to decrypt")
+	renamed := tamper(func(container *vaultContainer) {
+		container.Records[1].Name = "other"
+	})
+	_, err = DecryptFIDOState(renamed, "passphrase")
+	test.Assert(t, err != nil, "Renamed record should fail to decrypt")
+}
+
+func TestNewerVaultFormat(t *testing.T) {
+	header, _ := json.Marshal(vaultHeader{Format: vaultFormat, Version: VaultFormatVersion + 1, Cipher: VaultCipherAESGCM})
+	newer, _ := json.Marshal(vaultContainer{Header: header})
+	_, err := DecryptFIDOState(newer, "passphrase")
+	test.Assert(t, err != nil, "Newer formats should be refused")
+	_, err = PassphraseParameters(newer)
+	test.Assert(t, err != nil, "Newer formats should be refused")
+
+	header, _ = json.Marshal(vaultHeader{Format: vaultFormat, Version: VaultFormatVersion, Cipher: "chacha20-poly1305"})
+	unknownCipher, _ := json.Marshal(vaultContainer{Header: header})
+	_, err = DecryptFIDOState(unknownCipher, "passphrase")
+	test.Assert(t, err != nil, "Unknown ciphers should be refused")
+}
+
+func TestUnknownVaultRecordsKept(t *testing.T) {
+	state := testVaultState()
+	records, _ := deviceConfigRecords(state)
+	records = append(records, VaultRecord{Name: "future", Data: []byte("data")})
+	data, err := encryptVault(records, "passphrase", argon2idKDF(testVaultParameters))
+	test.Assert(t, err == nil, "Could not encrypt vault")
+
+	decrypted, err := DecryptFIDOState(data, "passphrase")
+	test.Assert(t, err == nil, "Unknown records should be skipped")
+	test.AssertEqual(t, len(decrypted.UnknownRecords), 1, "Unknown records should be kept")
+	saved, _ := EncryptFIDOStateWithParameters(*decrypted, "passphrase", testVaultParameters)
+	decrypted, err = DecryptFIDOState(saved, "passphrase")
+	test.Assert(t, err == nil, "Could not decrypt saved vault")
+	test.AssertEqual(t, len(decrypted.UnknownRecords), 1, "Unknown records should be saved again")
+	test.AssertEqual(t, string(decrypted.UnknownRecords[0].Data), "data", "Unknown records should be saved as they were")
+}
@@ -0,0 +1,222 @@
+// Package inspector streams decoded CTAPHID traffic and device events to browsers over a
+// WebSocket, so protocol flows can be watched live while debugging WebAuthn integrations
+package inspector
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var inspectorLogger = util.NewLogger("[INSPECTOR] ", util.LogSubsystemInspector, util.LogLevelDebug)
+
+type MessageKind string
+
+const (
+	// A CTAPHID message with its decoded request and response, or a raw packet
+	MessageSession MessageKind = "session"
+	// A device event, like a credential being created
+	MessageEvent MessageKind = "event"
+)
+
+// Message is sent as one JSON text message per session or device event
+type Message struct {
+	Kind    MessageKind            `json:"kind"`
+	Session *ctap_hid.SessionEvent `json:"session,omitempty"`
+	Event   *events.Event          `json:"event,omitempty"`
+}
+
+// Messages buffered for each browser. Messages for a browser that isn't keeping up are
+// dropped, so streaming never slows the device down.
+const clientBuffer = 256
+
+type client struct {
+	messages chan []byte
+	// Whether the browser asked for raw packets as well as messages
+	packets bool
+}
+
+// Server streams to every browser connected to its Handler
+type Server struct {
+	// Browsers can't set headers on WebSockets, so the token is passed as ?token=. Without
+	// it, any page open in the browser could read the traffic. It must not be empty.
+	Token   string
+	lock    sync.Mutex
+	clients map[*client]bool
+}
+
+func NewServer(token string) *Server {
+	return &Server{Token: token, clients: make(map[*client]bool)}
+}
+
+// PublishSession streams a session event. It can be passed to SessionRecorder.OnEvent.
+func (server *Server) PublishSession(event ctap_hid.SessionEvent) {
+	server.publish(Message{Kind: MessageSession, Session: &event}, event.Type != ctap_hid.SessionEventMessage)
+}
+
+func (server *Server) PublishEvent(event events.Event) {
+	server.publish(Message{Kind: MessageEvent, Event: &event}, false)
+}
+
+// Forward streams the events of subscription until it's unsubscribed
+func (server *Server) Forward(subscription *events.Subscription) {
+	for event := range subscription.Events() {
+		server.PublishEvent(event)
+	}
+}
+
+func (server *Server) publish(message Message, packet bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.clients) == 0 {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		inspectorLogger.Printf("ERROR: Could not encode message: %s\n\n", err)
+		return
+	}
+	for c := range server.clients {
+		if packet && !c.packets {
+			continue
+		}
+		select {
+		case c.messages <- data:
+		default:
+		}
+	}
+}
+
+func (server *Server) addClient(c *client) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.clients[c] = true
+}
+
+func (server *Server) removeClient(c *client) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	delete(server.clients, c)
+}
+
+// Handler serves:
+//
+//	GET /                                   a page that shows the stream
+//	GET /events?token=...[&packets=true]    the WebSocket stream of Messages
+func (server *Server) Handler() http.Handler {
+	return http.HandlerFunc(server.serveHTTP)
+}
+
+func (server *Server) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	return server.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(server.Token)) == 1
+}
+
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	route := strings.Trim(r.URL.Path, "/")
+	switch {
+	case route == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(inspectorPage))
+	case route == "events":
+		if !server.authorized(r) {
+			http.Error(w, "Invalid inspector token", http.StatusUnauthorized)
+			return
+		}
+		server.stream(w, r)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (server *Server) stream(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ws.close()
+	c := &client{messages: make(chan []byte, clientBuffer), packets: r.URL.Query().Get("packets") == "true"}
+	server.addClient(c)
+	defer server.removeClient(c)
+	closed := make(chan struct{})
+	go func() {
+		ws.readUntilClosed()
+		close(closed)
+	}()
+	inspectorLogger.Printf("Inspector connected from %s\n\n", r.RemoteAddr)
+	for {
+		select {
+		case data := <-c.messages:
+			if err := ws.writeFrame(opcodeText, data); err != nil {
+				inspectorLogger.Printf("Could not write to inspector: %s\n\n", err)
+				return
+			}
+		case <-closed:
+			inspectorLogger.Printf("Inspector disconnected from %s\n\n", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+// inspectorPage lists each CTAPHID message and device event as it arrives, with its decoded
+// request and response
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>virtual-fido inspector</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+details { border-bottom: 1px solid #ddd; padding: 0.3em 0; }
+summary { cursor: pointer; font-family: monospace; }
+pre { background: #f5f5f5; padding: 0.5em; overflow-x: auto; }
+#status { color: #888; }
+</style>
+</head>
+<body>
+<h1>virtual-fido inspector</h1>
+<p id="status">Connecting...</p>
+<div id="messages"></div>
+<script>
+const params = new URLSearchParams(location.search);
+const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+const socket = new WebSocket(scheme + "//" + location.host + "/events?" + params.toString());
+const status = document.getElementById("status");
+const messages = document.getElementById("messages");
+socket.onopen = () => { status.textContent = "Connected"; };
+socket.onclose = () => { status.textContent = "Disconnected (is ?token= set?)"; };
+socket.onmessage = (message) => {
+	const data = JSON.parse(message.data);
+	const item = document.createElement("details");
+	const summary = document.createElement("summary");
+	if (data.kind === "session") {
+		const s = data.session;
+		let text = s.time + " " + s.type;
+		if (s.type === "message") {
+			text += " channel " + s.channel_id.toString(16) + " " + s.command;
+			if (s.decoded_request) { text += " request 0x" + s.decoded_request.code.toString(16); }
+			if (s.decoded_response) { text += " status 0x" + s.decoded_response.code.toString(16); }
+		}
+		if (s.trace_id) { text += " trace " + s.trace_id; }
+		summary.textContent = text;
+	} else {
+		let text = data.event.time + " event " + data.event.type;
+		if (data.event.trace_id) { text += " trace " + data.event.trace_id; }
+		summary.textContent = text;
+	}
+	const body = document.createElement("pre");
+	body.textContent = JSON.stringify(data.session || data.event, null, 2);
+	item.append(summary, body);
+	messages.prepend(item);
+};
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,133 @@
+package inspector
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	test.AssertEqual(t, websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", "Accept key should match the RFC")
+}
+
+// dialStream does the client side of the handshake and returns the connection
+func dialStream(t *testing.T, server *httptest.Server, query string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	test.Assert(t, err == nil, "Could not connect")
+	handshake := "GET /events?" + query + " HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	_, err = conn.Write([]byte(handshake))
+	test.Assert(t, err == nil, "Could not send handshake")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	test.Assert(t, err == nil, "Could not read handshake response")
+	test.AssertEqual(t, response.StatusCode, http.StatusSwitchingProtocols, "Handshake should switch protocols")
+	test.AssertEqual(t, response.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", "Handshake should accept the key")
+	return conn, reader
+}
+
+func readMessage(t *testing.T, conn net.Conn, reader *bufio.Reader) Message {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	test.Assert(t, err == nil, "Could not read frame")
+	test.AssertEqual(t, header[0], 0x80|opcodeText, "Messages should be single text frames")
+	test.AssertEqual(t, header[1]&0x80, byte(0), "Server frames should not be masked")
+	length := int(header[1])
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(reader, extended)
+		length = int(extended[0])<<8 | int(extended[1])
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	test.Assert(t, err == nil, "Could not read frame payload")
+	var message Message
+	test.Assert(t, json.Unmarshal(payload, &message) == nil, "Message should be JSON")
+	return message
+}
+
+// waitForClients waits until the stream is registered, since it's added after the handshake
+func waitForClients(server *Server, count int) {
+	for i := 0; i < 100; i++ {
+		server.lock.Lock()
+		clients := len(server.clients)
+		server.lock.Unlock()
+		if clients == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInspectorStream(t *testing.T) {
+	inspector := NewServer("token")
+	server := httptest.NewServer(inspector.Handler())
+	defer server.Close()
+
+	conn, reader := dialStream(t, server, "token=token")
+	defer conn.Close()
+	waitForClients(inspector, 1)
+
+	inspector.PublishSession(ctap_hid.SessionEvent{Type: ctap_hid.SessionEventPacketOut, Packet: []byte{1, 2, 3}})
+	inspector.PublishSession(ctap_hid.SessionEvent{
+		Type:            ctap_hid.SessionEventMessage,
+		ChannelID:       0x01020304,
+		Command:         "CTAPHID_CBOR",
+		DecodedRequest:  map[string]interface{}{"code": 4},
+		DecodedResponse: map[string]interface{}{"code": 0},
+	})
+	inspector.PublishEvent(events.Event{Type: events.EventCredentialCreated, RelyingPartyID: "example.com"})
+
+	message := readMessage(t, conn, reader)
+	test.AssertEqual(t, message.Kind, MessageSession, "First message should be the session message, without the packet")
+	test.AssertEqual(t, message.Session.Command, "CTAPHID_CBOR", "Command should be streamed")
+	test.AssertEqual(t, message.Session.ChannelID, uint32(0x01020304), "Channel should be streamed")
+	message = readMessage(t, conn, reader)
+	test.AssertEqual(t, message.Kind, MessageEvent, "Device events should be streamed")
+	test.AssertEqual(t, message.Event.RelyingPartyID, "example.com", "Event should be streamed")
+
+	packets, packetReader := dialStream(t, server, "token=token&packets=true")
+	defer packets.Close()
+	waitForClients(inspector, 2)
+	inspector.PublishSession(ctap_hid.SessionEvent{Type: ctap_hid.SessionEventPacketIn, Packet: make([]byte, 200)})
+	message = readMessage(t, packets, packetReader)
+	test.AssertEqual(t, message.Session.Type, ctap_hid.SessionEventPacketIn, "Packets should be streamed when asked for")
+	test.AssertEqual(t, len(message.Session.Packet), 200, "Packet should be streamed whole")
+
+	// Masked close frame from the client
+	conn.Write([]byte{0x80 | opcodeClose, 0x80, 1, 2, 3, 4})
+	waitForClients(inspector, 1)
+	inspector.lock.Lock()
+	defer inspector.lock.Unlock()
+	test.AssertEqual(t, len(inspector.clients), 1, "Closed stream should be removed")
+}
+
+func TestInspectorToken(t *testing.T) {
+	server := httptest.NewServer(NewServer("token").Handler())
+	defer server.Close()
+	response, err := http.Get(server.URL + "/events?token=wrong")
+	test.Assert(t, err == nil, "Could not request stream")
+	test.AssertEqual(t, response.StatusCode, http.StatusUnauthorized, "Wrong token should be rejected")
+
+	server = httptest.NewServer(NewServer("").Handler())
+	defer server.Close()
+	response, err = http.Get(server.URL + "/events?token=")
+	test.Assert(t, err == nil, "Could not request stream")
+	test.AssertEqual(t, response.StatusCode, http.StatusUnauthorized, "An empty token should never be accepted")
+}
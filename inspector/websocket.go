@@ -0,0 +1,174 @@
+package inspector
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Appended to the client's key to prove the server speaks WebSocket (RFC 6455 section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opcodeText  byte = 0x1
+	opcodeClose byte = 0x8
+	opcodePing  byte = 0x9
+	opcodePong  byte = 0xA
+)
+
+// Browsers only send pings and close frames on this stream, so anything bigger is an error
+const maxClientFrameLength = 4096
+
+const writeTimeout = 10 * time.Second
+
+// websocketConn is the server side of RFC 6455, enough to push text messages to a browser.
+// Frames from the client are only read to answer pings and notice it closing.
+type websocketConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("Not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("Unsupported WebSocket version: %s", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return nil, fmt.Errorf("Invalid WebSocket key: %s", key)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("Connection can't be upgraded")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("Could not take over connection: %w", err)
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := buffered.WriteString(response); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Could not write handshake: %w", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Could not write handshake: %w", err)
+	}
+	return &websocketConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+// writeFrame sends payload as a single unmasked frame, as servers must
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// readFrame returns the opcode and unmasked payload of the next frame from the client
+func (ws *websocketConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("Client frames must be masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > maxClientFrameLength {
+		return 0, nil, fmt.Errorf("Client frame too long: %d bytes", length)
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readUntilClosed answers pings until the client closes the connection or it fails
+func (ws *websocketConn) readUntilClosed() {
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opcodePing:
+			if ws.writeFrame(opcodePong, payload) != nil {
+				return
+			}
+		case opcodeClose:
+			return
+		}
+	}
+}
+
+func (ws *websocketConn) close() {
+	ws.writeFrame(opcodeClose, nil)
+	ws.conn.Close()
+}
@@ -0,0 +1,32 @@
+// Package filelock takes advisory locks on files, so processes sharing a file can take
+// turns updating it. Other programs only respect them if they lock the file too.
+package filelock
+
+import (
+	"fmt"
+	"os"
+)
+
+type Lock struct {
+	file *os.File
+}
+
+// Acquire waits for a lock on filename, which is created if it doesn't exist. Any number of
+// shared locks can be held at once, but an exclusive lock only on its own.
+func Acquire(filename string, exclusive bool) (*Lock, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open lock file: %w", err)
+	}
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Could not lock %s: %w", filename, err)
+	}
+	return &Lock{file: file}, nil
+}
+
+func (lock *Lock) Release() error {
+	err := unlockFile(lock.file)
+	lock.file.Close()
+	return err
+}
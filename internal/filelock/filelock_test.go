@@ -0,0 +1,45 @@
+package filelock
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+// acquired reports whether Acquire returns within a short wait
+func acquired(filename string, exclusive bool) (chan *Lock, bool) {
+	locks := make(chan *Lock, 1)
+	go func() {
+		lock, err := Acquire(filename, exclusive)
+		if err == nil {
+			locks <- lock
+		}
+	}()
+	select {
+	case lock := <-locks:
+		locks <- lock
+		return locks, true
+	case <-time.After(50 * time.Millisecond):
+		return locks, false
+	}
+}
+
+func TestLocks(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "vault.lock")
+	shared, err := Acquire(filename, false)
+	test.Assert(t, err == nil, "Could not take shared lock")
+	other, ok := acquired(filename, false)
+	test.Assert(t, ok, "Shared locks should be held together")
+	(<-other).Release()
+
+	waiting, ok := acquired(filename, true)
+	test.Assert(t, !ok, "Exclusive lock should wait for the shared lock")
+	shared.Release()
+	exclusive := <-waiting
+	waiting, ok = acquired(filename, false)
+	test.Assert(t, !ok, "Shared lock should wait for the exclusive lock")
+	exclusive.Release()
+	(<-waiting).Release()
+}
@@ -0,0 +1,622 @@
+// Package verifier checks CTAP2 registration and assertion responses the way a WebAuthn
+// relying party does. It's written from the WebAuthn Level 2 and CTAP 2.1 specs and only
+// uses the standard library and the CBOR decoder, not the rest of this module, so an
+// encoding bug in the authenticator can't be hidden by the same bug in its own checks.
+package verifier
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	FlagUserPresent    = byte(0x01)
+	FlagUserVerified   = byte(0x04)
+	FlagBackupEligible = byte(0x08)
+	FlagBackedUp       = byte(0x10)
+	FlagAttestedData   = byte(0x40)
+	FlagExtensions     = byte(0x80)
+)
+
+const (
+	algorithmES256 = -7
+	algorithmEdDSA = -8
+)
+
+// id-fido-gen-ce-aaguid, which must match the AAGUID in the authenticator data if present
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Extension holding the nonce of the apple attestation format
+var oidAppleNonce = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 2}
+
+// KeyDescription extension of android-key attestation certificates
+var oidAndroidKeyDescription = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 17}
+
+var decMode cbor.DecMode
+var canonicalEncMode cbor.EncMode
+
+func init() {
+	var err error
+	decMode, err = cbor.DecOptions{
+		DupMapKey:   cbor.DupMapKeyEnforcedAPF,
+		IndefLength: cbor.IndefLengthForbidden,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	// CTAP 2.1 section 8 sorts map keys by major type, then length, then bytes, which is
+	// the canonical CBOR of RFC 7049
+	canonicalEncMode, err = cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Credential is what a relying party stores after a registration
+type Credential struct {
+	ID        []byte
+	PublicKey crypto.PublicKey
+	Algorithm int
+	SignCount uint32
+}
+
+// AuthenticatorData is the authenticator data of WebAuthn section 6.1
+type AuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// Attested credential data, only in registrations
+	AAGUID              []byte
+	CredentialID        []byte
+	CredentialPublicKey []byte
+	// Encoded extension outputs, if any
+	Extensions []byte
+}
+
+// checkCanonical fails if data isn't exactly one item of CTAP2 canonical CBOR
+func checkCanonical(data []byte) error {
+	raw, rest, err := decodeFirst(data)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%d bytes after the CBOR item", len(rest))
+	}
+	var item interface{}
+	if err := decMode.Unmarshal(raw, &item); err != nil {
+		return fmt.Errorf("Invalid CBOR: %w", err)
+	}
+	encoded, err := canonicalEncMode.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("Could not encode CBOR: %w", err)
+	}
+	if !bytes.Equal(encoded, data) {
+		return fmt.Errorf("CBOR is not canonical: got %x, expected %x", data, encoded)
+	}
+	return nil
+}
+
+// decodeFirst decodes the first CBOR item in data and returns it with the rest of data
+func decodeFirst(data []byte) ([]byte, []byte, error) {
+	decoder := decMode.NewDecoder(bytes.NewReader(data))
+	var raw cbor.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("Invalid CBOR: %w", err)
+	}
+	return raw, data[decoder.NumBytesRead():], nil
+}
+
+// ParseAuthenticatorData checks the layout of data, including that nothing follows the
+// attested credential data and extensions the flags announce
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("Authenticator data is %d bytes, less than 37", len(data))
+	}
+	authData := &AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+	if authData.Flags&FlagBackedUp != 0 && authData.Flags&FlagBackupEligible == 0 {
+		return nil, fmt.Errorf("Backed up flag is set without backup eligible")
+	}
+	if authData.Flags&FlagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("Attested credential data is truncated")
+		}
+		authData.AAGUID = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > 1023 || len(rest) < idLength {
+			return nil, fmt.Errorf("Invalid credential ID length %d", idLength)
+		}
+		authData.CredentialID = rest[:idLength]
+		key, remaining, err := decodeFirst(rest[idLength:])
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode credential public key: %w", err)
+		}
+		if err := checkCanonical(key); err != nil {
+			return nil, fmt.Errorf("Credential public key: %w", err)
+		}
+		authData.CredentialPublicKey = key
+		rest = remaining
+	}
+	if authData.Flags&FlagExtensions != 0 {
+		extensions, remaining, err := decodeFirst(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode extensions: %w", err)
+		}
+		if err := checkCanonical(extensions); err != nil {
+			return nil, fmt.Errorf("Extensions: %w", err)
+		}
+		var outputs map[string]cbor.RawMessage
+		if err := decMode.Unmarshal(extensions, &outputs); err != nil {
+			return nil, fmt.Errorf("Extensions are not a map: %w", err)
+		}
+		authData.Extensions = extensions
+		rest = remaining
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes after authenticator data", len(rest))
+	}
+	return authData, nil
+}
+
+func (authData *AuthenticatorData) check(rpID string) error {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return fmt.Errorf("RP ID hash does not match %s", rpID)
+	}
+	if authData.Flags&FlagUserVerified != 0 && authData.Flags&FlagUserPresent == 0 {
+		return fmt.Errorf("User verified without being present")
+	}
+	return nil
+}
+
+// coseKey has the parameters of the EC2 and OKP key types in RFC 8152 section 13
+type coseKey struct {
+	KeyType   int    `cbor:"1,keyasint"`
+	Algorithm int    `cbor:"3,keyasint"`
+	Curve     int    `cbor:"-1,keyasint"`
+	X         []byte `cbor:"-2,keyasint"`
+	Y         []byte `cbor:"-3,keyasint"`
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, int, error) {
+	var key coseKey
+	if err := decMode.Unmarshal(data, &key); err != nil {
+		return nil, 0, fmt.Errorf("Invalid COSE key: %w", err)
+	}
+	switch {
+	case key.KeyType == 2 && key.Algorithm == algorithmES256 && key.Curve == 1:
+		// Coordinates are fixed length, without leading zeros removed (RFC 8152 section 13.1.1)
+		if len(key.X) != 32 || len(key.Y) != 32 {
+			return nil, 0, fmt.Errorf("P-256 coordinates are %d and %d bytes, not 32", len(key.X), len(key.Y))
+		}
+		x := new(big.Int).SetBytes(key.X)
+		y := new(big.Int).SetBytes(key.Y)
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, 0, fmt.Errorf("Public key is not on P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, key.Algorithm, nil
+	case key.KeyType == 1 && key.Algorithm == algorithmEdDSA && key.Curve == 6:
+		if len(key.X) != ed25519.PublicKeySize {
+			return nil, 0, fmt.Errorf("Ed25519 key is %d bytes", len(key.X))
+		}
+		return ed25519.PublicKey(key.X), key.Algorithm, nil
+	default:
+		return nil, 0, fmt.Errorf("Unsupported COSE key type %d, algorithm %d, curve %d", key.KeyType, key.Algorithm, key.Curve)
+	}
+}
+
+func verifySignature(key crypto.PublicKey, algorithm int, data []byte, signature []byte) error {
+	switch algorithm {
+	case algorithmES256:
+		ecdsaKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("ES256 signature with a %T key", key)
+		}
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(ecdsaKey, digest[:], signature) {
+			return fmt.Errorf("ES256 signature does not verify")
+		}
+	case algorithmEdDSA:
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("EdDSA signature with a %T key", key)
+		}
+		if !ed25519.Verify(edKey, data, signature) {
+			return fmt.Errorf("EdDSA signature does not verify")
+		}
+	default:
+		return fmt.Errorf("Unsupported signature algorithm %d", algorithm)
+	}
+	return nil
+}
+
+type makeCredentialResponse struct {
+	Format    string          `cbor:"1,keyasint"`
+	AuthData  []byte          `cbor:"2,keyasint"`
+	Statement cbor.RawMessage `cbor:"3,keyasint"`
+}
+
+type packedStatement struct {
+	Alg int      `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5c [][]byte `cbor:"x5c"`
+}
+
+// VerifyRegistration checks an authenticatorMakeCredential response, without its status
+// byte, as in WebAuthn section 7.1, and returns the new credential
+func VerifyRegistration(response []byte, rpID string, clientDataHash []byte) (*Credential, *AuthenticatorData, error) {
+	if err := checkCanonical(response); err != nil {
+		return nil, nil, err
+	}
+	var decoded makeCredentialResponse
+	if err := decMode.Unmarshal(response, &decoded); err != nil {
+		return nil, nil, fmt.Errorf("Could not decode response: %w", err)
+	}
+	authData, err := ParseAuthenticatorData(decoded.AuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := authData.check(rpID); err != nil {
+		return nil, nil, err
+	}
+	if authData.Flags&FlagUserPresent == 0 {
+		return nil, nil, fmt.Errorf("User present flag is not set")
+	}
+	if authData.Flags&FlagAttestedData == 0 {
+		return nil, nil, fmt.Errorf("Attested credential data flag is not set")
+	}
+	publicKey, algorithm, err := parsePublicKey(authData.CredentialPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	credential := &Credential{
+		ID:        authData.CredentialID,
+		PublicKey: publicKey,
+		Algorithm: algorithm,
+		SignCount: authData.SignCount,
+	}
+	signedData := append(append([]byte{}, decoded.AuthData...), clientDataHash...)
+	switch decoded.Format {
+	case "packed":
+		err = verifyPacked(decoded.Statement, authData, credential, signedData)
+	case "apple":
+		err = verifyApple(decoded.Statement, credential, signedData)
+	case "android-key":
+		err = verifyAndroidKey(decoded.Statement, credential, signedData, clientDataHash)
+	case "android-safetynet":
+		err = verifySafetyNet(decoded.Statement, signedData)
+	case "none":
+		var statement map[string]cbor.RawMessage
+		if err = decMode.Unmarshal(decoded.Statement, &statement); err == nil && len(statement) != 0 {
+			err = fmt.Errorf("None attestation has a statement")
+		}
+	default:
+		err = fmt.Errorf("Unsupported attestation format %q", decoded.Format)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return credential, authData, nil
+}
+
+// verifyPacked follows WebAuthn section 8.2
+func verifyPacked(encoded []byte, authData *AuthenticatorData, credential *Credential, signedData []byte) error {
+	var statement packedStatement
+	if err := decMode.Unmarshal(encoded, &statement); err != nil {
+		return fmt.Errorf("Could not decode packed statement: %w", err)
+	}
+	if len(statement.X5c) == 0 {
+		// Self attestation
+		if statement.Alg != credential.Algorithm {
+			return fmt.Errorf("Self attestation algorithm %d does not match the credential's %d", statement.Alg, credential.Algorithm)
+		}
+		return verifySignature(credential.PublicKey, statement.Alg, signedData, statement.Sig)
+	}
+	certificate, err := x509.ParseCertificate(statement.X5c[0])
+	if err != nil {
+		return fmt.Errorf("Could not parse attestation certificate: %w", err)
+	}
+	if err := verifySignature(certificate.PublicKey, statement.Alg, signedData, statement.Sig); err != nil {
+		return fmt.Errorf("Attestation: %w", err)
+	}
+	// Certificate requirements of section 8.2.1
+	if certificate.Version != 3 {
+		return fmt.Errorf("Attestation certificate is version %d, not 3", certificate.Version)
+	}
+	subject := certificate.Subject
+	if len(subject.Country) == 0 || len(subject.Organization) == 0 || subject.CommonName == "" {
+		return fmt.Errorf("Attestation certificate subject %s is missing C, O or CN", subject)
+	}
+	if len(subject.OrganizationalUnit) != 1 || subject.OrganizationalUnit[0] != "Authenticator Attestation" {
+		return fmt.Errorf("Attestation certificate OU is %v, not Authenticator Attestation", subject.OrganizationalUnit)
+	}
+	if !certificate.BasicConstraintsValid || certificate.IsCA {
+		return fmt.Errorf("Attestation certificate must not be a CA")
+	}
+	// The rest of x5c is the chain, each certificate issued by the next
+	issued := certificate
+	for _, encoded := range statement.X5c[1:] {
+		issuer, err := x509.ParseCertificate(encoded)
+		if err != nil {
+			return fmt.Errorf("Could not parse intermediate certificate: %w", err)
+		}
+		if err := issued.CheckSignatureFrom(issuer); err != nil {
+			return fmt.Errorf("Certificate %s is not issued by %s: %w", issued.Subject, issuer.Subject, err)
+		}
+		issued = issuer
+	}
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(oidAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(extension.Value, &aaguid); err != nil || !bytes.Equal(aaguid, authData.AAGUID) {
+			return fmt.Errorf("Attestation certificate AAGUID does not match the authenticator data")
+		}
+	}
+	return nil
+}
+
+// verifyApple follows WebAuthn section 8.8, without checking the chain leads to Apple's root
+func verifyApple(encoded []byte, credential *Credential, signedData []byte) error {
+	var statement struct {
+		X5c [][]byte `cbor:"x5c"`
+	}
+	if err := decMode.Unmarshal(encoded, &statement); err != nil {
+		return fmt.Errorf("Could not decode apple statement: %w", err)
+	}
+	if len(statement.X5c) == 0 {
+		return fmt.Errorf("Apple statement has no certificate")
+	}
+	certificate, err := x509.ParseCertificate(statement.X5c[0])
+	if err != nil {
+		return fmt.Errorf("Could not parse credential certificate: %w", err)
+	}
+	nonce := sha256.Sum256(signedData)
+	var found bool
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(oidAppleNonce) {
+			continue
+		}
+		var value struct {
+			Nonce []byte `asn1:"explicit,tag:1"`
+		}
+		if _, err := asn1.Unmarshal(extension.Value, &value); err != nil || !bytes.Equal(value.Nonce, nonce[:]) {
+			return fmt.Errorf("Credential certificate nonce does not match the request")
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("Credential certificate has no nonce")
+	}
+	publicKey, ok := certificate.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(credential.PublicKey) {
+		return fmt.Errorf("Credential certificate is not for the credential's key")
+	}
+	return nil
+}
+
+// verifyAndroidKey follows WebAuthn section 8.4, accepting keys whose purpose and origin
+// are enforced by software as well as by a TEE
+func verifyAndroidKey(encoded []byte, credential *Credential, signedData []byte, clientDataHash []byte) error {
+	var statement packedStatement
+	if err := decMode.Unmarshal(encoded, &statement); err != nil {
+		return fmt.Errorf("Could not decode android-key statement: %w", err)
+	}
+	if len(statement.X5c) == 0 {
+		return fmt.Errorf("android-key statement has no certificate")
+	}
+	certificate, err := x509.ParseCertificate(statement.X5c[0])
+	if err != nil {
+		return fmt.Errorf("Could not parse credential certificate: %w", err)
+	}
+	if err := verifySignature(certificate.PublicKey, statement.Alg, signedData, statement.Sig); err != nil {
+		return fmt.Errorf("Attestation: %w", err)
+	}
+	publicKey, ok := certificate.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(credential.PublicKey) {
+		return fmt.Errorf("Credential certificate is not for the credential's key")
+	}
+	var description struct {
+		AttestationVersion       int
+		AttestationSecurityLevel asn1.Enumerated
+		KeymasterVersion         int
+		KeymasterSecurityLevel   asn1.Enumerated
+		AttestationChallenge     []byte
+		UniqueID                 []byte
+		SoftwareEnforced         asn1.RawValue
+		TEEEnforced              asn1.RawValue
+	}
+	var found bool
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oidAndroidKeyDescription) {
+			if _, err := asn1.Unmarshal(extension.Value, &description); err != nil {
+				return fmt.Errorf("Could not parse KeyDescription: %w", err)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Credential certificate has no KeyDescription")
+	}
+	if !bytes.Equal(description.AttestationChallenge, clientDataHash) {
+		return fmt.Errorf("KeyDescription challenge is not the client data hash")
+	}
+	var signs, generated bool
+	for _, list := range []asn1.RawValue{description.SoftwareEnforced, description.TEEEnforced} {
+		for rest := list.Bytes; len(rest) > 0; {
+			var entry asn1.RawValue
+			if rest, err = asn1.Unmarshal(rest, &entry); err != nil {
+				return fmt.Errorf("Could not parse authorization list: %w", err)
+			}
+			switch entry.Tag {
+			case 1:
+				var purposes []int
+				if _, err := asn1.UnmarshalWithParams(entry.Bytes, &purposes, "set"); err != nil {
+					return fmt.Errorf("Could not parse key purpose: %w", err)
+				}
+				for _, purpose := range purposes {
+					signs = signs || purpose == 2
+				}
+			case 600:
+				return fmt.Errorf("Credential key can be used by all applications")
+			case 702:
+				var origin int
+				if _, err := asn1.Unmarshal(entry.Bytes, &origin); err != nil {
+					return fmt.Errorf("Could not parse key origin: %w", err)
+				}
+				generated = origin == 0
+			}
+		}
+	}
+	if !signs || !generated {
+		return fmt.Errorf("Credential key is not a signing key generated on the device")
+	}
+	return nil
+}
+
+// verifySafetyNet follows WebAuthn section 8.5, without checking the chain leads to Google's
+// root or how old the response is
+func verifySafetyNet(encoded []byte, signedData []byte) error {
+	var statement struct {
+		Ver      string `cbor:"ver"`
+		Response []byte `cbor:"response"`
+	}
+	if err := decMode.Unmarshal(encoded, &statement); err != nil {
+		return fmt.Errorf("Could not decode android-safetynet statement: %w", err)
+	}
+	if statement.Ver == "" {
+		return fmt.Errorf("android-safetynet statement has no version")
+	}
+	parts := strings.Split(string(statement.Response), ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("SafetyNet response is not a JWS")
+	}
+	var header struct {
+		Algorithm string   `json:"alg"`
+		X5C       []string `json:"x5c"`
+	}
+	var payload struct {
+		Nonce           string `json:"nonce"`
+		CTSProfileMatch bool   `json:"ctsProfileMatch"`
+	}
+	for i, value := range []interface{}{&header, &payload} {
+		decoded, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return fmt.Errorf("Could not decode SafetyNet response: %w", err)
+		}
+		if err := json.Unmarshal(decoded, value); err != nil {
+			return fmt.Errorf("Could not decode SafetyNet response: %w", err)
+		}
+	}
+	if header.Algorithm != "ES256" || len(header.X5C) == 0 {
+		return fmt.Errorf("SafetyNet response is not signed with ES256 and a certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(header.X5C[0])
+	if err != nil {
+		return fmt.Errorf("Could not decode SafetyNet certificate: %w", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("Could not parse SafetyNet certificate: %w", err)
+	}
+	if err := certificate.VerifyHostname("attest.android.com"); err != nil {
+		return fmt.Errorf("SafetyNet certificate: %w", err)
+	}
+	key, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if !ok || err != nil || len(signature) != 64 {
+		return fmt.Errorf("SafetyNet signature is not ES256")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return fmt.Errorf("SafetyNet signature does not verify")
+	}
+	nonce := sha256.Sum256(signedData)
+	if payload.Nonce != base64.StdEncoding.EncodeToString(nonce[:]) {
+		return fmt.Errorf("SafetyNet nonce does not match the request")
+	}
+	if !payload.CTSProfileMatch {
+		return fmt.Errorf("SafetyNet response has no ctsProfileMatch")
+	}
+	return nil
+}
+
+type getAssertionResponse struct {
+	Credential *struct {
+		ID   []byte `cbor:"id"`
+		Type string `cbor:"type"`
+	} `cbor:"1,keyasint"`
+	AuthData  []byte `cbor:"2,keyasint"`
+	Signature []byte `cbor:"3,keyasint"`
+}
+
+// VerifyAssertion checks an authenticatorGetAssertion response, without its status byte, as
+// in WebAuthn section 7.2. It looks the credential up in credentials, which may only have
+// one entry if the response leaves the credential out, and updates its signature count.
+func VerifyAssertion(response []byte, rpID string, clientDataHash []byte, credentials []*Credential) (*Credential, *AuthenticatorData, error) {
+	if err := checkCanonical(response); err != nil {
+		return nil, nil, err
+	}
+	var decoded getAssertionResponse
+	if err := decMode.Unmarshal(response, &decoded); err != nil {
+		return nil, nil, fmt.Errorf("Could not decode response: %w", err)
+	}
+	var credential *Credential
+	if decoded.Credential == nil {
+		if len(credentials) != 1 {
+			return nil, nil, fmt.Errorf("Credential can only be left out when one was allowed")
+		}
+		credential = credentials[0]
+	} else {
+		if decoded.Credential.Type != "public-key" {
+			return nil, nil, fmt.Errorf("Credential type is %q", decoded.Credential.Type)
+		}
+		for _, c := range credentials {
+			if bytes.Equal(c.ID, decoded.Credential.ID) {
+				credential = c
+			}
+		}
+		if credential == nil {
+			return nil, nil, fmt.Errorf("Assertion is for unknown credential %x", decoded.Credential.ID)
+		}
+	}
+	authData, err := ParseAuthenticatorData(decoded.AuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := authData.check(rpID); err != nil {
+		return nil, nil, err
+	}
+	if authData.Flags&FlagAttestedData != 0 {
+		return nil, nil, fmt.Errorf("Assertion has attested credential data")
+	}
+	signedData := append(append([]byte{}, decoded.AuthData...), clientDataHash...)
+	if err := verifySignature(credential.PublicKey, credential.Algorithm, signedData, decoded.Signature); err != nil {
+		return nil, nil, err
+	}
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		return nil, nil, fmt.Errorf("Signature count went from %d to %d, the authenticator may be cloned", credential.SignCount, authData.SignCount)
+	}
+	credential.SignCount = authData.SignCount
+	return credential, authData, nil
+}
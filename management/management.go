@@ -0,0 +1,271 @@
+// Package management serves an HTTP API for managing a running authenticator, so dashboards
+// and scripts can list and delete credentials, attach and detach the device, change the log
+// level and answer approvals without restarting it
+package management
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// Vault is the part of virtual_fido.Vault the API uses
+type Vault interface {
+	ListCredentials() []identities.CredentialMetadata
+	DeleteIdentity(id []byte) bool
+}
+
+// Device attaches and detaches the virtual device
+type Device interface {
+	Attach() error
+	Detach() error
+	Attached() bool
+}
+
+// Approvals answers pending approvals, e.g. fido_client.RemoteApprovalUI
+type Approvals interface {
+	Pending() []fido_client.PendingApproval
+	Resolve(id string, approved bool) error
+}
+
+// Server serves the API for whichever of Vault, Device and Approvals are set. Routes for the
+// others return 501.
+type Server struct {
+	// Every request must carry the token as a bearer token, so it must not be empty
+	Token     string
+	Vault     Vault
+	Device    Device
+	Approvals Approvals
+}
+
+// Status describes the device
+type Status struct {
+	Attached         bool   `json:"attached"`
+	Credentials      int    `json:"credentials"`
+	PendingApprovals int    `json:"pending_approvals"`
+	LogLevel         string `json:"log_level"`
+}
+
+// Credential describes a credential without its private key. IDs are base64url, as in
+// credential URLs.
+type Credential struct {
+	ID               string    `json:"id"`
+	RelyingPartyID   string    `json:"rp_id"`
+	RelyingPartyName string    `json:"rp_name,omitempty"`
+	UserName         string    `json:"user_name,omitempty"`
+	UserDisplayName  string    `json:"user_display_name,omitempty"`
+	Nickname         string    `json:"nickname,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastUsedAt       time.Time `json:"last_used_at"`
+	UsageCount       uint32    `json:"usage_count"`
+	Policy           string    `json:"policy"`
+}
+
+// LogLevels is the global log level and the subsystems with a level of their own
+type LogLevels struct {
+	Level      string            `json:"level"`
+	Subsystems map[string]string `json:"subsystems,omitempty"`
+}
+
+// SetLogLevel changes the level of Subsystem, or the global level if it's empty. Clear
+// removes the level of Subsystem, so it uses the global level again.
+type SetLogLevel struct {
+	Level     string `json:"level,omitempty"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Clear     bool   `json:"clear,omitempty"`
+}
+
+type approvalDecision struct {
+	Approved bool `json:"approved"`
+}
+
+// Handler serves:
+//
+//	GET    /status                device status
+//	GET    /credentials           list credentials
+//	DELETE /credentials/{id}      delete a credential (base64url ID)
+//	POST   /attach                attach the device
+//	POST   /detach                detach the device
+//	GET    /log-level             global and subsystem log levels
+//	PUT    /log-level             {"level": "trace", "subsystem": "ctap"}, anything but unsafe
+//	GET    /approvals             pending approvals
+//	POST   /approvals/{id}        {"approved": true}
+func (server *Server) Handler() http.Handler {
+	return http.HandlerFunc(server.serveHTTP)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+var errNotSupported = fmt.Errorf("Not supported by this device")
+
+func (server *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return server.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(server.Token)) == 1
+}
+
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("Invalid management token"))
+		return
+	}
+	route := strings.Trim(r.URL.Path, "/")
+	switch {
+	case route == "status" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.Status())
+	case route == "credentials" && r.Method == http.MethodGet:
+		if server.Vault == nil {
+			writeError(w, http.StatusNotImplemented, errNotSupported)
+			return
+		}
+		writeJSON(w, http.StatusOK, server.credentials())
+	case strings.HasPrefix(route, "credentials/") && r.Method == http.MethodDelete:
+		if server.Vault == nil {
+			writeError(w, http.StatusNotImplemented, errNotSupported)
+			return
+		}
+		id, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(route, "credentials/"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid credential ID: %w", err))
+			return
+		}
+		if !server.Vault.DeleteIdentity(id) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("No credential with that ID"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case (route == "attach" || route == "detach") && r.Method == http.MethodPost:
+		if server.Device == nil {
+			writeError(w, http.StatusNotImplemented, errNotSupported)
+			return
+		}
+		var err error
+		if route == "attach" {
+			err = server.Device.Attach()
+		} else {
+			err = server.Device.Detach()
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, server.Status())
+	case route == "log-level" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, logLevels())
+	case route == "log-level" && r.Method == http.MethodPut:
+		var request SetLogLevel
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid log level: %w", err))
+			return
+		}
+		if err := setLogLevel(request); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, logLevels())
+	case route == "approvals" && r.Method == http.MethodGet:
+		if server.Approvals == nil {
+			writeJSON(w, http.StatusOK, []fido_client.PendingApproval{})
+			return
+		}
+		writeJSON(w, http.StatusOK, server.Approvals.Pending())
+	case strings.HasPrefix(route, "approvals/") && r.Method == http.MethodPost:
+		if server.Approvals == nil {
+			writeError(w, http.StatusNotImplemented, errNotSupported)
+			return
+		}
+		var decision approvalDecision
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid decision: %w", err))
+			return
+		}
+		if err := server.Approvals.Resolve(strings.TrimPrefix(route, "approvals/"), decision.Approved); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown command: %s %s", r.Method, route))
+	}
+}
+
+func (server *Server) Status() Status {
+	status := Status{LogLevel: util.GetLogLevel().String()}
+	if server.Device != nil {
+		status.Attached = server.Device.Attached()
+	}
+	if server.Vault != nil {
+		status.Credentials = len(server.Vault.ListCredentials())
+	}
+	if server.Approvals != nil {
+		status.PendingApprovals = len(server.Approvals.Pending())
+	}
+	return status
+}
+
+func (server *Server) credentials() []Credential {
+	credentials := make([]Credential, 0)
+	for _, metadata := range server.Vault.ListCredentials() {
+		credentials = append(credentials, Credential{
+			ID:               base64.RawURLEncoding.EncodeToString(metadata.ID),
+			RelyingPartyID:   metadata.RelyingPartyID,
+			RelyingPartyName: metadata.RelyingPartyName,
+			UserName:         metadata.UserName,
+			UserDisplayName:  metadata.UserDisplayName,
+			Nickname:         metadata.Nickname,
+			CreatedAt:        metadata.CreatedAt,
+			LastUsedAt:       metadata.LastUsedAt,
+			UsageCount:       metadata.UsageCount,
+			Policy:           metadata.Policy.String(),
+		})
+	}
+	return credentials
+}
+
+func logLevels() LogLevels {
+	levels := LogLevels{Level: util.GetLogLevel().String(), Subsystems: make(map[string]string)}
+	for subsystem, level := range util.GetSubsystemLogLevels() {
+		levels.Subsystems[string(subsystem)] = level.String()
+	}
+	return levels
+}
+
+func setLogLevel(request SetLogLevel) error {
+	subsystem := util.LogSubsystem(request.Subsystem)
+	if request.Clear {
+		if request.Subsystem == "" {
+			return fmt.Errorf("Only a subsystem's log level can be cleared")
+		}
+		util.ClearSubsystemLogLevel(subsystem)
+		return nil
+	}
+	level, err := util.ParseLogLevel(request.Level)
+	if err != nil {
+		return err
+	}
+	if level == util.LogLevelUnsafe {
+		// It logs secrets, so it can only be chosen where the device is started
+		return fmt.Errorf("The unsafe log level can't be set remotely")
+	}
+	if request.Subsystem == "" {
+		util.SetLogLevel(level)
+	} else {
+		util.SetSubsystemLogLevel(subsystem, level)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package management
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type memoryVault struct {
+	credentials []identities.CredentialMetadata
+}
+
+func (vault *memoryVault) ListCredentials() []identities.CredentialMetadata {
+	return vault.credentials
+}
+
+func (vault *memoryVault) DeleteIdentity(id []byte) bool {
+	for i, credential := range vault.credentials {
+		if bytes.Equal(credential.ID, id) {
+			vault.credentials = append(vault.credentials[:i], vault.credentials[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeDevice struct {
+	attached bool
+}
+
+func (device *fakeDevice) Attach() error {
+	if device.attached {
+		return fmt.Errorf("Already attached")
+	}
+	device.attached = true
+	return nil
+}
+
+func (device *fakeDevice) Detach() error {
+	if !device.attached {
+		return fmt.Errorf("Not attached")
+	}
+	device.attached = false
+	return nil
+}
+
+func (device *fakeDevice) Attached() bool {
+	return device.attached
+}
+
+func request(t *testing.T, server *httptest.Server, method string, path string, body string, response interface{}) int {
+	httpRequest, err := http.NewRequest(method, server.URL+path, bytes.NewReader([]byte(body)))
+	test.Assert(t, err == nil, "Could not create request")
+	httpRequest.Header.Set("Authorization", "Bearer token")
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	test.Assert(t, err == nil, "Could not send request")
+	defer httpResponse.Body.Close()
+	if response != nil {
+		test.Assert(t, json.NewDecoder(httpResponse.Body).Decode(response) == nil, "Could not decode response to "+path)
+	}
+	return httpResponse.StatusCode
+}
+
+func TestManagementAPI(t *testing.T) {
+	vault := &memoryVault{credentials: []identities.CredentialMetadata{
+		{ID: []byte{1, 2, 3}, RelyingPartyID: "example.com", UserName: "alice"},
+		{ID: []byte{4, 5, 6}, RelyingPartyID: "other.example", UserName: "bob"},
+	}}
+	device := &fakeDevice{attached: true}
+	approvals := fido_client.NewRemoteApprovalUI("", "", time.Minute)
+	management := &Server{Token: "token", Vault: vault, Device: device, Approvals: approvals}
+	server := httptest.NewServer(management.Handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/status")
+	test.Assert(t, err == nil, "Could not get status")
+	test.AssertEqual(t, response.StatusCode, http.StatusUnauthorized, "Token should be required")
+
+	var status Status
+	test.AssertEqual(t, request(t, server, http.MethodGet, "/status", "", &status), http.StatusOK, "Could not get status")
+	test.Assert(t, status.Attached, "Device should be attached")
+	test.AssertEqual(t, status.Credentials, 2, "Status should count credentials")
+
+	var credentials []Credential
+	test.AssertEqual(t, request(t, server, http.MethodGet, "/credentials", "", &credentials), http.StatusOK, "Could not list credentials")
+	test.AssertEqual(t, len(credentials), 2, "Should list every credential")
+	test.AssertEqual(t, credentials[0].ID, base64.RawURLEncoding.EncodeToString([]byte{1, 2, 3}), "IDs should be base64url")
+	test.AssertEqual(t, request(t, server, http.MethodDelete, "/credentials/"+credentials[0].ID, "", nil), http.StatusNoContent, "Could not delete credential")
+	test.AssertEqual(t, len(vault.credentials), 1, "Credential should be deleted")
+	test.AssertEqual(t, request(t, server, http.MethodDelete, "/credentials/"+credentials[0].ID, "", nil), http.StatusNotFound, "Deleted credential should be gone")
+
+	test.AssertEqual(t, request(t, server, http.MethodPost, "/detach", "", &status), http.StatusOK, "Could not detach")
+	test.Assert(t, !status.Attached, "Device should be detached")
+	test.AssertEqual(t, request(t, server, http.MethodPost, "/detach", "", nil), http.StatusConflict, "Detaching twice should fail")
+	test.AssertEqual(t, request(t, server, http.MethodPost, "/attach", "", &status), http.StatusOK, "Could not attach")
+	test.Assert(t, status.Attached, "Device should be attached again")
+
+	defer util.SetLogLevel(util.GetLogLevel())
+	defer util.ClearSubsystemLogLevel(util.LogSubsystemCTAP)
+	var levels LogLevels
+	test.AssertEqual(t, request(t, server, http.MethodPut, "/log-level", `{"level": "trace", "subsystem": "ctap"}`, &levels), http.StatusOK, "Could not set subsystem log level")
+	test.AssertEqual(t, levels.Subsystems["ctap"], "trace", "Subsystem log level should be set")
+	test.AssertEqual(t, request(t, server, http.MethodPut, "/log-level", `{"level": "debug"}`, &levels), http.StatusOK, "Could not set log level")
+	test.AssertEqual(t, levels.Level, "debug", "Log level should be set")
+	test.AssertEqual(t, request(t, server, http.MethodPut, "/log-level", `{"level": "loud"}`, nil), http.StatusBadRequest, "Unknown log level should be rejected")
+	test.AssertEqual(t, request(t, server, http.MethodPut, "/log-level", `{"level": "unsafe", "subsystem": "ctap"}`, nil), http.StatusBadRequest, "Unsafe log level should be rejected")
+	test.AssertEqual(t, request(t, server, http.MethodPut, "/log-level", `{"level": "unsafe"}`, nil), http.StatusBadRequest, "Unsafe log level should be rejected")
+
+	results := make(chan bool, 1)
+	go func() {
+		results <- <-approvals.Approve(fido_client.ApprovalRequest{Action: fido_client.ClientActionFIDOGetAssertion, Params: fido_client.ClientActionRequestParams{RelyingPartyID: "example.com"}})
+	}()
+	var pending []fido_client.PendingApproval
+	for i := 0; i < 100 && len(pending) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		test.AssertEqual(t, request(t, server, http.MethodGet, "/approvals", "", &pending), http.StatusOK, "Could not list approvals")
+	}
+	test.AssertEqual(t, len(pending), 1, "Approval should be pending")
+	test.AssertEqual(t, request(t, server, http.MethodPost, "/approvals/"+pending[0].ID, `{"approved": true}`, nil), http.StatusNoContent, "Could not resolve approval")
+	test.Assert(t, <-results, "Approval should be approved")
+}
+
+func TestManagementAPIWithoutToken(t *testing.T) {
+	server := httptest.NewServer((&Server{}).Handler())
+	defer server.Close()
+	test.AssertEqual(t, request(t, server, http.MethodGet, "/status", "", nil), http.StatusUnauthorized, "An empty token should never be accepted")
+}
@@ -0,0 +1,187 @@
+package mds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+)
+
+// Status values from the FIDO Metadata Service specification
+const (
+	StatusNotFIDOCertified          = "NOT_FIDO_CERTIFIED"
+	StatusFIDOCertified             = "FIDO_CERTIFIED"
+	StatusRevoked                   = "REVOKED"
+	StatusAttestationKeyCompromise  = "ATTESTATION_KEY_COMPROMISE"
+	StatusUserVerificationBypass    = "USER_VERIFICATION_BYPASS"
+	StatusUserKeyRemoteCompromise   = "USER_KEY_REMOTE_COMPROMISE"
+	StatusUserKeyPhysicalCompromise = "USER_KEY_PHYSICAL_COMPROMISE"
+	StatusUpdateAvailable           = "UPDATE_AVAILABLE"
+)
+
+// AddStatusReport records a new status for the authenticator, e.g. to test how an
+// RP treats a revoked device
+func (payload *MetadataBLOBPayload) AddStatusReport(aaguid [16]byte, status string) error {
+	formatted := identities.FormatAAGUID(aaguid)
+	for i := range payload.Entries {
+		entry := &payload.Entries[i]
+		if entry.AAGUID == formatted {
+			today := time.Now().UTC().Format(mdsDateFormat)
+			entry.StatusReports = append(entry.StatusReports, StatusReport{Status: status, EffectiveDate: today})
+			entry.TimeOfLastStatusChange = today
+			return nil
+		}
+	}
+	return fmt.Errorf("AAGUID %s is not registered", formatted)
+}
+
+// SigningRoot stands in for the FIDO Alliance MDS root; RPs under test must trust its certificate
+type SigningRoot struct {
+	Certificate *x509.Certificate
+	PrivateKey  *ecdsa.PrivateKey
+}
+
+func NewSigningRoot() (*SigningRoot, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate MDS root key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Virtual FIDO"}, CommonName: "Virtual FIDO MDS Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create MDS root certificate: %w", err)
+	}
+	certificate, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningRoot{Certificate: certificate, PrivateKey: privateKey}, nil
+}
+
+// LoadOrCreateSigningRoot reads a root saved as PEM at path, creating and saving a
+// new one if the file doesn't exist so RPs can keep trusting the same root
+func LoadOrCreateSigningRoot(path string) (*SigningRoot, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		root, err := NewSigningRoot()
+		if err != nil {
+			return nil, err
+		}
+		return root, os.WriteFile(path, root.encodePEM(), 0600)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read MDS root: %w", err)
+	}
+	root := &SigningRoot{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			root.Certificate, err = x509.ParseCertificate(block.Bytes)
+		case "EC PRIVATE KEY":
+			root.PrivateKey, err = x509.ParseECPrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode MDS root: %w", err)
+		}
+	}
+	if root.Certificate == nil || root.PrivateKey == nil {
+		return nil, fmt.Errorf("MDS root file must contain a certificate and an EC private key")
+	}
+	return root, nil
+}
+
+func (root *SigningRoot) encodePEM() []byte {
+	keyBytes, err := x509.MarshalECPrivateKey(root.PrivateKey)
+	if err != nil {
+		panic(err)
+	}
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Certificate.Raw})
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	return append(certificate, key...)
+}
+
+// CertificatePEM is the root certificate to configure as the MDS trust anchor in the RP
+func (root *SigningRoot) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Certificate.Raw})
+}
+
+func (root *SigningRoot) newSigner() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Virtual FIDO"}, CommonName: "Virtual FIDO MDS Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, root.Certificate, &privateKey.PublicKey, root.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certificate, err := x509.ParseCertificate(certBytes)
+	return certificate, privateKey, err
+}
+
+type jwtHeader struct {
+	Algorithm string   `json:"alg"`
+	Type      string   `json:"typ"`
+	X5C       []string `json:"x5c"`
+}
+
+// SignBLOB encodes the payload as an MDS3 blob: an ES256 JWT whose x5c chain leads to the root
+func (root *SigningRoot) SignBLOB(payload *MetadataBLOBPayload) ([]byte, error) {
+	signerCertificate, signerKey, err := root.newSigner()
+	if err != nil {
+		return nil, fmt.Errorf("Could not create MDS signing certificate: %w", err)
+	}
+	header := jwtHeader{
+		Algorithm: "ES256",
+		Type:      "JWT",
+		X5C:       []string{base64.StdEncoding.EncodeToString(signerCertificate.Raw)},
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode metadata: %w", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(payloadBytes)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, signerKey, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("Could not sign metadata: %w", err)
+	}
+	// JWS uses the fixed-size r || s encoding rather than ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return []byte(signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)), nil
+}
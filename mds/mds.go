@@ -0,0 +1,143 @@
+package mds
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+)
+
+const mdsDateFormat = "2006-01-02"
+
+const legalHeader = "Generated by virtual-fido for testing. Not issued by the FIDO Alliance."
+
+type Version struct {
+	Major uint16 `json:"major"`
+	Minor uint16 `json:"minor"`
+}
+
+type VerificationMethodDescriptor struct {
+	UserVerificationMethod string `json:"userVerificationMethod"`
+}
+
+// MetadataStatement is the subset of a FIDO metadata statement that describes a virtual-fido device
+type MetadataStatement struct {
+	LegalHeader                 string                           `json:"legalHeader"`
+	AAGUID                      string                           `json:"aaguid"`
+	Description                 string                           `json:"description"`
+	AuthenticatorVersion        uint32                           `json:"authenticatorVersion"`
+	ProtocolFamily              string                           `json:"protocolFamily"`
+	Schema                      uint16                           `json:"schema"`
+	UPV                         []Version                        `json:"upv"`
+	AuthenticationAlgorithms    []string                         `json:"authenticationAlgorithms"`
+	PublicKeyAlgAndEncodings    []string                         `json:"publicKeyAlgAndEncodings"`
+	AttestationTypes            []string                         `json:"attestationTypes"`
+	UserVerificationDetails     [][]VerificationMethodDescriptor `json:"userVerificationDetails"`
+	KeyProtection               []string                         `json:"keyProtection"`
+	MatcherProtection           []string                         `json:"matcherProtection"`
+	AttachmentHint              []string                         `json:"attachmentHint"`
+	TCDisplay                   []string                         `json:"tcDisplay"`
+	AttestationRootCertificates []string                         `json:"attestationRootCertificates"`
+}
+
+type StatusReport struct {
+	Status        string `json:"status"`
+	EffectiveDate string `json:"effectiveDate,omitempty"`
+}
+
+type MetadataBLOBPayloadEntry struct {
+	AAGUID                 string             `json:"aaguid"`
+	MetadataStatement      *MetadataStatement `json:"metadataStatement"`
+	StatusReports          []StatusReport     `json:"statusReports"`
+	TimeOfLastStatusChange string             `json:"timeOfLastStatusChange"`
+}
+
+// MetadataBLOBPayload is the payload of an MDS3 blob. Written as plain JSON it
+// can be loaded as local metadata by RP libraries that support it.
+type MetadataBLOBPayload struct {
+	LegalHeader string                     `json:"legalHeader"`
+	Number      uint32                     `json:"no"`
+	NextUpdate  string                     `json:"nextUpdate"`
+	Entries     []MetadataBLOBPayloadEntry `json:"entries"`
+}
+
+func NewMetadataBLOBPayload() *MetadataBLOBPayload {
+	return &MetadataBLOBPayload{
+		LegalHeader: legalHeader,
+		Number:      0,
+		NextUpdate:  time.Now().UTC().AddDate(0, 1, 0).Format(mdsDateFormat),
+		Entries:     make([]MetadataBLOBPayloadEntry, 0),
+	}
+}
+
+// NewMetadataStatement describes a virtual-fido device with the given AAGUID whose
+// attestation certificates chain to root
+func NewMetadataStatement(aaguid [16]byte, root *x509.Certificate, description string) *MetadataStatement {
+	return &MetadataStatement{
+		LegalHeader:                 legalHeader,
+		AAGUID:                      identities.FormatAAGUID(aaguid),
+		Description:                 description,
+		AuthenticatorVersion:        1,
+		ProtocolFamily:              "fido2",
+		Schema:                      3,
+		UPV:                         []Version{{Major: 1, Minor: 0}},
+		AuthenticationAlgorithms:    []string{"secp256r1_ecdsa_sha256_raw"},
+		PublicKeyAlgAndEncodings:    []string{"cose"},
+		AttestationTypes:            []string{"basic_full"},
+		UserVerificationDetails:     [][]VerificationMethodDescriptor{{{UserVerificationMethod: "presence_internal"}}},
+		KeyProtection:               []string{"software"},
+		MatcherProtection:           []string{"software"},
+		AttachmentHint:              []string{"external", "wired"},
+		TCDisplay:                   []string{},
+		AttestationRootCertificates: []string{base64.StdEncoding.EncodeToString(root.Raw)},
+	}
+}
+
+// RegisterAuthenticator adds an entry for the device, replacing any previous entry with the same AAGUID
+func (payload *MetadataBLOBPayload) RegisterAuthenticator(aaguid [16]byte, root *x509.Certificate, description string) {
+	today := time.Now().UTC().Format(mdsDateFormat)
+	entry := MetadataBLOBPayloadEntry{
+		AAGUID:                 identities.FormatAAGUID(aaguid),
+		MetadataStatement:      NewMetadataStatement(aaguid, root, description),
+		StatusReports:          []StatusReport{{Status: StatusNotFIDOCertified, EffectiveDate: today}},
+		TimeOfLastStatusChange: today,
+	}
+	for i, existing := range payload.Entries {
+		if existing.AAGUID == entry.AAGUID {
+			payload.Entries[i] = entry
+			return
+		}
+	}
+	payload.Entries = append(payload.Entries, entry)
+}
+
+// ReadLocalMetadata loads a metadata file, or returns an empty payload if it doesn't exist yet
+func ReadLocalMetadata(path string) (*MetadataBLOBPayload, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewMetadataBLOBPayload(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read metadata: %w", err)
+	}
+	payload := MetadataBLOBPayload{}
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode metadata: %w", err)
+	}
+	return &payload, nil
+}
+
+// WriteLocalMetadata saves the payload, bumping its serial number so RPs notice the change
+func WriteLocalMetadata(path string, payload *MetadataBLOBPayload) error {
+	payload.Number++
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not encode metadata: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
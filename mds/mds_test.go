@@ -0,0 +1,76 @@
+package mds
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestRegisterAuthenticator(t *testing.T) {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA key")
+	ca, err := identities.CreateSelfSignedCA(caPrivateKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	otherAAGUID, err := identities.ParseAAGUID("00112233-4455-6677-8899-aabbccddeeff")
+	test.Assert(t, err == nil, "Could not parse AAGUID")
+
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	payload, err := ReadLocalMetadata(path)
+	test.Assert(t, err == nil, "Missing metadata should start empty")
+	payload.RegisterAuthenticator(identities.DefaultAAGUID, ca, "First")
+	payload.RegisterAuthenticator(otherAAGUID, ca, "Other")
+	payload.RegisterAuthenticator(identities.DefaultAAGUID, ca, "Replaced")
+	test.Assert(t, WriteLocalMetadata(path, payload) == nil, "Could not write metadata")
+
+	loaded, err := ReadLocalMetadata(path)
+	test.Assert(t, err == nil, "Could not read metadata")
+	test.AssertEqual(t, loaded.Number, uint32(1), "Serial number should be bumped on write")
+	test.AssertEqual(t, len(loaded.Entries), 2, "Registering an AAGUID again should replace its entry")
+	test.AssertEqual(t, loaded.Entries[0].MetadataStatement.Description, "Replaced", "Entry was not replaced")
+	test.AssertEqual(t, loaded.Entries[1].AAGUID, "00112233-4455-6677-8899-aabbccddeeff", "AAGUID should be formatted as a UUID")
+	test.AssertEqual(t, len(loaded.Entries[1].MetadataStatement.AttestationRootCertificates), 1, "Attestation root missing")
+}
+
+func TestSignBLOB(t *testing.T) {
+	caPrivateKey, _ := identities.CreateCAPrivateKey()
+	ca, _ := identities.CreateSelfSignedCA(caPrivateKey)
+	payload := NewMetadataBLOBPayload()
+	payload.RegisterAuthenticator(identities.DefaultAAGUID, ca, "Virtual FIDO")
+	test.Assert(t, payload.AddStatusReport(identities.DefaultAAGUID, StatusRevoked) == nil, "Could not add status report")
+	test.AssertEqual(t, len(payload.Entries[0].StatusReports), 2, "Status report missing")
+	test.Assert(t, payload.AddStatusReport([16]byte{}, StatusRevoked) != nil, "Unregistered AAGUID should be rejected")
+
+	path := filepath.Join(t.TempDir(), "root.pem")
+	root, err := LoadOrCreateSigningRoot(path)
+	test.Assert(t, err == nil, "Could not create signing root")
+	reloaded, err := LoadOrCreateSigningRoot(path)
+	test.Assert(t, err == nil, "Could not reload signing root")
+	test.Assert(t, reloaded.Certificate.Equal(root.Certificate), "Signing root should be reused")
+
+	blob, err := root.SignBLOB(payload)
+	test.Assert(t, err == nil, "Could not sign blob")
+	parts := strings.Split(string(blob), ".")
+	test.AssertEqual(t, len(parts), 3, "Blob should be a compact JWS")
+	headerBytes, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	var header jwtHeader
+	test.Assert(t, json.Unmarshal(headerBytes, &header) == nil, "Invalid header")
+	certBytes, _ := base64.StdEncoding.DecodeString(header.X5C[0])
+	signer, err := x509.ParseCertificate(certBytes)
+	test.Assert(t, err == nil, "Invalid signing certificate")
+	test.Assert(t, signer.CheckSignatureFrom(root.Certificate) == nil, "Signer should chain to the root")
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	test.Assert(t, ecdsa.Verify(signer.PublicKey.(*ecdsa.PublicKey), digest[:], r, s), "Invalid blob signature")
+}
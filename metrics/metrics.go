@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency buckets in seconds, from a fast HID round trip up to a slow user approval
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+type metric interface {
+	writePrometheus(w io.Writer)
+	snapshot() interface{}
+}
+
+type registry struct {
+	lock    sync.Mutex
+	metrics map[string]metric
+}
+
+var defaultRegistry = &registry{metrics: make(map[string]metric)}
+
+func init() {
+	expvar.Publish("virtual_fido", expvar.Func(Snapshot))
+}
+
+func (r *registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics[name] = m
+}
+
+func (r *registry) sortedMetrics() []metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	return metrics
+}
+
+// Label values are joined into a single map key
+const labelSeparator = "\x00"
+
+func labelKey(labelNames []string, labelValues []string) string {
+	if len(labelValues) != len(labelNames) {
+		panic(fmt.Sprintf("Expected %d label values, got %d", len(labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, labelSeparator)
+}
+
+func formatLabels(labelNames []string, key string, extra ...string) string {
+	pairs := make([]string, 0, len(labelNames)+1)
+	if len(labelNames) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labelNames[i], value))
+		}
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type Counter struct {
+	name       string
+	help       string
+	labelNames []string
+	lock       sync.Mutex
+	values     map[string]uint64
+}
+
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{name: name, help: help, labelNames: labelNames, values: make(map[string]uint64)}
+	defaultRegistry.register(name, counter)
+	return counter
+}
+
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *Counter) Add(delta uint64, labelValues ...string) {
+	key := labelKey(counter.labelNames, labelValues)
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.values[key] += delta
+}
+
+func (counter *Counter) Value(labelValues ...string) uint64 {
+	key := labelKey(counter.labelNames, labelValues)
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	return counter.values[key]
+}
+
+func (counter *Counter) writePrometheus(w io.Writer) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+	for _, key := range sortedKeys(counter.values) {
+		fmt.Fprintf(w, "%s%s %d\n", counter.name, formatLabels(counter.labelNames, key), counter.values[key])
+	}
+}
+
+func (counter *Counter) snapshot() interface{} {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	values := make(map[string]uint64)
+	for key, value := range counter.values {
+		values[strings.ReplaceAll(key, labelSeparator, ",")] = value
+	}
+	return values
+}
+
+type histogramValue struct {
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+type Histogram struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	lock       sync.Mutex
+	values     map[string]*histogramValue
+}
+
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	histogram := &Histogram{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		values:     make(map[string]*histogramValue),
+	}
+	defaultRegistry.register(name, histogram)
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	key := labelKey(histogram.labelNames, labelValues)
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	entry, ok := histogram.values[key]
+	if !ok {
+		entry = &histogramValue{bucketCounts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = entry
+	}
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			entry.bucketCounts[i]++
+		}
+	}
+	entry.sum += value
+	entry.count++
+}
+
+func (histogram *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	histogram.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (histogram *Histogram) Count(labelValues ...string) uint64 {
+	key := labelKey(histogram.labelNames, labelValues)
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	if entry, ok := histogram.values[key]; ok {
+		return entry.count
+	}
+	return 0
+}
+
+func (histogram *Histogram) writePrometheus(w io.Writer) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+	for _, key := range sortedKeys(histogram.values) {
+		entry := histogram.values[key]
+		for i, bound := range histogram.buckets {
+			le := fmt.Sprintf("le=\"%g\"", bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labelNames, key, le), entry.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labelNames, key, "le=\"+Inf\""), entry.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", histogram.name, formatLabels(histogram.labelNames, key), entry.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labelNames, key), entry.count)
+	}
+}
+
+func (histogram *Histogram) snapshot() interface{} {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	values := make(map[string]interface{})
+	for key, entry := range histogram.values {
+		values[strings.ReplaceAll(key, labelSeparator, ",")] = map[string]interface{}{
+			"count": entry.count,
+			"sum":   entry.sum,
+		}
+	}
+	return values
+}
+
+// Snapshot returns every metric by name, as published through expvar
+func Snapshot() interface{} {
+	defaultRegistry.lock.Lock()
+	metrics := make(map[string]metric, len(defaultRegistry.metrics))
+	for name, m := range defaultRegistry.metrics {
+		metrics[name] = m
+	}
+	defaultRegistry.lock.Unlock()
+	snapshot := make(map[string]interface{})
+	for name, m := range metrics {
+		snapshot[name] = m.snapshot()
+	}
+	return snapshot
+}
+
+func WritePrometheus(w io.Writer) {
+	for _, m := range defaultRegistry.sortedMetrics() {
+		m.writePrometheus(w)
+	}
+}
+
+// Handler serves all metrics in the Prometheus text exposition format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w)
+	})
+}
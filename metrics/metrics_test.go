@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestPrometheusOutput(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Test requests", "command")
+	counter.Inc("ping")
+	counter.Add(2, "ping")
+	histogram := NewHistogram("test_duration_seconds", "Test durations", []float64{0.1, 1}, "command")
+	histogram.Observe(0.5, "ping")
+	test.AssertEqual(t, counter.Value("ping"), uint64(3), "Wrong counter value")
+	test.AssertEqual(t, histogram.Count("ping"), uint64(1), "Wrong histogram count")
+
+	output := &bytes.Buffer{}
+	WritePrometheus(output)
+	text := output.String()
+	expected := []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{command="ping"} 3`,
+		`test_duration_seconds_bucket{command="ping",le="0.1"} 0`,
+		`test_duration_seconds_bucket{command="ping",le="1"} 1`,
+		`test_duration_seconds_bucket{command="ping",le="+Inf"} 1`,
+		`test_duration_seconds_count{command="ping"} 1`,
+	}
+	for _, line := range expected {
+		test.Assert(t, strings.Contains(text, line+"\n"), "Missing line: "+line)
+	}
+}
@@ -0,0 +1,109 @@
+package otp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var otpLogger = util.NewLogger("[OTP] ", util.LogSubsystemOTP, util.LogLevelDebug)
+
+const (
+	defaultDigits = 6
+	defaultPeriod = 30
+)
+
+type OTPClient interface {
+	// OTPSlot returns nil for empty slots
+	OTPSlot(number int) *identities.OTPSlot
+	// SaveOTPSlots persists the slots after an HOTP counter moved
+	SaveOTPSlots()
+}
+
+// OTPKeyboard types text for the host, e.g. a usb.USBKeyboard
+type OTPKeyboard interface {
+	Type(text string) error
+}
+
+// OTPServer types the password of a slot when it's triggered, like touching a YubiKey
+type OTPServer struct {
+	client   OTPClient
+	keyboard OTPKeyboard
+	// Keeps HOTP counters from being used twice by concurrent triggers
+	lock sync.Mutex
+	now  func() time.Time
+}
+
+func NewOTPServer(client OTPClient, keyboard OTPKeyboard) *OTPServer {
+	return &OTPServer{client: client, keyboard: keyboard, now: util.Now}
+}
+
+// HOTP generates an RFC 4226 code
+func HOTP(secret []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(util.ToBE(counter))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0F
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7FFFFFFF
+	modulus := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%modulus)
+}
+
+// TOTP generates an RFC 6238 code for the time step containing now
+func TOTP(secret []byte, now time.Time, period int, digits int) string {
+	return HOTP(secret, uint64(now.Unix()/int64(period)), digits)
+}
+
+// Password returns what a slot types, moving HOTP counters forward
+func (server *OTPServer) Password(number int) (string, error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	slot := server.client.OTPSlot(number)
+	if slot == nil {
+		return "", fmt.Errorf("OTP slot %d is empty", number)
+	}
+	digits := slot.Digits
+	if digits == 0 {
+		digits = defaultDigits
+	}
+	var password string
+	switch slot.Type {
+	case identities.OTPSlotStatic:
+		password = slot.Password
+	case identities.OTPSlotHOTP:
+		password = HOTP(slot.Secret, slot.Counter, digits)
+		slot.Counter++
+		server.client.SaveOTPSlots()
+	case identities.OTPSlotTOTP:
+		period := slot.Period
+		if period == 0 {
+			period = defaultPeriod
+		}
+		password = TOTP(slot.Secret, server.now(), period, digits)
+	default:
+		return "", fmt.Errorf("Unknown OTP slot type: %s", slot.Type)
+	}
+	if slot.AppendEnter {
+		password += "\n"
+	}
+	return password, nil
+}
+
+// Trigger types the password of a slot on the keyboard
+func (server *OTPServer) Trigger(number int) error {
+	password, err := server.Password(number)
+	if err != nil {
+		return err
+	}
+	otpLogger.Printf("TYPING OTP SLOT %d\n\n", number)
+	return server.keyboard.Type(password)
+}
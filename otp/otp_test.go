@@ -0,0 +1,78 @@
+package otp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+type dummyOTPClient struct {
+	slots map[int]*identities.OTPSlot
+	saves int
+}
+
+func (client *dummyOTPClient) OTPSlot(number int) *identities.OTPSlot {
+	return client.slots[number]
+}
+
+func (client *dummyOTPClient) SaveOTPSlots() {
+	client.saves++
+}
+
+type dummyKeyboard struct {
+	typed []string
+}
+
+func (keyboard *dummyKeyboard) Type(text string) error {
+	keyboard.typed = append(keyboard.typed, text)
+	return nil
+}
+
+var rfcSecret = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	// Appendix D of RFC 4226
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range expected {
+		test.AssertEqual(t, HOTP(rfcSecret, uint64(counter), 6), code, "Incorrect HOTP code")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// Appendix B of RFC 6238, SHA1 only
+	expected := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for seconds, code := range expected {
+		test.AssertEqual(t, TOTP(rfcSecret, time.Unix(seconds, 0), 30, 8), code, "Incorrect TOTP code")
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	client := &dummyOTPClient{slots: map[int]*identities.OTPSlot{
+		1: {Slot: 1, Type: identities.OTPSlotHOTP, Secret: rfcSecret},
+		2: {Slot: 2, Type: identities.OTPSlotStatic, Password: "hunter2", AppendEnter: true},
+	}}
+	keyboard := &dummyKeyboard{}
+	server := NewOTPServer(client, keyboard)
+	test.Assert(t, server.Trigger(1) == nil, "Could not trigger HOTP slot")
+	test.Assert(t, server.Trigger(1) == nil, "Could not trigger HOTP slot")
+	test.Assert(t, server.Trigger(2) == nil, "Could not trigger static slot")
+	test.Assert(t, server.Trigger(3) != nil, "Empty slots can't be triggered")
+	test.AssertArrEqual(t, keyboard.typed, []string{"755224", "287082", "hunter2\n"}, "Incorrect passwords typed")
+	test.AssertEqual(t, client.slots[1].Counter, uint64(2), "HOTP counter should move forward")
+	test.AssertEqual(t, client.saves, 2, "HOTP counter should be saved")
+
+	client.slots[1] = &identities.OTPSlot{Slot: 1, Type: identities.OTPSlotTOTP, Secret: rfcSecret, Digits: 8}
+	server.now = func() time.Time { return time.Unix(59, 0) }
+	password, err := server.Password(1)
+	test.Assert(t, err == nil, "Could not generate TOTP code")
+	test.AssertEqual(t, password, "94287082", "Incorrect TOTP code")
+}
@@ -0,0 +1,99 @@
+package piv
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type pivAPDUHeader struct {
+	Cla         uint8
+	Instruction pivInstruction
+	Param1      uint8
+	Param2      uint8
+}
+
+func (header pivAPDUHeader) String() string {
+	description, ok := pivInstructionDescriptions[header.Instruction]
+	if !ok {
+		description = fmt.Sprintf("0x%x", header.Instruction)
+	}
+	return fmt.Sprintf("PIVAPDUHeader{ Cla: 0x%x, Instruction: %s, Param1: 0x%x, Param2: 0x%x }",
+		header.Cla,
+		description,
+		header.Param1,
+		header.Param2)
+}
+
+type pivAPDU struct {
+	header pivAPDUHeader
+	data   []byte
+	// Maximum response data length (Ne); 0 if the APDU has no Le field
+	responseLength int
+}
+
+func decodeLe(le []byte) int {
+	value := 0
+	for _, b := range le {
+		value = value<<8 | int(b)
+	}
+	if value == 0 {
+		// Le of zero asks for the maximum length
+		return 1 << (8 * len(le))
+	}
+	return value
+}
+
+// decodeAPDU parses every ISO 7816-4 APDU case, with short or extended lengths
+func decodeAPDU(apduBytes []byte) (pivAPDU, error) {
+	var apdu pivAPDU
+	if len(apduBytes) < int(util.SizeOf[pivAPDUHeader]()) {
+		return apdu, fmt.Errorf("APDU too short: %d bytes", len(apduBytes))
+	}
+	buffer := bytes.NewBuffer(apduBytes)
+	apdu.header = util.ReadBE[pivAPDUHeader](buffer)
+	body := buffer.Bytes()
+	apdu.data = []byte{}
+	switch {
+	case len(body) == 0:
+		// Case 1: no data and no Le
+	case len(body) == 1:
+		// Case 2S: short Le only
+		apdu.responseLength = decodeLe(body)
+	case body[0] == 0 && len(body) >= 3:
+		if len(body) == 3 {
+			// Case 2E: extended Le only
+			apdu.responseLength = decodeLe(body[1:3])
+			break
+		}
+		length := int(util.FromBE[uint16](body[1:3]))
+		rest := body[3:]
+		if len(rest) == length {
+			// Case 3E: extended Lc and data
+			apdu.data = rest
+		} else if len(rest) == length+2 {
+			// Case 4E: extended Lc, data and Le
+			apdu.data = rest[:length]
+			apdu.responseLength = decodeLe(rest[length:])
+		} else {
+			return apdu, fmt.Errorf("APDU length %d doesn't match declared length %d", len(rest), length)
+		}
+	case body[0] != 0:
+		length := int(body[0])
+		rest := body[1:]
+		if len(rest) == length {
+			// Case 3S: short Lc and data
+			apdu.data = rest
+		} else if len(rest) == length+1 {
+			// Case 4S: short Lc, data and Le
+			apdu.data = rest[:length]
+			apdu.responseLength = decodeLe(rest[length:])
+		} else {
+			return apdu, fmt.Errorf("APDU length %d doesn't match declared length %d", len(rest), length)
+		}
+	default:
+		return apdu, fmt.Errorf("Invalid APDU body: %#v", body)
+	}
+	return apdu, nil
+}
@@ -0,0 +1,568 @@
+package piv
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var pivLogger = util.NewLogger("[PIV] ", util.LogSubsystemPIV, util.LogLevelDebug)
+
+// APDU data holds PINs, management keys and signatures, so it's only logged at the unsafe level
+var unsafePIVLogger = util.NewLogger("[PIV] ", util.LogSubsystemPIV, util.LogLevelUnsafe)
+
+type pivInstruction uint8
+
+const (
+	pivInsVerify              pivInstruction = 0x20
+	pivInsChangeReferenceData pivInstruction = 0x24
+	pivInsResetRetryCounter   pivInstruction = 0x2C
+	pivInsGenerateKeyPair     pivInstruction = 0x47
+	pivInsGeneralAuthenticate pivInstruction = 0x87
+	pivInsSelect              pivInstruction = 0xA4
+	pivInsGetResponse         pivInstruction = 0xC0
+	pivInsGetData             pivInstruction = 0xCB
+	pivInsPutData             pivInstruction = 0xDB
+)
+
+var pivInstructionDescriptions = map[pivInstruction]string{
+	pivInsVerify:              "pivInsVerify",
+	pivInsChangeReferenceData: "pivInsChangeReferenceData",
+	pivInsResetRetryCounter:   "pivInsResetRetryCounter",
+	pivInsGenerateKeyPair:     "pivInsGenerateKeyPair",
+	pivInsGeneralAuthenticate: "pivInsGeneralAuthenticate",
+	pivInsSelect:              "pivInsSelect",
+	pivInsGetResponse:         "pivInsGetResponse",
+	pivInsGetData:             "pivInsGetData",
+	pivInsPutData:             "pivInsPutData",
+}
+
+type pivStatusWord uint16
+
+const (
+	pivSWSuccess                 pivStatusWord = 0x9000
+	pivSWWrongLength             pivStatusWord = 0x6700
+	pivSWSecurityNotSatisfied    pivStatusWord = 0x6982
+	pivSWAuthenticationBlocked   pivStatusWord = 0x6983
+	pivSWConditionsNotSatisfied  pivStatusWord = 0x6985
+	pivSWWrongData               pivStatusWord = 0x6A80
+	pivSWNotFound                pivStatusWord = 0x6A82
+	pivSWIncorrectParameters     pivStatusWord = 0x6A86
+	pivSWReferenceNotFound       pivStatusWord = 0x6A88
+	pivSWInstructionNotSupported pivStatusWord = 0x6D00
+	pivSWClassNotSupported       pivStatusWord = 0x6E00
+	// Low nibble holds the tries left
+	pivSWVerifyFailed pivStatusWord = 0x63C0
+	// Low byte holds the bytes left for GET RESPONSE
+	pivSWBytesRemaining pivStatusWord = 0x6100
+)
+
+const (
+	// CLA bit marking a command APDU that is continued by the next one
+	pivClaChaining uint8 = 0x10
+
+	pivKeyPIN        uint8 = 0x80
+	pivKeyPUK        uint8 = 0x81
+	pivKeyManagement uint8 = 0x9B
+	// Key slots that can be used without the PIN, and that need it before every use
+	pivSlotCardAuthentication uint8 = 0x9E
+	pivSlotSignature          uint8 = 0x9C
+
+	pivAlgorithm3DES    uint8 = 0x03
+	pivAlgorithmECCP256 uint8 = 0x11
+	pivAlgorithmECCP384 uint8 = 0x14
+
+	pivTagDiscovery uint32 = 0x7E
+)
+
+// Full AID of the PIV applet; hosts may select it by a prefix
+var pivAID = []byte{0xA0, 0x00, 0x00, 0x03, 0x08, 0x00, 0x00, 0x10, 0x00, 0x01, 0x00}
+
+const pivMinimumAIDLength = 5
+
+// ATR with T=1 and "vFIDOPIV" as historical bytes, ending with its checksum
+var pivATR = func() []byte {
+	atr := util.Concat([]byte{0x3B, 0x88, 0x80, 0x01}, []byte("vFIDOPIV"))
+	checksum := uint8(0)
+	for _, b := range atr[1:] {
+		checksum ^= b
+	}
+	return append(atr, checksum)
+}()
+
+type PIVClient interface {
+	// PIVState is the applet's saved state, which the server changes in place
+	PIVState() *identities.PIVState
+	// SavePIVState persists changes made to the PIV state
+	SavePIVState()
+}
+
+// PIVServer is a PIV applet, which is the card behind the device's CCID interface
+type PIVServer struct {
+	client PIVClient
+	// Security state of the session, lost when the card is powered off
+	pinVerified             bool
+	managementAuthenticated bool
+	// What the host has to send back to authenticate with the management key
+	managementWitness   []byte
+	managementChallenge []byte
+	// Data of command APDUs chained with CLA 0x10, waiting for the final APDU
+	chainedRequest []byte
+	// Rest of a long response, returned with GET RESPONSE
+	pendingResponse []byte
+}
+
+func NewPIVServer(client PIVClient) *PIVServer {
+	return &PIVServer{client: client}
+}
+
+// ATR is sent when the host powers on the card, which starts a new session
+func (server *PIVServer) ATR() []byte {
+	server.pinVerified = false
+	server.managementAuthenticated = false
+	server.managementWitness = nil
+	server.managementChallenge = nil
+	server.chainedRequest = nil
+	server.pendingResponse = nil
+	return pivATR
+}
+
+func (server *PIVServer) HandleAPDU(command []byte) []byte {
+	apdu, err := decodeAPDU(command)
+	if err != nil {
+		pivLogger.Printf("ERROR: %s\n\n", err)
+		return util.ToBE(pivSWWrongLength)
+	}
+	pivLogger.Printf("PIV APDU: %s\n\n", apdu.header)
+	unsafePIVLogger.Printf("PIV APDU DATA: %#v\n\n", apdu.data)
+	if apdu.header.Cla&^pivClaChaining != 0 {
+		return util.ToBE(pivSWClassNotSupported)
+	}
+	if apdu.header.Instruction == pivInsGetResponse {
+		return server.handleGetResponse(apdu.responseLength)
+	}
+	server.pendingResponse = nil
+	if apdu.header.Cla&pivClaChaining != 0 {
+		server.chainedRequest = append(server.chainedRequest, apdu.data...)
+		return util.ToBE(pivSWSuccess)
+	}
+	data := apdu.data
+	if server.chainedRequest != nil {
+		data = append(server.chainedRequest, apdu.data...)
+		server.chainedRequest = nil
+	}
+	response, status := server.handleInstruction(apdu.header, data)
+	pivLogger.Printf("PIV RESPONSE: 0x%x\n\n", status)
+	unsafePIVLogger.Printf("PIV RESPONSE DATA: %#v\n\n", response)
+	return server.chainResponse(util.Concat(response, util.ToBE(status)), apdu.responseLength)
+}
+
+func (server *PIVServer) handleInstruction(header pivAPDUHeader, data []byte) ([]byte, pivStatusWord) {
+	switch header.Instruction {
+	case pivInsSelect:
+		return server.handleSelect(header, data)
+	case pivInsGetData:
+		return server.handleGetData(header, data)
+	case pivInsPutData:
+		return server.handlePutData(header, data)
+	case pivInsVerify:
+		return nil, server.handleVerify(header, data)
+	case pivInsChangeReferenceData:
+		return nil, server.handleChangeReferenceData(header, data)
+	case pivInsResetRetryCounter:
+		return nil, server.handleResetRetryCounter(header, data)
+	case pivInsGenerateKeyPair:
+		return server.handleGenerateKeyPair(header, data)
+	case pivInsGeneralAuthenticate:
+		return server.handleGeneralAuthenticate(header, data)
+	default:
+		return nil, pivSWInstructionNotSupported
+	}
+}
+
+func (server *PIVServer) handleSelect(header pivAPDUHeader, data []byte) ([]byte, pivStatusWord) {
+	if header.Param1 != 0x04 {
+		return nil, pivSWIncorrectParameters
+	}
+	if len(data) < pivMinimumAIDLength || !bytes.HasPrefix(pivAID, data) {
+		return nil, pivSWNotFound
+	}
+	// Application property template: the AID's PIX, its authority and the algorithms we support
+	template := util.Concat(
+		encodeTLV(0x4F, pivAID[5:]),
+		encodeTLV(0x79, encodeTLV(0x4F, pivAID[:5])),
+		encodeTLV(0xAC, util.Concat(
+			encodeTLV(0x80, []byte{pivAlgorithm3DES}),
+			encodeTLV(0x80, []byte{pivAlgorithmECCP256}),
+			encodeTLV(0x80, []byte{pivAlgorithmECCP384}),
+			encodeTLV(0x06, []byte{0x00}),
+		)),
+	)
+	return encodeTLV(0x61, template), pivSWSuccess
+}
+
+// objectTag reads the tag list (5C) naming a data object
+func objectTag(tlvs []tlv) (uint32, bool) {
+	tagList := findTLV(tlvs, 0x5C)
+	if tagList == nil || len(tagList.value) == 0 || len(tagList.value) > 3 {
+		return 0, false
+	}
+	tag := uint32(0)
+	for _, b := range tagList.value {
+		tag = tag<<8 | uint32(b)
+	}
+	return tag, true
+}
+
+func (server *PIVServer) handleGetData(header pivAPDUHeader, data []byte) ([]byte, pivStatusWord) {
+	if header.Param1 != 0x3F || header.Param2 != 0xFF {
+		return nil, pivSWIncorrectParameters
+	}
+	tlvs, err := parseTLVs(data)
+	if err != nil {
+		return nil, pivSWWrongData
+	}
+	tag, ok := objectTag(tlvs)
+	if !ok {
+		return nil, pivSWWrongData
+	}
+	if tag == pivTagDiscovery {
+		// PIN usage policy: only the PIV PIN
+		return encodeTLV(pivTagDiscovery, util.Concat(encodeTLV(0x4F, pivAID), encodeTLV(0x5F2F, []byte{0x40, 0x00}))), pivSWSuccess
+	}
+	object, ok := server.client.PIVState().Objects[tag]
+	if !ok {
+		return nil, pivSWNotFound
+	}
+	return encodeTLV(0x53, object), pivSWSuccess
+}
+
+func (server *PIVServer) handlePutData(header pivAPDUHeader, data []byte) ([]byte, pivStatusWord) {
+	if header.Param1 != 0x3F || header.Param2 != 0xFF {
+		return nil, pivSWIncorrectParameters
+	}
+	if !server.managementAuthenticated {
+		return nil, pivSWSecurityNotSatisfied
+	}
+	tlvs, err := parseTLVs(data)
+	if err != nil {
+		return nil, pivSWWrongData
+	}
+	tag, ok := objectTag(tlvs)
+	object := findTLV(tlvs, 0x53)
+	if !ok || object == nil || tag == pivTagDiscovery {
+		return nil, pivSWWrongData
+	}
+	state := server.client.PIVState()
+	if len(object.value) == 0 {
+		delete(state.Objects, tag)
+	} else {
+		state.Objects[tag] = object.value
+	}
+	server.client.SavePIVState()
+	return nil, pivSWSuccess
+}
+
+func retriesStatus(retries int32) pivStatusWord {
+	if retries <= 0 {
+		return pivSWAuthenticationBlocked
+	}
+	return pivSWVerifyFailed | pivStatusWord(retries)
+}
+
+// checkReference compares a padded PIN or PUK with its hash, counting down the tries left
+func (server *PIVServer) checkReference(retries *int32, hash []byte, value []byte) pivStatusWord {
+	if *retries <= 0 {
+		return pivSWAuthenticationBlocked
+	}
+	if len(value) != identities.PIVPINLength {
+		return pivSWWrongData
+	}
+	if subtle.ConstantTimeCompare(identities.HashPIVPIN(value), hash) != 1 {
+		*retries--
+		server.client.SavePIVState()
+		return retriesStatus(*retries)
+	}
+	if *retries != identities.PIVDefaultRetries {
+		*retries = identities.PIVDefaultRetries
+		server.client.SavePIVState()
+	}
+	return pivSWSuccess
+}
+
+// validNewPIN checks a padded PIN is 6 to 8 characters
+func validNewPIN(value []byte) bool {
+	pin := bytes.TrimRight(value, "\xFF")
+	return len(value) == identities.PIVPINLength && len(pin) >= 6
+}
+
+func (server *PIVServer) handleVerify(header pivAPDUHeader, data []byte) pivStatusWord {
+	if header.Param2 != pivKeyPIN {
+		return pivSWReferenceNotFound
+	}
+	if header.Param1 == 0xFF {
+		server.pinVerified = false
+		return pivSWSuccess
+	}
+	state := server.client.PIVState()
+	if len(data) == 0 {
+		if server.pinVerified {
+			return pivSWSuccess
+		}
+		return retriesStatus(state.PINRetries)
+	}
+	status := server.checkReference(&state.PINRetries, state.PINHash, data)
+	server.pinVerified = status == pivSWSuccess
+	return status
+}
+
+func (server *PIVServer) handleChangeReferenceData(header pivAPDUHeader, data []byte) pivStatusWord {
+	if len(data) != 2*identities.PIVPINLength {
+		return pivSWWrongData
+	}
+	state := server.client.PIVState()
+	oldValue, newValue := data[:identities.PIVPINLength], data[identities.PIVPINLength:]
+	if !validNewPIN(newValue) {
+		return pivSWWrongData
+	}
+	switch header.Param2 {
+	case pivKeyPIN:
+		status := server.checkReference(&state.PINRetries, state.PINHash, oldValue)
+		if status != pivSWSuccess {
+			return status
+		}
+		state.PINHash = identities.HashPIVPIN(newValue)
+	case pivKeyPUK:
+		status := server.checkReference(&state.PUKRetries, state.PUKHash, oldValue)
+		if status != pivSWSuccess {
+			return status
+		}
+		state.PUKHash = identities.HashPIVPIN(newValue)
+	default:
+		return pivSWReferenceNotFound
+	}
+	server.client.SavePIVState()
+	return pivSWSuccess
+}
+
+func (server *PIVServer) handleResetRetryCounter(header pivAPDUHeader, data []byte) pivStatusWord {
+	if header.Param2 != pivKeyPIN {
+		return pivSWReferenceNotFound
+	}
+	if len(data) != 2*identities.PIVPINLength || !validNewPIN(data[identities.PIVPINLength:]) {
+		return pivSWWrongData
+	}
+	state := server.client.PIVState()
+	status := server.checkReference(&state.PUKRetries, state.PUKHash, data[:identities.PIVPINLength])
+	if status != pivSWSuccess {
+		return status
+	}
+	state.PINHash = identities.HashPIVPIN(data[identities.PIVPINLength:])
+	state.PINRetries = identities.PIVDefaultRetries
+	server.client.SavePIVState()
+	return pivSWSuccess
+}
+
+func curveForAlgorithm(algorithm uint8) elliptic.Curve {
+	switch algorithm {
+	case pivAlgorithmECCP256:
+		return elliptic.P256()
+	case pivAlgorithmECCP384:
+		return elliptic.P384()
+	default:
+		return nil
+	}
+}
+
+// isKeySlot is true for the four standard slots and the twenty retired key slots
+func isKeySlot(slot uint8) bool {
+	return (slot >= 0x9A && slot <= 0x9E && slot != pivKeyManagement) || (slot >= 0x82 && slot <= 0x95)
+}
+
+func (server *PIVServer) handleGenerateKeyPair(header pivAPDUHeader, data []byte) ([]byte, pivStatusWord) {
+	slot := header.Param2
+	if header.Param1 != 0x00 || !isKeySlot(slot) {
+		return nil, pivSWIncorrectParameters
+	}
+	if !server.managementAuthenticated {
+		return nil, pivSWSecurityNotSatisfied
+	}
+	tlvs, err := parseTLVs(data)
+	if err != nil {
+		return nil, pivSWWrongData
+	}
+	template := findTLV(tlvs, 0xAC)
+	if template == nil {
+		return nil, pivSWWrongData
+	}
+	controls, err := parseTLVs(template.value)
+	if err != nil {
+		return nil, pivSWWrongData
+	}
+	algorithm := findTLV(controls, 0x80)
+	if algorithm == nil || len(algorithm.value) != 1 {
+		return nil, pivSWWrongData
+	}
+	curve := curveForAlgorithm(algorithm.value[0])
+	if curve == nil {
+		return nil, pivSWWrongData
+	}
+	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	util.CheckErr(err, "Could not generate PIV key")
+	state := server.client.PIVState()
+	state.Keys[slot] = &identities.PIVKey{Algorithm: algorithm.value[0], PrivateKey: privateKey}
+	server.client.SavePIVState()
+	pivLogger.Printf("Generated key 0x%x in slot 0x%x\n\n", algorithm.value[0], slot)
+	point := elliptic.Marshal(curve, privateKey.X, privateKey.Y)
+	return encodeTLV(0x7F49, encodeTLV(0x86, point)), pivSWSuccess
+}
+
+func (server *PIVServer) handleGeneralAuthenticate(header pivAPDUHeader, data []byte) ([]byte, pivStatusWord) {
+	tlvs, err := parseTLVs(data)
+	if err != nil {
+		return nil, pivSWWrongData
+	}
+	template := findTLV(tlvs, 0x7C)
+	if template == nil {
+		return nil, pivSWWrongData
+	}
+	fields, err := parseTLVs(template.value)
+	if err != nil {
+		return nil, pivSWWrongData
+	}
+	if header.Param2 == pivKeyManagement {
+		return server.authenticateManagementKey(header.Param1, fields)
+	}
+	return server.useKey(header.Param1, header.Param2, fields)
+}
+
+// authenticateManagementKey runs either mutual authentication, where the card first sends an
+// encrypted witness, or external authentication, where the host encrypts a challenge
+func (server *PIVServer) authenticateManagementKey(algorithm uint8, fields []tlv) ([]byte, pivStatusWord) {
+	if algorithm != pivAlgorithm3DES {
+		return nil, pivSWIncorrectParameters
+	}
+	block, err := des.NewTripleDESCipher(server.client.PIVState().ManagementKey)
+	if err != nil {
+		return nil, pivSWConditionsNotSatisfied
+	}
+	witness := findTLV(fields, 0x80)
+	challenge := findTLV(fields, 0x81)
+	response := findTLV(fields, 0x82)
+	switch {
+	case witness != nil && len(witness.value) == 0:
+		server.managementWitness = crypto.RandomBytes(block.BlockSize())
+		encrypted := encryptBlock(block, server.managementWitness)
+		return encodeTLV(0x7C, encodeTLV(0x80, encrypted)), pivSWSuccess
+	case witness != nil && challenge != nil:
+		expected := server.managementWitness
+		server.managementWitness = nil
+		if expected == nil || subtle.ConstantTimeCompare(witness.value, expected) != 1 || len(challenge.value) != block.BlockSize() {
+			return nil, pivSWSecurityNotSatisfied
+		}
+		server.managementAuthenticated = true
+		return encodeTLV(0x7C, encodeTLV(0x82, encryptBlock(block, challenge.value))), pivSWSuccess
+	case challenge != nil && len(challenge.value) == 0:
+		server.managementChallenge = crypto.RandomBytes(block.BlockSize())
+		return encodeTLV(0x7C, encodeTLV(0x81, server.managementChallenge)), pivSWSuccess
+	case response != nil:
+		expected := server.managementChallenge
+		server.managementChallenge = nil
+		if expected == nil || subtle.ConstantTimeCompare(response.value, encryptBlock(block, expected)) != 1 {
+			return nil, pivSWSecurityNotSatisfied
+		}
+		server.managementAuthenticated = true
+		return nil, pivSWSuccess
+	default:
+		return nil, pivSWWrongData
+	}
+}
+
+func encryptBlock(block cipher.Block, data []byte) []byte {
+	encrypted := make([]byte, block.BlockSize())
+	block.Encrypt(encrypted, data)
+	return encrypted
+}
+
+// useKey signs a digest (81) or derives an ECDH secret with a peer's public key (85)
+func (server *PIVServer) useKey(algorithm uint8, slot uint8, fields []tlv) ([]byte, pivStatusWord) {
+	if !isKeySlot(slot) {
+		return nil, pivSWIncorrectParameters
+	}
+	key, ok := server.client.PIVState().Keys[slot]
+	if !ok {
+		return nil, pivSWReferenceNotFound
+	}
+	if key.Algorithm != algorithm {
+		return nil, pivSWIncorrectParameters
+	}
+	if slot != pivSlotCardAuthentication && !server.pinVerified {
+		return nil, pivSWSecurityNotSatisfied
+	}
+	if slot == pivSlotSignature {
+		// The signature key needs the PIN before every use
+		server.pinVerified = false
+	}
+	response := findTLV(fields, 0x82)
+	challenge := findTLV(fields, 0x81)
+	exponentiation := findTLV(fields, 0x85)
+	if response == nil || len(response.value) != 0 {
+		return nil, pivSWWrongData
+	}
+	var result []byte
+	switch {
+	case challenge != nil:
+		signature, err := ecdsa.SignASN1(rand.Reader, key.PrivateKey, challenge.value)
+		util.CheckErr(err, "Could not sign with PIV key")
+		result = signature
+	case exponentiation != nil:
+		curve := key.PrivateKey.Curve
+		x, y := elliptic.Unmarshal(curve, exponentiation.value)
+		if x == nil {
+			return nil, pivSWWrongData
+		}
+		sharedX, _ := curve.ScalarMult(x, y, key.PrivateKey.D.Bytes())
+		result = make([]byte, (curve.Params().BitSize+7)/8)
+		sharedX.FillBytes(result)
+	default:
+		return nil, pivSWWrongData
+	}
+	pivLogger.Printf("Used key in slot 0x%x\n\n", slot)
+	return encodeTLV(0x7C, encodeTLV(0x82, result)), pivSWSuccess
+}
+
+// Short APDUs can't carry more than 256 bytes of response, so longer responses are
+// split and the rest is fetched with GET RESPONSE
+func (server *PIVServer) chainResponse(response []byte, maxLength int) []byte {
+	if maxLength == 0 {
+		maxLength = 256
+	}
+	data := response[:len(response)-2]
+	status := response[len(response)-2:]
+	if len(data) <= maxLength {
+		server.pendingResponse = nil
+		return response
+	}
+	server.pendingResponse = append(data[maxLength:len(data):len(data)], status...)
+	remaining := len(server.pendingResponse) - 2
+	if remaining > 0xFF {
+		// 0x00 means 256 or more bytes remain
+		remaining = 0
+	}
+	return util.Concat(data[:maxLength], util.ToBE(pivSWBytesRemaining|pivStatusWord(remaining)))
+}
+
+func (server *PIVServer) handleGetResponse(maxLength int) []byte {
+	if server.pendingResponse == nil {
+		return util.ToBE(pivSWConditionsNotSatisfied)
+	}
+	return server.chainResponse(server.pendingResponse, maxLength)
+}
@@ -0,0 +1,203 @@
+package piv
+
+import (
+	"bytes"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type dummyPIVClient struct {
+	state *identities.PIVState
+	saves int
+}
+
+func (client *dummyPIVClient) PIVState() *identities.PIVState {
+	return client.state
+}
+
+func (client *dummyPIVClient) SavePIVState() {
+	client.saves++
+}
+
+func newTestServer() (*PIVServer, *dummyPIVClient) {
+	client := &dummyPIVClient{state: identities.NewPIVState()}
+	server := NewPIVServer(client)
+	server.ATR()
+	return server, client
+}
+
+func command(cla uint8, instruction pivInstruction, p1 uint8, p2 uint8, data []byte) []byte {
+	apdu := []byte{cla, uint8(instruction), p1, p2}
+	if len(data) > 0 {
+		apdu = append(apdu, uint8(len(data)))
+		apdu = append(apdu, data...)
+	}
+	return append(apdu, 0x00)
+}
+
+func send(t *testing.T, server *PIVServer, apdu []byte, expected pivStatusWord) []byte {
+	response := server.HandleAPDU(apdu)
+	test.Assert(t, len(response) >= 2, "Response too short")
+	status := pivStatusWord(util.FromBE[uint16](response[len(response)-2:]))
+	test.AssertEqual(t, status, expected, "Unexpected status word")
+	return response[:len(response)-2]
+}
+
+func paddedPIN(pin string) []byte {
+	padded := bytes.Repeat([]byte{0xFF}, identities.PIVPINLength)
+	copy(padded, pin)
+	return padded
+}
+
+func authenticateManagementKey(t *testing.T, server *PIVServer) {
+	block, err := des.NewTripleDESCipher(identities.PIVDefaultManagementKey)
+	test.Assert(t, err == nil, "Could not create cipher")
+	request := encodeTLV(0x7C, encodeTLV(0x80, nil))
+	response := send(t, server, command(0x00, pivInsGeneralAuthenticate, pivAlgorithm3DES, pivKeyManagement, request), pivSWSuccess)
+	tlvs, err := parseTLVs(response)
+	test.Assert(t, err == nil && len(tlvs) == 1, "Invalid witness response")
+	fields, _ := parseTLVs(tlvs[0].value)
+	encryptedWitness := findTLV(fields, 0x80)
+	test.Assert(t, encryptedWitness != nil, "Missing witness")
+	witness := make([]byte, 8)
+	block.Decrypt(witness, encryptedWitness.value)
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	request = encodeTLV(0x7C, util.Concat(encodeTLV(0x80, witness), encodeTLV(0x81, challenge)))
+	response = send(t, server, command(0x00, pivInsGeneralAuthenticate, pivAlgorithm3DES, pivKeyManagement, request), pivSWSuccess)
+	tlvs, _ = parseTLVs(response)
+	fields, _ = parseTLVs(tlvs[0].value)
+	encryptedChallenge := findTLV(fields, 0x82)
+	test.Assert(t, encryptedChallenge != nil, "Missing challenge response")
+	test.Assert(t, bytes.Equal(encryptedChallenge.value, encryptBlock(block, challenge)), "Card encrypted challenge incorrectly")
+}
+
+func TestSelect(t *testing.T) {
+	server, _ := newTestServer()
+	response := send(t, server, command(0x00, pivInsSelect, 0x04, 0x00, pivAID[:5]), pivSWSuccess)
+	tlvs, err := parseTLVs(response)
+	test.Assert(t, err == nil, "Could not parse template")
+	test.AssertEqual(t, tlvs[0].tag, 0x61, "Missing application property template")
+	send(t, server, command(0x00, pivInsSelect, 0x04, 0x00, []byte{0xA0, 0x00, 0x00, 0x06, 0x47}), pivSWNotFound)
+	send(t, server, command(0x80, pivInsSelect, 0x04, 0x00, pivAID), pivSWClassNotSupported)
+}
+
+func TestVerifyPIN(t *testing.T) {
+	server, client := newTestServer()
+	send(t, server, command(0x00, pivInsVerify, 0x00, pivKeyPIN, nil), pivSWVerifyFailed|3)
+	send(t, server, command(0x00, pivInsVerify, 0x00, pivKeyPIN, paddedPIN("654321")), pivSWVerifyFailed|2)
+	send(t, server, command(0x00, pivInsVerify, 0x00, pivKeyPIN, paddedPIN("123456")), pivSWSuccess)
+	test.AssertEqual(t, client.state.PINRetries, int32(identities.PIVDefaultRetries), "Retries should reset")
+	send(t, server, command(0x00, pivInsVerify, 0x00, pivKeyPIN, nil), pivSWSuccess)
+
+	newPIN := util.Concat(paddedPIN("123456"), paddedPIN("abcdef"))
+	send(t, server, command(0x00, pivInsChangeReferenceData, 0x00, pivKeyPIN, newPIN), pivSWSuccess)
+	for i := 0; i < identities.PIVDefaultRetries; i++ {
+		server.HandleAPDU(command(0x00, pivInsVerify, 0x00, pivKeyPIN, paddedPIN("123456")))
+	}
+	send(t, server, command(0x00, pivInsVerify, 0x00, pivKeyPIN, paddedPIN("abcdef")), pivSWAuthenticationBlocked)
+	reset := util.Concat(paddedPIN("12345678"), paddedPIN("987654"))
+	send(t, server, command(0x00, pivInsResetRetryCounter, 0x00, pivKeyPIN, reset), pivSWSuccess)
+	send(t, server, command(0x00, pivInsVerify, 0x00, pivKeyPIN, paddedPIN("987654")), pivSWSuccess)
+	test.Assert(t, client.saves > 0, "PIN changes should be saved")
+}
+
+func TestGenerateAndSign(t *testing.T) {
+	server, client := newTestServer()
+	generate := encodeTLV(0xAC, encodeTLV(0x80, []byte{pivAlgorithmECCP256}))
+	send(t, server, command(0x00, pivInsGenerateKeyPair, 0x00, 0x9A, generate), pivSWSecurityNotSatisfied)
+	authenticateManagementKey(t, server)
+	response := send(t, server, command(0x00, pivInsGenerateKeyPair, 0x00, 0x9A, generate), pivSWSuccess)
+	tlvs, err := parseTLVs(response)
+	test.Assert(t, err == nil && tlvs[0].tag == 0x7F49, "Missing public key template")
+	fields, _ := parseTLVs(tlvs[0].value)
+	point := findTLV(fields, 0x86)
+	test.Assert(t, point != nil, "Missing public key")
+	x, y := elliptic.Unmarshal(elliptic.P256(), point.value)
+	test.Assert(t, x != nil, "Invalid public key")
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	test.Assert(t, client.state.Keys[0x9A] != nil, "Key should be stored in the vault")
+
+	digest := sha256.Sum256([]byte("data to sign"))
+	sign := encodeTLV(0x7C, util.Concat(encodeTLV(0x82, nil), encodeTLV(0x81, digest[:])))
+	send(t, server, command(0x00, pivInsGeneralAuthenticate, pivAlgorithmECCP256, 0x9A, sign), pivSWSecurityNotSatisfied)
+	send(t, server, command(0x00, pivInsVerify, 0x00, pivKeyPIN, paddedPIN("123456")), pivSWSuccess)
+	send(t, server, command(0x00, pivInsGeneralAuthenticate, pivAlgorithmECCP384, 0x9A, sign), pivSWIncorrectParameters)
+	response = send(t, server, command(0x00, pivInsGeneralAuthenticate, pivAlgorithmECCP256, 0x9A, sign), pivSWSuccess)
+	tlvs, _ = parseTLVs(response)
+	fields, _ = parseTLVs(tlvs[0].value)
+	signature := findTLV(fields, 0x82)
+	test.Assert(t, signature != nil, "Missing signature")
+	test.Assert(t, ecdsa.VerifyASN1(publicKey, digest[:], signature.value), "Invalid signature")
+
+	// A power cycle drops the PIN
+	server.ATR()
+	send(t, server, command(0x00, pivInsGeneralAuthenticate, pivAlgorithmECCP256, 0x9A, sign), pivSWSecurityNotSatisfied)
+}
+
+func TestDataObjects(t *testing.T) {
+	server, client := newTestServer()
+	tag := []byte{0x5F, 0xC1, 0x05}
+	get := encodeTLV(0x5C, tag)
+	send(t, server, command(0x00, pivInsGetData, 0x3F, 0xFF, get), pivSWNotFound)
+
+	certificate := bytes.Repeat([]byte{0xAB}, 600)
+	put := util.Concat(encodeTLV(0x5C, tag), encodeTLV(0x53, encodeTLV(0x70, certificate)))
+	send(t, server, command(0x00, pivInsPutData, 0x3F, 0xFF, put[:200]), pivSWSecurityNotSatisfied)
+	authenticateManagementKey(t, server)
+	// Too long for one short APDU, so it's sent with command chaining
+	send(t, server, command(pivClaChaining, pivInsPutData, 0x3F, 0xFF, put[:250]), pivSWSuccess)
+	send(t, server, command(pivClaChaining, pivInsPutData, 0x3F, 0xFF, put[250:500]), pivSWSuccess)
+	send(t, server, command(0x00, pivInsPutData, 0x3F, 0xFF, put[500:]), pivSWSuccess)
+	test.Assert(t, client.state.Objects[0x5FC105] != nil, "Object should be stored in the vault")
+
+	// The response is longer than a short APDU allows, so it comes back with GET RESPONSE
+	response := send(t, server, command(0x00, pivInsGetData, 0x3F, 0xFF, get), pivSWBytesRemaining)
+	for len(response) < len(certificate) {
+		more := server.HandleAPDU([]byte{0x00, uint8(pivInsGetResponse), 0x00, 0x00, 0x00})
+		response = append(response, more[:len(more)-2]...)
+		if more[len(more)-2] != 0x61 {
+			test.AssertEqual(t, util.FromBE[uint16](more[len(more)-2:]), uint16(pivSWSuccess), "GET RESPONSE failed")
+			break
+		}
+	}
+	tlvs, err := parseTLVs(response)
+	test.Assert(t, err == nil && tlvs[0].tag == 0x53, "Invalid data object")
+	test.Assert(t, bytes.Equal(tlvs[0].value, encodeTLV(0x70, certificate)), "Data object changed")
+
+	response = send(t, server, command(0x00, pivInsGetData, 0x3F, 0xFF, encodeTLV(0x5C, []byte{0x7E})), pivSWSuccess)
+	test.AssertEqual(t, response[0], uint8(pivTagDiscovery), "Missing discovery object")
+}
+
+func TestPIVStateExport(t *testing.T) {
+	server, client := newTestServer()
+	authenticateManagementKey(t, server)
+	generate := encodeTLV(0xAC, encodeTLV(0x80, []byte{pivAlgorithmECCP384}))
+	send(t, server, command(0x00, pivInsGenerateKeyPair, 0x00, 0x9E, generate), pivSWSuccess)
+	client.state.Objects[0x5FC102] = []byte{1, 2, 3}
+	imported, err := identities.ImportPIVState(client.state.Export())
+	test.Assert(t, err == nil, "Could not import PIV state")
+	test.Assert(t, imported.Keys[0x9E].PrivateKey.Equal(client.state.Keys[0x9E].PrivateKey), "Key changed")
+	test.AssertEqual(t, imported.Keys[0x9E].Algorithm, pivAlgorithmECCP384, "Algorithm changed")
+	test.Assert(t, bytes.Equal(imported.Objects[0x5FC102], []byte{1, 2, 3}), "Object changed")
+	test.Assert(t, bytes.Equal(imported.PINHash, client.state.PINHash), "PIN changed")
+}
+
+func TestTLV(t *testing.T) {
+	long := bytes.Repeat([]byte{1}, 300)
+	encoded := util.Concat(encodeTLV(0x7F49, encodeTLV(0x86, long)), encodeTLV(0x5C, []byte{0x7E}))
+	tlvs, err := parseTLVs(encoded)
+	test.Assert(t, err == nil, "Could not parse TLVs")
+	test.AssertEqual(t, len(tlvs), 2, "Wrong number of TLVs")
+	test.AssertEqual(t, tlvs[0].tag, 0x7F49, "Two byte tag parsed incorrectly")
+	inner, _ := parseTLVs(tlvs[0].value)
+	test.Assert(t, bytes.Equal(inner[0].value, long), "Long value parsed incorrectly")
+	_, err = parseTLVs([]byte{0x53, 0x05, 0x01})
+	test.Assert(t, err != nil, "Truncated TLV should fail")
+}
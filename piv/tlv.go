@@ -0,0 +1,87 @@
+package piv
+
+import (
+	"fmt"
+)
+
+type tlv struct {
+	tag   uint32
+	value []byte
+}
+
+// encodeTLV encodes a BER-TLV with a one to three byte tag
+func encodeTLV(tag uint32, value []byte) []byte {
+	var encoded []byte
+	switch {
+	case tag > 0xFFFF:
+		encoded = []byte{uint8(tag >> 16), uint8(tag >> 8), uint8(tag)}
+	case tag > 0xFF:
+		encoded = []byte{uint8(tag >> 8), uint8(tag)}
+	default:
+		encoded = []byte{uint8(tag)}
+	}
+	length := len(value)
+	switch {
+	case length < 0x80:
+		encoded = append(encoded, uint8(length))
+	case length <= 0xFF:
+		encoded = append(encoded, 0x81, uint8(length))
+	default:
+		encoded = append(encoded, 0x82, uint8(length>>8), uint8(length))
+	}
+	return append(encoded, value...)
+}
+
+// parseTLVs splits data into its top level BER-TLVs
+func parseTLVs(data []byte) ([]tlv, error) {
+	tlvs := make([]tlv, 0)
+	for len(data) > 0 {
+		tag := uint32(data[0])
+		data = data[1:]
+		if tag&0x1F == 0x1F {
+			// Multi-byte tag, continued while the high bit is set
+			for {
+				if len(data) == 0 {
+					return nil, fmt.Errorf("Truncated TLV tag")
+				}
+				tag = tag<<8 | uint32(data[0])
+				data = data[1:]
+				if tag&0x80 == 0 {
+					break
+				}
+			}
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("Missing length for TLV 0x%x", tag)
+		}
+		length := int(data[0])
+		data = data[1:]
+		if length > 0x80 {
+			lengthBytes := length & 0x7F
+			if lengthBytes > 2 || len(data) < lengthBytes {
+				return nil, fmt.Errorf("Invalid length for TLV 0x%x", tag)
+			}
+			length = 0
+			for _, b := range data[:lengthBytes] {
+				length = length<<8 | int(b)
+			}
+			data = data[lengthBytes:]
+		}
+		if len(data) < length {
+			return nil, fmt.Errorf("TLV 0x%x is longer than its data", tag)
+		}
+		tlvs = append(tlvs, tlv{tag: tag, value: data[:length]})
+		data = data[length:]
+	}
+	return tlvs, nil
+}
+
+// findTLV returns the first TLV with tag, or nil
+func findTLV(tlvs []tlv, tag uint32) *tlv {
+	for i := range tlvs {
+		if tlvs[i].tag == tag {
+			return &tlvs[i]
+		}
+	}
+	return nil
+}
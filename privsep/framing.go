@@ -0,0 +1,151 @@
+package privsep
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var privsepLogger = util.NewLogger("[PRIVSEP] ", util.LogSubsystemPrivsep, util.LogLevelDebug)
+
+const (
+	privsepMagic = "VFPS"
+	// Version 2 added U2F SESSION frames
+	privsepVersion = 2
+	// Larger than any CTAPHID message, which tops out under 8KB at full speed
+	privsepMaxPayloadLength = 0x10000
+	privsepNonceLength      = 16
+)
+
+type frameType uint8
+
+const (
+	// Opens the handshake from the transport, and answers it from the key daemon
+	frameHello frameType = 1
+	// The transport's proof that it knows the secret
+	frameAuth frameType = 2
+	// The key daemon accepted the handshake
+	frameReady frameType = 3
+	// Requests carry a decoded CTAP2 or U2F message, and are answered with a response
+	// carrying the same ID
+	frameCTAP     frameType = 4
+	frameU2F      frameType = 5
+	frameResponse frameType = 6
+	// A U2F message whose payload starts with the big endian session of the message, for the
+	// U2F server's per-channel APDU chaining
+	frameU2FSession frameType = 7
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameHello:
+		return "HELLO"
+	case frameAuth:
+		return "AUTH"
+	case frameReady:
+		return "READY"
+	case frameCTAP:
+		return "CTAP"
+	case frameU2F:
+		return "U2F"
+	case frameResponse:
+		return "RESPONSE"
+	case frameU2FSession:
+		return "U2F SESSION"
+	}
+	return fmt.Sprintf("0x%x", uint8(t))
+}
+
+type frameHeader struct {
+	Type   frameType
+	ID     uint32
+	Length uint32
+}
+
+type frame struct {
+	frameType frameType
+	id        uint32
+	payload   []byte
+}
+
+// writeFrame writes the frame in one call, so frames from concurrent writers holding a lock
+// don't interleave on a stream socket
+func writeFrame(writer io.Writer, f frame) error {
+	if len(f.payload) > privsepMaxPayloadLength {
+		return fmt.Errorf("Frame payload too large: %d", len(f.payload))
+	}
+	header := frameHeader{Type: f.frameType, ID: f.id, Length: uint32(len(f.payload))}
+	_, err := writer.Write(util.Concat(util.ToBE(header), f.payload))
+	return err
+}
+
+func readFrame(reader io.Reader) (frame, error) {
+	var header frameHeader
+	err := binary.Read(reader, binary.BigEndian, &header)
+	if err != nil {
+		return frame{}, err
+	}
+	if header.Length > privsepMaxPayloadLength {
+		return frame{}, fmt.Errorf("Frame payload too large: %d", header.Length)
+	}
+	payload := make([]byte, header.Length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return frame{}, fmt.Errorf("Could not read frame payload: %w", err)
+	}
+	return frame{frameType: header.Type, id: header.ID, payload: payload}, nil
+}
+
+// hello is exchanged first by both sides. Each side proves it knows the shared secret by
+// MACing the other side's nonce, so neither can be replayed.
+type hello struct {
+	Magic   [4]byte
+	Version uint8
+	Nonce   [privsepNonceLength]byte
+}
+
+func newHello() hello {
+	message := hello{Version: privsepVersion}
+	copy(message.Magic[:], privsepMagic)
+	copy(message.Nonce[:], crypto.RandomBytes(privsepNonceLength))
+	return message
+}
+
+// parseHello also returns anything after the hello, which is the key daemon's proof
+func parseHello(f frame) (hello, []byte, error) {
+	var message hello
+	if f.frameType != frameHello {
+		return message, nil, fmt.Errorf("Expected HELLO, got %s", f.frameType)
+	}
+	reader := bytes.NewReader(f.payload)
+	err := binary.Read(reader, binary.BigEndian, &message)
+	if err != nil {
+		return message, nil, fmt.Errorf("Invalid HELLO: %w", err)
+	}
+	if string(message.Magic[:]) != privsepMagic {
+		return message, nil, fmt.Errorf("Invalid HELLO magic: %q", message.Magic[:])
+	}
+	if message.Version != privsepVersion {
+		return message, nil, fmt.Errorf("Unsupported protocol version %d, expected %d", message.Version, privsepVersion)
+	}
+	return message, f.payload[len(f.payload)-reader.Len():], nil
+}
+
+// Labels keep the key daemon's proof from being reflected back as the transport's
+const (
+	proofLabelKeyDaemon = "virtual-fido key daemon"
+	proofLabelTransport = "virtual-fido transport"
+)
+
+func handshakeProof(secret []byte, label string, nonce [privsepNonceLength]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	mac.Write(nonce[:])
+	return mac.Sum(nil)
+}
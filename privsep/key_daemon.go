@@ -0,0 +1,130 @@
+package privsep
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// How long a connecting transport has to complete the handshake
+const handshakeTimeout = 5 * time.Second
+
+// KeyDaemon holds the credentials and answers the decoded CTAP2 and U2F messages forwarded
+// by a Transport, so the process parsing USB traffic never sees a private key
+type KeyDaemon struct {
+	ctapServer ctap_hid.CTAPHIDClient
+	u2fServer  ctap_hid.CTAPHIDClient
+	secret     []byte
+}
+
+// NewKeyDaemon serves ctapServer and u2fServer, usually a ctap.CTAPServer and u2f.U2FServer,
+// to transports that know secret
+func NewKeyDaemon(ctapServer ctap_hid.CTAPHIDClient, u2fServer ctap_hid.CTAPHIDClient, secret []byte) *KeyDaemon {
+	return &KeyDaemon{ctapServer: ctapServer, u2fServer: u2fServer, secret: secret}
+}
+
+// Serve handles every transport accepted by listener until the listener is closed
+func (daemon *KeyDaemon) Serve(listener net.Listener) error {
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go daemon.handleConnection(connection)
+	}
+}
+
+func (daemon *KeyDaemon) handleConnection(connection net.Conn) {
+	defer connection.Close()
+	err := daemon.handshake(connection)
+	if err != nil {
+		privsepLogger.Printf("ERROR: Handshake with %s failed: %s\n\n", connection.RemoteAddr(), err)
+		return
+	}
+	privsepLogger.Printf("Transport connected from %s\n\n", connection.RemoteAddr())
+	writeLock := &sync.Mutex{}
+	for {
+		request, err := readFrame(connection)
+		if err != nil {
+			privsepLogger.Printf("Transport disconnected: %s\n\n", err)
+			return
+		}
+		var handle func() []byte
+		switch request.frameType {
+		case frameCTAP:
+			handle = func() []byte { return daemon.ctapServer.HandleMessage(request.payload) }
+		case frameU2F:
+			handle = func() []byte { return daemon.u2fServer.HandleMessage(request.payload) }
+		case frameU2FSession:
+			if len(request.payload) < 4 {
+				privsepLogger.Printf("ERROR: %s frame without a session\n\n", request.frameType)
+				return
+			}
+			handle = func() []byte { return daemon.handleU2FSession(request.payload) }
+		default:
+			privsepLogger.Printf("ERROR: Unexpected %s frame from transport\n\n", request.frameType)
+			return
+		}
+		// Requests from different channels can wait on approvals at the same time
+		go func() {
+			var response []byte
+			util.Try(func() {
+				response = handle()
+			}, func(err interface{}) {
+				privsepLogger.Printf("ERROR: %s request failed: %v\n\n", request.frameType, err)
+				response = errorResponse(request.frameType)
+			})
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			err := writeFrame(connection, frame{frameType: frameResponse, id: request.id, payload: response})
+			if err != nil {
+				privsepLogger.Printf("ERROR: Could not send response: %s\n\n", err)
+			}
+		}()
+	}
+}
+
+// handleU2FSession handles the payload of a U2F SESSION frame, a session and a U2F message
+func (daemon *KeyDaemon) handleU2FSession(payload []byte) []byte {
+	session := binary.BigEndian.Uint32(payload)
+	if sessions, ok := daemon.u2fServer.(ctap_hid.SessionCTAPHIDClient); ok {
+		return sessions.HandleSessionMessage(util.NewTraceID(), session, payload[4:])
+	}
+	return daemon.u2fServer.HandleMessage(payload[4:])
+}
+
+func (daemon *KeyDaemon) handshake(connection net.Conn) error {
+	connection.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer connection.SetDeadline(time.Time{})
+	request, err := readFrame(connection)
+	if err != nil {
+		return fmt.Errorf("Could not read HELLO: %w", err)
+	}
+	transportHello, _, err := parseHello(request)
+	if err != nil {
+		return err
+	}
+	daemonHello := newHello()
+	proof := handshakeProof(daemon.secret, proofLabelKeyDaemon, transportHello.Nonce)
+	err = writeFrame(connection, frame{frameType: frameHello, payload: util.Concat(util.ToBE(daemonHello), proof)})
+	if err != nil {
+		return fmt.Errorf("Could not send HELLO: %w", err)
+	}
+	auth, err := readFrame(connection)
+	if err != nil {
+		return fmt.Errorf("Could not read AUTH: %w", err)
+	}
+	if auth.frameType != frameAuth {
+		return fmt.Errorf("Expected AUTH, got %s", auth.frameType)
+	}
+	if !hmac.Equal(auth.payload, handshakeProof(daemon.secret, proofLabelTransport, daemonHello.Nonce)) {
+		return fmt.Errorf("Transport does not know the secret")
+	}
+	return writeFrame(connection, frame{frameType: frameReady})
+}
@@ -0,0 +1,150 @@
+package privsep
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type echoServer struct {
+	prefix byte
+}
+
+func (server *echoServer) HandleMessage(data []byte) []byte {
+	return append([]byte{server.prefix}, data...)
+}
+
+func (server *echoServer) HandleSessionMessage(trace util.TraceID, session uint32, data []byte) []byte {
+	return util.Concat([]byte{server.prefix}, util.ToBE(session), data)
+}
+
+// trackingListener remembers accepted connections so a test can simulate the key daemon dying
+type trackingListener struct {
+	net.Listener
+	lock        sync.Mutex
+	connections []net.Conn
+}
+
+func (listener *trackingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		listener.lock.Lock()
+		listener.connections = append(listener.connections, conn)
+		listener.lock.Unlock()
+	}
+	return conn, err
+}
+
+func (listener *trackingListener) kill() {
+	listener.Close()
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	for _, conn := range listener.connections {
+		conn.Close()
+	}
+}
+
+func startKeyDaemon(t *testing.T, address string, secret []byte) *trackingListener {
+	rawListener, err := net.Listen("unix", address)
+	test.Assert(t, err == nil, "Could not listen")
+	listener := &trackingListener{Listener: rawListener}
+	t.Cleanup(listener.kill)
+	daemon := NewKeyDaemon(&echoServer{prefix: 'C'}, &echoServer{prefix: 'U'}, secret)
+	go daemon.Serve(listener)
+	return listener
+}
+
+func newTestTransport(t *testing.T, address string, secret []byte) *Transport {
+	transport := NewTransport("unix", address, secret)
+	transport.SetReconnectTimeout(500 * time.Millisecond)
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	err := writeFrame(buffer, frame{frameType: frameCTAP, id: 7, payload: []byte{1, 2, 3}})
+	test.Assert(t, err == nil, "Could not write frame")
+	decoded, err := readFrame(buffer)
+	test.Assert(t, err == nil, "Could not read frame")
+	test.AssertEqual(t, decoded.frameType, frameCTAP, "Frame type should round trip")
+	test.AssertEqual(t, decoded.id, uint32(7), "Frame ID should round trip")
+	test.AssertArrEqual(t, decoded.payload, []byte{1, 2, 3}, "Payload should round trip")
+
+	err = writeFrame(buffer, frame{frameType: frameCTAP, payload: make([]byte, privsepMaxPayloadLength+1)})
+	test.Assert(t, err != nil, "Oversized frames should be rejected")
+}
+
+func TestForwardMessages(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "keys.sock")
+	secret := []byte("secret")
+	startKeyDaemon(t, address, secret)
+	transport := newTestTransport(t, address, secret)
+	test.Assert(t, transport.Connect() == nil, "Could not connect to key daemon")
+	test.AssertArrEqual(t, transport.CTAPServer().HandleMessage([]byte{0x04}), []byte{'C', 0x04}, "CTAP message should reach the CTAP server")
+	test.AssertArrEqual(t, transport.U2FServer().HandleMessage([]byte{0x01}), []byte{'U', 0x01}, "U2F message should reach the U2F server")
+	sessions, ok := transport.U2FServer().(ctap_hid.SessionCTAPHIDClient)
+	test.Assert(t, ok, "U2F server should keep sessions")
+	test.AssertArrEqual(t, sessions.HandleSessionMessage(0, 0x01020304, []byte{0x01}), []byte{'U', 1, 2, 3, 4, 0x01}, "U2F message should keep its session")
+}
+
+func TestWrongSecret(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "keys.sock")
+	startKeyDaemon(t, address, []byte("secret"))
+	transport := newTestTransport(t, address, []byte("wrong"))
+	test.Assert(t, transport.Connect() != nil, "Handshake should fail without the secret")
+	test.AssertArrEqual(t, transport.CTAPServer().HandleMessage([]byte{0x04}), []byte{ctapErrOther}, "CTAP requests should fail")
+	test.AssertArrEqual(t, transport.U2FServer().HandleMessage([]byte{0x01}), []byte{0x6F, 0x00}, "U2F requests should fail")
+}
+
+func TestReconnect(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "keys.sock")
+	secret := []byte("secret")
+	listener := startKeyDaemon(t, address, secret)
+	transport := newTestTransport(t, address, secret)
+	test.AssertArrEqual(t, transport.CTAPServer().HandleMessage([]byte{1}), []byte{'C', 1}, "First request should succeed")
+	listener.kill()
+	// Give the transport a moment to notice the key daemon is gone
+	time.Sleep(50 * time.Millisecond)
+	test.AssertArrEqual(t, transport.CTAPServer().HandleMessage([]byte{2}), []byte{ctapErrOther}, "Requests should fail while the key daemon is down")
+	startKeyDaemon(t, address, secret)
+	test.AssertArrEqual(t, transport.CTAPServer().HandleMessage([]byte{3}), []byte{'C', 3}, "Transport should reconnect to a restarted key daemon")
+}
+
+type blockingServer struct {
+	release chan struct{}
+}
+
+func (server *blockingServer) HandleMessage(data []byte) []byte {
+	if data[0] == 0 {
+		<-server.release
+	}
+	return data
+}
+
+func TestOutOfOrderResponses(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "keys.sock")
+	secret := []byte("secret")
+	listener, err := net.Listen("unix", address)
+	test.Assert(t, err == nil, "Could not listen")
+	t.Cleanup(func() { listener.Close() })
+	server := &blockingServer{release: make(chan struct{})}
+	go NewKeyDaemon(server, server, secret).Serve(listener)
+	transport := newTestTransport(t, address, secret)
+
+	slow := make(chan []byte)
+	go func() {
+		slow <- transport.CTAPServer().HandleMessage([]byte{0})
+	}()
+	// The second request finishes while the first is still waiting, e.g. on an approval
+	test.AssertArrEqual(t, transport.CTAPServer().HandleMessage([]byte{1}), []byte{1}, "Fast request should not wait on the slow one")
+	close(server.release)
+	test.AssertArrEqual(t, <-slow, []byte{0}, "Slow request should get its own response")
+}
@@ -0,0 +1,292 @@
+package privsep
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+const (
+	// CTAP1_ERR_OTHER and SW_UNKNOWN, returned when the key daemon can't answer
+	ctapErrOther      uint8  = 0x7F
+	u2fSWUnknown      uint16 = 0x6F00
+	reconnectTimeout         = 10 * time.Second
+	minReconnectDelay        = 100 * time.Millisecond
+	maxReconnectDelay        = 2 * time.Second
+)
+
+func errorResponse(requestType frameType) []byte {
+	if requestType == frameU2F || requestType == frameU2FSession {
+		return util.ToBE(u2fSWUnknown)
+	}
+	return []byte{ctapErrOther}
+}
+
+// Transport forwards CTAP2 and U2F messages to a KeyDaemon. It connects on first use and
+// reconnects whenever the connection drops, so either process can be restarted.
+type Transport struct {
+	network string
+	address string
+	secret  []byte
+	// How long a request waits for the key daemon to come back before it fails
+	reconnectTimeout time.Duration
+	lock             sync.Mutex
+	connection       *transportConnection
+	nextID           uint32
+	closed           bool
+}
+
+// NewTransport connects to the key daemon at address, e.g. NewTransport("unix",
+// "/run/virtual-fido-keys.sock", secret)
+func NewTransport(network string, address string, secret []byte) *Transport {
+	return &Transport{
+		network:          network,
+		address:          address,
+		secret:           secret,
+		reconnectTimeout: reconnectTimeout,
+	}
+}
+
+func (transport *Transport) SetReconnectTimeout(timeout time.Duration) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	transport.reconnectTimeout = timeout
+}
+
+// CTAPServer and U2FServer stand in for the servers given to the key daemon when creating
+// the CTAPHID server
+func (transport *Transport) CTAPServer() ctap_hid.CTAPHIDClient {
+	return &transportHandler{transport: transport, requestType: frameCTAP}
+}
+
+func (transport *Transport) U2FServer() ctap_hid.CTAPHIDClient {
+	return &u2fTransportHandler{transportHandler{transport: transport, requestType: frameU2F}}
+}
+
+// Connect waits for the key daemon to accept a connection, so a misconfiguration is found
+// before the device is attached
+func (transport *Transport) Connect() error {
+	_, err := transport.connect()
+	return err
+}
+
+// Close disconnects from the key daemon. Later requests fail.
+func (transport *Transport) Close() error {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	transport.closed = true
+	if transport.connection != nil {
+		transport.connection.fail()
+		transport.connection = nil
+	}
+	return nil
+}
+
+// connect returns the current connection, dialing with backoff if there isn't one
+func (transport *Transport) connect() (*transportConnection, error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	if transport.closed {
+		return nil, fmt.Errorf("Transport is closed")
+	}
+	if transport.connection != nil && !transport.connection.isFailed() {
+		return transport.connection, nil
+	}
+	transport.connection = nil
+	deadline := time.Now().Add(transport.reconnectTimeout)
+	delay := minReconnectDelay
+	for {
+		connection, err := transport.dial()
+		if err == nil {
+			privsepLogger.Printf("Connected to key daemon at %s\n\n", transport.address)
+			transport.connection = connection
+			go connection.readResponses()
+			return connection, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("Could not connect to key daemon: %w", err)
+		}
+		privsepLogger.Printf("Could not connect to key daemon, retrying in %s: %s\n\n", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (transport *Transport) dial() (*transportConnection, error) {
+	conn, err := net.Dial(transport.network, transport.address)
+	if err != nil {
+		return nil, err
+	}
+	err = transport.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Handshake failed: %w", err)
+	}
+	return &transportConnection{conn: conn, pending: make(map[uint32]chan []byte)}, nil
+}
+
+func (transport *Transport) handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	transportHello := newHello()
+	err := writeFrame(conn, frame{frameType: frameHello, payload: util.ToBE(transportHello)})
+	if err != nil {
+		return fmt.Errorf("Could not send HELLO: %w", err)
+	}
+	response, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("Could not read HELLO: %w", err)
+	}
+	daemonHello, proof, err := parseHello(response)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, handshakeProof(transport.secret, proofLabelKeyDaemon, transportHello.Nonce)) {
+		return fmt.Errorf("Key daemon does not know the secret")
+	}
+	proof = handshakeProof(transport.secret, proofLabelTransport, daemonHello.Nonce)
+	err = writeFrame(conn, frame{frameType: frameAuth, payload: proof})
+	if err != nil {
+		return fmt.Errorf("Could not send AUTH: %w", err)
+	}
+	ready, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("Key daemon rejected the handshake: %w", err)
+	}
+	if ready.frameType != frameReady {
+		return fmt.Errorf("Expected READY, got %s", ready.frameType)
+	}
+	return nil
+}
+
+func (transport *Transport) handleMessage(requestType frameType, message []byte) []byte {
+	// A request that couldn't be sent never reached the key daemon, so it's safe to retry
+	// once on a new connection
+	for attempt := 0; attempt < 2; attempt++ {
+		connection, err := transport.connect()
+		if err != nil {
+			privsepLogger.Printf("ERROR: %s\n\n", err)
+			return errorResponse(requestType)
+		}
+		transport.lock.Lock()
+		transport.nextID++
+		id := transport.nextID
+		transport.lock.Unlock()
+		result, err := connection.send(frame{frameType: requestType, id: id, payload: message})
+		if err != nil {
+			privsepLogger.Printf("ERROR: Could not send %s request: %s\n\n", requestType, err)
+			continue
+		}
+		response, ok := <-result
+		if !ok {
+			// The key daemon may have acted on it, so it isn't retried
+			privsepLogger.Printf("ERROR: Key daemon disconnected during %s request\n\n", requestType)
+			return errorResponse(requestType)
+		}
+		return response
+	}
+	return errorResponse(requestType)
+}
+
+type transportHandler struct {
+	transport   *Transport
+	requestType frameType
+}
+
+func (handler *transportHandler) HandleMessage(data []byte) []byte {
+	return handler.transport.handleMessage(handler.requestType, data)
+}
+
+// u2fTransportHandler also forwards the session of U2F messages, see ctap_hid.SessionCTAPHIDClient
+type u2fTransportHandler struct {
+	transportHandler
+}
+
+func (handler *u2fTransportHandler) HandleSessionMessage(trace util.TraceID, session uint32, data []byte) []byte {
+	return handler.transport.handleMessage(frameU2FSession, util.Concat(util.ToBE(session), data))
+}
+
+// transportConnection matches responses to requests, which may complete out of order
+type transportConnection struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	pending   map[uint32]chan []byte
+	failed    bool
+}
+
+func (connection *transportConnection) send(request frame) (<-chan []byte, error) {
+	result := make(chan []byte, 1)
+	connection.lock.Lock()
+	if connection.failed {
+		connection.lock.Unlock()
+		return nil, fmt.Errorf("Connection closed")
+	}
+	connection.pending[request.id] = result
+	connection.lock.Unlock()
+	connection.writeLock.Lock()
+	err := writeFrame(connection.conn, request)
+	connection.writeLock.Unlock()
+	if err != nil {
+		connection.lock.Lock()
+		delete(connection.pending, request.id)
+		connection.lock.Unlock()
+		connection.fail()
+		return nil, err
+	}
+	return result, nil
+}
+
+func (connection *transportConnection) readResponses() {
+	for {
+		response, err := readFrame(connection.conn)
+		if err != nil {
+			privsepLogger.Printf("Key daemon disconnected: %s\n\n", err)
+			connection.fail()
+			return
+		}
+		if response.frameType != frameResponse {
+			privsepLogger.Printf("ERROR: Unexpected %s frame from key daemon\n\n", response.frameType)
+			connection.fail()
+			return
+		}
+		connection.lock.Lock()
+		result, ok := connection.pending[response.id]
+		delete(connection.pending, response.id)
+		connection.lock.Unlock()
+		if !ok {
+			privsepLogger.Printf("ERROR: Response to unknown request %d\n\n", response.id)
+			continue
+		}
+		result <- response.payload
+	}
+}
+
+// fail closes the connection and fails every request waiting on it
+func (connection *transportConnection) fail() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	if connection.failed {
+		return
+	}
+	connection.failed = true
+	connection.conn.Close()
+	for id, result := range connection.pending {
+		close(result)
+		delete(connection.pending, id)
+	}
+}
+
+func (connection *transportConnection) isFailed() bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	return connection.failed
+}
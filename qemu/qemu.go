@@ -0,0 +1,102 @@
+// Package qemu passes the virtual key through to a QEMU/KVM guest. Once the device is
+// attached to this machine with USB/IP, QEMU's usb-host device hands it to the guest, either
+// added at runtime through the QMP monitor with Attach or configured on the command line with
+// HostDevice.Args.
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var qemuLogger = util.NewLogger("[QEMU] ", util.LogSubsystemGeneral, util.LogLevelDebug)
+
+const usbDevicesPath = "/sys/bus/usb/devices"
+
+// Product string of the virtual device, which has no vendor or product ID to match on
+const productName = "Virtual FIDO"
+
+// DefaultDeviceID is the QEMU device ID given to the key, to remove it again with Detach
+const DefaultDeviceID = "virtual-fido"
+
+// HostDevice is the virtual key as attached to this machine
+type HostDevice struct {
+	Bus     int
+	Address int
+}
+
+// FindHostDevice looks for the virtual key among the USB devices of this machine, only
+// matching one with serial if it isn't empty
+func FindHostDevice(serial string) (*HostDevice, error) {
+	return findHostDevice(usbDevicesPath, serial)
+}
+
+// WaitForHostDevice retries FindHostDevice until the device appears or timeout passes, as
+// it takes a moment after USB/IP attaches it
+func WaitForHostDevice(serial string, timeout time.Duration) (*HostDevice, error) {
+	deadline := util.Now().Add(timeout)
+	for {
+		device, err := FindHostDevice(serial)
+		if err == nil || util.Now().After(deadline) {
+			return device, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func findHostDevice(root string, serial string) (*HostDevice, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list USB devices: %w", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if readAttribute(path, "product") != productName {
+			continue
+		}
+		if serial != "" && readAttribute(path, "serial") != serial {
+			continue
+		}
+		bus, err := strconv.Atoi(readAttribute(path, "busnum"))
+		if err != nil {
+			continue
+		}
+		address, err := strconv.Atoi(readAttribute(path, "devnum"))
+		if err != nil {
+			continue
+		}
+		return &HostDevice{Bus: bus, Address: address}, nil
+	}
+	return nil, fmt.Errorf("Virtual key is not attached to this machine")
+}
+
+func readAttribute(path string, name string) string {
+	data, err := os.ReadFile(filepath.Join(path, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Options is the usb-host device option string for the key, as taken by -device or HMP's
+// device_add
+func (device *HostDevice) Options(id string) string {
+	return fmt.Sprintf("usb-host,hostbus=%d,hostaddr=%d,id=%s", device.Bus, device.Address, id)
+}
+
+// Args are QEMU command line arguments passing the key through. The guest needs a USB
+// controller, e.g. from -device qemu-xhci.
+func (device *HostDevice) Args(id string) []string {
+	return []string{"-device", device.Options(id)}
+}
+
+// MonitorCommand is the HMP command passing the key through to a running guest
+func (device *HostDevice) MonitorCommand(id string) string {
+	return "device_add " + device.Options(id)
+}
@@ -0,0 +1,38 @@
+package qemu
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func writeDevice(t *testing.T, root string, name string, attributes map[string]string) {
+	path := filepath.Join(root, name)
+	test.Assert(t, os.MkdirAll(path, 0755) == nil, "Could not create device")
+	for attribute, value := range attributes {
+		test.Assert(t, os.WriteFile(filepath.Join(path, attribute), []byte(value+"\n"), 0644) == nil, "Could not write attribute")
+	}
+}
+
+func TestFindHostDevice(t *testing.T) {
+	root := t.TempDir()
+	writeDevice(t, root, "1-1", map[string]string{"product": "Keyboard", "busnum": "1", "devnum": "2"})
+	writeDevice(t, root, "3-1", map[string]string{"product": "Virtual FIDO", "serial": "AAAA", "busnum": "3", "devnum": "4"})
+	writeDevice(t, root, "3-2", map[string]string{"product": "Virtual FIDO", "serial": "BBBB", "busnum": "3", "devnum": "5"})
+	// Interfaces have no device attributes
+	writeDevice(t, root, "3-2:1.0", map[string]string{})
+
+	device, err := findHostDevice(root, "BBBB")
+	test.Assert(t, err == nil, "Device should be found by serial")
+	test.AssertEqual(t, *device, HostDevice{Bus: 3, Address: 5}, "Bus and address should be read")
+	device, err = findHostDevice(root, "")
+	test.Assert(t, err == nil, "Any virtual device should be found without a serial")
+	test.AssertEqual(t, device.Bus, 3, "Only virtual devices should be found")
+	_, err = findHostDevice(root, "CCCC")
+	test.Assert(t, err != nil, "Other serials should not be found")
+
+	test.AssertEqual(t, device.MonitorCommand("key"), "device_add usb-host,hostbus=3,hostaddr=4,id=key", "Monitor command should name the host device")
+	test.AssertArrEqual(t, device.Args("key"), []string{"-device", "usb-host,hostbus=3,hostaddr=4,id=key"}, "Arguments should name the host device")
+}
@@ -0,0 +1,135 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Monitor is a connection to QEMU's QMP monitor, e.g. from -qmp unix:/tmp/qmp.sock,server
+type Monitor struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	Greeting *json.RawMessage `json:"QMP"`
+	Return   *json.RawMessage `json:"return"`
+	Event    string           `json:"event"`
+	Error    *struct {
+		Class       string `json:"class"`
+		Description string `json:"desc"`
+	} `json:"error"`
+}
+
+// DialMonitor connects to the monitor at address and enters command mode
+func DialMonitor(network string, address string) (*Monitor, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to QMP monitor: %w", err)
+	}
+	monitor, err := NewMonitor(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return monitor, nil
+}
+
+// NewMonitor reads the greeting from a QMP connection and negotiates capabilities
+func NewMonitor(conn net.Conn) (*Monitor, error) {
+	monitor := &Monitor{conn: conn, decoder: json.NewDecoder(conn)}
+	var greeting qmpResponse
+	if err := monitor.decoder.Decode(&greeting); err != nil {
+		return nil, fmt.Errorf("Could not read QMP greeting: %w", err)
+	}
+	if greeting.Greeting == nil {
+		return nil, fmt.Errorf("Not a QMP monitor")
+	}
+	if err := monitor.Execute("qmp_capabilities", nil); err != nil {
+		return nil, err
+	}
+	return monitor, nil
+}
+
+// Execute runs a QMP command, returning the error QEMU answers with
+func (monitor *Monitor) Execute(command string, arguments interface{}) error {
+	data, err := json.Marshal(qmpCommand{Execute: command, Arguments: arguments})
+	if err != nil {
+		return fmt.Errorf("Could not encode QMP command: %w", err)
+	}
+	if _, err := monitor.conn.Write(data); err != nil {
+		return fmt.Errorf("Could not send QMP command: %w", err)
+	}
+	for {
+		var response qmpResponse
+		if err := monitor.decoder.Decode(&response); err != nil {
+			return fmt.Errorf("Could not read QMP response: %w", err)
+		}
+		if response.Event != "" {
+			qemuLogger.Printf("QMP event: %s\n\n", response.Event)
+			continue
+		}
+		if response.Error != nil {
+			return fmt.Errorf("%s failed: %s", command, response.Error.Description)
+		}
+		if response.Return != nil {
+			return nil
+		}
+	}
+}
+
+// AddDevice passes device through to the guest as id
+func (monitor *Monitor) AddDevice(device *HostDevice, id string) error {
+	return monitor.Execute("device_add", map[string]interface{}{
+		"driver":   "usb-host",
+		"hostbus":  device.Bus,
+		"hostaddr": device.Address,
+		"id":       id,
+	})
+}
+
+// RemoveDevice unplugs the device added as id from the guest
+func (monitor *Monitor) RemoveDevice(id string) error {
+	return monitor.Execute("device_del", map[string]interface{}{"id": id})
+}
+
+func (monitor *Monitor) Close() error {
+	return monitor.conn.Close()
+}
+
+// Attach passes the virtual key with serial through to the guest whose QMP monitor listens
+// on the Unix socket at monitorPath, once USB/IP has attached the key to this machine, which
+// it waits up to timeout for
+func Attach(monitorPath string, serial string, timeout time.Duration) error {
+	device, err := WaitForHostDevice(serial, timeout)
+	if err != nil {
+		return err
+	}
+	monitor, err := DialMonitor("unix", monitorPath)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+	if err := monitor.AddDevice(device, DefaultDeviceID); err != nil {
+		return err
+	}
+	qemuLogger.Printf("Passed bus %d device %d through to the guest\n\n", device.Bus, device.Address)
+	return nil
+}
+
+// Detach unplugs the virtual key from the guest again
+func Detach(monitorPath string) error {
+	monitor, err := DialMonitor("unix", monitorPath)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+	return monitor.RemoveDevice(DefaultDeviceID)
+}
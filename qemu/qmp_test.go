@@ -0,0 +1,55 @@
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+// fakeQEMU answers QMP commands with replies, in order, after sending the greeting
+func fakeQEMU(conn net.Conn, replies []string) <-chan map[string]interface{} {
+	commands := make(chan map[string]interface{}, len(replies))
+	go func() {
+		defer close(commands)
+		conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+		decoder := json.NewDecoder(bufio.NewReader(conn))
+		for _, reply := range replies {
+			var command map[string]interface{}
+			if decoder.Decode(&command) != nil {
+				return
+			}
+			commands <- command
+			conn.Write([]byte(reply + "\n"))
+		}
+	}()
+	return commands
+}
+
+func TestMonitor(t *testing.T) {
+	qemuConn, conn := net.Pipe()
+	defer qemuConn.Close()
+	commands := fakeQEMU(qemuConn, []string{
+		`{"return": {}}`,
+		`{"event": "DEVICE_ADDED", "data": {}}` + "\n" + `{"return": {}}`,
+		`{"error": {"class": "GenericError", "desc": "Duplicate device ID 'virtual-fido'"}}`,
+	})
+	monitor, err := NewMonitor(conn)
+	test.Assert(t, err == nil, "Could not negotiate capabilities")
+	defer monitor.Close()
+	test.AssertEqual(t, (<-commands)["execute"].(string), "qmp_capabilities", "Capabilities should be negotiated first")
+
+	device := &HostDevice{Bus: 3, Address: 4}
+	test.Assert(t, monitor.AddDevice(device, DefaultDeviceID) == nil, "Events before the return should be skipped")
+	command := <-commands
+	test.AssertEqual(t, command["execute"].(string), "device_add", "Device should be added")
+	arguments := command["arguments"].(map[string]interface{})
+	test.AssertEqual(t, arguments["driver"].(string), "usb-host", "Device should be passed through")
+	test.AssertEqual(t, arguments["hostbus"].(float64), float64(3), "Bus should be passed")
+	test.AssertEqual(t, arguments["hostaddr"].(float64), float64(4), "Address should be passed")
+
+	err = monitor.AddDevice(device, DefaultDeviceID)
+	test.Assert(t, err != nil, "QMP errors should be returned")
+}
@@ -0,0 +1,140 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// Events buffered for the collector, which only updates counters for each
+const collectorBuffer = 256
+
+// Usage counts the credentials created and assertions made, in all or for one RP or protocol
+type Usage struct {
+	Registrations uint64    `json:"registrations"`
+	Assertions    uint64    `json:"assertions"`
+	LastUsedAt    time.Time `json:"last_used_at,omitempty"`
+}
+
+// Stats is what a Collector counted. It's plain JSON, so embedders can save it and pass it
+// to NewCollector to keep counting where they left off.
+type Stats struct {
+	// When counting started
+	Since time.Time `json:"since"`
+	Usage
+	PINFailures uint64 `json:"pin_failures"`
+	// By ProtocolCTAP2 and ProtocolU2F
+	Protocols map[string]Usage `json:"protocols"`
+	// By RP ID. U2F only knows the application parameter, so U2F requests only count
+	// in Usage and Protocols.
+	RelyingParties map[string]Usage `json:"relying_parties"`
+	// Events the collector missed because it wasn't keeping up
+	DroppedEvents uint64 `json:"dropped_events,omitempty"`
+}
+
+func (stats Stats) copy() Stats {
+	stats.Protocols = copyUsage(stats.Protocols)
+	stats.RelyingParties = copyUsage(stats.RelyingParties)
+	return stats
+}
+
+func copyUsage(usage map[string]Usage) map[string]Usage {
+	copied := make(map[string]Usage, len(usage))
+	for key, value := range usage {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Collector counts the credentials and assertions of the events published on a bus, for
+// embedders' own dashboards. Nothing is reported anywhere: the counts stay in memory until
+// read with Stats.
+type Collector struct {
+	lock         sync.Mutex
+	stats        Stats
+	subscription *events.Subscription
+	// Dropped events of the subscription when counting started
+	dropped uint64
+	done    chan struct{}
+}
+
+// NewCollector counts the events published on bus from now on, on top of previous, which
+// may be empty
+func NewCollector(bus *events.EventBus, previous Stats) *Collector {
+	stats := previous.copy()
+	if stats.Since.IsZero() {
+		stats.Since = util.Now().UTC()
+	}
+	collector := &Collector{
+		stats:        stats,
+		subscription: bus.Subscribe(collectorBuffer),
+		done:         make(chan struct{}),
+	}
+	go collector.collect()
+	return collector
+}
+
+func (collector *Collector) collect() {
+	defer close(collector.done)
+	for event := range collector.subscription.Events() {
+		collector.count(event)
+	}
+}
+
+func (collector *Collector) count(event events.Event) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	switch event.Type {
+	case events.EventCredentialCreated, events.EventAssertionMade:
+		record := func(usage Usage) Usage {
+			if event.Type == events.EventCredentialCreated {
+				usage.Registrations++
+			} else {
+				usage.Assertions++
+			}
+			usage.LastUsedAt = event.Time.UTC()
+			return usage
+		}
+		collector.stats.Usage = record(collector.stats.Usage)
+		if event.Protocol != "" {
+			collector.stats.Protocols[event.Protocol] = record(collector.stats.Protocols[event.Protocol])
+		}
+		if event.RelyingPartyID != "" {
+			collector.stats.RelyingParties[event.RelyingPartyID] = record(collector.stats.RelyingParties[event.RelyingPartyID])
+		}
+	case events.EventPINFailed:
+		collector.stats.PINFailures++
+	}
+}
+
+// Stats returns the counts so far
+func (collector *Collector) Stats() Stats {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	stats := collector.stats.copy()
+	stats.DroppedEvents += collector.subscription.Dropped() - collector.dropped
+	return stats
+}
+
+// RelyingParty returns the counts for one RP ID
+func (collector *Collector) RelyingParty(relyingPartyID string) Usage {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	return collector.stats.RelyingParties[relyingPartyID]
+}
+
+// Reset starts counting again from zero
+func (collector *Collector) Reset() {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	collector.stats = Stats{Since: util.Now().UTC()}.copy()
+	collector.dropped = collector.subscription.Dropped()
+}
+
+// Stop counts the events already published and stops counting
+func (collector *Collector) Stop() {
+	collector.subscription.Unsubscribe()
+	<-collector.done
+}
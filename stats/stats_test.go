@@ -0,0 +1,61 @@
+package stats
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestCollector(t *testing.T) {
+	bus := events.NewEventBus()
+	collector := NewCollector(bus, Stats{})
+	used := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	bus.Publish(events.Event{Type: events.EventCredentialCreated, Protocol: events.ProtocolCTAP2, RelyingPartyID: "example.com"})
+	bus.Publish(events.Event{Type: events.EventAssertionMade, Protocol: events.ProtocolCTAP2, RelyingPartyID: "example.com", Time: used})
+	bus.Publish(events.Event{Type: events.EventAssertionMade, Protocol: events.ProtocolCTAP2, RelyingPartyID: "example.org"})
+	bus.Publish(events.Event{Type: events.EventCredentialCreated, Protocol: events.ProtocolU2F})
+	bus.Publish(events.Event{Type: events.EventPINFailed, PINRetries: 7})
+	bus.Publish(events.Event{Type: events.EventChannelOpened})
+	collector.Stop()
+
+	stats := collector.Stats()
+	test.AssertEqual(t, stats.Registrations, uint64(2), "Wrong registrations")
+	test.AssertEqual(t, stats.Assertions, uint64(2), "Wrong assertions")
+	test.AssertEqual(t, stats.PINFailures, uint64(1), "Wrong PIN failures")
+	test.AssertEqual(t, stats.Protocols[events.ProtocolU2F].Registrations, uint64(1), "Wrong U2F registrations")
+	test.AssertEqual(t, stats.Protocols[events.ProtocolCTAP2].Assertions, uint64(2), "Wrong CTAP2 assertions")
+	test.AssertEqual(t, len(stats.RelyingParties), 2, "U2F requests shouldn't count for an RP")
+	test.AssertEqual(t, collector.RelyingParty("example.com"), Usage{Registrations: 1, Assertions: 1, LastUsedAt: used}, "Wrong RP usage")
+
+	data, err := json.Marshal(stats)
+	test.Assert(t, err == nil, "Could not marshal stats")
+	saved := Stats{}
+	test.Assert(t, json.Unmarshal(data, &saved) == nil, "Could not unmarshal stats")
+	bus.Publish(events.Event{Type: events.EventAssertionMade, Protocol: events.ProtocolCTAP2, RelyingPartyID: "example.com"})
+	resumed := NewCollector(bus, saved)
+	bus.Publish(events.Event{Type: events.EventAssertionMade, Protocol: events.ProtocolCTAP2, RelyingPartyID: "example.com"})
+	resumed.Stop()
+	test.AssertEqual(t, resumed.Stats().Since, stats.Since, "Resumed stats should keep their start")
+	test.AssertEqual(t, resumed.RelyingParty("example.com").Assertions, uint64(2), "Resumed stats should count on")
+	test.AssertEqual(t, stats.RelyingParties["example.com"].Assertions, uint64(1), "Stats should be a copy")
+
+	resumed.Reset()
+	test.AssertEqual(t, resumed.Stats().Assertions, uint64(0), "Reset should clear the counts")
+}
+
+func TestCollectorDroppedEvents(t *testing.T) {
+	bus := events.NewEventBus()
+	collector := NewCollector(bus, Stats{})
+	collector.lock.Lock()
+	for i := 0; i < collectorBuffer+2; i++ {
+		bus.Publish(events.Event{Type: events.EventPINFailed})
+	}
+	collector.lock.Unlock()
+	collector.Stop()
+	stats := collector.Stats()
+	test.Assert(t, stats.DroppedEvents > 0, "Events past the buffer should be dropped")
+	test.AssertEqual(t, stats.PINFailures+stats.DroppedEvents, uint64(collectorBuffer+2), "Every event should be counted or dropped")
+}
@@ -0,0 +1,15 @@
+// Package systemd lets the authenticator run as a systemd service: it takes the sockets
+// passed in by socket activation and reports readiness with sd_notify. Outside systemd, and
+// on other platforms, there are no sockets and notifications are ignored.
+package systemd
+
+// States sent with Notify
+const (
+	NotifyReady    = "READY=1"
+	NotifyStopping = "STOPPING=1"
+)
+
+// NotifyStatus describes what the service is doing, for systemctl status
+func NotifyStatus(status string) string {
+	return "STATUS=" + status
+}
@@ -0,0 +1,85 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The first socket passed by systemd, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed to this process by systemd socket activation, in the
+// order of the socket unit's Listen lines. It returns none if the process wasn't socket
+// activated. The variables describing the sockets are unset, so child processes don't
+// mistake them for their own.
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS: %s", os.Getenv("LISTEN_FDS"))
+	}
+	return listenersFrom(listenFDsStart, count, os.Getenv("LISTEN_FDNAMES"))
+}
+
+func listenersFrom(start int, count int, fdNames string) ([]net.Listener, error) {
+	names := strings.Split(fdNames, ":")
+	listeners := make([]net.Listener, 0, count)
+	for fd := start; fd < start+count; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - start; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		// FileListener uses a duplicate of the descriptor
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, other := range listeners {
+				other.Close()
+			}
+			return nil, fmt.Errorf("Could not listen on socket %s: %w", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Notify sends state, e.g. NotifyReady, to the service manager. It does nothing unless the
+// service has Type=notify (or NotifyAccess set), i.e. NOTIFY_SOCKET is set.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Sockets starting with @ are in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Could not connect to systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("Could not notify systemd: %w", err)
+	}
+	return nil
+}
+
+// Notifying reports whether Notify will reach a service manager
+func Notifying() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
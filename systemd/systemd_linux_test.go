@@ -0,0 +1,62 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestListenersFrom(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Assert(t, err == nil, "Could not listen")
+	defer listener.Close()
+	// A duplicate of the socket stands in for the one systemd passes at fd 3
+	file, err := listener.(*net.TCPListener).File()
+	test.Assert(t, err == nil, "Could not get socket file")
+
+	listeners, err := listenersFrom(int(file.Fd()), 1, "usbip")
+	test.Assert(t, err == nil, "Could not use passed socket")
+	test.AssertEqual(t, len(listeners), 1, "Passed socket should be returned")
+	defer listeners[0].Close()
+	test.AssertEqual(t, listeners[0].Addr().String(), listener.Addr().String(), "Listener should use the passed socket")
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listeners[0].Accept()
+	test.Assert(t, err == nil, "Should accept from the passed socket")
+	conn.Close()
+}
+
+func TestListenersWithoutActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := Listeners()
+	test.Assert(t, err == nil && len(listeners) == 0, "Sockets for another process should be ignored")
+	test.AssertEqual(t, os.Getenv("LISTEN_FDS"), "", "Socket variables should be unset")
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	test.Assert(t, Notify(NotifyReady) == nil, "Notify should do nothing outside systemd")
+	test.Assert(t, !Notifying(), "Should not be notifying outside systemd")
+
+	path := filepath.Join(t.TempDir(), "notify")
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	test.Assert(t, err == nil, "Could not create notify socket")
+	defer socket.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	test.Assert(t, Notifying(), "Should be notifying under systemd")
+	test.Assert(t, Notify(NotifyReady) == nil, "Could not notify")
+	buffer := make([]byte, 64)
+	n, err := socket.Read(buffer)
+	test.Assert(t, err == nil, "Could not read notification")
+	test.AssertEqual(t, string(buffer[:n]), NotifyReady, "Readiness should be sent")
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package systemd
+
+import "net"
+
+func Listeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+func Notify(state string) error {
+	return nil
+}
+
+func Notifying() bool {
+	return false
+}
@@ -0,0 +1,180 @@
+package u2f
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+const (
+	// CLA bit marking a command APDU that is continued by the next one
+	u2f_CLA_CHAINING uint8 = 0x10
+
+	u2f_COMMAND_GET_RESPONSE U2FCommand = 0xC0
+
+	// SW1 of a response with more data waiting for GET RESPONSE
+	u2f_SW1_BYTES_REMAINING uint8 = 0x61
+
+	// Most data a chain of command APDUs can carry, that of one extended APDU
+	maxChainedRequestLength = 0xFFFF
+)
+
+// u2fSession is the APDU state kept between messages of a transport session, e.g. a
+// CTAPHID channel
+type u2fSession struct {
+	// Data of command APDUs chained with CLA 0x10, waiting for the final APDU
+	chainedRequest []byte
+	// Rest of a response to a short APDU, fetched with GET RESPONSE
+	pendingResponse []byte
+}
+
+// updateSession calls update with the state of session, forgetting sessions left without any
+func (server *U2FServer) updateSession(session uint32, update func(state *u2fSession)) {
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+	state, ok := server.sessions[session]
+	if !ok {
+		state = &u2fSession{}
+	}
+	update(state)
+	if state.chainedRequest == nil && state.pendingResponse == nil {
+		delete(server.sessions, session)
+	} else {
+		server.sessions[session] = state
+	}
+}
+
+// chainRequest adds data to the chained request of session, or drops the chain and returns
+// false if that would take it past maxChainedRequestLength
+func (server *U2FServer) chainRequest(session uint32, data []byte) bool {
+	ok := true
+	server.updateSession(session, func(state *u2fSession) {
+		if len(state.chainedRequest)+len(data) > maxChainedRequestLength {
+			state.chainedRequest = nil
+			ok = false
+			return
+		}
+		state.chainedRequest = append(state.chainedRequest, data...)
+	})
+	return ok
+}
+
+// takeChainedRequest returns the chained data of session, if any, and starts a new chain
+func (server *U2FServer) takeChainedRequest(session uint32) []byte {
+	var request []byte
+	server.updateSession(session, func(state *u2fSession) {
+		request = state.chainedRequest
+		state.chainedRequest = nil
+	})
+	return request
+}
+
+type u2fAPDU struct {
+	header U2FMessageHeader
+	data   []byte
+	// Maximum response data length (Ne); 0 if the APDU has no Le field
+	responseLength int
+	extended       bool
+}
+
+func decodeLe(le []byte) int {
+	value := 0
+	for _, b := range le {
+		value = value<<8 | int(b)
+	}
+	if value == 0 {
+		// Le of zero asks for the maximum length
+		return 1 << (8 * len(le))
+	}
+	return value
+}
+
+// decodeU2FMessage parses every ISO 7816-4 APDU case, with short or extended lengths
+func decodeU2FMessage(messageBytes []byte) (u2fAPDU, error) {
+	var apdu u2fAPDU
+	if len(messageBytes) < int(util.SizeOf[U2FMessageHeader]()) {
+		return apdu, fmt.Errorf("U2F message too short: %d bytes", len(messageBytes))
+	}
+	buffer := bytes.NewBuffer(messageBytes)
+	apdu.header = util.ReadBE[U2FMessageHeader](buffer)
+	body := buffer.Bytes()
+	switch {
+	case len(body) == 0:
+		// Case 1: no data and no Le
+		apdu.data = []byte{}
+	case len(body) == 1:
+		// Case 2S: short Le only
+		apdu.data = []byte{}
+		apdu.responseLength = decodeLe(body)
+	case body[0] == 0 && len(body) >= 3:
+		apdu.extended = true
+		if len(body) == 3 {
+			// Case 2E: extended Le only
+			apdu.data = []byte{}
+			apdu.responseLength = decodeLe(body[1:3])
+			break
+		}
+		length := int(util.FromBE[uint16](body[1:3]))
+		rest := body[3:]
+		if len(rest) == length {
+			// Case 3E: extended Lc and data
+			apdu.data = rest
+		} else if len(rest) == length+2 {
+			// Case 4E: extended Lc, data and Le. Lc may be zero when there's no data.
+			apdu.data = rest[:length]
+			apdu.responseLength = decodeLe(rest[length:])
+		} else {
+			return apdu, fmt.Errorf("U2F request length %d doesn't match declared length %d: %#v", len(rest), length, messageBytes)
+		}
+	case body[0] != 0:
+		length := int(body[0])
+		rest := body[1:]
+		if len(rest) == length {
+			// Case 3S: short Lc and data
+			apdu.data = rest
+		} else if len(rest) == length+1 {
+			// Case 4S: short Lc, data and Le
+			apdu.data = rest[:length]
+			apdu.responseLength = decodeLe(rest[length:])
+		} else {
+			return apdu, fmt.Errorf("U2F request length %d doesn't match declared length %d: %#v", len(rest), length, messageBytes)
+		}
+	default:
+		return apdu, fmt.Errorf("Invalid U2F Payload length: %s %#v", apdu.header, messageBytes)
+	}
+	return apdu, nil
+}
+
+// Short APDUs can't carry more than 256 bytes of response, so longer responses are
+// split and the rest is fetched with GET RESPONSE
+func (server *U2FServer) chainResponse(session uint32, response []byte, maxLength int) []byte {
+	if maxLength == 0 {
+		maxLength = 256
+	}
+	data := response[:len(response)-2]
+	status := response[len(response)-2:]
+	var pending []byte
+	if len(data) > maxLength {
+		pending = append(data[maxLength:len(data):len(data)], status...)
+	}
+	server.updateSession(session, func(state *u2fSession) { state.pendingResponse = pending })
+	if pending == nil {
+		return response
+	}
+	remaining := len(pending) - 2
+	if remaining > 0xFF {
+		// 0x00 means 256 or more bytes remain
+		remaining = 0
+	}
+	return util.Concat(data[:maxLength], []byte{u2f_SW1_BYTES_REMAINING, uint8(remaining)})
+}
+
+func (server *U2FServer) handleGetResponse(session uint32, maxLength int) []byte {
+	var pending []byte
+	server.updateSession(session, func(state *u2fSession) { pending = state.pendingResponse })
+	if pending == nil {
+		return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
+	}
+	return server.chainResponse(session, pending, maxLength)
+}
@@ -5,16 +5,25 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/bulwarkid/virtual-fido/audit"
 	"github.com/bulwarkid/virtual-fido/cose"
-	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/fault_injection"
+	"github.com/bulwarkid/virtual-fido/metrics"
 	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
-	"github.com/fxamacker/cbor/v2"
 )
 
-var u2fLogger = util.NewLogger("[U2F] ", util.LogLevelDebug)
+var u2fLogger = util.NewLogger("[U2F] ", util.LogSubsystemU2F, util.LogLevelDebug)
+
+var u2fCommandCounter = metrics.NewCounter("virtual_fido_u2f_commands_total", "U2F commands handled", "command", "status")
+var u2fCommandDuration = metrics.NewHistogram("virtual_fido_u2f_command_duration_seconds", "Time to handle a U2F command, including user approval", metrics.DefaultBuckets, "command")
 
 type U2FCommand uint8
 
@@ -73,138 +82,327 @@ type U2FClient interface {
 	ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool
 }
 
-type U2FServer struct {
-	client U2FClient
+// U2FKeyHandleClient is implemented by clients with key handles the server didn't seal
+// itself, which are looked up before unsealing
+type U2FKeyHandleClient interface {
+	// Looks up key handles issued by another token and imported into this one
+	ImportedKeyHandle(keyHandle []byte) *webauthn.KeyHandle
+	// Looks up a CTAP2 credential by ID so it can be used through U2F
+	CredentialKeyHandle(credentialID []byte) *webauthn.KeyHandle
 }
 
-func NewU2FServer(client U2FClient) *U2FServer {
-	return &U2FServer{client: client}
+// U2FKeyClient is implemented by clients that create and open key handles themselves, e.g.
+// a delegate's front-end, so the server never sees the private keys or the sealing key.
+// NewPrivateKey, SealingEncryptionKey and U2FKeyHandleClient aren't used then.
+type U2FKeyClient interface {
+	// Creates a key for application, returning its sealed key handle
+	NewU2FKey(application []byte) (keyHandle []byte, privateKey *cose.SupportedCOSEPrivateKey, err error)
+	// Opens a key handle given for application
+	OpenU2FKey(application []byte, keyHandle []byte) (*cose.SupportedCOSEPrivateKey, error)
+}
+
+// NewKey creates a key with client's NewPrivateKey and seals it into a key handle for
+// application with client's sealing key. It's what the server does for clients that aren't
+// a U2FKeyClient.
+func NewKey(client U2FClient, application []byte) ([]byte, *cose.SupportedCOSEPrivateKey, error) {
+	privateKey := client.NewPrivateKey()
+	encodedPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not encode private key: %w", err)
+	}
+	keyHandle, err := webauthn.SealKeyHandle(client.SealingEncryptionKey(), &webauthn.KeyHandle{PrivateKey: encodedPrivateKey, ApplicationID: application})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyHandle, &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}, nil
 }
 
-func decodeU2FMessage(messageBytes []byte) (U2FMessageHeader, []byte, uint16) {
-	buffer := bytes.NewBuffer(messageBytes)
-	header := util.ReadBE[U2FMessageHeader](buffer)
-	if buffer.Len() == 0 {
-		// No request length, no response length
-		return header, []byte{}, 0
+// OpenKey opens a key handle given for application, looking it up first if client is a
+// U2FKeyHandleClient. It's what the server does for clients that aren't a U2FKeyClient.
+func OpenKey(client U2FClient, application []byte, boxBytes []byte) (*cose.SupportedCOSEPrivateKey, error) {
+	var keyHandle *webauthn.KeyHandle
+	if lookup, ok := client.(U2FKeyHandleClient); ok {
+		keyHandle = lookup.ImportedKeyHandle(boxBytes)
+		if keyHandle == nil {
+			keyHandle = lookup.CredentialKeyHandle(boxBytes)
+		}
 	}
-	// We should either have a request length or response length, so we have at least
-	// one '0' byte at the start
-	if util.Read(buffer, 1)[0] != 0 {
-		panic(fmt.Sprintf("Invalid U2F Payload length: %s %#v", header, messageBytes))
+	if keyHandle == nil {
+		var err error
+		keyHandle, err = webauthn.OpenKeyHandle(client.SealingEncryptionKey(), application, boxBytes)
+		if err != nil {
+			return nil, err
+		}
 	}
-	length := util.ReadBE[uint16](buffer)
-	if buffer.Len() == 0 {
-		// No payload, so length must be the response length
-		return header, []byte{}, length
+	if keyHandle.PrivateKey == nil || !bytes.Equal(keyHandle.ApplicationID, application) {
+		return nil, fmt.Errorf("Key handle is not for this application")
 	}
-	// length is the request length
-	request := util.Read(buffer, uint(length))
-	if buffer.Len() == 0 {
-		return header, request, 0
+	privateKey, err := x509.ParseECPrivateKey(keyHandle.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode private key: %w", err)
 	}
-	responseLength := util.ReadBE[uint16](buffer)
-	return header, request, responseLength
+	return &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}, nil
+}
+
+// U2FTransactionClient is implemented by clients whose state can change between requests,
+// e.g. when the vault is reloaded. Each request is handled between BeginTransaction and
+// EndTransaction.
+type U2FTransactionClient interface {
+	BeginTransaction()
+	EndTransaction()
+}
+
+// U2FAlwaysUVClient is implemented by clients with the CTAP 2.1 alwaysUv setting. U2F can't
+// verify the user, so every command fails while it's on.
+type U2FAlwaysUVClient interface {
+	AlwaysUV() bool
+}
+
+type U2FServer struct {
+	client U2FClient
+	faults *fault_injection.FaultInjector
+	// APDU chaining state by session, see HandleSessionMessage
+	sessionsLock sync.Mutex
+	sessions     map[uint32]*u2fSession
+	// Refuses registrations, see SetReadOnly
+	readOnly bool
+	auditor  audit.Auditor
+	// Limits authentications by application parameter, see SetAuthenticationRateLimit
+	authenticationLimiter *util.RateLimiter
+}
+
+func NewU2FServer(client U2FClient) *U2FServer {
+	return &U2FServer{client: client, sessions: make(map[uint32]*u2fSession)}
+}
+
+func (server *U2FServer) SetFaultInjector(faults *fault_injection.FaultInjector) {
+	server.faults = faults
+}
+
+// SetReadOnly makes the server refuse registrations, so only existing key handles can be used.
+// U2F has no status for a refused operation, so they fail as unsupported.
+func (server *U2FServer) SetReadOnly(readOnly bool) {
+	server.readOnly = readOnly
+}
+
+// SetAuthenticationRateLimit fails authentications for an application past limit with
+// SW_CONDITIONS_NOT_SATISFIED before the user is asked, as if the user hadn't touched the
+// key yet. Check-only requests aren't counted.
+func (server *U2FServer) SetAuthenticationRateLimit(limit util.RateLimit) {
+	server.authenticationLimiter = util.NewRateLimiter(limit)
+}
+
+// SetAuditor tells auditor about every authentication request and how it was answered
+func (server *U2FServer) SetAuditor(auditor audit.Auditor) {
+	server.auditor = auditor
 }
 
 func (server *U2FServer) HandleMessage(message []byte) []byte {
-	header, request, responseLength := decodeU2FMessage(message)
-	u2fLogger.Printf("MESSAGE: Header: %s Request: %#v Response Length: %d\n\n", header, request, responseLength)
+	return server.HandleTracedMessage(util.NewTraceID(), message)
+}
+
+// HandleTracedMessage handles a message traced by the transport, tagging what's logged and
+// published while handling it with the trace. It's in session 0, see HandleSessionMessage.
+func (server *U2FServer) HandleTracedMessage(trace util.TraceID, message []byte) []byte {
+	return server.HandleSessionMessage(trace, 0, message)
+}
+
+// HandleSessionMessage is HandleTracedMessage for transports with sessions, such as CTAPHID
+// channels, which each get their own APDU chaining and GET RESPONSE state. Messages of a
+// session must not be handled concurrently.
+func (server *U2FServer) HandleSessionMessage(trace util.TraceID, session uint32, message []byte) []byte {
+	logger := u2fLogger.WithTrace(trace)
+	if transactionClient, ok := server.client.(U2FTransactionClient); ok {
+		transactionClient.BeginTransaction()
+		defer transactionClient.EndTransaction()
+	}
+	apdu, err := decodeU2FMessage(message)
+	if err != nil {
+		logger.Printf("ERROR: %s\n\n", err)
+		server.takeChainedRequest(session)
+		return util.ToBE(u2f_SW_WRONG_DATA)
+	}
+	header := apdu.header
+	logger.Printf("MESSAGE: Header: %s Request: %#v Response Length: %d\n\n", header, apdu.data, apdu.responseLength)
+	if header.Cla&^u2f_CLA_CHAINING != 0 {
+		return util.ToBE(u2f_SW_CLA_NOT_SUPPORTED)
+	}
+	if header.Command == u2f_COMMAND_GET_RESPONSE {
+		return server.handleGetResponse(session, apdu.responseLength)
+	}
+	server.updateSession(session, func(state *u2fSession) { state.pendingResponse = nil })
+	if header.Cla&u2f_CLA_CHAINING != 0 {
+		if !server.chainRequest(session, apdu.data) {
+			logger.Printf("ERROR: Chained request longer than %d bytes\n\n", maxChainedRequestLength)
+			return util.ToBE(u2f_SW_WRONG_LENGTH)
+		}
+		return util.ToBE(u2f_SW_NO_ERROR)
+	}
+	request := apdu.data
+	if chained := server.takeChainedRequest(session); chained != nil {
+		if len(chained)+len(apdu.data) > maxChainedRequestLength {
+			logger.Printf("ERROR: Chained request longer than %d bytes\n\n", maxChainedRequestLength)
+			return util.ToBE(u2f_SW_WRONG_LENGTH)
+		}
+		request = append(chained, apdu.data...)
+	}
+	start := time.Now()
 	var response []byte
-	switch header.Command {
-	case u2f_COMMAND_VERSION:
+	alwaysUVClient, ok := server.client.(U2FAlwaysUVClient)
+	alwaysUV := ok && alwaysUVClient.AlwaysUV()
+	switch {
+	case alwaysUV:
+		logger.Printf("ERROR: U2F is turned off by alwaysUv\n\n")
+		response = util.ToBE(u2f_SW_INS_NOT_SUPPORTED)
+	case header.Command == u2f_COMMAND_VERSION:
 		response = append([]byte("U2F_V2"), util.ToBE(u2f_SW_NO_ERROR)...)
-	case u2f_COMMAND_REGISTER:
-		response = server.handleU2FRegister(header, request)
-	case u2f_COMMAND_AUTHENTICATE:
-		response = server.handleU2FAuthenticate(header, request)
+	case header.Command == u2f_COMMAND_REGISTER:
+		if server.readOnly {
+			logger.Printf("U2F REGISTER: Refused in read-only mode\n\n")
+			response = util.ToBE(u2f_SW_INS_NOT_SUPPORTED)
+			break
+		}
+		response = server.handleU2FRegister(trace, header, request)
+	case header.Command == u2f_COMMAND_AUTHENTICATE:
+		response = server.handleU2FAuthenticate(trace, header, request)
+		server.auditAuthentication(request, response)
 	default:
-		panic(fmt.Sprintf("Invalid U2F Command: %#v", header))
+		logger.Printf("ERROR: Invalid U2F Command: %#v\n\n", header)
+		response = util.ToBE(u2f_SW_INS_NOT_SUPPORTED)
+	}
+	logger.Printf("RESPONSE: %#v\n\n", response)
+	commandName, ok := U2FCommandDescriptions[header.Command]
+	if !ok {
+		commandName = "unknown"
+	}
+	u2fCommandCounter.Inc(commandName, fmt.Sprintf("0x%x", response[len(response)-2:]))
+	u2fCommandDuration.ObserveSince(start, commandName)
+	if !apdu.extended {
+		// Extended APDUs always get the whole response, as many U2F clients omit Le
+		response = server.chainResponse(session, response, apdu.responseLength)
 	}
-	u2fLogger.Printf("RESPONSE: %#v\n\n", response)
 	return response
 }
 
-func (server *U2FServer) sealKeyHandle(keyHandle *webauthn.KeyHandle) []byte {
-	box := crypto.Seal(server.client.SealingEncryptionKey(), util.MarshalCBOR(keyHandle))
-	return util.MarshalCBOR(box)
+func (server *U2FServer) newKey(application []byte) ([]byte, *cose.SupportedCOSEPrivateKey, error) {
+	if keyClient, ok := server.client.(U2FKeyClient); ok {
+		return keyClient.NewU2FKey(application)
+	}
+	return NewKey(server.client, application)
 }
 
-func (server *U2FServer) openKeyHandle(boxBytes []byte) (*webauthn.KeyHandle, error) {
-	var box crypto.EncryptedBox
-	err := cbor.Unmarshal(boxBytes, &box)
-	if err != nil {
-		return nil, err
+func (server *U2FServer) openKey(application []byte, boxBytes []byte) (*cose.SupportedCOSEPrivateKey, error) {
+	if keyClient, ok := server.client.(U2FKeyClient); ok {
+		return keyClient.OpenU2FKey(application, boxBytes)
 	}
-	data := crypto.Open(server.client.SealingEncryptionKey(), box)
-	var keyHandle webauthn.KeyHandle
-	err = cbor.Unmarshal(data, &keyHandle)
-	if err != nil {
-		return nil, err
-	}
-	return &keyHandle, nil
+	return OpenKey(server.client, application, boxBytes)
 }
 
-func (server *U2FServer) handleU2FRegister(header U2FMessageHeader, request []byte) []byte {
+func (server *U2FServer) handleU2FRegister(trace util.TraceID, header U2FMessageHeader, request []byte) []byte {
+	logger := u2fLogger.WithTrace(trace)
+	if len(request) != 64 {
+		logger.Printf("U2F REGISTER: Invalid request length %d\n\n", len(request))
+		return util.ToBE(u2f_SW_WRONG_LENGTH)
+	}
 	challenge := request[:32]
 	application := request[32:]
-	util.Assert(len(challenge) == 32, "Challenge is not 32 bytes")
-	util.Assert(len(application) == 32, "Application is not 32 bytes")
-
-	privateKey := server.client.NewPrivateKey()
-	encodedPublicKey := elliptic.Marshal(elliptic.P256(), privateKey.PublicKey.X, privateKey.PublicKey.Y)
-	encodedPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
-	util.CheckErr(err, "Could not encode private key")
 
-	unencryptedKeyHandle := webauthn.KeyHandle{PrivateKey: encodedPrivateKey, ApplicationID: application}
-	keyHandle := server.sealKeyHandle(&unencryptedKeyHandle)
-	u2fLogger.Printf("KEY HANDLE: %d %#v\n\n", len(keyHandle), keyHandle)
+	keyHandle, cosePrivateKey, err := server.newKey(application)
+	if err != nil {
+		logger.Printf("U2F REGISTER: %s\n\n", err)
+		return util.ToBE(u2f_SW_WRONG_DATA)
+	}
+	publicKey := cosePrivateKey.Public().ECDSA
+	if publicKey == nil {
+		logger.Printf("U2F REGISTER: Key is not a P-256 key\n\n")
+		return util.ToBE(u2f_SW_WRONG_DATA)
+	}
+	encodedPublicKey := elliptic.Marshal(elliptic.P256(), publicKey.X, publicKey.Y)
+	logger.Printf("KEY HANDLE: %d %#v\n\n", len(keyHandle), keyHandle)
 
-	if !server.client.ApproveU2FRegistration(&unencryptedKeyHandle) {
+	// Approvers only get the application, never the key
+	if !server.client.ApproveU2FRegistration(&webauthn.KeyHandle{ApplicationID: application}) {
 		return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 	}
 
-	cosePrivateKey := &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}
 	cert := server.client.CreateAttestationCertificiate(cosePrivateKey)
 
 	signatureDataBytes := util.Concat([]byte{0}, application, challenge, keyHandle, encodedPublicKey)
 	signature := cosePrivateKey.Sign(signatureDataBytes)
 
+	events.Publish(events.Event{Type: events.EventCredentialCreated, Protocol: events.ProtocolU2F, CredentialID: keyHandle, TraceID: trace})
 	return util.Concat([]byte{0x05}, encodedPublicKey, []byte{uint8(len(keyHandle))}, keyHandle, cert, signature, util.ToBE(u2f_SW_NO_ERROR))
 }
 
-func (server *U2FServer) handleU2FAuthenticate(header U2FMessageHeader, request []byte) []byte {
+func (server *U2FServer) auditAuthentication(request []byte, response []byte) {
+	if server.auditor == nil {
+		return
+	}
+	status := U2FStatusWord(binary.BigEndian.Uint16(response[len(response)-2:]))
+	attempt := audit.Attempt{
+		Time:     time.Now(),
+		Protocol: events.ProtocolU2F,
+		// U2F is only carried over CTAPHID
+		Origin: "usb",
+		Status: uint16(status),
+	}
+	var keyHandle []byte
+	if len(request) >= 65 && len(request) >= 65+int(request[64]) {
+		attempt.ClientDataHash = request[:32]
+		attempt.Application = request[32:64]
+		keyHandle = request[65 : 65+int(request[64])]
+		attempt.AllowList = [][]byte{keyHandle}
+	}
+	switch status {
+	case u2f_SW_NO_ERROR:
+		attempt.Outcome = audit.OutcomeSuccess
+		attempt.CredentialID = keyHandle
+	case u2f_SW_WRONG_DATA:
+		attempt.Outcome = audit.OutcomeNoCredentials
+	case u2f_SW_CONDITIONS_NOT_SATISFIED:
+		attempt.Outcome = audit.OutcomeDenied
+	default:
+		attempt.Outcome = audit.OutcomeError
+	}
+	server.auditor.Audit(attempt)
+}
+
+func (server *U2FServer) handleU2FAuthenticate(trace util.TraceID, header U2FMessageHeader, request []byte) []byte {
+	logger := u2fLogger.WithTrace(trace)
+	if len(request) < 65 || len(request) < 65+int(request[64]) {
+		logger.Printf("U2F AUTHENTICATE: Invalid request length %d\n\n", len(request))
+		return util.ToBE(u2f_SW_WRONG_LENGTH)
+	}
 	requestReader := bytes.NewBuffer(request)
 	control := U2FAuthenticateControl(header.Param1)
-	challenge := util.Read(requestReader, 32)
-	application := util.Read(requestReader, 32)
+	challenge := requestReader.Next(32)
+	application := requestReader.Next(32)
 
 	keyHandleLength := util.ReadLE[uint8](requestReader)
-	encryptedKeyHandleBytes := util.Read(requestReader, uint(keyHandleLength))
-	keyHandle, err := server.openKeyHandle(encryptedKeyHandleBytes)
+	encryptedKeyHandleBytes := requestReader.Next(int(keyHandleLength))
+	cosePrivateKey, err := server.openKey(application, encryptedKeyHandleBytes)
 	if err != nil {
-		u2fLogger.Printf("U2F AUTHENTICATE: Invalid key handle given - %s %#v\n\n", err, encryptedKeyHandleBytes)
+		logger.Printf("U2F AUTHENTICATE: Invalid key handle given - %s %#v\n\n", err, encryptedKeyHandleBytes)
 		return util.ToBE(u2f_SW_WRONG_DATA)
 	}
-	if keyHandle.PrivateKey == nil || bytes.Compare(keyHandle.ApplicationID, application) != 0 {
-		u2fLogger.Printf("U2F AUTHENTICATE: Invalid input data %#v\n\n", keyHandle)
-		return util.ToBE(u2f_SW_WRONG_DATA)
-	}
-	privateKey, err := x509.ParseECPrivateKey(keyHandle.PrivateKey)
-	util.CheckErr(err, "Could not decode private key")
-	cosePrivateKey := &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}
+	keyHandle := &webauthn.KeyHandle{ApplicationID: application}
 
 	if control == u2f_AUTH_CONTROL_CHECK_ONLY {
 		return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 	} else if control == u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN || control == u2f_AUTH_CONTROL_SIGN {
+		if !server.authenticationLimiter.Allow(hex.EncodeToString(application)) {
+			logger.Printf("U2F AUTHENTICATE: Too many authentications for %x\n\n", application)
+			return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
+		}
 		if control == u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN {
 			if !server.client.ApproveU2FAuthentication(keyHandle) {
 				return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 			}
 		}
-		counter := server.client.NewAuthenticationCounterId()
+		counter := server.faults.MaybeStaleCounter(server.client.NewAuthenticationCounterId())
 		signatureDataBytes := util.Concat(application, []byte{1}, util.ToBE(counter), challenge)
-		signature := cosePrivateKey.Sign(signatureDataBytes)
+		signature := server.faults.MaybeCorruptSignature(cosePrivateKey.Sign(signatureDataBytes))
+		events.Publish(events.Event{Type: events.EventAssertionMade, Protocol: events.ProtocolU2F, CredentialID: encryptedKeyHandleBytes, TraceID: trace})
 		return util.Concat([]byte{1}, util.ToBE(counter), signature, util.ToBE(u2f_SW_NO_ERROR))
 	} else {
 		// No error specific to invalid control byte, so return WRONG_LENGTH to indicate data error
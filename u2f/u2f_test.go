@@ -10,13 +10,16 @@ import (
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"math/big"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"golang.org/x/crypto/cryptobyte"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/internal/test"
 	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
 )
@@ -68,6 +71,14 @@ func (client *DummyU2FClient) SealingEncryptionKey() []byte {
 	return client.encryptionKey
 }
 
+func (client *DummyU2FClient) ImportedKeyHandle(keyHandle []byte) *webauthn.KeyHandle {
+	return nil
+}
+
+func (client *DummyU2FClient) CredentialKeyHandle(credentialID []byte) *webauthn.KeyHandle {
+	return nil
+}
+
 func (client *DummyU2FClient) NewPrivateKey() *ecdsa.PrivateKey {
 	return crypto.GenerateECDSAKey()
 }
@@ -161,3 +172,287 @@ func TestU2FRegistration(t *testing.T) {
 		t.Fatalf("Could not verify signature returned by Authenticate")
 	}
 }
+
+func TestU2FReadOnly(t *testing.T) {
+	server := NewU2FServer(newDummyU2FClient())
+	server.SetReadOnly(true)
+	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, crypto.RandomBytes(64), util.ToBE(uint16(512)))
+	response := server.HandleMessage(registration)
+	if !bytes.Equal(response, util.ToBE(u2f_SW_INS_NOT_SUPPORTED)) {
+		t.Fatalf("Registration should be refused: %#v", response)
+	}
+	response = server.HandleMessage(util.Concat(u2fHeader(u2f_COMMAND_VERSION, 0, 0), []byte{0, 0, 0}))
+	if !bytes.Equal(response, util.Concat([]byte("U2F_V2"), util.ToBE(u2f_SW_NO_ERROR))) {
+		t.Fatalf("Version should still work: %#v", response)
+	}
+}
+
+func TestU2FMalformedMessages(t *testing.T) {
+	client := newDummyU2FClient()
+	server := NewU2FServer(client)
+	checkStatus := func(message []byte, expected U2FStatusWord, description string) {
+		response := server.HandleMessage(message)
+		if len(response) != 2 {
+			t.Fatalf("%s: Expected only a status word, got %#v", description, response)
+		}
+		status := util.FromBE[U2FStatusWord](response)
+		if status != expected {
+			t.Fatalf("%s: Expected status 0x%x, got 0x%x", description, expected, status)
+		}
+	}
+	checkStatus([]byte{0, 1}, u2f_SW_WRONG_DATA, "Truncated header")
+	checkStatus(util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{5, 0, 64}), u2f_SW_WRONG_DATA, "Short length mismatch")
+	checkStatus(util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 1}), u2f_SW_WRONG_DATA, "Truncated extended length")
+	checkStatus(util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, crypto.RandomBytes(10)), u2f_SW_WRONG_DATA, "Truncated payload")
+	checkStatus(util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 10}, crypto.RandomBytes(10)), u2f_SW_WRONG_LENGTH, "Short register request")
+	checkStatus(util.Concat(u2fHeader(0x55, 0, 0)), u2f_SW_INS_NOT_SUPPORTED, "Unknown instruction")
+	checkStatus([]byte{0x80, byte(u2f_COMMAND_VERSION), 0, 0}, u2f_SW_CLA_NOT_SUPPORTED, "Invalid class")
+
+	authRequest := util.Concat(crypto.RandomBytes(64), []byte{200}, crypto.RandomBytes(10))
+	checkStatus(util.Concat(u2fHeader(u2f_COMMAND_AUTHENTICATE, uint8(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN), 0), []byte{0}, util.ToBE(uint16(len(authRequest))), authRequest), u2f_SW_WRONG_LENGTH, "Key handle longer than request")
+	authRequest = util.Concat(crypto.RandomBytes(64), []byte{10}, crypto.RandomBytes(10))
+	checkStatus(util.Concat(u2fHeader(u2f_COMMAND_AUTHENTICATE, uint8(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN), 0), []byte{0}, util.ToBE(uint16(len(authRequest))), authRequest), u2f_SW_WRONG_DATA, "Garbage key handle")
+}
+
+func TestU2FAPDUEncodings(t *testing.T) {
+	version := u2fHeader(u2f_COMMAND_VERSION, 0, 0)
+	expected := append([]byte("U2F_V2"), util.ToBE(u2f_SW_NO_ERROR)...)
+	encodings := map[string][]byte{
+		"No Le":                 version,
+		"Short Le":              util.Concat(version, []byte{0}),
+		"Extended Le":           util.Concat(version, []byte{0, 0, 0}),
+		"Extended Lc=0 with Le": util.Concat(version, []byte{0, 0, 0, 0, 0}),
+	}
+	for description, message := range encodings {
+		response := NewU2FServer(newDummyU2FClient()).HandleMessage(message)
+		if !bytes.Equal(response, expected) {
+			t.Fatalf("%s: Incorrect response %#v", description, response)
+		}
+	}
+	apdu, err := decodeU2FMessage(util.Concat(version, []byte{0, 0, 0}))
+	checkErr(err, t)
+	if apdu.responseLength != 65536 {
+		t.Fatalf("Extended Le of zero should mean 65536, got %d", apdu.responseLength)
+	}
+	apdu, err = decodeU2FMessage(util.Concat(version, []byte{2, 1, 2, 0}))
+	checkErr(err, t)
+	if apdu.extended || !bytes.Equal(apdu.data, []byte{1, 2}) || apdu.responseLength != 256 {
+		t.Fatalf("Short APDU decoded incorrectly: %#v", apdu)
+	}
+}
+
+// startChainedRegistration sends the challenge of a register request in a chained short APDU
+// of session
+func startChainedRegistration(t *testing.T, server *U2FServer, session uint32, challenge []byte) {
+	chainedHeader := append([]byte{u2f_CLA_CHAINING}, u2fHeader(u2f_COMMAND_REGISTER, 0, 0)[1:]...)
+	response := server.HandleSessionMessage(0, session, util.Concat(chainedHeader, []byte{32}, challenge))
+	if !bytes.Equal(response, util.ToBE(u2f_SW_NO_ERROR)) {
+		t.Errorf("Chained APDU not accepted: %#v", response)
+	}
+}
+
+// finishChainedRegistration sends the application parameter in the final APDU of session
+func finishChainedRegistration(server *U2FServer, session uint32, application []byte) []byte {
+	return server.HandleSessionMessage(0, session, util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{32}, application, []byte{0}))
+}
+
+// fetchResponse fetches the rest of a response in parts with GET RESPONSE
+func fetchResponse(t *testing.T, server *U2FServer, session uint32, response []byte) []byte {
+	full := []byte{}
+	for len(response) >= 2 && response[len(response)-2] == u2f_SW1_BYTES_REMAINING {
+		if len(response) != 258 {
+			t.Errorf("Partial response should be 256 bytes, got %d", len(response)-2)
+			return nil
+		}
+		full = append(full, response[:len(response)-2]...)
+		response = server.HandleSessionMessage(0, session, util.Concat(u2fHeader(u2f_COMMAND_GET_RESPONSE, 0, 0), []byte{0}))
+	}
+	return append(full, response...)
+}
+
+func registerChained(t *testing.T, server *U2FServer, session uint32, challenge []byte, application []byte) []byte {
+	startChainedRegistration(t, server, session, challenge)
+	return fetchResponse(t, server, session, finishChainedRegistration(server, session, application))
+}
+
+func verifyRegistration(t *testing.T, response []byte, challenge []byte, application []byte) {
+	_, publicKey, keyHandle, _, signature, returnCode := parseRegistrationResponse(response, t)
+	test.AssertEqual(t, returnCode, u2f_SW_NO_ERROR, "Registration should succeed")
+	signatureBytes := util.Concat([]byte{0}, application, challenge, keyHandle, crypto.EncodePublicKey(publicKey))
+	test.Assert(t, crypto.VerifyECDSA(publicKey, signatureBytes, signature), "Chained request should be reassembled from its own session")
+}
+
+func TestU2FShortAPDUChaining(t *testing.T) {
+	server := NewU2FServer(newDummyU2FClient())
+	challenge := crypto.RandomBytes(32)
+	application := crypto.RandomBytes(32)
+	full := registerChained(t, server, 0, challenge, application)
+	if len(full) <= 258 {
+		t.Fatalf("Response should have needed chaining")
+	}
+	verifyRegistration(t, full, challenge, application)
+}
+
+func TestU2FChainingPerSession(t *testing.T) {
+	server := NewU2FServer(newDummyU2FClient())
+	challenges := [][]byte{crypto.RandomBytes(32), crypto.RandomBytes(32)}
+	applications := [][]byte{crypto.RandomBytes(32), crypto.RandomBytes(32)}
+	// Both channels chain their requests, then fetch their responses, in step with each other
+	for session := range challenges {
+		startChainedRegistration(t, server, uint32(session+1), challenges[session])
+	}
+	responses := make([][]byte, 2)
+	for session := range challenges {
+		responses[session] = finishChainedRegistration(server, uint32(session+1), applications[session])
+	}
+	for session := range challenges {
+		verifyRegistration(t, fetchResponse(t, server, uint32(session+1), responses[session]), challenges[session], applications[session])
+	}
+
+	// And at the same time, for the race detector
+	var wait sync.WaitGroup
+	for session := range responses {
+		wait.Add(1)
+		go func(session int) {
+			defer wait.Done()
+			for i := 0; i < 20; i++ {
+				responses[session] = registerChained(t, server, uint32(session+1), challenges[session], applications[session])
+			}
+		}(session)
+	}
+	wait.Wait()
+	for session := range responses {
+		verifyRegistration(t, responses[session], challenges[session], applications[session])
+	}
+	test.AssertEqual(t, len(server.sessions), 0, "Finished sessions should be forgotten")
+}
+
+func TestU2FChainedRequestLimit(t *testing.T) {
+	server := NewU2FServer(newDummyU2FClient())
+	// Extended APDUs chained with CLA 0x10, carrying length bytes of data
+	chained := func(length int) []byte {
+		header := append([]byte{u2f_CLA_CHAINING}, u2fHeader(u2f_COMMAND_REGISTER, 0, 0)[1:]...)
+		return util.Concat(header, []byte{0}, util.ToBE(uint16(length)), make([]byte, length))
+	}
+	response := server.HandleSessionMessage(0, 1, chained(40000))
+	test.AssertArrEqual(t, response, util.ToBE(u2f_SW_NO_ERROR), "A chained APDU under the limit should be accepted")
+	response = server.HandleSessionMessage(0, 1, chained(40000))
+	test.AssertArrEqual(t, response, util.ToBE(u2f_SW_WRONG_LENGTH), "Chaining past the limit should fail")
+	test.AssertEqual(t, len(server.sessions), 0, "Chained data past the limit should be dropped")
+
+	// The final APDU counts towards the limit too
+	server.HandleSessionMessage(0, 1, chained(40000))
+	final := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0}, util.ToBE(uint16(40000)), make([]byte, 40000))
+	response = server.HandleSessionMessage(0, 1, final)
+	test.AssertArrEqual(t, response, util.ToBE(u2f_SW_WRONG_LENGTH), "A final APDU past the limit should fail")
+	test.AssertEqual(t, len(server.sessions), 0, "Chained data past the limit should be dropped")
+}
+
+func FuzzU2FMessage(f *testing.F) {
+	client := newDummyU2FClient()
+	server := NewU2FServer(client)
+	f.Add(u2fHeader(u2f_COMMAND_VERSION, 0, 0))
+	f.Add(util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, make([]byte, 64), util.ToBE[uint16](256)))
+	f.Add(util.Concat(u2fHeader(u2f_COMMAND_AUTHENTICATE, uint8(u2f_AUTH_CONTROL_CHECK_ONLY), 0), []byte{0, 0, 66}, make([]byte, 64), []byte{1, 0}))
+	f.Fuzz(func(t *testing.T, message []byte) {
+		response := server.HandleMessage(message)
+		if len(response) < 2 {
+			t.Fatalf("Response is missing status word: %#v", response)
+		}
+	})
+}
+
+func TestU2FKeyHandleSealing(t *testing.T) {
+	encryptionKey := sha256.Sum256([]byte("test"))
+	otherKey := sha256.Sum256([]byte("other"))
+	application := crypto.RandomBytes(32)
+	otherApplication := crypto.RandomBytes(32)
+	privateKey, err := x509.MarshalECPrivateKey(crypto.GenerateECDSAKey())
+	checkErr(err, t)
+	sealed, err := webauthn.SealKeyHandle(encryptionKey[:], &webauthn.KeyHandle{PrivateKey: privateKey, ApplicationID: application})
+	checkErr(err, t)
+	keyHandle, err := webauthn.OpenKeyHandle(encryptionKey[:], application, sealed)
+	checkErr(err, t)
+	if !bytes.Equal(keyHandle.PrivateKey, privateKey) || !bytes.Equal(keyHandle.ApplicationID, application) {
+		t.Fatalf("Opened key handle does not match: %#v", keyHandle)
+	}
+	if _, err := webauthn.OpenKeyHandle(encryptionKey[:], otherApplication, sealed); err == nil {
+		t.Fatalf("Opened key handle for another application")
+	}
+	if _, err := webauthn.OpenKeyHandle(otherKey[:], application, sealed); err == nil {
+		t.Fatalf("Opened key handle with another key")
+	}
+	// Without its commitment, the key handle is treated as the old format, which must not open
+	var box map[int][]byte
+	checkErr(cbor.Unmarshal(sealed, &box), t)
+	delete(box, 3)
+	if _, err := webauthn.OpenKeyHandle(encryptionKey[:], application, util.MarshalCBOR(box)); err == nil {
+		t.Fatalf("Opened key handle without its commitment")
+	}
+
+	// Key handles sealed before key commitment still open, but only for their application
+	legacy := util.MarshalCBOR(crypto.Seal(encryptionKey[:], util.MarshalCBOR(webauthn.KeyHandle{PrivateKey: privateKey, ApplicationID: application})))
+	keyHandle, err = webauthn.OpenKeyHandle(encryptionKey[:], application, legacy)
+	checkErr(err, t)
+	if !bytes.Equal(keyHandle.PrivateKey, privateKey) {
+		t.Fatalf("Opened legacy key handle does not match: %#v", keyHandle)
+	}
+	if _, err := webauthn.OpenKeyHandle(encryptionKey[:], otherApplication, legacy); err == nil {
+		t.Fatalf("Opened legacy key handle for another application")
+	}
+	server := NewU2FServer(newDummyU2FClient())
+	authenticate := util.Concat(crypto.RandomBytes(32), application, []byte{byte(len(legacy))}, legacy)
+	response := server.HandleMessage(util.Concat(u2fHeader(u2f_COMMAND_AUTHENTICATE, uint8(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN), 0), []byte{0}, util.ToBE(uint16(len(authenticate))), authenticate, []byte{0, 0}))
+	if status := util.ReadBE[U2FStatusWord](bytes.NewBuffer(response[len(response)-2:])); status != u2f_SW_NO_ERROR {
+		t.Fatalf("Could not authenticate with a legacy key handle: 0x%x", status)
+	}
+}
+
+func TestU2FAuthenticationRateLimit(t *testing.T) {
+	client := newDummyU2FClient()
+	server := NewU2FServer(client)
+	server.SetAuthenticationRateLimit(util.RateLimit{Requests: 1, Per: time.Hour})
+	application := crypto.RandomBytes(32)
+	privateKey, err := x509.MarshalECPrivateKey(crypto.GenerateECDSAKey())
+	checkErr(err, t)
+	keyHandle, err := webauthn.SealKeyHandle(client.SealingEncryptionKey(), &webauthn.KeyHandle{PrivateKey: privateKey, ApplicationID: application})
+	checkErr(err, t)
+	authenticate := func(control U2FAuthenticateControl) U2FStatusWord {
+		request := util.Concat(crypto.RandomBytes(32), application, []byte{byte(len(keyHandle))}, keyHandle)
+		response := server.HandleMessage(util.Concat(u2fHeader(u2f_COMMAND_AUTHENTICATE, uint8(control), 0), []byte{0}, util.ToBE(uint16(len(request))), request, []byte{0, 0}))
+		return util.ReadBE[U2FStatusWord](bytes.NewBuffer(response[len(response)-2:]))
+	}
+	if status := authenticate(u2f_AUTH_CONTROL_CHECK_ONLY); status != u2f_SW_CONDITIONS_NOT_SATISFIED {
+		t.Fatalf("Check-only should find the key handle: 0x%x", status)
+	}
+	if status := authenticate(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN); status != u2f_SW_NO_ERROR {
+		t.Fatalf("Check-only requests shouldn't be counted: 0x%x", status)
+	}
+	if status := authenticate(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN); status != u2f_SW_CONDITIONS_NOT_SATISFIED {
+		t.Fatalf("Authentications past the limit should be refused: 0x%x", status)
+	}
+}
+
+type alwaysUVU2FClient struct {
+	U2FClient
+	alwaysUV bool
+}
+
+func (client *alwaysUVU2FClient) AlwaysUV() bool {
+	return client.alwaysUV
+}
+
+func TestU2FAlwaysUV(t *testing.T) {
+	client := &alwaysUVU2FClient{U2FClient: newDummyU2FClient(), alwaysUV: true}
+	server := NewU2FServer(client)
+	version := util.Concat(u2fHeader(u2f_COMMAND_VERSION, 0, 0), []byte{0, 0, 0})
+	response := server.HandleMessage(version)
+	if !bytes.Equal(response, util.ToBE(u2f_SW_INS_NOT_SUPPORTED)) {
+		t.Fatalf("U2F should be turned off: %#v", response)
+	}
+	client.alwaysUV = false
+	response = server.HandleMessage(version)
+	if !bytes.Equal(response, util.Concat([]byte("U2F_V2"), util.ToBE(u2f_SW_NO_ERROR))) {
+		t.Fatalf("U2F should work again: %#v", response)
+	}
+}
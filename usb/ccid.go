@@ -0,0 +1,303 @@
+package usb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var ccidLogger = util.NewLogger("[CCID] ", util.LogSubsystemUSB, util.LogLevelDebug)
+
+// APDUs can carry PINs and keys, so their data is only logged at the unsafe level
+var unsafeCCIDLogger = util.NewLogger("[CCID] ", util.LogSubsystemUSB, util.LogLevelUnsafe)
+
+// CCIDCard is the smartcard in the reader of a CCID interface
+type CCIDCard interface {
+	// ATR is the Answer To Reset sent when the host powers on the card
+	ATR() []byte
+	// HandleAPDU returns the response APDU, including the status word, for a command APDU
+	HandleAPDU(command []byte) []byte
+}
+
+const (
+	usbInterfaceClassCCID = 0x0B
+
+	ccidDescriptorFunctional usbDescriptorType = 0x21
+	// Enough for an extended APDU with a few KB of data
+	ccidMaxMessageLength = 3072
+	// Messages the host can send ahead of the card answering, before the USB/IP connection
+	// waits for it
+	ccidMessageQueueLength = 16
+)
+
+type ccidMessageType uint8
+
+const (
+	ccidPCToRDRSetParameters   ccidMessageType = 0x61
+	ccidPCToRDRIccPowerOn      ccidMessageType = 0x62
+	ccidPCToRDRIccPowerOff     ccidMessageType = 0x63
+	ccidPCToRDRGetSlotStatus   ccidMessageType = 0x65
+	ccidPCToRDRGetParameters   ccidMessageType = 0x6C
+	ccidPCToRDRResetParameters ccidMessageType = 0x6D
+	ccidPCToRDRXfrBlock        ccidMessageType = 0x6F
+	ccidPCToRDRAbort           ccidMessageType = 0x72
+
+	ccidRDRToPCDataBlock  ccidMessageType = 0x80
+	ccidRDRToPCSlotStatus ccidMessageType = 0x81
+	ccidRDRToPCParameters ccidMessageType = 0x82
+)
+
+// Bits of bStatus in replies
+const (
+	ccidICCActive     uint8 = 0x00
+	ccidICCInactive   uint8 = 0x01
+	ccidCommandFailed uint8 = 0x40
+)
+
+// bError values of failed commands
+const (
+	ccidErrorCommandNotSupported uint8 = 0x00
+	ccidErrorBadSlot             uint8 = 0x05
+	ccidErrorICCMute             uint8 = 0xFE
+)
+
+const ccidRequestAbort = 0x01
+
+// T=1 protocol data returned for GET_PARAMETERS, which we never actually use
+var ccidT1Parameters = []byte{0x11, 0x10, 0x00, 0x4D, 0x00, 0xFE, 0x00}
+
+type ccidClassDescriptor struct {
+	BLength                uint8
+	BDescriptorType        usbDescriptorType
+	BcdCCID                uint16
+	BMaxSlotIndex          uint8
+	BVoltageSupport        uint8
+	DwProtocols            uint32
+	DwDefaultClock         uint32
+	DwMaximumClock         uint32
+	BNumClockSupported     uint8
+	DwDataRate             uint32
+	DwMaxDataRate          uint32
+	BNumDataRatesSupported uint8
+	DwMaxIFSD              uint32
+	DwSynchProtocols       uint32
+	DwMechanical           uint32
+	DwFeatures             uint32
+	DwMaxCCIDMessageLength uint32
+	BClassGetResponse      uint8
+	BClassEnvelope         uint8
+	WLcdLayout             uint16
+	BPINSupport            uint8
+	BMaxCCIDBusySlots      uint8
+}
+
+// Header of every bulk message. The last three bytes depend on the message; in replies
+// they are bStatus, bError and a message specific byte.
+type ccidMessageHeader struct {
+	MessageType ccidMessageType
+	Length      uint32
+	Slot        uint8
+	Sequence    uint8
+	Specific    [3]uint8
+}
+
+func (header ccidMessageHeader) String() string {
+	return fmt.Sprintf("CCIDMessageHeader{ MessageType: 0x%x, Length: %d, Slot: %d, Sequence: %d, Specific: %v }",
+		header.MessageType,
+		header.Length,
+		header.Slot,
+		header.Sequence,
+		header.Specific)
+}
+
+// ccidRequest is a complete bulk OUT message waiting for the card
+type ccidRequest struct {
+	trace  util.TraceID
+	header ccidMessageHeader
+	data   []byte
+}
+
+// ccidInterface is a smartcard reader with a single slot that always holds the card
+type ccidInterface struct {
+	device *USBDevice
+	card   CCIDCard
+	send   func(trace util.TraceID, index int, data []byte)
+	// Bulk transfers may split a message, so OUT data is collected until it's complete
+	pending []byte
+	// Messages are handled one at a time, in order, by the goroutine started by start
+	messages chan ccidRequest
+	powered  bool
+}
+
+// AddCCIDInterface adds a smartcard reader holding card, which makes the device a composite
+// device. It must be called before the device is attached.
+func (device *USBDevice) AddCCIDInterface(card CCIDCard) {
+	device.addInterface(&ccidInterface{device: device, card: card})
+}
+
+func (iface *ccidInterface) name() string {
+	return "CCID Interface"
+}
+
+func (iface *ccidInterface) interfaceClass() (uint8, uint8, uint8) {
+	return usbInterfaceClassCCID, 0, 0
+}
+
+func (iface *ccidInterface) classDescriptors() []byte {
+	descriptor := ccidClassDescriptor{
+		BLength:         util.SizeOf[ccidClassDescriptor](),
+		BDescriptorType: ccidDescriptorFunctional,
+		BcdCCID:         0x0110,
+		BMaxSlotIndex:   0,
+		// 5V, 3V and 1.8V
+		BVoltageSupport: 0x07,
+		// T=1
+		DwProtocols:    0x02,
+		DwDefaultClock: 4000,
+		DwMaximumClock: 4000,
+		DwDataRate:     10752,
+		DwMaxDataRate:  10752,
+		DwMaxIFSD:      254,
+		// The reader handles voltage, clock, baud rate and parameters itself and exchanges
+		// whole short and extended APDUs
+		DwFeatures:             0x000400FE,
+		DwMaxCCIDMessageLength: ccidMaxMessageLength,
+		BClassGetResponse:      0xFF,
+		BClassEnvelope:         0xFF,
+		BMaxCCIDBusySlots:      1,
+	}
+	return util.ToLE(descriptor)
+}
+
+func (iface *ccidInterface) endpoints() []usbEndpointDescriptor {
+	// Bulk endpoints have a fixed packet size at each speed
+	packetSize := uint16(64)
+	if iface.device.speed == USBSpeedHigh {
+		packetSize = 512
+	}
+	length := util.SizeOf[usbEndpointDescriptor]()
+	return []usbEndpointDescriptor{
+		{
+			BLength:          length,
+			BDescriptorType:  usbDescriptorEndpoint,
+			BEndpointAddress: 0b00000000,
+			BmAttributes:     0b00000010,
+			WMaxPacketSize:   packetSize,
+		},
+		{
+			BLength:          length,
+			BDescriptorType:  usbDescriptorEndpoint,
+			BEndpointAddress: 0b10000000,
+			BmAttributes:     0b00000010,
+			WMaxPacketSize:   packetSize,
+		},
+	}
+}
+
+func (iface *ccidInterface) handleRequest(setup usbSetupPacket, data []byte) ([]byte, error) {
+	if setup.requestClass() == usbRequestClassClass && setup.BRequest == ccidRequestAbort {
+		// Messages are never left half done, so there is nothing to abort
+		ccidLogger.Printf("ABORT: No-op\n\n")
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Invalid CCID bRequest: %d", setup.BRequest)
+}
+
+func (iface *ccidInterface) handleOutput(trace util.TraceID, index int, data []byte) {
+	iface.pending = append(iface.pending, data...)
+	headerSize := int(util.SizeOf[ccidMessageHeader]())
+	for len(iface.pending) >= headerSize {
+		header := util.ReadLE[ccidMessageHeader](bytes.NewBuffer(iface.pending))
+		if header.Length > ccidMaxMessageLength {
+			ccidLogger.WithTrace(trace).Printf("ERROR: CCID message too long: %s\n\n", header)
+			iface.pending = nil
+			return
+		}
+		length := headerSize + int(header.Length)
+		if len(iface.pending) < length {
+			return
+		}
+		message := iface.pending[:length:length]
+		iface.pending = iface.pending[length:]
+		// The card can take a while, so don't hold up the USB/IP connection
+		iface.messages <- ccidRequest{trace: trace, header: header, data: message[headerSize:]}
+	}
+}
+
+func (iface *ccidInterface) start(send func(trace util.TraceID, index int, data []byte)) {
+	iface.send = send
+	iface.messages = make(chan ccidRequest, ccidMessageQueueLength)
+	go func() {
+		for message := range iface.messages {
+			iface.handleMessage(message.trace, message.header, message.data)
+		}
+	}()
+}
+
+func (iface *ccidInterface) handleMessage(trace util.TraceID, header ccidMessageHeader, data []byte) {
+	ccidLogger.WithTrace(trace).Printf("CCID MESSAGE: %s\n\n", header)
+	unsafeCCIDLogger.WithTrace(trace).Printf("CCID MESSAGE DATA: %#v\n\n", data)
+	if header.Slot != 0 {
+		iface.reply(trace, header, iface.failedReplyType(header.MessageType), ccidCommandFailed|ccidICCActive, ccidErrorBadSlot, 0, nil)
+		return
+	}
+	switch header.MessageType {
+	case ccidPCToRDRIccPowerOn:
+		iface.powered = true
+		iface.reply(trace, header, ccidRDRToPCDataBlock, ccidICCActive, 0, 0, iface.card.ATR())
+	case ccidPCToRDRIccPowerOff:
+		iface.powered = false
+		iface.reply(trace, header, ccidRDRToPCSlotStatus, ccidICCInactive, 0, 0, nil)
+	case ccidPCToRDRGetSlotStatus, ccidPCToRDRAbort:
+		iface.reply(trace, header, ccidRDRToPCSlotStatus, iface.iccStatus(), 0, 0, nil)
+	case ccidPCToRDRGetParameters, ccidPCToRDRResetParameters, ccidPCToRDRSetParameters:
+		// Always T=1, whatever the host asks for
+		iface.reply(trace, header, ccidRDRToPCParameters, iface.iccStatus(), 0, 1, ccidT1Parameters)
+	case ccidPCToRDRXfrBlock:
+		if !iface.powered {
+			iface.reply(trace, header, ccidRDRToPCDataBlock, ccidCommandFailed|ccidICCInactive, ccidErrorICCMute, 0, nil)
+			return
+		}
+		iface.reply(trace, header, ccidRDRToPCDataBlock, ccidICCActive, 0, 0, iface.card.HandleAPDU(data))
+	default:
+		ccidLogger.WithTrace(trace).Printf("ERROR: Unsupported CCID message: 0x%x\n\n", header.MessageType)
+		iface.reply(trace, header, iface.failedReplyType(header.MessageType), ccidCommandFailed|iface.iccStatus(), ccidErrorCommandNotSupported, 0, nil)
+	}
+}
+
+func (iface *ccidInterface) iccStatus() uint8 {
+	if iface.powered {
+		return ccidICCActive
+	}
+	return ccidICCInactive
+}
+
+// failedReplyType is the reply the host expects for a message it sent
+func (iface *ccidInterface) failedReplyType(messageType ccidMessageType) ccidMessageType {
+	switch messageType {
+	case ccidPCToRDRIccPowerOn, ccidPCToRDRXfrBlock:
+		return ccidRDRToPCDataBlock
+	case ccidPCToRDRGetParameters, ccidPCToRDRResetParameters, ccidPCToRDRSetParameters:
+		return ccidRDRToPCParameters
+	default:
+		return ccidRDRToPCSlotStatus
+	}
+}
+
+func (iface *ccidInterface) reply(trace util.TraceID, request ccidMessageHeader, messageType ccidMessageType, status uint8, errorCode uint8, specific uint8, data []byte) {
+	header := ccidMessageHeader{
+		MessageType: messageType,
+		Length:      uint32(len(data)),
+		Slot:        request.Slot,
+		Sequence:    request.Sequence,
+		Specific:    [3]uint8{status, errorCode, specific},
+	}
+	ccidLogger.WithTrace(trace).Printf("CCID REPLY: %s\n\n", header)
+	unsafeCCIDLogger.WithTrace(trace).Printf("CCID REPLY DATA: %#v\n\n", data)
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, header)
+	buffer.Write(data)
+	iface.send(trace, 1, buffer.Bytes())
+}
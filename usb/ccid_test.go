@@ -0,0 +1,148 @@
+package usb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/usbip"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type dummyCCIDCard struct{}
+
+func (card *dummyCCIDCard) ATR() []byte {
+	return []byte{0x3B, 0x80, 0x80, 0x01, 0x01}
+}
+
+func (card *dummyCCIDCard) HandleAPDU(command []byte) []byte {
+	return util.Concat(command, []byte{0x90, 0x00})
+}
+
+func ccidMessage(messageType ccidMessageType, sequence uint8, data []byte) []byte {
+	header := ccidMessageHeader{MessageType: messageType, Length: uint32(len(data)), Sequence: sequence}
+	return util.Concat(util.ToLE(header), data)
+}
+
+// ccidExchange writes a message to the bulk OUT endpoint and reads the reply from bulk IN
+func ccidExchange(t *testing.T, device *USBDevice, message []byte) (ccidMessageHeader, []byte) {
+	setup := make([]byte, util.SizeOf[usbSetupPacket]())
+	device.HandleMessage(0, func([]byte, int32) {}, 3, setup, message)
+	return ccidReadReply(t, device)
+}
+
+func ccidReadReply(t *testing.T, device *USBDevice) (ccidMessageHeader, []byte) {
+	setup := make([]byte, util.SizeOf[usbSetupPacket]())
+	replies := make(chan []byte, 1)
+	device.HandleMessage(1, func(response []byte, status int32) {
+		replies <- response
+	}, 4, setup, nil)
+	select {
+	case reply := <-replies:
+		buffer := bytes.NewBuffer(reply)
+		header := util.ReadLE[ccidMessageHeader](buffer)
+		return header, buffer.Bytes()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No CCID reply")
+		return ccidMessageHeader{}, nil
+	}
+}
+
+func TestCCIDDescriptors(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	device.AddCCIDInterface(&dummyCCIDCard{})
+	test.AssertEqual(t, util.SizeOf[ccidClassDescriptor](), 54, "CCID descriptor has the wrong size")
+	var setup usbSetupPacket
+	setup.setDirection(usbDeviceToHost)
+	setup.setRecipient(usbRequestRecipientDevice)
+	setup.BRequest = usbRequestGetDescriptor
+	setup.WValue = uint16(usbDescriptorConfiguration) << 8
+	setup.WLength = 0xFFFF
+	response, status := sendControlMessage(device, setup)
+	test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Could not get configuration")
+	buffer := bytes.NewBuffer(response)
+	configuration := util.ReadLE[usbConfigurationDescriptor](buffer)
+	test.AssertEqual(t, int(configuration.WTotalLength), len(response), "WTotalLength incorrect")
+	test.AssertEqual(t, configuration.BNumInterfaces, 2, "Device should have two interfaces")
+	// Skip past the HID interface
+	util.ReadLE[usbInterfaceDescriptor](buffer)
+	util.ReadLE[usbHIDDescriptor](buffer)
+	util.ReadLE[usbEndpointDescriptor](buffer)
+	util.ReadLE[usbEndpointDescriptor](buffer)
+	ccid := util.ReadLE[usbInterfaceDescriptor](buffer)
+	test.AssertEqual(t, ccid.BInterfaceNumber, 1, "CCID should be the second interface")
+	test.AssertEqual(t, ccid.BInterfaceClass, usbInterfaceClassCCID, "Incorrect interface class")
+	test.AssertEqual(t, ccid.BNumEndpoints, 2, "CCID should have two endpoints")
+	classDescriptor := util.ReadLE[ccidClassDescriptor](buffer)
+	test.AssertEqual(t, classDescriptor.BDescriptorType, ccidDescriptorFunctional, "Incorrect class descriptor")
+	bulkOut := util.ReadLE[usbEndpointDescriptor](buffer)
+	test.AssertEqual(t, bulkOut.BEndpointAddress, 0x03, "Bulk OUT should be endpoint 3")
+	bulkIn := util.ReadLE[usbEndpointDescriptor](buffer)
+	test.AssertEqual(t, bulkIn.BEndpointAddress, 0x84, "Bulk IN should be endpoint 4")
+	test.AssertEqual(t, buffer.Len(), 0, "Unexpected descriptors")
+
+	name, err := device.getDescriptor(usbDescriptorString, usbInterfaceStringIndex+1)
+	test.Assert(t, err == nil, "Missing CCID interface name")
+	test.Assert(t, bytes.Contains(name, util.Utf16encode("CCID Interface")), "Incorrect CCID interface name")
+	summary := device.DeviceSummary()
+	test.AssertEqual(t, len(summary.DeviceInterfaces), 2, "Summary should list both interfaces")
+}
+
+func TestCCIDMessages(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	card := &dummyCCIDCard{}
+	device.AddCCIDInterface(card)
+
+	header, data := ccidExchange(t, device, ccidMessage(ccidPCToRDRXfrBlock, 1, []byte{0x00, 0xA4}))
+	test.AssertEqual(t, header.Specific[0], ccidCommandFailed|ccidICCInactive, "Unpowered card should fail")
+	test.AssertEqual(t, header.Specific[1], ccidErrorICCMute, "Unpowered card should be mute")
+
+	header, data = ccidExchange(t, device, ccidMessage(ccidPCToRDRIccPowerOn, 2, nil))
+	test.AssertEqual(t, header.MessageType, ccidRDRToPCDataBlock, "Power on should return a data block")
+	test.AssertEqual(t, header.Sequence, 2, "Reply should echo the sequence number")
+	test.Assert(t, bytes.Equal(data, card.ATR()), "Power on should return the ATR")
+
+	apdu := []byte{0x00, 0xA4, 0x04, 0x00, 0x02, 0xA0, 0x00}
+	// Split the message like a host sending several bulk packets
+	message := ccidMessage(ccidPCToRDRXfrBlock, 3, apdu)
+	setup := make([]byte, util.SizeOf[usbSetupPacket]())
+	device.HandleMessage(0, func([]byte, int32) {}, 3, setup, message[:6])
+	header, data = ccidExchange(t, device, message[6:])
+	test.AssertEqual(t, header.MessageType, ccidRDRToPCDataBlock, "APDU should return a data block")
+	test.AssertEqual(t, header.Specific[0], ccidICCActive, "APDU should succeed")
+	test.Assert(t, bytes.Equal(data, card.HandleAPDU(apdu)), "Incorrect response APDU")
+
+	header, _ = ccidExchange(t, device, ccidMessage(0x6B, 4, nil))
+	test.AssertEqual(t, header.MessageType, ccidRDRToPCSlotStatus, "Unsupported messages should return slot status")
+	test.AssertEqual(t, header.Specific[0]&ccidCommandFailed, ccidCommandFailed, "Unsupported messages should fail")
+
+	header, _ = ccidExchange(t, device, ccidMessage(ccidPCToRDRIccPowerOff, 5, nil))
+	test.AssertEqual(t, header.Specific[0], ccidICCInactive, "Card should be powered off")
+}
+
+// slowCCIDCard takes longer to answer APDUs that start with a larger byte
+type slowCCIDCard struct {
+	dummyCCIDCard
+}
+
+func (card *slowCCIDCard) HandleAPDU(command []byte) []byte {
+	time.Sleep(time.Duration(command[0]) * time.Millisecond)
+	return card.dummyCCIDCard.HandleAPDU(command)
+}
+
+func TestCCIDMessageOrder(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	device.AddCCIDInterface(&slowCCIDCard{})
+	ccidExchange(t, device, ccidMessage(ccidPCToRDRIccPowerOn, 0, nil))
+	// Send every message before reading any reply, with earlier APDUs taking longer
+	setup := make([]byte, util.SizeOf[usbSetupPacket]())
+	for sequence := uint8(1); sequence <= 10; sequence++ {
+		device.HandleMessage(0, func([]byte, int32) {}, 3, setup, ccidMessage(ccidPCToRDRXfrBlock, sequence, []byte{20 - 2*sequence}))
+	}
+	for sequence := uint8(1); sequence <= 10; sequence++ {
+		header, data := ccidReadReply(t, device)
+		test.AssertEqual(t, header.Sequence, sequence, "Replies should come in the order of the messages")
+		test.AssertArrEqual(t, data, []byte{20 - 2*sequence, 0x90, 0x00}, "Reply should answer its own message")
+	}
+}
@@ -0,0 +1,162 @@
+package usb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+const (
+	usbHIDSubclassBoot        = 1
+	usbHIDProtocolKeyboard    = 1
+	usbHIDProtocolReport      = 1
+	keyboardReportLength      = 8
+	keyboardModifierLeftShift = 0x02
+	keyboardKeyEnter          = 0x28
+)
+
+// The boot keyboard report descriptor from appendix E.6 of the HID spec: a modifier byte,
+// a reserved byte and six key codes in, the LED state out
+var keyboardHIDReport = []byte{
+	0x05, 0x01, 0x09, 0x06, 0xA1, 0x01, 0x05, 0x07, 0x19, 0xE0, 0x29, 0xE7, 0x15, 0x00, 0x25, 0x01,
+	0x75, 0x01, 0x95, 0x08, 0x81, 0x02, 0x95, 0x01, 0x75, 0x08, 0x81, 0x01, 0x95, 0x05, 0x75, 0x01,
+	0x05, 0x08, 0x19, 0x01, 0x29, 0x05, 0x91, 0x02, 0x95, 0x01, 0x75, 0x03, 0x91, 0x01, 0x95, 0x06,
+	0x75, 0x08, 0x15, 0x00, 0x25, 0x65, 0x05, 0x07, 0x19, 0x00, 0x29, 0x65, 0x81, 0x00, 0xC0,
+}
+
+type keyStroke struct {
+	modifiers uint8
+	key       uint8
+}
+
+// Key codes for printable ASCII on a US layout, which is what the host assumes for a
+// keyboard without a country code
+var keyboardUSLayout = func() map[rune]keyStroke {
+	layout := map[rune]keyStroke{
+		'\n': {0, keyboardKeyEnter},
+		'\t': {0, 0x2B},
+		' ':  {0, 0x2C},
+	}
+	for i := 0; i < 26; i++ {
+		layout[rune('a'+i)] = keyStroke{0, uint8(0x04 + i)}
+		layout[rune('A'+i)] = keyStroke{keyboardModifierLeftShift, uint8(0x04 + i)}
+	}
+	digits := "1234567890"
+	shiftedDigits := "!@#$%^&*()"
+	for i := range digits {
+		layout[rune(digits[i])] = keyStroke{0, uint8(0x1E + i)}
+		layout[rune(shiftedDigits[i])] = keyStroke{keyboardModifierLeftShift, uint8(0x1E + i)}
+	}
+	symbols := "-=[]\\"
+	shiftedSymbols := "_+{}|"
+	for i := range symbols {
+		layout[rune(symbols[i])] = keyStroke{0, uint8(0x2D + i)}
+		layout[rune(shiftedSymbols[i])] = keyStroke{keyboardModifierLeftShift, uint8(0x2D + i)}
+	}
+	symbols = ";'`,./"
+	shiftedSymbols = ":\"~<>?"
+	for i := range symbols {
+		layout[rune(symbols[i])] = keyStroke{0, uint8(0x33 + i)}
+		layout[rune(shiftedSymbols[i])] = keyStroke{keyboardModifierLeftShift, uint8(0x33 + i)}
+	}
+	return layout
+}()
+
+// USBKeyboard is a boot keyboard interface that types text for the host, the way a
+// YubiKey types its OTP slots
+type USBKeyboard struct {
+	device *USBDevice
+	send   func(trace util.TraceID, index int, data []byte)
+	// Keeps the key strokes of concurrent calls to Type from interleaving
+	lock sync.Mutex
+}
+
+// AddKeyboardInterface adds a HID keyboard, which makes the device a composite device.
+// It must be called before the device is attached.
+func (device *USBDevice) AddKeyboardInterface() *USBKeyboard {
+	keyboard := &USBKeyboard{device: device}
+	device.addInterface(keyboard)
+	return keyboard
+}
+
+// Type queues a key press and release for each character of text. Only printable ASCII,
+// tabs and newlines can be typed.
+func (keyboard *USBKeyboard) Type(text string) error {
+	strokes := make([]keyStroke, 0, len(text))
+	for _, char := range text {
+		stroke, ok := keyboardUSLayout[char]
+		if !ok {
+			return fmt.Errorf("Cannot type character %q", char)
+		}
+		strokes = append(strokes, stroke)
+	}
+	keyboard.lock.Lock()
+	defer keyboard.lock.Unlock()
+	for _, stroke := range strokes {
+		press := make([]byte, keyboardReportLength)
+		press[0] = stroke.modifiers
+		press[2] = stroke.key
+		keyboard.send(0, 0, press)
+		// Releasing every key lets the host see repeated characters as separate presses
+		keyboard.send(0, 0, make([]byte, keyboardReportLength))
+	}
+	return nil
+}
+
+func (keyboard *USBKeyboard) name() string {
+	return "Keyboard Interface"
+}
+
+func (keyboard *USBKeyboard) interfaceClass() (uint8, uint8, uint8) {
+	return usbInterfaceClassHID, usbHIDSubclassBoot, usbHIDProtocolKeyboard
+}
+
+func (keyboard *USBKeyboard) classDescriptors() []byte {
+	return util.ToLE(keyboard.device.getHIDDescriptor(keyboard.hidReport()))
+}
+
+func (keyboard *USBKeyboard) endpoints() []usbEndpointDescriptor {
+	// Poll every 8ms regardless of the FIDO interface's interval, so typing isn't slow
+	var interval uint8 = 8
+	if keyboard.device.speed == USBSpeedHigh {
+		interval = 7
+	}
+	return []usbEndpointDescriptor{
+		{
+			BLength:          util.SizeOf[usbEndpointDescriptor](),
+			BDescriptorType:  usbDescriptorEndpoint,
+			BEndpointAddress: 0b10000000,
+			BmAttributes:     0b00000011,
+			WMaxPacketSize:   keyboardReportLength,
+			BInterval:        interval,
+		},
+	}
+}
+
+func (keyboard *USBKeyboard) hidReport() []byte {
+	return keyboardHIDReport
+}
+
+func (keyboard *USBKeyboard) handleRequest(setup usbSetupPacket, data []byte) ([]byte, error) {
+	switch usbHIDRequestType(setup.BRequest) {
+	case usbHIDRequestGetReport:
+		return make([]byte, keyboardReportLength), nil
+	case usbHIDRequestSetReport:
+		// The host setting the LEDs, which we don't have
+		return nil, nil
+	case usbHIDRequestGetIdle:
+		return []byte{0}, nil
+	case usbHIDRequestGetProtocol:
+		// Boot and report protocol reports are the same for this keyboard
+		return []byte{usbHIDProtocolReport}, nil
+	}
+	return keyboard.device.handleHIDRequest(setup)
+}
+
+func (keyboard *USBKeyboard) handleOutput(trace util.TraceID, index int, data []byte) {
+}
+
+func (keyboard *USBKeyboard) start(send func(trace util.TraceID, index int, data []byte)) {
+	keyboard.send = send
+}
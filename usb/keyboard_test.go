@@ -0,0 +1,67 @@
+package usb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/usbip"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+func readKeyboardReport(t *testing.T, device *USBDevice) []byte {
+	setup := make([]byte, util.SizeOf[usbSetupPacket]())
+	reports := make(chan []byte, 1)
+	device.HandleMessage(0, func(response []byte, status int32) {
+		reports <- response
+	}, 3, setup, nil)
+	select {
+	case report := <-reports:
+		return report
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No keyboard report")
+		return nil
+	}
+}
+
+func TestKeyboardDescriptors(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	device.AddKeyboardInterface()
+	keyboard := device.getInterfaceDescriptor(1)
+	test.AssertEqual(t, keyboard.BInterfaceClass, usbInterfaceClassHID, "Keyboard should be a HID interface")
+	test.AssertEqual(t, keyboard.BInterfaceProtocol, usbHIDProtocolKeyboard, "Keyboard should use the keyboard boot protocol")
+	endpoints := device.getInterfaceEndpoints(1)
+	test.AssertEqual(t, len(endpoints), 1, "Keyboard should only have an IN endpoint")
+	test.AssertEqual(t, endpoints[0].BEndpointAddress, 0x83, "Keyboard IN should be endpoint 3")
+
+	var setup usbSetupPacket
+	setup.setDirection(usbDeviceToHost)
+	setup.setRecipient(usbRequestRecipientInterface)
+	setup.BRequest = usbRequestGetDescriptor
+	setup.WValue = uint16(usbDescriptorHIDReport) << 8
+	setup.WIndex = 1
+	setup.WLength = 0xFF
+	response, status := sendControlMessage(device, setup)
+	test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Could not get keyboard report descriptor")
+	test.Assert(t, bytes.Equal(response, keyboardHIDReport), "Incorrect keyboard report descriptor")
+	setup.WIndex = 0
+	response, _ = sendControlMessage(device, setup)
+	test.Assert(t, bytes.Equal(response, device.getHIDReport()), "FIDO report descriptor changed")
+}
+
+func TestKeyboardType(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	keyboard := device.AddKeyboardInterface()
+	err := keyboard.Type("é")
+	test.Assert(t, err != nil, "Non-ASCII characters can't be typed")
+	err = keyboard.Type("aA1\n")
+	test.Assert(t, err == nil, "Could not type text")
+	expected := []keyStroke{{0, 0x04}, {keyboardModifierLeftShift, 0x04}, {0, 0x1E}, {0, keyboardKeyEnter}}
+	for _, stroke := range expected {
+		press := readKeyboardReport(t, device)
+		test.Assert(t, bytes.Equal(press, []byte{stroke.modifiers, 0, stroke.key, 0, 0, 0, 0, 0}), "Incorrect key press")
+		release := readKeyboardReport(t, device)
+		test.Assert(t, bytes.Equal(release, make([]byte, keyboardReportLength)), "Key should be released")
+	}
+}
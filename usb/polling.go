@@ -0,0 +1,52 @@
+package usb
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// InterruptPolling controls how interrupt IN endpoints answer the host's polls, to reproduce
+// timing-sensitive host behavior
+type InterruptPolling struct {
+	// How long a poll waits for data before it completes without any, or 0 to wait until
+	// there is data, like a device that NAKs every poll in between
+	EmptyPollTimeout time.Duration
+	// Chance that the device NAKs a poll while it has data, holding the data back for another
+	// polling interval
+	NAKRate float64
+}
+
+func DefaultInterruptPolling() InterruptPolling {
+	return InterruptPolling{EmptyPollTimeout: time.Second}
+}
+
+// SetInterruptPolling changes how interrupt IN polls are answered. Must be called before the
+// device is attached.
+func (device *USBDevice) SetInterruptPolling(polling InterruptPolling) error {
+	if polling.EmptyPollTimeout < 0 {
+		return fmt.Errorf("Empty poll timeout can't be negative: %s", polling.EmptyPollTimeout)
+	}
+	if polling.NAKRate < 0 || polling.NAKRate >= 1 {
+		return fmt.Errorf("NAK rate must be at least 0 and less than 1, not %f", polling.NAKRate)
+	}
+	device.polling = polling
+	return nil
+}
+
+// pollingPeriod is how often the host polls the interrupt endpoints
+func (device *USBDevice) pollingPeriod() time.Duration {
+	if device.speed == USBSpeedHigh {
+		// 2^(interval-1) microframes of 125us
+		return time.Duration(1<<(device.interval-1)) * 125 * time.Microsecond
+	}
+	return time.Duration(device.interval) * time.Millisecond
+}
+
+// simulateNAKs holds data back for a polling interval for every poll the device NAKs. Data
+// is held before it's queued, so it still reaches the host in order.
+func (device *USBDevice) simulateNAKs() {
+	for device.polling.NAKRate > 0 && rand.Float64() < device.polling.NAKRate {
+		time.Sleep(device.pollingPeriod())
+	}
+}
@@ -0,0 +1,63 @@
+package usb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/usbip"
+)
+
+func pollInterrupt(device *USBDevice, id uint32) chan []byte {
+	responses := make(chan []byte, 1)
+	device.HandleMessage(id, func(response []byte, status int32) {
+		responses <- response
+	}, 1, make([]byte, 8), nil)
+	return responses
+}
+
+func TestInterruptPollingValidation(t *testing.T) {
+	device := NewUSBDevice(&echoUSBDeviceDelegate{})
+	test.Assert(t, device.SetInterruptPolling(InterruptPolling{NAKRate: 1}) != nil, "NAKing every poll should be rejected")
+	test.Assert(t, device.SetInterruptPolling(InterruptPolling{NAKRate: -0.1}) != nil, "Negative NAK rate should be rejected")
+	test.Assert(t, device.SetInterruptPolling(InterruptPolling{EmptyPollTimeout: -time.Second}) != nil, "Negative timeout should be rejected")
+
+	test.AssertEqual(t, device.pollingPeriod(), 255*time.Millisecond, "Full speed interval is in milliseconds")
+	test.Assert(t, device.SetSpeed(USBSpeedHigh, 64, 4) == nil, "Could not switch to high speed")
+	test.AssertEqual(t, device.pollingPeriod(), time.Millisecond, "High speed interval is an exponent of microframes")
+}
+
+func TestEmptyPolls(t *testing.T) {
+	device := NewUSBDevice(&echoUSBDeviceDelegate{})
+	test.Assert(t, device.SetInterruptPolling(InterruptPolling{EmptyPollTimeout: 10 * time.Millisecond}) == nil, "Could not set polling")
+	select {
+	case response := <-pollInterrupt(device, 1):
+		test.Assert(t, response == nil, "Poll without data should complete empty")
+	case <-time.After(time.Second):
+		t.Fatal("Poll without data should time out")
+	}
+
+	test.Assert(t, device.SetInterruptPolling(InterruptPolling{}) == nil, "Could not set polling")
+	responses := pollInterrupt(device, 2)
+	select {
+	case <-responses:
+		t.Fatal("Poll should wait for data without a timeout")
+	case <-time.After(30 * time.Millisecond):
+	}
+	device.HandleMessage(3, func([]byte, int32) {}, 2, make([]byte, 8), []byte{1})
+	test.AssertArrEqual(t, <-responses, []byte{1}, "Poll should get the data once it's ready")
+}
+
+func TestNAKSimulation(t *testing.T) {
+	device := NewUSBDevice(&echoUSBDeviceDelegate{})
+	test.Assert(t, device.SetSpeed(USBSpeedFull, 64, 1) == nil, "Could not set interval")
+	test.Assert(t, device.SetInterruptPolling(InterruptPolling{NAKRate: 0.5}) == nil, "Could not set polling")
+	for i := byte(0); i < 10; i++ {
+		device.HandleMessage(uint32(i), func(response []byte, status int32) {
+			test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Output failed")
+		}, 2, make([]byte, 8), []byte{i})
+	}
+	for i := byte(0); i < 10; i++ {
+		test.AssertArrEqual(t, <-pollInterrupt(device, uint32(10+i)), []byte{i}, "NAKs should not reorder reports")
+	}
+}
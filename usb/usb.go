@@ -80,6 +80,15 @@ const (
 	usbHIDRequestSetProtocol   usbHIDRequestType = 11
 )
 
+// Report types in the high byte of wValue for GET_REPORT and SET_REPORT
+type usbHIDReportType uint8
+
+const (
+	usbHIDReportInput   usbHIDReportType = 1
+	usbHIDReportOutput  usbHIDReportType = 2
+	usbHIDReportFeature usbHIDReportType = 3
+)
+
 var interfaceRequestDescriptions = map[usbHIDRequestType]string{
 	usbHIDRequestGetReport:     "usbHIDRequestGetReport",
 	usbHIDRequestGetIdle:       "usbHIDRequestGetIdle",
@@ -140,11 +149,29 @@ const (
 	usbConfigAttributeSelfPowered  = 0b01000000
 	usbConfigAttributeRemoteWakeup = 0b00100000
 
+	// bConfigurationValue of our only configuration; 0 means unconfigured
+	usbConfigurationValue = 1
+
 	usbInterfaceClassHID = 3
 
 	usbLangIDEngUSA = 0x0409
 )
 
+type usbFeatureSelector uint16
+
+const (
+	usbFeatureEndpointHalt       usbFeatureSelector = 0
+	usbFeatureDeviceRemoteWakeup usbFeatureSelector = 1
+	usbFeatureTestMode           usbFeatureSelector = 2
+)
+
+// Bits of the first byte of a GET_STATUS reply
+const (
+	usbStatusSelfPowered  = 0b01
+	usbStatusRemoteWakeup = 0b10
+	usbStatusEndpointHalt = 0b01
+)
+
 type usbSetupPacket struct {
 	BmRequestType uint8
 	BRequest      usbRequestType
@@ -209,6 +236,26 @@ const (
 	usbEndpointInput   usbEndpoint = 2
 )
 
+// USBSpeed uses the Linux usb_device_speed values that USB/IP reports to the host
+type USBSpeed uint32
+
+const (
+	USBSpeedFull USBSpeed = 2
+	USBSpeedHigh USBSpeed = 3
+)
+
+type usbDeviceQualifierDescriptor struct {
+	BLength            uint8
+	BDescriptorType    usbDescriptorType
+	BcdUSB             uint16
+	BDeviceClass       uint8
+	BDeviceSubclass    uint8
+	BDeviceProtocol    uint8
+	BMaxPacketSize0    uint8
+	BNumConfigurations uint8
+	BReserved          uint8
+}
+
 type usbDeviceDescriptor struct {
 	BLength            uint8
 	BDescriptorType    usbDescriptorType
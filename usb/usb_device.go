@@ -3,194 +3,572 @@ package usb
 import (
 	"bytes"
 	"fmt"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/bulwarkid/virtual-fido/usbip"
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
-var usbLogger = util.NewLogger("[USB] ", util.LogLevelTrace)
+var usbLogger = util.NewLogger("[USB] ", util.LogSubsystemUSB, util.LogLevelTrace)
 
 type USBDeviceDelegate interface {
+	// Called on the USB/IP connection's goroutine, so it should queue long-running work
 	HandleMessage(transferBuffer []byte)
 	SetResponseHandler(handler func(response []byte))
 }
 
+// TracedUSBDeviceDelegate is implemented by delegates that follow each message's trace, and
+// return it with the responses to the message
+type TracedUSBDeviceDelegate interface {
+	HandleTracedMessage(trace util.TraceID, transferBuffer []byte)
+	SetTracedResponseHandler(handler func(trace util.TraceID, response []byte))
+}
+
+type descriptorKey struct {
+	descriptorType usbDescriptorType
+	index          uint8
+}
+
+// Descriptors served from the cache, built when the device is created. Interface names and
+// HID reports are added for each interface.
+var cachedDescriptors = []descriptorKey{
+	{usbDescriptorDevice, 0},
+	{usbDescriptorConfiguration, 0},
+	{usbDescriptorString, 0},
+	{usbDescriptorString, 1},
+	{usbDescriptorString, 2},
+	{usbDescriptorString, 3},
+	{usbDescriptorString, 4},
+}
+
+// Interface names follow the fixed strings
+const usbInterfaceStringIndex = 5
+
+// Device qualifiers only exist for high speed devices
+var highSpeedDescriptors = []descriptorKey{
+	{usbDescriptorDeviceQualifier, 0},
+}
+
 type USBDevice struct {
-	delegate        USBDeviceDelegate
-	requestBuffer *util.RequestBuffer
+	// Interfaces in the order they were added, and the endpoints they own by number
+	interfaces      []usbInterface
+	endpoints       map[usbEndpoint]*usbEndpointRoute
+	descriptorsLock sync.Mutex
+	descriptors     map[descriptorKey][]byte
+	speed           USBSpeed
+	// Packet size and polling interval of the interrupt endpoints
+	maxPacketSize uint16
+	interval      uint8
+	// Report ID prefixed to every FIDO HID report, or 0 for reports without an ID
+	reportID uint8
+	polling  InterruptPolling
+	// Lets the host recognize the device when it's attached again
+	serialNumber string
+	// Tells devices on the same USB/IP server apart
+	deviceNumber uint32
+	// State changed by standard requests
+	stateLock       sync.Mutex
+	configuration   uint8
+	remoteWakeup    bool
+	haltedEndpoints map[usbEndpoint]bool
 }
 
 func NewUSBDevice(delegate USBDeviceDelegate) *USBDevice {
 	device := &USBDevice{
-		delegate:        delegate,
-		requestBuffer:   util.MakeRequestBuffer(),
+		endpoints:       make(map[usbEndpoint]*usbEndpointRoute),
+		speed:           USBSpeedFull,
+		maxPacketSize:   64,
+		interval:        255,
+		polling:         DefaultInterruptPolling(),
+		serialNumber:    "No Serial Number",
+		deviceNumber:    2,
+		haltedEndpoints: make(map[usbEndpoint]bool),
 	}
-	delegate.SetResponseHandler(func(response []byte) {
-		device.handleResponse(response)
-	})
+	device.addInterface(&hidInterface{device: device, delegate: delegate})
 	return device
 }
 
+// addInterface makes the device composite. Interfaces must be added before the device is
+// attached, since the host only reads the configuration once.
+func (device *USBDevice) addInterface(iface usbInterface) {
+	number := uint8(len(device.interfaces))
+	device.interfaces = append(device.interfaces, iface)
+	routes := make([]*usbEndpointRoute, 0)
+	for index, endpoint := range iface.endpoints() {
+		route := &usbEndpointRoute{iface: iface, interfaceNumber: number, index: index}
+		if endpoint.BEndpointAddress&0x80 != 0 {
+			route.requests = util.MakeRequestBuffer()
+		}
+		device.endpoints[usbEndpoint(len(device.endpoints)+1)] = route
+		routes = append(routes, route)
+	}
+	iface.start(func(trace util.TraceID, index int, data []byte) {
+		device.simulateNAKs()
+		routes[index].requests.RespondTraced(data, trace)
+	})
+	device.cacheDescriptors()
+}
+
+// SetSpeed changes the speed reported to the host and the packet size and polling interval
+// of the interrupt endpoints. At high speed the interval is an exponent, polling every
+// 2^(interval-1) microframes, instead of milliseconds. The HID layer must use the same
+// packet size, since it is also the HID report size.
+func (device *USBDevice) SetSpeed(speed USBSpeed, maxPacketSize uint16, interval uint8) error {
+	switch speed {
+	case USBSpeedFull:
+		if maxPacketSize != 64 {
+			return fmt.Errorf("Full speed HID devices use 64 byte packets, not %d", maxPacketSize)
+		}
+		if interval == 0 {
+			return fmt.Errorf("Full speed interval must be between 1 and 255 ms")
+		}
+	case USBSpeedHigh:
+		if maxPacketSize < 64 || maxPacketSize > 1024 {
+			return fmt.Errorf("High speed packet size must be between 64 and 1024 bytes, not %d", maxPacketSize)
+		}
+		if interval < 1 || interval > 16 {
+			return fmt.Errorf("High speed interval must be between 1 and 16, not %d", interval)
+		}
+	default:
+		return fmt.Errorf("Unsupported USB speed: %d", speed)
+	}
+	device.speed = speed
+	device.maxPacketSize = maxPacketSize
+	device.interval = interval
+	device.cacheDescriptors()
+	return nil
+}
+
+// SetReportID makes the FIDO HID interface declare a report ID, which prefixes every report
+// sent or received, for host HID stacks that expect one. 0 turns report IDs off again.
+func (device *USBDevice) SetReportID(reportID uint8) {
+	device.reportID = reportID
+	device.cacheDescriptors()
+}
+
+// SetSerialNumber changes the serial number in the device descriptor, which hosts use to
+// tell devices apart
+func (device *USBDevice) SetSerialNumber(serialNumber string) {
+	device.serialNumber = serialNumber
+	device.cacheDescriptors()
+}
+
+// SetDeviceNumber changes the device's number on the USB/IP bus, and so its bus ID, so several
+// devices can be served together. Numbers start at 2, the default.
+func (device *USBDevice) SetDeviceNumber(number uint32) {
+	device.deviceNumber = number
+}
+
+// cacheDescriptors serializes every descriptor up front so enumeration doesn't rebuild them
+func (device *USBDevice) cacheDescriptors() {
+	descriptors := make(map[descriptorKey][]byte)
+	keys := cachedDescriptors
+	if device.speed == USBSpeedHigh {
+		keys = append(keys[:len(keys):len(keys)], highSpeedDescriptors...)
+	}
+	for number, iface := range device.interfaces {
+		keys = append(keys[:len(keys):len(keys)], descriptorKey{usbDescriptorString, usbInterfaceStringIndex + uint8(number)})
+		if _, ok := iface.(usbHIDReporter); ok {
+			keys = append(keys, descriptorKey{usbDescriptorHIDReport, uint8(number)})
+		}
+	}
+	for _, key := range keys {
+		var descriptor []byte
+		var err error
+		if key.descriptorType == usbDescriptorHIDReport {
+			descriptor = device.interfaces[key.index].(usbHIDReporter).hidReport()
+		} else {
+			descriptor, err = device.buildDescriptor(key.descriptorType, key.index)
+		}
+		util.CheckErr(err, "Could not build USB descriptor")
+		descriptors[key] = descriptor
+	}
+	device.descriptorsLock.Lock()
+	defer device.descriptorsLock.Unlock()
+	device.descriptors = descriptors
+}
+
+func (device *USBDevice) cachedDescriptor(descriptorType usbDescriptorType, index uint8) ([]byte, bool) {
+	device.descriptorsLock.Lock()
+	defer device.descriptorsLock.Unlock()
+	descriptor, ok := device.descriptors[descriptorKey{descriptorType, index}]
+	return descriptor, ok
+}
+
 func (device *USBDevice) BusID() string {
-	return "2-2"
+	return fmt.Sprintf("2-%d", device.deviceNumber)
 }
 
 func (device *USBDevice) DeviceSummary() usbip.USBIPDeviceSummary {
 	summary := usbip.USBIPDeviceSummary{
 		Header: usbip.USBIPDeviceSummaryHeader{
 			Busnum:              2,
-			Devnum:              2,
-			Speed:               2,
+			Devnum:              device.deviceNumber,
+			Speed:               uint32(device.speed),
 			IdVendor:            0,
 			IdProduct:           0,
 			BcdDevice:           0,
 			BDeviceClass:        0,
 			BDeviceSubclass:     0,
 			BDeviceProtocol:     0,
-			BConfigurationValue: 0,
+			BConfigurationValue: device.currentConfiguration(),
 			BNumConfigurations:  1,
-			BNumInterfaces:      1,
-		},
-		DeviceInterface: usbip.USBIPDeviceInterface{
-			BInterfaceClass:    3,
-			BInterfaceSubclass: 0,
-			Padding:            0,
+			BNumInterfaces:      uint8(len(device.interfaces)),
 		},
 	}
-	copy(summary.Header.Path[:], []byte("/device/0"))
-	copy(summary.Header.BusID[:], []byte("2-2"))
+	for _, iface := range device.interfaces {
+		class, subclass, protocol := iface.interfaceClass()
+		summary.DeviceInterfaces = append(summary.DeviceInterfaces, usbip.USBIPDeviceInterface{
+			BInterfaceClass:    class,
+			BInterfaceSubclass: subclass,
+			BInterfaceProtocol: protocol,
+		})
+	}
+	copy(summary.Header.Path[:], []byte(fmt.Sprintf("/device/%d", device.deviceNumber-2)))
+	copy(summary.Header.BusID[:], []byte(device.BusID()))
 	return summary
 }
 
 func (device *USBDevice) RemoveWaitingRequest(id uint32) bool {
-	return device.requestBuffer.CancelRequest(id)
+	for _, route := range device.endpoints {
+		if route.requests != nil && route.requests.CancelRequest(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Detach is called when the host detaches the device. Requests the host left waiting and
+// responses it didn't read are dropped, and the device is unconfigured as if it had been
+// unplugged. The authenticator behind it keeps its state.
+func (device *USBDevice) Detach() {
+	device.stateLock.Lock()
+	device.configuration = 0
+	device.remoteWakeup = false
+	device.stateLock.Unlock()
+	device.resetEndpoints(func(route *usbEndpointRoute) bool { return true })
+	for _, route := range device.endpoints {
+		if route.requests != nil {
+			route.requests.Reset()
+		}
+	}
+}
+
+func (device *USBDevice) HandleMessage(id uint32, onFinish func(response []byte, status int32), endpoint uint32, setupBytes []byte, data []byte) {
+	device.HandleTracedMessage(util.NewTraceID(), id, onFinish, endpoint, setupBytes, data)
 }
 
-func (device *USBDevice) HandleMessage(id uint32, onFinish func(response []byte), endpoint uint32, setupBytes []byte, data []byte) {
+func (device *USBDevice) HandleTracedMessage(trace util.TraceID, id uint32, onFinish func(response []byte, status int32), endpoint uint32, setupBytes []byte, data []byte) {
+	logger := usbLogger.WithTrace(trace)
+	if len(setupBytes) < int(util.SizeOf[usbSetupPacket]()) {
+		logger.Printf("ERROR: Setup packet too short: %#v\n\n", setupBytes)
+		onFinish(nil, usbip.USBIPStatusStall)
+		return
+	}
 	setup := util.ReadLE[usbSetupPacket](bytes.NewBuffer(setupBytes))
-	usbLogger.Printf("USB MESSAGE - ENDPOINT %d SETUP: %s\n\n", endpoint, setup)
-	switch usbEndpoint(endpoint) {
-	case usbEndpointControl:
-		reply := device.handleControlMessage(setup)
-		onFinish(reply)
-	case usbEndpointOutput:
-		device.requestBuffer.Request(id, onFinish)
-		util.SetTimeout(1000, func() {
-			// If the request hasn't finished yet, cancel it and return nil
-			if device.requestBuffer.CancelRequest(id) {
-				onFinish(nil)
+	logger.Printf("USB MESSAGE - ENDPOINT %d SETUP: %s\n\n", endpoint, setup)
+	if device.isHalted(usbEndpoint(endpoint)) {
+		logger.Printf("STALL: Endpoint %d is halted\n\n", endpoint)
+		onFinish(nil, usbip.USBIPStatusStall)
+		return
+	}
+	if usbEndpoint(endpoint) == usbEndpointControl {
+		reply, err := device.handleControlTransfer(setup, data)
+		if err != nil {
+			logger.Printf("STALL: %s\n\n", err)
+			onFinish(nil, usbip.USBIPStatusStall)
+			return
+		}
+		onFinish(reply, usbip.USBIPStatusSuccess)
+		return
+	}
+	route, ok := device.endpoints[usbEndpoint(endpoint)]
+	if !ok {
+		logger.Printf("STALL: Invalid USB endpoint: %d\n\n", endpoint)
+		onFinish(nil, usbip.USBIPStatusStall)
+		return
+	}
+	if route.requests != nil {
+		onResponse := func(response []byte, responseTrace util.TraceID) {
+			if responseTrace != 0 {
+				logger.Printf("IN DATA for trace %s\n\n", responseTrace)
 			}
-		})
+			onFinish(response, usbip.USBIPStatusSuccess)
+		}
+		if !route.requests.RequestTraced(id, onResponse) && device.polling.EmptyPollTimeout > 0 {
+			time.AfterFunc(device.polling.EmptyPollTimeout, func() {
+				// If the request hasn't finished yet, cancel it and return nil
+				if route.requests.CancelRequest(id) {
+					onFinish(nil, usbip.USBIPStatusSuccess)
+				}
+			})
+		}
 		// onFinish will be called when a response is returned
-	case usbEndpointInput:
-		usbLogger.Printf("INPUT DATA: %#v\n\n", data)
-		go device.delegate.HandleMessage(data)
-		onFinish(nil)
-	default:
-		util.Panic(fmt.Sprintf("Invalid USB endpoint: %d", endpoint))
+	} else {
+		logger.Printf("INPUT DATA: %#v\n\n", data)
+		route.iface.handleOutput(trace, route.index, data)
+		onFinish(nil, usbip.USBIPStatusSuccess)
 	}
 }
 
-func (device *USBDevice) handleResponse(response []byte) {
-	device.requestBuffer.Respond(response)
+// handleControlTransfer limits both data stages to wLength. Replies longer than wLength are
+// cut, and shorter ones end the transfer early with a short packet.
+func (device *USBDevice) handleControlTransfer(setup usbSetupPacket, data []byte) ([]byte, error) {
+	if len(data) > int(setup.WLength) {
+		data = data[:setup.WLength]
+	}
+	reply, err := device.handleControlMessage(setup, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) > int(setup.WLength) {
+		reply = reply[:setup.WLength]
+	}
+	return reply, nil
 }
 
-func (device *USBDevice) handleControlMessage(setup usbSetupPacket) []byte {
+func (device *USBDevice) handleControlMessage(setup usbSetupPacket, data []byte) ([]byte, error) {
 	switch setup.recipient() {
 	case usbRequestRecipientDevice:
 		return device.handleDeviceRequest(setup)
 	case usbRequestRecipientInterface:
-		return device.handleInterfaceRequest(setup)
+		return device.handleInterfaceRequest(setup, data)
+	case usbRequestRecipientEndpoint:
+		return device.handleEndpointRequest(setup)
 	default:
-		util.Panic(fmt.Sprintf("Invalid CMD_SUBMIT recipient: %d", setup.recipient()))
+		return nil, fmt.Errorf("Invalid CMD_SUBMIT recipient: %d", setup.recipient())
 	}
-	return nil
 }
 
-func (device *USBDevice) handleDeviceRequest(setup usbSetupPacket) []byte {
+func (device *USBDevice) handleDeviceRequest(setup usbSetupPacket) ([]byte, error) {
 	switch setup.BRequest {
 	case usbRequestGetDescriptor:
 		descriptorType, descriptorIndex := getDescriptorTypeAndIndex(setup.WValue)
 		return device.getDescriptor(descriptorType, descriptorIndex)
+	case usbRequestGetConfiguration:
+		return []byte{device.currentConfiguration()}, nil
 	case usbRequestSetConfiguration:
-		usbLogger.Printf("SET_CONFIGURATION: No-op\n\n")
-		// TODO: Handle configuration changes
-		// No-op since we can't change configuration
-		return nil
+		configuration := uint8(setup.WValue)
+		if configuration != 0 && configuration != usbConfigurationValue {
+			return nil, fmt.Errorf("Invalid USB configuration: %d", configuration)
+		}
+		usbLogger.Printf("SET_CONFIGURATION: %d\n\n", configuration)
+		device.stateLock.Lock()
+		device.configuration = configuration
+		device.stateLock.Unlock()
+		// Configuring the device resets the endpoints
+		device.resetEndpoints(func(route *usbEndpointRoute) bool { return true })
+		// Rebuild the descriptors in case they depend on the configuration
+		device.cacheDescriptors()
+		return nil, nil
+	case usbRequestSetAddress:
+		// The USB/IP host assigns the address itself
+		usbLogger.Printf("SET_ADDRESS: No-op\n\n")
+		return nil, nil
 	case usbRequestGetStatus:
-		return []byte{1}
+		status := uint8(usbStatusSelfPowered)
+		device.stateLock.Lock()
+		if device.remoteWakeup {
+			status |= usbStatusRemoteWakeup
+		}
+		device.stateLock.Unlock()
+		return []byte{status, 0}, nil
+	case usbRequestSetFeature, usbRequestClearFeature:
+		if usbFeatureSelector(setup.WValue) != usbFeatureDeviceRemoteWakeup {
+			return nil, fmt.Errorf("Unsupported USB device feature: %d", setup.WValue)
+		}
+		device.stateLock.Lock()
+		device.remoteWakeup = setup.BRequest == usbRequestSetFeature
+		device.stateLock.Unlock()
+		return nil, nil
 	default:
-		util.Panic(fmt.Sprintf("Invalid CMD_SUBMIT bRequest: %d", setup.BRequest))
+		return nil, fmt.Errorf("Invalid CMD_SUBMIT bRequest: %d", setup.BRequest)
 	}
-	return nil
 }
 
-func (device *USBDevice) handleInterfaceRequest(setup usbSetupPacket) []byte {
-	switch usbHIDRequestType(setup.BRequest) {
-	case usbHIDRequestSetIdle:
-		// No-op since we are made in software
-		usbLogger.Printf("SET IDLE: No-op\n\n")
-	case usbHIDRequestSetProtocol:
-		// No-op since we are always in report protocol, no boot protocol
-	case usbHIDRequestGetDescriptor:
-		descriptorType, descriptorIndex := getDescriptorTypeAndIndex(setup.WValue)
-		usbLogger.Printf("GET INTERFACE DESCRIPTOR - Type: %s Index: %d\n\n", descriptorType, descriptorIndex)
-		switch descriptorType {
-		case usbDescriptorHIDReport:
-			usbLogger.Printf("HID REPORT: %v\n\n", device.getHIDReport())
-			return device.getHIDReport()
-		default:
-			util.Panic(fmt.Sprintf("Invalid USB Interface descriptor: %d - %d", descriptorType, descriptorIndex))
+func (device *USBDevice) handleInterfaceRequest(setup usbSetupPacket, data []byte) ([]byte, error) {
+	number := uint8(setup.WIndex)
+	if int(number) >= len(device.interfaces) {
+		return nil, fmt.Errorf("Invalid USB interface: %d", setup.WIndex)
+	}
+	if setup.requestClass() == usbRequestClassStandard {
+		switch setup.BRequest {
+		case usbRequestGetStatus:
+			// Interfaces have no status bits
+			return []byte{0, 0}, nil
+		case usbRequestGetInterface:
+			return []byte{0}, nil
+		case usbRequestSetInterface:
+			// None of our interfaces have alternate settings
+			if setup.WValue != 0 {
+				return nil, fmt.Errorf("Invalid USB alternate setting: %d", setup.WValue)
+			}
+			device.resetEndpoints(func(route *usbEndpointRoute) bool {
+				return route.interfaceNumber == number
+			})
+			return nil, nil
+		case usbRequestSetFeature, usbRequestClearFeature:
+			return nil, fmt.Errorf("Unsupported USB interface feature: %d", setup.WValue)
+		}
+	}
+	return device.interfaces[number].handleRequest(setup, data)
+}
+
+func (device *USBDevice) handleEndpointRequest(setup usbSetupPacket) ([]byte, error) {
+	endpoint, ok := device.endpointForAddress(uint8(setup.WIndex))
+	if !ok {
+		return nil, fmt.Errorf("Invalid USB endpoint address: 0x%x", setup.WIndex)
+	}
+	switch setup.BRequest {
+	case usbRequestGetStatus:
+		if device.isHalted(endpoint) {
+			return []byte{usbStatusEndpointHalt, 0}, nil
+		}
+		return []byte{0, 0}, nil
+	case usbRequestSetFeature, usbRequestClearFeature:
+		if usbFeatureSelector(setup.WValue) != usbFeatureEndpointHalt {
+			return nil, fmt.Errorf("Unsupported USB endpoint feature: %d", setup.WValue)
+		}
+		if endpoint == usbEndpointControl {
+			return nil, fmt.Errorf("Control endpoint can't be halted")
 		}
+		halted := setup.BRequest == usbRequestSetFeature
+		usbLogger.Printf("ENDPOINT %d HALTED: %t\n\n", endpoint, halted)
+		device.stateLock.Lock()
+		defer device.stateLock.Unlock()
+		if halted {
+			device.haltedEndpoints[endpoint] = true
+		} else {
+			delete(device.haltedEndpoints, endpoint)
+		}
+		return nil, nil
 	default:
-		util.Panic(fmt.Sprintf("Invalid USB Interface bRequest: %d", setup.BRequest))
+		return nil, fmt.Errorf("Invalid USB endpoint bRequest: %d", setup.BRequest)
 	}
-	return nil
 }
 
-func (device *USBDevice) getDescriptor(descriptorType usbDescriptorType, index uint8) []byte {
+// endpointForAddress maps an endpoint address, which includes the direction bit, to the
+// endpoint number USB/IP uses
+func (device *USBDevice) endpointForAddress(address uint8) (usbEndpoint, bool) {
+	if address&0x7F == 0 {
+		return usbEndpointControl, true
+	}
+	for _, descriptor := range device.getEndpointDescriptors() {
+		if descriptor.BEndpointAddress == address {
+			return usbEndpoint(address & 0x0F), true
+		}
+	}
+	return 0, false
+}
+
+// pollInput takes the oldest data queued on an IN endpoint of iface, if the host hasn't read it
+func (device *USBDevice) pollInput(iface usbInterface, index int) ([]byte, bool) {
+	for _, route := range device.endpoints {
+		if route.iface == iface && route.index == index && route.requests != nil {
+			return route.requests.Poll()
+		}
+	}
+	return nil, false
+}
+
+func (device *USBDevice) isHalted(endpoint usbEndpoint) bool {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	return device.haltedEndpoints[endpoint]
+}
+
+// resetEndpoints clears the halt on the endpoints matching filter
+func (device *USBDevice) resetEndpoints(filter func(route *usbEndpointRoute) bool) {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	for endpoint := range device.haltedEndpoints {
+		if filter(device.endpoints[endpoint]) {
+			delete(device.haltedEndpoints, endpoint)
+		}
+	}
+}
+
+func (device *USBDevice) currentConfiguration() uint8 {
+	device.stateLock.Lock()
+	defer device.stateLock.Unlock()
+	return device.configuration
+}
+
+func (device *USBDevice) getDescriptor(descriptorType usbDescriptorType, index uint8) ([]byte, error) {
 	usbLogger.Printf("GET DESCRIPTOR: Type: %s Index: %d\n\n", descriptorTypeDescriptions[descriptorType], index)
+	if descriptor, ok := device.cachedDescriptor(descriptorType, index); ok {
+		return descriptor, nil
+	}
+	return device.buildDescriptor(descriptorType, index)
+}
+
+func (device *USBDevice) buildDescriptor(descriptorType usbDescriptorType, index uint8) ([]byte, error) {
 	switch descriptorType {
 	case usbDescriptorDevice:
 		descriptor := device.getDeviceDescriptor()
 		usbLogger.Printf("DEVICE DESCRIPTOR: %#v\n\n", descriptor)
-		return util.ToLE(descriptor)
+		return util.ToLE(descriptor), nil
 	case usbDescriptorConfiguration:
-		buffer := new(bytes.Buffer)
-		interfaceDescriptor := device.getInterfaceDescriptor()
-		buffer.Write(util.ToLE(interfaceDescriptor))
-		hid := device.getHIDDescriptor(device.getHIDReport())
-		buffer.Write(util.ToLE(hid))
-		endpoints := device.getEndpointDescriptors()
-		for _, endpoint := range endpoints {
-			usbLogger.Printf("ENDPOINT: %#v\n\n", endpoint)
-			buffer.Write(util.ToLE(endpoint))
+		buffer := util.GetBuffer()
+		defer util.PutBuffer(buffer)
+		for number, iface := range device.interfaces {
+			interfaceDescriptor := device.getInterfaceDescriptor(uint8(number))
+			usbLogger.Printf("INTERFACE: %#v\n\n", interfaceDescriptor)
+			buffer.Write(util.ToLE(interfaceDescriptor))
+			buffer.Write(iface.classDescriptors())
+			for _, endpoint := range device.getInterfaceEndpoints(uint8(number)) {
+				usbLogger.Printf("ENDPOINT: %#v\n\n", endpoint)
+				buffer.Write(util.ToLE(endpoint))
+			}
 		}
 		configBytes := buffer.Bytes()
 		config := device.getConfigurationDescriptor(uint16(len(configBytes)))
-		usbLogger.Printf("CONFIGURATION: %#v\n\nINTERFACE: %#v\n\nHID: %#v\n\n", config, interfaceDescriptor, hid)
-		return util.Concat(util.ToLE(config), configBytes)
+		usbLogger.Printf("CONFIGURATION: %#v\n\n", config)
+		return util.Concat(util.ToLE(config), configBytes), nil
+	case usbDescriptorDeviceQualifier:
+		if device.speed != USBSpeedHigh {
+			return nil, fmt.Errorf("No device qualifier below high speed")
+		}
+		deviceDescriptor := device.getDeviceDescriptor()
+		qualifier := usbDeviceQualifierDescriptor{
+			BLength:            util.SizeOf[usbDeviceQualifierDescriptor](),
+			BDescriptorType:    usbDescriptorDeviceQualifier,
+			BcdUSB:             deviceDescriptor.BcdUSB,
+			BDeviceClass:       deviceDescriptor.BDeviceClass,
+			BDeviceSubclass:    deviceDescriptor.BDeviceSubclass,
+			BDeviceProtocol:    deviceDescriptor.BDeviceProtocol,
+			BMaxPacketSize0:    deviceDescriptor.BMaxPacketSize,
+			BNumConfigurations: deviceDescriptor.BNumConfigurations,
+		}
+		return util.ToLE(qualifier), nil
 	case usbDescriptorString:
-		message := device.getStringDescriptor(index)
+		message, err := device.getStringDescriptor(index)
+		if err != nil {
+			return nil, err
+		}
 		header := usbStringDescriptorHeader{
 			BLength:         0,
 			BDescriptorType: usbDescriptorString,
 		}
 		header.BLength = uint8(unsafe.Sizeof(header)) + uint8(len(message))
 		usbLogger.Printf("STRING: Length: %d Message: \"%s\" Bytes: %v\n\n", header.BLength, message, message)
-		return util.Concat(util.ToLE(header), message)
+		return util.Concat(util.ToLE(header), message), nil
 	default:
-		util.Panic(fmt.Sprintf("Invalid Descriptor type: %d", descriptorType))
+		return nil, fmt.Errorf("Invalid Descriptor type: %d", descriptorType)
 	}
-	return nil
 }
 
 func (device *USBDevice) getDeviceDescriptor() usbDeviceDescriptor {
+	bcdUSB := uint16(0x0110)
+	if device.speed == USBSpeedHigh {
+		bcdUSB = 0x0200
+	}
 	return usbDeviceDescriptor{
 		BLength:            util.SizeOf[usbDeviceDescriptor](),
 		BDescriptorType:    usbDescriptorDevice,
-		BcdUSB:             0x0110,
+		BcdUSB:             bcdUSB,
 		BDeviceClass:       0,
 		BDeviceSubclass:    0,
 		BDeviceProtocol:    0,
@@ -211,25 +589,27 @@ func (device *USBDevice) getConfigurationDescriptor(configLength uint16) usbConf
 		BLength:             util.SizeOf[usbConfigurationDescriptor](),
 		BDescriptorType:     usbDescriptorConfiguration,
 		WTotalLength:        totalLength,
-		BNumInterfaces:      1,
-		BConfigurationValue: 0,
+		BNumInterfaces:      uint8(len(device.interfaces)),
+		BConfigurationValue: usbConfigurationValue,
 		IConfiguration:      4,
-		BmAttributes:        usbConfigAttributeBase | usbConfigAttributeSelfPowered,
+		BmAttributes:        usbConfigAttributeBase | usbConfigAttributeSelfPowered | usbConfigAttributeRemoteWakeup,
 		BMaxPower:           0,
 	}
 }
 
-func (device *USBDevice) getInterfaceDescriptor() usbInterfaceDescriptor {
+func (device *USBDevice) getInterfaceDescriptor(number uint8) usbInterfaceDescriptor {
+	iface := device.interfaces[number]
+	class, subclass, protocol := iface.interfaceClass()
 	return usbInterfaceDescriptor{
 		BLength:            util.SizeOf[usbInterfaceDescriptor](),
 		BDescriptorType:    usbDescriptorInterface,
-		BInterfaceNumber:   0,
+		BInterfaceNumber:   number,
 		BAlternateSetting:  0,
-		BNumEndpoints:      2,
-		BInterfaceClass:    usbInterfaceClassHID,
-		BInterfaceSubclass: 0,
-		BInterfaceProtocol: 0,
-		IInterface:         5,
+		BNumEndpoints:      uint8(len(iface.endpoints())),
+		BInterfaceClass:    class,
+		BInterfaceSubclass: subclass,
+		BInterfaceProtocol: protocol,
+		IInterface:         usbInterfaceStringIndex + number,
 	}
 }
 
@@ -245,49 +625,66 @@ func (device *USBDevice) getHIDDescriptor(hidReportDescriptor []byte) usbHIDDesc
 	}
 }
 
+// hidReportCount encodes a Report Count item, which needs two bytes past 255
+func hidReportCount(count uint16) []byte {
+	if count <= 0xFF {
+		return []byte{0x95, uint8(count)}
+	}
+	return []byte{0x96, uint8(count), uint8(count >> 8)}
+}
+
 func (device *USBDevice) getHIDReport() []byte {
-	// Manually calculated using the HID Report calculator for a FIDO device
-	return []byte{6, 208, 241, 9, 1, 161, 1, 9, 32, 20, 37, 255, 117, 8, 149, 64, 129, 2, 9, 33, 20, 37, 255, 117, 8, 149, 64, 145, 2, 192}
+	var reportID []byte
+	if device.reportID != 0 {
+		reportID = []byte{0x85, device.reportID}
+	}
+	// Manually calculated using the HID Report calculator for a FIDO device, with
+	// input and output reports the size of a packet
+	return util.Concat(
+		[]byte{6, 208, 241, 9, 1, 161, 1},
+		reportID,
+		[]byte{9, 32, 20, 37, 255, 117, 8},
+		hidReportCount(device.maxPacketSize),
+		[]byte{129, 2, 9, 33, 20, 37, 255, 117, 8},
+		hidReportCount(device.maxPacketSize),
+		[]byte{145, 2, 192},
+	)
+}
+
+// getInterfaceEndpoints returns the endpoints of an interface with their numbers filled in
+func (device *USBDevice) getInterfaceEndpoints(number uint8) []usbEndpointDescriptor {
+	descriptors := device.interfaces[number].endpoints()
+	for endpoint, route := range device.endpoints {
+		if route.interfaceNumber == number {
+			descriptors[route.index].BEndpointAddress |= uint8(endpoint)
+		}
+	}
+	return descriptors
 }
 
 func (device *USBDevice) getEndpointDescriptors() []usbEndpointDescriptor {
-	length := util.SizeOf[usbEndpointDescriptor]()
-	return []usbEndpointDescriptor{
-		{
-			BLength:          length,
-			BDescriptorType:  usbDescriptorEndpoint,
-			BEndpointAddress: 0b10000001,
-			BmAttributes:     0b00000011,
-			WMaxPacketSize:   64,
-			BInterval:        255,
-		},
-		{
-			BLength:          length,
-			BDescriptorType:  usbDescriptorEndpoint,
-			BEndpointAddress: 0b00000010,
-			BmAttributes:     0b00000011,
-			WMaxPacketSize:   64,
-			BInterval:        255,
-		},
+	descriptors := make([]usbEndpointDescriptor, 0)
+	for number := range device.interfaces {
+		descriptors = append(descriptors, device.getInterfaceEndpoints(uint8(number))...)
 	}
+	return descriptors
 }
 
-func (device *USBDevice) getStringDescriptor(index uint8) []byte {
+func (device *USBDevice) getStringDescriptor(index uint8) ([]byte, error) {
 	switch index {
 	case 0:
-		return util.ToLE[uint16](usbLangIDEngUSA)
+		return util.ToLE[uint16](usbLangIDEngUSA), nil
 	case 1:
-		return util.Utf16encode("No Company")
+		return util.Utf16encode("No Company"), nil
 	case 2:
-		return util.Utf16encode("Virtual FIDO")
+		return util.Utf16encode("Virtual FIDO"), nil
 	case 3:
-		return util.Utf16encode("No Serial Number")
+		return util.Utf16encode(device.serialNumber), nil
 	case 4:
-		return util.Utf16encode("String 4")
-	case 5:
-		return util.Utf16encode("Default Interface")
-	default:
-		util.Panic(fmt.Sprintf("Invalid string descriptor index: %d", index))
+		return util.Utf16encode("String 4"), nil
 	}
-	return nil
+	if number := int(index) - usbInterfaceStringIndex; number >= 0 && number < len(device.interfaces) {
+		return util.Utf16encode(device.interfaces[number].name()), nil
+	}
+	return nil, fmt.Errorf("Invalid string descriptor index: %d", index)
 }
@@ -4,7 +4,8 @@ import (
 	"bytes"
 	"testing"
 
-	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/usbip"
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
@@ -21,7 +22,7 @@ func TestGetDescriptor(t *testing.T) {
 	delegate := dummyUSBDeviceDelegate{}
 	device := NewUSBDevice(&delegate)
 	var response []byte = nil
-	setResponse := func(other []byte) {
+	setResponse := func(other []byte, status int32) {
 		response = other
 	}
 	var setup usbSetupPacket
@@ -45,7 +46,7 @@ func TestGetConfiguration(t *testing.T) {
 	delegate := dummyUSBDeviceDelegate{}
 	device := NewUSBDevice(&delegate)
 	var response []byte = nil
-	setResponse := func(other []byte) {
+	setResponse := func(other []byte, status int32) {
 		response = other
 	}
 	var setup usbSetupPacket
@@ -81,7 +82,7 @@ func TestGetStringDescriptor(t *testing.T) {
 	delegate := dummyUSBDeviceDelegate{}
 	device := NewUSBDevice(&delegate)
 	var response []byte = nil
-	setResponse := func(other []byte) {
+	setResponse := func(other []byte, status int32) {
 		response = other
 	}
 	// Right now there are 5 string descriptors; we just need to check if we can generally access them
@@ -104,7 +105,7 @@ func TestGetHIDReport(t *testing.T) {
 	delegate := dummyUSBDeviceDelegate{}
 	device := NewUSBDevice(&delegate)
 	var response []byte = nil
-	setResponse := func(other []byte) {
+	setResponse := func(other []byte, status int32) {
 		response = other
 	}
 	var setup usbSetupPacket
@@ -139,4 +140,339 @@ func TestDeviceSummary(t *testing.T) {
 		util.CStringToString(summary.Header.Path[:]) != "/device/0" {
 		t.Fatalf("Device summary incorrect")
 	}
-}
\ No newline at end of file
+}
+func sendControlMessage(device *USBDevice, setup usbSetupPacket) ([]byte, int32) {
+	var response []byte = nil
+	var status int32 = usbip.USBIPStatusSuccess
+	device.HandleMessage(0, func(other []byte, otherStatus int32) {
+		response = other
+		status = otherStatus
+	}, 0, util.ToLE(setup), []byte{})
+	return response, status
+}
+
+func TestMalformedControlMessages(t *testing.T) {
+	delegate := dummyUSBDeviceDelegate{}
+	device := NewUSBDevice(&delegate)
+
+	var invalidDescriptor usbSetupPacket
+	invalidDescriptor.setRecipient(usbRequestRecipientDevice)
+	invalidDescriptor.BRequest = usbRequestGetDescriptor
+	invalidDescriptor.WValue = (uint16(0x7F) << 8)
+	_, status := sendControlMessage(device, invalidDescriptor)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Invalid descriptor type did not stall")
+
+	var invalidString usbSetupPacket
+	invalidString.setRecipient(usbRequestRecipientDevice)
+	invalidString.BRequest = usbRequestGetDescriptor
+	invalidString.WValue = (uint16(usbDescriptorString) << 8) | 200
+	_, status = sendControlMessage(device, invalidString)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Invalid string index did not stall")
+
+	var invalidRequest usbSetupPacket
+	invalidRequest.setRecipient(usbRequestRecipientDevice)
+	invalidRequest.BRequest = usbRequestSynchFrame
+	_, status = sendControlMessage(device, invalidRequest)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Invalid device request did not stall")
+
+	var invalidInterfaceRequest usbSetupPacket
+	invalidInterfaceRequest.setRecipient(usbRequestRecipientInterface)
+	invalidInterfaceRequest.BRequest = 0x55
+	_, status = sendControlMessage(device, invalidInterfaceRequest)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Invalid interface request did not stall")
+
+	var invalidRecipient usbSetupPacket
+	invalidRecipient.setRecipient(usbRequestRecipientOther)
+	_, status = sendControlMessage(device, invalidRecipient)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Invalid recipient did not stall")
+
+	status = usbip.USBIPStatusSuccess
+	device.HandleMessage(0, func(other []byte, otherStatus int32) {
+		status = otherStatus
+	}, 0, []byte{1, 2}, []byte{})
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Short setup packet did not stall")
+}
+
+func TestDescriptorCache(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	first, err := device.getDescriptor(usbDescriptorConfiguration, 0)
+	test.Assert(t, err == nil, "Could not get configuration")
+	second, err := device.getDescriptor(usbDescriptorConfiguration, 0)
+	test.Assert(t, err == nil, "Could not get configuration")
+	test.Assert(t, &first[0] == &second[0], "Configuration should come from the cache")
+
+	var setup usbSetupPacket
+	setup.setRecipient(usbRequestRecipientDevice)
+	setup.BRequest = usbRequestSetConfiguration
+	_, err = device.handleControlMessage(setup, nil)
+	test.Assert(t, err == nil, "SET_CONFIGURATION failed")
+	rebuilt, err := device.getDescriptor(usbDescriptorConfiguration, 0)
+	test.Assert(t, err == nil, "Could not get configuration")
+	test.Assert(t, &rebuilt[0] != &first[0], "SET_CONFIGURATION should rebuild the cache")
+	test.Assert(t, bytes.Equal(rebuilt, first), "Rebuilt configuration should match")
+	_, err = device.getDescriptor(usbDescriptorString, 9)
+	test.Assert(t, err != nil, "Unknown string descriptor should fail")
+}
+
+func TestHighSpeed(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	test.Assert(t, device.SetSpeed(USBSpeedFull, 512, 1) != nil, "Full speed should only allow 64 byte packets")
+	test.Assert(t, device.SetSpeed(USBSpeedHigh, 2048, 4) != nil, "High speed packets should be at most 1024 bytes")
+	test.Assert(t, device.SetSpeed(USBSpeedHigh, 512, 17) != nil, "High speed interval should be at most 16")
+	_, err := device.getDescriptor(usbDescriptorDeviceQualifier, 0)
+	test.Assert(t, err != nil, "Full speed device should have no qualifier")
+
+	test.Assert(t, device.SetSpeed(USBSpeedHigh, 512, 4) == nil, "Could not switch to high speed")
+	test.AssertEqual(t, device.DeviceSummary().Header.Speed, uint32(USBSpeedHigh), "Summary should report high speed")
+	deviceDescriptor := device.getDeviceDescriptor()
+	test.AssertEqual(t, deviceDescriptor.BcdUSB, 0x0200, "High speed device should be USB 2.0")
+	_, err = device.getDescriptor(usbDescriptorDeviceQualifier, 0)
+	test.Assert(t, err == nil, "High speed device should have a qualifier")
+	for _, endpoint := range device.getEndpointDescriptors() {
+		test.AssertEqual(t, endpoint.WMaxPacketSize, 512, "Endpoints should use the packet size")
+		test.AssertEqual(t, endpoint.BInterval, 4, "Endpoints should use the interval")
+	}
+	report, err := device.getDescriptor(usbDescriptorHIDReport, 0)
+	test.Assert(t, err == nil, "Could not get HID report")
+	test.Assert(t, bytes.Contains(report, []byte{0x96, 0x00, 0x02}), "HID reports should be the packet size")
+}
+
+func TestStandardRequests(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	request := func(recipient usbRequestRecipient, bRequest usbRequestType, value uint16, index uint16) ([]byte, int32) {
+		var setup usbSetupPacket
+		setup.setDirection(usbDeviceToHost)
+		setup.setRequestClass(usbRequestClassStandard)
+		setup.setRecipient(recipient)
+		setup.BRequest = bRequest
+		setup.WValue = value
+		setup.WIndex = index
+		setup.WLength = 2
+		var response []byte
+		var status int32
+		device.HandleMessage(0, func(other []byte, otherStatus int32) {
+			response = other
+			status = otherStatus
+		}, 0, util.ToLE(setup), []byte{})
+		return response, status
+	}
+
+	response, _ := request(usbRequestRecipientDevice, usbRequestGetStatus, 0, 0)
+	test.Assert(t, bytes.Equal(response, []byte{usbStatusSelfPowered, 0}), "Device should only be self powered")
+	_, status := request(usbRequestRecipientDevice, usbRequestSetFeature, uint16(usbFeatureDeviceRemoteWakeup), 0)
+	test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Could not enable remote wakeup")
+	response, _ = request(usbRequestRecipientDevice, usbRequestGetStatus, 0, 0)
+	test.Assert(t, bytes.Equal(response, []byte{usbStatusSelfPowered | usbStatusRemoteWakeup, 0}), "Remote wakeup should be enabled")
+	_, status = request(usbRequestRecipientDevice, usbRequestSetFeature, uint16(usbFeatureTestMode), 0)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Test mode should stall")
+
+	response, _ = request(usbRequestRecipientDevice, usbRequestGetConfiguration, 0, 0)
+	test.Assert(t, bytes.Equal(response, []byte{0}), "Device should start unconfigured")
+	_, status = request(usbRequestRecipientDevice, usbRequestSetConfiguration, 2, 0)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Unknown configuration should stall")
+	request(usbRequestRecipientDevice, usbRequestSetConfiguration, usbConfigurationValue, 0)
+	response, _ = request(usbRequestRecipientDevice, usbRequestGetConfiguration, 0, 0)
+	test.Assert(t, bytes.Equal(response, []byte{usbConfigurationValue}), "Configuration not set")
+
+	response, _ = request(usbRequestRecipientInterface, usbRequestGetStatus, 0, 0)
+	test.Assert(t, bytes.Equal(response, []byte{0, 0}), "Incorrect interface status")
+	_, status = request(usbRequestRecipientInterface, usbRequestSetInterface, 0, 0)
+	test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Could not select alternate setting 0")
+	_, status = request(usbRequestRecipientInterface, usbRequestSetInterface, 1, 0)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Unknown alternate setting should stall")
+
+	_, status = request(usbRequestRecipientEndpoint, usbRequestSetFeature, uint16(usbFeatureEndpointHalt), 0x81)
+	test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Could not halt endpoint")
+	response, _ = request(usbRequestRecipientEndpoint, usbRequestGetStatus, 0, 0x81)
+	test.Assert(t, bytes.Equal(response, []byte{usbStatusEndpointHalt, 0}), "Endpoint should be halted")
+	device.HandleMessage(1, func(_ []byte, otherStatus int32) { status = otherStatus }, uint32(usbEndpointOutput), make([]byte, 8), nil)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Halted endpoint should stall")
+	request(usbRequestRecipientEndpoint, usbRequestClearFeature, uint16(usbFeatureEndpointHalt), 0x81)
+	response, _ = request(usbRequestRecipientEndpoint, usbRequestGetStatus, 0, 0x81)
+	test.Assert(t, bytes.Equal(response, []byte{0, 0}), "Endpoint should not be halted")
+	_, status = request(usbRequestRecipientEndpoint, usbRequestGetStatus, 0, 0x83)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Unknown endpoint should stall")
+}
+
+type echoUSBDeviceDelegate struct {
+	transferBuffer []byte
+	respond        func(response []byte)
+}
+
+func (delegate *echoUSBDeviceDelegate) HandleMessage(transferBuffer []byte) {
+	delegate.transferBuffer = transferBuffer
+	delegate.respond(transferBuffer)
+}
+
+func (delegate *echoUSBDeviceDelegate) SetResponseHandler(handler func(response []byte)) {
+	delegate.respond = handler
+}
+
+func TestReportID(t *testing.T) {
+	for _, reportID := range []uint8{0, 3} {
+		delegate := &echoUSBDeviceDelegate{}
+		device := NewUSBDevice(delegate)
+		device.SetReportID(reportID)
+		report, err := device.getDescriptor(usbDescriptorHIDReport, 0)
+		test.Assert(t, err == nil, "Could not get HID report")
+		test.AssertEqual(t, bytes.Contains(report, []byte{0x85, 3}), reportID != 0, "Report ID item should only be declared when enabled")
+
+		packet := bytes.Repeat([]byte{0xAB}, 64)
+		output := packet
+		if reportID != 0 {
+			output = util.Concat([]byte{reportID}, packet)
+		}
+		device.HandleMessage(1, func(response []byte, status int32) {}, 2, make([]byte, 8), output)
+		test.AssertArrEqual(t, delegate.transferBuffer, packet, "HID layer should receive the report without its ID")
+		var input []byte
+		device.HandleMessage(2, func(response []byte, status int32) { input = response }, 1, make([]byte, 8), nil)
+		test.AssertArrEqual(t, input, output, "Host should receive the report with its ID")
+	}
+
+	delegate := &echoUSBDeviceDelegate{}
+	device := NewUSBDevice(delegate)
+	device.SetReportID(3)
+	device.HandleMessage(1, func(response []byte, status int32) {}, 2, make([]byte, 8), util.Concat([]byte{4}, make([]byte, 64)))
+	test.Assert(t, delegate.transferBuffer == nil, "Reports with the wrong ID should be dropped")
+}
+
+func controlReport(device *USBDevice, request usbHIDRequestType, reportType usbHIDReportType, data []byte) ([]byte, int32) {
+	var setup usbSetupPacket
+	setup.setRequestClass(usbRequestClassClass)
+	setup.setRecipient(usbRequestRecipientInterface)
+	setup.BRequest = usbRequestType(request)
+	setup.WValue = uint16(reportType) << 8
+	setup.WLength = uint16(len(data))
+	if request == usbHIDRequestGetReport {
+		setup.setDirection(usbDeviceToHost)
+		setup.WLength = 65
+	}
+	var response []byte
+	var status int32
+	device.HandleMessage(1, func(other []byte, otherStatus int32) {
+		response = other
+		status = otherStatus
+	}, 0, util.ToLE(setup), data)
+	return response, status
+}
+
+func TestControlReports(t *testing.T) {
+	for _, reportID := range []uint8{0, 3} {
+		delegate := &echoUSBDeviceDelegate{}
+		device := NewUSBDevice(delegate)
+		device.SetReportID(reportID)
+		packet := bytes.Repeat([]byte{0xAB}, 64)
+		output := packet
+		empty := make([]byte, 64)
+		if reportID != 0 {
+			output = util.Concat([]byte{reportID}, packet)
+			empty = util.Concat([]byte{reportID}, empty)
+		}
+
+		_, status := controlReport(device, usbHIDRequestSetReport, usbHIDReportOutput, output)
+		test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "SET_REPORT failed")
+		test.AssertArrEqual(t, delegate.transferBuffer, packet, "SET_REPORT should deliver the report to the HID layer")
+		response, status := controlReport(device, usbHIDRequestGetReport, usbHIDReportInput, nil)
+		test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "GET_REPORT failed")
+		test.AssertArrEqual(t, response, output, "GET_REPORT should return the waiting response")
+		response, _ = controlReport(device, usbHIDRequestGetReport, usbHIDReportInput, nil)
+		test.AssertArrEqual(t, response, empty, "GET_REPORT without a waiting response should return an empty report")
+	}
+
+	device := NewUSBDevice(&echoUSBDeviceDelegate{})
+	_, status := controlReport(device, usbHIDRequestGetReport, usbHIDReportFeature, nil)
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "FIDO devices have no feature reports")
+	_, status = controlReport(device, usbHIDRequestSetReport, usbHIDReportInput, make([]byte, 64))
+	test.AssertEqual(t, status, usbip.USBIPStatusStall, "Input reports can't be set")
+}
+
+func TestControlDataStageLength(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	var setup usbSetupPacket
+	setup.setDirection(usbDeviceToHost)
+	setup.setRecipient(usbRequestRecipientDevice)
+	setup.BRequest = usbRequestGetDescriptor
+	setup.WValue = uint16(usbDescriptorDevice) << 8
+	setup.WLength = 8
+	response, status := sendControlMessage(device, setup)
+	test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Could not get device descriptor")
+	test.AssertEqual(t, len(response), 8, "Device descriptor should be cut to wLength")
+
+	setup.WValue = uint16(usbDescriptorConfiguration) << 8
+	setup.WLength = 9
+	response, _ = sendControlMessage(device, setup)
+	test.AssertEqual(t, len(response), 9, "Configuration should be cut to wLength")
+	configuration := util.ReadLE[usbConfigurationDescriptor](bytes.NewBuffer(response))
+	setup.WLength = 0xFFFF
+	response, _ = sendControlMessage(device, setup)
+	test.AssertEqual(t, len(response), int(configuration.WTotalLength), "Configuration shorter than wLength should not be padded")
+	setup.WLength = 0
+	response, status = sendControlMessage(device, setup)
+	test.AssertEqual(t, status, usbip.USBIPStatusSuccess, "Request without a data stage should succeed")
+	test.AssertEqual(t, len(response), 0, "Request without a data stage should return no data")
+}
+
+func TestSerialNumber(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	device.SetSerialNumber("0123ABCD")
+	serialNumber, err := device.getDescriptor(usbDescriptorString, device.getDeviceDescriptor().ISerialNumber)
+	test.Assert(t, err == nil, "Could not get serial number")
+	test.Assert(t, bytes.Contains(serialNumber, util.Utf16encode("0123ABCD")), "Device should report its serial number")
+}
+
+func TestDeviceNumber(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	test.AssertEqual(t, device.BusID(), "2-2", "Default bus ID should not change")
+	device.SetDeviceNumber(3)
+	test.AssertEqual(t, device.BusID(), "2-3", "Bus ID should use the device number")
+	summary := device.DeviceSummary()
+	test.AssertEqual(t, summary.Header.Devnum, uint32(3), "Summary should use the device number")
+	test.Assert(t, bytes.HasPrefix(summary.Header.BusID[:], []byte("2-3\x00")), "Summary should use the bus ID")
+}
+
+func TestDetach(t *testing.T) {
+	device := NewUSBDevice(&echoUSBDeviceDelegate{})
+	device.handleControlTransfer(usbSetupPacket{BRequest: usbRequestSetConfiguration, WValue: usbConfigurationValue}, nil)
+	packet := bytes.Repeat([]byte{0xAB}, 64)
+	oldRead := false
+	device.HandleMessage(1, func(response []byte, status int32) { oldRead = true }, 1, make([]byte, 8), nil)
+	device.Detach()
+	test.AssertEqual(t, device.currentConfiguration(), uint8(0), "Detached device should be unconfigured")
+	var input []byte
+	device.HandleMessage(2, func(response []byte, status int32) { input = response }, 1, make([]byte, 8), nil)
+	device.HandleMessage(3, func(response []byte, status int32) {}, 2, make([]byte, 8), packet)
+	test.Assert(t, !oldRead, "Reads the old host left waiting should be dropped")
+	test.AssertArrEqual(t, input, packet, "New host should get its own response")
+
+	device.HandleMessage(4, func(response []byte, status int32) {}, 2, make([]byte, 8), packet)
+	device.Detach()
+	response, _ := controlReport(device, usbHIDRequestGetReport, usbHIDReportInput, nil)
+	test.AssertArrEqual(t, response, make([]byte, 64), "Responses the old host didn't read should be dropped")
+}
+
+type tracedEchoUSBDeviceDelegate struct {
+	echoUSBDeviceDelegate
+	trace         util.TraceID
+	tracedRespond func(trace util.TraceID, response []byte)
+}
+
+func (delegate *tracedEchoUSBDeviceDelegate) HandleTracedMessage(trace util.TraceID, transferBuffer []byte) {
+	delegate.trace = trace
+	delegate.transferBuffer = transferBuffer
+	delegate.tracedRespond(trace, transferBuffer)
+}
+
+func (delegate *tracedEchoUSBDeviceDelegate) SetTracedResponseHandler(handler func(trace util.TraceID, response []byte)) {
+	delegate.tracedRespond = handler
+}
+
+func TestTracedDelegate(t *testing.T) {
+	delegate := &tracedEchoUSBDeviceDelegate{}
+	device := NewUSBDevice(delegate)
+	packet := bytes.Repeat([]byte{0xAB}, 64)
+	device.HandleTracedMessage(7, 1, func(response []byte, status int32) {}, 2, make([]byte, 8), packet)
+	test.AssertEqual(t, delegate.trace, util.TraceID(7), "Delegate should get the trace of the URB")
+	var input []byte
+	device.HandleTracedMessage(8, 2, func(response []byte, status int32) { input = response }, 1, make([]byte, 8), nil)
+	test.AssertArrEqual(t, input, packet, "Traced responses should reach the host")
+}
@@ -0,0 +1,180 @@
+package usb
+
+import (
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// usbInterface is one function of a composite device. The device numbers interfaces in the
+// order they're added and numbers their endpoints after the ones it already has.
+type usbInterface interface {
+	name() string
+	interfaceClass() (class uint8, subclass uint8, protocol uint8)
+	// Class-specific descriptors placed between the interface and its endpoints
+	classDescriptors() []byte
+	// Endpoint addresses only carry the direction bit, the device fills in the number
+	endpoints() []usbEndpointDescriptor
+	// Requests addressed to the interface other than the standard ones the device handles,
+	// with the data stage of host to device requests
+	handleRequest(setup usbSetupPacket, data []byte) ([]byte, error)
+	// Data the host wrote to the OUT endpoint at index, traced by the URB that carried it
+	handleOutput(trace util.TraceID, index int, data []byte)
+	// start gives the interface a way to queue data for the host on its IN endpoints, with
+	// the trace of the request it answers
+	start(send func(trace util.TraceID, index int, data []byte))
+}
+
+// Interfaces with a HID report descriptor, which is cached with the interface number as index
+type usbHIDReporter interface {
+	hidReport() []byte
+}
+
+type usbEndpointRoute struct {
+	iface           usbInterface
+	interfaceNumber uint8
+	index           int
+	// Responses waiting for the host to read them, only on IN endpoints
+	requests *util.RequestBuffer
+}
+
+// hidInterface is the FIDO HID interface every device starts with
+type hidInterface struct {
+	device   *USBDevice
+	delegate USBDeviceDelegate
+}
+
+func (iface *hidInterface) name() string {
+	return "Default Interface"
+}
+
+func (iface *hidInterface) interfaceClass() (uint8, uint8, uint8) {
+	return usbInterfaceClassHID, 0, 0
+}
+
+func (iface *hidInterface) classDescriptors() []byte {
+	hid := iface.device.getHIDDescriptor(iface.hidReport())
+	usbLogger.Printf("HID: %#v\n\n", hid)
+	return util.ToLE(hid)
+}
+
+func (iface *hidInterface) endpoints() []usbEndpointDescriptor {
+	length := util.SizeOf[usbEndpointDescriptor]()
+	return []usbEndpointDescriptor{
+		{
+			BLength:          length,
+			BDescriptorType:  usbDescriptorEndpoint,
+			BEndpointAddress: 0b10000000,
+			BmAttributes:     0b00000011,
+			WMaxPacketSize:   iface.device.maxPacketSize,
+			BInterval:        iface.device.interval,
+		},
+		{
+			BLength:          length,
+			BDescriptorType:  usbDescriptorEndpoint,
+			BEndpointAddress: 0b00000000,
+			BmAttributes:     0b00000011,
+			WMaxPacketSize:   iface.device.maxPacketSize,
+			BInterval:        iface.device.interval,
+		},
+	}
+}
+
+func (iface *hidInterface) hidReport() []byte {
+	return iface.device.getHIDReport()
+}
+
+// handleRequest also carries reports over the control endpoint, which some hosts use
+// instead of the interrupt endpoints, e.g. to probe the device during enumeration
+func (iface *hidInterface) handleRequest(setup usbSetupPacket, data []byte) ([]byte, error) {
+	if setup.requestClass() != usbRequestClassClass {
+		return iface.device.handleHIDRequest(setup)
+	}
+	reportType := usbHIDReportType(setup.WValue >> 8)
+	switch usbHIDRequestType(setup.BRequest) {
+	case usbHIDRequestGetReport:
+		if reportType != usbHIDReportInput {
+			return nil, fmt.Errorf("Invalid HID report type for GET_REPORT: %d", reportType)
+		}
+		// Reports read here are not also sent on the interrupt endpoint
+		if report, ok := iface.device.pollInput(iface, 0); ok {
+			return report, nil
+		}
+		return iface.emptyReport(), nil
+	case usbHIDRequestSetReport:
+		if reportType != usbHIDReportOutput {
+			return nil, fmt.Errorf("Invalid HID report type for SET_REPORT: %d", reportType)
+		}
+		// Reports written with SET_REPORT start their trace in the delegate
+		iface.handleOutput(0, 0, data)
+		return nil, nil
+	}
+	return iface.device.handleHIDRequest(setup)
+}
+
+// emptyReport is returned by GET_REPORT when there's no response waiting for the host
+func (iface *hidInterface) emptyReport() []byte {
+	report := make([]byte, iface.device.maxPacketSize)
+	if reportID := iface.device.reportID; reportID != 0 {
+		report = util.Concat([]byte{reportID}, report)
+	}
+	return report
+}
+
+// handleHIDRequest handles the class requests every HID interface supports
+func (device *USBDevice) handleHIDRequest(setup usbSetupPacket) ([]byte, error) {
+	switch usbHIDRequestType(setup.BRequest) {
+	case usbHIDRequestSetIdle:
+		// No-op since we are made in software
+		usbLogger.Printf("SET IDLE: No-op\n\n")
+	case usbHIDRequestSetProtocol:
+		// No-op since we are always in report protocol, no boot protocol
+	case usbHIDRequestGetDescriptor:
+		descriptorType, descriptorIndex := getDescriptorTypeAndIndex(setup.WValue)
+		usbLogger.Printf("GET INTERFACE DESCRIPTOR - Type: %s Index: %d\n\n", descriptorType, descriptorIndex)
+		switch descriptorType {
+		case usbDescriptorHIDReport:
+			report, _ := device.cachedDescriptor(usbDescriptorHIDReport, uint8(setup.WIndex))
+			usbLogger.Printf("HID REPORT: %v\n\n", report)
+			return report, nil
+		default:
+			return nil, fmt.Errorf("Invalid USB Interface descriptor: %d - %d", descriptorType, descriptorIndex)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid USB Interface bRequest: %d", setup.BRequest)
+	}
+	return nil, nil
+}
+
+func (iface *hidInterface) handleOutput(trace util.TraceID, index int, data []byte) {
+	if reportID := iface.device.reportID; reportID != 0 {
+		if len(data) == 0 || data[0] != reportID {
+			usbLogger.WithTrace(trace).Printf("ERROR: HID report without report ID %d: %#v\n\n", reportID, data)
+			return
+		}
+		data = data[1:]
+	}
+	if traced, ok := iface.delegate.(TracedUSBDeviceDelegate); ok && trace != 0 {
+		traced.HandleTracedMessage(trace, data)
+	} else {
+		iface.delegate.HandleMessage(data)
+	}
+}
+
+func (iface *hidInterface) start(send func(trace util.TraceID, index int, data []byte)) {
+	withReportID := func(response []byte) []byte {
+		if reportID := iface.device.reportID; reportID != 0 {
+			return util.Concat([]byte{reportID}, response)
+		}
+		return response
+	}
+	if traced, ok := iface.delegate.(TracedUSBDeviceDelegate); ok {
+		traced.SetTracedResponseHandler(func(trace util.TraceID, response []byte) {
+			send(trace, 0, withReportID(response))
+		})
+		return
+	}
+	iface.delegate.SetResponseHandler(func(response []byte) {
+		send(0, 0, withReportID(response))
+	})
+}
@@ -1,6 +1,8 @@
 package usbip
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 )
 
@@ -8,6 +10,14 @@ const (
 	usbipVersion = 0x0111
 )
 
+// Status codes returned to the host in RET_SUBMIT; these are negated Linux errno
+// values regardless of the platform we are running on
+const (
+	USBIPStatusSuccess  int32 = 0
+	USBIPStatusStall    int32 = -32  // -EPIPE
+	USBIPStatusTimedOut int32 = -110 // -ETIMEDOUT
+)
+
 type usbipDirection uint32
 
 const (
@@ -72,6 +82,21 @@ type usbipOpRepDevlist struct {
 	Devices    []USBIPDeviceSummary
 }
 
+// bytes encodes the reply by hand, since binary.Write can't handle the variable number of
+// devices and interfaces
+func (reply usbipOpRepDevlist) bytes() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, reply.Header)
+	binary.Write(buffer, binary.BigEndian, reply.NumDevices)
+	for _, device := range reply.Devices {
+		binary.Write(buffer, binary.BigEndian, device.Header)
+		for _, deviceInterface := range device.DeviceInterfaces {
+			binary.Write(buffer, binary.BigEndian, deviceInterface)
+		}
+	}
+	return buffer.Bytes()
+}
+
 func newOpRepDevlist(devices []USBIPDevice) usbipOpRepDevlist {
 	summaries := make([]USBIPDeviceSummary, len(devices))
 	for i := range devices {
@@ -172,7 +197,7 @@ func (body usbipCommandSubmitBody) String() string {
 }
 
 type usbipReturnSubmitBody struct {
-	Status          uint32
+	Status          int32
 	ActualLength    uint32
 	StartFrame      uint32
 	NumberOfPackets uint32
@@ -191,12 +216,12 @@ type usbipReturnUnlinkBody struct {
 }
 
 type USBIPDeviceSummary struct {
-	Header          USBIPDeviceSummaryHeader
-	DeviceInterface USBIPDeviceInterface // We only support one interface to use binary.Write/Read
+	Header           USBIPDeviceSummaryHeader
+	DeviceInterfaces []USBIPDeviceInterface
 }
 
 func (summary USBIPDeviceSummary) String() string {
-	return fmt.Sprintf("USBIPDeviceSummary{ Header: %s, DeviceInterface: %#v }", summary.Header, summary.DeviceInterface)
+	return fmt.Sprintf("USBIPDeviceSummary{ Header: %s, DeviceInterfaces: %#v }", summary.Header, summary.DeviceInterfaces)
 }
 
 type USBIPDeviceSummaryHeader struct {
@@ -238,11 +263,12 @@ func (header USBIPDeviceSummaryHeader) String() string {
 type USBIPDeviceInterface struct {
 	BInterfaceClass    uint8
 	BInterfaceSubclass uint8
+	BInterfaceProtocol uint8
 	Padding            uint8
 }
 
 type USBIPDevice interface {
-	HandleMessage(id uint32, onFinish func(response []byte), endpoint uint32, setupBytes []byte, transferBuffer []byte)
+	HandleMessage(id uint32, onFinish func(response []byte, status int32), endpoint uint32, setupBytes []byte, transferBuffer []byte)
 	RemoveWaitingRequest(id uint32) bool
 	BusID() string
 	DeviceSummary() USBIPDeviceSummary
@@ -0,0 +1,219 @@
+package usbip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcapng block types
+const (
+	pcapngSectionHeaderBlock     uint32 = 0x0A0D0D0A
+	pcapngInterfaceDescription   uint32 = 0x00000001
+	pcapngEnhancedPacketBlock    uint32 = 0x00000006
+	pcapngByteOrderMagic         uint32 = 0x1A2B3C4D
+	pcapngLinkTypeUSBLinuxMmaped uint16 = 220
+)
+
+// usbmon URB event and transfer types, as decoded by Wireshark
+const (
+	usbmonEventSubmit   byte = 'S'
+	usbmonEventComplete byte = 'C'
+
+	usbmonTransferInterrupt byte = 1
+	usbmonTransferControl   byte = 2
+
+	usbmonSetupAbsent   byte = '-'
+	usbmonDataAbsentIn  byte = '<'
+	usbmonDataAbsentOut byte = '>'
+)
+
+// Linux usbmon mmapped header (LINKTYPE_USB_LINUX_MMAPPED), always little endian in captures
+type usbmonHeader struct {
+	ID           uint64
+	EventType    byte
+	TransferType byte
+	Endpoint     byte
+	Devnum       byte
+	Busnum       uint16
+	FlagSetup    byte
+	FlagData     byte
+	Seconds      int64
+	Microseconds int32
+	Status       int32
+	Length       uint32
+	CapturedLen  uint32
+	Setup        [8]byte
+	Interval     int32
+	StartFrame   int32
+	TransferFlag uint32
+	NumDesc      uint32
+}
+
+// usbCapture writes URB traffic as pcapng that Wireshark decodes like a usbmon capture
+type usbCapture struct {
+	lock   sync.Mutex
+	output io.WriteCloser
+}
+
+func newUSBCapture(output io.WriteCloser) (*usbCapture, error) {
+	capture := &usbCapture{output: output}
+	sectionHeader := new(bytes.Buffer)
+	binary.Write(sectionHeader, binary.LittleEndian, pcapngByteOrderMagic)
+	binary.Write(sectionHeader, binary.LittleEndian, uint16(1)) // Major version
+	binary.Write(sectionHeader, binary.LittleEndian, uint16(0)) // Minor version
+	binary.Write(sectionHeader, binary.LittleEndian, int64(-1)) // Unknown section length
+	if err := capture.writeBlock(pcapngSectionHeaderBlock, sectionHeader.Bytes()); err != nil {
+		return nil, err
+	}
+	interfaceDescription := new(bytes.Buffer)
+	binary.Write(interfaceDescription, binary.LittleEndian, pcapngLinkTypeUSBLinuxMmaped)
+	binary.Write(interfaceDescription, binary.LittleEndian, uint16(0)) // Reserved
+	binary.Write(interfaceDescription, binary.LittleEndian, uint32(0)) // No snapshot length limit
+	if err := capture.writeBlock(pcapngInterfaceDescription, interfaceDescription.Bytes()); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+func (capture *usbCapture) writeBlock(blockType uint32, body []byte) error {
+	padding := (4 - len(body)%4) % 4
+	totalLength := uint32(12 + len(body) + padding)
+	block := new(bytes.Buffer)
+	binary.Write(block, binary.LittleEndian, blockType)
+	binary.Write(block, binary.LittleEndian, totalLength)
+	block.Write(body)
+	block.Write(make([]byte, padding))
+	binary.Write(block, binary.LittleEndian, totalLength)
+	_, err := capture.output.Write(block.Bytes())
+	return err
+}
+
+func (capture *usbCapture) writeURB(header usbmonHeader, data []byte, timestamp time.Time) {
+	if capture == nil {
+		return
+	}
+	header.Seconds = timestamp.Unix()
+	header.Microseconds = int32(timestamp.Nanosecond() / 1000)
+	header.CapturedLen = uint32(len(data))
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.LittleEndian, header)
+	packet.Write(data)
+	// Timestamps use the default pcapng resolution of microseconds
+	micros := uint64(timestamp.UnixNano() / 1000)
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, uint32(0)) // Interface ID
+	binary.Write(body, binary.LittleEndian, uint32(micros>>32))
+	binary.Write(body, binary.LittleEndian, uint32(micros))
+	binary.Write(body, binary.LittleEndian, uint32(packet.Len()))
+	binary.Write(body, binary.LittleEndian, uint32(packet.Len()))
+	body.Write(packet.Bytes())
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	if err := capture.writeBlock(pcapngEnhancedPacketBlock, body.Bytes()); err != nil {
+		errLogger.Printf("Could not write USB capture: %v", err)
+	}
+}
+
+func urbHeader(eventType byte, header usbipMessageHeader, setupBytes []byte) usbmonHeader {
+	urb := usbmonHeader{
+		ID:           uint64(header.SequenceNumber),
+		EventType:    eventType,
+		TransferType: usbmonTransferInterrupt,
+		Endpoint:     byte(header.Endpoint & 0x7F),
+		Busnum:       uint16(header.DeviceID >> 16),
+		Devnum:       byte(header.DeviceID),
+		FlagSetup:    usbmonSetupAbsent,
+	}
+	if header.Direction == usbipDirIn {
+		urb.Endpoint |= 0x80
+	}
+	if header.Endpoint == 0 {
+		urb.TransferType = usbmonTransferControl
+		if eventType == usbmonEventSubmit {
+			urb.FlagSetup = 0
+			copy(urb.Setup[:], setupBytes)
+		}
+	}
+	return urb
+}
+
+// Records a CMD_SUBMIT; OUT transfers carry their data on submission
+func (capture *usbCapture) submit(header usbipMessageHeader, setupBytes []byte, length uint32, transferBuffer []byte) {
+	if capture == nil {
+		return
+	}
+	urb := urbHeader(usbmonEventSubmit, header, setupBytes)
+	urb.Length = length
+	var data []byte
+	if header.Direction == usbipDirOut {
+		data = transferBuffer
+	} else {
+		urb.FlagData = usbmonDataAbsentIn
+	}
+	capture.writeURB(urb, data, time.Now())
+}
+
+// Records a RET_SUBMIT; IN transfers carry their data on completion
+func (capture *usbCapture) complete(header usbipMessageHeader, status int32, transferBuffer []byte) {
+	if capture == nil {
+		return
+	}
+	urb := urbHeader(usbmonEventComplete, header, nil)
+	urb.Status = status
+	urb.Length = uint32(len(transferBuffer))
+	var data []byte
+	if header.Direction == usbipDirIn {
+		data = transferBuffer
+	} else {
+		urb.FlagData = usbmonDataAbsentOut
+	}
+	capture.writeURB(urb, data, time.Now())
+}
+
+func (capture *usbCapture) close() error {
+	if capture == nil {
+		return nil
+	}
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	return capture.output.Close()
+}
+
+// EnableCapture writes all URB traffic to a pcapng file at path, which can be
+// opened in Wireshark next to usbmon captures of real hardware
+func (server *USBIPServer) EnableCapture(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Could not create capture file: %w", err)
+	}
+	capture, err := newUSBCapture(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Could not write capture header: %w", err)
+	}
+	server.captureLock.Lock()
+	previous := server.capture
+	server.capture = capture
+	server.captureLock.Unlock()
+	return previous.close()
+}
+
+// DisableCapture stops any capture and closes its file
+func (server *USBIPServer) DisableCapture() error {
+	server.captureLock.Lock()
+	capture := server.capture
+	server.capture = nil
+	server.captureLock.Unlock()
+	return capture.close()
+}
+
+func (server *USBIPServer) currentCapture() *usbCapture {
+	server.captureLock.Lock()
+	defer server.captureLock.Unlock()
+	return server.capture
+}
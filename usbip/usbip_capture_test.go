@@ -0,0 +1,81 @@
+package usbip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readPCAPNGBlocks(t *testing.T, data []byte) []pcapngBlock {
+	blocks := make([]pcapngBlock, 0)
+	for len(data) > 0 {
+		test.Assert(t, len(data) >= 12, "Truncated pcapng block")
+		blockType := binary.LittleEndian.Uint32(data[0:4])
+		length := binary.LittleEndian.Uint32(data[4:8])
+		test.Assert(t, int(length) <= len(data) && length%4 == 0, "Invalid pcapng block length")
+		test.AssertEqual(t, binary.LittleEndian.Uint32(data[length-4:length]), length, "Trailing block length should match")
+		blocks = append(blocks, pcapngBlock{blockType: blockType, body: data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestUSBCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	server := NewUSBIPServer([]USBIPDevice{&dummyUSBIPDevice{}})
+	err := server.EnableCapture(path)
+	test.Assert(t, err == nil, "Capture should start")
+	outData := bytes.Repeat([]byte{0xAB}, 64)
+	input := util.Concat(importRequest("2-2"), submitRequest(usbipDirOut, 1, outData), submitRequest(usbipDirIn, 1, make([]byte, 4)))
+	conn := newUSBIPConnection(server, &replayConn{input: bytes.NewReader(input)})
+	conn.handle()
+	test.Assert(t, server.DisableCapture() == nil, "Capture should close")
+
+	data, err := os.ReadFile(path)
+	test.Assert(t, err == nil, "Capture should be readable")
+	blocks := readPCAPNGBlocks(t, data)
+	test.AssertEqual(t, len(blocks), 6, "Capture should have a header, an interface and four URB events")
+	test.AssertEqual(t, blocks[0].blockType, pcapngSectionHeaderBlock, "Capture should start with a section header")
+	test.AssertEqual(t, binary.LittleEndian.Uint16(blocks[1].body[0:2]), pcapngLinkTypeUSBLinuxMmaped, "Interface should use the usbmon link type")
+
+	packet := func(i int) []byte {
+		return blocks[i].body[20:]
+	}
+	test.AssertEqual(t, packet(2)[8], usbmonEventSubmit, "OUT transfer should be submitted")
+	test.Assert(t, bytes.Equal(packet(2)[64:], outData), "OUT data should be captured on submit")
+	test.AssertEqual(t, packet(3)[8], usbmonEventComplete, "OUT transfer should complete")
+	test.AssertEqual(t, len(packet(3)), 64, "OUT completion should carry no data")
+	test.AssertEqual(t, packet(5)[10], byte(0x81), "IN endpoint should have the direction bit set")
+	test.Assert(t, bytes.Equal(packet(5)[64:], []byte{1, 2, 3, 4}), "IN data should be captured on completion")
+}
+
+func TestControlShortPacket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	server := NewUSBIPServer([]USBIPDevice{&dummyUSBIPDevice{}})
+	test.Assert(t, server.EnableCapture(path) == nil, "Capture should start")
+	// IN submissions only carry the buffer length
+	inRequest := func(endpoint uint32, length int) []byte {
+		return submitRequest(usbipDirIn, endpoint, make([]byte, length))[:48]
+	}
+	input := util.Concat(importRequest("2-2"), inRequest(0, 255), inRequest(1, 8))
+	conn := newUSBIPConnection(server, &replayConn{input: bytes.NewReader(input)})
+	conn.handle()
+	test.Assert(t, server.DisableCapture() == nil, "Capture should close")
+
+	data, err := os.ReadFile(path)
+	test.Assert(t, err == nil, "Capture should be readable")
+	blocks := readPCAPNGBlocks(t, data)
+	test.AssertEqual(t, len(blocks), 6, "Capture should have a header, an interface and four URB events")
+	test.Assert(t, bytes.Equal(blocks[3].body[20+64:], []byte{1, 2, 3, 4}), "Control reply shorter than the buffer should end with a short packet")
+	test.Assert(t, bytes.Equal(blocks[5].body[20+64:], []byte{1, 2, 3, 4, 0, 0, 0, 0}), "Interrupt replies should be padded to the buffer")
+}
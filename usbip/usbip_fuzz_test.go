@@ -0,0 +1,76 @@
+package usbip
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type dummyUSBIPDevice struct{}
+
+func (device *dummyUSBIPDevice) HandleMessage(id uint32, onFinish func(response []byte, status int32), endpoint uint32, setupBytes []byte, transferBuffer []byte) {
+	onFinish([]byte{1, 2, 3, 4}, USBIPStatusSuccess)
+}
+
+func (device *dummyUSBIPDevice) RemoveWaitingRequest(id uint32) bool {
+	return false
+}
+
+func (device *dummyUSBIPDevice) BusID() string {
+	return "2-2"
+}
+
+func (device *dummyUSBIPDevice) DeviceSummary() USBIPDeviceSummary {
+	summary := USBIPDeviceSummary{}
+	copy(summary.Header.BusID[:], []byte("2-2"))
+	return summary
+}
+
+// Feeds fixed input to the connection handler and discards everything written back
+type replayConn struct {
+	input io.Reader
+}
+
+func (conn *replayConn) Read(b []byte) (int, error)         { return conn.input.Read(b) }
+func (conn *replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (conn *replayConn) Close() error                       { return nil }
+func (conn *replayConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (conn *replayConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (conn *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func importRequest(busID string) []byte {
+	header := usbipControlHeader{Version: usbipVersion, Command: usbipCommandOpReqImport}
+	busIDBytes := make([]byte, 32)
+	copy(busIDBytes, busID)
+	return util.Concat(util.ToBE(header), busIDBytes)
+}
+
+func submitRequest(direction usbipDirection, endpoint uint32, data []byte) []byte {
+	header := usbipMessageHeader{Command: usbipCmdSubmit, SequenceNumber: 1, Direction: direction, Endpoint: endpoint}
+	body := usbipCommandSubmitBody{TransferBufferLength: uint32(len(data))}
+	return util.Concat(util.ToBE(header), util.ToBE(body), data)
+}
+
+func FuzzUSBIPHeader(f *testing.F) {
+	devlist := usbipControlHeader{Version: usbipVersion, Command: usbipCommandOpReqDevlist}
+	f.Add(util.ToBE(devlist))
+	f.Add(importRequest("2-2"))
+	f.Add(importRequest("9-9"))
+	f.Add(util.Concat(importRequest("2-2"), submitRequest(usbipDirOut, 1, make([]byte, 64))))
+	f.Add(util.Concat(importRequest("2-2"), submitRequest(usbipDirIn, 0, make([]byte, 18))))
+	unlink := usbipMessageHeader{Command: usbipCmdUnlink, SequenceNumber: 2}
+	f.Add(util.Concat(importRequest("2-2"), util.ToBE(unlink), util.ToBE(usbipCommandUnlinkBody{UnlinkSequenceNumber: 1})))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server := NewUSBIPServer([]USBIPDevice{&dummyUSBIPDevice{}})
+		conn := newUSBIPConnection(server, &replayConn{input: bytes.NewReader(data)})
+		if conn.handle() == nil {
+			t.Fatalf("Connection handler returned without an error")
+		}
+	})
+}
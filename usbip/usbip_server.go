@@ -1,34 +1,118 @@
 package usbip
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/metrics"
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
-var usbipLogger = util.NewLogger("[USBIP] ", util.LogLevelTrace)
-var errLogger = util.NewLogger("[ERR] ", util.LogLevelEnabled)
+var usbipLogger = util.NewLogger("[USBIP] ", util.LogSubsystemUSBIP, util.LogLevelTrace)
+var errLogger = util.NewLogger("[ERR] ", util.LogSubsystemUSBIP, util.LogLevelEnabled)
+
+var usbipURBCounter = metrics.NewCounter("virtual_fido_usbip_urbs_total", "USB/IP requests handled", "command")
+var usbipConnectionCounter = metrics.NewCounter("virtual_fido_usbip_connections_total", "USB/IP connections accepted")
+
+// DefaultAddress is where Start listens unless SetListener is called
+const DefaultAddress = ":3240"
+
+// Our endpoints never transfer more than a maximum-size control transfer
+const usbipMaxTransferBufferLength = 0xFFFF
+
+// How often an idle connection is probed, so a host that went away without closing it, e.g. a
+// VM that was reset, is noticed and the device detached
+const usbipKeepAlivePeriod = 15 * time.Second
+
+// USBIPDetacher is implemented by devices that reset themselves when the host detaches them,
+// e.g. to drop requests the old connection left waiting
+type USBIPDetacher interface {
+	Detach()
+}
+
+// USBIPTracedDevice is implemented by devices that tag what they log and publish while
+// handling a URB with its trace
+type USBIPTracedDevice interface {
+	HandleTracedMessage(trace util.TraceID, id uint32, onFinish func(response []byte, status int32), endpoint uint32, setupBytes []byte, transferBuffer []byte)
+}
 
 type USBIPServer struct {
-	devices []USBIPDevice
+	devices     []USBIPDevice
+	captureLock sync.Mutex
+	capture     *usbCapture
+	// Accepted from instead of listening on DefaultAddress
+	providedListener net.Listener
+	watchdog         *util.Watchdog
+	// Set while Start is running, so Stop can close them
+	listenerLock sync.Mutex
+	listener     net.Listener
+	connections  map[net.Conn]bool
+	stopped      bool
+	// The connection each device is imported by, by bus ID
+	attachments map[string]*usbipAttachment
+}
+
+// usbipAttachment is a device imported by a connection. done is closed once the device has
+// been detached from it.
+type usbipAttachment struct {
+	conn net.Conn
+	done chan struct{}
 }
 
 func NewUSBIPServer(devices []USBIPDevice) *USBIPServer {
 	server := new(USBIPServer)
 	server.devices = devices
+	server.connections = make(map[net.Conn]bool)
+	server.attachments = make(map[string]*usbipAttachment)
 	return server
 }
 
+// SetListener makes Start accept connections from listener, e.g. a socket passed in by systemd
+// socket activation, instead of listening on DefaultAddress. Stop closes it.
+func (server *USBIPServer) SetListener(listener net.Listener) {
+	server.providedListener = listener
+}
+
+// SetWatchdog fails URBs whose device handler runs past the watchdog's deadline with
+// USBIPStatusTimedOut, so the host isn't left waiting on them
+func (server *USBIPServer) SetWatchdog(watchdog *util.Watchdog) {
+	server.watchdog = watchdog
+}
+
+// Start accepts connections until Stop is called. Each connection is served on its own, so a
+// host can reconnect and import the device again while an old connection lingers.
 func (server *USBIPServer) Start() {
 	usbipLogger.Println("Starting USBIP server...")
-	listener, err := net.Listen("tcp", ":3240")
-	util.CheckErr(err, "Could not create listener")
+	listener := server.providedListener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", DefaultAddress)
+		util.CheckErr(err, "Could not create listener")
+	}
+	server.listenerLock.Lock()
+	if server.stopped {
+		server.listenerLock.Unlock()
+		listener.Close()
+		return
+	}
+	server.listener = listener
+	server.listenerLock.Unlock()
 	for {
 		connection, err := listener.Accept()
 		if err != nil {
+			if server.isStopped() {
+				usbipLogger.Println("USBIP server stopped")
+				return
+			}
 			usbipLogger.Printf("Connection accept error: %v", err)
 			continue
 		}
@@ -37,13 +121,90 @@ func (server *USBIPServer) Start() {
 			connection.Close()
 			continue
 		}
-		usbipConn := newUSBIPConnection(server, connection)
-		util.Try(func() {
-			usbipConn.handle()
-		}, func(err interface{}) {
-			errLogger.Printf("%v", err)
-		})
+		usbipConnectionCounter.Inc()
+		server.listenerLock.Lock()
+		if server.stopped {
+			server.listenerLock.Unlock()
+			connection.Close()
+			return
+		}
+		server.connections[connection] = true
+		server.listenerLock.Unlock()
+		go server.serve(connection)
+	}
+}
+
+func (server *USBIPServer) serve(connection net.Conn) {
+	defer func() {
+		connection.Close()
+		server.listenerLock.Lock()
+		delete(server.connections, connection)
+		server.listenerLock.Unlock()
+	}()
+	if tcpConnection, ok := connection.(*net.TCPConn); ok {
+		tcpConnection.SetKeepAlive(true)
+		tcpConnection.SetKeepAlivePeriod(usbipKeepAlivePeriod)
+	}
+	usbipConn := newUSBIPConnection(server, connection)
+	util.Try(func() {
+		err := usbipConn.handle()
+		errLogger.Printf("Connection closed: %v", err)
+	}, func(err interface{}) {
+		errLogger.Printf("%v", err)
+	})
+}
+
+// Stop closes the listener and every connection, which detaches the devices, so Start
+// returns
+func (server *USBIPServer) Stop() {
+	server.listenerLock.Lock()
+	defer server.listenerLock.Unlock()
+	server.stopped = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	for connection := range server.connections {
+		connection.Close()
+	}
+}
+
+func (server *USBIPServer) isStopped() bool {
+	server.listenerLock.Lock()
+	defer server.listenerLock.Unlock()
+	return server.stopped
+}
+
+// attach makes conn the connection device is imported by. A host importing a device that's
+// still imported by another connection has usually lost that one without it closing, so the
+// old connection is closed and the device detached from it first.
+func (server *USBIPServer) attach(device USBIPDevice, conn net.Conn) *usbipAttachment {
+	attachment := &usbipAttachment{conn: conn, done: make(chan struct{})}
+	server.listenerLock.Lock()
+	previous := server.attachments[device.BusID()]
+	server.attachments[device.BusID()] = attachment
+	server.listenerLock.Unlock()
+	if previous != nil {
+		usbipLogger.Printf("Device %s imported again, closing its previous connection\n\n", device.BusID())
+		previous.conn.Close()
+		<-previous.done
+	}
+	events.Publish(events.Event{Type: events.EventDeviceAttached, BusID: device.BusID()})
+	return attachment
+}
+
+// detach resets the device once its connection is gone, keeping the state behind it (e.g. the
+// vault), so the next import starts from a freshly plugged in device
+func (server *USBIPServer) detach(device USBIPDevice, attachment *usbipAttachment) {
+	if detacher, ok := device.(USBIPDetacher); ok {
+		detacher.Detach()
+	}
+	events.Publish(events.Event{Type: events.EventDeviceDetached, BusID: device.BusID()})
+	server.listenerLock.Lock()
+	if server.attachments[device.BusID()] == attachment {
+		delete(server.attachments, device.BusID())
 	}
+	server.listenerLock.Unlock()
+	close(attachment.done)
 }
 
 func (server *USBIPServer) getDevice(busID string) USBIPDevice {
@@ -71,88 +232,157 @@ func newUSBIPConnection(server *USBIPServer, conn net.Conn) *usbipConnection {
 	return usbipConn
 }
 
-func (conn *usbipConnection) handle() {
+func (conn *usbipConnection) handle() error {
 	for {
-		header := util.ReadBE[usbipControlHeader](conn.conn)
+		var header usbipControlHeader
+		err := binary.Read(conn.conn, binary.BigEndian, &header)
+		if err != nil {
+			return fmt.Errorf("Could not read control header: %w", err)
+		}
 		usbipLogger.Printf("[CONTROL MESSAGE] %#v\n\n", header)
 		if header.Command == usbipCommandOpReqDevlist {
 			reply := newOpRepDevlist(conn.server.devices)
 			usbipLogger.Printf("[OP_REP_DEVLIST] %#v\n\n", reply)
-			conn.writeResponse(util.ToBE(reply))
+			conn.writeResponse(reply.bytes())
 		} else if header.Command == usbipCommandOpReqImport {
-			busIDData := util.Read(conn.conn, 32)
-			busID := util.CStringToString(busIDData)
-			device := conn.server.getDevice(busID)
+			busIDData := make([]byte, 32)
+			_, err := io.ReadFull(conn.conn, busIDData)
+			if err != nil {
+				return fmt.Errorf("Could not read bus ID: %w", err)
+			}
+			device := conn.server.getDevice(string(bytes.TrimRight(busIDData, "\x00")))
 			if device == nil {
 				// Device not found
 				reply := opRepImportError(1)
 				conn.writeResponse(util.ToBE(reply))
 				continue
 			}
+			attachment := conn.server.attach(device, conn.conn)
+			defer conn.server.detach(device, attachment)
 			reply := newOpRepImport(device)
 			usbipLogger.Printf("[OP_REP_IMPORT] %s\n\n", reply)
 			conn.writeResponse(util.ToBE(reply))
-			conn.handleCommands(device)
+			return conn.handleCommands(device)
 		} else {
-			usbipLogger.Printf("Unknown Command Code: %d", header.Command)
+			return fmt.Errorf("Unknown Command Code: %d", header.Command)
 		}
 	}
 }
 
-func (conn *usbipConnection) handleCommands(device USBIPDevice) {
+func (conn *usbipConnection) handleCommands(device USBIPDevice) error {
 	for {
-		util.Try(func() {
-			header := util.ReadBE[usbipMessageHeader](conn.conn)
-			usbipLogger.Printf("[MESSAGE HEADER] %s\n\n", header)
-			if header.Command == usbipCmdSubmit {
-				conn.handleCommandSubmit(device, header)
-			} else if header.Command == usbipCmdUnlink {
-				conn.handleCommandUnlink(device, header)
-			} else {
-				usbipLogger.Printf("Unsupported Command: %#v\n\n", header)
-			}
-		}, func(err interface{}) {
-			errLogger.Printf("%v", err)
-		})
+		var header usbipMessageHeader
+		err := binary.Read(conn.conn, binary.BigEndian, &header)
+		if err != nil {
+			return fmt.Errorf("Could not read message header: %w", err)
+		}
+		// Every URB starts a trace, which follows its data through the device and back
+		trace := util.NewTraceID()
+		usbipLogger.WithTrace(trace).Printf("[MESSAGE HEADER] %s\n\n", header)
+		if header.Command == usbipCmdSubmit {
+			usbipURBCounter.Inc("submit")
+			err = conn.handleCommandSubmit(trace, device, header)
+		} else if header.Command == usbipCmdUnlink {
+			usbipURBCounter.Inc("unlink")
+			err = conn.handleCommandUnlink(trace, device, header)
+		} else {
+			err = fmt.Errorf("Unsupported Command: %#v", header)
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
-func (conn *usbipConnection) handleCommandSubmit(device USBIPDevice, header usbipMessageHeader) {
-	command := util.ReadBE[usbipCommandSubmitBody](conn.conn)
-	usbipLogger.Printf("[COMMAND SUBMIT] %s\n\n", command)
-	transferBuffer := make([]byte, command.TransferBufferLength)
-	if header.Direction == usbipDirOut && command.TransferBufferLength > 0 {
-		_, err := conn.conn.Read(transferBuffer)
-		util.CheckErr(err, "Could not read transfer buffer")
+func (conn *usbipConnection) handleCommandSubmit(trace util.TraceID, device USBIPDevice, header usbipMessageHeader) error {
+	logger := usbipLogger.WithTrace(trace)
+	var command usbipCommandSubmitBody
+	err := binary.Read(conn.conn, binary.BigEndian, &command)
+	if err != nil {
+		return fmt.Errorf("Could not read CMD_SUBMIT body: %w", err)
 	}
-	// Getting the reponse may not be immediate, so we need a callback
-	onReturnSubmit := func(response []byte) {
-		if response != nil {
-			copy(transferBuffer, response)
+	logger.Printf("[COMMAND SUBMIT] %s\n\n", command)
+	if command.TransferBufferLength > usbipMaxTransferBufferLength {
+		return fmt.Errorf("Transfer buffer too large: %d", command.TransferBufferLength)
+	}
+	// The device may hold on to OUT data, so only IN replies are built in pooled buffers
+	var transferBuffer []byte
+	if header.Direction == usbipDirOut {
+		transferBuffer = make([]byte, command.TransferBufferLength)
+		if command.TransferBufferLength > 0 {
+			_, err := io.ReadFull(conn.conn, transferBuffer)
+			if err != nil {
+				return fmt.Errorf("Could not read transfer buffer: %w", err)
+			}
+		}
+	}
+	capture := conn.server.currentCapture()
+	capture.submit(header, command.SetupBytes[:], command.TransferBufferLength, transferBuffer)
+	// Getting the reponse may not be immediate, so we need a callback. Once the watchdog has
+	// failed the URB, the device's own reply is dropped.
+	var completed atomic.Bool
+	onReturnSubmit := func(response []byte, status int32) {
+		if completed.Swap(true) {
+			logger.Printf("Dropping late reply to URB %d\n\n", header.SequenceNumber)
+			return
+		}
+		actualLength := command.TransferBufferLength
+		if status != USBIPStatusSuccess {
+			actualLength = 0
+		} else if header.Direction == usbipDirIn && header.Endpoint == 0 && uint32(len(response)) < actualLength {
+			// A control data stage ends early with a short packet when the device has less
+			// data than wLength, instead of being padded
+			actualLength = uint32(len(response))
 		}
 		replyHeader := header.replyHeader()
 		replyBody := usbipReturnSubmitBody{
-			Status:          0,
-			ActualLength:    uint32(len(transferBuffer)),
+			Status:          status,
+			ActualLength:    actualLength,
 			StartFrame:      0,
 			NumberOfPackets: 0,
 			ErrorCount:      0,
 			Padding:         0,
 		}
-		usbipLogger.Printf("[RETURN SUBMIT] %v %#v\n\n", replyHeader, replyBody)
-		reply := util.Concat(util.ToBE(replyHeader), util.ToBE(replyBody))
+		logger.Printf("[RETURN SUBMIT] %v %#v\n\n", replyHeader, replyBody)
+		reply := util.GetBuffer()
+		defer util.PutBuffer(reply)
+		binary.Write(reply, binary.BigEndian, replyHeader)
+		binary.Write(reply, binary.BigEndian, replyBody)
+		dataStart := reply.Len()
 		if header.Direction == usbipDirIn {
-			usbipLogger.Printf("[RETURN SUBMIT] DATA: %#v\n\n", transferBuffer)
-			reply = append(reply, transferBuffer...)
+			// Replies are padded or cut to the requested length
+			if len(response) > int(actualLength) {
+				response = response[:actualLength]
+			}
+			reply.Write(response)
+			util.Fill(reply, dataStart+int(actualLength))
+			logger.Printf("[RETURN SUBMIT] DATA: %#v\n\n", reply.Bytes()[dataStart:])
+			capture.complete(header, status, reply.Bytes()[dataStart:])
+		} else {
+			capture.complete(header, status, transferBuffer[:actualLength])
 		}
-		conn.writeResponse(reply)
+		conn.writeResponse(reply.Bytes())
 	}
-	device.HandleMessage(header.SequenceNumber, onReturnSubmit, header.Endpoint, command.SetupBytes[:], transferBuffer)
+	handled := conn.server.watchdog.Run(trace.Describe(header), func() {
+		if traced, ok := device.(USBIPTracedDevice); ok {
+			traced.HandleTracedMessage(trace, header.SequenceNumber, onReturnSubmit, header.Endpoint, command.SetupBytes[:], transferBuffer)
+		} else {
+			device.HandleMessage(header.SequenceNumber, onReturnSubmit, header.Endpoint, command.SetupBytes[:], transferBuffer)
+		}
+	})
+	if !handled {
+		onReturnSubmit(nil, USBIPStatusTimedOut)
+	}
+	return nil
 }
 
-func (conn *usbipConnection) handleCommandUnlink(device USBIPDevice, header usbipMessageHeader) {
-	unlink := util.ReadBE[usbipCommandUnlinkBody](conn.conn)
-	usbipLogger.Printf("[COMMAND UNLINK] %#v\n\n", unlink)
+func (conn *usbipConnection) handleCommandUnlink(trace util.TraceID, device USBIPDevice, header usbipMessageHeader) error {
+	var unlink usbipCommandUnlinkBody
+	err := binary.Read(conn.conn, binary.BigEndian, &unlink)
+	if err != nil {
+		return fmt.Errorf("Could not read CMD_UNLINK body: %w", err)
+	}
+	usbipLogger.WithTrace(trace).Printf("[COMMAND UNLINK] %#v\n\n", unlink)
 	var status int32
 	if device.RemoveWaitingRequest(unlink.UnlinkSequenceNumber) {
 		status = -int32(syscall.ECONNRESET)
@@ -169,10 +399,16 @@ func (conn *usbipConnection) handleCommandUnlink(device USBIPDevice, header usbi
 		util.ToBE(replyBody),
 	)
 	conn.writeResponse(reply)
+	return nil
 }
 
 func (conn *usbipConnection) writeResponse(data []byte) {
 	conn.responseMutex.Lock()
-	util.Write(conn.conn, data)
-	conn.responseMutex.Unlock()
+	defer conn.responseMutex.Unlock()
+	// Responses can arrive asynchronously after the connection has gone away,
+	// so a failed write is logged rather than treated as fatal
+	_, err := conn.conn.Write(data)
+	if err != nil {
+		errLogger.Printf("Could not write response: %v", err)
+	}
 }
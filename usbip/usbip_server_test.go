@@ -0,0 +1,127 @@
+package usbip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type detachingUSBIPDevice struct {
+	dummyUSBIPDevice
+	lock     sync.Mutex
+	detached int
+}
+
+func (device *detachingUSBIPDevice) Detach() {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	device.detached++
+}
+
+func nextDeviceEvent(t *testing.T, subscription *events.Subscription) events.EventType {
+	for {
+		select {
+		case event := <-subscription.Events():
+			if event.Type == events.EventDeviceAttached || event.Type == events.EventDeviceDetached {
+				return event.Type
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for device event")
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Assert(t, err == nil, "Could not listen")
+	device := &detachingUSBIPDevice{}
+	server := NewUSBIPServer([]USBIPDevice{device})
+	server.SetListener(listener)
+	stopped := make(chan struct{})
+	go func() {
+		server.Start()
+		close(stopped)
+	}()
+	subscription := events.Subscribe(16)
+	defer subscription.Unsubscribe()
+
+	importDevice := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		test.Assert(t, err == nil, "Could not connect")
+		_, err = conn.Write(importRequest("2-2"))
+		test.Assert(t, err == nil, "Could not import device")
+		return conn
+	}
+
+	// A host that goes away without closing its connection, like a VM that was reset
+	lost := importDevice()
+	defer lost.Close()
+	test.AssertEqual(t, nextDeviceEvent(t, subscription), events.EventDeviceAttached, "Device should be attached")
+	reconnected := importDevice()
+	test.AssertEqual(t, nextDeviceEvent(t, subscription), events.EventDeviceDetached, "Device should be detached from the lost connection")
+	test.AssertEqual(t, nextDeviceEvent(t, subscription), events.EventDeviceAttached, "Device should be attached again")
+	lost.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(lost)
+	test.Assert(t, err == nil, "Lost connection should be closed")
+
+	reconnected.Close()
+	test.AssertEqual(t, nextDeviceEvent(t, subscription), events.EventDeviceDetached, "Device should be detached when the host disconnects")
+	device.lock.Lock()
+	test.AssertEqual(t, device.detached, 2, "Device should be reset on every detach")
+	device.lock.Unlock()
+
+	// The server keeps accepting after hosts go away
+	importDevice().Close()
+	test.AssertEqual(t, nextDeviceEvent(t, subscription), events.EventDeviceAttached, "Device should be attached after reconnecting")
+	test.AssertEqual(t, nextDeviceEvent(t, subscription), events.EventDeviceDetached, "Device should be detached again")
+	server.Stop()
+	<-stopped
+}
+
+type hungUSBIPDevice struct {
+	dummyUSBIPDevice
+	release chan struct{}
+}
+
+func (device *hungUSBIPDevice) HandleMessage(id uint32, onFinish func(response []byte, status int32), endpoint uint32, setupBytes []byte, transferBuffer []byte) {
+	<-device.release
+	onFinish([]byte{1, 2, 3, 4}, USBIPStatusSuccess)
+}
+
+// Feeds fixed input to the connection handler and keeps everything written back
+type recordingConn struct {
+	replayConn
+	lock   sync.Mutex
+	writes [][]byte
+}
+
+func (conn *recordingConn) Write(b []byte) (int, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.writes = append(conn.writes, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func TestWatchdog(t *testing.T) {
+	device := &hungUSBIPDevice{release: make(chan struct{})}
+	server := NewUSBIPServer([]USBIPDevice{device})
+	server.SetWatchdog(util.NewWatchdog(50 * time.Millisecond))
+	input := util.Concat(importRequest("2-2"), submitRequest(usbipDirOut, 1, make([]byte, 64)))
+	conn := &recordingConn{replayConn: replayConn{input: bytes.NewReader(input)}}
+	newUSBIPConnection(server, conn).handle()
+	close(device.release)
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	test.AssertEqual(t, len(conn.writes), 2, "Hung URB should be completed once, after the import reply")
+	status := int32(binary.BigEndian.Uint32(conn.writes[1][20:24]))
+	test.AssertEqual(t, status, USBIPStatusTimedOut, "Hung URB should time out")
+}
@@ -0,0 +1,193 @@
+package usbredir
+
+import "fmt"
+
+// usbredir packet types (usbredirproto.h)
+type usbredirPacketType uint32
+
+const (
+	usbredirHello                   usbredirPacketType = 0
+	usbredirDeviceConnect           usbredirPacketType = 1
+	usbredirDeviceDisconnect        usbredirPacketType = 2
+	usbredirReset                   usbredirPacketType = 3
+	usbredirInterfaceInfo           usbredirPacketType = 4
+	usbredirEPInfo                  usbredirPacketType = 5
+	usbredirSetConfiguration        usbredirPacketType = 6
+	usbredirGetConfiguration        usbredirPacketType = 7
+	usbredirConfigurationStatus     usbredirPacketType = 8
+	usbredirSetAltSetting           usbredirPacketType = 9
+	usbredirGetAltSetting           usbredirPacketType = 10
+	usbredirAltSettingStatus        usbredirPacketType = 11
+	usbredirStartInterruptReceiving usbredirPacketType = 15
+	usbredirStopInterruptReceiving  usbredirPacketType = 16
+	usbredirInterruptReceivingStat  usbredirPacketType = 17
+	usbredirCancelDataPacket        usbredirPacketType = 21
+	usbredirFilterReject            usbredirPacketType = 22
+	usbredirFilterFilter            usbredirPacketType = 23
+	usbredirDeviceDisconnectAck     usbredirPacketType = 24
+	usbredirControlPacket           usbredirPacketType = 100
+	usbredirBulkPacket              usbredirPacketType = 101
+	usbredirInterruptPacket         usbredirPacketType = 103
+)
+
+var usbredirPacketTypeDescriptions = map[usbredirPacketType]string{
+	usbredirHello:                   "usbredirHello",
+	usbredirDeviceConnect:           "usbredirDeviceConnect",
+	usbredirDeviceDisconnect:        "usbredirDeviceDisconnect",
+	usbredirReset:                   "usbredirReset",
+	usbredirInterfaceInfo:           "usbredirInterfaceInfo",
+	usbredirEPInfo:                  "usbredirEPInfo",
+	usbredirSetConfiguration:        "usbredirSetConfiguration",
+	usbredirGetConfiguration:        "usbredirGetConfiguration",
+	usbredirConfigurationStatus:     "usbredirConfigurationStatus",
+	usbredirSetAltSetting:           "usbredirSetAltSetting",
+	usbredirGetAltSetting:           "usbredirGetAltSetting",
+	usbredirAltSettingStatus:        "usbredirAltSettingStatus",
+	usbredirStartInterruptReceiving: "usbredirStartInterruptReceiving",
+	usbredirStopInterruptReceiving:  "usbredirStopInterruptReceiving",
+	usbredirInterruptReceivingStat:  "usbredirInterruptReceivingStatus",
+	usbredirCancelDataPacket:        "usbredirCancelDataPacket",
+	usbredirFilterReject:            "usbredirFilterReject",
+	usbredirFilterFilter:            "usbredirFilterFilter",
+	usbredirDeviceDisconnectAck:     "usbredirDeviceDisconnectAck",
+	usbredirControlPacket:           "usbredirControlPacket",
+	usbredirBulkPacket:              "usbredirBulkPacket",
+	usbredirInterruptPacket:         "usbredirInterruptPacket",
+}
+
+func (packetType usbredirPacketType) String() string {
+	description, ok := usbredirPacketTypeDescriptions[packetType]
+	if !ok {
+		return fmt.Sprintf("usbredirPacketType(%d)", uint32(packetType))
+	}
+	return description
+}
+
+// Capabilities, as bits of the first word of the hello packet
+const (
+	usbredirCapConnectDeviceVersion = 1 << 1
+	usbredirCapEPInfoMaxPacketSize  = 1 << 4
+	// Not advertised, so packet IDs stay 32 bits
+	usbredirCap64BitIDs = 1 << 5
+)
+
+const usbredirCapabilities uint32 = usbredirCapConnectDeviceVersion | usbredirCapEPInfoMaxPacketSize
+
+type usbredirStatus uint8
+
+const (
+	usbredirStatusSuccess   usbredirStatus = 0
+	usbredirStatusCancelled usbredirStatus = 1
+	usbredirStatusInvalid   usbredirStatus = 2
+	usbredirStatusIOError   usbredirStatus = 3
+	usbredirStatusStall     usbredirStatus = 4
+	usbredirStatusTimeout   usbredirStatus = 5
+)
+
+// Speeds in the device_connect packet
+const (
+	usbredirSpeedFull    uint8 = 1
+	usbredirSpeedHigh    uint8 = 2
+	usbredirSpeedUnknown uint8 = 255
+)
+
+// Endpoint types in the ep_info packet
+const (
+	usbredirTypeControl     uint8 = 0
+	usbredirTypeBulk        uint8 = 2
+	usbredirTypeInterrupt   uint8 = 3
+	usbredirTypeInvalid     uint8 = 255
+	usbredirEndpointEntries       = 32
+)
+
+// Every packet starts with this header, whose length counts the bytes after it. All
+// integers are little endian.
+type usbredirHeader struct {
+	Type   usbredirPacketType
+	Length uint32
+	ID     uint32
+}
+
+func (header usbredirHeader) String() string {
+	return fmt.Sprintf("usbredirHeader{ Type: %s, Length: %d, ID: %d }", header.Type, header.Length, header.ID)
+}
+
+type usbredirHelloHeader struct {
+	Version      [64]byte
+	Capabilities uint32
+}
+
+type usbredirDeviceConnectHeader struct {
+	Speed            uint8
+	DeviceClass      uint8
+	DeviceSubclass   uint8
+	DeviceProtocol   uint8
+	VendorID         uint16
+	ProductID        uint16
+	DeviceVersionBCD uint16
+}
+
+// Interfaces are listed by index, in parallel arrays
+type usbredirInterfaceInfoHeader struct {
+	InterfaceCount    uint32
+	Interface         [32]uint8
+	InterfaceClass    [32]uint8
+	InterfaceSubclass [32]uint8
+	InterfaceProtocol [32]uint8
+}
+
+// Endpoints are indexed by their number, plus 16 for IN endpoints
+type usbredirEPInfoHeader struct {
+	Type          [usbredirEndpointEntries]uint8
+	Interval      [usbredirEndpointEntries]uint8
+	Interface     [usbredirEndpointEntries]uint8
+	MaxPacketSize [usbredirEndpointEntries]uint16
+}
+
+func usbredirEndpointIndex(address uint8) int {
+	return int((address&0x80)>>3 | address&0x0F)
+}
+
+type usbredirConfigurationStatusHeader struct {
+	Status        usbredirStatus
+	Configuration uint8
+}
+
+type usbredirSetAltSettingHeader struct {
+	Interface  uint8
+	AltSetting uint8
+}
+
+type usbredirAltSettingStatusHeader struct {
+	Status     usbredirStatus
+	Interface  uint8
+	AltSetting uint8
+}
+
+type usbredirInterruptReceivingStatusHeader struct {
+	Status   usbredirStatus
+	Endpoint uint8
+}
+
+type usbredirControlPacketHeader struct {
+	Endpoint    uint8
+	Request     uint8
+	RequestType uint8
+	Status      usbredirStatus
+	Value       uint16
+	Index       uint16
+	Length      uint16
+}
+
+type usbredirBulkPacketHeader struct {
+	Endpoint uint8
+	Status   usbredirStatus
+	Length   uint16
+	StreamID uint32
+}
+
+type usbredirInterruptPacketHeader struct {
+	Endpoint uint8
+	Status   usbredirStatus
+	Length   uint16
+}
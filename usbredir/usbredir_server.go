@@ -0,0 +1,627 @@
+// Package usbredir serves a device over the usbredir protocol
+// (https://gitlab.freedesktop.org/spice/usbredir), which QEMU's usb-redir device and SPICE
+// clients like virt-manager use to attach USB devices to a guest. The server plays the
+// usbredir host: the guest connects to it, e.g. with
+// -chardev socket,id=usbredir,host=localhost,port=4000 -device usb-redir,chardev=usbredir.
+package usbredir
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/usbip"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var usbredirLogger = util.NewLogger("[USBREDIR] ", util.LogSubsystemUSBRedir, util.LogLevelTrace)
+var errLogger = util.NewLogger("[ERR] ", util.LogSubsystemUSBRedir, util.LogLevelEnabled)
+
+// DefaultAddress is where Start listens unless SetListener is called
+const DefaultAddress = "localhost:4000"
+
+const usbredirVersion = "virtual-fido"
+
+// Packets carry at most a maximum-size control transfer after their headers
+const usbredirMaxPacketLength = 0xFFFF + 256
+
+// IDs of the interrupt IN requests made while the guest is receiving from an endpoint. The
+// guest numbers its own packets from 0, so they don't collide.
+const usbredirReceiveIDStart uint32 = 1 << 31
+
+// Standard requests the configuration and alternate setting packets are turned into
+const (
+	usbRequestGetDescriptor    uint8 = 6
+	usbRequestGetConfiguration uint8 = 8
+	usbRequestSetConfiguration uint8 = 9
+	usbRequestGetInterface     uint8 = 10
+	usbRequestSetInterface     uint8 = 11
+)
+
+const (
+	usbDescriptorDevice        uint8 = 1
+	usbDescriptorConfiguration uint8 = 2
+	usbDescriptorInterface     uint8 = 4
+	usbDescriptorEndpoint      uint8 = 5
+)
+
+type usbSetupPacket struct {
+	BmRequestType uint8
+	BRequest      uint8
+	WValue        uint16
+	WIndex        uint16
+	WLength       uint16
+}
+
+type USBRedirServer struct {
+	device usbip.USBIPDevice
+	// Accepted from instead of listening on DefaultAddress
+	providedListener net.Listener
+	// Set while Start is running, so Stop can close them
+	lock       sync.Mutex
+	listener   net.Listener
+	connection *usbredirConnection
+	stopped    bool
+}
+
+// NewUSBRedirServer serves device to one guest at a time. A guest connecting while another
+// is attached takes the device over, as the other has usually gone away without closing its
+// connection.
+func NewUSBRedirServer(device usbip.USBIPDevice) *USBRedirServer {
+	return &USBRedirServer{device: device}
+}
+
+// SetListener makes Start accept connections from listener instead of listening on
+// DefaultAddress. Stop closes it.
+func (server *USBRedirServer) SetListener(listener net.Listener) {
+	server.providedListener = listener
+}
+
+// Start accepts connections until Stop is called
+func (server *USBRedirServer) Start() {
+	usbredirLogger.Println("Starting usbredir server...")
+	listener := server.providedListener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", DefaultAddress)
+		util.CheckErr(err, "Could not create listener")
+	}
+	server.lock.Lock()
+	if server.stopped {
+		server.lock.Unlock()
+		listener.Close()
+		return
+	}
+	server.listener = listener
+	server.lock.Unlock()
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if server.isStopped() {
+				usbredirLogger.Println("usbredir server stopped")
+				return
+			}
+			usbredirLogger.Printf("Connection accept error: %v", err)
+			continue
+		}
+		if address, ok := connection.RemoteAddr().(*net.TCPAddr); ok && !address.IP.IsLoopback() {
+			usbredirLogger.Printf("Connection attempted from non-local address: %s", address)
+			connection.Close()
+			continue
+		}
+		go server.serve(connection)
+	}
+}
+
+func (server *USBRedirServer) serve(connection net.Conn) {
+	conn := newUSBRedirConnection(server.device, connection)
+	server.lock.Lock()
+	if server.stopped {
+		server.lock.Unlock()
+		connection.Close()
+		return
+	}
+	previous := server.connection
+	server.connection = conn
+	server.lock.Unlock()
+	if previous != nil {
+		usbredirLogger.Printf("Guest connected again, closing its previous connection\n\n")
+		previous.conn.Close()
+		<-previous.done
+	}
+	events.Publish(events.Event{Type: events.EventDeviceAttached, BusID: server.device.BusID()})
+	util.Try(func() {
+		err := conn.handle()
+		errLogger.Printf("Connection closed: %v", err)
+	}, func(err interface{}) {
+		errLogger.Printf("%v", err)
+	})
+	connection.Close()
+	// The next guest starts from a freshly plugged in device
+	if detacher, ok := server.device.(usbip.USBIPDetacher); ok {
+		detacher.Detach()
+	}
+	events.Publish(events.Event{Type: events.EventDeviceDetached, BusID: server.device.BusID()})
+	server.lock.Lock()
+	if server.connection == conn {
+		server.connection = nil
+	}
+	server.lock.Unlock()
+	close(conn.done)
+}
+
+// Stop closes the listener and the guest's connection, so Start returns
+func (server *USBRedirServer) Stop() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.stopped = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	if server.connection != nil {
+		server.connection.conn.Close()
+	}
+}
+
+func (server *USBRedirServer) isStopped() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.stopped
+}
+
+type usbredirConnection struct {
+	device usbip.USBIPDevice
+	conn   net.Conn
+	// Closed once the device has been detached from the connection
+	done      chan struct{}
+	writeLock sync.Mutex
+	// Capabilities both sides advertised
+	capabilities uint32
+	lock         sync.Mutex
+	// Replies to the data packets the device hasn't answered yet, by ID
+	pending map[uint32]func(response []byte, status usbredirStatus)
+	// The request waiting on each interrupt IN endpoint the guest is receiving from
+	receiving map[uint8]uint32
+	nextID    uint32
+}
+
+func newUSBRedirConnection(device usbip.USBIPDevice, conn net.Conn) *usbredirConnection {
+	return &usbredirConnection{
+		device:    device,
+		conn:      conn,
+		done:      make(chan struct{}),
+		pending:   make(map[uint32]func(response []byte, status usbredirStatus)),
+		receiving: make(map[uint8]uint32),
+		nextID:    usbredirReceiveIDStart,
+	}
+}
+
+func (conn *usbredirConnection) handle() error {
+	hello := usbredirHelloHeader{Capabilities: usbredirCapabilities}
+	copy(hello.Version[:], usbredirVersion)
+	if err := conn.writePacket(usbredirHello, 0, hello, nil); err != nil {
+		return err
+	}
+	for {
+		var header usbredirHeader
+		if err := binary.Read(conn.conn, binary.LittleEndian, &header); err != nil {
+			return fmt.Errorf("Could not read packet header: %w", err)
+		}
+		if header.Length > usbredirMaxPacketLength {
+			return fmt.Errorf("Packet too large: %s", header)
+		}
+		body := make([]byte, header.Length)
+		if _, err := io.ReadFull(conn.conn, body); err != nil {
+			return fmt.Errorf("Could not read packet body: %w", err)
+		}
+		usbredirLogger.Printf("[PACKET] %s\n\n", header)
+		if err := conn.handlePacket(header, body); err != nil {
+			return err
+		}
+	}
+}
+
+func (conn *usbredirConnection) handlePacket(header usbredirHeader, body []byte) error {
+	switch header.Type {
+	case usbredirHello:
+		return conn.handleHello(body)
+	case usbredirReset:
+		conn.handleReset()
+	case usbredirSetConfiguration:
+		var configuration uint8
+		if err := readPacketHeader(body, &configuration); err != nil {
+			return err
+		}
+		_, status := conn.controlRequest(usbSetupPacket{BRequest: usbRequestSetConfiguration, WValue: uint16(configuration)})
+		return conn.writePacket(usbredirConfigurationStatus, header.ID, usbredirConfigurationStatusHeader{Status: status, Configuration: configuration}, nil)
+	case usbredirGetConfiguration:
+		response, status := conn.controlRequest(usbSetupPacket{BmRequestType: 0x80, BRequest: usbRequestGetConfiguration, WLength: 1})
+		reply := usbredirConfigurationStatusHeader{Status: status}
+		if len(response) > 0 {
+			reply.Configuration = response[0]
+		}
+		return conn.writePacket(usbredirConfigurationStatus, header.ID, reply, nil)
+	case usbredirSetAltSetting:
+		var request usbredirSetAltSettingHeader
+		if err := readPacketHeader(body, &request); err != nil {
+			return err
+		}
+		_, status := conn.controlRequest(usbSetupPacket{BmRequestType: 0x01, BRequest: usbRequestSetInterface, WValue: uint16(request.AltSetting), WIndex: uint16(request.Interface)})
+		return conn.writePacket(usbredirAltSettingStatus, header.ID, usbredirAltSettingStatusHeader{Status: status, Interface: request.Interface, AltSetting: request.AltSetting}, nil)
+	case usbredirGetAltSetting:
+		var iface uint8
+		if err := readPacketHeader(body, &iface); err != nil {
+			return err
+		}
+		response, status := conn.controlRequest(usbSetupPacket{BmRequestType: 0x81, BRequest: usbRequestGetInterface, WIndex: uint16(iface), WLength: 1})
+		reply := usbredirAltSettingStatusHeader{Status: status, Interface: iface}
+		if len(response) > 0 {
+			reply.AltSetting = response[0]
+		}
+		return conn.writePacket(usbredirAltSettingStatus, header.ID, reply, nil)
+	case usbredirStartInterruptReceiving:
+		var endpoint uint8
+		if err := readPacketHeader(body, &endpoint); err != nil {
+			return err
+		}
+		conn.startReceiving(endpoint)
+		return conn.writePacket(usbredirInterruptReceivingStat, header.ID, usbredirInterruptReceivingStatusHeader{Status: usbredirStatusSuccess, Endpoint: endpoint}, nil)
+	case usbredirStopInterruptReceiving:
+		var endpoint uint8
+		if err := readPacketHeader(body, &endpoint); err != nil {
+			return err
+		}
+		conn.stopReceiving(endpoint)
+		return conn.writePacket(usbredirInterruptReceivingStat, header.ID, usbredirInterruptReceivingStatusHeader{Status: usbredirStatusSuccess, Endpoint: endpoint}, nil)
+	case usbredirCancelDataPacket:
+		if conn.device.RemoveWaitingRequest(header.ID) {
+			if reply := conn.takePending(header.ID); reply != nil {
+				reply(nil, usbredirStatusCancelled)
+			}
+		}
+	case usbredirControlPacket:
+		return conn.handleControlPacket(header, body)
+	case usbredirBulkPacket:
+		return conn.handleBulkPacket(header, body)
+	case usbredirInterruptPacket:
+		return conn.handleInterruptPacket(header, body)
+	case usbredirFilterReject, usbredirFilterFilter, usbredirDeviceDisconnectAck:
+		// We only ever offer the one device
+	default:
+		usbredirLogger.Printf("Ignoring unsupported packet: %s\n\n", header)
+	}
+	return nil
+}
+
+// handleHello describes the device to the guest, which then connects it
+func (conn *usbredirConnection) handleHello(body []byte) error {
+	var hello usbredirHelloHeader
+	if err := readPacketHeader(body, &hello); err != nil {
+		return err
+	}
+	conn.capabilities = hello.Capabilities & usbredirCapabilities
+	usbredirLogger.Printf("[HELLO] %s, capabilities 0x%x\n\n", string(bytes.TrimRight(hello.Version[:], "\x00")), hello.Capabilities)
+
+	deviceDescriptor, status := conn.controlRequest(usbSetupPacket{BmRequestType: 0x80, BRequest: usbRequestGetDescriptor, WValue: uint16(usbDescriptorDevice) << 8, WLength: 18})
+	if status != usbredirStatusSuccess || len(deviceDescriptor) < 18 {
+		return fmt.Errorf("Could not get device descriptor")
+	}
+	configurationDescriptor, status := conn.controlRequest(usbSetupPacket{BmRequestType: 0x80, BRequest: usbRequestGetDescriptor, WValue: uint16(usbDescriptorConfiguration) << 8, WLength: 0xFFFF})
+	if status != usbredirStatusSuccess {
+		return fmt.Errorf("Could not get configuration descriptor")
+	}
+	interfaceInfo, endpointInfo := parseConfiguration(configurationDescriptor)
+	// The control endpoint isn't described by the configuration
+	for _, address := range []uint8{0x00, 0x80} {
+		index := usbredirEndpointIndex(address)
+		endpointInfo.Type[index] = usbredirTypeControl
+		endpointInfo.MaxPacketSize[index] = uint16(deviceDescriptor[7])
+	}
+
+	if err := conn.writePacket(usbredirInterfaceInfo, 0, interfaceInfo, nil); err != nil {
+		return err
+	}
+	endpointData := util.ToLE(endpointInfo)
+	if conn.capabilities&usbredirCapEPInfoMaxPacketSize == 0 {
+		endpointData = endpointData[:3*usbredirEndpointEntries]
+	}
+	if err := conn.writePacket(usbredirEPInfo, 0, nil, endpointData); err != nil {
+		return err
+	}
+	connect := usbredirDeviceConnectHeader{
+		Speed:            usbredirSpeed(conn.device.DeviceSummary().Header.Speed),
+		DeviceClass:      deviceDescriptor[4],
+		DeviceSubclass:   deviceDescriptor[5],
+		DeviceProtocol:   deviceDescriptor[6],
+		VendorID:         binary.LittleEndian.Uint16(deviceDescriptor[8:]),
+		ProductID:        binary.LittleEndian.Uint16(deviceDescriptor[10:]),
+		DeviceVersionBCD: binary.LittleEndian.Uint16(deviceDescriptor[12:]),
+	}
+	connectData := util.ToLE(connect)
+	if conn.capabilities&usbredirCapConnectDeviceVersion == 0 {
+		connectData = connectData[:8]
+	}
+	usbredirLogger.Printf("[DEVICE CONNECT] %#v\n\n", connect)
+	return conn.writePacket(usbredirDeviceConnect, 0, nil, connectData)
+}
+
+// parseConfiguration lists the interfaces and endpoints of a configuration descriptor
+func parseConfiguration(descriptor []byte) (usbredirInterfaceInfoHeader, usbredirEPInfoHeader) {
+	var interfaceInfo usbredirInterfaceInfoHeader
+	var endpointInfo usbredirEPInfoHeader
+	for i := range endpointInfo.Type {
+		endpointInfo.Type[i] = usbredirTypeInvalid
+	}
+	var iface uint8
+	for len(descriptor) >= 2 && descriptor[0] >= 2 && int(descriptor[0]) <= len(descriptor) {
+		length := descriptor[0]
+		switch descriptor[1] {
+		case usbDescriptorInterface:
+			// Alternate settings share their interface's entry
+			if length < 9 || descriptor[3] != 0 || interfaceInfo.InterfaceCount >= 32 {
+				break
+			}
+			count := interfaceInfo.InterfaceCount
+			iface = descriptor[2]
+			interfaceInfo.Interface[count] = iface
+			interfaceInfo.InterfaceClass[count] = descriptor[5]
+			interfaceInfo.InterfaceSubclass[count] = descriptor[6]
+			interfaceInfo.InterfaceProtocol[count] = descriptor[7]
+			interfaceInfo.InterfaceCount++
+		case usbDescriptorEndpoint:
+			if length < 7 {
+				break
+			}
+			index := usbredirEndpointIndex(descriptor[2])
+			endpointInfo.Type[index] = descriptor[3] & 0x03
+			endpointInfo.MaxPacketSize[index] = binary.LittleEndian.Uint16(descriptor[4:])
+			endpointInfo.Interval[index] = descriptor[6]
+			endpointInfo.Interface[index] = iface
+		}
+		descriptor = descriptor[length:]
+	}
+	return interfaceInfo, endpointInfo
+}
+
+// usbredirSpeed converts the Linux speed USB/IP devices report
+func usbredirSpeed(speed uint32) uint8 {
+	switch speed {
+	case 2:
+		return usbredirSpeedFull
+	case 3:
+		return usbredirSpeedHigh
+	default:
+		return usbredirSpeedUnknown
+	}
+}
+
+// handleReset resets the device as the guest expects from a bus reset. Endpoints it's
+// receiving from keep being polled, since the guest doesn't start receiving again.
+func (conn *usbredirConnection) handleReset() {
+	usbredirLogger.Printf("[RESET]\n\n")
+	conn.lock.Lock()
+	conn.pending = make(map[uint32]func(response []byte, status usbredirStatus))
+	endpoints := make([]uint8, 0, len(conn.receiving))
+	for endpoint := range conn.receiving {
+		endpoints = append(endpoints, endpoint)
+	}
+	conn.lock.Unlock()
+	for _, endpoint := range endpoints {
+		conn.stopReceiving(endpoint)
+	}
+	if detacher, ok := conn.device.(usbip.USBIPDetacher); ok {
+		detacher.Detach()
+	}
+	for _, endpoint := range endpoints {
+		conn.startReceiving(endpoint)
+	}
+}
+
+func (conn *usbredirConnection) handleControlPacket(header usbredirHeader, body []byte) error {
+	var packet usbredirControlPacketHeader
+	if err := readPacketHeader(body, &packet); err != nil {
+		return err
+	}
+	data := body[util.SizeOf[usbredirControlPacketHeader]():]
+	setup := usbSetupPacket{
+		BmRequestType: packet.RequestType,
+		BRequest:      packet.Request,
+		WValue:        packet.Value,
+		WIndex:        packet.Index,
+		WLength:       packet.Length,
+	}
+	in := packet.RequestType&0x80 != 0
+	usbredirLogger.Printf("[CONTROL PACKET] %#v\n\n", packet)
+	conn.submit(header.ID, 0, util.ToLE(setup), data, func(response []byte, status usbredirStatus) {
+		reply := packet
+		reply.Status = status
+		reply.Length = replyLength(in, response, data, status)
+		conn.writeReply(usbredirControlPacket, header.ID, reply, in, response)
+	})
+	return nil
+}
+
+func (conn *usbredirConnection) handleBulkPacket(header usbredirHeader, body []byte) error {
+	var packet usbredirBulkPacketHeader
+	if err := readPacketHeader(body, &packet); err != nil {
+		return err
+	}
+	data := body[util.SizeOf[usbredirBulkPacketHeader]():]
+	in := packet.Endpoint&0x80 != 0
+	conn.submit(header.ID, packet.Endpoint, make([]byte, 8), data, func(response []byte, status usbredirStatus) {
+		reply := packet
+		reply.Status = status
+		reply.Length = replyLength(in, response, data, status)
+		conn.writeReply(usbredirBulkPacket, header.ID, reply, in, response)
+	})
+	return nil
+}
+
+func (conn *usbredirConnection) handleInterruptPacket(header usbredirHeader, body []byte) error {
+	var packet usbredirInterruptPacketHeader
+	if err := readPacketHeader(body, &packet); err != nil {
+		return err
+	}
+	data := body[util.SizeOf[usbredirInterruptPacketHeader]():]
+	in := packet.Endpoint&0x80 != 0
+	conn.submit(header.ID, packet.Endpoint, make([]byte, 8), data, func(response []byte, status usbredirStatus) {
+		reply := packet
+		reply.Status = status
+		reply.Length = replyLength(in, response, data, status)
+		conn.writeReply(usbredirInterruptPacket, header.ID, reply, in, response)
+	})
+	return nil
+}
+
+// replyLength is the data transferred: what the device returned for IN packets, or all of
+// it for OUT packets
+func replyLength(in bool, response []byte, data []byte, status usbredirStatus) uint16 {
+	if status != usbredirStatusSuccess {
+		return 0
+	}
+	if in {
+		return uint16(len(response))
+	}
+	return uint16(len(data))
+}
+
+// writeReply answers a data packet, with the data returned by the device for IN packets
+func (conn *usbredirConnection) writeReply(packetType usbredirPacketType, id uint32, header interface{}, in bool, response []byte) {
+	if !in {
+		response = nil
+	}
+	if err := conn.writePacket(packetType, id, header, response); err != nil {
+		errLogger.Printf("Could not write reply: %v", err)
+	}
+}
+
+// submit hands a data packet to the device, keeping its reply until the device answers so
+// the guest can cancel it
+func (conn *usbredirConnection) submit(id uint32, endpoint uint8, setupBytes []byte, data []byte, reply func(response []byte, status usbredirStatus)) {
+	conn.lock.Lock()
+	conn.pending[id] = reply
+	conn.lock.Unlock()
+	onFinish := func(response []byte, status int32) {
+		if reply := conn.takePending(id); reply != nil {
+			reply(response, usbredirStatusFromUSBIP(status))
+		}
+	}
+	conn.handleMessage(id, onFinish, endpoint, setupBytes, data)
+}
+
+func (conn *usbredirConnection) takePending(id uint32) func(response []byte, status usbredirStatus) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	reply := conn.pending[id]
+	delete(conn.pending, id)
+	return reply
+}
+
+func (conn *usbredirConnection) handleMessage(id uint32, onFinish func(response []byte, status int32), endpoint uint8, setupBytes []byte, data []byte) {
+	if traced, ok := conn.device.(usbip.USBIPTracedDevice); ok {
+		traced.HandleTracedMessage(util.NewTraceID(), id, onFinish, uint32(endpoint&0x0F), setupBytes, data)
+	} else {
+		conn.device.HandleMessage(id, onFinish, uint32(endpoint&0x0F), setupBytes, data)
+	}
+}
+
+// controlRequest makes a control transfer on the guest's behalf and waits for the device
+func (conn *usbredirConnection) controlRequest(setup usbSetupPacket) ([]byte, usbredirStatus) {
+	type result struct {
+		response []byte
+		status   int32
+	}
+	results := make(chan result, 1)
+	conn.lock.Lock()
+	id := conn.nextID
+	conn.nextID++
+	conn.lock.Unlock()
+	conn.handleMessage(id, func(response []byte, status int32) {
+		results <- result{response, status}
+	}, 0, util.ToLE(setup), nil)
+	finished := <-results
+	return finished.response, usbredirStatusFromUSBIP(finished.status)
+}
+
+// startReceiving polls an interrupt IN endpoint, sending the guest each report without
+// waiting to be asked
+func (conn *usbredirConnection) startReceiving(endpoint uint8) {
+	conn.lock.Lock()
+	id := conn.nextID
+	conn.nextID++
+	conn.receiving[endpoint] = id
+	conn.lock.Unlock()
+	conn.handleMessage(id, func(response []byte, status int32) {
+		conn.lock.Lock()
+		current := conn.receiving[endpoint] == id
+		conn.lock.Unlock()
+		if !current {
+			return
+		}
+		if status != usbip.USBIPStatusSuccess {
+			conn.stopReceiving(endpoint)
+			conn.writePacket(usbredirInterruptReceivingStat, 0, usbredirInterruptReceivingStatusHeader{Status: usbredirStatusFromUSBIP(status), Endpoint: endpoint}, nil)
+			return
+		}
+		if len(response) > 0 {
+			packet := usbredirInterruptPacketHeader{Endpoint: endpoint, Status: usbredirStatusSuccess, Length: uint16(len(response))}
+			if err := conn.writePacket(usbredirInterruptPacket, id, packet, response); err != nil {
+				errLogger.Printf("Could not write interrupt packet: %v", err)
+				return
+			}
+		}
+		// The device may answer from within the request, while holding locks of its own
+		go conn.startReceiving(endpoint)
+	}, endpoint, make([]byte, 8), nil)
+}
+
+func (conn *usbredirConnection) stopReceiving(endpoint uint8) {
+	conn.lock.Lock()
+	id, ok := conn.receiving[endpoint]
+	delete(conn.receiving, endpoint)
+	conn.lock.Unlock()
+	if ok {
+		conn.device.RemoveWaitingRequest(id)
+	}
+}
+
+func usbredirStatusFromUSBIP(status int32) usbredirStatus {
+	switch status {
+	case usbip.USBIPStatusSuccess:
+		return usbredirStatusSuccess
+	case usbip.USBIPStatusStall:
+		return usbredirStatusStall
+	case usbip.USBIPStatusTimedOut:
+		return usbredirStatusTimeout
+	default:
+		return usbredirStatusIOError
+	}
+}
+
+func readPacketHeader(body []byte, header interface{}) error {
+	if err := binary.Read(bytes.NewReader(body), binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("Packet too short for %T: %w", header, err)
+	}
+	return nil
+}
+
+// writePacket sends a packet whose type-specific header is followed by data. A nil header
+// sends data alone.
+func (conn *usbredirConnection) writePacket(packetType usbredirPacketType, id uint32, header interface{}, data []byte) error {
+	var body bytes.Buffer
+	if header != nil {
+		binary.Write(&body, binary.LittleEndian, header)
+	}
+	body.Write(data)
+	packetHeader := usbredirHeader{Type: packetType, Length: uint32(body.Len()), ID: id}
+	usbredirLogger.Printf("[REPLY] %s\n\n", packetHeader)
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	// Replies can arrive after the connection has gone away
+	_, err := conn.conn.Write(util.Concat(util.ToLE(packetHeader), body.Bytes()))
+	return err
+}
@@ -0,0 +1,160 @@
+package usbredir
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+	"github.com/bulwarkid/virtual-fido/usb"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// echoDelegate answers every HID report with itself
+type echoDelegate struct {
+	respond func(response []byte)
+}
+
+func (delegate *echoDelegate) HandleMessage(transferBuffer []byte) {
+	delegate.respond(transferBuffer)
+}
+
+func (delegate *echoDelegate) SetResponseHandler(handler func(response []byte)) {
+	delegate.respond = handler
+}
+
+type testGuest struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (guest *testGuest) send(packetType usbredirPacketType, id uint32, header interface{}, data []byte) {
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, header)
+	body.Write(data)
+	packet := util.Concat(util.ToLE(usbredirHeader{Type: packetType, Length: uint32(body.Len()), ID: id}), body.Bytes())
+	_, err := guest.conn.Write(packet)
+	test.Assert(guest.t, err == nil, "Could not send packet")
+}
+
+func (guest *testGuest) receive(packetType usbredirPacketType) (usbredirHeader, []byte) {
+	guest.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header usbredirHeader
+	err := binary.Read(guest.conn, binary.LittleEndian, &header)
+	test.Assert(guest.t, err == nil, "Could not read packet header")
+	body := make([]byte, header.Length)
+	_, err = io.ReadFull(guest.conn, body)
+	test.Assert(guest.t, err == nil, "Could not read packet body")
+	test.AssertEqual(guest.t, header.Type, packetType, "Unexpected packet")
+	return header, body
+}
+
+func startTestServer(t *testing.T) (*USBRedirServer, *testGuest) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Assert(t, err == nil, "Could not listen")
+	server := NewUSBRedirServer(usb.NewUSBDevice(&echoDelegate{}))
+	server.SetListener(listener)
+	go server.Start()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	test.Assert(t, err == nil, "Could not connect")
+	return server, &testGuest{t: t, conn: conn}
+}
+
+func TestUSBRedirConnect(t *testing.T) {
+	server, guest := startTestServer(t)
+	defer server.Stop()
+	defer guest.conn.Close()
+
+	_, body := guest.receive(usbredirHello)
+	var hello usbredirHelloHeader
+	test.Assert(t, readPacketHeader(body, &hello) == nil, "Could not read hello")
+	test.AssertEqual(t, hello.Capabilities, usbredirCapabilities, "Wrong capabilities")
+	guest.send(usbredirHello, 0, usbredirHelloHeader{Capabilities: usbredirCapabilities}, nil)
+
+	_, body = guest.receive(usbredirInterfaceInfo)
+	var interfaceInfo usbredirInterfaceInfoHeader
+	test.Assert(t, readPacketHeader(body, &interfaceInfo) == nil, "Could not read interface info")
+	test.AssertEqual(t, interfaceInfo.InterfaceCount, uint32(1), "FIDO device has one interface")
+	test.AssertEqual(t, interfaceInfo.InterfaceClass[0], uint8(3), "Interface should be HID")
+
+	_, body = guest.receive(usbredirEPInfo)
+	var endpointInfo usbredirEPInfoHeader
+	test.Assert(t, readPacketHeader(body, &endpointInfo) == nil, "Could not read endpoint info")
+	test.AssertEqual(t, endpointInfo.Type[usbredirEndpointIndex(0x00)], usbredirTypeControl, "Endpoint 0 is the control endpoint")
+	test.AssertEqual(t, endpointInfo.Type[usbredirEndpointIndex(0x81)], usbredirTypeInterrupt, "Endpoint 1 is interrupt IN")
+	test.AssertEqual(t, endpointInfo.Type[usbredirEndpointIndex(0x02)], usbredirTypeInterrupt, "Endpoint 2 is interrupt OUT")
+	test.AssertEqual(t, endpointInfo.MaxPacketSize[usbredirEndpointIndex(0x81)], uint16(64), "Wrong packet size")
+	test.AssertEqual(t, endpointInfo.Type[usbredirEndpointIndex(0x83)], usbredirTypeInvalid, "Endpoint 3 doesn't exist")
+
+	_, body = guest.receive(usbredirDeviceConnect)
+	var connect usbredirDeviceConnectHeader
+	test.Assert(t, readPacketHeader(body, &connect) == nil, "Could not read device connect")
+	test.AssertEqual(t, connect.Speed, usbredirSpeedFull, "Device should be full speed")
+}
+
+func TestUSBRedirTransfers(t *testing.T) {
+	server, guest := startTestServer(t)
+	defer server.Stop()
+	defer guest.conn.Close()
+	guest.receive(usbredirHello)
+	guest.send(usbredirHello, 0, usbredirHelloHeader{}, nil)
+	guest.receive(usbredirInterfaceInfo)
+	_, body := guest.receive(usbredirEPInfo)
+	test.AssertEqual(t, len(body), 3*usbredirEndpointEntries, "Packet sizes are only sent with the capability")
+	_, body = guest.receive(usbredirDeviceConnect)
+	test.AssertEqual(t, len(body), 8, "Device version is only sent with the capability")
+
+	guest.send(usbredirControlPacket, 1, usbredirControlPacketHeader{RequestType: 0x80, Request: usbRequestGetDescriptor, Value: uint16(usbDescriptorDevice) << 8, Length: 18}, nil)
+	header, body := guest.receive(usbredirControlPacket)
+	test.AssertEqual(t, header.ID, uint32(1), "Reply should answer the request")
+	var control usbredirControlPacketHeader
+	test.Assert(t, readPacketHeader(body, &control) == nil, "Could not read control packet")
+	test.AssertEqual(t, control.Status, usbredirStatusSuccess, "GET_DESCRIPTOR should succeed")
+	test.AssertEqual(t, control.Length, uint16(18), "Wrong descriptor length")
+	test.AssertEqual(t, body[util.SizeOf[usbredirControlPacketHeader]()+1], usbDescriptorDevice, "Reply should hold the device descriptor")
+
+	guest.send(usbredirSetConfiguration, 2, uint8(1), nil)
+	header, body = guest.receive(usbredirConfigurationStatus)
+	test.AssertEqual(t, header.ID, uint32(2), "Reply should answer the request")
+	test.AssertArrEqual(t, body, []byte{byte(usbredirStatusSuccess), 1}, "Configuration should be set")
+
+	guest.send(usbredirStartInterruptReceiving, 3, uint8(0x81), nil)
+	_, body = guest.receive(usbredirInterruptReceivingStat)
+	test.AssertArrEqual(t, body, []byte{byte(usbredirStatusSuccess), 0x81}, "Receiving should start")
+
+	report := bytes.Repeat([]byte{0xAB}, 64)
+	guest.send(usbredirInterruptPacket, 4, usbredirInterruptPacketHeader{Endpoint: 0x02, Length: 64}, report)
+	// The device echoes the report before the OUT packet is acknowledged
+	replies := make(map[uint8][]byte)
+	for i := 0; i < 2; i++ {
+		_, body = guest.receive(usbredirInterruptPacket)
+		var interrupt usbredirInterruptPacketHeader
+		test.Assert(t, readPacketHeader(body, &interrupt) == nil, "Could not read interrupt packet")
+		test.AssertEqual(t, interrupt.Length, uint16(64), "Reply should count the data")
+		replies[interrupt.Endpoint] = body[util.SizeOf[usbredirInterruptPacketHeader]():]
+	}
+	test.AssertEqual(t, len(replies[0x02]), 0, "OUT reply has no data")
+	test.AssertArrEqual(t, replies[0x81], report, "Report should be echoed from the IN endpoint")
+
+	guest.send(usbredirStopInterruptReceiving, 5, uint8(0x81), nil)
+	header, _ = guest.receive(usbredirInterruptReceivingStat)
+	test.AssertEqual(t, header.ID, uint32(5), "Receiving should stop")
+}
+
+func TestParseConfigurationSkipsAlternateSettings(t *testing.T) {
+	descriptor := []byte{
+		9, usbDescriptorConfiguration, 0, 0, 1, 1, 0, 0x80, 50,
+		9, usbDescriptorInterface, 0, 0, 1, 3, 0, 0, 0,
+		7, usbDescriptorEndpoint, 0x81, 0x03, 64, 0, 5,
+		9, usbDescriptorInterface, 0, 1, 1, 3, 0, 0, 0,
+		7, usbDescriptorEndpoint, 0x02, 0x02, 0, 2, 0,
+	}
+	interfaceInfo, endpointInfo := parseConfiguration(descriptor)
+	test.AssertEqual(t, interfaceInfo.InterfaceCount, uint32(1), "Alternate settings aren't interfaces")
+	test.AssertEqual(t, endpointInfo.Interval[usbredirEndpointIndex(0x81)], uint8(5), "Wrong interval")
+	test.AssertEqual(t, endpointInfo.Type[usbredirEndpointIndex(0x02)], usbredirTypeBulk, "Wrong endpoint type")
+	test.AssertEqual(t, endpointInfo.MaxPacketSize[usbredirEndpointIndex(0x02)], uint16(512), "Wrong packet size")
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Buffers that grew past this are left for the GC rather than pinned in the pool
+const maxPooledBufferSize = 1 << 16
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// GetBuffer returns an empty buffer from a shared pool. Hand it back with PutBuffer
+// once nothing refers to its contents anymore.
+func GetBuffer() *bytes.Buffer {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+func PutBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buffer)
+}
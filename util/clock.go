@@ -0,0 +1,130 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time for timestamps the authenticator records and the timeouts it enforces.
+// Test suites can install a FakeClock with SetClock, so credential timestamps, attestation
+// certificates and PIN token expiry don't depend on when the test runs.
+type Clock interface {
+	Now() time.Time
+	// NewTimer fires once after d, like time.NewTimer
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	// Stop returns false if the timer already fired or was stopped
+	Stop() bool
+}
+
+var clockLock sync.RWMutex
+var clock Clock = SystemClock{}
+
+// SetClock replaces the clock used by every package, or restores the system clock if nil
+func SetClock(c Clock) {
+	clockLock.Lock()
+	defer clockLock.Unlock()
+	if c == nil {
+		c = SystemClock{}
+	}
+	clock = c
+}
+
+func currentClock() Clock {
+	clockLock.RLock()
+	defer clockLock.RUnlock()
+	return clock
+}
+
+func Now() time.Time {
+	return currentClock().Now()
+}
+
+func NewTimer(d time.Duration) Timer {
+	return currentClock().NewTimer(d)
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// FakeClock only moves when Advance is called, firing the timers that fall due
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, timers: make(map[*fakeTimer]bool)}
+}
+
+func (fake *FakeClock) Now() time.Time {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.now
+}
+
+func (fake *FakeClock) NewTimer(d time.Duration) Timer {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	timer := &fakeTimer{clock: fake, deadline: fake.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- fake.now
+	} else {
+		fake.timers[timer] = true
+	}
+	return timer
+}
+
+// Advance moves the clock forward by d
+func (fake *FakeClock) Advance(d time.Duration) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.now = fake.now.Add(d)
+	for timer := range fake.timers {
+		if !timer.deadline.After(fake.now) {
+			timer.c <- fake.now
+			delete(fake.timers, timer)
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (timer *fakeTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+	pending := timer.clock.timers[timer]
+	delete(timer.clock.timers, timer)
+	return pending
+}
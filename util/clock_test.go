@@ -0,0 +1,46 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	timer := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Minute)
+	test.Assert(t, stopped.Stop(), "Pending timer should stop")
+
+	clock.Advance(30 * time.Second)
+	test.Assert(t, clock.Now().Equal(start.Add(30*time.Second)), "Clock should advance")
+	select {
+	case <-timer.C():
+		t.Fatal("Timer should not fire early")
+	default:
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case fired := <-timer.C():
+		test.Assert(t, fired.Equal(start.Add(time.Minute)), "Timer should fire at the deadline")
+	default:
+		t.Fatal("Timer should fire once due")
+	}
+	select {
+	case <-stopped.C():
+		t.Fatal("Stopped timer should not fire")
+	default:
+	}
+	test.Assert(t, !timer.Stop(), "Fired timer should not stop")
+}
+
+func TestSetClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start))
+	test.Assert(t, Now().Equal(start), "Now should use the installed clock")
+	SetClock(nil)
+	test.Assert(t, Now().After(start), "Nil should restore the system clock")
+}
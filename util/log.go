@@ -2,11 +2,15 @@ package util
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"strings"
+	"sync"
+	"time"
 )
 
-var logLog = NewLogger("[LOG] ", LogLevelEnabled)
+var logLog = NewLogger("[LOG] ", LogSubsystemGeneral, LogLevelEnabled)
 
 type LogLevel byte
 
@@ -17,6 +21,71 @@ const (
 	LogLevelEnabled LogLevel = 3
 )
 
+var logLevelDescriptions = map[LogLevel]string{
+	LogLevelUnsafe:  "unsafe",
+	LogLevelTrace:   "trace",
+	LogLevelDebug:   "debug",
+	LogLevelEnabled: "enabled",
+}
+
+func (level LogLevel) String() string {
+	if s, ok := logLevelDescriptions[level]; ok {
+		return s
+	}
+	return fmt.Sprintf("%d", level)
+}
+
+// ParseLogLevel reads a level written by LogLevel.String
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, description := range logLevelDescriptions {
+		if description == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level: %s", name)
+}
+
+type LogSubsystem string
+
+const (
+	LogSubsystemGeneral   LogSubsystem = "general"
+	LogSubsystemUSB       LogSubsystem = "usb"
+	LogSubsystemUSBIP     LogSubsystem = "usbip"
+	LogSubsystemUSBRedir  LogSubsystem = "usbredir"
+	LogSubsystemHID       LogSubsystem = "hid"
+	LogSubsystemCTAP      LogSubsystem = "ctap"
+	LogSubsystemU2F       LogSubsystem = "u2f"
+	LogSubsystemPIV       LogSubsystem = "piv"
+	LogSubsystemOTP       LogSubsystem = "otp"
+	LogSubsystemDelegate  LogSubsystem = "delegate"
+	LogSubsystemPrivsep   LogSubsystem = "privsep"
+	LogSubsystemSync      LogSubsystem = "sync"
+	LogSubsystemVault     LogSubsystem = "vault"
+	LogSubsystemMac       LogSubsystem = "mac"
+	LogSubsystemAudit     LogSubsystem = "audit"
+	LogSubsystemInspector LogSubsystem = "inspector"
+	LogSubsystemProxy     LogSubsystem = "proxy"
+	LogSubsystemVPCD      LogSubsystem = "vpcd"
+	LogSubsystemCDP       LogSubsystem = "cdp"
+	LogSubsystemHotkey    LogSubsystem = "hotkey"
+)
+
+type LogFormat uint8
+
+const (
+	LogFormatText LogFormat = 0
+	LogFormatJSON LogFormat = 1
+)
+
+// Logger is implemented by every subsystem logger; messages below the
+// configured level for the logger's subsystem are dropped.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+	// WithTrace returns a logger that tags every line with trace, unless it's zero
+	WithTrace(trace TraceID) Logger
+}
+
 // Not sure if there is a standard library way to do this,
 // but I couldn't find any at the moment
 type logBuffer struct {
@@ -47,36 +116,140 @@ func (logBuf *logBuffer) setOutput(output io.Writer) {
 	logBuf.output = output
 }
 
-var enabledLogOutput *logBuffer = newLogBuffer()
-var debugLogOutput *logBuffer = newLogBuffer()
-var traceLogOutput *logBuffer = newLogBuffer()
-var unsafeLogOutput *logBuffer = newLogBuffer()
+type logConfig struct {
+	lock            sync.Mutex
+	output          *logBuffer
+	level           LogLevel
+	subsystemLevels map[LogSubsystem]LogLevel
+	format          LogFormat
+}
+
+var logSettings = &logConfig{
+	output:          newLogBuffer(),
+	level:           LogLevelEnabled,
+	subsystemLevels: make(map[LogSubsystem]LogLevel),
+	format:          LogFormatText,
+}
+
+func (config *logConfig) enabled(subsystem LogSubsystem, level LogLevel) bool {
+	threshold, ok := config.subsystemLevels[subsystem]
+	if !ok {
+		threshold = config.level
+	}
+	return level >= threshold
+}
 
 func SetLogOutput(out io.Writer) {
-	enabledLogOutput.setOutput(out)
+	logSettings.lock.Lock()
+	logSettings.output.setOutput(out)
+	logSettings.lock.Unlock()
 }
 
+// SetLogLevel sets the level for every subsystem without a level of its own
 func SetLogLevel(level LogLevel) {
-	if level <= LogLevelUnsafe {
-		unsafeLogOutput.setOutput(traceLogOutput)
-	}
-	if level <= LogLevelTrace {
-		traceLogOutput.setOutput(debugLogOutput)
-	}
-	if level <= LogLevelDebug {
-		debugLogOutput.setOutput(enabledLogOutput)
+	logSettings.lock.Lock()
+	logSettings.level = level
+	logSettings.lock.Unlock()
+	logLog.Printf("Log Level Set: %s\n", level)
+}
+
+// GetLogLevel returns the level set by SetLogLevel
+func GetLogLevel() LogLevel {
+	logSettings.lock.Lock()
+	defer logSettings.lock.Unlock()
+	return logSettings.level
+}
+
+// GetSubsystemLogLevels returns the subsystems with a level of their own
+func GetSubsystemLogLevels() map[LogSubsystem]LogLevel {
+	logSettings.lock.Lock()
+	defer logSettings.lock.Unlock()
+	levels := make(map[LogSubsystem]LogLevel, len(logSettings.subsystemLevels))
+	for subsystem, level := range logSettings.subsystemLevels {
+		levels[subsystem] = level
 	}
-	logLog.Printf("Log Level Set: %d\n", level)
+	return levels
+}
+
+func SetSubsystemLogLevel(subsystem LogSubsystem, level LogLevel) {
+	logSettings.lock.Lock()
+	logSettings.subsystemLevels[subsystem] = level
+	logSettings.lock.Unlock()
+	logLog.Printf("Log Level Set: %s=%s\n", subsystem, level)
+}
+
+func ClearSubsystemLogLevel(subsystem LogSubsystem) {
+	logSettings.lock.Lock()
+	delete(logSettings.subsystemLevels, subsystem)
+	logSettings.lock.Unlock()
+}
+
+func SetLogFormat(format LogFormat) {
+	logSettings.lock.Lock()
+	logSettings.format = format
+	logSettings.lock.Unlock()
+}
+
+type jsonLogLine struct {
+	Time      string       `json:"time"`
+	Level     string       `json:"level"`
+	Subsystem LogSubsystem `json:"subsystem"`
+	TraceID   TraceID      `json:"trace_id,omitempty"`
+	Message   string       `json:"message"`
+}
+
+type subsystemLogger struct {
+	prefix    string
+	subsystem LogSubsystem
+	level     LogLevel
+	trace     TraceID
+}
+
+func NewLogger(prefix string, subsystem LogSubsystem, level LogLevel) Logger {
+	return &subsystemLogger{prefix: prefix, subsystem: subsystem, level: level}
+}
+
+func (logger *subsystemLogger) WithTrace(trace TraceID) Logger {
+	traced := *logger
+	traced.trace = trace
+	return &traced
+}
+
+func (logger *subsystemLogger) Printf(format string, v ...interface{}) {
+	logger.output(func() string { return fmt.Sprintf(format, v...) })
 }
 
-func NewLogger(prefix string, level LogLevel) *log.Logger {
-	if level == LogLevelEnabled {
-		return log.New(enabledLogOutput, prefix, 0)
-	} else if level == LogLevelDebug {
-		return log.New(debugLogOutput, prefix, 0)
-	} else if level == LogLevelTrace {
-		return log.New(traceLogOutput, prefix, 0)
+func (logger *subsystemLogger) Println(v ...interface{}) {
+	logger.output(func() string { return fmt.Sprintln(v...) })
+}
+
+func (logger *subsystemLogger) output(message func() string) {
+	logSettings.lock.Lock()
+	defer logSettings.lock.Unlock()
+	if !logSettings.enabled(logger.subsystem, logger.level) {
+		return
+	}
+	var line []byte
+	if logSettings.format == LogFormatJSON {
+		entry := jsonLogLine{
+			Time:      time.Now().UTC().Format(time.RFC3339Nano),
+			Level:     logger.level.String(),
+			Subsystem: logger.subsystem,
+			TraceID:   logger.trace,
+			Message:   strings.TrimSpace(message()),
+		}
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
 	} else {
-		return log.New(unsafeLogOutput, prefix, 0)
+		text := logger.prefix
+		if logger.trace != 0 {
+			text += "[trace " + logger.trace.String() + "] "
+		}
+		text += message()
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		line = []byte(text)
 	}
+	logSettings.output.Write(line)
 }
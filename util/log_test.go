@@ -0,0 +1,84 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func resetLogSettings(output *bytes.Buffer) {
+	logSettings = &logConfig{
+		output:          newLogBuffer(),
+		level:           LogLevelEnabled,
+		subsystemLevels: make(map[LogSubsystem]LogLevel),
+		format:          LogFormatText,
+	}
+	SetLogOutput(output)
+}
+
+func TestLogLevels(t *testing.T) {
+	output := new(bytes.Buffer)
+	resetLogSettings(output)
+	debugLogger := NewLogger("[TEST] ", LogSubsystemCTAP, LogLevelDebug)
+	debugLogger.Printf("hidden")
+	test.AssertEqual(t, output.Len(), 0, "Debug message logged at enabled level")
+	SetLogLevel(LogLevelDebug)
+	output.Reset()
+	debugLogger.Printf("shown")
+	test.AssertEqual(t, output.String(), "[TEST] shown\n", "Debug message not logged at debug level")
+}
+
+func TestSubsystemLogLevel(t *testing.T) {
+	output := new(bytes.Buffer)
+	resetLogSettings(output)
+	SetLogLevel(LogLevelTrace)
+	SetSubsystemLogLevel(LogSubsystemHID, LogLevelEnabled)
+	output.Reset()
+	NewLogger("[HID] ", LogSubsystemHID, LogLevelDebug).Printf("hid")
+	NewLogger("[USB] ", LogSubsystemUSB, LogLevelDebug).Printf("usb")
+	test.Assert(t, !strings.Contains(output.String(), "hid"), "Silenced subsystem was logged")
+	test.Assert(t, strings.Contains(output.String(), "usb"), "Other subsystem was not logged")
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogLevelUnsafe, LogLevelTrace, LogLevelDebug, LogLevelEnabled} {
+		parsed, err := ParseLogLevel(level.String())
+		test.Assert(t, err == nil, "Could not parse "+level.String())
+		test.AssertEqual(t, parsed, level, "Parsed level does not match")
+	}
+	_, err := ParseLogLevel("loud")
+	test.Assert(t, err != nil, "Unknown level should be rejected")
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	output := new(bytes.Buffer)
+	resetLogSettings(output)
+	SetLogFormat(LogFormatJSON)
+	NewLogger("[U2F] ", LogSubsystemU2F, LogLevelEnabled).Printf("message %d\n\n", 1)
+	var line jsonLogLine
+	err := json.Unmarshal(output.Bytes(), &line)
+	test.Assert(t, err == nil, "Could not decode JSON log line")
+	test.AssertEqual(t, line.Subsystem, LogSubsystemU2F, "Incorrect subsystem")
+	test.AssertEqual(t, line.Message, "message 1", "Incorrect message")
+	test.AssertEqual(t, line.Level, "enabled", "Incorrect level")
+}
+
+func TestTracedLogger(t *testing.T) {
+	output := new(bytes.Buffer)
+	resetLogSettings(output)
+	logger := NewLogger("[TEST] ", LogSubsystemCTAP, LogLevelEnabled)
+	logger.WithTrace(0x2a).Printf("traced")
+	logger.WithTrace(0).Printf("untraced")
+	test.AssertEqual(t, output.String(), "[TEST] [trace 0000002a] traced\n[TEST] untraced\n", "Trace should prefix the message")
+
+	output.Reset()
+	SetLogFormat(LogFormatJSON)
+	logger.WithTrace(0x2a).Printf("traced")
+	var line jsonLogLine
+	test.Assert(t, json.Unmarshal(output.Bytes(), &line) == nil, "Could not decode JSON log line")
+	test.AssertEqual(t, line.TraceID, TraceID(0x2a), "Trace should be logged")
+	test.Assert(t, strings.Contains(output.String(), `"trace_id":"0000002a"`), "Trace should be logged as hex")
+}
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Requests requests in every Per, in bursts of up to Requests. The zero
+// RateLimit allows everything.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRateLimit reads a limit written as requests/duration, e.g. "10/1m"
+func ParseRateLimit(text string) (RateLimit, error) {
+	requests, per, ok := strings.Cut(text, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("Rate limit %q should look like 10/1m", text)
+	}
+	var limit RateLimit
+	var err error
+	if limit.Requests, err = strconv.Atoi(requests); err != nil || limit.Requests <= 0 {
+		return RateLimit{}, fmt.Errorf("Invalid request count in rate limit %q", text)
+	}
+	if limit.Per, err = time.ParseDuration(per); err != nil || limit.Per <= 0 {
+		return RateLimit{}, fmt.Errorf("Invalid duration in rate limit %q", text)
+	}
+	return limit, nil
+}
+
+func (limit RateLimit) String() string {
+	if limit.Requests == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%s", limit.Requests, limit.Per)
+}
+
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter limits requests by key, e.g. by RP ID, with a token bucket per key. Time
+// comes from the clock set with SetClock. A nil RateLimiter allows everything.
+type RateLimiter struct {
+	limit   RateLimit
+	lock    sync.Mutex
+	buckets map[string]*rateLimitBucket
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	if limit.Requests == 0 {
+		return nil
+	}
+	return &RateLimiter{limit: limit, buckets: make(map[string]*rateLimitBucket)}
+}
+
+// Allow takes a request for key out of its bucket, reporting false if the bucket is empty
+func (limiter *RateLimiter) Allow(key string) bool {
+	if limiter == nil {
+		return true
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := Now()
+	capacity := float64(limiter.limit.Requests)
+	refill := func(bucket *rateLimitBucket) {
+		elapsed := now.Sub(bucket.updated)
+		bucket.tokens += capacity * float64(elapsed) / float64(limiter.limit.Per)
+		if bucket.tokens > capacity {
+			bucket.tokens = capacity
+		}
+		bucket.updated = now
+	}
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		// Full buckets are the same as no bucket, so they're dropped to bound the memory
+		// used by keys seen once
+		for otherKey, other := range limiter.buckets {
+			if refill(other); other.tokens == capacity {
+				delete(limiter.buckets, otherKey)
+			}
+		}
+		bucket = &rateLimitBucket{tokens: capacity, updated: now}
+		limiter.buckets[key] = bucket
+	}
+	refill(bucket)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("10/1m")
+	test.Assert(t, err == nil, "Could not parse rate limit")
+	test.AssertEqual(t, limit, RateLimit{Requests: 10, Per: time.Minute}, "Wrong rate limit")
+	for _, invalid := range []string{"10", "0/1m", "10/0s", "x/1m", "10/x"} {
+		_, err := ParseRateLimit(invalid)
+		test.Assert(t, err != nil, "Rate limit should be invalid: "+invalid)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	SetClock(clock)
+	defer SetClock(nil)
+	limiter := NewRateLimiter(RateLimit{Requests: 2, Per: time.Minute})
+	test.Assert(t, limiter.Allow("a") && limiter.Allow("a"), "A burst up to the limit should be allowed")
+	test.Assert(t, !limiter.Allow("a"), "Requests past the limit should be refused")
+	test.Assert(t, limiter.Allow("b"), "Keys should be limited separately")
+
+	clock.Advance(30 * time.Second)
+	test.Assert(t, limiter.Allow("a"), "Half the period should allow one request")
+	test.Assert(t, !limiter.Allow("a"), "Requests past the limit should be refused")
+	clock.Advance(time.Hour)
+	limiter.Allow("c")
+	test.AssertEqual(t, len(limiter.buckets), 1, "Full buckets should be dropped")
+
+	var unlimited *RateLimiter = NewRateLimiter(RateLimit{})
+	test.Assert(t, unlimited == nil && unlimited.Allow("a"), "The zero limit shouldn't limit")
+}
@@ -2,60 +2,123 @@ package util
 
 import "sync"
 
+// Responses the host hasn't asked for yet. Past this, Respond waits for the host to catch up.
+const maxBufferedResponses = 1024
+
+// bufferedResponse keeps the trace of the request a response answers
+type bufferedResponse struct {
+	data  []byte
+	trace TraceID
+}
+
 type RequestBuffer struct {
 	lock           *sync.Mutex
-	waitingForData map[uint32]func([]byte)
-	responses      [][]byte
+	hasSpace       *sync.Cond
+	waitingForData map[uint32]func([]byte, TraceID)
+	// Waiting request IDs, oldest first, so responses are returned in order
+	waitingOrder []uint32
+	responses    []bufferedResponse
 }
 
 func MakeRequestBuffer() *RequestBuffer {
+	lock := &sync.Mutex{}
 	buffer := RequestBuffer{
-		lock:           &sync.Mutex{},
-		waitingForData: make(map[uint32]func([]byte)),
-		responses:      make([][]byte, 0),
+		lock:           lock,
+		hasSpace:       sync.NewCond(lock),
+		waitingForData: make(map[uint32]func([]byte, TraceID)),
+		waitingOrder:   make([]uint32, 0),
+		responses:      make([]bufferedResponse, 0),
 	}
 	return &buffer
 }
 
 func (buffer *RequestBuffer) Request(id uint32, request func(response []byte)) bool {
+	return buffer.RequestTraced(id, func(response []byte, trace TraceID) { request(response) })
+}
+
+// RequestTraced is Request, also passing the trace the response was sent with
+func (buffer *RequestBuffer) RequestTraced(id uint32, request func(response []byte, trace TraceID)) bool {
 	buffer.lock.Lock()
 	defer buffer.lock.Unlock()
 	if len(buffer.responses) > 0 {
 		response := buffer.responses[0]
 		buffer.responses = buffer.responses[1:]
-		request(response)
+		buffer.hasSpace.Signal()
+		request(response.data, response.trace)
 		return true
 	} else {
+		if _, exists := buffer.waitingForData[id]; !exists {
+			buffer.waitingOrder = append(buffer.waitingOrder, id)
+		}
 		buffer.waitingForData[id] = request
 		return false
 	}
 }
 
+// Poll takes the oldest response the host hasn't asked for yet, without waiting for one
+func (buffer *RequestBuffer) Poll() ([]byte, bool) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if len(buffer.responses) == 0 {
+		return nil, false
+	}
+	response := buffer.responses[0]
+	buffer.responses = buffer.responses[1:]
+	buffer.hasSpace.Signal()
+	return response.data, true
+}
+
 func (buffer *RequestBuffer) CancelRequest(id uint32) bool {
 	buffer.lock.Lock()
 	defer buffer.lock.Unlock()
 	if _, ok := buffer.waitingForData[id]; ok {
 		delete(buffer.waitingForData, id)
+		for i, waiting := range buffer.waitingOrder {
+			if waiting == id {
+				buffer.waitingOrder = append(buffer.waitingOrder[:i], buffer.waitingOrder[i+1:]...)
+				break
+			}
+		}
 		return true
 	} else {
 		return false
 	}
 }
 
+// Reset drops waiting requests without answering them, and responses nobody asked for
+func (buffer *RequestBuffer) Reset() {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	buffer.waitingForData = make(map[uint32]func([]byte, TraceID))
+	buffer.waitingOrder = make([]uint32, 0)
+	buffer.responses = make([]bufferedResponse, 0)
+	buffer.hasSpace.Broadcast()
+}
+
+// Respond hands data to the oldest waiting request, or buffers it until the next
+// request. It blocks while the buffer is full.
 func (buffer *RequestBuffer) Respond(data []byte) {
+	buffer.RespondTraced(data, 0)
+}
+
+// RespondTraced is Respond for a response to the request traced by trace
+func (buffer *RequestBuffer) RespondTraced(data []byte, trace TraceID) {
 	buffer.lock.Lock()
-	if len(buffer.waitingForData) > 0 {
-		// Get first waiting request
-		var id uint32
-		var request func([]byte)
-		for id, request = range buffer.waitingForData {
-			break
+	for {
+		if len(buffer.waitingOrder) > 0 {
+			id := buffer.waitingOrder[0]
+			buffer.waitingOrder = buffer.waitingOrder[1:]
+			request := buffer.waitingForData[id]
+			delete(buffer.waitingForData, id)
+			buffer.lock.Unlock()
+			request(data, trace)
+			return
 		}
-		delete(buffer.waitingForData, id)
-		buffer.lock.Unlock()
-		request(data)
-	} else {
-		buffer.responses = append(buffer.responses, data)
-		buffer.lock.Unlock()
+		if len(buffer.responses) < maxBufferedResponses {
+			buffer.responses = append(buffer.responses, bufferedResponse{data: data, trace: trace})
+			buffer.lock.Unlock()
+			return
+		}
+		buffer.hasSpace.Wait()
 	}
 }
@@ -3,7 +3,7 @@ package util
 import (
 	"testing"
 
-	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/internal/test"
 )
 
 func TestRequestBuffer(t *testing.T) {
@@ -16,7 +16,10 @@ func TestRequestBuffer(t *testing.T) {
 	buffer.Request(1, makeRequest([]byte{1}))
 	buffer.Request(2, makeRequest([]byte{2}))
 	buffer.Request(3, makeRequest([]byte{3}))
+	// Respond is checked before the test ends, so a mismatch can't fail a later test
+	responded := make(chan struct{})
 	go func() {
+		defer close(responded)
 		buffer.Respond([]byte{1})
 		buffer.Respond([]byte{2})
 		buffer.Respond([]byte{3})
@@ -24,7 +27,67 @@ func TestRequestBuffer(t *testing.T) {
 		buffer.Respond([]byte{5})
 		buffer.Respond([]byte{6})
 	}()
-	buffer.Request(3, makeRequest([]byte{4}))
-	buffer.Request(3, makeRequest([]byte{5}))
-	buffer.Request(3, makeRequest([]byte{6}))
-}
\ No newline at end of file
+	// New IDs, since a request with the ID of a waiting one replaces it
+	buffer.Request(4, makeRequest([]byte{4}))
+	buffer.Request(5, makeRequest([]byte{5}))
+	buffer.Request(6, makeRequest([]byte{6}))
+	<-responded
+}
+
+func TestRequestBufferOrder(t *testing.T) {
+	buffer := MakeRequestBuffer()
+	responses := make([]byte, 0)
+	for i := uint32(10); i > 0; i-- {
+		buffer.Request(i, func(response []byte) {
+			responses = append(responses, response[0])
+		})
+	}
+	buffer.CancelRequest(5)
+	for i := byte(0); i < 9; i++ {
+		buffer.Respond([]byte{i})
+	}
+	for i, response := range responses {
+		test.AssertEqual(t, response, byte(i), "Responses should go to the oldest waiting request")
+	}
+	test.AssertEqual(t, len(responses), 9, "Every waiting request should get a response")
+}
+
+func TestRequestBufferPoll(t *testing.T) {
+	buffer := MakeRequestBuffer()
+	_, ok := buffer.Poll()
+	test.Assert(t, !ok, "Empty buffer should have nothing to poll")
+	buffer.Respond([]byte{1})
+	buffer.Respond([]byte{2})
+	response, ok := buffer.Poll()
+	test.Assert(t, ok, "Could not poll response")
+	test.AssertArrEqual(t, response, []byte{1}, "Poll should return the oldest response")
+	buffer.Request(1, func(response []byte) {
+		test.AssertArrEqual(t, response, []byte{2}, "Request should get the response left after polling")
+	})
+}
+
+func TestRequestBufferReset(t *testing.T) {
+	buffer := MakeRequestBuffer()
+	buffer.Respond([]byte{1})
+	buffer.Reset()
+	_, ok := buffer.Poll()
+	test.Assert(t, !ok, "Reset should drop responses")
+	answered := false
+	buffer.Request(1, func(response []byte) { answered = true })
+	buffer.Reset()
+	buffer.Respond([]byte{2})
+	test.Assert(t, !answered, "Reset should drop waiting requests")
+	response, ok := buffer.Poll()
+	test.Assert(t, ok, "Response after reset should be kept")
+	test.AssertArrEqual(t, response, []byte{2}, "Response after reset should be kept")
+}
+
+func TestRequestBufferTrace(t *testing.T) {
+	buffer := MakeRequestBuffer()
+	var traces []TraceID
+	buffer.RequestTraced(1, func(response []byte, trace TraceID) { traces = append(traces, trace) })
+	buffer.RespondTraced([]byte{1}, 7)
+	buffer.RespondTraced([]byte{2}, 8)
+	buffer.RequestTraced(2, func(response []byte, trace TraceID) { traces = append(traces, trace) })
+	test.AssertArrEqual(t, traces, []TraceID{7, 8}, "Responses should keep their trace whether or not they were buffered")
+}
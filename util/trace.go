@@ -0,0 +1,49 @@
+package util
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// TraceID follows a request through the layers, from the URB that carried it through HID
+// reassembly to the CTAP or U2F handler and back, so the log lines and events of requests
+// interleaved on several channels can be told apart. The zero ID means untraced.
+type TraceID uint64
+
+var lastTraceID atomic.Uint64
+
+func NewTraceID() TraceID {
+	return TraceID(lastTraceID.Add(1))
+}
+
+func (trace TraceID) String() string {
+	return fmt.Sprintf("%08x", uint64(trace))
+}
+
+func (trace TraceID) MarshalText() ([]byte, error) {
+	return []byte(trace.String()), nil
+}
+
+func (trace *TraceID) UnmarshalText(text []byte) error {
+	var id uint64
+	if _, err := fmt.Sscanf(string(text), "%x", &id); err != nil {
+		return fmt.Errorf("Invalid trace ID %q: %w", text, err)
+	}
+	*trace = TraceID(id)
+	return nil
+}
+
+type tracedDescription struct {
+	trace       TraceID
+	description fmt.Stringer
+}
+
+func (traced tracedDescription) String() string {
+	return fmt.Sprintf("[trace %s] %s", traced.trace, traced.description)
+}
+
+// Describe tags description with the trace, e.g. so a watchdog's dump of hung handlers can be
+// matched with their log lines
+func (trace TraceID) Describe(description fmt.Stringer) fmt.Stringer {
+	return tracedDescription{trace: trace, description: description}
+}
@@ -67,14 +67,23 @@ func ReadLE[T any](reader io.Reader) T {
 	return value
 }
 
+// sizedBuffer preallocates room for the encoding of val, if it has a fixed size
+func sizedBuffer(val interface{}) *bytes.Buffer {
+	size := binary.Size(val)
+	if size < 0 {
+		size = 0
+	}
+	return bytes.NewBuffer(make([]byte, 0, size))
+}
+
 func ToLE[T any](val T) []byte {
-	buffer := new(bytes.Buffer)
+	buffer := sizedBuffer(val)
 	binary.Write(buffer, binary.LittleEndian, val)
 	return buffer.Bytes()
 }
 
 func ToBE[T any](val T) []byte {
-	buffer := new(bytes.Buffer)
+	buffer := sizedBuffer(val)
 	binary.Write(buffer, binary.BigEndian, val)
 	return buffer.Bytes()
 }
@@ -115,13 +124,19 @@ func Utf16encode(message string) []byte {
 
 func SizeOf[T any]() uint8 {
 	var val T
-	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, &val)
-	return uint8(buffer.Len())
+	size := binary.Size(&val)
+	if size < 0 {
+		return 0
+	}
+	return uint8(size)
 }
 
 func Concat[T any](arrays ...[]T) []T {
-	output := make([]T, 0)
+	length := 0
+	for _, arr := range arrays {
+		length += len(arr)
+	}
+	output := make([]T, 0, length)
 	for _, arr := range arrays {
 		output = append(output, arr...)
 	}
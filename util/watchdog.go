@@ -0,0 +1,94 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var watchdogLogger = NewLogger("[WATCHDOG] ", LogSubsystemGeneral, LogLevelEnabled)
+
+// Watchdog bounds how long request handlers run, e.g. a URB waiting on an approval callback
+// that never returns. A handler that misses the deadline is abandoned: Run returns so the
+// request can be failed, and every handler still running is logged to show what hung. Go
+// can't stop the handler, so it keeps its goroutine until it returns, and the caller must
+// ignore anything it does after that.
+type Watchdog struct {
+	deadline time.Duration
+	lock     sync.Mutex
+	pending  map[*WatchdogTask]bool
+}
+
+// WatchdogTask is a handler that's running
+type WatchdogTask struct {
+	Description fmt.Stringer
+	Started     time.Time
+}
+
+func NewWatchdog(deadline time.Duration) *Watchdog {
+	return &Watchdog{deadline: deadline, pending: make(map[*WatchdogTask]bool)}
+}
+
+// Run runs handler and returns whether it finished within the deadline. description is only
+// formatted when tasks are logged. A nil Watchdog runs handler without a deadline.
+func (watchdog *Watchdog) Run(description fmt.Stringer, handler func()) bool {
+	if watchdog == nil {
+		handler()
+		return true
+	}
+	task := &WatchdogTask{Description: description, Started: time.Now()}
+	watchdog.lock.Lock()
+	watchdog.pending[task] = true
+	watchdog.lock.Unlock()
+	done := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			watchdog.lock.Lock()
+			delete(watchdog.pending, task)
+			watchdog.lock.Unlock()
+			// Panics are raised again in Run's goroutine, unless it already gave up
+			done <- recover()
+		}()
+		handler()
+	}()
+	timer := time.NewTimer(watchdog.deadline)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			panic(err)
+		}
+		return true
+	case <-timer.C:
+		watchdog.logPending(task)
+		go func() {
+			if err := <-done; err != nil {
+				watchdogLogger.Printf("ERROR: Abandoned handler %s panicked: %v\n\n", task.Description, err)
+			}
+		}()
+		return false
+	}
+}
+
+// Pending returns the handlers still running, oldest first
+func (watchdog *Watchdog) Pending() []WatchdogTask {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+	tasks := make([]WatchdogTask, 0, len(watchdog.pending))
+	for task := range watchdog.pending {
+		tasks = append(tasks, *task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Started.Before(tasks[j].Started) })
+	return tasks
+}
+
+func (watchdog *Watchdog) logPending(expired *WatchdogTask) {
+	now := time.Now()
+	var dump strings.Builder
+	for _, task := range watchdog.Pending() {
+		fmt.Fprintf(&dump, "\n  %s: running for %s", task.Description, now.Sub(task.Started).Round(time.Millisecond))
+	}
+	watchdogLogger.Printf("ERROR: %s did not finish within %s, failing it. Handlers still running:%s\n\n", expired.Description, watchdog.deadline, dump.String())
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+type watchdogDescription string
+
+func (description watchdogDescription) String() string {
+	return string(description)
+}
+
+func TestWatchdog(t *testing.T) {
+	var nilWatchdog *Watchdog
+	ran := false
+	test.Assert(t, nilWatchdog.Run(watchdogDescription("nil"), func() { ran = true }) && ran, "Nil watchdog should run the handler")
+
+	watchdog := NewWatchdog(50 * time.Millisecond)
+	test.Assert(t, watchdog.Run(watchdogDescription("quick"), func() {}), "Quick handler should finish")
+	test.AssertEqual(t, len(watchdog.Pending()), 0, "Finished handlers should not be pending")
+
+	release := make(chan struct{})
+	test.Assert(t, !watchdog.Run(watchdogDescription("hung"), func() { <-release }), "Hung handler should be abandoned")
+	pending := watchdog.Pending()
+	test.AssertEqual(t, len(pending), 1, "Abandoned handler should be pending until it returns")
+	test.AssertEqual(t, pending[0].Description.String(), "hung", "Pending handler should be described")
+	close(release)
+	for i := 0; i < 100 && len(watchdog.Pending()) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	test.AssertEqual(t, len(watchdog.Pending()), 0, "Abandoned handler should be removed once it returns")
+}
+
+func TestWatchdogPanic(t *testing.T) {
+	watchdog := NewWatchdog(time.Second)
+	defer func() {
+		test.Assert(t, recover() == "handler panic", "Handler panics should be raised in the caller")
+	}()
+	watchdog.Run(watchdogDescription("panicking"), func() { panic("handler panic") })
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrQueueFull   = errors.New("Queue full")
+	ErrPoolFull    = errors.New("Worker pool full")
+	ErrPoolStopped = errors.New("Worker pool stopped")
+)
+
+// WorkerPool runs tasks on a fixed set of goroutines. Tasks submitted with the same key
+// run one at a time in submission order, and each key's queue is bounded so a flood of
+// work is turned away instead of growing without limit.
+type WorkerPool struct {
+	lock        *sync.Mutex
+	hasWork     *sync.Cond
+	queueLength int
+	// Limit on tasks queued across all keys, or 0 for none
+	totalQueueLength int
+	queued           int
+	queues           map[interface{}][]func()
+	// Keys whose task is still running after handing its worker back, see Hold
+	held map[interface{}]bool
+	// Keys with queued tasks, in the order workers should pick them up
+	ready   []interface{}
+	stopped bool
+}
+
+func NewWorkerPool(workers int, queueLength int) *WorkerPool {
+	lock := &sync.Mutex{}
+	pool := &WorkerPool{
+		lock:        lock,
+		hasWork:     sync.NewCond(lock),
+		queueLength: queueLength,
+		queues:      make(map[interface{}][]func()),
+		held:        make(map[interface{}]bool),
+		ready:       make([]interface{}, 0),
+	}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// SetTotalQueueLength bounds the tasks queued across all keys, so many keys together can't
+// queue without limit either
+func (pool *WorkerPool) SetTotalQueueLength(tasks int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.totalQueueLength = tasks
+}
+
+// Submit queues task behind earlier tasks with the same key. It fails with ErrQueueFull if
+// the key's queue is full, ErrPoolFull if the pool as a whole is, and ErrPoolStopped once
+// the pool has been stopped.
+func (pool *WorkerPool) Submit(key interface{}, task func()) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	queue, scheduled := pool.queues[key]
+	switch {
+	case pool.stopped:
+		return ErrPoolStopped
+	case len(queue) >= pool.queueLength:
+		return ErrQueueFull
+	case pool.totalQueueLength > 0 && pool.queued >= pool.totalQueueLength:
+		return ErrPoolFull
+	}
+	pool.queues[key] = append(queue, task)
+	pool.queued++
+	if !scheduled {
+		pool.ready = append(pool.ready, key)
+		pool.hasWork.Signal()
+	}
+	return nil
+}
+
+// Hold is called by a task for key that continues on its own goroutine, to free its worker
+// while keeping key's later tasks queued until it calls release
+func (pool *WorkerPool) Hold(key interface{}) (release func()) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.held[key] = true
+	return func() {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		delete(pool.held, key)
+		pool.schedule(key)
+	}
+}
+
+// Stop lets running tasks finish and drops everything still queued
+func (pool *WorkerPool) Stop() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.stopped = true
+	pool.hasWork.Broadcast()
+}
+
+// schedule puts key back in line once its last task is done, or forgets it if nothing else
+// is queued for it. It's called with the lock held.
+func (pool *WorkerPool) schedule(key interface{}) {
+	if len(pool.queues[key]) > 0 {
+		// Go to the back of the line so one busy key can't starve the others
+		pool.ready = append(pool.ready, key)
+		pool.hasWork.Signal()
+	} else {
+		delete(pool.queues, key)
+	}
+}
+
+func (pool *WorkerPool) work() {
+	for {
+		pool.lock.Lock()
+		for len(pool.ready) == 0 && !pool.stopped {
+			pool.hasWork.Wait()
+		}
+		if pool.stopped {
+			pool.lock.Unlock()
+			return
+		}
+		key := pool.ready[0]
+		pool.ready = pool.ready[1:]
+		task := pool.queues[key][0]
+		pool.queues[key] = pool.queues[key][1:]
+		pool.queued--
+		pool.lock.Unlock()
+
+		task()
+
+		pool.lock.Lock()
+		// A held key keeps its entry in queues, so Submit doesn't schedule it either
+		if !pool.held[key] {
+			pool.schedule(key)
+		}
+		pool.lock.Unlock()
+	}
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	pool := NewWorkerPool(4, 100)
+	defer pool.Stop()
+	lock := sync.Mutex{}
+	results := map[int][]int{}
+	done := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		key, value := i%3, i
+		done.Add(1)
+		err := pool.Submit(key, func() {
+			lock.Lock()
+			results[key] = append(results[key], value)
+			lock.Unlock()
+			done.Done()
+		})
+		test.Assert(t, err == nil, "Task should be queued")
+	}
+	done.Wait()
+	test.AssertEqual(t, len(results), 3, "Every key should run")
+	for _, values := range results {
+		for i := 1; i < len(values); i++ {
+			test.Assert(t, values[i] > values[i-1], "Tasks for a key should run in order")
+		}
+		test.Assert(t, len(values) > 30, "Every task for the key should run")
+	}
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	pool := NewWorkerPool(1, 2)
+	defer pool.Stop()
+	block := make(chan struct{})
+	started := make(chan struct{})
+	test.Assert(t, pool.Submit("a", func() { close(started); <-block }) == nil, "First task should be queued")
+	<-started
+	test.Assert(t, pool.Submit("a", func() {}) == nil, "Queue should have room")
+	test.Assert(t, pool.Submit("a", func() {}) == nil, "Queue should have room")
+	test.Assert(t, pool.Submit("a", func() {}) == ErrQueueFull, "Full queue should reject tasks")
+	test.Assert(t, pool.Submit("b", func() {}) == nil, "Other keys should have their own queue")
+	close(block)
+}
+
+func TestWorkerPoolTotalQueueLength(t *testing.T) {
+	// Without workers nothing leaves the queues
+	pool := NewWorkerPool(0, 2)
+	defer pool.Stop()
+	pool.SetTotalQueueLength(3)
+	test.Assert(t, pool.Submit("a", func() {}) == nil, "Pool should have room")
+	test.Assert(t, pool.Submit("b", func() {}) == nil, "Pool should have room")
+	test.Assert(t, pool.Submit("c", func() {}) == nil, "Pool should have room")
+	test.Assert(t, pool.Submit("d", func() {}) == ErrPoolFull, "Full pool should reject tasks for new keys")
+	test.Assert(t, pool.Submit("a", func() {}) == ErrPoolFull, "Full pool should reject tasks for queued keys")
+}
+
+func TestWorkerPoolHold(t *testing.T) {
+	pool := NewWorkerPool(1, 4)
+	defer pool.Stop()
+	release := make(chan func())
+	ran := make(chan string, 4)
+	test.Assert(t, pool.Submit("a", func() { release <- pool.Hold("a") }) == nil, "Task should be queued")
+	done := <-release
+	test.Assert(t, pool.Submit("a", func() { ran <- "a" }) == nil, "Task should be queued")
+	test.Assert(t, pool.Submit("b", func() { ran <- "b" }) == nil, "Task should be queued")
+	test.AssertEqual(t, <-ran, "b", "Other keys should run on the freed worker")
+	select {
+	case <-ran:
+		t.Fatalf("Held key should wait for release")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	test.AssertEqual(t, <-ran, "a", "Released key should run")
+}
@@ -0,0 +1,428 @@
+package vault_sync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The XX pattern from the Noise specification (revision 34): both sides learn each other's
+// static key during the handshake. Pairing adds a PSK made from the pairing code.
+const (
+	noiseProtocolXX       = "Noise_XX_25519_AESGCM_SHA256"
+	noiseProtocolXXPSK3   = "Noise_XXpsk3_25519_AESGCM_SHA256"
+	noiseKeyLength        = 32
+	noiseTagLength        = 16
+	noiseMaxMessageLength = 65535
+)
+
+type noiseKeyPair struct {
+	private []byte
+	public  []byte
+}
+
+func newNoiseKeyPair(private []byte) (noiseKeyPair, error) {
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return noiseKeyPair{}, fmt.Errorf("Invalid Curve25519 key: %w", err)
+	}
+	return noiseKeyPair{private: private, public: public}, nil
+}
+
+func generateNoiseKeyPair() noiseKeyPair {
+	keyPair, err := newNoiseKeyPair(crypto.RandomBytes(noiseKeyLength))
+	if err != nil {
+		// Only fails for keys that clamp to a low order point, which a random key won't
+		panic(err)
+	}
+	return keyPair
+}
+
+func noiseDH(keyPair noiseKeyPair, public []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(keyPair.private, public)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Curve25519 public key: %w", err)
+	}
+	return shared, nil
+}
+
+// noiseHKDF returns two or three outputs, as in section 4.3 of the specification
+func noiseHKDF(chainingKey []byte, inputKeyMaterial []byte, outputs int) [][]byte {
+	tempKey := crypto.HMACSHA256(chainingKey, inputKeyMaterial)
+	output1 := crypto.HMACSHA256(tempKey, []byte{1})
+	output2 := crypto.HMACSHA256(tempKey, append(append([]byte{}, output1...), 2))
+	if outputs == 2 {
+		return [][]byte{output1, output2}
+	}
+	output3 := crypto.HMACSHA256(tempKey, append(append([]byte{}, output2...), 3))
+	return [][]byte{output1, output2, output3}
+}
+
+type noiseCipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func (state *noiseCipherState) initializeKey(key []byte) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	state.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	state.nonce = 0
+}
+
+func (state *noiseCipherState) nonceBytes() []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], state.nonce)
+	return nonce
+}
+
+func (state *noiseCipherState) encrypt(associatedData []byte, plaintext []byte) []byte {
+	if state.aead == nil {
+		return plaintext
+	}
+	ciphertext := state.aead.Seal(nil, state.nonceBytes(), plaintext, associatedData)
+	state.nonce++
+	return ciphertext
+}
+
+func (state *noiseCipherState) decrypt(associatedData []byte, ciphertext []byte) ([]byte, error) {
+	if state.aead == nil {
+		return ciphertext, nil
+	}
+	plaintext, err := state.aead.Open(nil, state.nonceBytes(), ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt message: %w", err)
+	}
+	state.nonce++
+	return plaintext, nil
+}
+
+type noiseSymmetricState struct {
+	cipherState noiseCipherState
+	chainingKey []byte
+	hash        []byte
+}
+
+func newNoiseSymmetricState(protocolName string) *noiseSymmetricState {
+	state := &noiseSymmetricState{}
+	if len(protocolName) <= sha256.Size {
+		state.hash = make([]byte, sha256.Size)
+		copy(state.hash, protocolName)
+	} else {
+		state.hash = crypto.HashSHA256([]byte(protocolName))
+	}
+	state.chainingKey = state.hash
+	return state
+}
+
+func (state *noiseSymmetricState) mixKey(inputKeyMaterial []byte) {
+	outputs := noiseHKDF(state.chainingKey, inputKeyMaterial, 2)
+	state.chainingKey = outputs[0]
+	state.cipherState.initializeKey(outputs[1])
+}
+
+func (state *noiseSymmetricState) mixHash(data []byte) {
+	state.hash = crypto.HashSHA256(append(append([]byte{}, state.hash...), data...))
+}
+
+func (state *noiseSymmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
+	outputs := noiseHKDF(state.chainingKey, inputKeyMaterial, 3)
+	state.chainingKey = outputs[0]
+	state.mixHash(outputs[1])
+	state.cipherState.initializeKey(outputs[2])
+}
+
+func (state *noiseSymmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := state.cipherState.encrypt(state.hash, plaintext)
+	state.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (state *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := state.cipherState.decrypt(state.hash, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	state.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the initiator's sending and receiving cipher states
+func (state *noiseSymmetricState) split() (*noiseCipherState, *noiseCipherState) {
+	outputs := noiseHKDF(state.chainingKey, nil, 2)
+	initiatorToResponder := &noiseCipherState{}
+	initiatorToResponder.initializeKey(outputs[0])
+	responderToInitiator := &noiseCipherState{}
+	responderToInitiator.initializeKey(outputs[1])
+	return initiatorToResponder, responderToInitiator
+}
+
+// noiseHandshake runs one side of an XX handshake over rw. Handshake messages are sent with a
+// two byte length prefix, like transport messages.
+type noiseHandshake struct {
+	rw              io.ReadWriter
+	symmetric       *noiseSymmetricState
+	static          noiseKeyPair
+	ephemeral       noiseKeyPair
+	remoteEphemeral []byte
+	remoteStatic    []byte
+	psk             []byte
+}
+
+func newNoiseHandshake(rw io.ReadWriter, static noiseKeyPair, prologue []byte, psk []byte) *noiseHandshake {
+	protocolName := noiseProtocolXX
+	if psk != nil {
+		protocolName = noiseProtocolXXPSK3
+	}
+	handshake := &noiseHandshake{
+		rw:        rw,
+		symmetric: newNoiseSymmetricState(protocolName),
+		static:    static,
+		psk:       psk,
+	}
+	handshake.symmetric.mixHash(prologue)
+	return handshake
+}
+
+func (handshake *noiseHandshake) writeEphemeral() []byte {
+	handshake.ephemeral = generateNoiseKeyPair()
+	handshake.symmetric.mixHash(handshake.ephemeral.public)
+	if handshake.psk != nil {
+		handshake.symmetric.mixKey(handshake.ephemeral.public)
+	}
+	return handshake.ephemeral.public
+}
+
+func (handshake *noiseHandshake) readEphemeral(message []byte) ([]byte, error) {
+	if len(message) < noiseKeyLength {
+		return nil, fmt.Errorf("Handshake message too short")
+	}
+	handshake.remoteEphemeral = message[:noiseKeyLength]
+	handshake.symmetric.mixHash(handshake.remoteEphemeral)
+	if handshake.psk != nil {
+		handshake.symmetric.mixKey(handshake.remoteEphemeral)
+	}
+	return message[noiseKeyLength:], nil
+}
+
+func (handshake *noiseHandshake) readStatic(message []byte) ([]byte, error) {
+	length := noiseKeyLength
+	if handshake.symmetric.cipherState.aead != nil {
+		length += noiseTagLength
+	}
+	if len(message) < length {
+		return nil, fmt.Errorf("Handshake message too short")
+	}
+	remoteStatic, err := handshake.symmetric.decryptAndHash(message[:length])
+	if err != nil {
+		return nil, err
+	}
+	handshake.remoteStatic = remoteStatic
+	return message[length:], nil
+}
+
+func (handshake *noiseHandshake) mixDH(keyPair noiseKeyPair, public []byte) error {
+	shared, err := noiseDH(keyPair, public)
+	if err != nil {
+		return err
+	}
+	handshake.symmetric.mixKey(shared)
+	return nil
+}
+
+func (handshake *noiseHandshake) send(message []byte) error {
+	if len(message) > noiseMaxMessageLength {
+		return fmt.Errorf("Handshake message too long")
+	}
+	frame := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(frame, uint16(len(message)))
+	_, err := handshake.rw.Write(append(frame, message...))
+	return err
+}
+
+func (handshake *noiseHandshake) receive() ([]byte, error) {
+	return readNoiseFrame(handshake.rw)
+}
+
+func readNoiseFrame(reader io.Reader) ([]byte, error) {
+	var length uint16
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, length)
+	_, err = io.ReadFull(reader, message)
+	return message, err
+}
+
+// initiate runs -> e; <- e, ee, s, es; -> s, se (, psk)
+func (handshake *noiseHandshake) initiate() (*noiseTransport, error) {
+	message := handshake.writeEphemeral()
+	message = append(message, handshake.symmetric.encryptAndHash(nil)...)
+	if err := handshake.send(message); err != nil {
+		return nil, err
+	}
+
+	message, err := handshake.receive()
+	if err != nil {
+		return nil, err
+	}
+	if message, err = handshake.readEphemeral(message); err != nil {
+		return nil, err
+	}
+	if err = handshake.mixDH(handshake.ephemeral, handshake.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if message, err = handshake.readStatic(message); err != nil {
+		return nil, err
+	}
+	if err = handshake.mixDH(handshake.ephemeral, handshake.remoteStatic); err != nil {
+		return nil, err
+	}
+	if _, err = handshake.symmetric.decryptAndHash(message); err != nil {
+		return nil, err
+	}
+
+	message = handshake.symmetric.encryptAndHash(handshake.static.public)
+	if err = handshake.mixDH(handshake.static, handshake.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if handshake.psk != nil {
+		handshake.symmetric.mixKeyAndHash(handshake.psk)
+	}
+	message = append(message, handshake.symmetric.encryptAndHash(nil)...)
+	if err = handshake.send(message); err != nil {
+		return nil, err
+	}
+	send, receive := handshake.symmetric.split()
+	return &noiseTransport{rw: handshake.rw, send: send, receive: receive, remoteStatic: handshake.remoteStatic}, nil
+}
+
+// respond is the other side of initiate
+func (handshake *noiseHandshake) respond() (*noiseTransport, error) {
+	message, err := handshake.receive()
+	if err != nil {
+		return nil, err
+	}
+	if message, err = handshake.readEphemeral(message); err != nil {
+		return nil, err
+	}
+	if _, err = handshake.symmetric.decryptAndHash(message); err != nil {
+		return nil, err
+	}
+
+	message = handshake.writeEphemeral()
+	if err = handshake.mixDH(handshake.ephemeral, handshake.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	message = append(message, handshake.symmetric.encryptAndHash(handshake.static.public)...)
+	if err = handshake.mixDH(handshake.static, handshake.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	message = append(message, handshake.symmetric.encryptAndHash(nil)...)
+	if err = handshake.send(message); err != nil {
+		return nil, err
+	}
+
+	message, err = handshake.receive()
+	if err != nil {
+		return nil, err
+	}
+	if message, err = handshake.readStatic(message); err != nil {
+		return nil, err
+	}
+	if err = handshake.mixDH(handshake.ephemeral, handshake.remoteStatic); err != nil {
+		return nil, err
+	}
+	if handshake.psk != nil {
+		handshake.symmetric.mixKeyAndHash(handshake.psk)
+	}
+	if _, err = handshake.symmetric.decryptAndHash(message); err != nil {
+		return nil, err
+	}
+	initiatorToResponder, responderToInitiator := handshake.symmetric.split()
+	return &noiseTransport{rw: handshake.rw, send: responderToInitiator, receive: initiatorToResponder, remoteStatic: handshake.remoteStatic}, nil
+}
+
+// noiseTransport carries messages of any length after the handshake, split into Noise
+// transport messages
+type noiseTransport struct {
+	rw           io.ReadWriter
+	send         *noiseCipherState
+	receive      *noiseCipherState
+	remoteStatic []byte
+}
+
+const noiseMaxChunkLength = noiseMaxMessageLength - noiseTagLength
+
+// Bounds what a peer can make us buffer
+const maxSyncMessageLength = 64 << 20
+
+func (transport *noiseTransport) writeMessage(data []byte) error {
+	if len(data) > maxSyncMessageLength {
+		return fmt.Errorf("Sync message too long: %d", len(data))
+	}
+	plaintext := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(plaintext, uint32(len(data)))
+	plaintext = append(plaintext, data...)
+	for len(plaintext) > 0 {
+		chunk := plaintext
+		if len(chunk) > noiseMaxChunkLength {
+			chunk = chunk[:noiseMaxChunkLength]
+		}
+		plaintext = plaintext[len(chunk):]
+		ciphertext := transport.send.encrypt(nil, chunk)
+		frame := make([]byte, 2, 2+len(ciphertext))
+		binary.BigEndian.PutUint16(frame, uint16(len(ciphertext)))
+		if _, err := transport.rw.Write(append(frame, ciphertext...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (transport *noiseTransport) readChunk() ([]byte, error) {
+	ciphertext, err := readNoiseFrame(transport.rw)
+	if err != nil {
+		return nil, err
+	}
+	return transport.receive.decrypt(nil, ciphertext)
+}
+
+func (transport *noiseTransport) readMessage() ([]byte, error) {
+	chunk, err := transport.readChunk()
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) < 4 {
+		return nil, fmt.Errorf("Sync message too short")
+	}
+	length := binary.BigEndian.Uint32(chunk)
+	if length > maxSyncMessageLength {
+		return nil, fmt.Errorf("Sync message too long: %d", length)
+	}
+	data := make([]byte, 0, length)
+	data = append(data, chunk[4:]...)
+	for uint32(len(data)) < length {
+		chunk, err = transport.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	if uint32(len(data)) != length {
+		return nil, fmt.Errorf("Sync message longer than its header")
+	}
+	return data, nil
+}
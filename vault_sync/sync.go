@@ -0,0 +1,284 @@
+package vault_sync
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var syncLogger = util.NewLogger("[SYNC] ", util.LogSubsystemSync, util.LogLevelDebug)
+
+const (
+	syncMagic   = "VFSY"
+	syncVersion = 1
+	// How long a whole pairing or sync may take
+	syncTimeout = 30 * time.Second
+	// How long a pairing code shown by StartPairing can be used
+	PairingCodeLifetime = 5 * time.Minute
+)
+
+type syncMode uint8
+
+const (
+	syncModeSync syncMode = 1
+	syncModePair syncMode = 2
+)
+
+// Client is the vault being synced, usually a fido_client.DefaultFIDOClient
+type Client interface {
+	SyncPrivateKey() []byte
+	SyncPeers() []identities.SyncPeer
+	AddSyncPeer(peer identities.SyncPeer)
+	SyncSnapshot() identities.SyncSnapshot
+	ApplySyncSnapshot(peerPublicKey []byte, remote identities.SyncSnapshot) error
+}
+
+type syncHello struct {
+	Name string `json:"name"`
+}
+
+// Syncer mirrors credentials between two paired instances, e.g. a laptop and a home server.
+// Connections are encrypted and mutually authenticated with the Noise XX handshake, using a
+// static key kept in each vault. Pairing is done once with a code shown by the listening
+// instance, after which each side only syncs with the public keys it has paired with.
+type Syncer struct {
+	client Client
+	name   string
+	// One sync at a time, since each one rewrites the vault
+	lock              sync.Mutex
+	pairingCode       string
+	pairingCodeExpiry time.Time
+}
+
+// NewSyncer syncs client, introducing it to new peers as name
+func NewSyncer(client Client, name string) *Syncer {
+	return &Syncer{client: client, name: name}
+}
+
+func (syncer *Syncer) keyPair() (noiseKeyPair, error) {
+	return newNoiseKeyPair(syncer.client.SyncPrivateKey())
+}
+
+// PublicKey identifies this instance to its peers
+func (syncer *Syncer) PublicKey() ([]byte, error) {
+	keyPair, err := syncer.keyPair()
+	if err != nil {
+		return nil, err
+	}
+	return keyPair.public, nil
+}
+
+func normalizePairingCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func pairingPSK(code string) []byte {
+	return crypto.HashSHA256([]byte("virtual-fido pairing " + normalizePairingCode(code)))
+}
+
+// StartPairing returns a code to enter on the other instance with Pair. It can be used once,
+// for PairingCodeLifetime, by a connection accepted by Serve.
+func (syncer *Syncer) StartPairing() string {
+	encoded := base32.StdEncoding.EncodeToString(crypto.RandomBytes(10))
+	code := fmt.Sprintf("%s-%s-%s-%s", encoded[0:4], encoded[4:8], encoded[8:12], encoded[12:16])
+	syncer.lock.Lock()
+	defer syncer.lock.Unlock()
+	syncer.pairingCode = code
+	syncer.pairingCodeExpiry = time.Now().Add(PairingCodeLifetime)
+	return code
+}
+
+// Serve answers pairing and sync requests from peers until listener is closed
+func (syncer *Syncer) Serve(listener net.Listener) error {
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer connection.Close()
+			err := syncer.respond(connection)
+			if err != nil {
+				syncLogger.Printf("ERROR: Sync with %s failed: %s\n\n", connection.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Pair connects to an instance showing code, trusts it, and syncs with it
+func (syncer *Syncer) Pair(network string, address string, code string) error {
+	return syncer.initiate(network, address, syncModePair, pairingPSK(code))
+}
+
+// Sync connects to a paired instance and merges the credentials of both
+func (syncer *Syncer) Sync(network string, address string) error {
+	return syncer.initiate(network, address, syncModeSync, nil)
+}
+
+func syncPrologue(mode syncMode) []byte {
+	return append([]byte(syncMagic), syncVersion, byte(mode))
+}
+
+func (syncer *Syncer) initiate(network string, address string, mode syncMode, psk []byte) error {
+	keyPair, err := syncer.keyPair()
+	if err != nil {
+		return err
+	}
+	connection, err := net.DialTimeout(network, address, syncTimeout)
+	if err != nil {
+		return fmt.Errorf("Could not connect to %s: %w", address, err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(syncTimeout))
+	prologue := syncPrologue(mode)
+	if _, err = connection.Write(prologue); err != nil {
+		return err
+	}
+	transport, err := newNoiseHandshake(connection, keyPair, prologue, psk).initiate()
+	if err != nil {
+		return fmt.Errorf("Handshake failed: %w", err)
+	}
+	syncer.lock.Lock()
+	defer syncer.lock.Unlock()
+	if mode == syncModePair {
+		if err = syncer.pair(transport, true); err != nil {
+			return err
+		}
+	} else if syncer.peer(transport.remoteStatic) == nil {
+		return fmt.Errorf("%s is not a paired instance", address)
+	}
+	return syncer.exchangeSnapshots(transport, true)
+}
+
+func (syncer *Syncer) respond(connection net.Conn) error {
+	connection.SetDeadline(time.Now().Add(syncTimeout))
+	prologue := make([]byte, len(syncMagic)+2)
+	if _, err := io.ReadFull(connection, prologue); err != nil {
+		return err
+	}
+	if string(prologue[:len(syncMagic)]) != syncMagic || prologue[len(syncMagic)] != syncVersion {
+		return fmt.Errorf("Not a virtual-fido sync request")
+	}
+	mode := syncMode(prologue[len(syncMagic)+1])
+	var psk []byte
+	var code string
+	switch mode {
+	case syncModeSync:
+	case syncModePair:
+		syncer.lock.Lock()
+		code = syncer.pairingCode
+		expiry := syncer.pairingCodeExpiry
+		syncer.lock.Unlock()
+		if code == "" || time.Now().After(expiry) {
+			return fmt.Errorf("Pairing was not started")
+		}
+		psk = pairingPSK(code)
+	default:
+		return fmt.Errorf("Unknown sync mode %d", mode)
+	}
+	keyPair, err := syncer.keyPair()
+	if err != nil {
+		return err
+	}
+	transport, err := newNoiseHandshake(connection, keyPair, prologue, psk).respond()
+	if err != nil {
+		return fmt.Errorf("Handshake failed: %w", err)
+	}
+	syncer.lock.Lock()
+	defer syncer.lock.Unlock()
+	if mode == syncModePair {
+		// Another connection may have used the code first
+		if syncer.pairingCode != code {
+			return fmt.Errorf("Pairing code was already used")
+		}
+		syncer.pairingCode = ""
+		if err = syncer.pair(transport, false); err != nil {
+			return err
+		}
+	} else if syncer.peer(transport.remoteStatic) == nil {
+		return fmt.Errorf("Peer is not paired")
+	}
+	return syncer.exchangeSnapshots(transport, false)
+}
+
+func (syncer *Syncer) peer(publicKey []byte) *identities.SyncPeer {
+	for _, peer := range syncer.client.SyncPeers() {
+		if bytes.Equal(peer.PublicKey, publicKey) {
+			return &peer
+		}
+	}
+	return nil
+}
+
+// exchange sends ours and handles theirs. The responder handles theirs before answering, so
+// the initiator knows both sides are done when it returns.
+func exchange(transport *noiseTransport, ours []byte, initiator bool, handle func(theirs []byte) error) error {
+	if initiator {
+		if err := transport.writeMessage(ours); err != nil {
+			return err
+		}
+		theirs, err := transport.readMessage()
+		if err != nil {
+			return err
+		}
+		return handle(theirs)
+	}
+	theirs, err := transport.readMessage()
+	if err != nil {
+		return err
+	}
+	if err = handle(theirs); err != nil {
+		return err
+	}
+	return transport.writeMessage(ours)
+}
+
+func (syncer *Syncer) pair(transport *noiseTransport, initiator bool) error {
+	ours, err := json.Marshal(syncHello{Name: syncer.name})
+	if err != nil {
+		return err
+	}
+	return exchange(transport, ours, initiator, func(theirs []byte) error {
+		hello := syncHello{}
+		if err := json.Unmarshal(theirs, &hello); err != nil {
+			return fmt.Errorf("Invalid pairing message: %w", err)
+		}
+		syncer.client.AddSyncPeer(identities.SyncPeer{
+			Name:      hello.Name,
+			PublicKey: transport.remoteStatic,
+			PairedAt:  util.Now().UTC(),
+		})
+		syncLogger.Printf("Paired with %s\n\n", hello.Name)
+		return nil
+	})
+}
+
+func (syncer *Syncer) exchangeSnapshots(transport *noiseTransport, initiator bool) error {
+	ours, err := json.Marshal(syncer.client.SyncSnapshot())
+	if err != nil {
+		return err
+	}
+	return exchange(transport, ours, initiator, func(theirs []byte) error {
+		snapshot := identities.SyncSnapshot{}
+		if err := json.Unmarshal(theirs, &snapshot); err != nil {
+			return fmt.Errorf("Invalid sync message: %w", err)
+		}
+		if err := syncer.client.ApplySyncSnapshot(transport.remoteStatic, snapshot); err != nil {
+			return fmt.Errorf("Could not merge credentials: %w", err)
+		}
+		syncLogger.Printf("Synced %d credentials from %s\n\n", len(snapshot.Sources), syncer.peer(transport.remoteStatic).Name)
+		return nil
+	})
+}
@@ -0,0 +1,147 @@
+package vault_sync
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+type memoryClient struct {
+	privateKey []byte
+	peers      []identities.SyncPeer
+	snapshot   identities.SyncSnapshot
+}
+
+func newMemoryClient(credentialIDs ...string) *memoryClient {
+	client := &memoryClient{privateKey: crypto.RandomBytes(32)}
+	for _, id := range credentialIDs {
+		client.snapshot.Sources = append(client.snapshot.Sources, identities.SavedCredentialSource{ID: []byte(id)})
+	}
+	return client
+}
+
+func (client *memoryClient) SyncPrivateKey() []byte {
+	return client.privateKey
+}
+
+func (client *memoryClient) SyncPeers() []identities.SyncPeer {
+	return client.peers
+}
+
+func (client *memoryClient) AddSyncPeer(peer identities.SyncPeer) {
+	client.peers = append(client.peers, peer)
+}
+
+func (client *memoryClient) SyncSnapshot() identities.SyncSnapshot {
+	return client.snapshot
+}
+
+func (client *memoryClient) ApplySyncSnapshot(peerPublicKey []byte, remote identities.SyncSnapshot) error {
+	client.snapshot = identities.MergeSyncSnapshots(client.snapshot, remote)
+	return nil
+}
+
+func (client *memoryClient) hasCredential(id string) bool {
+	for _, source := range client.snapshot.Sources {
+		if bytes.Equal(source.ID, []byte(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+func startSyncServer(t *testing.T, syncer *Syncer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Assert(t, err == nil, "Could not listen")
+	t.Cleanup(func() { listener.Close() })
+	go syncer.Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestPairAndSync(t *testing.T) {
+	serverClient := newMemoryClient("server")
+	server := NewSyncer(serverClient, "server")
+	address := startSyncServer(t, server)
+	laptopClient := newMemoryClient("laptop")
+	laptop := NewSyncer(laptopClient, "laptop")
+
+	code := server.StartPairing()
+	err := laptop.Pair("tcp", address, code)
+	test.Assert(t, err == nil, "Could not pair")
+	test.Assert(t, len(laptopClient.peers) == 1 && laptopClient.peers[0].Name == "server", "Laptop should trust the server")
+	test.Assert(t, laptopClient.hasCredential("server"), "Pairing should sync credentials to the laptop")
+	test.Assert(t, serverClient.hasCredential("laptop"), "Pairing should sync credentials to the server")
+
+	laptopClient.snapshot.Sources = append(laptopClient.snapshot.Sources, identities.SavedCredentialSource{ID: []byte("new")})
+	err = laptop.Sync("tcp", address)
+	test.Assert(t, err == nil, "Could not sync")
+	test.Assert(t, serverClient.hasCredential("new"), "New credentials should be synced")
+	test.AssertEqual(t, len(serverClient.peers), 1, "Server should trust the laptop once")
+
+	err = laptop.Pair("tcp", address, code)
+	test.Assert(t, err != nil, "A pairing code should only be used once")
+}
+
+func TestWrongPairingCode(t *testing.T) {
+	serverClient := newMemoryClient("server")
+	server := NewSyncer(serverClient, "server")
+	address := startSyncServer(t, server)
+	laptopClient := newMemoryClient("laptop")
+	laptop := NewSyncer(laptopClient, "laptop")
+
+	server.StartPairing()
+	err := laptop.Pair("tcp", address, "AAAA-AAAA-AAAA-AAAA")
+	test.Assert(t, err != nil, "Pairing with the wrong code should fail")
+	test.AssertEqual(t, len(laptopClient.peers), 0, "Laptop should not trust the server")
+	test.AssertEqual(t, len(serverClient.peers), 0, "Server should not trust the laptop")
+	test.Assert(t, !serverClient.hasCredential("laptop"), "Nothing should be synced")
+}
+
+func TestUnpairedSyncRefused(t *testing.T) {
+	serverClient := newMemoryClient("server")
+	server := NewSyncer(serverClient, "server")
+	address := startSyncServer(t, server)
+	laptopClient := newMemoryClient("laptop")
+	laptop := NewSyncer(laptopClient, "laptop")
+	serverKey, _ := server.PublicKey()
+	// The laptop trusts the server, but the server never paired with the laptop
+	laptopClient.AddSyncPeer(identities.SyncPeer{Name: "server", PublicKey: serverKey})
+
+	err := laptop.Sync("tcp", address)
+	test.Assert(t, err != nil, "Unpaired instances should not sync")
+	test.Assert(t, !serverClient.hasCredential("laptop"), "Nothing should be synced")
+	test.Assert(t, !laptopClient.hasCredential("server"), "Nothing should be synced")
+}
+
+func TestNoiseTransportLargeMessage(t *testing.T) {
+	initiatorConnection, responderConnection := net.Pipe()
+	defer initiatorConnection.Close()
+	defer responderConnection.Close()
+	initiatorKey, responderKey := generateNoiseKeyPair(), generateNoiseKeyPair()
+	prologue := syncPrologue(syncModeSync)
+
+	responderResult := make(chan *noiseTransport)
+	go func() {
+		transport, err := newNoiseHandshake(responderConnection, responderKey, prologue, nil).respond()
+		if err != nil {
+			t.Errorf("Responder handshake failed: %s", err)
+		}
+		responderResult <- transport
+	}()
+	initiator, err := newNoiseHandshake(initiatorConnection, initiatorKey, prologue, nil).initiate()
+	test.Assert(t, err == nil, "Initiator handshake failed")
+	responder := <-responderResult
+	test.Assert(t, responder != nil, "Responder handshake failed")
+	test.AssertArrEqual(t, initiator.remoteStatic, responderKey.public, "Initiator should learn the responder's key")
+	test.AssertArrEqual(t, responder.remoteStatic, initiatorKey.public, "Responder should learn the initiator's key")
+
+	message := crypto.RandomBytes(3*noiseMaxChunkLength + 100)
+	go initiator.writeMessage(message)
+	received, err := responder.readMessage()
+	test.Assert(t, err == nil, "Could not read message")
+	test.AssertArrEqual(t, received, message, "Message should be split into chunks and joined")
+}
@@ -1,27 +1,363 @@
 package virtual_fido
 
 import (
+	"fmt"
 	"io"
+	"net"
+	"sync"
+	"time"
 
+	"github.com/bulwarkid/virtual-fido/audit"
 	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
+	"github.com/bulwarkid/virtual-fido/events"
+	"github.com/bulwarkid/virtual-fido/fault_injection"
+	"github.com/bulwarkid/virtual-fido/hidproxy"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/otp"
+	"github.com/bulwarkid/virtual-fido/piv"
+	"github.com/bulwarkid/virtual-fido/privsep"
+	"github.com/bulwarkid/virtual-fido/stats"
 	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/usb"
 	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/vpcd"
 )
 
-type FIDOClient interface {
+// Client stores the credentials of the authenticator and approves requests.
+// fido_client.DefaultFIDOClient is a complete implementation.
+type Client interface {
 	u2f.U2FClient
 	ctap.CTAPClient
 }
 
-func Start(client FIDOClient) {
+// Deprecated: Use Client.
+type FIDOClient = Client
+
+// Vault is implemented by clients, like fido_client.DefaultFIDOClient, whose credentials
+// can be listed, edited and backed up
+type Vault interface {
+	ListCredentials() []identities.CredentialMetadata
+	SetCredentialNickname(id []byte, nickname string) bool
+	SetCredentialPolicy(id []byte, policy identities.CredentialPolicy) bool
+	DeleteIdentity(id []byte) bool
+	ResetVault()
+	ExportVault(passphrase string) ([]byte, error)
+	ImportVault(data []byte, passphrase string) error
+}
+
+// DeviceIdentity is implemented by clients, like fido_client.DefaultFIDOClient, that keep the
+// device's serial number with their credentials. Start persists the identity before attaching
+// the device, so the host sees the same device after a restart.
+type DeviceIdentity interface {
+	SerialNumber() string
+	PersistDeviceIdentity()
+}
+
+type LogLevel = util.LogLevel
+
+const (
+	LogLevelUnsafe  = util.LogLevelUnsafe
+	LogLevelTrace   = util.LogLevelTrace
+	LogLevelDebug   = util.LogLevelDebug
+	LogLevelEnabled = util.LogLevelEnabled
+)
+
+type LogSubsystem = util.LogSubsystem
+
+type LogFormat = util.LogFormat
+
+const (
+	LogFormatText = util.LogFormatText
+	LogFormatJSON = util.LogFormatJSON
+)
+
+type USBSpeed = usb.USBSpeed
+
+type InterruptPolling = usb.InterruptPolling
+
+// DefaultInterruptPolling completes interrupt polls without data after a second and never NAKs
+func DefaultInterruptPolling() InterruptPolling {
+	return usb.DefaultInterruptPolling()
+}
+
+type CTAPTimeouts = ctap.Timeouts
+
+// DefaultCTAPTimeouts are the limits in the CTAP 2.1 spec, used by DefaultOptions
+func DefaultCTAPTimeouts() CTAPTimeouts {
+	return ctap.DefaultTimeouts()
+}
+
+const (
+	USBSpeedFull = usb.USBSpeedFull
+	USBSpeedHigh = usb.USBSpeedHigh
+)
+
+// Options configure a Device. Start from DefaultOptions, since the zero value has no USB
+// packet size or CTAP timeouts.
+type Options struct {
+	// FaultInjector makes the device misbehave as configured on the injector
+	FaultInjector *fault_injection.FaultInjector
+	// SessionRecorder records all CTAPHID traffic for later replay
+	SessionRecorder *ctap_hid.SessionRecorder
+	// USBCapturePath, if set, is a pcapng file USB/IP traffic is written to for Wireshark
+	USBCapturePath string
+	// USBSpeed is the speed the device reports over USB/IP, with the packet size and polling
+	// interval of its interrupt endpoints
+	USBSpeed      USBSpeed
+	USBPacketSize uint16
+	USBInterval   uint8
+	// USBReportID prefixes every FIDO HID report with a report ID, declared in the report
+	// descriptor, for host HID stacks that expect report IDs. 0 sends reports without an ID.
+	// Only supported over USB/IP.
+	USBReportID uint8
+	// InterruptPolling is how the device answers the host polling its interrupt IN endpoint,
+	// e.g. to NAK some polls. Only supported over USB/IP.
+	InterruptPolling InterruptPolling
+	// MaxMessageSize limits CTAP requests, and is advertised as maxMsgSize in GetInfo. Larger
+	// requests are rejected with ERR_INVALID_LEN. 0 allows as much as the HID packet size does.
+	MaxMessageSize uint32
+	// CTAPTimeouts are how long user presence and PIN tokens stay valid and how long requests
+	// wait for the user
+	CTAPTimeouts CTAPTimeouts
+	// Watchdog fails URBs and U2F/CTAP requests that are still being handled after it, e.g.
+	// because an approval callback never returned, and logs what was still running. 0 lets
+	// them run forever.
+	Watchdog time.Duration
+	// ReadOnly refuses new credentials and PIN changes, e.g. for demos or honeypots whose
+	// credentials must not change, while existing credentials can still be used. CTAP2
+	// requests fail with CTAP2_ERR_OPERATION_DENIED.
+	ReadOnly bool
+	// ConformanceMode makes CTAP2 answer exactly as the FIDO Alliance conformance tools
+	// expect, see ctap.CTAPServer.SetConformanceMode
+	ConformanceMode bool
+	// MakeCredUVNotRequired lets MakeCredential create non-resident credentials without the
+	// PIN while alwaysUv is off, see ctap.CTAPServer.SetMakeCredUVNotRequired
+	MakeCredUVNotRequired bool
+	// DeviceAssertionLimit limits CTAP2 assertions and U2F authentications on all CTAPHID
+	// channels together, answering ERR_CHANNEL_BUSY, and RelyingPartyAssertionLimit those
+	// for an RP, answering CTAP2_ERR_USER_ACTION_TIMEOUT or U2F's
+	// SW_CONDITIONS_NOT_SATISFIED. The zero RateLimit doesn't limit.
+	DeviceAssertionLimit       util.RateLimit
+	RelyingPartyAssertionLimit util.RateLimit
+	// Auditor records every assertion attempt, successful or not, e.g. an audit.Log wrapped
+	// in an audit.CanaryAuditor
+	Auditor audit.Auditor
+	// PIV adds a CCID smartcard interface with a PIV applet next to the FIDO interface. The
+	// client must also implement piv.PIVClient. Only supported over USB/IP.
+	PIV bool
+	// OTP adds a HID keyboard interface that types OTP slots when Device.TriggerOTP is
+	// called. The client must also implement otp.OTPClient. Only supported over USB/IP.
+	OTP bool
+}
+
+// DefaultOptions are a full speed device with the CTAP 2.1 spec's timeouts
+func DefaultOptions() Options {
+	return Options{
+		USBSpeed:         usb.USBSpeedFull,
+		USBPacketSize:    64,
+		USBInterval:      255,
+		InterruptPolling: usb.DefaultInterruptPolling(),
+		CTAPTimeouts:     ctap.DefaultTimeouts(),
+	}
+}
+
+// Device is a security key that can be attached to the host, one at a time
+type Device struct {
+	options  Options
+	watchdog *util.Watchdog
+
+	lock sync.Mutex
+	// The USB/IP or usbredir server the device is served by while started
+	server           interface{ Stop() }
+	usbipListener    net.Listener
+	usbredirListener net.Listener
+	otpServer        *otp.OTPServer
+}
+
+// NewDevice creates a device configured by options, which can't be changed afterwards
+func NewDevice(options Options) *Device {
+	device := &Device{options: options}
+	if options.Watchdog != 0 {
+		device.watchdog = util.NewWatchdog(options.Watchdog)
+	}
+	return device
+}
+
+// Start attaches a device with DefaultOptions and blocks forever
+func Start(client Client) {
+	NewDevice(DefaultOptions()).Start(client)
+}
+
+// Start attaches the device and blocks until Stop is called
+func (device *Device) Start(client Client) {
 	// Calls either the Mac or USB/IP client, based on system
-	startClient(client)
+	device.startClient(client)
 }
 
-func SetLogLevel(level util.LogLevel) {
+// StartMultiple attaches a device for each client, e.g. one for each profile of a vault, and
+// blocks until Stop is called. Only supported over USB/IP, and OTP needs a single device.
+func (device *Device) StartMultiple(clients []Client) error {
+	return device.startClients(clients)
+}
+
+// StartTransport attaches a device whose CTAP2 and U2F messages are answered by a key
+// daemon started with ServeKeyDaemon, so this process never holds a key. It blocks until
+// Stop is called. Only supported over USB/IP, without PIV or OTP.
+func (device *Device) StartTransport(network string, address string, secret []byte) error {
+	transport := privsep.NewTransport(network, address, secret)
+	defer transport.Close()
+	err := transport.Connect()
+	if err != nil {
+		return err
+	}
+	return device.startTransport(transport)
+}
+
+// StartProxy attaches a device that forwards every CTAPHID report to the FIDO key at path,
+// a Linux hidraw device like /dev/hidraw3, so the host uses the real key. It blocks until
+// Stop is called. Only supported over USB/IP at full speed, without PIV or OTP, and the
+// traffic isn't recorded or fault injected.
+func (device *Device) StartProxy(path string) error {
+	proxy, err := hidproxy.Open(path)
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+	return device.startProxy(proxy)
+}
+
+// StartRoutedProxy attaches a device that answers the RPs routes sends to software with
+// client, and forwards the messages of every other RP to the FIDO key at path, so accounts
+// can be moved between a physical key and the software store one at a time. It blocks until
+// Stop is called. Only supported over USB/IP, without PIV or OTP.
+func (device *Device) StartRoutedProxy(path string, client Client, routes *hidproxy.Routes) error {
+	key, err := hidproxy.OpenKey(path)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	return device.startRoutedProxy(key, client, routes)
+}
+
+// StartSmartCard puts the PIV applet of client in a pcscd reader through virtualsmartcard's
+// vpcd driver listening at address (usually vpcd.DefaultAddress), without a USB device. It
+// blocks until vpcd disconnects.
+func StartSmartCard(address string, client piv.PIVClient) error {
+	icc, err := vpcd.Dial("tcp", address, piv.NewPIVServer(client))
+	if err != nil {
+		return err
+	}
+	defer icc.Close()
+	return icc.Serve()
+}
+
+// ServeKeyDaemon answers the devices started with StartTransport that connect to listener
+// and know secret, until the listener is closed. Only the CTAP2 and U2F options apply.
+func (device *Device) ServeKeyDaemon(listener net.Listener, client Client, secret []byte) error {
+	ctapServer, u2fServer := device.newClientServers(client)
+	// The transport's packet size isn't known, so assume the smallest
+	size := ctap_hid.MaxMessageSize
+	if device.options.MaxMessageSize != 0 && device.options.MaxMessageSize < size {
+		size = device.options.MaxMessageSize
+	}
+	ctapServer.SetTransport(size, "usb")
+	return privsep.NewKeyDaemon(ctapServer, u2fServer, secret).Serve(listener)
+}
+
+func (device *Device) newClientServers(client Client) (*ctap.CTAPServer, *u2f.U2FServer) {
+	options := device.options
+	ctapServer := ctap.NewCTAPServer(client)
+	u2fServer := u2f.NewU2FServer(client)
+	ctapServer.SetFaultInjector(options.FaultInjector)
+	ctapServer.SetTimeouts(options.CTAPTimeouts)
+	u2fServer.SetFaultInjector(options.FaultInjector)
+	ctapServer.SetReadOnly(options.ReadOnly)
+	ctapServer.SetConformanceMode(options.ConformanceMode)
+	ctapServer.SetMakeCredUVNotRequired(options.MakeCredUVNotRequired)
+	ctapServer.SetAssertionRateLimit(options.RelyingPartyAssertionLimit)
+	u2fServer.SetAuthenticationRateLimit(options.RelyingPartyAssertionLimit)
+	u2fServer.SetReadOnly(options.ReadOnly)
+	ctapServer.SetAuditor(options.Auditor)
+	u2fServer.SetAuditor(options.Auditor)
+	return ctapServer, u2fServer
+}
+
+func (device *Device) newCTAPHIDServer(ctapServer ctap_hid.CTAPHIDClient, u2fServer ctap_hid.CTAPHIDClient) *ctap_hid.CTAPHIDServer {
+	options := device.options
+	ctapHIDServer := ctap_hid.NewCTAPHIDServer(ctapServer, u2fServer)
+	ctapHIDServer.SetPacketSize(int(options.USBPacketSize))
+	ctapHIDServer.SetMaxMessageSize(options.MaxMessageSize)
+	ctapHIDServer.SetFaultInjector(options.FaultInjector)
+	ctapHIDServer.SetSessionRecorder(options.SessionRecorder)
+	ctapHIDServer.SetWatchdog(device.watchdog)
+	ctapHIDServer.SetAssertionRateLimit(options.DeviceAssertionLimit)
+	workers := util.NewWorkerPool(ctap_hid.DefaultWorkers, ctap_hid.DefaultChannelQueueLength)
+	workers.SetTotalQueueLength(ctap_hid.DefaultTotalQueueLength)
+	ctapHIDServer.SetWorkerPool(workers)
+	return ctapHIDServer
+}
+
+// Stop detaches the device and makes Start return. Only supported over USB/IP.
+func (device *Device) Stop() error {
+	return device.stopClient()
+}
+
+// SetUSBIPListener makes the next Start accept USB/IP connections from listener instead of
+// listening on port 3240, e.g. with a socket from systemd socket activation. Stop closes it,
+// so later Starts listen on the port.
+func (device *Device) SetUSBIPListener(listener net.Listener) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	device.usbipListener = listener
+}
+
+// SetUSBRedirListener makes the next Start serve the device over usbredir on listener instead
+// of over USB/IP, for QEMU's usb-redir device and SPICE clients. Only a single device is
+// supported, on Linux and Windows.
+func (device *Device) SetUSBRedirListener(listener net.Listener) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	device.usbredirListener = listener
+}
+
+// TriggerOTP types the password of an OTP slot, like touching a YubiKey
+func (device *Device) TriggerOTP(slot int) error {
+	device.lock.Lock()
+	otpServer := device.otpServer
+	device.lock.Unlock()
+	if otpServer == nil {
+		return fmt.Errorf("OTP keyboard is not enabled")
+	}
+	return otpServer.Trigger(slot)
+}
+
+// SubscribeEvents delivers device events, like credentials being created, to the returned
+// subscription until it's unsubscribed. Events are dropped while its buffer is full.
+func SubscribeEvents(buffer int) *events.Subscription {
+	return events.Subscribe(buffer)
+}
+
+// CollectStats counts registrations, assertions and PIN failures, in all and by RP ID, on
+// top of previous until the collector is stopped. The counts are only kept in memory.
+func CollectStats(previous stats.Stats) *stats.Collector {
+	return stats.NewCollector(events.DefaultBus, previous)
+}
+
+func SetLogLevel(level LogLevel) {
 	util.SetLogLevel(level)
 }
 
+// SetSubsystemLogLevel overrides the global log level for a single subsystem,
+// e.g. to silence HID traffic while still debugging CTAP
+func SetSubsystemLogLevel(subsystem LogSubsystem, level LogLevel) {
+	util.SetSubsystemLogLevel(subsystem, level)
+}
+
 func SetLogOutput(out io.Writer) {
 	util.SetLogOutput(out)
 }
+
+func SetLogFormat(format LogFormat) {
+	util.SetLogFormat(format)
+}
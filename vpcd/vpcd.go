@@ -0,0 +1,127 @@
+// Package vpcd puts a card in a reader of pcscd through the vpcd driver of virtualsmartcard
+// (https://frankmorgner.github.io/vsmartcard/virtualsmartcard/README.html), so PC/SC
+// applications like the OpenSC tools use it without a USB device. The card is the virtual
+// ICC of the vpcd protocol: it connects to vpcd, which sends power and ATR requests and
+// command APDUs, each prefixed with its two byte big-endian length.
+package vpcd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/usb"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+var vpcdLogger = util.NewLogger("[VPCD] ", util.LogSubsystemVPCD, util.LogLevelDebug)
+
+// DefaultAddress is where vpcd listens for the card of its first reader
+const DefaultAddress = "localhost:35963"
+
+// Control messages are a single byte, which APDUs never are
+const (
+	vpcdPowerOff byte = 0x00
+	vpcdPowerOn  byte = 0x01
+	vpcdReset    byte = 0x02
+	vpcdGetATR   byte = 0x04
+)
+
+// ICC answers vpcd for card
+type ICC struct {
+	conn      net.Conn
+	card      usb.CCIDCard
+	atr       []byte
+	closeOnce sync.Once
+}
+
+// Dial connects card to vpcd at address
+func Dial(network string, address string, card usb.CCIDCard) (*ICC, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to vpcd: %w", err)
+	}
+	vpcdLogger.Printf("Connected to vpcd at %s\n\n", address)
+	return NewICC(conn, card), nil
+}
+
+func NewICC(conn net.Conn, card usb.CCIDCard) *ICC {
+	return &ICC{conn: conn, card: card}
+}
+
+// Serve answers vpcd until the connection is closed, e.g. when pcscd stops
+func (icc *ICC) Serve() error {
+	for {
+		request, err := icc.readMessage()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("Could not read from vpcd: %w", err)
+		}
+		response := icc.handleMessage(request)
+		if response == nil {
+			continue
+		}
+		if err := icc.writeMessage(response); err != nil {
+			return fmt.Errorf("Could not write to vpcd: %w", err)
+		}
+	}
+}
+
+func (icc *ICC) handleMessage(request []byte) []byte {
+	if len(request) != 1 {
+		vpcdLogger.Printf("APDU: %x\n\n", request)
+		response := icc.card.HandleAPDU(request)
+		vpcdLogger.Printf("RESPONSE: %x\n\n", response)
+		return response
+	}
+	switch request[0] {
+	case vpcdPowerOff:
+		vpcdLogger.Printf("Power off\n\n")
+		icc.atr = nil
+	case vpcdPowerOn, vpcdReset:
+		vpcdLogger.Printf("Power on\n\n")
+		icc.atr = icc.card.ATR()
+	case vpcdGetATR:
+		// vpcd also asks for the ATR to check the card is present, which mustn't reset it
+		if icc.atr == nil {
+			icc.atr = icc.card.ATR()
+		}
+		return icc.atr
+	default:
+		vpcdLogger.Printf("ERROR: Unknown control message 0x%x\n\n", request[0])
+	}
+	return nil
+}
+
+func (icc *ICC) readMessage() ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(icc.conn, length); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(icc.conn, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (icc *ICC) writeMessage(message []byte) error {
+	if len(message) > 0xFFFF {
+		return fmt.Errorf("%d byte response is too long", len(message))
+	}
+	_, err := icc.conn.Write(util.Concat(util.ToBE(uint16(len(message))), message))
+	return err
+}
+
+// Close disconnects from vpcd, which removes the card from its reader
+func (icc *ICC) Close() error {
+	var err error
+	icc.closeOnce.Do(func() {
+		err = icc.conn.Close()
+	})
+	return err
+}
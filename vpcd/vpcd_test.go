@@ -0,0 +1,68 @@
+package vpcd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/internal/test"
+)
+
+// countingCard answers every APDU with success and counts power ons
+type countingCard struct {
+	powerOns int
+}
+
+func (card *countingCard) ATR() []byte {
+	card.powerOns++
+	return []byte{0x3B, 0x80, 0x80, 0x01, 0x01}
+}
+
+func (card *countingCard) HandleAPDU(command []byte) []byte {
+	return append(append([]byte{}, command[1:2]...), 0x90, 0x00)
+}
+
+func send(t *testing.T, conn net.Conn, message []byte) {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(message)))
+	_, err := conn.Write(append(length, message...))
+	test.Assert(t, err == nil, "Could not send message")
+}
+
+func receive(t *testing.T, conn net.Conn) []byte {
+	length := make([]byte, 2)
+	_, err := io.ReadFull(conn, length)
+	test.Assert(t, err == nil, "Could not read length")
+	message := make([]byte, binary.BigEndian.Uint16(length))
+	_, err = io.ReadFull(conn, message)
+	test.Assert(t, err == nil, "Could not read message")
+	return message
+}
+
+func TestICC(t *testing.T) {
+	vpcd, conn := net.Pipe()
+	card := &countingCard{}
+	icc := NewICC(conn, card)
+	done := make(chan error)
+	go func() { done <- icc.Serve() }()
+
+	send(t, vpcd, []byte{vpcdPowerOn})
+	send(t, vpcd, []byte{vpcdGetATR})
+	test.AssertArrEqual(t, receive(t, vpcd), []byte{0x3B, 0x80, 0x80, 0x01, 0x01}, "ATR should be sent")
+	// vpcd polls the ATR to check the card is present
+	send(t, vpcd, []byte{vpcdGetATR})
+	receive(t, vpcd)
+	test.AssertEqual(t, card.powerOns, 1, "Getting the ATR should not reset the card")
+
+	send(t, vpcd, []byte{0x00, 0xA4, 0x04, 0x00})
+	test.AssertArrEqual(t, receive(t, vpcd), []byte{0xA4, 0x90, 0x00}, "APDUs should be answered by the card")
+
+	send(t, vpcd, []byte{vpcdReset})
+	send(t, vpcd, []byte{vpcdGetATR})
+	receive(t, vpcd)
+	test.AssertEqual(t, card.powerOns, 2, "Reset should reset the card")
+
+	vpcd.Close()
+	test.Assert(t, <-done == nil, "Serve should stop when vpcd disconnects")
+}
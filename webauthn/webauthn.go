@@ -1,15 +1,23 @@
 package webauthn
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"encoding/hex"
+	"errors"
 	"fmt"
 
 	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
 )
 
 type PublicKeyCredentialRPEntity struct {
 	ID   string `cbor:"id" json:"id"`
 	Name string `cbor:"name" json:"name"`
+	// URL of an image for the RP, usually a data: URL, from CTAP 2.0 clients
+	Icon string `cbor:"icon,omitempty" json:"icon,omitempty"`
 }
 
 func (rp PublicKeyCredentialRPEntity) String() string {
@@ -21,6 +29,8 @@ type PublicKeyCrendentialUserEntity struct {
 	ID          []byte `cbor:"id" json:"id"`
 	DisplayName string `cbor:"displayName" json:"display_name"`
 	Name        string `cbor:"name" json:"name"`
+	// URL of an image for the user account, usually a data: URL, from CTAP 2.0 clients
+	Icon string `cbor:"icon,omitempty" json:"icon,omitempty"`
 }
 
 func (user PublicKeyCrendentialUserEntity) String() string {
@@ -43,5 +53,89 @@ type PublicKeyCredentialParams struct {
 
 type KeyHandle struct {
 	PrivateKey    []byte `cbor:"1,keyasint"`
-	ApplicationID []byte `cbor:"2,keyasint"`
+	ApplicationID []byte `cbor:"2,keyasint,omitempty"`
+}
+
+// MaxKeyHandleLength is the longest key handle U2F can carry, as its length is one byte
+const MaxKeyHandleLength = 255
+
+var ErrKeyHandleTooLong = errors.New("Sealed key handle is longer than U2F allows")
+
+const (
+	keyHandleEncryptionLabel = "virtual-fido key handle encryption"
+	keyHandleCommitmentLabel = "virtual-fido key handle commitment"
+)
+
+// sealedKeyHandle is the key handle given to the RP. Key handles sealed before key
+// commitment have no Commitment, and keep the application ID in the encrypted data instead
+// of in the associated data.
+type sealedKeyHandle struct {
+	Data       []byte `cbor:"1,keyasint"`
+	IV         []byte `cbor:"2,keyasint"`
+	Commitment []byte `cbor:"3,keyasint,omitempty"`
+}
+
+// keyHandleCommitment commits to the sealing key, so a key handle can't be made to open under
+// two different keys, as AES-GCM alone allows. The nonce keeps it different for every key handle.
+func keyHandleCommitment(encryptionKey []byte, nonce []byte) []byte {
+	return crypto.HMACSHA256(encryptionKey, util.Concat([]byte(keyHandleCommitmentLabel), nonce))
+}
+
+// SealKeyHandle encrypts a key handle so it can be given to the RP instead of being stored.
+// The application ID is bound as associated data, so the key handle only opens for it.
+// Returns ErrKeyHandleTooLong if it's longer than MaxKeyHandleLength, e.g. with a crypto
+// provider whose nonces are large.
+func SealKeyHandle(encryptionKey []byte, keyHandle *KeyHandle) ([]byte, error) {
+	encrypted := KeyHandle{PrivateKey: keyHandle.PrivateKey}
+	data, nonce, err := crypto.EncryptWithAssociatedData(crypto.HMACSHA256(encryptionKey, []byte(keyHandleEncryptionLabel)), util.MarshalCBOR(encrypted), keyHandle.ApplicationID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not seal key handle: %w", err)
+	}
+	box := util.MarshalCBOR(sealedKeyHandle{Data: data, IV: nonce, Commitment: keyHandleCommitment(encryptionKey, nonce)})
+	if len(box) > MaxKeyHandleLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrKeyHandleTooLong, len(box))
+	}
+	return box, nil
+}
+
+// OpenKeyHandle opens a key handle sealed for applicationID, in either format
+func OpenKeyHandle(encryptionKey []byte, applicationID []byte, boxBytes []byte) (*KeyHandle, error) {
+	var box sealedKeyHandle
+	err := cbor.Unmarshal(boxBytes, &box)
+	if err != nil {
+		return nil, err
+	}
+	if box.Commitment == nil {
+		return openLegacyKeyHandle(encryptionKey, applicationID, box)
+	}
+	if !hmac.Equal(box.Commitment, keyHandleCommitment(encryptionKey, box.IV)) {
+		return nil, fmt.Errorf("Key handle was not sealed with this key")
+	}
+	data, err := crypto.DecryptWithAssociatedData(crypto.HMACSHA256(encryptionKey, []byte(keyHandleEncryptionLabel)), box.Data, box.IV, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	var keyHandle KeyHandle
+	err = cbor.Unmarshal(data, &keyHandle)
+	if err != nil {
+		return nil, err
+	}
+	keyHandle.ApplicationID = applicationID
+	return &keyHandle, nil
+}
+
+func openLegacyKeyHandle(encryptionKey []byte, applicationID []byte, box sealedKeyHandle) (*KeyHandle, error) {
+	data, err := crypto.Decrypt(encryptionKey, box.Data, box.IV)
+	if err != nil {
+		return nil, err
+	}
+	var keyHandle KeyHandle
+	err = cbor.Unmarshal(data, &keyHandle)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(keyHandle.ApplicationID, applicationID) {
+		return nil, fmt.Errorf("Key handle is for another application")
+	}
+	return &keyHandle, nil
 }